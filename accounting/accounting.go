@@ -0,0 +1,219 @@
+// package accounting keeps rolling totals of the bytes transferred per key,
+// like destination domains on clients and downstream clients on servers.
+// Totals are kept per day in the configDir, so that they survive restarts and
+// can be rolled up over the last day, week and month, for users on metered
+// connections and for quotas.
+package accounting
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/store"
+)
+
+const (
+	DEFAULT_DAYS     = 31              // number of days of totals to keep, enough for a month
+	MAX_KEYS_PER_DAY = 10000           // number of keys to track per day, beyond which bytes are accounted to OTHER
+	OTHER            = "(other)"       // key for bytes beyond MAX_KEYS_PER_DAY
+	SAVE_INTERVAL    = 1 * time.Minute // how frequently totals are saved to the Store
+	WEEK             = 7               // days in Total.Week
+	MONTH            = 30              // days in Total.Month
+	dayFormat        = "2006-01-02"    // sorts like the days it formats
+)
+
+// Total is the bytes transferred for one key
+type Total struct {
+	Key   string `json:"key"`
+	Today int64  `json:"today"`
+	Week  int64  `json:"week"`  // the last WEEK days, including today
+	Month int64  `json:"month"` // the last MONTH days, including today
+}
+
+// Ledger accumulates the bytes transferred per key and (local) day
+type Ledger struct {
+	Name  string       // name of the totals in Store
+	Store *store.Store // (optional) where totals are kept across restarts
+	Days  int          // (optional) number of days to keep, defaults to DEFAULT_DAYS
+
+	days  map[string]map[string]int64 // day -> key -> bytes
+	dirty bool
+	mutex sync.Mutex
+}
+
+// Start loads the totals from the Store and starts saving them every
+// SAVE_INTERVAL in the background
+func (ledger *Ledger) Start() {
+	if ledger.Days <= 0 {
+		ledger.Days = DEFAULT_DAYS
+	}
+	if ledger.Store == nil {
+		return
+	}
+	var days map[string]map[string]int64
+	err := ledger.Store.Load(ledger.Name, &days)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to load %s, starting afresh: %s", ledger.Name, err)
+	}
+	ledger.mutex.Lock()
+	for day, keys := range days {
+		for key, bytes := range keys {
+			ledger.addLocked(day, key, bytes)
+		}
+	}
+	ledger.mutex.Unlock()
+	go func() {
+		defer crash.Recover()
+		for {
+			time.Sleep(SAVE_INTERVAL)
+			if err := ledger.Save(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// Add accounts the given bytes to the given key for today.  It is safe to call
+// on a nil Ledger, in which case it does nothing.
+func (ledger *Ledger) Add(key string, bytes int64) {
+	if ledger == nil || bytes <= 0 {
+		return
+	}
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	ledger.addLocked(time.Now().Format(dayFormat), key, bytes)
+}
+
+func (ledger *Ledger) addLocked(day string, key string, bytes int64) {
+	if ledger.days == nil {
+		ledger.days = make(map[string]map[string]int64)
+	}
+	keys := ledger.days[day]
+	if keys == nil {
+		keys = make(map[string]int64)
+		ledger.days[day] = keys
+		ledger.trimLocked(time.Now())
+	}
+	if _, found := keys[key]; !found && len(keys) >= MAX_KEYS_PER_DAY {
+		key = OTHER
+	}
+	keys[key] += bytes
+	ledger.dirty = true
+}
+
+// trimLocked drops the days that are more than Days before now
+func (ledger *Ledger) trimLocked(now time.Time) {
+	days := ledger.Days
+	if days <= 0 {
+		days = DEFAULT_DAYS
+	}
+	cutoff := now.AddDate(0, 0, -(days - 1)).Format(dayFormat)
+	for day := range ledger.days {
+		if day < cutoff {
+			delete(ledger.days, day)
+		}
+	}
+}
+
+// Save saves the totals to the Store, if they changed since they were last
+// saved
+func (ledger *Ledger) Save() error {
+	if ledger == nil || ledger.Store == nil {
+		return nil
+	}
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	if !ledger.dirty {
+		return nil
+	}
+	if err := ledger.Store.Save(ledger.Name, ledger.days); err != nil {
+		return fmt.Errorf("Unable to save %s: %s", ledger.Name, err)
+	}
+	ledger.dirty = false
+	return nil
+}
+
+// Totals returns the totals per key, the ones with the most bytes this month
+// first, up to max of them (all if max is 0).  It is safe to call on a nil
+// Ledger.
+func (ledger *Ledger) Totals(max int) []*Total {
+	if ledger == nil {
+		return nil
+	}
+	return ledger.totalsAsOf(time.Now(), max)
+}
+
+func (ledger *Ledger) totalsAsOf(now time.Time, max int) []*Total {
+	today := now.Format(dayFormat)
+	weekStart := now.AddDate(0, 0, -(WEEK - 1)).Format(dayFormat)
+	monthStart := now.AddDate(0, 0, -(MONTH - 1)).Format(dayFormat)
+
+	ledger.mutex.Lock()
+	byKey := make(map[string]*Total)
+	for day, keys := range ledger.days {
+		if day < monthStart || day > today {
+			continue
+		}
+		for key, bytes := range keys {
+			total := byKey[key]
+			if total == nil {
+				total = &Total{Key: key}
+				byKey[key] = total
+			}
+			total.Month += bytes
+			if day >= weekStart {
+				total.Week += bytes
+			}
+			if day == today {
+				total.Today += bytes
+			}
+		}
+	}
+	ledger.mutex.Unlock()
+
+	totals := make(byMonth, 0, len(byKey))
+	for _, total := range byKey {
+		totals = append(totals, total)
+	}
+	sort.Sort(totals)
+	if max > 0 && len(totals) > max {
+		totals = totals[:max]
+	}
+	return totals
+}
+
+// Total returns the bytes accounted to the given key over the last days days,
+// including today, e.g. for enforcing quotas.  It is safe to call on a nil
+// Ledger.
+func (ledger *Ledger) Total(key string, days int) int64 {
+	if ledger == nil {
+		return 0
+	}
+	start := time.Now().AddDate(0, 0, -(days - 1)).Format(dayFormat)
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	total := int64(0)
+	for day, keys := range ledger.days {
+		if day >= start {
+			total += keys[key]
+		}
+	}
+	return total
+}
+
+// byMonth sorts Totals by descending bytes this month, then by key
+type byMonth []*Total
+
+func (a byMonth) Len() int      { return len(a) }
+func (a byMonth) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byMonth) Less(i, j int) bool {
+	if a[i].Month != a[j].Month {
+		return a[i].Month > a[j].Month
+	}
+	return a[i].Key < a[j].Key
+}
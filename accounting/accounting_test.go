@@ -0,0 +1,65 @@
+package accounting
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/store"
+)
+
+func TestTotals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.New(dir, "")
+	if err != nil {
+		t.Fatalf("Unable to create store: %s", err)
+	}
+
+	now := time.Now()
+	day := func(daysAgo int) string {
+		return now.AddDate(0, 0, -daysAgo).Format(dayFormat)
+	}
+	ledger := &Ledger{Name: "bandwidth", Store: s}
+	ledger.Add("example.com", 100)
+	ledger.mutex.Lock()
+	ledger.addLocked(day(3), "example.com", 10)
+	ledger.addLocked(day(10), "example.com", 1)
+	ledger.addLocked(day(10), "example.org", 1000)
+	ledger.addLocked(day(40), "example.org", 5000)
+	ledger.mutex.Unlock()
+	if err := ledger.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Totals survive restarts, except for days that are too old
+	loaded := &Ledger{Name: "bandwidth", Store: s}
+	loaded.Start()
+	totals := loaded.totalsAsOf(now, 0)
+	if len(totals) != 2 {
+		t.Fatalf("Expected 2 totals, got %d", len(totals))
+	}
+	org, com := totals[0], totals[1]
+	if org.Key != "example.org" || org.Month != 1000 || org.Week != 0 || org.Today != 0 {
+		t.Errorf("Unexpected total for example.org: %+v", org)
+	}
+	if com.Key != "example.com" || com.Month != 111 || com.Week != 110 || com.Today != 100 {
+		t.Errorf("Unexpected total for example.com: %+v", com)
+	}
+	if total := loaded.Total("example.com", WEEK); total != 110 {
+		t.Errorf("Expected 110 bytes this week, got %d", total)
+	}
+	if top := loaded.totalsAsOf(now, 1); len(top) != 1 || top[0].Key != "example.org" {
+		t.Errorf("Expected only the top total")
+	}
+
+	var none *Ledger
+	none.Add("example.com", 1)
+	if none.Totals(0) != nil || none.Total("example.com", 1) != 0 {
+		t.Errorf("Nil ledger should have no totals")
+	}
+}
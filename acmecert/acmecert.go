@@ -0,0 +1,388 @@
+// package acmecert obtains a publicly trusted certificate for a server's
+// hostname from an ACME CA (Let's Encrypt by default) and renews it before it
+// expires, so that fronts that verify origin certificates (like CloudFlare in
+// Full (strict) mode) can reach the server.
+//
+// The CA checks that we control the hostname with one of two challenges:
+//
+//	http-01: the CA fetches a token from http://<host>/.well-known/acme-challenge/,
+//	         which we answer at HTTPAddr while obtaining a certificate
+//	dns-01:  the CA looks up a TXT record at _acme-challenge.<host>, which we
+//	         set with a ddns.TXTProvider
+//
+// The certificate, its key and our ACME account's key are kept in files, so
+// that restarts reuse the certificate rather than running into the CA's rate
+// limits.
+package acmecert
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/ddns"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	HTTP_01 = "http-01"
+	DNS_01  = "dns-01"
+
+	DEFAULT_DIRECTORY_URL   = acme.LetsEncryptURL
+	DEFAULT_HTTP_ADDR       = ":80"
+	DEFAULT_RENEW_BEFORE    = 30 * 24 * time.Hour
+	DEFAULT_DNS_PROPAGATION = 1 * time.Minute
+	CHECK_INTERVAL          = 12 * time.Hour // how often we check whether to renew (and retry failed renewals)
+	OBTAIN_TIMEOUT          = 10 * time.Minute
+
+	challengePathPrefix = "/.well-known/acme-challenge/"
+)
+
+// Manager obtains and renews the certificate for Host
+type Manager struct {
+	Host           string           // FQDN for which to obtain the certificate
+	Challenge      string           // HTTP_01 or DNS_01
+	CertFile       string           // where to keep the certificate chain (PEM)
+	KeyFile        string           // where to keep the certificate's private key (PEM)
+	AccountKeyFile string           // where to keep our ACME account's private key (PEM)
+	Email          string           // (optional) contact to which the CA sends expiry notices
+	DirectoryURL   string           // (optional) the CA's ACME directory, defaults to DEFAULT_DIRECTORY_URL (Let's Encrypt)
+	HTTPAddr       string           // (optional) address at which to answer http-01 challenges, defaults to DEFAULT_HTTP_ADDR
+	DNS            ddns.TXTProvider // (dns-01 only) sets the TXT records that answer dns-01 challenges
+	DNSPropagation time.Duration    // (optional) how long to wait for TXT records to propagate, defaults to DEFAULT_DNS_PROPAGATION
+	RenewBefore    time.Duration    // (optional) how long before it expires to renew the certificate, defaults to DEFAULT_RENEW_BEFORE
+
+	cert   *tls.Certificate
+	tokens map[string]string // http-01 responses by path
+	mutex  sync.RWMutex
+}
+
+// Start loads the certificate kept in CertFile, obtaining a new one if it's
+// missing or due for renewal, and keeps it renewed in the background.  It
+// fails if there's no certificate to serve, i.e. if obtaining one fails and
+// the one kept isn't valid anymore.
+func (manager *Manager) Start() error {
+	if manager.RenewBefore <= 0 {
+		manager.RenewBefore = DEFAULT_RENEW_BEFORE
+	}
+	if err := manager.load(); err != nil {
+		log.Debugf("Not using kept certificate: %s", err)
+	}
+	if manager.needsRenewal() {
+		if err := manager.obtain(); err != nil {
+			leaf := manager.Certificate()
+			if leaf == nil || time.Now().After(leaf.NotAfter) {
+				return err
+			}
+			log.Errorf("Unable to renew certificate for %s, using the one that expires %s: %s", manager.Host, leaf.NotAfter.Format(time.RFC3339), err)
+		}
+	}
+	go manager.keepRenewed()
+	return nil
+}
+
+// GetCertificate returns our certificate, for use as a tls.Config's
+// GetCertificate
+func (manager *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	if manager.cert == nil {
+		return nil, fmt.Errorf("No certificate for %s yet", manager.Host)
+	}
+	return manager.cert, nil
+}
+
+// Certificate returns our current certificate, if any.  It is safe to call on
+// a nil Manager, in which case it returns nil.
+func (manager *Manager) Certificate() *x509.Certificate {
+	if manager == nil {
+		return nil
+	}
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	if manager.cert == nil {
+		return nil
+	}
+	return manager.cert.Leaf
+}
+
+// keepRenewed renews the certificate once it's due, checking every
+// CHECK_INTERVAL
+func (manager *Manager) keepRenewed() {
+	defer crash.Recover()
+	for {
+		time.Sleep(CHECK_INTERVAL)
+		if !manager.needsRenewal() {
+			continue
+		}
+		if err := manager.obtain(); err != nil {
+			log.Errorf("Unable to renew certificate for %s: %s", manager.Host, err)
+		}
+	}
+}
+
+// needsRenewal indicates whether we lack a certificate or it expires within
+// RenewBefore
+func (manager *Manager) needsRenewal() bool {
+	leaf := manager.Certificate()
+	return leaf == nil || leaf.NotAfter.Sub(time.Now()) < manager.RenewBefore
+}
+
+// load loads the certificate kept in CertFile and KeyFile, if it's for Host
+func (manager *Manager) load() error {
+	cert, err := tls.LoadX509KeyPair(manager.CertFile, manager.KeyFile)
+	if err != nil {
+		return err
+	}
+	return manager.use(&cert)
+}
+
+// use starts serving the given certificate, if it's for Host
+func (manager *Manager) use(cert *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Unable to parse certificate: %s", err)
+	}
+	if err := leaf.VerifyHostname(manager.Host); err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	manager.mutex.Lock()
+	manager.cert = cert
+	manager.mutex.Unlock()
+	return nil
+}
+
+// obtain obtains a new certificate from the CA, saves it and starts serving it
+func (manager *Manager) obtain() error {
+	directoryURL := manager.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = DEFAULT_DIRECTORY_URL
+	}
+	log.Debugf("Obtaining certificate for %s from %s with %s challenge", manager.Host, directoryURL, manager.Challenge)
+	accountKey, err := loadOrCreateKey(manager.AccountKeyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load ACME account key: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), OBTAIN_TIMEOUT)
+	defer cancel()
+	client := &acme.Client{Key: accountKey, DirectoryURL: directoryURL, UserAgent: "flashlight"}
+	account := &acme.Account{}
+	if manager.Email != "" {
+		account.Contact = []string{"mailto:" + manager.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("Unable to register with ACME CA: %s", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(manager.Host))
+	if err != nil {
+		return fmt.Errorf("Unable to order certificate: %s", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := manager.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("Certificate order failed: %s", err)
+	}
+
+	// Renewals keep the key, so that clients that pin it (see package
+	// identity) keep trusting us
+	key, err := loadOrCreateKey(manager.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load or generate key: %s", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: manager.Host},
+		DNSNames: []string{manager.Host},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("Unable to create certificate request: %s", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("Unable to finalize certificate order: %s", err)
+	}
+	return manager.save(chain, key)
+}
+
+// authorize proves to the CA that we control Host, unless we already have
+func (manager *Manager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("Unable to get authorization: %s", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == manager.Challenge {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("CA doesn't offer %s challenges for %s", manager.Challenge, manager.Host)
+	}
+	cleanup, err := manager.prepare(client, challenge)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("Unable to accept %s challenge: %s", challenge.Type, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s challenge for %s failed: %s", challenge.Type, manager.Host, err)
+	}
+	return nil
+}
+
+// prepare gets ready to answer the given challenge, returning a function that
+// cleans up after it
+func (manager *Manager) prepare(client *acme.Client, challenge *acme.Challenge) (func(), error) {
+	switch manager.Challenge {
+	case HTTP_01:
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to prepare http-01 response: %s", err)
+		}
+		return manager.answerHTTP01(client.HTTP01ChallengePath(challenge.Token), response)
+	case DNS_01:
+		record, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to prepare dns-01 record: %s", err)
+		}
+		name := "_acme-challenge." + manager.Host
+		if err := manager.DNS.SetTXT(name, record); err != nil {
+			return nil, fmt.Errorf("Unable to set TXT record %s: %s", name, err)
+		}
+		propagation := manager.DNSPropagation
+		if propagation <= 0 {
+			propagation = DEFAULT_DNS_PROPAGATION
+		}
+		log.Debugf("Set TXT record %s, waiting %v for it to propagate", name, propagation)
+		time.Sleep(propagation)
+		return func() {
+			if err := manager.DNS.ClearTXT(name, record); err != nil {
+				log.Errorf("Unable to clear TXT record %s: %s", name, err)
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported challenge %s", manager.Challenge)
+	}
+}
+
+// answerHTTP01 answers http-01 challenges at HTTPAddr, with the given
+// response at the given path, until cleaned up
+func (manager *Manager) answerHTTP01(path string, response string) (func(), error) {
+	addr := manager.HTTPAddr
+	if addr == "" {
+		addr = DEFAULT_HTTP_ADDR
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for http-01 challenges at %s: %s", addr, err)
+	}
+	manager.mutex.Lock()
+	manager.tokens = map[string]string{path: response}
+	manager.mutex.Unlock()
+	go http.Serve(l, http.HandlerFunc(manager.serveChallenge))
+	return func() {
+		l.Close()
+		manager.mutex.Lock()
+		manager.tokens = nil
+		manager.mutex.Unlock()
+	}, nil
+}
+
+// serveChallenge answers the http-01 challenges that we're expecting
+func (manager *Manager) serveChallenge(resp http.ResponseWriter, req *http.Request) {
+	manager.mutex.RLock()
+	response, found := manager.tokens[req.URL.Path]
+	manager.mutex.RUnlock()
+	if !found || !strings.HasPrefix(req.URL.Path, challengePathPrefix) {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(response))
+}
+
+// save writes the given chain and key to CertFile and KeyFile and starts
+// serving them
+func (manager *Manager) save(chain [][]byte, key crypto.Signer) error {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	if err != nil {
+		return fmt.Errorf("Unable to encode key: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("CA returned an unusable certificate: %s", err)
+	}
+	if err := manager.use(&cert); err != nil {
+		return fmt.Errorf("CA returned an unusable certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(manager.KeyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("Unable to save key: %s", err)
+	}
+	if err := ioutil.WriteFile(manager.CertFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("Unable to save certificate: %s", err)
+	}
+	log.Debugf("Obtained certificate for %s, expiring %s", manager.Host, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// loadOrCreateKey loads the ECDSA key at path, generating and saving one if
+// there isn't one
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not PEM", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
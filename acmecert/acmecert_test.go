@@ -0,0 +1,94 @@
+package acmecert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmecert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := &Manager{
+		Host:           "fl1.example.org",
+		Challenge:      HTTP_01,
+		CertFile:       filepath.Join(dir, "cert.pem"),
+		KeyFile:        filepath.Join(dir, "key.pem"),
+		AccountKeyFile: filepath.Join(dir, "account.pem"),
+		DirectoryURL:   "http://127.0.0.1:1/directory",
+		HTTPAddr:       "127.0.0.1:0",
+	}
+	writeCert := func(host string, notAfter time.Time) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{host}, NotBefore: notAfter.Add(-90 * 24 * time.Hour), NotAfter: notAfter}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.save([][]byte{der}, key); err != nil && host == manager.Host {
+			t.Fatal(err)
+		}
+		manager.cert = nil
+	}
+
+	// Without a certificate, we need the CA, which is unreachable
+	if err := manager.Start(); err == nil {
+		t.Fatalf("Start should fail without a certificate")
+	}
+	if _, err := os.Stat(manager.AccountKeyFile); err != nil {
+		t.Errorf("Account key should have been created: %s", err)
+	}
+
+	// A kept certificate that's not due for renewal is used without
+	// contacting the CA
+	writeCert(manager.Host, time.Now().Add(60*24*time.Hour))
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Unable to start with kept certificate: %s", err)
+	}
+	cert, err := manager.GetCertificate(nil)
+	if err != nil || cert.Leaf.DNSNames[0] != manager.Host {
+		t.Errorf("Wrong certificate: %v, %v", cert, err)
+	}
+
+	// One that's due is still used if renewing fails
+	writeCert(manager.Host, time.Now().Add(24*time.Hour))
+	if err := manager.Start(); err != nil || manager.Certificate() == nil {
+		t.Errorf("Kept certificate should be used while renewal fails: %s", err)
+	}
+
+	// One for another host isn't
+	manager.CertFile = filepath.Join(dir, "othercert.pem")
+	writeCert("other.example.org", time.Now().Add(60*24*time.Hour))
+	if err := manager.load(); err == nil {
+		t.Errorf("Certificate for another host shouldn't be used")
+	}
+}
+
+func TestServeChallenge(t *testing.T) {
+	manager := &Manager{}
+	manager.tokens = map[string]string{challengePathPrefix + "token": "token.thumbprint"}
+	for path, expected := range map[string]int{
+		challengePathPrefix + "token": http.StatusOK,
+		challengePathPrefix + "other": http.StatusNotFound,
+		"/":                           http.StatusNotFound,
+	} {
+		req, _ := http.NewRequest("GET", "http://fl1.example.org"+path, nil)
+		resp := httptest.NewRecorder()
+		manager.serveChallenge(resp, req)
+		if resp.Code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, path, resp.Code)
+		}
+	}
+}
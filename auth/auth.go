@@ -0,0 +1,97 @@
+// package auth lets a server accept only clients that know a shared secret
+// token, which they carry in the X-Lantern-Auth header of their requests.
+//
+// Requests without the token are shown a Decoy instead, so that anyone who
+// probes the server sees an ordinary web server rather than a proxy.  The
+// Decoy is either a generic 404 page (by default), a page of our own (also
+// served as a 404) or a whole site that we reverse proxy.
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+const (
+	X_LANTERN_AUTH = "X-Lantern-Auth" // header carrying the token
+
+	// NOT_FOUND_PAGE is the default Decoy, the 404 page of a stock nginx
+	NOT_FOUND_PAGE = `<html>
+<head><title>404 Not Found</title></head>
+<body>
+<center><h1>404 Not Found</h1></center>
+<hr><center>nginx</center>
+</body>
+</html>
+`
+)
+
+// Authorized indicates whether the given request carries the given token,
+// which mustn't be empty
+func Authorized(req *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get(X_LANTERN_AUTH)), []byte(token)) == 1
+}
+
+// Strip removes the token from the given request, so that it doesn't go any
+// further
+func Strip(req *http.Request) {
+	req.Header.Del(X_LANTERN_AUTH)
+}
+
+// Decoy is what requests that don't carry the token are shown
+type Decoy struct {
+	page  []byte
+	proxy *httputil.ReverseProxy
+}
+
+// NewDecoy creates the Decoy specified by the given spec, which is either
+// empty (for NOT_FOUND_PAGE), the URL of a site to reverse proxy or the name
+// of an HTML file to serve as a 404 page
+func NewDecoy(spec string) (*Decoy, error) {
+	if spec == "" {
+		return &Decoy{page: []byte(NOT_FOUND_PAGE)}, nil
+	}
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		target, err := url.Parse(spec)
+		if err != nil || target.Host == "" {
+			return nil, fmt.Errorf("Invalid decoy URL %s", spec)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Host = target.Host
+		}
+		return &Decoy{proxy: proxy}, nil
+	}
+	page, err := ioutil.ReadFile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read decoy page: %s", err)
+	}
+	return &Decoy{page: page}, nil
+}
+
+// ServeHTTP serves the decoy.  It is safe to call on a nil Decoy, which serves
+// NOT_FOUND_PAGE.
+func (decoy *Decoy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if decoy != nil && decoy.proxy != nil {
+		Strip(req)
+		decoy.proxy.ServeHTTP(resp, req)
+		return
+	}
+	page := []byte(NOT_FOUND_PAGE)
+	if decoy != nil {
+		page = decoy.page
+	}
+	resp.Header().Set("Content-Type", "text/html")
+	resp.WriteHeader(http.StatusNotFound)
+	resp.Write(page)
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorized(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://fl1.example.org/", nil)
+	if Authorized(req, "s3cret") {
+		t.Errorf("Request without token shouldn't be authorized")
+	}
+	req.Header.Set(X_LANTERN_AUTH, "wrong")
+	if Authorized(req, "s3cret") {
+		t.Errorf("Request with wrong token shouldn't be authorized")
+	}
+	req.Header.Set(X_LANTERN_AUTH, "s3cret")
+	if !Authorized(req, "s3cret") {
+		t.Errorf("Request with token should be authorized")
+	}
+	if Authorized(req, "") {
+		t.Errorf("Empty token should never be authorized")
+	}
+	Strip(req)
+	if req.Header.Get(X_LANTERN_AUTH) != "" {
+		t.Errorf("Token should have been stripped")
+	}
+}
+
+func TestDecoy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pageFile := filepath.Join(dir, "404.html")
+	ioutil.WriteFile(pageFile, []byte("<h1>Nothing here</h1>"), 0644)
+
+	var originHost, originToken string
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		originHost = req.Host
+		originToken = req.Header.Get(X_LANTERN_AUTH)
+		resp.Write([]byte("Welcome"))
+	}))
+	defer origin.Close()
+
+	serve := func(decoy *Decoy) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://fl1.example.org/probe", nil)
+		req.Header.Set(X_LANTERN_AUTH, "guess")
+		resp := httptest.NewRecorder()
+		decoy.ServeHTTP(resp, req)
+		return resp
+	}
+
+	defaultDecoy, err := NewDecoy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileDecoy, err := NewDecoy(pageFile)
+	if err != nil {
+		t.Fatalf("Unable to load decoy page: %s", err)
+	}
+	for decoy, expected := range map[*Decoy]string{nil: NOT_FOUND_PAGE, defaultDecoy: NOT_FOUND_PAGE, fileDecoy: "<h1>Nothing here</h1>"} {
+		resp := serve(decoy)
+		if resp.Code != http.StatusNotFound || resp.Body.String() != expected {
+			t.Errorf("Expected 404 with %q, got %d with %q", expected, resp.Code, resp.Body.String())
+		}
+	}
+
+	siteDecoy, err := NewDecoy(origin.URL)
+	if err != nil {
+		t.Fatalf("Unable to create decoy site: %s", err)
+	}
+	resp := serve(siteDecoy)
+	if resp.Code != http.StatusOK || resp.Body.String() != "Welcome" {
+		t.Errorf("Expected decoy site, got %d with %q", resp.Code, resp.Body.String())
+	}
+	if originHost != origin.Listener.Addr().String() {
+		t.Errorf("Decoy site should be requested with its own host, got %s", originHost)
+	}
+	if originToken != "" {
+		t.Errorf("Token guesses shouldn't reach the decoy site")
+	}
+
+	for _, bad := range []string{"http://", filepath.Join(dir, "missing.html")} {
+		if _, err := NewDecoy(bad); err == nil {
+			t.Errorf("%s should be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// package blocklist blocks hostnames listed by subscribable remote lists, such
+// as malware and phishing feeds.  Subscriptions are configured in a JSON file,
+// for example:
+//
+//	[
+//	  {
+//	    "name": "malware",
+//	    "url": "http://lists.example.org/malware.txt",
+//	    "publickey": "-----BEGIN PUBLIC KEY-----\n...\n-----END PUBLIC KEY-----",
+//	    "enabled": true
+//	  }
+//	]
+//
+// A list contains one hostname per line (hosts file style lines like
+// "0.0.0.0 host" are also accepted, and # starts a comment).  It must be
+// signed by the subscription's ECDSA public key, with the base64-encoded
+// signature of the SHA-256 of the list served at the list's URL plus ".sig".
+// Blocking a host also blocks its subdomains.  Lists are fetched through the
+// tunnel and refreshed periodically.  Subscriptions can be enabled and disabled
+// while running with SetEnabled (e.g. from the client's dashboard), which
+// saves the change to the file.
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	REFRESH_INTERVAL = 24 * time.Hour
+	RETRY_INTERVAL   = 1 * time.Hour
+	FETCH_TIMEOUT    = 2 * time.Minute
+	MAX_LIST_SIZE    = 32 * 1024 * 1024
+
+	SIGNATURE_SUFFIX = ".sig"
+)
+
+// Subscription is a subscription to a remote list
+type Subscription struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	PublicKey string `json:"publickey"` // PEM-encoded ECDSA public key with which the list is signed
+	Enabled   bool   `json:"enabled"`
+
+	publicKey *ecdsa.PublicKey
+}
+
+// Blocklist is the set of hosts blocked by its Subscriptions
+type Blocklist struct {
+	Subscriptions []*Subscription
+
+	filename   string // from which we were loaded, and to which SetEnabled saves
+	httpClient *http.Client
+	hosts      map[string]map[string]bool // hosts by subscription name
+	hostsMutex sync.RWMutex
+	running    map[string]chan bool // stops the refreshing of each enabled subscription, nil until Start
+	stopMutex  sync.Mutex
+}
+
+// ListStatus is the status of a Subscription
+type ListStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Hosts   int    `json:"hosts"` // how many hosts from the list are blocked
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// Load loads a Blocklist from the JSON subscriptions file at the given filename.
+func Load(filename string) (*Blocklist, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open blocklists file %s: %s", filename, err)
+	}
+	defer file.Close()
+	blocklist := &Blocklist{
+		filename: filename,
+		hosts:    make(map[string]map[string]bool),
+	}
+	err = json.NewDecoder(file).Decode(&blocklist.Subscriptions)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse blocklists file %s: %s", filename, err)
+	}
+	for _, sub := range blocklist.Subscriptions {
+		if sub.publicKey, err = parsePublicKey(sub.PublicKey); err != nil {
+			return nil, fmt.Errorf("Invalid public key for blocklist %s: %s", sub.Name, err)
+		}
+	}
+	return blocklist, nil
+}
+
+// Start starts fetching and periodically refreshing the enabled
+// subscriptions, dialing with the given function (e.g. through the tunnel),
+// until Stop.
+func (blocklist *Blocklist) Start(dial func(network, addr string) (net.Conn, error)) {
+	blocklist.httpClient = &http.Client{
+		Timeout:   FETCH_TIMEOUT,
+		Transport: &http.Transport{Dial: dial},
+	}
+	blocklist.stopMutex.Lock()
+	defer blocklist.stopMutex.Unlock()
+	blocklist.running = make(map[string]chan bool)
+	for _, sub := range blocklist.Subscriptions {
+		if sub.Enabled {
+			blocklist.run(sub)
+		} else {
+			log.Debugf("Blocklist %s is disabled", sub.Name)
+		}
+	}
+}
+
+// run starts refreshing the given subscription.  stopMutex must be held.
+func (blocklist *Blocklist) run(sub *Subscription) {
+	stop := make(chan bool)
+	blocklist.running[sub.Name] = stop
+	go blocklist.keepFresh(sub, stop)
+}
+
+// Stop stops refreshing.  The hosts loaded so far stay blocked.  It is safe
+// to call on a nil or stopped Blocklist.
+func (blocklist *Blocklist) Stop() {
+	if blocklist == nil {
+		return
+	}
+	blocklist.stopMutex.Lock()
+	defer blocklist.stopMutex.Unlock()
+	for _, stop := range blocklist.running {
+		close(stop)
+	}
+	blocklist.running = nil
+}
+
+// SetEnabled enables or disables the subscription with the given name and
+// saves that to the file that we were loaded from.  Enabling a subscription
+// starts fetching it (if we're started), and disabling it unblocks its hosts
+// right away.
+func (blocklist *Blocklist) SetEnabled(name string, enabled bool) error {
+	blocklist.stopMutex.Lock()
+	defer blocklist.stopMutex.Unlock()
+	var sub *Subscription
+	for _, candidate := range blocklist.Subscriptions {
+		if candidate.Name == name {
+			sub = candidate
+		}
+	}
+	if sub == nil {
+		return fmt.Errorf("No blocklist named %s", name)
+	}
+	if sub.Enabled == enabled {
+		return nil
+	}
+	sub.Enabled = enabled
+	if err := blocklist.save(); err != nil {
+		sub.Enabled = !enabled
+		return err
+	}
+	if enabled {
+		log.Debugf("Enabled blocklist %s", name)
+		if blocklist.running != nil {
+			blocklist.run(sub)
+		}
+		return nil
+	}
+	log.Debugf("Disabled blocklist %s", name)
+	if stop := blocklist.running[name]; stop != nil {
+		close(stop)
+		delete(blocklist.running, name)
+	}
+	blocklist.hostsMutex.Lock()
+	delete(blocklist.hosts, name)
+	blocklist.hostsMutex.Unlock()
+	return nil
+}
+
+// save saves the Subscriptions to the file that we were loaded from, if any
+func (blocklist *Blocklist) save() error {
+	if blocklist.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(blocklist.Subscriptions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal blocklists: %s", err)
+	}
+	if err := ioutil.WriteFile(blocklist.filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("Unable to save blocklists file %s: %s", blocklist.filename, err)
+	}
+	return nil
+}
+
+// Lists returns the status of each Subscription.  It is safe to call on a nil
+// Blocklist, which has none.
+func (blocklist *Blocklist) Lists() []*ListStatus {
+	if blocklist == nil {
+		return nil
+	}
+	blocklist.stopMutex.Lock()
+	defer blocklist.stopMutex.Unlock()
+	blocklist.hostsMutex.RLock()
+	defer blocklist.hostsMutex.RUnlock()
+	lists := make([]*ListStatus, 0, len(blocklist.Subscriptions))
+	for _, sub := range blocklist.Subscriptions {
+		lists = append(lists, &ListStatus{Name: sub.Name, Enabled: sub.Enabled, Hosts: len(blocklist.hosts[sub.Name])})
+	}
+	return lists
+}
+
+// IsBlocked indicates whether the given host (which may include a port) or
+// any of its parent domains is blocked.  It is safe to call on a nil
+// Blocklist.
+func (blocklist *Blocklist) IsBlocked(host string) bool {
+	if blocklist == nil {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	blocklist.hostsMutex.RLock()
+	defer blocklist.hostsMutex.RUnlock()
+	for {
+		for _, hosts := range blocklist.hosts {
+			if hosts[host] {
+				return true
+			}
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+func (blocklist *Blocklist) keepFresh(sub *Subscription, stop chan bool) {
+	defer crash.Recover()
+	for {
+		next := REFRESH_INTERVAL
+		hosts, err := blocklist.fetch(sub)
+		if err != nil {
+			log.Errorf("Unable to refresh blocklist %s: %s", sub.Name, err)
+			next = RETRY_INTERVAL
+		} else {
+			blocklist.hostsMutex.Lock()
+			select {
+			case <-stop:
+				// Disabled (or stopped) while fetching
+				blocklist.hostsMutex.Unlock()
+				return
+			default:
+				log.Debugf("Loaded %d hosts from blocklist %s", len(hosts), sub.Name)
+				blocklist.hosts[sub.Name] = hosts
+			}
+			blocklist.hostsMutex.Unlock()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// fetch fetches the given subscription's list and verifies its signature
+func (blocklist *Blocklist) fetch(sub *Subscription) (map[string]bool, error) {
+	list, err := blocklist.get(sub.URL)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := blocklist.get(sub.URL + SIGNATURE_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(sub.publicKey, list, sig); err != nil {
+		return nil, err
+	}
+	return parseList(list), nil
+}
+
+func (blocklist *Blocklist) get(url string) ([]byte, error) {
+	resp, err := blocklist.httpClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response status fetching %s: %d", url, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_LIST_SIZE))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", url, err)
+	}
+	return body, nil
+}
+
+// verify verifies the base64-encoded signature sig of the given list
+func verify(publicKey *ecdsa.PublicKey, list []byte, sig []byte) error {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("Unable to decode signature: %s", err)
+	}
+	signature := &ecdsaSignature{}
+	if _, err := asn1.Unmarshal(der, signature); err != nil {
+		return fmt.Errorf("Unable to parse signature: %s", err)
+	}
+	hash := sha256.Sum256(list)
+	if !ecdsa.Verify(publicKey, hash[:], signature.R, signature.S) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
+
+func parsePublicKey(pemData string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Not an ECDSA public key")
+	}
+	return publicKey, nil
+}
+
+// parseList parses a list of hosts
+func parseList(list []byte) map[string]bool {
+	hosts := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			// Hosts file style lines have the address first
+			fields = fields[1:]
+		}
+		for _, host := range fields {
+			host = strings.TrimSuffix(strings.ToLower(host), ".")
+			if host != "localhost" && net.ParseIP(host) == nil {
+				hosts[host] = true
+			}
+		}
+	}
+	return hosts
+}
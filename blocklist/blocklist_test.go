@@ -0,0 +1,121 @@
+package blocklist
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testList = `
+# Malware hosts
+evil.example
+0.0.0.0 phish.example tracker.example
+127.0.0.1 localhost
+`
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(testList))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(ecdsaSignature{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := []byte(base64.StdEncoding.EncodeToString(der))
+
+	if err := verify(&key.PublicKey, []byte(testList), sig); err != nil {
+		t.Errorf("Valid signature didn't verify: %s", err)
+	}
+	if err := verify(&key.PublicKey, []byte(testList+"google.com\n"), sig); err == nil {
+		t.Error("Tampered list shouldn't verify")
+	}
+}
+
+func TestIsBlocked(t *testing.T) {
+	blocklist := &Blocklist{
+		hosts: map[string]map[string]bool{"malware": parseList([]byte(testList))},
+	}
+	for _, host := range []string{"evil.example", "www.evil.example:443", "Phish.Example", "tracker.example"} {
+		if !blocklist.IsBlocked(host) {
+			t.Errorf("%s should be blocked", host)
+		}
+	}
+	for _, host := range []string{"example", "notevil.example", "localhost"} {
+		if blocklist.IsBlocked(host) {
+			t.Errorf("%s shouldn't be blocked", host)
+		}
+	}
+	var nilBlocklist *Blocklist
+	if nilBlocklist.IsBlocked("evil.example") {
+		t.Error("nil Blocklist shouldn't block")
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	subscriptions, _ := json.Marshal([]*Subscription{
+		{Name: "malware", URL: "http://lists.example/malware.txt", PublicKey: publicKey, Enabled: true},
+		{Name: "ads", URL: "http://lists.example/ads.txt", PublicKey: publicKey},
+	})
+	filename := filepath.Join(dir, "blocklists.json")
+	if err := ioutil.WriteFile(filename, subscriptions, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blocklist, err := Load(filename)
+	if err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+	blocklist.hosts["malware"] = parseList([]byte(testList))
+	if err := blocklist.SetEnabled("malware", false); err != nil {
+		t.Fatalf("Unable to disable: %s", err)
+	}
+	if blocklist.IsBlocked("evil.example") {
+		t.Error("Hosts of a disabled list shouldn't be blocked")
+	}
+	if err := blocklist.SetEnabled("ads", true); err != nil {
+		t.Fatalf("Unable to enable: %s", err)
+	}
+	if err := blocklist.SetEnabled("missing", true); err == nil {
+		t.Error("Expected error enabling a list that doesn't exist")
+	}
+
+	reloaded, err := Load(filename)
+	if err != nil {
+		t.Fatalf("Unable to reload: %s", err)
+	}
+	for _, list := range reloaded.Lists() {
+		if list.Enabled != (list.Name == "ads") {
+			t.Errorf("Toggling %s wasn't saved", list.Name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// package capabilities lets clients discover at runtime what the server that
+// they're connected to supports, so that the configs of clients and servers
+// don't need to be kept in sync by hand.
+//
+// Servers publish their Capabilities as JSON at CAPABILITIES_PATH.  Clients
+// authenticate either with a shared token in the X-Lantern-Capabilities-Token
+// header or, on servers that host tenants, with their tenant token.  Clients
+// fetch the Capabilities once per session and turn off features that the
+// server lacks.
+package capabilities
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	CAPABILITIES_PATH            = "/capabilities"                // path at which servers publish their Capabilities
+	X_LANTERN_CAPABILITIES_TOKEN = "X-Lantern-Capabilities-Token" // header with which clients authenticate
+
+	VERSION = 1 // version of the Capabilities document, bumped when its meaning changes
+
+	TRANSPORT_ENPROXY = "enproxy" // http-encapsulated tunnels (see github.com/getlantern/enproxy)
+	CODEC_DEFLATE     = "deflate" // see protocol.Compress
+
+	MAX_SIZE = 64 * 1024
+)
+
+// Capabilities is what a server supports
+type Capabilities struct {
+	Version     int      `json:"version"`
+	Transports  []string `json:"transports"`  // tunnel transports, like TRANSPORT_ENPROXY
+	Compression []string `json:"compression"` // codecs for tunnels marked with protocol.EncodeCompressed, like CODEC_DEFLATE
+	Media       bool     `json:"media"`       // whether media is compressed for destinations marked with protocol.EncodeMedia
+	Hops        bool     `json:"hops"`        // whether the server relays to next hops
+	UDP         bool     `json:"udp"`         // whether the server relays UDP for SOCKS clients
+	Feedback    bool     `json:"feedback"`    // whether the server accepts feedback (see package feedback)
+	Prefetch    bool     `json:"prefetch"`    // whether the server pushes the subresources of pages (see package prefetch)
+	Limits      *Limits  `json:"limits"`
+}
+
+// Limits are the server's limits that clients may want to know about
+type Limits struct {
+	ReadTimeout  int64 `json:"readtimeout,omitempty"`  // seconds within which requests have to be read
+	WriteTimeout int64 `json:"writetimeout,omitempty"` // seconds within which responses have to be written
+	DailyCap     int64 `json:"dailycap,omitempty"`     // bytes per day for the client's tenant, if capped
+}
+
+// SupportsCompression indicates whether the server decompresses tunnels
+// compressed with the given codec.  It is safe to call on a nil Capabilities
+// (not discovered yet), which supports everything.
+func (capabilities *Capabilities) SupportsCompression(codec string) bool {
+	if capabilities == nil {
+		return true
+	}
+	for _, supported := range capabilities.Compression {
+		if supported == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsMedia indicates whether the server compresses media.  It is safe to
+// call on a nil Capabilities, which supports everything.
+func (capabilities *Capabilities) SupportsMedia() bool {
+	return capabilities == nil || capabilities.Media
+}
+
+// SupportsHops indicates whether the server relays to next hops.  It is safe
+// to call on a nil Capabilities, which supports everything.
+func (capabilities *Capabilities) SupportsHops() bool {
+	return capabilities == nil || capabilities.Hops
+}
+
+// SupportsUDP indicates whether the server relays UDP.  It is safe to call on
+// a nil Capabilities, which supports everything.
+func (capabilities *Capabilities) SupportsUDP() bool {
+	return capabilities == nil || capabilities.UDP
+}
+
+// SupportsFeedback indicates whether the server accepts feedback.  It is safe
+// to call on a nil Capabilities, which supports everything.
+func (capabilities *Capabilities) SupportsFeedback() bool {
+	return capabilities == nil || capabilities.Feedback
+}
+
+// SupportsPrefetch indicates whether the server pushes the subresources of
+// pages.  It is safe to call on a nil Capabilities, which supports everything.
+func (capabilities *Capabilities) SupportsPrefetch() bool {
+	return capabilities == nil || capabilities.Prefetch
+}
+
+// PrepareRequest turns the given request to the server (usually built by a
+// protocol.ClientProtocol) into one for the server's Capabilities,
+// authenticated with the given token (if any)
+func PrepareRequest(req *http.Request, token string) {
+	req.Method = "GET"
+	req.URL.Path = CAPABILITIES_PATH
+	if token != "" {
+		req.Header.Set(X_LANTERN_CAPABILITIES_TOKEN, token)
+	}
+	req.Body = nil
+	req.ContentLength = 0
+}
+
+// ReadResponse reads the Capabilities from the given response to a request
+// made with PrepareRequest.  Servers that don't publish their capabilities (or
+// don't accept our token) result in an error that IsUnsupported.
+func ReadResponse(resp *http.Response) (*Capabilities, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &unsupportedError{resp.Status}
+	}
+	capabilities := &Capabilities{}
+	err := json.NewDecoder(io.LimitReader(resp.Body, MAX_SIZE)).Decode(capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode capabilities: %s", err)
+	}
+	return capabilities, nil
+}
+
+// IsUnsupported indicates whether the given error from ReadResponse means
+// that the server won't tell us its capabilities, as opposed to us not having
+// reached it
+func IsUnsupported(err error) bool {
+	_, ok := err.(*unsupportedError)
+	return ok
+}
+
+type unsupportedError struct {
+	status string
+}
+
+func (err *unsupportedError) Error() string {
+	return fmt.Sprintf("Server didn't publish capabilities: %s", err.status)
+}
+
+// Authorized indicates whether the given request carries the given token,
+// which mustn't be empty
+func Authorized(req *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get(X_LANTERN_CAPABILITIES_TOKEN)), []byte(token)) == 1
+}
+
+// Serve serves the given capabilities as JSON
+func Serve(resp http.ResponseWriter, capabilities *Capabilities) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(capabilities)
+}
@@ -0,0 +1,46 @@
+package capabilities
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != CAPABILITIES_PATH || !Authorized(req, "secret") {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		Serve(resp, &Capabilities{Version: VERSION, Compression: []string{CODEC_DEFLATE}, Hops: true, Limits: &Limits{DailyCap: 1000}})
+	}))
+	defer server.Close()
+
+	fetch := func(token string) (*Capabilities, error) {
+		req, _ := http.NewRequest("POST", server.URL+"/other", nil)
+		PrepareRequest(req, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to request capabilities: %s", err)
+		}
+		return ReadResponse(resp)
+	}
+
+	capabilities, err := fetch("secret")
+	if err != nil {
+		t.Fatalf("Unable to read capabilities: %s", err)
+	}
+	if !capabilities.SupportsCompression(CODEC_DEFLATE) || !capabilities.SupportsHops() || capabilities.SupportsMedia() || capabilities.Limits.DailyCap != 1000 {
+		t.Errorf("Unexpected capabilities: %+v", capabilities)
+	}
+
+	_, err = fetch("wrong")
+	if !IsUnsupported(err) {
+		t.Errorf("Wrong token should be unsupported, got %v", err)
+	}
+
+	var unknown *Capabilities
+	if !unknown.SupportsCompression(CODEC_DEFLATE) || !unknown.SupportsUDP() || !unknown.SupportsFeedback() {
+		t.Errorf("Undiscovered capabilities should support everything")
+	}
+}
@@ -0,0 +1,436 @@
+// package client provides flashlight's client for embedding in other Go
+// programs, such as the Lantern UI, mobile wrappers and tests.  The flashlight
+// command is a thin CLI around it and package server.  For example:
+//
+//	c := client.New(&client.Config{
+//		Addr:        "127.0.0.1:8787",
+//		Servers:     []string{"fl1.example.org"},
+//		Masquerades: []string{"cdnjs.com"},
+//	})
+//	err := c.ListenAndServe()
+//
+// Settings beyond those of Config (rules, SOCKS, caching and so on) are made
+// on the proxy.Client given as Config.Proxy.
+package client
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/metrics"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/protocol/azure"
+	"github.com/getlantern/flashlight/protocol/cloudflare"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/proxydialer"
+	"github.com/getlantern/flashlight/resolver"
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/tls"
+)
+
+const (
+	DEFAULT_SERVER_PORT = 443
+	DEFAULT_PROTOCOL    = "cloudflare"
+)
+
+// Config configures a Client
+type Config struct {
+	Addr             string             // ip:port on which to listen with http
+	Servers          []string           // FQDNs of flashlight servers, optionally with weights like host=weight, among which to balance connections
+	ServerPort       int                // (optional) port on which to connect to the servers, defaults to DEFAULT_SERVER_PORT
+	Protocols        []string           // (optional) fronting protocols ("cloudflare" or "azure") in order of preference, defaults to DEFAULT_PROTOCOL
+	AzureServer      string             // (optional) FQDN of the server to reach with the azure protocol, defaults to each of Servers
+	Masquerades      []string           // (optional) hosts to actually dial in place of the servers
+	AzureMasquerades []string           // (optional) masquerades for the azure protocol, defaults to Masquerades
+	MasqueradeCA     string             // (optional) PEM encoded CA cert against which to verify masquerades, defaults to the system's trusted roots
+	RootCA           string             // (optional) PEM encoded CA cert to which to pin the servers
+	ServerPins       []string           // (optional) identity.Fingerprints of the servers' public keys, which they have to prove that they have
+	ClientCert       string             // (optional) PEM encoded certificate and key (see package clientauth) to present to servers that require one, when dialing them directly
+	Balance          string             // (optional) how to balance among multiple Servers, defaults to protocol.BALANCE_ROUND_ROBIN
+	ParallelDials    int                // (optional) number of masquerades to dial concurrently, defaults to 1
+	IPVersion        string             // (optional) "4" or "6" to prefer dialing over IPv4 or IPv6, defaults to auto
+	MaxIdleConns     int                // (optional) number of warm connections to keep to each masquerade (or server) host, 0 disables pooling
+	IdleConnTimeout  time.Duration      // (optional) how long warm connections may sit idle, defaults to protocol.DEFAULT_IDLE_CONN_TIMEOUT
+	Resolver         *resolver.Resolver // (optional) resolver for hostnames, defaults to the OS resolver
+	UpstreamProxy    proxydialer.Dialer // (optional) proxy (e.g. a corporate proxy) through which to dial
+	Prober           *protocol.Prober   // (optional) probes the servers, started by ListenAndServe
+
+	// LookupCountry (optional) looks up the country of destination hosts, for
+	// picking servers whose advertised egress policy permits them
+	LookupCountry func(host string) (string, error)
+
+	// Proxy (optional) is the client proxy, for settings beyond these.  Its
+	// Addr, NewEnproxyConfig, CurrentProtocol, CurrentHost, Prober,
+	// UpstreamProxy and ServerPins are set from this Config.
+	Proxy *proxy.Client
+}
+
+// upstream is how we reach the server(s), either a protocol.Chain for a
+// single server or a protocol.Balancer for several
+type upstream interface {
+	EnproxyConfig() *enproxy.Config
+	Current() string
+	Stop()
+}
+
+// Client is a flashlight client
+type Client struct {
+	config       Config
+	proxy        *proxy.Client
+	monitor      *protocol.NetworkMonitor
+	sessionCache tls.ClientSessionCache
+	pools        map[string]*protocol.MasqueradePool // by comma-separated list of masquerades
+	upstream     upstream
+	lastHost     string // the host (masquerade or server) that we last dialed
+	mutex        sync.RWMutex
+}
+
+// New creates a Client with the given Config
+func New(config *Config) *Client {
+	client := &Client{
+		config:       *config,
+		proxy:        config.Proxy,
+		monitor:      protocol.NewNetworkMonitor(),
+		sessionCache: protocol.NewSessionCache(),
+		pools:        make(map[string]*protocol.MasqueradePool),
+	}
+	if client.proxy == nil {
+		client.proxy = &proxy.Client{}
+	}
+	return client
+}
+
+// Proxy returns the client proxy
+func (client *Client) Proxy() *proxy.Client {
+	return client.proxy
+}
+
+// ListenAndServe sets up the protocols for reaching the servers, starts the
+// Prober (if any) and runs the client proxy until it fails
+func (client *Client) ListenAndServe() error {
+	client.mutex.Lock()
+	current, err := client.build(client.config.Prober)
+	if err != nil {
+		client.mutex.Unlock()
+		return fmt.Errorf("Unable to initialize client protocols: %s", err)
+	}
+	client.upstream = current
+	prober := client.config.Prober
+	client.mutex.Unlock()
+
+	if prober != nil {
+		prober.OnProbe = client.observe
+		prober.OnAdvertised = client.advertised
+		prober.Header = client.proxy.TokenHeader()
+		prober.Start()
+	}
+	client.proxy.Addr = client.config.Addr
+	client.proxy.NewEnproxyConfig = func(addr string) *enproxy.Config {
+		current := client.current()
+		if balancer, ok := current.(*protocol.Balancer); ok {
+			return balancer.EnproxyConfigFor(addr)
+		}
+		return current.EnproxyConfig()
+	}
+	client.proxy.ServerConfigs = client.serverConfigs
+	client.proxy.CurrentProtocol = func() string {
+		return client.current().Current()
+	}
+	client.proxy.CurrentHost = func() string {
+		client.mutex.RLock()
+		defer client.mutex.RUnlock()
+		return client.lastHost
+	}
+	client.proxy.Prober = prober
+	client.proxy.UpstreamProxy = client.config.UpstreamProxy
+	client.proxy.ServerPins = client.config.ServerPins
+	return client.proxy.Run()
+}
+
+// Shutdown drains the client proxy's tunnels for up to drainTimeout (see
+// proxy.Client.Shutdown)
+func (client *Client) Shutdown(drainTimeout time.Duration) *proxy.Session {
+	return client.proxy.Shutdown(drainTimeout)
+}
+
+// Close stops the client proxy from listening, after which ListenAndServe
+// returns without an error (see proxy.Client.Close), and stops everything
+// that runs in the background (network monitoring, masquerade verification,
+// re-probing and the Prober)
+func (client *Client) Close() error {
+	err := client.proxy.Close()
+	client.monitor.Stop()
+	client.config.Prober.Stop()
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.upstream != nil {
+		client.upstream.Stop()
+	}
+	for _, pool := range client.pools {
+		pool.Stop()
+	}
+	return err
+}
+
+// IsConnected indicates whether the latest dial to a server succeeded.  It's
+// false until the first dial.
+func (client *Client) IsConnected() bool {
+	return client.monitor.Connected()
+}
+
+// SetServers switches to the given servers (see Config.Servers).  Existing
+// connections stay with the servers they were made to.  If the new servers
+// can't be set up, the current ones are kept.
+func (client *Client) SetServers(servers []string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	previous := client.config.Servers
+	client.config.Servers = servers
+	if client.upstream == nil {
+		// Not serving yet, ListenAndServe will use the new servers
+		return nil
+	}
+	var prober *protocol.Prober
+	if client.config.Prober != nil {
+		prober = &protocol.Prober{}
+	}
+	current, err := client.build(prober)
+	if err != nil {
+		client.config.Servers = previous
+		return err
+	}
+	client.config.Prober.ReplaceTargets(prober)
+	client.upstream.Stop()
+	client.upstream = current
+	client.proxy.VerifyServers()
+	return nil
+}
+
+// serverConfigs returns an enproxy.Config for reaching each current server,
+// by name
+func (client *Client) serverConfigs() map[string]*enproxy.Config {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	if balancer, ok := client.upstream.(*protocol.Balancer); ok {
+		return balancer.ServerConfigs()
+	}
+	name, _ := splitServer(client.config.Servers[0])
+	return map[string]*enproxy.Config{name: client.upstream.EnproxyConfig()}
+}
+
+// ReplaceMasquerades replaces the given list of masquerades (Masquerades or
+// AzureMasquerades) with replacement, whose hosts are verified before they're
+// used.  It returns false if no protocol uses that list, e.g. because we're
+// not serving yet.
+func (client *Client) ReplaceMasquerades(masquerades []string, replacement []string) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	key := strings.Join(masquerades, ",")
+	pool := client.pools[key]
+	if pool == nil || len(replacement) == 0 {
+		return false
+	}
+	pool.SetCandidates(replacement)
+	delete(client.pools, key)
+	client.pools[strings.Join(replacement, ",")] = pool
+	if strings.Join(client.config.Masquerades, ",") == key {
+		client.config.Masquerades = replacement
+	}
+	if strings.Join(client.config.AzureMasquerades, ",") == key {
+		client.config.AzureMasquerades = replacement
+	}
+	return true
+}
+
+func (client *Client) current() upstream {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.upstream
+}
+
+// observe passes the outcome of a probe on to the current upstream, if it
+// balances among servers
+func (client *Client) observe(name string, rtt time.Duration, err error) {
+	if balancer, ok := client.current().(*protocol.Balancer); ok {
+		balancer.Observe(name, rtt, err)
+	}
+}
+
+// advertised passes what a server advertised in response to a probe on to the
+// current upstream, if it balances among servers
+func (client *Client) advertised(name string, header http.Header) {
+	if balancer, ok := client.current().(*protocol.Balancer); ok {
+		balancer.Advertised(name, header)
+	}
+}
+
+// build builds the upstream for the configured servers, adding them to the
+// given Prober (if not nil).  If there are multiple servers, it balances among
+// them.  The caller must hold the mutex.
+func (client *Client) build(prober *protocol.Prober) (upstream, error) {
+	if len(client.config.Servers) == 0 {
+		return nil, fmt.Errorf("No servers specified")
+	}
+	var servers []*protocol.BalancedServer
+	for _, spec := range client.config.Servers {
+		name, weight := splitServer(spec)
+		server := &protocol.BalancedServer{Name: name}
+		if weight != "" {
+			var err error
+			server.Weight, err = strconv.Atoi(weight)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid weight for server %s: %s", name, err)
+			}
+		}
+		var err error
+		server.Chain, err = client.protocolChain(server.Name, prober)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 1 {
+		return servers[0].Chain, nil
+	}
+	balance := client.config.Balance
+	if balance == "" {
+		balance = protocol.BALANCE_ROUND_ROBIN
+	}
+	balancer, err := protocol.NewBalancer(servers, balance)
+	if err != nil {
+		return nil, err
+	}
+	balancer.Usable = client.proxy.ServerVerified
+	balancer.LookupCountry = client.config.LookupCountry
+	return balancer, nil
+}
+
+// splitServer splits a server spec (see Config.Servers) into the server's name
+// and weight, which is empty if it's not specified
+func splitServer(spec string) (name string, weight string) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return spec, ""
+}
+
+// protocolChain builds a protocol.Chain for reaching the given server with
+// the configured protocols, adding them to the given Prober
+func (client *Client) protocolChain(server string, prober *protocol.Prober) (*protocol.Chain, error) {
+	names := client.config.Protocols
+	if len(names) == 0 {
+		names = []string{DEFAULT_PROTOCOL}
+	}
+	var entries []*protocol.ChainEntry
+	for _, name := range names {
+		cp, err := client.clientProtocol(name, server)
+		if err != nil {
+			return nil, err
+		}
+		prober.Add(server, name, cp)
+		entries = append(entries, &protocol.ChainEntry{Name: name, Protocol: client.monitor.Migrating(cp)})
+	}
+	return protocol.NewChain(entries)
+}
+
+// clientProtocol builds the named protocol.ClientProtocol for reaching the
+// given server
+func (client *Client) clientProtocol(name string, server string) (protocol.ClientProtocol, error) {
+	if name != "cloudflare" && name != "azure" {
+		return nil, fmt.Errorf("Unknown protocol %s", name)
+	}
+	port := client.config.ServerPort
+	if port == 0 {
+		port = DEFAULT_SERVER_PORT
+	}
+	var clientCert *tls.Certificate
+	if client.config.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(client.config.ClientCert), []byte(client.config.ClientCert))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client cert: %s", err)
+		}
+		clientCert = &cert
+	}
+	config := &protocol.ClientConfig{
+		UpstreamHost:  server,
+		UpstreamPort:  port,
+		RootCA:        client.config.RootCA,
+		ServerPins:    client.config.ServerPins,
+		ClientCert:    clientCert,
+		ParallelDials: client.config.ParallelDials,
+		IPVersion:     client.config.IPVersion,
+		Resolver:      client.config.Resolver,
+		UpstreamProxy: client.config.UpstreamProxy,
+		SessionCache:  client.sessionCache,
+		OnTiming: func(phase string, elapsed time.Duration, host string) {
+			client.proxy.Metrics.Observe(metrics.LatencyName(phase, name), elapsed, host)
+			if phase == protocol.PHASE_TLS {
+				client.mutex.Lock()
+				client.lastHost = host
+				client.mutex.Unlock()
+			}
+		},
+	}
+	if client.config.MaxIdleConns > 0 {
+		config.Pool = &protocol.ConnPool{
+			MaxIdlePerHost: client.config.MaxIdleConns,
+			IdleTimeout:    client.config.IdleConnTimeout,
+		}
+	}
+	masquerades := client.config.Masquerades
+	if name == "azure" {
+		if client.config.AzureServer != "" {
+			config.UpstreamHost = client.config.AzureServer
+		}
+		if len(client.config.AzureMasquerades) > 0 {
+			masquerades = client.config.AzureMasquerades
+		}
+	}
+	if len(masquerades) > 0 {
+		var err error
+		config.Masquerades, err = client.masqueradePool(masquerades, port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if name == "azure" {
+		return azure.NewClientProtocol(config)
+	}
+	return cloudflare.NewClientProtocol(config)
+}
+
+// masqueradePool returns the protocol.MasqueradePool for the given list of
+// masquerades, which is shared among all servers that use that list
+func (client *Client) masqueradePool(masquerades []string, port int) (*protocol.MasqueradePool, error) {
+	key := strings.Join(masquerades, ",")
+	if pool, found := client.pools[key]; found {
+		return pool, nil
+	}
+	rootCAs, err := client.masqueradeRootCAs()
+	if err != nil {
+		return nil, err
+	}
+	pool := protocol.NewMasqueradePool(masquerades, port, rootCAs, client.config.Resolver, client.config.UpstreamProxy)
+	client.pools[key] = pool
+	return pool, nil
+}
+
+// masqueradeRootCAs returns the pool of CAs against which to verify masquerade
+// hosts, or nil to use the system's trusted roots.
+func (client *Client) masqueradeRootCAs() (*x509.CertPool, error) {
+	if client.config.MasqueradeCA == "" {
+		return nil, nil
+	}
+	caCert, err := keyman.LoadCertificateFromPEMBytes([]byte(client.config.MasqueradeCA))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load masquerade ca cert: %s", err)
+	}
+	return caCert.PoolContainingCert(), nil
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/getlantern/flashlight/protocol"
+)
+
+func TestBuild(t *testing.T) {
+	client := New(&Config{Servers: []string{"fl1.example.org"}})
+	single, err := client.build(nil)
+	if err != nil {
+		t.Fatalf("Unable to build upstream: %s", err)
+	}
+	if _, ok := single.(*protocol.Chain); !ok {
+		t.Errorf("Expected a Chain for a single server, got %T", single)
+	}
+
+	client = New(&Config{Servers: []string{"fl1.example.org", "fl2.example.org=3"}, Protocols: []string{"cloudflare", "azure"}})
+	balanced, err := client.build(nil)
+	if err != nil {
+		t.Fatalf("Unable to build upstream: %s", err)
+	}
+	if _, ok := balanced.(*protocol.Balancer); !ok {
+		t.Errorf("Expected a Balancer for multiple servers, got %T", balanced)
+	}
+
+	for _, config := range []*Config{
+		{},
+		{Servers: []string{"fl1.example.org=heavy"}},
+		{Servers: []string{"fl1.example.org"}, Protocols: []string{"carrierpigeon"}},
+	} {
+		if _, err := New(config).build(nil); err == nil {
+			t.Errorf("Expected error building upstream for %+v", config)
+		}
+	}
+}
+
+func TestSetServersBeforeServing(t *testing.T) {
+	client := New(&Config{Servers: []string{"fl1.example.org"}})
+	if err := client.SetServers([]string{"fl2.example.org"}); err != nil {
+		t.Fatalf("Unable to set servers: %s", err)
+	}
+	if client.config.Servers[0] != "fl2.example.org" {
+		t.Errorf("Expected new servers to be used once serving, got %v", client.config.Servers)
+	}
+	if client.ReplaceMasquerades([]string{"cdnjs.com"}, []string{"www.example.com"}) {
+		t.Errorf("Expected no masquerades to replace before serving")
+	}
+}
@@ -0,0 +1,269 @@
+// package clientauth implements mutual TLS between flashlight clients and a
+// private server, so that only authorized clients can use it.
+//
+// The server keeps a CA in its configDir, which issues a certificate (and key)
+// for each client.  With a Verifier, the server requires clients to present a
+// certificate issued by its CA and, if the Verifier has an allowlist, one
+// issued for a name on the allowlist.  The allowlist is a text file with one
+// client name per line (# starts a comment), which can be reloaded while the
+// server runs, for example to revoke a client:
+//
+//	# clients allowed to use this server
+//	alice
+//	bob
+//
+// Fronts terminate the client's TLS connection, so client certificates only
+// reach servers that clients dial directly (without masquerades).
+package clientauth
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CA_VALIDITY      = 20 * 365 * 24 * time.Hour // how long the CA is valid for
+	DEFAULT_VALIDITY = 365 * 24 * time.Hour      // how long client certificates are valid for by default
+	CA_NAME          = "flashlight client CA"
+)
+
+// CA issues client certificates
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// LoadOrCreateCA loads the CA from the given PEM files, creating it if it
+// doesn't exist yet
+func LoadOrCreateCA(certFile string, keyFile string) (*CA, error) {
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse client CA cert: %s", err)
+		}
+		return &CA{Cert: cert, Key: keyPair.PrivateKey.(crypto.Signer)}, nil
+	}
+	if _, statErr := os.Stat(certFile); !os.IsNotExist(statErr) {
+		return nil, fmt.Errorf("Unable to load client CA: %s", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate client CA key: %s", err)
+	}
+	template, err := newTemplate(CA_NAME, CA_VALIDITY)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create client CA cert: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("Unable to save client CA key: %s", err)
+	}
+	if err := ioutil.WriteFile(certFile, encodeCert(der), 0644); err != nil {
+		return nil, fmt.Errorf("Unable to save client CA cert: %s", err)
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// Issue issues a certificate for the client with the given name, valid for
+// the given duration (DEFAULT_VALIDITY if 0).  It returns the certificate and
+// its private key PEM encoded in one file, which clients load with
+// LoadClientCert.
+func (ca *CA) Issue(name string, validity time.Duration) (*x509.Certificate, []byte, error) {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "\r\n") || strings.HasPrefix(name, "#") {
+		return nil, nil, fmt.Errorf("Invalid client name %q", name)
+	}
+	if validity == 0 {
+		validity = DEFAULT_VALIDITY
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to generate client key: %s", err)
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to issue client cert: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, append(encodeCert(der), keyPEM...), nil
+}
+
+// Pool returns a pool containing the CA's certificate, for verifying client
+// certificates
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// LoadClientCert loads a client certificate and its private key from the
+// given PEM file, as written by Issue
+func LoadClientCert(filename string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read client cert: %s", err)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load client cert and key from %s: %s", filename, err)
+	}
+	return &cert, nil
+}
+
+// Verifier verifies client certificates on a server
+type Verifier struct {
+	CA            *CA
+	AllowlistFile string // (optional) file with the names of the clients that are allowed, all clients with certificates from CA are allowed if not specified
+
+	allowed map[string]bool
+	mutex   sync.RWMutex
+}
+
+// Reload (re)loads the AllowlistFile, keeping the current allowlist if it
+// can't be loaded
+func (verifier *Verifier) Reload() error {
+	if verifier.AllowlistFile == "" {
+		return nil
+	}
+	allowed, err := LoadAllowlist(verifier.AllowlistFile)
+	if err != nil {
+		return err
+	}
+	verifier.mutex.Lock()
+	verifier.allowed = allowed
+	verifier.mutex.Unlock()
+	return nil
+}
+
+// Allowed returns the number of clients on the allowlist, or -1 if there's no
+// allowlist
+func (verifier *Verifier) Allowed() int {
+	verifier.mutex.RLock()
+	defer verifier.mutex.RUnlock()
+	if verifier.allowed == nil {
+		return -1
+	}
+	return len(verifier.allowed)
+}
+
+// Configure makes the given server tls.Config require client certificates
+// issued by our CA and check them against the allowlist
+func (verifier *Verifier) Configure(config *tls.Config) {
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = verifier.CA.Pool()
+	config.VerifyConnection = verifier.verifyConnection
+}
+
+// verifyConnection checks the client certificate (already verified against
+// our CA) against the allowlist.  Unlike VerifyPeerCertificate, it's also
+// called for resumed sessions, so that revoked clients can't resume theirs.
+func (verifier *Verifier) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("No client certificate")
+	}
+	return verifier.Check(state.PeerCertificates[0])
+}
+
+// Check checks whether the client with the given certificate (which must
+// already be verified against our CA) is on the allowlist
+func (verifier *Verifier) Check(cert *x509.Certificate) error {
+	verifier.mutex.RLock()
+	defer verifier.mutex.RUnlock()
+	if verifier.allowed != nil && !verifier.allowed[cert.Subject.CommonName] {
+		return fmt.Errorf("Client %s is not allowed", cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// LoadAllowlist loads the names of allowed clients from the given file
+func LoadAllowlist(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open client allowlist: %s", err)
+	}
+	defer file.Close()
+	allowed := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		allowed[name] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read client allowlist: %s", err)
+	}
+	return allowed, nil
+}
+
+func newTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate serial number: %s", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Lantern"},
+			CommonName:   name,
+		},
+		NotBefore: now.Add(-1 * time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode key: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,112 @@
+package clientauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "clientca.pem")
+	keyFile := filepath.Join(dir, "clientcakey.pem")
+
+	ca, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unable to create CA: %s", err)
+	}
+	reloaded, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil || !reloaded.Cert.Equal(ca.Cert) {
+		t.Fatalf("Should have loaded the same CA, got %v", err)
+	}
+	otherCA, err := LoadOrCreateCA(filepath.Join(dir, "other.pem"), filepath.Join(dir, "otherkey.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(ca *CA, name string) *tls.Certificate {
+		cert, certAndKey, err := ca.Issue(name, time.Hour)
+		if err != nil {
+			t.Fatalf("Unable to issue cert: %s", err)
+		}
+		if cert.Subject.CommonName != name {
+			t.Errorf("Expected cert for %s, got %s", name, cert.Subject.CommonName)
+		}
+		filename := filepath.Join(dir, name+".pem")
+		ioutil.WriteFile(filename, certAndKey, 0600)
+		clientCert, err := LoadClientCert(filename)
+		if err != nil {
+			t.Fatalf("Unable to load client cert: %s", err)
+		}
+		return clientCert
+	}
+	alice := issue(ca, "alice")
+	bob := issue(ca, "bob")
+	mallory := issue(otherCA, "alice")
+	if _, _, err := ca.Issue("# not a name", time.Hour); err == nil {
+		t.Errorf("Names that look like comments should be rejected")
+	}
+
+	allowlist := filepath.Join(dir, "allowlist")
+	ioutil.WriteFile(allowlist, []byte("# allowed clients\nalice\n"), 0644)
+	verifier := &Verifier{CA: ca, AllowlistFile: allowlist}
+	if err := verifier.Reload(); err != nil {
+		t.Fatalf("Unable to load allowlist: %s", err)
+	}
+	if verifier.Allowed() != 1 {
+		t.Errorf("Expected 1 allowed client, got %d", verifier.Allowed())
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{}
+	verifier.Configure(server.TLS)
+	server.StartTLS()
+	defer server.Close()
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(server.Certificate())
+
+	connect := func(cert *tls.Certificate) error {
+		config := &tls.Config{RootCAs: serverCAs}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := connect(alice); err != nil {
+		t.Errorf("alice should be allowed: %s", err)
+	}
+	for name, cert := range map[string]*tls.Certificate{"no cert": nil, "bob": bob, "alice from another CA": mallory} {
+		if connect(cert) == nil {
+			t.Errorf("%s shouldn't be allowed", name)
+		}
+	}
+
+	// Reloading changes who's allowed, and keeps the allowlist if it fails
+	ioutil.WriteFile(allowlist, []byte("bob\n"), 0644)
+	if err := verifier.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if connect(bob) != nil || connect(alice) == nil {
+		t.Errorf("Only bob should be allowed after reloading")
+	}
+	os.Remove(allowlist)
+	if verifier.Reload() == nil || connect(bob) != nil {
+		t.Errorf("Failed reload should keep the allowlist")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/flashlight/configfile"
+)
+
+const (
+	ENV_PREFIX = "FLASHLIGHT_"
+)
+
+// fileConfig is the configuration file given with -config, in YAML or JSON.
+// Each setting corresponds to a flag, and flags given on the command line
+// override the file's settings.  For example:
+//
+//	role: client
+//	listeners:
+//	  http: 127.0.0.1:8787
+//	  socks: 127.0.0.1:1080
+//	  admin: 127.0.0.1:7070
+//	upstreams: [fl1.example.org, fl2.example.org]
+//	masquerades: [cdnjs.com, www.example.com]
+//	protocols: [cloudflare, azure]
+//	logging:
+//	  destinations: false
+//	certs:
+//	  root: /etc/flashlight/root.pem
+//	flags:
+//	  smartrouting: true
+//
+// Flags without a section of their own can be set under flags, by name.
+type fileConfig struct {
+	Role             string                 `json:"role"`
+	ConfigDir        string                 `json:"configdir"`
+	Listeners        fileListeners          `json:"listeners"`
+	Upstreams        []string               `json:"upstreams"`        // -server
+	UpstreamPort     int                    `json:"upstreamport"`     // -serverport
+	Hops             []string               `json:"hops"`             // -hops
+	Masquerades      []string               `json:"masquerades"`      // -masquerade
+	AzureMasquerades []string               `json:"azuremasquerades"` // -azuremasquerade
+	Protocols        []string               `json:"protocols"`        // -protocol
+	Logging          fileLogging            `json:"logging"`
+	Certs            fileCerts              `json:"certs"`
+	Flags            map[string]interface{} `json:"flags"` // any other flags, by name
+}
+
+type fileListeners struct {
+	HTTP        string   `json:"http"`        // -addr (https for servers)
+	SOCKS       string   `json:"socks"`       // -socksaddr
+	Transparent string   `json:"transparent"` // -transparentaddr
+	DNS         string   `json:"dns"`         // -dnsaddr
+	Stats       string   `json:"stats"`       // -statsaddr
+	Admin       string   `json:"admin"`       // -listeners admin=...
+	Additional  []string `json:"additional"`  // -listeners, as role=ip:port
+}
+
+type fileLogging struct {
+	Level        string `json:"level"`        // -loglevel
+	Format       string `json:"format"`       // -logformat
+	File         string `json:"file"`         // -logfile
+	MaxSize      int    `json:"maxsize"`      // -logmaxsize, in MB
+	Destinations *bool  `json:"destinations"` // -logdestinations
+	DumpHeaders  *bool  `json:"dumpheaders"`  // -dumpheaders
+}
+
+type fileCerts struct {
+	Root       string   `json:"root"`       // -rootca
+	Masquerade string   `json:"masquerade"` // -masqueradeca
+	Hops       string   `json:"hops"`       // -hoprootca
+	Servers    []string `json:"servers"`    // -servercertfingerprint
+}
+
+var (
+	// commandLineFlags are the flags that were given on the command line or
+	// in the environment, which the config file doesn't override
+	commandLineFlags map[string]bool
+
+	// environmentVars are the environment variables from which flags were
+	// set, for the plan
+	environmentVars []string
+
+	// fileSettings are the settings from the config file as of the last
+	// time that it was applied, by flag name
+	fileSettings map[string]string
+)
+
+// envVar returns the name of the environment variable for the named flag,
+// e.g. FLASHLIGHT_CONFIGDIR for -configdir.  Hyphens become underscores,
+// since shells don't allow them in variable names (e.g.
+// FLASHLIGHT_INSTALL_SYSTEMD for -install-systemd).
+func envVar(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnvironment sets the flags that weren't given on the command line from
+// their environment variables (see envVar), which take precedence over the
+// config file.  Variables that don't correspond to flags are ignored, since
+// orchestrators set some of their own, like FLASHLIGHT_SERVICE_HOST for a
+// Kubernetes service named flashlight.
+func applyEnvironment() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || commandLineFlags[f.Name] {
+			return
+		}
+		name := envVar(f.Name)
+		value, found := os.LookupEnv(name)
+		if !found {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("Invalid value for %s: %s", name, setErr)
+			return
+		}
+		commandLineFlags[f.Name] = true
+		environmentVars = append(environmentVars, name)
+	})
+	return err
+}
+
+// loadConfigFile loads the settings in the given configuration file, by flag
+// name
+func loadConfigFile(filename string) (map[string]string, error) {
+	config := &fileConfig{}
+	if err := configfile.Load(filename, config); err != nil {
+		return nil, err
+	}
+	settings, err := config.settings()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %s", filename, err)
+	}
+	return settings, nil
+}
+
+// applyConfigFile applies the settings in the given configuration file to the
+// flags that weren't given on the command line (see commandLineFlags)
+func applyConfigFile(filename string) error {
+	settings, err := loadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	// Apply in a consistent order so that errors are reproducible
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if commandLineFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("Invalid value for %s in config file %s: %s", name, filename, err)
+		}
+	}
+	fileSettings = settings
+	return nil
+}
+
+// settings returns the values of the flags that this config sets, by flag name
+func (config *fileConfig) settings() (map[string]string, error) {
+	settings := make(map[string]string)
+	set := func(name string, value string) {
+		if value != "" {
+			settings[name] = value
+		}
+	}
+	setList := func(name string, values []string) {
+		set(name, strings.Join(values, ","))
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			settings[name] = strconv.FormatBool(*value)
+		}
+	}
+
+	set("role", config.Role)
+	set("configdir", config.ConfigDir)
+	set("addr", config.Listeners.HTTP)
+	set("socksaddr", config.Listeners.SOCKS)
+	set("transparentaddr", config.Listeners.Transparent)
+	set("dnsaddr", config.Listeners.DNS)
+	set("statsaddr", config.Listeners.Stats)
+	additional := config.Listeners.Additional
+	if config.Listeners.Admin != "" {
+		additional = append(additional, "admin="+config.Listeners.Admin)
+	}
+	setList("listeners", additional)
+	setList("server", config.Upstreams)
+	if config.UpstreamPort != 0 {
+		set("serverport", strconv.Itoa(config.UpstreamPort))
+	}
+	setList("hops", config.Hops)
+	setList("masquerade", config.Masquerades)
+	setList("azuremasquerade", config.AzureMasquerades)
+	setList("protocol", config.Protocols)
+	set("loglevel", config.Logging.Level)
+	set("logformat", config.Logging.Format)
+	set("logfile", config.Logging.File)
+	if config.Logging.MaxSize != 0 {
+		set("logmaxsize", strconv.Itoa(config.Logging.MaxSize))
+	}
+	setBool("logdestinations", config.Logging.Destinations)
+	setBool("dumpheaders", config.Logging.DumpHeaders)
+	set("rootca", config.Certs.Root)
+	set("masqueradeca", config.Certs.Masquerade)
+	set("hoprootca", config.Certs.Hops)
+	setList("servercertfingerprint", config.Certs.Servers)
+
+	for name, value := range config.Flags {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("unknown flag %s", name)
+		}
+		if _, exists := settings[name]; exists {
+			return nil, fmt.Errorf("%s is set both under flags and in its own section", name)
+		}
+		s, err := flagValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("flag %s: %s", name, err)
+		}
+		settings[name] = s
+	}
+	return settings, nil
+}
+
+// flagValue formats the given decoded value as a flag value.  Lists become
+// comma-separated.
+func flagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
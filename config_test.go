@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestEnvVar(t *testing.T) {
+	for name, expected := range map[string]string{
+		"configdir":       "FLASHLIGHT_CONFIGDIR",
+		"dry-run":         "FLASHLIGHT_DRY_RUN",
+		"install-systemd": "FLASHLIGHT_INSTALL_SYSTEMD",
+	} {
+		if actual := envVar(name); actual != expected {
+			t.Errorf("Expected %s for -%s, got %s", expected, name, actual)
+		}
+	}
+}
+
+func TestApplyEnvironmentToHyphenatedFlag(t *testing.T) {
+	os.Setenv("FLASHLIGHT_DRY_RUN", "true")
+	defer os.Unsetenv("FLASHLIGHT_DRY_RUN")
+	defer flag.Set("dry-run", "false")
+	commandLineFlags = make(map[string]bool)
+	environmentVars = nil
+
+	if err := applyEnvironment(); err != nil {
+		t.Fatalf("Unable to apply environment: %s", err)
+	}
+	if !*dryRun {
+		t.Errorf("-dry-run should have been set from FLASHLIGHT_DRY_RUN")
+	}
+}
@@ -0,0 +1,208 @@
+// package configdir upgrades the layout of flashlight's configDir in place as
+// the files that flashlight keeps there change (separate keys, encrypted
+// stores, profiles and the like), so that upgrading flashlight doesn't break
+// existing installations.
+//
+// The configDir's layout version is kept in VERSION_FILE.  Each Migration
+// upgrades the layout by one version.  Before migrating, the files are backed
+// up to BACKUP_DIR, and if a Migration fails, they're restored from there, so
+// the configDir is left at the last version that migrated successfully.
+package configdir
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	VERSION_FILE = "configversion" // holds the layout version
+	BACKUP_DIR   = "configbackup"  // holds backups of the files, by version (e.g. configbackup/v1)
+)
+
+// Migration upgrades the configDir from version To-1 to version To
+type Migration struct {
+	To          int                    // the version after migrating
+	Description string                 // what changes, for the log
+	Migrate     func(dir string) error // migrates the configDir at dir
+}
+
+// Migrator migrates a configDir to the latest version
+type Migrator struct {
+	Dir        string       // the configDir, "" meaning the current directory
+	Files      []string     // the names of the files (and directories) in Dir that belong to flashlight, which are backed up
+	Migrations []*Migration // (optional) in order of version, starting at 1
+}
+
+// Latest returns the latest version, which is the version of a new configDir
+func (migrator *Migrator) Latest() int {
+	if len(migrator.Migrations) == 0 {
+		return 0
+	}
+	return migrator.Migrations[len(migrator.Migrations)-1].To
+}
+
+// Current returns the configDir's current version.  A configDir without a
+// VERSION_FILE is at version 0, or at the Latest version if it's new (none of
+// the Files exist).
+func (migrator *Migrator) Current() (int, error) {
+	data, err := ioutil.ReadFile(migrator.path(VERSION_FILE))
+	if err == nil {
+		version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %s: %s", migrator.path(VERSION_FILE), err)
+		}
+		return version, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, fmt.Errorf("Unable to read %s: %s", migrator.path(VERSION_FILE), err)
+	}
+	for _, name := range migrator.Files {
+		if _, err := os.Lstat(migrator.path(name)); err == nil {
+			return 0, nil
+		}
+	}
+	return migrator.Latest(), nil
+}
+
+// Migrate migrates the configDir to the Latest version.  The backup of the
+// version that it started at is kept, so that users can go back to an older
+// flashlight by hand.
+func (migrator *Migrator) Migrate() error {
+	for i, migration := range migrator.Migrations {
+		if migration.To != i+1 {
+			return fmt.Errorf("Migration to version %d is out of order", migration.To)
+		}
+	}
+	current, err := migrator.Current()
+	if err != nil {
+		return err
+	}
+	latest := migrator.Latest()
+	if current > latest {
+		return fmt.Errorf("configDir is at version %d, which is newer than this flashlight supports (%d)", current, latest)
+	}
+	if current == latest {
+		if _, err := os.Stat(migrator.path(VERSION_FILE)); err == nil {
+			return nil
+		}
+		// Stamp configDirs that have no version yet
+		return migrator.setVersion(latest)
+	}
+
+	start := current
+	for _, migration := range migrator.Migrations[current:] {
+		log.Debugf("Migrating configDir to version %d: %s", migration.To, migration.Description)
+		backup := migrator.backupPath(current)
+		if err := migrator.backUp(backup); err != nil {
+			return err
+		}
+		if err := migration.Migrate(migrator.Dir); err != nil {
+			if restoreErr := migrator.restore(backup); restoreErr != nil {
+				return fmt.Errorf("Unable to migrate configDir to version %d: %s, and unable to restore version %d from %s: %s", migration.To, err, current, backup, restoreErr)
+			}
+			return fmt.Errorf("Unable to migrate configDir to version %d, restored version %d: %s", migration.To, current, err)
+		}
+		if err := migrator.setVersion(migration.To); err != nil {
+			return err
+		}
+		if current != start {
+			os.RemoveAll(backup)
+		}
+		current = migration.To
+	}
+	log.Debugf("Migrated configDir from version %d to %d, backup in %s", start, current, migrator.backupPath(start))
+	return nil
+}
+
+func (migrator *Migrator) path(name string) string {
+	return filepath.Join(migrator.Dir, name)
+}
+
+func (migrator *Migrator) backupPath(version int) string {
+	return filepath.Join(migrator.Dir, BACKUP_DIR, fmt.Sprintf("v%d", version))
+}
+
+func (migrator *Migrator) setVersion(version int) error {
+	if err := ioutil.WriteFile(migrator.path(VERSION_FILE), []byte(strconv.Itoa(version)+"\n"), 0644); err != nil {
+		return fmt.Errorf("Unable to save configDir version: %s", err)
+	}
+	return nil
+}
+
+// backUp copies the Files to backup, replacing any previous backup there
+func (migrator *Migrator) backUp(backup string) error {
+	if err := os.RemoveAll(backup); err != nil {
+		return fmt.Errorf("Unable to remove old backup %s: %s", backup, err)
+	}
+	if err := os.MkdirAll(backup, 0700); err != nil {
+		return fmt.Errorf("Unable to create backup %s: %s", backup, err)
+	}
+	for _, name := range migrator.Files {
+		if err := copyPath(migrator.path(name), filepath.Join(backup, name)); err != nil {
+			return fmt.Errorf("Unable to back up %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// restore replaces the Files with those in backup
+func (migrator *Migrator) restore(backup string) error {
+	for _, name := range migrator.Files {
+		if err := os.RemoveAll(migrator.path(name)); err != nil {
+			return err
+		}
+		if err := copyPath(filepath.Join(backup, name), migrator.path(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyPath copies the file or directory (recursively) at src to dst.  Copying
+// something that doesn't exist does nothing.
+func copyPath(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == src {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,91 @@
+package configdir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testMigrator(t *testing.T, migrations ...*Migration) (*Migrator, func()) {
+	dir, err := ioutil.TempDir("", "configdir")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	return &Migrator{Dir: dir, Files: []string{"key.pem", "store"}, Migrations: migrations}, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Unable to write %s: %s", path, err)
+	}
+}
+
+func readFile(path string) string {
+	data, _ := ioutil.ReadFile(path)
+	return string(data)
+}
+
+// renameKey is a migration that moves key.pem into the store
+var renameKey = &Migration{To: 1, Description: "Move key into store", Migrate: func(dir string) error {
+	return os.Rename(filepath.Join(dir, "key.pem"), filepath.Join(dir, "store", "key.pem"))
+}}
+
+func TestMigrate(t *testing.T) {
+	fail := &Migration{To: 2, Description: "Fail halfway", Migrate: func(dir string) error {
+		writeFile(t, filepath.Join(dir, "store", "key.pem"), "garbage")
+		return fmt.Errorf("out of space")
+	}}
+	migrator, cleanup := testMigrator(t, renameKey, fail)
+	defer cleanup()
+	writeFile(t, filepath.Join(migrator.Dir, "key.pem"), "key")
+	writeFile(t, filepath.Join(migrator.Dir, "store", "doc.json"), "{}")
+
+	if err := migrator.Migrate(); err == nil {
+		t.Fatalf("Expected failing migration to fail")
+	}
+	if current, _ := migrator.Current(); current != 1 {
+		t.Errorf("Expected to stay at version 1, got %d", current)
+	}
+	if key := readFile(filepath.Join(migrator.Dir, "store", "key.pem")); key != "key" {
+		t.Errorf("Expected version 1 to be restored, key is %q", key)
+	}
+	if doc := readFile(filepath.Join(migrator.Dir, "store", "doc.json")); doc != "{}" {
+		t.Errorf("Expected store to be restored, doc is %q", doc)
+	}
+	if key := readFile(filepath.Join(migrator.Dir, BACKUP_DIR, "v0", "key.pem")); key != "key" {
+		t.Errorf("Expected backup of version 0 to be kept, key is %q", key)
+	}
+
+	// Once fixed, migrating picks up where it left off
+	fail.Migrate = func(dir string) error { return nil }
+	if err := migrator.Migrate(); err != nil {
+		t.Fatalf("Unable to migrate: %s", err)
+	}
+	if current, _ := migrator.Current(); current != 2 {
+		t.Errorf("Expected version 2, got %d", current)
+	}
+
+	migrator.Migrations = migrator.Migrations[:1]
+	if err := migrator.Migrate(); err == nil {
+		t.Errorf("Expected error migrating a configDir newer than we support")
+	}
+}
+
+func TestNewConfigDir(t *testing.T) {
+	migrator, cleanup := testMigrator(t, renameKey)
+	defer cleanup()
+	if err := migrator.Migrate(); err != nil {
+		t.Fatalf("Unable to migrate: %s", err)
+	}
+	if version := readFile(filepath.Join(migrator.Dir, VERSION_FILE)); version != "1\n" {
+		t.Errorf("Expected new configDir to be stamped with the latest version, got %q", version)
+	}
+	if _, err := os.Stat(filepath.Join(migrator.Dir, BACKUP_DIR)); !os.IsNotExist(err) {
+		t.Errorf("Expected no backup for a new configDir")
+	}
+}
@@ -0,0 +1,59 @@
+// package configfile loads configuration files in JSON or YAML into Go
+// values, the way encoding/json does.  Files ending in .yaml or .yml are
+// parsed as YAML, anything else as JSON.
+//
+// Only a subset of YAML is supported, which is enough for configuration:
+// block mappings and sequences (indented with spaces), plain, single-quoted
+// and double-quoted scalars, flow sequences of scalars like [a, b] and
+// comments.  Anchors, tags, multi-line scalars and multiple documents aren't
+// supported.  For example:
+//
+//	role: client
+//	listeners:
+//	  http: 127.0.0.1:8787
+//	upstreams:
+//	  - fl1.example.org # preferred
+//	  - fl2.example.org
+//	protocols: [cloudflare, azure]
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Load loads the configuration file with the given name into v, which is
+// decoded like JSON.  Keys that don't correspond to anything in v are
+// reported as errors, since they're most likely typos.
+func Load(filename string, v interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to read config file %s: %s", filename, err)
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".yaml" || ext == ".yml" {
+		doc, err := ParseYAML(data)
+		if err != nil {
+			return fmt.Errorf("Unable to parse config file %s: %s", filename, err)
+		}
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("Unable to convert config file %s: %s", filename, err)
+		}
+	}
+	if err := Decode(data, v); err != nil {
+		return fmt.Errorf("Unable to decode config file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// Decode decodes the given configuration in JSON into v, like Load
+func Decode(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,114 @@
+package configfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const TEST_YAML = `
+# A client
+role: client
+listeners:
+  http: 127.0.0.1:8787   # the browser's proxy
+  socks: ""
+upstreams:
+- fl1.example.org
+- 'fl2.example.org'
+protocols: [cloudflare, azure]
+flags:
+  maxidleconns: 4
+  smartrouting: true
+  idleconntimeout: 30s
+`
+
+func TestParseYAML(t *testing.T) {
+	doc, err := ParseYAML([]byte(TEST_YAML))
+	if err != nil {
+		t.Fatalf("Unable to parse: %s", err)
+	}
+	expected := map[string]interface{}{
+		"role": "client",
+		"listeners": map[string]interface{}{
+			"http":  "127.0.0.1:8787",
+			"socks": "",
+		},
+		"upstreams": []interface{}{"fl1.example.org", "fl2.example.org"},
+		"protocols": []interface{}{"cloudflare", "azure"},
+		"flags": map[string]interface{}{
+			"maxidleconns":    float64(4),
+			"smartrouting":    true,
+			"idleconntimeout": "30s",
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("Unexpected document: %#v", doc)
+	}
+}
+
+func TestParseYAMLListOfMaps(t *testing.T) {
+	doc, err := ParseYAML([]byte("servers:\n  - host: a\n    port: 1\n  - host: b\n"))
+	if err != nil {
+		t.Fatalf("Unable to parse: %s", err)
+	}
+	expected := map[string]interface{}{
+		"servers": []interface{}{
+			map[string]interface{}{"host": "a", "port": float64(1)},
+			map[string]interface{}{"host": "b"},
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("Unexpected document: %#v", doc)
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, bad := range []string{
+		"a: 1\n   b: 2\n",
+		"a: 1\na: 2\n",
+		"a: &anchor 1\n",
+		"a: \"unterminated\n",
+	} {
+		if _, err := ParseYAML([]byte(bad)); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type config struct {
+		Role      string   `json:"role"`
+		Upstreams []string `json:"upstreams"`
+	}
+	for name, content := range map[string]string{
+		"config.yaml": "role: server\nupstreams: [a]\n",
+		"config.json": `{"role": "server", "upstreams": ["a"]}`,
+	} {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var c config
+		if err := Load(filename, &c); err != nil {
+			t.Fatalf("Unable to load %s: %s", name, err)
+		}
+		if c.Role != "server" || len(c.Upstreams) != 1 {
+			t.Errorf("Unexpected config from %s: %+v", name, c)
+		}
+	}
+
+	filename := filepath.Join(dir, "typo.yaml")
+	ioutil.WriteFile(filename, []byte("rol: server\n"), 0600)
+	var c config
+	if err := Load(filename, &c); err == nil {
+		t.Error("Unknown keys should be reported")
+	}
+}
@@ -0,0 +1,245 @@
+package configfile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// line is a non-blank line of YAML with its comment removed
+type line struct {
+	num    int // 1-based line number, for errors
+	indent int
+	text   string
+}
+
+// ParseYAML parses the supported subset of YAML (see the package doc) into
+// map[string]interface{}, []interface{}, string, bool, float64 and nil
+// values, like encoding/json would for the equivalent JSON.
+func ParseYAML(data []byte) (interface{}, error) {
+	lines, err := splitLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	doc, pos, err := parseNode(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if pos < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[pos].num)
+	}
+	return doc, nil
+}
+
+func splitLines(data string) ([]*line, error) {
+	var lines []*line
+	for i, text := range strings.Split(data, "\n") {
+		text = strings.TrimRight(stripComment(text), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" {
+			continue
+		}
+		if trimmed == "---" && len(lines) == 0 {
+			// Document start marker
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", i+1)
+		}
+		lines = append(lines, &line{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	return lines, nil
+}
+
+// stripComment removes a # comment (one that starts the line or follows
+// whitespace, outside of quotes) from the given line
+func stripComment(text string) string {
+	var quote rune
+	for i, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// parseNode parses the block starting at lines[pos], which is indented by
+// indent, returning its value and the position following it
+func parseNode(lines []*line, pos int, indent int) (interface{}, int, error) {
+	l := lines[pos]
+	if isListItem(l.text) {
+		return parseList(lines, pos, indent)
+	}
+	if _, _, ok := splitKey(l.text); ok {
+		return parseMap(lines, pos, indent)
+	}
+	value, err := parseScalar(l.text)
+	if err != nil {
+		return nil, pos, fmt.Errorf("line %d: %s", l.num, err)
+	}
+	return value, pos + 1, nil
+}
+
+func parseList(lines []*line, pos int, indent int) (interface{}, int, error) {
+	list := []interface{}{}
+	for pos < len(lines) && lines[pos].indent == indent && isListItem(lines[pos].text) {
+		l := lines[pos]
+		rest := strings.TrimLeft(l.text[1:], " ")
+		var value interface{}
+		var err error
+		if rest == "" {
+			// The item is the block on the following lines
+			pos++
+			if pos < len(lines) && lines[pos].indent > indent {
+				value, pos, err = parseNode(lines, pos, lines[pos].indent)
+			}
+		} else {
+			// The item starts on this line, so treat its content as a
+			// line of its own that's indented past the dash
+			itemIndent := indent + len(l.text) - len(rest)
+			item := &line{num: l.num, indent: itemIndent, text: rest}
+			value, pos, err = parseNode(replaceLine(lines, pos, item), pos, itemIndent)
+		}
+		if err != nil {
+			return nil, pos, err
+		}
+		list = append(list, value)
+	}
+	if pos < len(lines) && lines[pos].indent > indent {
+		return nil, pos, fmt.Errorf("line %d: unexpected indentation", lines[pos].num)
+	}
+	return list, pos, nil
+}
+
+func parseMap(lines []*line, pos int, indent int) (interface{}, int, error) {
+	m := make(map[string]interface{})
+	for pos < len(lines) && lines[pos].indent == indent {
+		l := lines[pos]
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			return nil, pos, fmt.Errorf("line %d: expected key: value", l.num)
+		}
+		if _, exists := m[key]; exists {
+			return nil, pos, fmt.Errorf("line %d: duplicate key %s", l.num, key)
+		}
+		var value interface{}
+		var err error
+		pos++
+		if rest != "" {
+			value, err = parseScalar(rest)
+			if err != nil {
+				return nil, pos, fmt.Errorf("line %d: %s", l.num, err)
+			}
+		} else if pos < len(lines) && (lines[pos].indent > indent || lines[pos].indent == indent && isListItem(lines[pos].text)) {
+			// The value is the block on the following lines, sequences
+			// may be at the same indentation as their key
+			value, pos, err = parseNode(lines, pos, lines[pos].indent)
+			if err != nil {
+				return nil, pos, err
+			}
+		}
+		m[key] = value
+	}
+	if pos < len(lines) && lines[pos].indent > indent {
+		return nil, pos, fmt.Errorf("line %d: unexpected indentation", lines[pos].num)
+	}
+	return m, pos, nil
+}
+
+// replaceLine returns a copy of lines with the line at pos replaced
+func replaceLine(lines []*line, pos int, l *line) []*line {
+	replaced := make([]*line, len(lines))
+	copy(replaced, lines)
+	replaced[pos] = l
+	return replaced
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits a "key: value" line into its (unquoted) key and value
+func splitKey(text string) (string, string, bool) {
+	var quote rune
+	for i, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 {
+				quote = c
+			}
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key, err := parseScalar(strings.TrimSpace(text[:i]))
+			if err != nil {
+				return "", "", false
+			}
+			return fmt.Sprint(key), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// parseScalar parses a scalar or a flow sequence of scalars
+func parseScalar(text string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		if !strings.HasSuffix(text, `"`) || len(text) < 2 {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s: %s", text, err)
+		}
+		return s, nil
+	case strings.HasPrefix(text, "'"):
+		if !strings.HasSuffix(text, "'") || len(text) < 2 {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated sequence %s", text)
+		}
+		list := []interface{}{}
+		inner := strings.TrimSpace(text[1 : len(text)-1])
+		if inner == "" {
+			return list, nil
+		}
+		for _, item := range strings.Split(inner, ",") {
+			value, err := parseScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case strings.HasPrefix(text, "{"), strings.HasPrefix(text, "&"), strings.HasPrefix(text, "*"),
+		strings.HasPrefix(text, "!"), strings.HasPrefix(text, "|"), strings.HasPrefix(text, ">"):
+		return nil, fmt.Errorf("unsupported YAML %s", text)
+	}
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if n, err := strconv.ParseFloat(text, 64); err == nil && !strings.ContainsAny(text, "xXnN") {
+		return n, nil
+	}
+	return text, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/getlantern/flashlight/handoff"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/systemd"
+)
+
+const (
+	REDACTED = "<redacted>" // value reported by the admin API in place of secrets
+)
+
+// SECRET_FLAGS are the flags whose values can contain tokens or credentials,
+// which the admin API doesn't reveal
+var SECRET_FLAGS = map[string]bool{
+	"acmedns":           true,
+	"admintoken":        true,
+	"authtoken":         true,
+	"capabilitiestoken": true,
+	"crashreporttoken":  true,
+	"ddns":              true,
+	"egressroutes":      true,
+	"feedbacktoken":     true,
+	"influx":            true,
+	"shiplogstoken":     true,
+	"storepassphrase":   true,
+	"tenanttoken":       true,
+	"upstreamproxy":     true,
+	"webhook":           true,
+}
+
+// adminControl lets the admin API report our flags, reload our configuration
+// (like SIGHUP), stop us (like SIGTERM) and wipe our data (like -wipe)
+func adminControl(proxyClient *proxy.Client) *proxy.Control {
+	return &proxy.Control{
+		Config: currentFlags,
+		Reload: func() error {
+			return reload(proxyClient.Rules)
+		},
+		Stop: func() {
+			log.Debug("Stopping at the request of the admin API")
+			stop()
+		},
+		Wipe: func() {
+			log.Debug("Wiping at the request of the admin API")
+			panicWipe()
+		},
+	}
+}
+
+// stop shuts down gracefully, as on SIGTERM, and exits
+func stop() {
+	if !handoff.Restarting() {
+		// Otherwise the new process is taking over from us
+		if err := systemd.Stopping(); err != nil {
+			log.Debug(err)
+		}
+	}
+	runShutdownHooks()
+	os.Exit(0)
+}
+
+// currentFlags returns the current values of all flags, by name, with the
+// values of SECRET_FLAGS redacted
+func currentFlags() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if SECRET_FLAGS[f.Name] && value != "" {
+			value = REDACTED
+		}
+		values[f.Name] = value
+	})
+	return values
+}
+
+// changedFlags returns the values of the flags that differ from their
+// defaults, by name, with the values of SECRET_FLAGS redacted
+func changedFlags() map[string]string {
+	values := currentFlags()
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == f.DefValue {
+			delete(values, f.Name)
+		}
+	})
+	return values
+}
@@ -0,0 +1,305 @@
+// package crash captures panics in flashlight's long-running goroutines,
+// writing a crash dump to Dir before letting the panic crash the process as
+// usual, so that crashes in the field don't go unnoticed.  Dumps are JSON,
+// for example:
+//
+//	{
+//	  "time": "2015-03-01T12:00:00Z",
+//	  "version": "2.1.0",
+//	  "os": "windows",
+//	  "arch": "amd64",
+//	  "goversion": "go1.4.2",
+//	  "panic": "runtime error: invalid memory address or nil pointer dereference",
+//	  "stack": "goroutine 23 [running]:\n...",
+//	  "config": {"role": "client", "tenanttoken": "<redacted>"},
+//	  "fingerprint": "9c1d0b6a3e2f4d58"
+//	}
+//
+// config is whatever Config returns (flashlight passes its non-default flags,
+// with secrets redacted), and fingerprint is a hash of it, so that crashes
+// can be grouped by configuration.
+//
+// Since the process is crashing, dumps aren't submitted right away.  Instead,
+// Start submits the dumps left by previous runs to URL (through the tunnel, on
+// clients), marking them as sent.
+package crash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	MAX_DUMPS       = 10 // how many dumps we keep in Dir, pending or sent
+	SUBMIT_TIMEOUT  = 30 * time.Second
+	SUBMIT_INTERVAL = 1 * time.Hour // how often to retry submitting dumps that couldn't be submitted
+
+	X_LANTERN_CRASH_TOKEN = "X-Lantern-Crash-Token" // header carrying the Reporter's Token
+
+	pendingSuffix = ".json"
+	sentSuffix    = ".sent"
+)
+
+var (
+	current      *Reporter
+	currentMutex sync.Mutex
+)
+
+// Dump is what's written for a crash, and submitted
+type Dump struct {
+	Time        time.Time         `json:"time"`
+	Version     string            `json:"version"`
+	OS          string            `json:"os"`
+	Arch        string            `json:"arch"`
+	GoVersion   string            `json:"goversion"`
+	Panic       string            `json:"panic"`
+	Stack       string            `json:"stack"`
+	Config      map[string]string `json:"config,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+}
+
+// Reporter writes and submits crash dumps
+type Reporter struct {
+	Dir     string                   // where to write dumps
+	Version string                   // (optional) our version
+	Config  func() map[string]string // (optional) our configuration, without secrets
+	URL     string                   // (optional) where to POST dumps
+	Token   string                   // (optional) sent in the X-Lantern-Crash-Token header
+
+	httpClient *http.Client
+	stop       chan bool
+	stopMutex  sync.Mutex
+}
+
+// Install makes this the Reporter that writes dumps when Recover recovers a
+// panic
+func (reporter *Reporter) Install() {
+	currentMutex.Lock()
+	current = reporter
+	currentMutex.Unlock()
+}
+
+// Recover writes a crash dump with the installed Reporter, if any, when the
+// goroutine that deferred it panics, and then panics again.  It must be
+// deferred directly, e.g. at the top of a goroutine:
+//
+//	defer crash.Recover()
+func Recover() {
+	p := recover()
+	if p == nil {
+		return
+	}
+	currentMutex.Lock()
+	reporter := current
+	currentMutex.Unlock()
+	if reporter != nil {
+		if path, err := reporter.write(p, debug.Stack()); err != nil {
+			log.Errorf("Unable to write crash dump: %s", err)
+		} else {
+			log.Errorf("Crashed, wrote crash dump to %s", path)
+		}
+	}
+	panic(p)
+}
+
+// Go runs f in a new goroutine that writes a crash dump if it panics
+func Go(f func()) {
+	go func() {
+		defer Recover()
+		f()
+	}()
+}
+
+// write writes a dump for the given panic and stack, and prunes old dumps
+func (reporter *Reporter) write(p interface{}, stack []byte) (string, error) {
+	dump := &Dump{
+		Time:      time.Now().UTC(),
+		Version:   reporter.Version,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		GoVersion: runtime.Version(),
+		Panic:     fmt.Sprint(p),
+		Stack:     string(stack),
+	}
+	if reporter.Config != nil {
+		dump.Config = reporter.Config()
+		dump.Fingerprint = Fingerprint(dump.Config)
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Unable to encode crash dump: %s", err)
+	}
+	if err := os.MkdirAll(reporter.Dir, 0700); err != nil {
+		return "", fmt.Errorf("Unable to create %s: %s", reporter.Dir, err)
+	}
+	path := filepath.Join(reporter.Dir, fmt.Sprintf("crash-%d%s", dump.Time.UnixNano(), pendingSuffix))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("Unable to write %s: %s", path, err)
+	}
+	reporter.prune()
+	return path, nil
+}
+
+// prune removes the oldest dumps beyond MAX_DUMPS
+func (reporter *Reporter) prune() {
+	dumps, err := reporter.dumps(pendingSuffix, sentSuffix)
+	if err != nil {
+		return
+	}
+	for len(dumps) > MAX_DUMPS {
+		os.Remove(dumps[0])
+		dumps = dumps[1:]
+	}
+}
+
+// dumps returns the paths of the dumps in Dir with any of the given
+// suffixes, oldest first
+func (reporter *Reporter) dumps(suffixes ...string) ([]string, error) {
+	infos, err := ioutil.ReadDir(reporter.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, "crash-") {
+			continue
+		}
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(name, suffix) {
+				paths = append(paths, filepath.Join(reporter.Dir, name))
+				break
+			}
+		}
+	}
+	// Names sort by time, since the timestamps have the same number of digits
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Start submits the dumps left by previous runs to URL in the background,
+// dialing with the given function (e.g. through the tunnel, or nil to dial
+// directly), and retries every SUBMIT_INTERVAL until they're all submitted
+// or Stop.
+// It does nothing without a URL.
+func (reporter *Reporter) Start(dial func(network, addr string) (net.Conn, error)) {
+	if reporter.URL == "" {
+		return
+	}
+	transport := &http.Transport{}
+	if dial != nil {
+		transport.Dial = dial
+	}
+	reporter.httpClient = &http.Client{Timeout: SUBMIT_TIMEOUT, Transport: transport}
+	stop := make(chan bool)
+	reporter.stopMutex.Lock()
+	reporter.stop = stop
+	reporter.stopMutex.Unlock()
+	go func() {
+		for {
+			n, err := reporter.submitPending()
+			if err == nil {
+				if n > 0 {
+					log.Debugf("Submitted %d crash dump(s)", n)
+				}
+				return
+			}
+			log.Debugf("Unable to submit crash dumps: %s", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(SUBMIT_INTERVAL):
+			}
+		}
+	}()
+}
+
+// Stop stops retrying to submit dumps.  Dumps are still written.  It is safe
+// to call on a nil or stopped Reporter.
+func (reporter *Reporter) Stop() {
+	if reporter == nil {
+		return
+	}
+	reporter.stopMutex.Lock()
+	defer reporter.stopMutex.Unlock()
+	if reporter.stop != nil {
+		close(reporter.stop)
+		reporter.stop = nil
+	}
+}
+
+// submitPending submits the dumps that haven't been sent yet, marking each
+// as sent, and returns how many it submitted
+func (reporter *Reporter) submitPending() (int, error) {
+	pending, err := reporter.dumps(pendingSuffix)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to list crash dumps: %s", err)
+	}
+	for i, path := range pending {
+		if err := reporter.submit(path); err != nil {
+			return i, err
+		}
+		if err := os.Rename(path, strings.TrimSuffix(path, pendingSuffix)+sentSuffix); err != nil {
+			return i, fmt.Errorf("Unable to mark %s as sent: %s", path, err)
+		}
+	}
+	return len(pending), nil
+}
+
+// submit POSTs the dump at path to URL
+func (reporter *Reporter) submit(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read %s: %s", path, err)
+	}
+	req, err := http.NewRequest("POST", reporter.URL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if reporter.Token != "" {
+		req.Header.Set(X_LANTERN_CRASH_TOKEN, reporter.Token)
+	}
+	resp, err := reporter.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to post %s: %s", path, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response status posting %s: %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+// Fingerprint hashes the given configuration, regardless of order
+func Fingerprint(config map[string]string) string {
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s=%s\n", name, config[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
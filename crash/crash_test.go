@@ -0,0 +1,87 @@
+package crash
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reporter := &Reporter{
+		Dir:     dir,
+		Version: "1.2.3",
+		Config: func() map[string]string {
+			return map[string]string{"role": "client", "tenanttoken": "<redacted>"}
+		},
+	}
+	reporter.Install()
+	defer (*Reporter)(nil).Install()
+
+	var repanicked interface{}
+	func() {
+		defer func() {
+			repanicked = recover()
+		}()
+		defer Recover()
+		panic("boom")
+	}()
+	if repanicked != "boom" {
+		t.Errorf("Recover should panic again, got %v", repanicked)
+	}
+	pending, _ := reporter.dumps(pendingSuffix)
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 pending dump, got %d", len(pending))
+	}
+
+	var submitted []*Dump
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(X_LANTERN_CRASH_TOKEN) != "token" {
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		dump := &Dump{}
+		json.NewDecoder(req.Body).Decode(dump)
+		submitted = append(submitted, dump)
+	}))
+	defer server.Close()
+	reporter.URL = server.URL
+	reporter.Token = "token"
+	reporter.httpClient = &http.Client{}
+	if n, err := reporter.submitPending(); n != 1 || err != nil {
+		t.Fatalf("Expected to submit 1 dump, got %d, %v", n, err)
+	}
+	dump := submitted[0]
+	if dump.Panic != "boom" || dump.Version != "1.2.3" || !strings.Contains(dump.Stack, "TestCrash") || dump.Fingerprint != Fingerprint(dump.Config) {
+		t.Errorf("Unexpected dump: %+v", dump)
+	}
+	if n, _ := reporter.submitPending(); n != 0 {
+		t.Errorf("Sent dumps shouldn't be submitted again")
+	}
+
+	for i := 0; i < MAX_DUMPS+5; i++ {
+		if _, err := reporter.write("boom", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if all, _ := reporter.dumps(pendingSuffix, sentSuffix); len(all) != MAX_DUMPS {
+		t.Errorf("Expected %d dumps after pruning, got %d", MAX_DUMPS, len(all))
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := Fingerprint(map[string]string{"role": "client", "addr": ":8787"})
+	b := Fingerprint(map[string]string{"addr": ":8787", "role": "client"})
+	c := Fingerprint(map[string]string{"addr": ":8788", "role": "client"})
+	if a != b || a == c {
+		t.Errorf("Fingerprints should depend on the config only: %s %s %s", a, b, c)
+	}
+}
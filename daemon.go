@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/handoff"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/systemd"
+)
+
+const (
+	SYSTEMD_UNIT_FILE = "/etc/systemd/system/" + SERVICE_NAME + ".service"
+	SYSTEMD_ENV_FILE  = "/etc/default/" + SERVICE_NAME // holds the SECRET_FLAGS, readable only by root
+	LAUNCHD_LABEL     = "org.getlantern." + SERVICE_NAME
+
+	readyPollInterval = 100 * time.Millisecond
+)
+
+// notifyWhenListening tells systemd that we're ready once we're listening at
+// our addresses
+func notifyWhenListening() {
+	for _, a := range roleAddrs() {
+		for !handoff.Listening(a) {
+			time.Sleep(readyPollInterval)
+		}
+	}
+	if err := systemd.Ready(); err != nil {
+		log.Error(err)
+	}
+}
+
+// installDaemon writes and loads a systemd unit (-install-systemd) or launchd
+// plist (-install-launchd) that runs this binary with our other flags, and
+// exits
+func installDaemon() {
+	var err error
+	if *installSystemd {
+		err = installSystemdUnit()
+	} else {
+		err = installLaunchdPlist()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// daemonCommand returns the absolute path of our binary, our command-line
+// arguments without the named flag and the current directory, against which
+// relative paths in the arguments resolve.  The arguments don't include the
+// SECRET_FLAGS, which are returned as environment variables (see envVar)
+// instead, so that they don't end up in world-readable files.
+func daemonCommand(flagName string) (string, []string, map[string]string, string, error) {
+	executable, err := exec.LookPath(os.Args[0])
+	if err == nil {
+		executable, err = filepath.Abs(executable)
+	}
+	if err != nil {
+		return "", nil, nil, "", fmt.Errorf("Unable to find our binary: %s", err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", nil, nil, "", fmt.Errorf("Unable to get current directory: %s", err)
+	}
+	args, secrets := splitSecretArgs(argsWithout(os.Args[1:], flagName, false))
+	return executable, args, secrets, dir, nil
+}
+
+// splitSecretArgs splits the SECRET_FLAGS out of the given command-line
+// arguments, returning the other arguments and the secrets' values by the
+// names of their environment variables
+func splitSecretArgs(args []string) ([]string, map[string]string) {
+	var public []string
+	secrets := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			// Flag parsing stops here
+			public = append(public, args[i:]...)
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		hasValue := false
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+		if !hasValue && !isBoolFlag(name) && i+1 < len(args) {
+			// The value is the next argument
+			i++
+			value = args[i]
+			if !SECRET_FLAGS[name] {
+				public = append(public, arg, value)
+				continue
+			}
+		}
+		if !SECRET_FLAGS[name] {
+			public = append(public, arg)
+			continue
+		}
+		secrets[envVar(name)] = value
+	}
+	return public, secrets
+}
+
+// isBoolFlag indicates whether the named flag is a boolean, which doesn't take
+// its value from the next argument
+func isBoolFlag(name string) bool {
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
+// writePrivateFile writes data to a new file that only its owner can read,
+// replacing any existing file, whose mode WriteFile would keep
+func writePrivateFile(filename string, data []byte) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to replace %s: %s", filename, err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", filename, err)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the given map in order, so that the files
+// that we write are reproducible
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func installSystemdUnit() error {
+	executable, args, secrets, dir, err := daemonCommand("install-systemd")
+	if err != nil {
+		return err
+	}
+	if len(secrets) > 0 {
+		if err := writePrivateFile(SYSTEMD_ENV_FILE, []byte(systemdEnvironment(secrets))); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", SYSTEMD_ENV_FILE)
+	} else if err := os.Remove(SYSTEMD_ENV_FILE); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove %s: %s", SYSTEMD_ENV_FILE, err)
+	}
+	if err := ioutil.WriteFile(SYSTEMD_UNIT_FILE, []byte(systemdUnit(executable, args, len(secrets) > 0, dir)), 0644); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", SYSTEMD_UNIT_FILE, err)
+	}
+	fmt.Printf("Wrote %s\n", SYSTEMD_UNIT_FILE)
+	if err := runCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runCommand("systemctl", "enable", "--now", SERVICE_NAME)
+}
+
+// systemdUnit returns a unit of Type=notify that runs the given command in
+// dir, with the SYSTEMD_ENV_FILE if withSecrets.  NotifyAccess=all lets
+// processes that we restart into (on SIGUSR2 or updates) take over as the
+// main process.
+func systemdUnit(executable string, args []string, withSecrets bool, dir string) string {
+	command := []string{systemdQuote(executable)}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+	environmentFile := ""
+	if withSecrets {
+		environmentFile = "EnvironmentFile=" + SYSTEMD_ENV_FILE + "\n"
+	}
+	return fmt.Sprintf(`[Unit]
+Description=%s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=all
+%sExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+WorkingDirectory=%s
+Restart=on-failure
+TimeoutStopSec=%d
+
+[Install]
+WantedBy=multi-user.target
+`, SERVICE_DESCRIPTION, environmentFile, strings.Join(command, " "), strings.Replace(dir, "%", "%%", -1), int((*drainTimeout+30*time.Second)/time.Second))
+}
+
+// systemdQuote quotes an argument for ExecStart, escaping specifiers and
+// variables
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(arg)
+	return `"` + arg + `"`
+}
+
+// systemdEnvironment returns an EnvironmentFile that sets the given variables
+func systemdEnvironment(vars map[string]string) string {
+	var lines []string
+	for _, name := range sortedKeys(vars) {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(vars[name])
+		lines = append(lines, name+`="`+value+`"`)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func installLaunchdPlist() error {
+	executable, args, secrets, dir, err := daemonCommand("install-launchd")
+	if err != nil {
+		return err
+	}
+	filename := launchdPlistFile()
+	plist := []byte(launchdPlist(append([]string{executable}, args...), secrets, dir))
+	if len(secrets) > 0 {
+		// The plist carries the secrets in its EnvironmentVariables
+		err = writePrivateFile(filename, plist)
+	} else if err = ioutil.WriteFile(filename, plist, 0644); err != nil {
+		err = fmt.Errorf("Unable to write %s: %s", filename, err)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", filename)
+	// Unload any previous version, which fails if there's none
+	exec.Command("launchctl", "unload", filename).Run()
+	return runCommand("launchctl", "load", "-w", filename)
+}
+
+// launchdPlistFile returns where to install our plist, as a daemon when
+// running as root and as an agent of the current user otherwise
+func launchdPlistFile() string {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/Library/LaunchDaemons", LAUNCHD_LABEL+".plist")
+	}
+	return filepath.Join(os.Getenv("HOME"), "Library/LaunchAgents", LAUNCHD_LABEL+".plist")
+}
+
+// launchdPlist returns a plist that keeps the given command running in dir
+// with the given environment variables
+func launchdPlist(command []string, env map[string]string, dir string) string {
+	var arguments []string
+	for _, arg := range command {
+		arguments = append(arguments, "\t\t<string>"+xmlEscape(arg)+"</string>")
+	}
+	environment := ""
+	if len(env) > 0 {
+		environment = "\t<key>EnvironmentVariables</key>\n\t<dict>\n"
+		for _, name := range sortedKeys(env) {
+			environment += "\t\t<key>" + xmlEscape(name) + "</key>\n\t\t<string>" + xmlEscape(env[name]) + "</string>\n"
+		}
+		environment += "\t</dict>\n"
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s
+	</array>
+%s	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ExitTimeOut</key>
+	<integer>%d</integer>
+</dict>
+</plist>
+`, LAUNCHD_LABEL, strings.Join(arguments, "\n"), environment, xmlEscape(dir), int((*drainTimeout+30*time.Second)/time.Second))
+}
+
+func xmlEscape(s string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// runCommand runs the given command, failing with its output if it fails
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to run %s %s: %s\n%s", name, strings.Join(args, " "), err, out)
+	}
+	fmt.Printf("Ran %s %s\n", name, strings.Join(args, " "))
+	return nil
+}
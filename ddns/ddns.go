@@ -0,0 +1,166 @@
+// package ddns keeps a hostname's DNS record pointing at this machine's
+// public IP by registering it with a dynamic DNS provider, so that clients
+// configured with the hostname keep working when the server's IP changes.
+//
+// Providers are specified as URLs:
+//
+//	duckdns://<token>@duckdns.org
+//	dyndns2://<user>:<password>@<update host>   (e.g. members.dyndns.org, dynupdate.no-ip.com)
+//	cloudflare://<api token>@<zone id>
+//
+// The duckdns and cloudflare providers can also set TXT records (see
+// TXTProvider), with which ACME dns-01 challenges are answered.
+package ddns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_IP_SOURCE = "https://api.ipify.org"
+	DEFAULT_INTERVAL  = 5 * time.Minute
+	HTTP_TIMEOUT      = 30 * time.Second
+)
+
+var (
+	httpClient = &http.Client{Timeout: HTTP_TIMEOUT}
+)
+
+// Provider is a dynamic DNS provider
+type Provider interface {
+	// Update points host at the given IP
+	Update(host string, ip net.IP) error
+}
+
+// TXTProvider is a Provider that can also set TXT records, e.g. for ACME
+// dns-01 challenges (see package acmecert)
+type TXTProvider interface {
+	// SetTXT adds a TXT record with the given name and value
+	SetTXT(name string, value string) error
+
+	// ClearTXT removes the TXT record with the given name and value
+	ClearTXT(name string, value string) error
+}
+
+// Updater periodically checks our public IP and updates Host's DNS record
+// with Provider whenever the IP changes.
+type Updater struct {
+	Host     string        // FQDN to keep updated
+	Provider Provider      // provider with which to register the IP
+	Interval time.Duration // (optional) how frequently to check our public IP, defaults to DEFAULT_INTERVAL
+	IPSource string        // (optional) URL that returns our public IP as plain text, defaults to DEFAULT_IP_SOURCE
+}
+
+// ParseProvider parses a Provider from its URL (see package documentation)
+func ParseProvider(spec string) (Provider, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse dynamic dns provider %s: %s", spec, err)
+	}
+	if u.User == nil {
+		return nil, fmt.Errorf("No credentials in dynamic dns provider %s", u.Scheme)
+	}
+	switch u.Scheme {
+	case "duckdns":
+		return &DuckDNS{Token: u.User.Username()}, nil
+	case "dyndns2":
+		password, _ := u.User.Password()
+		return &DynDNS2{
+			UpdateHost: u.Host,
+			Username:   u.User.Username(),
+			Password:   password,
+		}, nil
+	case "cloudflare":
+		return &Cloudflare{Token: u.User.Username(), ZoneID: u.Host}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported dynamic dns provider: %s", u.Scheme)
+	}
+}
+
+// Start starts updating in the background
+func (updater *Updater) Start() {
+	go updater.run()
+}
+
+func (updater *Updater) run() {
+	defer crash.Recover()
+	interval := updater.Interval
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	var lastIP net.IP
+	for {
+		ip, err := updater.publicIP()
+		if err != nil {
+			log.Errorf("Unable to determine public IP for dynamic dns: %s", err)
+		} else if !ip.Equal(lastIP) {
+			err = updater.Provider.Update(updater.Host, ip)
+			if err != nil {
+				log.Errorf("Unable to update dynamic dns for %s: %s", updater.Host, err)
+			} else {
+				log.Debugf("Pointed %s at %s", updater.Host, ip)
+				lastIP = ip
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// publicIP looks up our public IP using IPSource
+func (updater *Updater) publicIP() (net.IP, error) {
+	source := updater.IPSource
+	if source == "" {
+		source = DEFAULT_IP_SOURCE
+	}
+	body, err := get(source, nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("Unexpected response from %s: %s", source, body)
+	}
+	return ip, nil
+}
+
+// get performs a GET against the given URL (optionally modifying the request
+// before sending it) and returns the response body, failing on non-200
+// statuses.
+func get(u string, modify func(req *http.Request)) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if modify != nil {
+		modify(req)
+	}
+	return do(req)
+}
+
+// do performs the given request and returns the response body, failing on
+// non-200 statuses.
+func do(req *http.Request) ([]byte, error) {
+	req.Header.Set("User-Agent", "flashlight")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to request %s: %s", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read response from %s: %s", req.URL.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response status from %s: %d %s", req.URL.Host, resp.StatusCode, body)
+	}
+	return body, nil
+}
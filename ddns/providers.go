@@ -0,0 +1,203 @@
+package ddns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	DUCKDNS_URL    = "https://www.duckdns.org/update"
+	CLOUDFLARE_URL = "https://api.cloudflare.com/client/v4"
+)
+
+const (
+	CLOUDFLARE_TXT_TTL = 120 // seconds, the minimum
+)
+
+// DuckDNS updates records at duckdns.org
+type DuckDNS struct {
+	Token string
+}
+
+func (provider *DuckDNS) Update(host string, ip net.IP) error {
+	params := url.Values{
+		"domains": {strings.TrimSuffix(host, ".duckdns.org")},
+		"token":   {provider.Token},
+	}
+	if ip.To4() != nil {
+		params.Set("ip", ip.String())
+	} else {
+		params.Set("ipv6", ip.String())
+	}
+	body, err := get(DUCKDNS_URL+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(body, []byte("OK")) {
+		return fmt.Errorf("duckdns rejected update: %s", body)
+	}
+	return nil
+}
+
+// SetTXT sets the TXT record of the duckdns domain that name is in (duckdns
+// answers TXT queries for all of a domain's subdomains with it)
+func (provider *DuckDNS) SetTXT(name string, value string) error {
+	return provider.updateTXT(name, url.Values{"txt": {value}})
+}
+
+func (provider *DuckDNS) ClearTXT(name string, value string) error {
+	return provider.updateTXT(name, url.Values{"txt": {""}, "clear": {"true"}})
+}
+
+func (provider *DuckDNS) updateTXT(name string, params url.Values) error {
+	domain := strings.TrimSuffix(name, ".duckdns.org")
+	domain = domain[strings.LastIndex(domain, ".")+1:]
+	params.Set("domains", domain)
+	params.Set("token", provider.Token)
+	body, err := get(DUCKDNS_URL+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(body, []byte("OK")) {
+		return fmt.Errorf("duckdns rejected TXT update: %s", body)
+	}
+	return nil
+}
+
+// DynDNS2 updates records using the dyndns2 protocol, which is supported by
+// most dynamic dns providers (Dyn, No-IP, Google Domains and others).
+type DynDNS2 struct {
+	UpdateHost string // host that serves /nic/update
+	Username   string
+	Password   string
+}
+
+func (provider *DynDNS2) Update(host string, ip net.IP) error {
+	params := url.Values{
+		"hostname": {host},
+		"myip":     {ip.String()},
+	}
+	u := fmt.Sprintf("https://%s/nic/update?%s", provider.UpdateHost, params.Encode())
+	body, err := get(u, func(req *http.Request) {
+		req.SetBasicAuth(provider.Username, provider.Password)
+	})
+	if err != nil {
+		return err
+	}
+	// Response is "good <ip>" or "nochg <ip>" on success
+	if !bytes.HasPrefix(body, []byte("good")) && !bytes.HasPrefix(body, []byte("nochg")) {
+		return fmt.Errorf("%s rejected update: %s", provider.UpdateHost, body)
+	}
+	return nil
+}
+
+// Cloudflare updates an existing A or AAAA record in a Cloudflare zone using
+// an API token with DNS edit permission.
+type Cloudflare struct {
+	Token  string
+	ZoneID string
+}
+
+// cloudflareResponse is the envelope of Cloudflare API responses
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Result  []struct {
+		ID string `json:"id"`
+	} `json:"result"`
+}
+
+func (provider *Cloudflare) Update(host string, ip net.IP) error {
+	recordType := "A"
+	if ip.To4() == nil {
+		recordType = "AAAA"
+	}
+	recordsURL := provider.recordsURL()
+	body, err := get(recordsURL+"?"+url.Values{"type": {recordType}, "name": {host}}.Encode(), provider.authorize)
+	if err != nil {
+		return err
+	}
+	records := &cloudflareResponse{}
+	err = json.Unmarshal(body, records)
+	if err != nil {
+		return fmt.Errorf("Unable to parse cloudflare dns records: %s", err)
+	}
+	if len(records.Result) == 0 {
+		return fmt.Errorf("No %s record for %s in cloudflare zone %s", recordType, host, provider.ZoneID)
+	}
+
+	update, err := json.Marshal(map[string]interface{}{
+		"type":    recordType,
+		"name":    host,
+		"content": ip.String(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", recordsURL+"/"+records.Result[0].ID, bytes.NewReader(update))
+	if err != nil {
+		return err
+	}
+	provider.authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	_, err = do(req)
+	return err
+}
+
+// SetTXT creates a TXT record in the zone
+func (provider *Cloudflare) SetTXT(name string, value string) error {
+	create, err := json.Marshal(map[string]interface{}{
+		"type":    "TXT",
+		"name":    name,
+		"content": value,
+		"ttl":     CLOUDFLARE_TXT_TTL,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", provider.recordsURL(), bytes.NewReader(create))
+	if err != nil {
+		return err
+	}
+	provider.authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	_, err = do(req)
+	return err
+}
+
+// ClearTXT deletes the TXT records with the given name and value from the
+// zone
+func (provider *Cloudflare) ClearTXT(name string, value string) error {
+	body, err := get(provider.recordsURL()+"?"+url.Values{"type": {"TXT"}, "name": {name}, "content": {value}}.Encode(), provider.authorize)
+	if err != nil {
+		return err
+	}
+	records := &cloudflareResponse{}
+	err = json.Unmarshal(body, records)
+	if err != nil {
+		return fmt.Errorf("Unable to parse cloudflare dns records: %s", err)
+	}
+	for _, record := range records.Result {
+		req, err := http.NewRequest("DELETE", provider.recordsURL()+"/"+record.ID, nil)
+		if err != nil {
+			return err
+		}
+		provider.authorize(req)
+		if _, err := do(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (provider *Cloudflare) recordsURL() string {
+	return fmt.Sprintf("%s/zones/%s/dns_records", CLOUDFLARE_URL, provider.ZoneID)
+}
+
+func (provider *Cloudflare) authorize(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+provider.Token)
+}
@@ -0,0 +1,214 @@
+// package egress implements restrictions on the destinations to which a server
+// proxy is willing to egress.
+package egress
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/flashlight/geolookup"
+)
+
+const (
+	X_LANTERN_EGRESS_POLICY = "X-Lantern-Egress-Policy" // header advertising the policy to clients
+)
+
+// Policy restricts egress by destination country and/or ASN.  Allowed lists,
+// if non-empty, are exhaustive.  Excluded lists always take precedence.
+type Policy struct {
+	AllowedCountries  []string                   `json:"allowedCountries,omitempty"`  // ISO country codes to which we will egress
+	ExcludedCountries []string                   `json:"excludedCountries,omitempty"` // ISO country codes to which we won't egress
+	AllowedASNs       []uint                     `json:"allowedASNs,omitempty"`       // ASNs to which we will egress
+	ExcludedASNs      []uint                     `json:"excludedASNs,omitempty"`      // ASNs to which we won't egress
+	CountryDatabase   *geolookup.CountryDatabase `json:"-"`                           // required if any country restrictions are configured
+	ASNDatabase       *geolookup.ASNDatabase     `json:"-"`                           // required if any ASN restrictions are configured
+}
+
+// ParsePolicy parses a policy from the form used in the
+// X-Lantern-Egress-Policy header (see String).  The result has no databases,
+// so it's only good for PermitsCountry.
+func ParsePolicy(s string) (*Policy, error) {
+	policy := &Policy{}
+	for _, field := range strings.Split(s, ";") {
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid egress policy field: %s", field)
+		}
+		var err error
+		switch parts[0] {
+		case "allow":
+			policy.AllowedCountries = splitNonEmpty(parts[1])
+		case "exclude":
+			policy.ExcludedCountries = splitNonEmpty(parts[1])
+		case "allowasn":
+			policy.AllowedASNs, err = parseUints(parts[1])
+		case "excludeasn":
+			policy.ExcludedASNs, err = parseUints(parts[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid egress policy field %s: %s", field, err)
+		}
+	}
+	return policy, nil
+}
+
+// RestrictsCountries indicates whether or not this policy restricts egress by
+// destination country, which requires a CountryDatabase.  It is safe to call
+// on a nil Policy.
+func (policy *Policy) RestrictsCountries() bool {
+	return policy != nil && (len(policy.AllowedCountries) > 0 || len(policy.ExcludedCountries) > 0)
+}
+
+// PermitsCountry indicates whether or not this policy permits egress to the
+// given country.  ASN restrictions aren't considered.  It is safe to call on a
+// nil Policy.
+func (policy *Policy) PermitsCountry(country string) bool {
+	return policy.checkCountry(country) == nil
+}
+
+// IsRestricted indicates whether or not this policy restricts anything.  It is
+// safe to call on a nil Policy.
+func (policy *Policy) IsRestricted() bool {
+	return policy != nil && (policy.RestrictsCountries() || policy.restrictsASNs())
+}
+
+// Check checks whether the given destination ip is permitted by this policy,
+// returning an error if it isn't.  Lookup failures are treated as violations.
+// Errors don't include the ip, so that they can be logged safely.  It is safe
+// to call on a nil Policy.
+func (policy *Policy) Check(ip net.IP) error {
+	if !policy.IsRestricted() {
+		return nil
+	}
+
+	if policy.RestrictsCountries() {
+		if policy.CountryDatabase == nil {
+			return fmt.Errorf("No country database configured, unable to check country")
+		}
+		country, err := policy.CountryDatabase.LookupCountry(ip.String())
+		if err != nil {
+			return fmt.Errorf("Unable to determine country: %s", err)
+		}
+		if err := policy.checkCountry(country); err != nil {
+			return err
+		}
+	}
+
+	if policy.restrictsASNs() {
+		if policy.ASNDatabase == nil {
+			return fmt.Errorf("No ASN database configured, unable to check ASN")
+		}
+		asn, err := policy.ASNDatabase.LookupASN(ip)
+		if err != nil {
+			return fmt.Errorf("Unable to determine ASN: %s", err)
+		}
+		if containsUint(policy.ExcludedASNs, asn) {
+			return fmt.Errorf("Egress to AS%d is excluded", asn)
+		}
+		if len(policy.AllowedASNs) > 0 && !containsUint(policy.AllowedASNs, asn) {
+			return fmt.Errorf("Egress to AS%d is not allowed", asn)
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP publishes the policy as JSON, for operators and monitoring to see
+// which destinations we refuse.  Clients read the X-Lantern-Egress-Policy
+// header instead.
+func (policy *Policy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if policy == nil {
+		policy = &Policy{}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(resp).Encode(policy)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// String returns a compact representation of the policy suitable for use in
+// the X-Lantern-Egress-Policy header, for example
+// "allow=US,CA;exclude=;allowasn=;excludeasn=15169".
+func (policy *Policy) String() string {
+	if policy == nil {
+		policy = &Policy{}
+	}
+	return fmt.Sprintf("allow=%s;exclude=%s;allowasn=%s;excludeasn=%s",
+		strings.Join(policy.AllowedCountries, ","),
+		strings.Join(policy.ExcludedCountries, ","),
+		joinUints(policy.AllowedASNs),
+		joinUints(policy.ExcludedASNs))
+}
+
+func (policy *Policy) checkCountry(country string) error {
+	if !policy.RestrictsCountries() {
+		return nil
+	}
+	if containsString(policy.ExcludedCountries, country) {
+		return fmt.Errorf("Egress to country %s is excluded", country)
+	}
+	if len(policy.AllowedCountries) > 0 && !containsString(policy.AllowedCountries, country) {
+		return fmt.Errorf("Egress to country %s is not allowed", country)
+	}
+	return nil
+}
+
+func (policy *Policy) restrictsASNs() bool {
+	return len(policy.AllowedASNs) > 0 || len(policy.ExcludedASNs) > 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, candidate := range list {
+		if strings.EqualFold(candidate, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint(list []uint, u uint) bool {
+	for _, candidate := range list {
+		if candidate == u {
+			return true
+		}
+	}
+	return false
+}
+
+func joinUints(list []uint) string {
+	strs := make([]string, len(list))
+	for i, u := range list {
+		strs[i] = fmt.Sprintf("%d", u)
+	}
+	return strings.Join(strs, ",")
+}
+
+func splitNonEmpty(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseUints(s string) ([]uint, error) {
+	var list []uint
+	for _, item := range splitNonEmpty(s) {
+		u, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, uint(u))
+	}
+	return list, nil
+}
@@ -0,0 +1,51 @@
+package egress
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	policy := &Policy{
+		AllowedCountries:  []string{"US", "CA"},
+		ExcludedCountries: []string{"DE"},
+		ExcludedASNs:      []uint{15169},
+	}
+	parsed, err := ParsePolicy(policy.String())
+	if err != nil {
+		t.Fatalf("Unable to parse policy: %s", err)
+	}
+	if parsed.String() != policy.String() {
+		t.Errorf("Expected %s, got %s", policy, parsed)
+	}
+	if _, err := ParsePolicy("allow=US;excludeasn=AS1"); err == nil {
+		t.Errorf("Expected invalid ASN to fail")
+	}
+	if _, err := ParsePolicy("allow"); err == nil {
+		t.Errorf("Expected field without value to fail")
+	}
+}
+
+func TestPermitsCountry(t *testing.T) {
+	var unrestricted *Policy
+	if !unrestricted.PermitsCountry("DE") {
+		t.Errorf("Expected nil policy to permit everything")
+	}
+	allowed := &Policy{AllowedCountries: []string{"US", "CA"}, ExcludedCountries: []string{"CA"}}
+	if !allowed.PermitsCountry("us") {
+		t.Errorf("Expected allowed country to be permitted regardless of case")
+	}
+	if allowed.PermitsCountry("CA") {
+		t.Errorf("Expected exclusion to take precedence")
+	}
+	if allowed.PermitsCountry("DE") {
+		t.Errorf("Expected country outside of allowed list not to be permitted")
+	}
+}
+
+func TestCheckRequiresCountryDatabase(t *testing.T) {
+	policy := &Policy{ExcludedCountries: []string{"DE"}}
+	if err := policy.Check(net.ParseIP("192.0.2.1")); err == nil {
+		t.Errorf("Expected check without a country database to fail rather than look up the country elsewhere")
+	}
+}
@@ -0,0 +1,271 @@
+// package feedback lets clients report destinations that failed through a
+// server, so that the server can notice when specific origins block its
+// egress IP.
+//
+// Clients batch failures with a Reporter and POST them as a Report to
+// FEEDBACK_PATH on the server, authenticating with a shared token in the
+// X-Lantern-Feedback-Token header.  The server aggregates reports with an
+// Aggregator, which flags an origin once Threshold distinct clients have
+// reported it within Window.
+package feedback
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	FEEDBACK_PATH            = "/feedback"                // path at which servers accept feedback
+	X_LANTERN_FEEDBACK_TOKEN = "X-Lantern-Feedback-Token" // header with which clients authenticate
+
+	DEFAULT_THRESHOLD       = 3
+	DEFAULT_WINDOW          = 1 * time.Hour
+	DEFAULT_REPORT_INTERVAL = 1 * time.Minute
+	MAX_FAILURES_PER_REPORT = 100
+	MAX_REPORT_SIZE         = 64 * 1024
+)
+
+// Failure is a destination that failed through the server
+type Failure struct {
+	Host   string `json:"host"`
+	Reason string `json:"reason"` // e.g. "403" or "reset"
+}
+
+// Report is a batch of Failures from a client
+type Report struct {
+	Failures []*Failure `json:"failures"`
+}
+
+// Reporter batches Failures on the client and periodically sends them with
+// Send
+type Reporter struct {
+	Send     func(report *Report) error // sends the report to the server
+	Interval time.Duration              // (optional) how frequently to send reports, defaults to DEFAULT_REPORT_INTERVAL
+
+	failures []*Failure
+	stop     chan bool
+	mutex    sync.Mutex
+}
+
+// Record records a failure of the given destination (host or host:port).  It
+// is safe to call on a nil Reporter, in which case it does nothing.
+func (reporter *Reporter) Record(dest string, reason string) {
+	if reporter == nil {
+		return
+	}
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	if len(reporter.failures) < MAX_FAILURES_PER_REPORT {
+		reporter.failures = append(reporter.failures, &Failure{Host: hostOf(dest), Reason: reason})
+	}
+}
+
+// Start starts sending reports in the background, until Stop
+func (reporter *Reporter) Start() {
+	if reporter.Interval <= 0 {
+		reporter.Interval = DEFAULT_REPORT_INTERVAL
+	}
+	stop := make(chan bool)
+	reporter.mutex.Lock()
+	reporter.stop = stop
+	reporter.mutex.Unlock()
+	go func() {
+		defer crash.Recover()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(reporter.Interval):
+			}
+			reporter.mutex.Lock()
+			failures := reporter.failures
+			reporter.failures = nil
+			reporter.mutex.Unlock()
+			if len(failures) == 0 {
+				continue
+			}
+			err := reporter.Send(&Report{Failures: failures})
+			if err != nil {
+				log.Debugf("Unable to send feedback: %s", err)
+			}
+		}
+	}()
+}
+
+// Stop stops sending reports.  It is safe to call on a nil or stopped
+// Reporter.
+func (reporter *Reporter) Stop() {
+	if reporter == nil {
+		return
+	}
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	if reporter.stop != nil {
+		close(reporter.stop)
+		reporter.stop = nil
+	}
+}
+
+// PrepareRequest turns the given request to the server (usually built by a
+// protocol.ClientProtocol) into one that sends the given report
+func PrepareRequest(req *http.Request, token string, report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal feedback: %s", err)
+	}
+	req.Method = "POST"
+	req.URL.Path = FEEDBACK_PATH
+	req.Header.Set(X_LANTERN_FEEDBACK_TOKEN, token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
+// Aggregator aggregates Reports on the server
+type Aggregator struct {
+	Token     string        // shared token with which clients authenticate
+	Threshold int           // (optional) distinct clients that need to report an origin before we flag it, defaults to DEFAULT_THRESHOLD
+	Window    time.Duration // (optional) window within which reports count, defaults to DEFAULT_WINDOW
+
+	// OnBlocked (optional) is called when an origin is flagged as blocking us
+	OnBlocked func(host string)
+
+	reports map[string]map[string]time.Time // host -> reporter -> last reported
+	blocked map[string]time.Time            // host -> when it was flagged
+	mutex   sync.Mutex
+}
+
+// ServeHTTP accepts Reports (POST) and publishes the flagged origins (GET),
+// both of which require the Token.
+func (aggregator *Aggregator) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get(X_LANTERN_FEEDBACK_TOKEN)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(aggregator.Token)) != 1 {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case "POST":
+		report := &Report{}
+		err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, MAX_REPORT_SIZE)).Decode(report)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Unable to decode feedback: %s", err), http.StatusBadRequest)
+			return
+		}
+		aggregator.Add(reporterOf(req), report)
+		resp.WriteHeader(http.StatusNoContent)
+	case "GET":
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(aggregator.Blocked())
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Add adds the given report from the given reporter (e.g. client IP)
+func (aggregator *Aggregator) Add(reporter string, report *Report) {
+	threshold := aggregator.Threshold
+	if threshold <= 0 {
+		threshold = DEFAULT_THRESHOLD
+	}
+	window := aggregator.Window
+	if window <= 0 {
+		window = DEFAULT_WINDOW
+	}
+
+	var flagged []string
+	aggregator.mutex.Lock()
+	if aggregator.reports == nil {
+		aggregator.reports = make(map[string]map[string]time.Time)
+		aggregator.blocked = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for _, failure := range report.Failures {
+		host := hostOf(failure.Host)
+		if host == "" {
+			continue
+		}
+		reporters := aggregator.reports[host]
+		if reporters == nil {
+			reporters = make(map[string]time.Time)
+			aggregator.reports[host] = reporters
+		}
+		reporters[reporter] = now
+		for r, reported := range reporters {
+			if now.Sub(reported) > window {
+				delete(reporters, r)
+			}
+		}
+		if len(reporters) >= threshold {
+			// Start counting afresh, since whatever we do about it (e.g.
+			// rotating our egress IP) may fix it
+			delete(aggregator.reports, host)
+			aggregator.blocked[host] = now
+			flagged = append(flagged, host)
+		}
+	}
+	aggregator.mutex.Unlock()
+
+	for _, host := range flagged {
+		log.Errorf("%d clients reported that %s is unreachable through us", threshold, log.Redact(host))
+		if aggregator.OnBlocked != nil {
+			aggregator.OnBlocked(host)
+		}
+	}
+}
+
+// Blocked returns the origins that have been flagged within the Window, with
+// the time at which they were flagged
+func (aggregator *Aggregator) Blocked() map[string]time.Time {
+	window := aggregator.Window
+	if window <= 0 {
+		window = DEFAULT_WINDOW
+	}
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+	result := make(map[string]time.Time)
+	for host, flagged := range aggregator.blocked {
+		if time.Now().Sub(flagged) > window {
+			delete(aggregator.blocked, host)
+		} else {
+			result[host] = flagged
+		}
+	}
+	return result
+}
+
+// reporterOf identifies the client that sent the given request, preferring
+// X-Forwarded-For over the remote address.  The server drops any
+// X-Forwarded-For that the client sent, so it's only present if the front's
+// RewriteRequest reported the client's IP, which it only does for requests
+// from the front's published IP ranges (see -frontranges).
+func reporterOf(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// hostOf returns the lowercased host of the given host or host:port
+func hostOf(dest string) string {
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		host = dest
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,58 @@
+package feedback
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	var flagged []string
+	aggregator := &Aggregator{
+		Token:     "secret",
+		Threshold: 2,
+		OnBlocked: func(host string) {
+			flagged = append(flagged, host)
+		},
+	}
+	report := &Report{Failures: []*Failure{&Failure{Host: "Example.com:443", Reason: "closed"}}}
+	aggregator.Add("1.1.1.1", report)
+	aggregator.Add("1.1.1.1", report)
+	if len(flagged) != 0 {
+		t.Fatalf("Repeated reports from the same client shouldn't flag an origin")
+	}
+	aggregator.Add("2.2.2.2", report)
+	if len(flagged) != 1 || flagged[0] != "example.com" {
+		t.Fatalf("Expected example.com to be flagged, got %v", flagged)
+	}
+	if _, found := aggregator.Blocked()["example.com"]; !found {
+		t.Errorf("Expected example.com in blocked origins")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	aggregator := &Aggregator{Token: "secret"}
+	req, _ := http.NewRequest("GET", "http://server/", nil)
+	err := PrepareRequest(req, "wrong", &Report{})
+	if err != nil {
+		t.Fatalf("Unable to prepare request: %s", err)
+	}
+	resp := httptest.NewRecorder()
+	aggregator.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("Expected wrong token to be rejected, got %d", resp.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "http://server/", nil)
+	PrepareRequest(req, "secret", &Report{Failures: []*Failure{&Failure{Host: "example.com", Reason: "403"}}})
+	if req.URL.Path != FEEDBACK_PATH || req.Method != "POST" {
+		t.Errorf("Request not prepared properly: %s %s", req.Method, req.URL)
+	}
+	req.RemoteAddr = "3.3.3.3:1234"
+	resp = httptest.NewRecorder()
+	aggregator.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNoContent {
+		t.Errorf("Expected report to be accepted, got %d: %s", resp.Code, strings.TrimSpace(resp.Body.String()))
+	}
+}
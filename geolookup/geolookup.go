@@ -0,0 +1,177 @@
+// package geolookup provides geolocation of IP addresses using the go-geoserve
+// service or a MaxMind Country database, as well as lookups of autonomous
+// system numbers using a MaxMind ASN database.
+package geolookup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	GEOSERVE_URL_TEMPLATE = "http://go-geoserve.herokuapp.com/lookup/%s"
+)
+
+// The City structure corresponds to the data in the GeoIP2/GeoLite2 City
+// databases.
+type City struct {
+	City struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code      string            `maxminddb:"code"`
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"continent"`
+	Country struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		MetroCode uint    `maxminddb:"metro_code"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	RegisteredCountry struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"registered_country"`
+	RepresentedCountry struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+		Type      string            `maxminddb:"type"`
+	} `maxminddb:"represented_country"`
+	Subdivisions []struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Traits struct {
+		IsAnonymousProxy    bool `maxminddb:"is_anonymous_proxy"`
+		IsSatelliteProvider bool `maxminddb:"is_satellite_provider"`
+	} `maxminddb:"traits"`
+}
+
+// The Country structure corresponds to the data in the GeoIP2/GeoLite2
+// Country databases.
+type Country struct {
+	Continent struct {
+		Code      string            `maxminddb:"code"`
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"continent"`
+	Country struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"registered_country"`
+	RepresentedCountry struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+		Type      string            `maxminddb:"type"`
+	} `maxminddb:"represented_country"`
+	Traits struct {
+		IsAnonymousProxy    bool `maxminddb:"is_anonymous_proxy"`
+		IsSatelliteProvider bool `maxminddb:"is_satellite_provider"`
+	} `maxminddb:"traits"`
+}
+
+// ASN corresponds to the data in the GeoLite2 ASN database
+type ASN struct {
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// ASNDatabase looks up ASNs in a MaxMind ASN database
+type ASNDatabase struct {
+	reader *maxminddb.Reader
+}
+
+// CountryDatabase looks up countries in a MaxMind Country (or City) database,
+// without asking anyone else
+type CountryDatabase struct {
+	reader *maxminddb.Reader
+}
+
+// LookupCity looks up the City information for the given ip using geoserve
+func LookupCity(ip string) (*City, error) {
+	resp, err := http.Get(fmt.Sprintf(GEOSERVE_URL_TEMPLATE, ip))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response status looking up %s: %d", ip, resp.StatusCode)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	geodata := &City{}
+	err = decoder.Decode(geodata)
+	if err != nil {
+		return nil, err
+	}
+	return geodata, nil
+}
+
+// OpenASNDatabase opens the MaxMind ASN database at the given filename
+func OpenASNDatabase(filename string) (*ASNDatabase, error) {
+	reader, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open ASN database %s: %s", filename, err)
+	}
+	return &ASNDatabase{reader}, nil
+}
+
+// LookupASN looks up the autonomous system number for the given ip
+func (db *ASNDatabase) LookupASN(ip net.IP) (uint, error) {
+	asn := &ASN{}
+	err := db.reader.Lookup(ip, asn)
+	if err != nil {
+		return 0, err
+	}
+	return asn.AutonomousSystemNumber, nil
+}
+
+// OpenCountryDatabase opens the MaxMind Country (or City) database at the
+// given filename
+func OpenCountryDatabase(filename string) (*CountryDatabase, error) {
+	reader, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open country database %s: %s", filename, err)
+	}
+	return &CountryDatabase{reader}, nil
+}
+
+// LookupCountry looks up the ISO country code for the given ip
+func (db *CountryDatabase) LookupCountry(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("Invalid IP %s", ip)
+	}
+	country := &Country{}
+	err := db.reader.Lookup(parsed, country)
+	if err != nil {
+		return "", err
+	}
+	if country.Country.IsoCode == "" {
+		return "", fmt.Errorf("No country for %s", ip)
+	}
+	return country.Country.IsoCode, nil
+}
@@ -0,0 +1,268 @@
+// package handoff lets a new flashlight process take over the listening
+// sockets of a running one, so that busy servers can be upgraded in place
+// without refusing connections.
+//
+// Restart starts a new process from the (possibly replaced) binary, with the
+// same arguments and environment, passing it our listeners' file descriptors
+// and their addresses in FLASHLIGHT_HANDOFF_FDS.  When the new process calls
+// Listen for one of those addresses, it gets the inherited socket instead of
+// binding a new one.  Once it has taken over all of them (or READY_TIMEOUT
+// after the first), it sends us SIGTERM, on which we stop accepting and drain
+// our connections as usual.  Meanwhile both processes accept on the same
+// sockets, so no connection gets refused.
+//
+// Listen also uses the sockets that systemd passes with socket activation,
+// for the addresses that they're bound to.
+package handoff
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/systemd"
+)
+
+const (
+	ENV_FDS    = "FLASHLIGHT_HANDOFF_FDS"    // addr=fd,... of the listeners inherited from the parent
+	ENV_PARENT = "FLASHLIGHT_HANDOFF_PARENT" // pid of the parent, which we tell to shut down once we've taken over
+
+	READY_TIMEOUT = 30 * time.Second // how long after taking over the first listener we tell the parent to shut down anyway
+
+	firstInheritedFD = 3 // ExtraFiles start after stdin, stdout and stderr
+)
+
+var (
+	inherited   map[string]*os.File // not yet taken over, by address
+	activated   []net.Listener      // passed by systemd and not yet used
+	listeners   = make(map[string]*listener)
+	restarting  bool
+	readyTimer  *time.Timer
+	readyOnce   sync.Once
+	inheritOnce sync.Once
+	mutex       sync.Mutex
+)
+
+// listener is a listener that we can hand off, until it's closed
+type listener struct {
+	net.Listener
+	addr string
+}
+
+func (l *listener) Close() error {
+	mutex.Lock()
+	if listeners[l.addr] == l {
+		delete(listeners, l.addr)
+	}
+	mutex.Unlock()
+	return l.Listener.Close()
+}
+
+// Listen listens for TCP connections at the given address, taking over the
+// socket that our parent handed off for it, if any
+func Listen(addr string) (net.Listener, error) {
+	inheritOnce.Do(inherit)
+	mutex.Lock()
+	defer mutex.Unlock()
+	var l net.Listener
+	var err error
+	if file := inherited[addr]; file != nil {
+		delete(inherited, addr)
+		l, err = net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to take over listener at %s: %s", addr, err)
+		}
+		log.Debugf("Took over listener at %s", addr)
+		if len(inherited) == 0 {
+			go Ready()
+		} else if readyTimer == nil {
+			readyTimer = time.AfterFunc(READY_TIMEOUT, Ready)
+		}
+	} else if l = takeActivated(addr); l != nil {
+		log.Debugf("Using socket passed by systemd for %s", addr)
+	} else {
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tracked := &listener{Listener: l, addr: addr}
+	listeners[addr] = tracked
+	return tracked, nil
+}
+
+// takeActivated removes and returns the listener that systemd passed for the
+// given address, if any
+func takeActivated(addr string) net.Listener {
+	for i, l := range activated {
+		if systemd.SameAddr(addr, l.Addr().String()) {
+			activated = append(activated[:i], activated[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// Listening indicates whether we're listening at the given address
+func Listening(addr string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return listeners[addr] != nil
+}
+
+// inherit picks up the listeners that our parent handed off or that systemd
+// passed, if any
+func inherit() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var err error
+	activated, err = systemd.Listeners()
+	if err != nil {
+		log.Error(err)
+	}
+	fds, err := parseFDs(os.Getenv(ENV_FDS))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	inherited = make(map[string]*os.File, len(fds))
+	for addr, fd := range fds {
+		inherited[addr] = os.NewFile(uintptr(fd), addr)
+	}
+}
+
+// parseFDs parses the value of ENV_FDS
+func parseFDs(value string) (map[string]int, error) {
+	fds := make(map[string]int)
+	for _, spec := range strings.Split(value, ",") {
+		if spec == "" {
+			continue
+		}
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid handed off listener %s", spec)
+		}
+		fd, err := strconv.Atoi(spec[i+1:])
+		if err != nil || fd < firstInheritedFD {
+			return nil, fmt.Errorf("Invalid file descriptor in handed off listener %s", spec)
+		}
+		fds[spec[:i]] = fd
+	}
+	return fds, nil
+}
+
+// Ready tells our parent (if we were started by Restart) to shut down,
+// because we've taken over its listeners.  Only the first call counts.
+func Ready() {
+	readyOnce.Do(func() {
+		pid := Parent()
+		if pid == 0 {
+			return
+		}
+		log.Debugf("Telling previous process %d to shut down", pid)
+		parent, err := os.FindProcess(pid)
+		if err == nil {
+			err = parent.Signal(syscall.SIGTERM)
+		}
+		if err != nil {
+			log.Errorf("Unable to tell previous process %d to shut down: %s", pid, err)
+		}
+	})
+}
+
+// Parent returns the pid of the process that started us with Restart, or 0
+// if we weren't
+func Parent() int {
+	pid, err := strconv.Atoi(os.Getenv(ENV_PARENT))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Restart starts a new process from the binary at os.Args[0] with the same
+// arguments and environment, handing it our listeners, and returns its pid.
+// The binary is looked up by path rather than through /proc/self/exe so that
+// an upgraded binary installed at the same path gets started.  If the new
+// process exits before telling us to shut down, we keep running as before.
+// It isn't supported on Windows.
+func Restart() (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if restarting {
+		return 0, fmt.Errorf("Already restarting")
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find our binary: %s", err)
+	}
+
+	var files []*os.File
+	var specs []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for addr, l := range listeners {
+		filer, ok := l.Listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return 0, fmt.Errorf("Unable to hand off listener at %s", addr)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return 0, fmt.Errorf("Unable to get file of listener at %s: %s", addr, err)
+		}
+		specs = append(specs, fmt.Sprintf("%s=%d", addr, firstInheritedFD+len(files)))
+		files = append(files, file)
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environ(), ENV_FDS+"="+strings.Join(specs, ","), ENV_PARENT+"="+strconv.Itoa(os.Getpid()))
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("Unable to start %s: %s", path, err)
+	}
+	restarting = true
+	go func() {
+		err := cmd.Wait()
+		log.Errorf("New process %d exited: %v", cmd.Process.Pid, err)
+		mutex.Lock()
+		restarting = false
+		mutex.Unlock()
+	}()
+	return cmd.Process.Pid, nil
+}
+
+// Restarting indicates whether we've started a new process that's taking over
+// our listeners, in which case it's the one that tells us to shut down
+func Restarting() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return restarting
+}
+
+// environ returns our environment without the variables that we inherited
+// from our own parent
+func environ() []string {
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, ENV_FDS+"=") && !strings.HasPrefix(v, ENV_PARENT+"=") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
@@ -0,0 +1,59 @@
+package handoff
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseFDs(t *testing.T) {
+	fds, err := parseFDs("[::]:443=3,127.0.0.1:8787=4")
+	if err != nil || len(fds) != 2 || fds["[::]:443"] != 3 || fds["127.0.0.1:8787"] != 4 {
+		t.Errorf("Unexpected fds %v: %v", fds, err)
+	}
+	for _, bad := range []string{":443", ":443=x", ":443=1"} {
+		if _, err := parseFDs(bad); err == nil {
+			t.Errorf("%s should be invalid", bad)
+		}
+	}
+}
+
+func TestListenInherited(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	addr := parent.Addr().String()
+	file, err := parent.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inheritOnce.Do(func() {
+		inherited = map[string]*os.File{addr: file}
+	})
+
+	l, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("Unable to take over %s: %s", addr, err)
+	}
+	if len(inherited) != 0 || listeners[addr] == nil {
+		t.Errorf("Listener at %s should have been taken over", addr)
+	}
+	parent.Close()
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Unable to accept on taken over listener: %s", err)
+	}
+	conn.Close()
+	l.Close()
+	if listeners[addr] != nil {
+		t.Errorf("Closed listener shouldn't be handed off")
+	}
+}
@@ -0,0 +1,366 @@
+// package httpcache implements an http.RoundTripper that caches plain http
+// GET responses on disk, following the caching rules of RFC 7234: responses
+// are served from the cache while they're fresh according to their
+// Cache-Control (or Expires) headers, and once they're stale they're
+// revalidated with the origin using their ETag or Last-Modified, which saves
+// transferring the body again when it hasn't changed.  This saves bandwidth
+// and speeds up repeat visits on slow links.
+//
+// Responses are kept in a store.Store (encrypted if the store is), under
+// hashed names so that file names don't reveal what was visited.  When the
+// cache grows beyond MaxBytes, the oldest responses are evicted.  Purge
+// removes all cached responses.
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/store"
+)
+
+const (
+	DEFAULT_MAX_BYTES = 100 * 1024 * 1024
+	MAX_ENTRY_SIZE    = 5 * 1024 * 1024 // largest response that we'll cache
+	MAX_HEURISTIC_AGE = 24 * time.Hour  // longest that responses without explicit freshness are considered fresh
+	NAME_PREFIX       = "httpcache-"
+
+	X_LANTERN_CACHE = "X-Lantern-Cache" // header marking responses served from the cache (HIT) or revalidated (REVALIDATED)
+)
+
+// Cache is an http.RoundTripper that caches GET responses
+type Cache struct {
+	Transport http.RoundTripper
+	Store     *store.Store // store in which responses are kept
+	MaxBytes  int64        // (optional) maximum total size of cached responses, defaults to DEFAULT_MAX_BYTES
+
+	// Now (optional) returns the current time, defaults to time.Now
+	Now func() time.Time
+
+	capped     *store.Capped // cached responses, created on first use
+	cappedOnce sync.Once
+}
+
+// entry is a cached response
+type entry struct {
+	URL      string
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Vary     map[string]string // values of the request headers named by the response's Vary header
+	Received time.Time         // when the response (or its last revalidation) was received
+}
+
+func (cache *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isCacheableRequest(req) {
+		return cache.Transport.RoundTrip(req)
+	}
+
+	url := req.URL.String()
+	name := nameFor(url)
+	cached := cache.load(name, req)
+	if cached != nil {
+		if cache.isFresh(cached, req) {
+			log.Debugf("Serving %s from cache", log.Redact(url))
+			return cache.toResponse(cached, req, "HIT"), nil
+		}
+		addValidators(req, cached)
+	}
+
+	resp, err := cache.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		log.Debugf("Revalidated cached %s", log.Redact(url))
+		// Update the cached headers with the new ones, per RFC 7234 4.3.4
+		for key, values := range resp.Header {
+			cached.Header[key] = values
+		}
+		cached.Received = cache.now()
+		cache.save(name, cached)
+		return cache.toResponse(cached, req, "REVALIDATED"), nil
+	}
+	if !isCacheableResponse(resp) {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_ENTRY_SIZE+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > MAX_ENTRY_SIZE {
+		// Too big to cache, pass it through
+		resp.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	e := &entry{
+		URL:      url,
+		Status:   resp.StatusCode,
+		Header:   cloneHeader(resp.Header),
+		Body:     body,
+		Vary:     make(map[string]string),
+		Received: cache.now(),
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		e.Vary[name] = req.Header.Get(name)
+	}
+	cache.save(name, e)
+	return resp, nil
+}
+
+// Purge removes all cached responses
+func (cache *Cache) Purge() error {
+	return cache.entries().Purge()
+}
+
+// load loads the cached response for the given name if it matches the given
+// request, or returns nil
+func (cache *Cache) load(name string, req *http.Request) *entry {
+	e := &entry{}
+	if err := cache.Store.Load(name, e); err != nil {
+		return nil
+	}
+	if e.URL != req.URL.String() {
+		return nil
+	}
+	for header, value := range e.Vary {
+		if req.Header.Get(header) != value {
+			return nil
+		}
+	}
+	return e
+}
+
+// save saves the given response under the given name, evicting the oldest
+// responses if that takes us over MaxBytes
+func (cache *Cache) save(name string, e *entry) {
+	if err := cache.entries().Save(name, e); err != nil {
+		log.Errorf("Unable to cache %s: %s", log.Redact(e.URL), err)
+	}
+}
+
+// entries returns the store.Capped in which responses are cached
+func (cache *Cache) entries() *store.Capped {
+	cache.cappedOnce.Do(func() {
+		cache.capped = &store.Capped{Store: cache.Store, Prefix: NAME_PREFIX, MaxBytes: cache.maxBytes()}
+	})
+	return cache.capped
+}
+
+func (cache *Cache) maxBytes() int64 {
+	if cache.MaxBytes > 0 {
+		return cache.MaxBytes
+	}
+	return DEFAULT_MAX_BYTES
+}
+
+func (cache *Cache) now() time.Time {
+	if cache.Now != nil {
+		return cache.Now()
+	}
+	return time.Now()
+}
+
+// age returns the current age of the given cached response, per RFC 7234 4.2.3
+func (cache *Cache) age(e *entry) time.Duration {
+	age := cache.now().Sub(e.Received)
+	if seconds, err := strconv.Atoi(e.Header.Get("Age")); err == nil && seconds > 0 {
+		age += time.Duration(seconds) * time.Second
+	}
+	return age
+}
+
+// isFresh indicates whether the given cached response can be served for the
+// given request without revalidating it
+func (cache *Cache) isFresh(e *entry, req *http.Request) bool {
+	reqDirectives := parseCacheControl(req.Header)
+	if _, found := reqDirectives["no-cache"]; found || req.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	respDirectives := parseCacheControl(e.Header)
+	if _, found := respDirectives["no-cache"]; found {
+		return false
+	}
+	lifetime := freshnessLifetime(e.Header, respDirectives)
+	if maxAge, found := reqDirectives["max-age"]; found {
+		if seconds, err := strconv.Atoi(maxAge); err == nil && time.Duration(seconds)*time.Second < lifetime {
+			lifetime = time.Duration(seconds) * time.Second
+		}
+	}
+	return cache.age(e) < lifetime
+}
+
+// freshnessLifetime returns how long a response with the given header is
+// fresh for, per RFC 7234 4.2.1, using the heuristic from 4.2.2 if the
+// response doesn't say
+func freshnessLifetime(header http.Header, directives map[string]string) time.Duration {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, found := directives[directive]; found {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return 0
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid dates like "0" mean already expired
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		heuristic := date.Sub(lastModified) / 10
+		if heuristic > MAX_HEURISTIC_AGE {
+			heuristic = MAX_HEURISTIC_AGE
+		}
+		return heuristic
+	}
+	return 0
+}
+
+// addValidators makes the given request conditional on the given cached
+// response having changed
+func addValidators(req *http.Request, e *entry) {
+	if etag := e.Header.Get("ETag"); etag != "" && req.Header.Get("If-None-Match") == "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" && req.Header.Get("If-Modified-Since") == "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// isCacheableRequest indicates whether responses to the given request may be
+// taken from or put in the cache
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	// The browser's own conditional requests are for its cache, not ours
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// isCacheableResponse indicates whether the given response may be cached, per
+// RFC 7234 3, which for us means that it's complete, may be stored by a shared
+// cache and either has an explicit lifetime or can be revalidated
+func isCacheableResponse(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	directives := parseCacheControl(resp.Header)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, found := directives[directive]; found {
+			return false
+		}
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "" {
+		return true
+	}
+	return freshnessLifetime(resp.Header, directives) > 0
+}
+
+// parseCacheControl parses the Cache-Control header into a map of lowercase
+// directives to their (unquoted) values
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			kv := strings.SplitN(part, "=", 2)
+			directive := strings.ToLower(strings.TrimSpace(kv[0]))
+			if len(kv) == 2 {
+				directives[directive] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			} else {
+				directives[directive] = ""
+			}
+		}
+	}
+	return directives
+}
+
+// varyHeaders returns the canonical names of the request headers named by the
+// given response header's Vary
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// nameFor returns the store name for the given URL, which is hashed so that
+// file names don't reveal what was visited
+func nameFor(url string) string {
+	hash := sha256.Sum256([]byte(url))
+	return NAME_PREFIX + hex.EncodeToString(hash[:])
+}
+
+func (cache *Cache) toResponse(e *entry, req *http.Request, result string) *http.Response {
+	header := cloneHeader(e.Header)
+	header.Set("Age", strconv.Itoa(int(cache.age(e).Seconds())))
+	header.Set(X_LANTERN_CACHE, result)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// multiReadCloser reads from a Reader and closes a Closer
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,121 @@
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/store"
+)
+
+// fakeOrigin serves a fixed body with the given headers, answering
+// conditional requests with 304 if the ETag matches
+type fakeOrigin struct {
+	header   http.Header
+	requests int
+}
+
+func (o *fakeOrigin) RoundTrip(req *http.Request) (*http.Response, error) {
+	o.requests++
+	header := make(http.Header)
+	for name, values := range o.header {
+		header[name] = values
+	}
+	if etag := header.Get("ETag"); etag != "" && req.Header.Get("If-None-Match") == etag {
+		return &http.Response{StatusCode: http.StatusNotModified, Header: header, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(bytes.NewReader([]byte("page")))}, nil
+}
+
+func newCache(t *testing.T, origin *fakeOrigin, now *time.Time) (*Cache, func()) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.New(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &Cache{Transport: origin, Store: s, Now: func() time.Time { return *now }}
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func get(t *testing.T, cache *Cache) *http.Response {
+	req, _ := http.NewRequest("GET", "http://example.org/page", nil)
+	resp, err := cache.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unable to round trip: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "page" {
+		t.Fatalf("Unexpected body: %s", body)
+	}
+	return resp
+}
+
+func TestFreshAndRevalidated(t *testing.T) {
+	now := time.Now()
+	origin := &fakeOrigin{header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}}
+	cache, cleanup := newCache(t, origin, &now)
+	defer cleanup()
+
+	get(t, cache)
+	if resp := get(t, cache); resp.Header.Get(X_LANTERN_CACHE) != "HIT" || origin.requests != 1 {
+		t.Errorf("Fresh response should have been served from the cache, made %d requests", origin.requests)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if resp := get(t, cache); resp.Header.Get(X_LANTERN_CACHE) != "REVALIDATED" || origin.requests != 2 {
+		t.Errorf("Stale response should have been revalidated, made %d requests", origin.requests)
+	}
+	if resp := get(t, cache); resp.Header.Get(X_LANTERN_CACHE) != "HIT" || origin.requests != 2 {
+		t.Errorf("Revalidated response should be fresh again, made %d requests", origin.requests)
+	}
+
+	if err := cache.Purge(); err != nil {
+		t.Fatalf("Unable to purge: %s", err)
+	}
+	if resp := get(t, cache); resp.Header.Get(X_LANTERN_CACHE) != "" || origin.requests != 3 {
+		t.Errorf("Purged response shouldn't have been served from the cache")
+	}
+}
+
+func TestNotCacheable(t *testing.T) {
+	now := time.Now()
+	for _, header := range []http.Header{
+		{"Cache-Control": {"no-store, max-age=60"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		{},
+	} {
+		origin := &fakeOrigin{header: header}
+		cache, cleanup := newCache(t, origin, &now)
+		get(t, cache)
+		get(t, cache)
+		if origin.requests != 2 {
+			t.Errorf("Response with %v shouldn't have been cached", header)
+		}
+		cleanup()
+	}
+}
+
+func TestEviction(t *testing.T) {
+	now := time.Now()
+	origin := &fakeOrigin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	cache, cleanup := newCache(t, origin, &now)
+	defer cleanup()
+	cache.MaxBytes = 1
+
+	get(t, cache)
+	infos, err := cache.Store.List(NAME_PREFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("Response over MaxBytes should have been evicted")
+	}
+}
@@ -0,0 +1,205 @@
+// package identity lets clients verify that the flashlight server that they
+// reach through a front is the one that they expect, rather than one that the
+// front (or whoever controls it) routes them to instead.
+//
+// Fronts terminate the client's TLS connection, so clients can't see the
+// server's certificate.  Instead, clients pin the server's public key with a
+// Fingerprint (or several, e.g. while rotating keys) and send a random nonce in the X-Lantern-Identity-Challenge
+// header of a request to IDENTITY_PATH.  The server answers with its
+// certificate and a signature of the nonce made with the certificate's key,
+// which only the real server has.
+//
+// This can't detect a front that relays the challenge to the real server while
+// tampering with other requests, since the tunnel isn't encrypted end to end.
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	IDENTITY_PATH                = "/identity"                    // path at which servers answer challenges
+	X_LANTERN_IDENTITY_CHALLENGE = "X-Lantern-Identity-Challenge" // header with the client's base64 encoded nonce
+
+	FINGERPRINT_PREFIX = "sha256/" // prefix of Fingerprints, which are the base64 encoded SHA-256 of the public key (as in HPKP)
+	NONCE_SIZE         = 32
+	SIGNATURE_CONTEXT  = "flashlight identity v1\n" // prepended to nonces before signing them, so that signatures can't be mistaken for others made with the key
+
+	MAX_SIZE = 64 * 1024
+)
+
+// Proof is the server's answer to a challenge
+type Proof struct {
+	Certificate []byte `json:"certificate"` // DER encoded
+	Signature   []byte `json:"signature"`   // of SIGNATURE_CONTEXT followed by the nonce
+}
+
+// Fingerprint returns the fingerprint of the given certificate's public key,
+// which stays the same when the certificate is renewed with the same key
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return FINGERPRINT_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// CheckPins checks that the given certificate's public key has one of the
+// given Fingerprints
+func CheckPins(cert *x509.Certificate, pins []string) error {
+	actual := Fingerprint(cert)
+	for _, pin := range pins {
+		if pin == actual {
+			return nil
+		}
+	}
+	return fmt.Errorf("Server presented key %s, which isn't pinned", actual)
+}
+
+// ParsePin parses the given pin, which is either a Fingerprint or the name of
+// a file with a PEM encoded certificate (whose Fingerprint is used)
+func ParsePin(pin string) (string, error) {
+	if strings.HasPrefix(pin, FINGERPRINT_PREFIX) {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, FINGERPRINT_PREFIX))
+		if err != nil || len(sum) != sha256.Size {
+			return "", fmt.Errorf("Invalid fingerprint %s", pin)
+		}
+		return pin, nil
+	}
+	certPEM, err := ioutil.ReadFile(pin)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read certificate: %s", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", fmt.Errorf("%s is neither a fingerprint (%s...) nor a PEM file", pin, FINGERPRINT_PREFIX)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a certificate: %s", pin, err)
+	}
+	return Fingerprint(cert), nil
+}
+
+// PrepareRequest turns the given request to the server (usually built by a
+// protocol.ClientProtocol) into a challenge, returning the nonce to pass to
+// ReadResponse
+func PrepareRequest(req *http.Request) ([]byte, error) {
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	req.Method = "GET"
+	req.URL.Path = IDENTITY_PATH
+	req.Header.Set(X_LANTERN_IDENTITY_CHALLENGE, base64.StdEncoding.EncodeToString(nonce))
+	req.Body = nil
+	req.ContentLength = 0
+	return nonce, nil
+}
+
+// ReadResponse reads the Proof from the given response to a request made with
+// PrepareRequest and checks that it was made for the given nonce with a key
+// with one of the given Fingerprints
+func ReadResponse(resp *http.Response, nonce []byte, pins []string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Server didn't answer identity challenge: %s", resp.Status)
+	}
+	proof := &Proof{}
+	err := json.NewDecoder(io.LimitReader(resp.Body, MAX_SIZE)).Decode(proof)
+	if err != nil {
+		return fmt.Errorf("Unable to decode identity proof: %s", err)
+	}
+	return proof.Verify(nonce, pins)
+}
+
+// Verify checks that the Proof was made for the given nonce with a key with
+// one of the given Fingerprints
+func (proof *Proof) Verify(nonce []byte, pins []string) error {
+	cert, err := x509.ParseCertificate(proof.Certificate)
+	if err != nil {
+		return fmt.Errorf("Unable to parse server certificate: %s", err)
+	}
+	if err := CheckPins(cert, pins); err != nil {
+		return err
+	}
+	message := append([]byte(SIGNATURE_CONTEXT), nonce...)
+	digest := sha256.Sum256(message)
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], proof.Signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], proof.Signature) {
+			err = fmt.Errorf("verification failed")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, message, proof.Signature) {
+			err = fmt.Errorf("verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key %T", pub)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid identity signature: %s", err)
+	}
+	return nil
+}
+
+// IsRequest indicates whether the given request is a challenge
+func IsRequest(req *http.Request) bool {
+	return req.Method == "GET" && req.URL.Path == IDENTITY_PATH && req.Header.Get(X_LANTERN_IDENTITY_CHALLENGE) != ""
+}
+
+// Serve answers the challenge in the given request with a Proof made with the
+// given certificate
+func Serve(resp http.ResponseWriter, req *http.Request, cert *tls.Certificate) {
+	nonce, err := base64.StdEncoding.DecodeString(req.Header.Get(X_LANTERN_IDENTITY_CHALLENGE))
+	if err != nil || len(nonce) != NONCE_SIZE {
+		http.Error(resp, "Invalid challenge", http.StatusBadRequest)
+		return
+	}
+	proof, err := Prove(cert, nonce)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(proof)
+}
+
+// Prove makes a Proof for the given nonce with the given certificate
+func Prove(cert *tls.Certificate, nonce []byte) (*Proof, error) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("No certificate")
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unable to sign with %T", cert.PrivateKey)
+	}
+	message := append([]byte(SIGNATURE_CONTEXT), nonce...)
+	var signature []byte
+	var err error
+	if _, isEd25519 := signer.Public().(ed25519.PublicKey); isEd25519 {
+		signature, err = signer.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign challenge: %s", err)
+	}
+	return &Proof{Certificate: cert.Certificate[0], Signature: signature}, nil
+}
@@ -0,0 +1,115 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other := certFor(t, otherKey)
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey, edKey} {
+		cert := certFor(t, key)
+		server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if !IsRequest(req) {
+				resp.WriteHeader(http.StatusNotFound)
+				return
+			}
+			Serve(resp, req, cert)
+		}))
+
+		challenge := func(pins []string) error {
+			req, _ := http.NewRequest("POST", server.URL+"/other", nil)
+			nonce, err := PrepareRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Unable to send challenge: %s", err)
+			}
+			return ReadResponse(resp, nonce, pins)
+		}
+
+		pin := Fingerprint(cert.Leaf)
+		if err := challenge([]string{Fingerprint(other.Leaf), pin}); err != nil {
+			t.Errorf("%T: pinned key should be verified: %s", key, err)
+		}
+		if err := challenge([]string{Fingerprint(other.Leaf)}); err == nil {
+			t.Errorf("%T: unpinned key shouldn't be verified", key)
+		}
+		server.Close()
+
+		// A proof for another nonce (e.g. a replayed one) isn't valid
+		proof, err := Prove(cert, make([]byte, NONCE_SIZE))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, NONCE_SIZE)
+		nonce[0] = 1
+		if err := proof.Verify(nonce, []string{pin}); err == nil {
+			t.Errorf("%T: proof for another nonce shouldn't be verified", key)
+		}
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := certFor(t, key)
+	certFile := filepath.Join(dir, "servercert.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+
+	expected := Fingerprint(cert.Leaf)
+	for _, pin := range []string{expected, certFile} {
+		if fingerprint, err := ParsePin(pin); err != nil || fingerprint != expected {
+			t.Errorf("Expected %s for %s, got %s, %v", expected, pin, fingerprint, err)
+		}
+	}
+	for _, bad := range []string{"sha256/short", filepath.Join(dir, "missing.pem")} {
+		if _, err := ParsePin(bad); err == nil {
+			t.Errorf("%s should be rejected", bad)
+		}
+	}
+}
+
+func certFor(t *testing.T, key crypto.Signer) *tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fl1.example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Unable to create cert: %s", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/getlantern/flashlight/handoff"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/pidfile"
+	"github.com/getlantern/flashlight/systemd"
+)
+
+const (
+	PID_FILE = "flashlight.pid" // in the configDir
+
+	replaceGrace = 10 * time.Second // how much longer than -draintimeout we wait for the flashlight that we -replace to exit
+)
+
+// claimPIDFile records us in the pidfile in the configDir, removing it when
+// we shut down.  If the flashlight recorded there is still running at one of
+// our addresses, we exit with an error, unless -replace was given, in which
+// case we stop it first.  One that doesn't share an address with us is left
+// alone either way.  The flashlight that we were restarted from (see package
+// handoff) doesn't count, since we're taking over from it.
+func claimPIDFile() {
+	path := inConfigDir(PID_FILE)
+	addrs := roleAddrs()
+	existing, err := pidfile.Read(path)
+	if err != nil {
+		log.Error(err)
+	} else if existing != nil && existing.PID != os.Getpid() && existing.PID != handoff.Parent() && existing.Running() {
+		shared := sharedAddr(existing.Addrs, addrs)
+		if shared == "" {
+			log.Debugf("Leaving alone flashlight running as pid %d, which doesn't listen at any of our addresses", existing.PID)
+		} else if *replace {
+			log.Debugf("Replacing flashlight running at %s as pid %d", shared, existing.PID)
+			if err := existing.Stop(*drainTimeout + replaceGrace); err != nil {
+				log.Fatalf("Unable to replace running flashlight: %s", err)
+			}
+		} else {
+			log.Fatalf("flashlight is already running at %s as pid %d (see %s).  Stop it or use -replace.", shared, existing.PID, path)
+		}
+	}
+	if err := pidfile.Write(path, addrs); err != nil {
+		log.Error(err)
+		return
+	}
+	addShutdownHook(func() {
+		if err := pidfile.Remove(path); err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+// sharedAddr returns the first of ours that's also one of theirs, if any
+func sharedAddr(theirs []string, ours []string) string {
+	for _, o := range ours {
+		for _, t := range theirs {
+			if systemd.SameAddr(o, t) || systemd.SameAddr(t, o) {
+				return o
+			}
+		}
+	}
+	return ""
+}
@@ -1,40 +1,134 @@
 // package log implements logging functions that log errors to stderr and debug
-// messages to stdout
+// messages to stdout, or both to a rotated file.  Messages can be logged as
+// text or as JSON (for log collectors like ELK), and the level can be set per
+// module (package), see Configure.
 package log
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 )
 
+const (
+	RECENT_ERRORS = 20 // number of recent errors kept for RecentErrors
+)
+
+var (
+	// SafeLogging, if true, causes Redact to obscure destinations in logs so
+	// that logs don't reveal what sites a user visited.  Defaults to true.
+	SafeLogging = true
+
+	// redactionSalt is a random per-process salt for hashing destinations,
+	// so that hashes can be correlated within a single run but can't be
+	// reversed by hashing well-known domains.
+	redactionSalt = randomSalt()
+
+	errorHandlers      []func(message string)
+	errorHandlersMutex sync.RWMutex
+
+	recentErrors      []*RecentError
+	recentErrorsMutex sync.Mutex
+)
+
+// RecentError is an error message that was logged recently
+type RecentError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// OnError registers a function that's called with every error message logged
+// (e.g. to ship it elsewhere).  Handlers mustn't log errors themselves.
+func OnError(handler func(message string)) {
+	errorHandlersMutex.Lock()
+	defer errorHandlersMutex.Unlock()
+	errorHandlers = append(errorHandlers, handler)
+}
+
+// RecentErrors returns the last RECENT_ERRORS error messages logged, oldest
+// first, e.g. for showing in a dashboard
+func RecentErrors() []*RecentError {
+	recentErrorsMutex.Lock()
+	defer recentErrorsMutex.Unlock()
+	return append([]*RecentError(nil), recentErrors...)
+}
+
+func notifyError(message string) {
+	recentErrorsMutex.Lock()
+	recentErrors = append(recentErrors, &RecentError{Time: time.Now(), Message: message})
+	if len(recentErrors) > RECENT_ERRORS {
+		recentErrors = recentErrors[len(recentErrors)-RECENT_ERRORS:]
+	}
+	recentErrorsMutex.Unlock()
+
+	errorHandlersMutex.RLock()
+	handlers := errorHandlers
+	errorHandlersMutex.RUnlock()
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+// Redact returns the given destination (host, address or URL) unchanged if
+// SafeLogging is off, otherwise returns a salted hash of it.
+func Redact(destination string) string {
+	if !SafeLogging {
+		return destination
+	}
+	hash := sha256.Sum256(append(redactionSalt, destination...))
+	return fmt.Sprintf("<redacted:%x>", hash[:4])
+}
+
+func randomSalt() []byte {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to generate salt for redaction: %s", err))
+	}
+	return salt
+}
+
 // Debug logs to stdout
 func Debug(arg interface{}) {
-	fmt.Fprintln(os.Stdout, arg)
+	write(0, fmt.Sprint(arg), 1, false)
 }
 
 // Debugf logs to stdout
 func Debugf(message string, args ...interface{}) {
-	fmt.Fprintf(os.Stdout, message+"\n", args...)
+	write(0, fmt.Sprintf(message, args...), 1, false)
 }
 
-// Error logs to stderr
+// Error logs to stderr.  Errors are passed to OnError handlers and kept for
+// RecentErrors even if they're not logged at the configured level.
 func Error(arg interface{}) {
-	fmt.Fprintln(os.Stderr, arg)
+	message := fmt.Sprint(arg)
+	write(1, message, 1, false)
+	notifyError(message)
 }
 
-// Errorf logs to stderr
+// Errorf logs to stderr, see Error
 func Errorf(message string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, message+"\n", args...)
+	message = fmt.Sprintf(message, args...)
+	write(1, message, 1, false)
+	notifyError(message)
 }
 
-// Fatal logs to stderr and then exits with status 1
+// Fatal logs to stderr, regardless of the level, and then exits with status 1
 func Fatal(arg interface{}) {
-	Error(arg)
+	message := fmt.Sprint(arg)
+	write(1, message, 1, true)
+	notifyError(message)
 	os.Exit(1)
 }
 
-// Fatalf logs to stderr and then exits with status 1
+// Fatalf logs to stderr, regardless of the level, and then exits with status
+// 1
 func Fatalf(message string, args ...interface{}) {
-	Errorf(message, args...)
+	message = fmt.Sprintf(message, args...)
+	write(1, message, 1, true)
+	notifyError(message)
 	os.Exit(1)
 }
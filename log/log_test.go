@@ -0,0 +1,127 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Configure(&Config{})
+	path := filepath.Join(dir, "flashlight.log")
+
+	if err := Configure(&Config{Level: "error", File: path}); err != nil {
+		t.Fatal(err)
+	}
+	Debug("hidden")
+	Error("shown")
+	// Messages are attributed to the package of the caller, which is us
+	if err := Configure(&Config{Level: "error,log=debug", Format: FORMAT_JSON, File: path}); err != nil {
+		t.Fatal(err)
+	}
+	Debugf("shown %d", 2)
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " ERROR shown") {
+		t.Fatalf("Unexpected log:\n%s", b)
+	}
+	var line jsonLine
+	if err := json.Unmarshal([]byte(lines[1]), &line); err != nil || line.Level != LEVEL_DEBUG || line.Module != "log" || line.Message != "shown 2" {
+		t.Errorf("Unexpected JSON line %s: %v", lines[1], err)
+	}
+
+	for _, bad := range []string{"verbose", "proxy=debug,error", "=debug"} {
+		if err := (&Config{Level: bad}).Validate(); err == nil {
+			t.Errorf("Level %s should be invalid", bad)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flashlight.log")
+
+	f, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, message := range []string{"first\n", "second\n", "third\n", "fourth\n", "fifth\n"} {
+		f.Write([]byte(message))
+	}
+	for suffix, expected := range map[string]string{"": "fifth\n", ".1": "fourth\n", ".3": "second\n"} {
+		if b, _ := ioutil.ReadFile(path + suffix); string(b) != expected {
+			t.Errorf("Expected %q in %s, got %q", expected, path+suffix, b)
+		}
+	}
+	if _, err := os.Stat(path + ".4"); !os.IsNotExist(err) {
+		t.Errorf("Only %d backups should be kept", FILE_BACKUPS)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Configure(&Config{})
+	defer func(safe bool) { SafeLogging = safe }(SafeLogging)
+	path := filepath.Join(dir, "flashlight.log")
+	if err := Configure(&Config{Level: "debug", File: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	destinations := []string{"example.com", "example.com:443", "http://example.com/secret?q=1", "203.0.113.5:80"}
+	SafeLogging = true
+	seen := make(map[string]bool)
+	for _, dest := range destinations {
+		redacted := Redact(dest)
+		if !strings.HasPrefix(redacted, "<redacted:") || strings.Contains(redacted, "example") || strings.Contains(redacted, "203.0.113.5") {
+			t.Errorf("%s not redacted: %s", dest, redacted)
+		}
+		if Redact(dest) != redacted {
+			t.Errorf("Redacting %s isn't stable, so log lines can't be correlated", dest)
+		}
+		if seen[redacted] {
+			t.Errorf("Different destinations redacted the same: %s", redacted)
+		}
+		seen[redacted] = true
+		Debugf("Dialing %s", Redact(dest))
+	}
+
+	SafeLogging = false
+	for _, dest := range destinations {
+		if redacted := Redact(dest); redacted != dest {
+			t.Errorf("With SafeLogging off, %s should be logged as is, got %s", dest, redacted)
+		}
+	}
+	Debugf("Dialing %s", Redact("unredacted.example"))
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != len(destinations)+1 {
+		t.Fatalf("Unexpected log:\n%s", b)
+	}
+	for _, line := range lines[:len(destinations)] {
+		if strings.Contains(line, "example") || strings.Contains(line, "203.0.113.5") {
+			t.Errorf("Destination leaked into log: %s", line)
+		}
+	}
+	if !strings.HasSuffix(lines[len(destinations)], "Dialing unredacted.example") {
+		t.Errorf("Destination not logged with SafeLogging off: %s", lines[len(destinations)])
+	}
+}
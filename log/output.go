@@ -0,0 +1,225 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LEVEL_DEBUG = "debug" // log everything
+	LEVEL_ERROR = "error" // log only errors
+	LEVEL_NONE  = "none"  // log nothing (errors are still available to OnError handlers and RecentErrors)
+
+	FORMAT_TEXT = "text" // plain messages, with the time and level in files
+	FORMAT_JSON = "json" // one JSON object per line with time, level, module and msg
+
+	DEFAULT_MAX_FILE_SIZE = 10 * 1024 * 1024
+	FILE_BACKUPS          = 3 // number of rotated files kept, as <file>.1 (newest) to <file>.3
+)
+
+var (
+	// levels are the LEVEL_ constants by severity
+	levels = []string{LEVEL_DEBUG, LEVEL_ERROR, LEVEL_NONE}
+
+	current      = &output{}
+	currentMutex sync.RWMutex
+)
+
+func init() {
+	// Route logging from the standard library (e.g. net/http servers' errors
+	// about misbehaving clients) through us
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(stdlibWriter{})
+}
+
+// Config configures logging, see Configure
+type Config struct {
+	// Level (optional) is the minimum level to log, optionally followed by
+	// levels for specific modules (packages), like "error,proxy=debug".
+	// Defaults to LEVEL_DEBUG.
+	Level string
+
+	Format      string // (optional) FORMAT_TEXT (the default) or FORMAT_JSON
+	File        string // (optional) file to which to log instead of stdout (debug) and stderr (errors)
+	MaxFileSize int64  // (optional) size at which File is rotated, defaults to DEFAULT_MAX_FILE_SIZE
+}
+
+// output is where and how we log
+type output struct {
+	level        int            // index in levels
+	moduleLevels map[string]int // by module
+	json         bool
+	file         *rotatingFile
+}
+
+// Configure configures logging.  Until it's called, we log everything as text
+// to stdout and stderr.  It may be called again to reconfigure.
+func Configure(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	out := &output{json: config.Format == FORMAT_JSON}
+	out.level, out.moduleLevels, _ = parseLevel(config.Level)
+	var err error
+	if config.File != "" {
+		out.file, err = openRotatingFile(config.File, config.MaxFileSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	currentMutex.Lock()
+	previous := current
+	current = out
+	currentMutex.Unlock()
+	if previous.file != nil {
+		previous.file.Close()
+	}
+	return nil
+}
+
+// Validate checks the config's Level and Format
+func (config *Config) Validate() error {
+	if _, _, err := parseLevel(config.Level); err != nil {
+		return err
+	}
+	if config.Format != "" && config.Format != FORMAT_TEXT && config.Format != FORMAT_JSON {
+		return fmt.Errorf("Unknown log format %s, use %s or %s", config.Format, FORMAT_TEXT, FORMAT_JSON)
+	}
+	return nil
+}
+
+// parseLevel parses a Config's Level into the index of the default level and
+// those of specific modules
+func parseLevel(spec string) (int, map[string]int, error) {
+	level := 0
+	moduleLevels := make(map[string]int)
+	if spec == "" {
+		return level, moduleLevels, nil
+	}
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		module := ""
+		if eq := strings.Index(part, "="); eq >= 0 {
+			module, part = part[:eq], part[eq+1:]
+			if module == "" {
+				return 0, nil, fmt.Errorf("Missing module in log level %s", spec)
+			}
+		} else if i > 0 {
+			return 0, nil, fmt.Errorf("Only the first log level may be without a module, got %s", spec)
+		}
+		index := indexOf(levels, part)
+		if index < 0 {
+			return 0, nil, fmt.Errorf("Unknown log level %s, use one of %s", part, strings.Join(levels, ", "))
+		}
+		if module == "" {
+			level = index
+		} else {
+			moduleLevels[module] = index
+		}
+	}
+	return level, moduleLevels, nil
+}
+
+// write logs the given message at the given level (an index in levels) if
+// it's enabled for the module that logged it, which is skip frames up from
+// write's caller.  If always, it's logged regardless of the level.
+func write(level int, message string, skip int, always bool) {
+	currentMutex.RLock()
+	defer currentMutex.RUnlock()
+	module := ""
+	if current.json || len(current.moduleLevels) > 0 {
+		module = callerModule(skip + 1)
+	}
+	current.write(level, module, message, always)
+}
+
+func (out *output) write(level int, module string, message string, always bool) {
+	threshold := out.level
+	if moduleLevel, found := out.moduleLevels[module]; found {
+		threshold = moduleLevel
+	}
+	if level < threshold && !always {
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if level > 0 {
+		w = os.Stderr
+	}
+	if out.file != nil {
+		w = out.file
+	}
+	now := time.Now()
+	switch {
+	case out.json:
+		// Encoder adds the newline, and keeps destinations like <redacted:...>
+		// readable by not escaping HTML
+		var line bytes.Buffer
+		encoder := json.NewEncoder(&line)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(&jsonLine{Time: now, Level: levels[level], Module: module, Message: message})
+		w.Write(line.Bytes())
+	case out.file != nil:
+		fmt.Fprintf(w, "%s %s %s\n", now.Format(time.RFC3339), strings.ToUpper(levels[level]), message)
+	default:
+		fmt.Fprintln(w, message)
+	}
+}
+
+// jsonLine is a line logged in FORMAT_JSON
+type jsonLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Module  string    `json:"module,omitempty"`
+	Message string    `json:"msg"`
+}
+
+// callerModule returns the last element of the package path of the function
+// that's skip frames up from callerModule's caller, e.g. proxy
+func callerModule(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+	name := fn.Name()
+	if slash := strings.LastIndex(name, "/"); slash >= 0 {
+		name = name[slash+1:]
+	}
+	if dot := strings.Index(name, "."); dot >= 0 {
+		name = name[:dot]
+	}
+	return name
+}
+
+// stdlibWriter logs what the standard library's logger writes as debug
+// messages of the module stdlib
+type stdlibWriter struct{}
+
+func (w stdlibWriter) Write(b []byte) (int, error) {
+	currentMutex.RLock()
+	defer currentMutex.RUnlock()
+	current.write(0, "stdlib", strings.TrimRight(string(b), "\n"), false)
+	return len(b), nil
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,99 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that's rotated once it reaches maxSize, keeping
+// FILE_BACKUPS old files
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	mutex   sync.Mutex
+}
+
+// OpenRotatingFile opens the file at path for appending, rotating it like a
+// Config's File once it reaches maxSize (DEFAULT_MAX_FILE_SIZE if 0), e.g. for
+// access logs
+func OpenRotatingFile(path string, maxSize int64) (io.WriteCloser, error) {
+	return openRotatingFile(path, maxSize)
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_FILE_SIZE
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens (or creates) path for appending
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open log file %s: %s", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to stat log file %s: %s", f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, fmt.Errorf("Log file %s is closed", f.path)
+	}
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Keep logging to what we have rather than losing messages
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves path to path.1, path.1 to path.2 and so on, dropping the
+// oldest, and starts a new file at path
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", f.path, FILE_BACKUPS))
+	for i := FILE_BACKUPS - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	renameErr := os.Rename(f.path, f.path+".1")
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("Unable to rotate log file %s: %s", f.path, renameErr)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
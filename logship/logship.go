@@ -0,0 +1,197 @@
+// package logship ships clients' error logs to an operator's collection
+// endpoint, through the tunnel, so that failures in the field can be debugged
+// without users having to extract log files.  Errors are batched and POSTed
+// as JSON every Interval, for example:
+//
+//	{
+//	  "client": "3f9a1c0d5e7b2a64",
+//	  "entries": [
+//	    {"time": "2015-03-01T12:00:00Z", "message": "Unable to dial <redacted:1a2b3c4d>: <ip> timed out"}
+//	  ],
+//	  "dropped": 0
+//	}
+//
+// client is random for each run, so that entries can be correlated without
+// identifying the user.  Messages are only as redacted as the logs themselves
+// (see log.Redact), and IP addresses in them are scrubbed as well.  At most
+// MaxPerInterval entries are shipped per Interval, and the rest are counted
+// as dropped.
+package logship
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_INTERVAL         = 1 * time.Minute
+	DEFAULT_MAX_PER_INTERVAL = 50
+	SHIP_TIMEOUT             = 30 * time.Second
+	MAX_MESSAGE_LENGTH       = 1024
+
+	X_LANTERN_LOG_TOKEN = "X-Lantern-Log-Token" // header carrying the Shipper's Token
+)
+
+var (
+	// ipPattern matches IPv4 addresses and IPv6 addresses with at least a
+	// few groups, so that times like 12:00:00 aren't mistaken for them
+	ipPattern = regexp.MustCompile(`\b(\d{1,3}\.){3}\d{1,3}\b|\[?\b([0-9a-fA-F]{0,4}:){3,7}[0-9a-fA-F]{1,4}\b\]?`)
+)
+
+// Entry is an error logged
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Batch is what's shipped at once
+type Batch struct {
+	Client  string   `json:"client"`
+	Entries []*Entry `json:"entries"`
+	Dropped int      `json:"dropped"` // entries that exceeded the rate limit since the last batch
+}
+
+// Shipper ships logged errors
+type Shipper struct {
+	URL            string        // where to POST batches
+	Token          string        // (optional) sent in the X-Lantern-Log-Token header
+	Interval       time.Duration // (optional) how often to ship, defaults to DEFAULT_INTERVAL
+	MaxPerInterval int           // (optional) how many entries to ship per Interval at most, defaults to DEFAULT_MAX_PER_INTERVAL
+
+	client     string
+	httpClient *http.Client
+	entries    []*Entry
+	dropped    int
+	stop       chan bool
+	mutex      sync.Mutex
+}
+
+// Log queues the given error message for shipping, unless the rate limit has
+// been reached.  It's meant to be registered with log.OnError.  It is safe to
+// call on a nil Shipper.
+func (shipper *Shipper) Log(message string) {
+	if shipper == nil {
+		return
+	}
+	max := shipper.MaxPerInterval
+	if max <= 0 {
+		max = DEFAULT_MAX_PER_INTERVAL
+	}
+	shipper.mutex.Lock()
+	defer shipper.mutex.Unlock()
+	if len(shipper.entries) >= max {
+		shipper.dropped += 1
+		return
+	}
+	shipper.entries = append(shipper.entries, &Entry{Time: time.Now(), Message: scrub(message)})
+}
+
+// Start starts shipping periodically in the background, dialing with the
+// given function (e.g. through the tunnel), until Stop
+func (shipper *Shipper) Start(dial func(network, addr string) (net.Conn, error)) {
+	shipper.client = randomId()
+	shipper.httpClient = &http.Client{
+		Timeout:   SHIP_TIMEOUT,
+		Transport: &http.Transport{Dial: dial},
+	}
+	interval := shipper.Interval
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	stop := make(chan bool)
+	shipper.mutex.Lock()
+	shipper.stop = stop
+	shipper.mutex.Unlock()
+	go func() {
+		defer crash.Recover()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			if err := shipper.ship(); err != nil {
+				// Not logged as an error, which would be shipped in turn
+				log.Debugf("Unable to ship logs: %s", err)
+			}
+		}
+	}()
+}
+
+// Stop stops shipping.  Entries queued since the last shipment are kept.  It
+// is safe to call on a nil or stopped Shipper.
+func (shipper *Shipper) Stop() {
+	if shipper == nil {
+		return
+	}
+	shipper.mutex.Lock()
+	defer shipper.mutex.Unlock()
+	if shipper.stop != nil {
+		close(shipper.stop)
+		shipper.stop = nil
+	}
+}
+
+// ship ships the queued entries.  Entries that can't be shipped are dropped,
+// which leaves room for newer ones.
+func (shipper *Shipper) ship() error {
+	shipper.mutex.Lock()
+	batch := &Batch{Client: shipper.client, Entries: shipper.entries, Dropped: shipper.dropped}
+	shipper.entries = nil
+	shipper.dropped = 0
+	shipper.mutex.Unlock()
+	if len(batch.Entries) == 0 && batch.Dropped == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("Unable to encode batch: %s", err)
+	}
+	req, err := http.NewRequest("POST", shipper.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if shipper.Token != "" {
+		req.Header.Set(X_LANTERN_LOG_TOKEN, shipper.Token)
+	}
+	resp, err := shipper.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to post %d entries: %s", len(batch.Entries), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response status posting %d entries: %d", len(batch.Entries), resp.StatusCode)
+	}
+	return nil
+}
+
+// scrub removes IP addresses from the given message and truncates it to
+// MAX_MESSAGE_LENGTH
+func scrub(message string) string {
+	message = ipPattern.ReplaceAllString(message, "<ip>")
+	if len(message) > MAX_MESSAGE_LENGTH {
+		message = message[:MAX_MESSAGE_LENGTH] + "..."
+	}
+	return message
+}
+
+func randomId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,56 @@
+package logship
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	for message, expected := range map[string]string{
+		"dial tcp 10.1.2.3:443: i/o timeout":         "dial tcp <ip>:443: i/o timeout",
+		"dial tcp [2001:db8::1]:443: refused":        "dial tcp <ip>:443: refused",
+		"Probe at 12:00:00 failed":                   "Probe at 12:00:00 failed",
+		"Unable to dial <redacted:1a2b3c4d>: closed": "Unable to dial <redacted:1a2b3c4d>: closed",
+	} {
+		if scrubbed := scrub(message); scrubbed != expected {
+			t.Errorf("Expected %q, got %q", expected, scrubbed)
+		}
+	}
+}
+
+func TestShip(t *testing.T) {
+	batches := make(chan *Batch, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(X_LANTERN_LOG_TOKEN) != "secret" {
+			t.Errorf("Missing token")
+		}
+		batch := &Batch{}
+		if err := json.NewDecoder(req.Body).Decode(batch); err != nil {
+			t.Errorf("Unable to decode batch: %s", err)
+		}
+		batches <- batch
+	}))
+	defer server.Close()
+
+	shipper := &Shipper{URL: server.URL, Token: "secret", MaxPerInterval: 2}
+	shipper.httpClient = &http.Client{Transport: &http.Transport{Dial: net.Dial}}
+	for i := 0; i < 3; i++ {
+		shipper.Log("Unable to reach 10.1.2.3")
+	}
+	if err := shipper.ship(); err != nil {
+		t.Fatalf("Unable to ship: %s", err)
+	}
+	batch := <-batches
+	if len(batch.Entries) != 2 || batch.Dropped != 1 {
+		t.Errorf("Expected 2 entries and 1 dropped, got %d and %d", len(batch.Entries), batch.Dropped)
+	}
+	if batch.Entries[0].Message != "Unable to reach <ip>" {
+		t.Errorf("Message wasn't scrubbed: %s", batch.Entries[0].Message)
+	}
+
+	var nilShipper *Shipper
+	nilShipper.Log("ignored")
+}
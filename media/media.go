@@ -0,0 +1,325 @@
+// package media stretches limited bandwidth by recompressing the media in
+// plain http responses on the server: images are downscaled and re-encoded,
+// and video is throttled to a bitrate cap, which makes adaptive streaming
+// players (HLS, DASH) fall back to lower quality renditions.
+//
+// Clients ask for this per destination with rules (see "compressmedia" in
+// package rules), which mark the destination address that's sent to the
+// server (see protocol.EncodeMedia).  Servers without a Compressor ignore the
+// mark.  Since HTTPS is opaque to the server, only plain http benefits.
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	_ "image/gif"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_MAX_DIMENSION = 800
+	DEFAULT_QUALITY       = 50
+	DEFAULT_VIDEO_KBPS    = 500
+	MAX_IMAGE_SIZE        = 10 * 1024 * 1024 // larger images are passed through unchanged
+	MAX_IMAGE_PIXELS      = 16 * 1000 * 1000 // images with more pixels are passed through unchanged, since small files can decode to huge images
+	MAX_PIPELINED         = 16               // number of requests that may be waiting for responses
+)
+
+// Compressor compresses the media in http responses
+type Compressor struct {
+	MaxDimension int // (optional) maximum width and height of images, defaults to DEFAULT_MAX_DIMENSION
+	Quality      int // (optional) JPEG quality (1-100), defaults to DEFAULT_QUALITY
+	VideoKbps    int // (optional) bitrate to which to throttle video, defaults to DEFAULT_VIDEO_KBPS, negative disables throttling
+}
+
+// Wrap returns a connection that relays http between its user and the given
+// connection to an origin, compressing the media in responses.  Protocol
+// upgrades (e.g. websockets) are relayed unchanged.
+func (c *Compressor) Wrap(origin net.Conn) net.Conn {
+	conn, user := net.Pipe()
+	go c.serve(user, origin)
+	return conn
+}
+
+// exchange is a request that has been forwarded to the origin and is waiting
+// for its response
+type exchange struct {
+	req     *http.Request
+	written chan error // receives the result of writing the request
+	resume  chan bool  // for upgrade requests, tells forwardRequests whether to keep going
+}
+
+// serve relays requests from user to origin and responses back until either
+// side closes the connection.  Requests are forwarded as soon as they arrive,
+// so pipelined requests reach the origin without waiting for earlier
+// responses, and large uploads don't hold up responses (e.g. an origin
+// refusing an upload early).  Responses are relayed in order.
+func (c *Compressor) serve(user net.Conn, origin net.Conn) {
+	defer user.Close()
+	defer origin.Close()
+	userReader := bufio.NewReader(user)
+	originReader := bufio.NewReader(origin)
+	pending := make(chan *exchange, MAX_PIPELINED)
+	stop := make(chan bool)
+	defer close(stop)
+	go forwardRequests(userReader, origin, pending, stop)
+
+	for ex := range pending {
+		resp, err := readFinalResponse(originReader, ex.req, user)
+		if err != nil {
+			log.Debugf("Unable to read response from origin: %s", err)
+			return
+		}
+		upgraded := resp.StatusCode == http.StatusSwitchingProtocols
+		if ex.resume != nil {
+			ex.resume <- !upgraded
+		}
+		c.compress(resp)
+		err = resp.Write(user)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		if upgraded {
+			// forwardRequests has stopped, so userReader is ours now
+			go io.Copy(origin, userReader)
+			io.Copy(user, originReader)
+			return
+		}
+		if ex.req.Close || resp.Close || delimitedByClose(ex.req, resp) {
+			// Connection is done (or the response was delimited by
+			// closing it)
+			return
+		}
+		if err := <-ex.written; err != nil {
+			log.Debugf("Unable to write request to origin: %s", err)
+			return
+		}
+	}
+}
+
+// forwardRequests reads requests from user and writes them to origin, queueing
+// them on pending for their responses, until the user is done, a request asks
+// to close the connection or a request upgrades the connection.
+func forwardRequests(userReader *bufio.Reader, origin net.Conn, pending chan *exchange, stop chan bool) {
+	defer close(pending)
+	for {
+		req, err := http.ReadRequest(userReader)
+		if err != nil {
+			return
+		}
+		ex := &exchange{req: req, written: make(chan error, 1)}
+		upgrade := req.Header.Get("Upgrade") != ""
+		if upgrade {
+			ex.resume = make(chan bool, 1)
+		}
+		select {
+		case pending <- ex:
+		case <-stop:
+			return
+		}
+		err = req.Write(origin)
+		ex.written <- err
+		if err != nil || req.Close {
+			return
+		}
+		if upgrade {
+			// Whatever follows may not be http, wait for the response
+			select {
+			case resume := <-ex.resume:
+				if !resume {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// readFinalResponse reads the response to the given request from originReader,
+// relaying any interim (1xx) responses such as 100 Continue to user on the way.
+func readFinalResponse(originReader *bufio.Reader, req *http.Request, user io.Writer) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(originReader, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		// Interim responses have no body, write them as is
+		if _, err := fmt.Fprintf(user, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+			return nil, err
+		}
+		if err := resp.Header.Write(user); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(user, "\r\n"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// delimitedByClose indicates whether the given response's body ends when the
+// origin closes the connection, rather than with a length or chunking
+func delimitedByClose(req *http.Request, resp *http.Response) bool {
+	if req.Method == "HEAD" || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+}
+
+// compress compresses the given response's body if it's an image or video
+func (c *Compressor) compress(resp *http.Response) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(contentType, "image/jpeg") || strings.HasPrefix(contentType, "image/png"):
+		c.compressImage(resp)
+	case strings.HasPrefix(contentType, "video/"):
+		kbps := c.VideoKbps
+		if kbps == 0 {
+			kbps = DEFAULT_VIDEO_KBPS
+		}
+		if kbps > 0 {
+			resp.Body = &throttledReader{ReadCloser: resp.Body, bytesPerSecond: kbps * 1000 / 8, start: time.Now()}
+		}
+	}
+}
+
+// compressImage replaces the given response's body with a downscaled and
+// re-encoded version of the image, if that's smaller
+func (c *Compressor) compressImage(resp *http.Response) {
+	original := resp.Body
+	body, err := ioutil.ReadAll(io.LimitReader(original, MAX_IMAGE_SIZE+1))
+	if err != nil || len(body) > MAX_IMAGE_SIZE {
+		// Pass through what we've read along with the rest
+		resp.Body = &readCloser{io.MultiReader(bytes.NewReader(body), original), original}
+		return
+	}
+	original.Close()
+	compressed := c.recompress(body)
+	if compressed == nil || len(compressed) >= len(body) {
+		compressed = body
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	resp.ContentLength = int64(len(compressed))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Length")
+}
+
+// recompress downscales and re-encodes the given image in its original
+// format, returning nil if it can't
+func (c *Compressor) recompress(b []byte) []byte {
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	if int64(config.Width)*int64(config.Height) > MAX_IMAGE_PIXELS {
+		log.Debugf("Not decoding %dx%d image", config.Width, config.Height)
+		return nil
+	}
+	img, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	maxDimension := c.MaxDimension
+	if maxDimension <= 0 {
+		maxDimension = DEFAULT_MAX_DIMENSION
+	}
+	img = downscale(img, maxDimension)
+	out := &bytes.Buffer{}
+	switch format {
+	case "jpeg":
+		quality := c.Quality
+		if quality <= 0 {
+			quality = DEFAULT_QUALITY
+		}
+		err = jpeg.Encode(out, img, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(out, img)
+	default:
+		return nil
+	}
+	if err != nil {
+		log.Debugf("Unable to encode %s: %s", format, err)
+		return nil
+	}
+	return out.Bytes()
+}
+
+// downscale scales the given image to fit within maxDimension in each
+// direction, averaging the source pixels that make up each target pixel
+func downscale(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxDimension && height <= maxDimension {
+		return img
+	}
+	scaled := image.Rect(0, 0, maxDimension, height*maxDimension/width)
+	if height > width {
+		scaled = image.Rect(0, 0, width*maxDimension/height, maxDimension)
+	}
+	if scaled.Dx() == 0 || scaled.Dy() == 0 {
+		return img
+	}
+	result := image.NewRGBA(scaled)
+	for y := 0; y < scaled.Dy(); y++ {
+		y0, y1 := bounds.Min.Y+y*height/scaled.Dy(), bounds.Min.Y+(y+1)*height/scaled.Dy()
+		for x := 0; x < scaled.Dx(); x++ {
+			x0, x1 := bounds.Min.X+x*width/scaled.Dx(), bounds.Min.X+(x+1)*width/scaled.Dx()
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+				}
+			}
+			result.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return result
+}
+
+// throttledReader reads no faster than bytesPerSecond
+type throttledReader struct {
+	io.ReadCloser
+	bytesPerSecond int
+	start          time.Time
+	read           int64
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	// Read in small chunks so that the rate stays smooth
+	if chunk := r.bytesPerSecond / 4; len(b) > chunk && chunk > 0 {
+		b = b[:chunk]
+	}
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+	due := r.start.Add(time.Duration(r.read * int64(time.Second) / int64(r.bytesPerSecond)))
+	if wait := due.Sub(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,204 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testJPEG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * y), uint8(x), uint8(y), 255})
+		}
+	}
+	out := &bytes.Buffer{}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("Unable to encode test image: %s", err)
+	}
+	return out.Bytes()
+}
+
+// serveOrigin responds to one request on conn with the given body
+func serveOrigin(conn net.Conn, contentType string, body []byte) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	resp.Write(conn)
+}
+
+func get(t *testing.T, conn net.Conn) *http.Response {
+	req, _ := http.NewRequest("GET", "http://origin.example/image.jpg", nil)
+	go req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Unable to read response: %s", err)
+	}
+	return resp
+}
+
+func TestCompressImage(t *testing.T) {
+	original := testJPEG(t, 1600, 400)
+	origin, originSide := net.Pipe()
+	go serveOrigin(originSide, "image/jpeg", original)
+	conn := (&Compressor{}).Wrap(origin)
+	defer conn.Close()
+
+	resp := get(t, conn)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unable to read body: %s", err)
+	}
+	if len(body) >= len(original) {
+		t.Errorf("Image wasn't compressed, %d bytes became %d", len(original), len(body))
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("Wrong Content-Length %s for %d bytes", resp.Header.Get("Content-Length"), len(body))
+	}
+	img, err := jpeg.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to decode compressed image: %s", err)
+	}
+	if size := img.Bounds().Size(); size.X != DEFAULT_MAX_DIMENSION || size.Y != 200 {
+		t.Errorf("Expected image to be downscaled to 800x200, was %v", size)
+	}
+}
+
+func TestDecompressionBomb(t *testing.T) {
+	small := &bytes.Buffer{}
+	png.Encode(small, image.NewGray(image.Rect(0, 0, 1, 1)))
+	// Claim to be 100000x100000 in the IHDR chunk, fixing up its CRC
+	bomb := small.Bytes()
+	binary.BigEndian.PutUint32(bomb[16:], 100000)
+	binary.BigEndian.PutUint32(bomb[20:], 100000)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+	if config, err := png.DecodeConfig(bytes.NewReader(bomb)); err != nil || config.Width != 100000 {
+		t.Fatalf("Unable to build test image: %v", err)
+	}
+	if (&Compressor{}).recompress(bomb) != nil {
+		t.Errorf("Huge image shouldn't be recompressed")
+	}
+}
+
+func TestThrottleVideo(t *testing.T) {
+	video := make([]byte, 20000)
+	origin, originSide := net.Pipe()
+	go serveOrigin(originSide, "video/mp4", video)
+	// 20000 bytes at 800 kbps take 200ms
+	conn := (&Compressor{VideoKbps: 800}).Wrap(origin)
+	defer conn.Close()
+
+	start := time.Now()
+	resp := get(t, conn)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if len(body) != len(video) {
+		t.Errorf("Expected %d bytes of video, got %d", len(video), len(body))
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Video wasn't throttled, took %s", elapsed)
+	}
+}
+
+func TestEarlyResponseToUpload(t *testing.T) {
+	origin, originSide := net.Pipe()
+	go func() {
+		// Refuse the upload without reading its body
+		req, err := http.ReadRequest(bufio.NewReader(originSide))
+		if err != nil {
+			return
+		}
+		resp := &http.Response{StatusCode: http.StatusRequestEntityTooLarge, ProtoMajor: 1, ProtoMinor: 1, Request: req, Close: true}
+		resp.Write(originSide)
+		originSide.Close()
+	}()
+	conn := (&Compressor{}).Wrap(origin)
+	defer conn.Close()
+
+	upload := make([]byte, 10*1024*1024)
+	req, _ := http.NewRequest("POST", "http://origin.example/upload", bytes.NewReader(upload))
+	go req.Write(conn)
+	result := make(chan int)
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			result <- 0
+			return
+		}
+		result <- resp.StatusCode
+	}()
+	select {
+	case status := <-result:
+		if status != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413, got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload held up the response")
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	origin, originSide := net.Pipe()
+	go func() {
+		// Only respond once both requests have arrived
+		defer originSide.Close()
+		reader := bufio.NewReader(originSide)
+		var reqs []*http.Request
+		for i := 0; i < 2; i++ {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		for _, req := range reqs {
+			body := req.URL.Path
+			resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Request: req, ContentLength: int64(len(body)), Body: ioutil.NopCloser(strings.NewReader(body))}
+			resp.Write(originSide)
+		}
+	}()
+	conn := (&Compressor{}).Wrap(origin)
+	defer conn.Close()
+
+	first, _ := http.NewRequest("GET", "http://origin.example/first", nil)
+	second, _ := http.NewRequest("GET", "http://origin.example/second", nil)
+	go func() {
+		first.Write(conn)
+		second.Write(conn)
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, req := range []*http.Request{first, second} {
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("Unable to read response to %s: %s", req.URL.Path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != req.URL.Path {
+			t.Errorf("Expected response for %s, got %s", req.URL.Path, body)
+		}
+	}
+}
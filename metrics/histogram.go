@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// LATENCY_BUCKETS are the upper bounds (in milliseconds) of the buckets
+	// into which latencies are counted.  Percentiles are reported as the
+	// upper bound of the bucket that they fall in, so they're only as precise
+	// as these.
+	LATENCY_BUCKETS = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000, 60000}
+
+	// PERCENTILES are the percentiles reported for each histogram, as
+	// <name>_p<percentile>
+	PERCENTILES = []int{50, 90, 99}
+)
+
+// Exemplar is the slowest observation of a histogram during an export
+// interval, which points at a concrete example (e.g. a masquerade host) when
+// latency goes up
+type Exemplar struct {
+	Name   string  // the histogram's name
+	Millis float64 // the observed latency
+	Label  string  // what was observed, e.g. the host
+}
+
+// histogram counts latencies into LATENCY_BUCKETS.  Everything but the total
+// is reset on every Snapshot, so percentiles are for the export interval.
+type histogram struct {
+	total    int64
+	count    int64
+	buckets  []int64 // one per bucket in LATENCY_BUCKETS, plus one for anything slower
+	exemplar *Exemplar
+}
+
+// Observe records a latency in the named histogram, along with a label
+// describing what was observed (e.g. the host) that's exported as an
+// Exemplar if it's the slowest of the interval.  Histograms are exported as a
+// <name>_count counter and <name>_p50, _p90, _p99 and _max gauges (ms).  It
+// is safe to call on a nil Registry.
+func (registry *Registry) Observe(name string, latency time.Duration, label string) {
+	if registry == nil {
+		return
+	}
+	millis := float64(latency) / float64(time.Millisecond)
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	h := registry.histograms[name]
+	if h == nil {
+		if registry.histograms == nil {
+			registry.histograms = make(map[string]*histogram)
+		}
+		h = &histogram{buckets: make([]int64, len(LATENCY_BUCKETS)+1)}
+		registry.histograms[name] = h
+	}
+	h.total++
+	h.count++
+	h.buckets[bucketFor(millis)]++
+	if h.exemplar == nil || millis > h.exemplar.Millis {
+		h.exemplar = &Exemplar{Name: name, Millis: millis, Label: label}
+	}
+}
+
+// LatencyName returns the name of the histogram for the latency of the given
+// phase (e.g. dial or total) via the given route (e.g. cloudflare or direct),
+// like latency_dial_cloudflare
+func LatencyName(phase string, route string) string {
+	return "latency_" + phase + "_" + route
+}
+
+func bucketFor(millis float64) int {
+	for i, bound := range LATENCY_BUCKETS {
+		if millis <= bound {
+			return i
+		}
+	}
+	return len(LATENCY_BUCKETS)
+}
+
+// points returns the histogram's count as a counter (named name_count) and,
+// if anything was observed since the last time, its PERCENTILES and max as
+// gauges in milliseconds.  It resets the histogram for the next interval.
+// The caller must hold the Registry's mutex.
+func (h *histogram) points(name string) []*Point {
+	points := []*Point{{
+		Name:  name + "_count",
+		Kind:  COUNTER,
+		Value: float64(h.total),
+		Delta: float64(h.count),
+	}}
+	if h.count == 0 {
+		return points
+	}
+	for _, percentile := range PERCENTILES {
+		points = append(points, &Point{
+			Name:  fmt.Sprintf("%s_p%d", name, percentile),
+			Kind:  GAUGE,
+			Value: h.percentile(float64(percentile) / 100),
+		})
+	}
+	points = append(points, &Point{Name: name + "_max", Kind: GAUGE, Value: h.exemplar.Millis})
+	h.count = 0
+	h.buckets = make([]int64, len(h.buckets))
+	h.exemplar = nil
+	return points
+}
+
+// percentile returns the upper bound of the bucket in which the given
+// fraction of observations falls, or the max if that's lower
+func (h *histogram) percentile(fraction float64) float64 {
+	rank := int64(fraction*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			if i < len(LATENCY_BUCKETS) && LATENCY_BUCKETS[i] < h.exemplar.Millis {
+				return LATENCY_BUCKETS[i]
+			}
+			break
+		}
+	}
+	return h.exemplar.Millis
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	INFLUX_TIMEOUT = 10 * time.Second
+)
+
+var (
+	influxEscaper       = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// Influx exports metrics in the InfluxDB line protocol, either by POSTing them
+// to an http(s) URL (e.g. http://localhost:8086/write?db=flashlight) or by
+// sending them to a udp://host:port (e.g. Telegraf's socket_listener).  Each
+// metric is a field of the measurement named by Batch.Prefix, tagged with
+// Batch.Tags.  Exemplars go in the <prefix>_exemplars measurement, tagged with
+// the histogram's name as metric, with their latency (ms) and label as fields.
+type Influx struct {
+	URL string
+
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+func (influx *Influx) Export(batch *Batch) error {
+	u, err := url.Parse(influx.URL)
+	if err != nil {
+		return fmt.Errorf("Unable to parse InfluxDB URL: %s", err)
+	}
+	lines := influxLines(batch)
+	if u.Scheme == "udp" {
+		influx.mutex.Lock()
+		defer influx.mutex.Unlock()
+		if influx.conn == nil {
+			influx.conn, err = net.Dial("udp", u.Host)
+			if err != nil {
+				return fmt.Errorf("Unable to dial InfluxDB at %s: %s", u.Host, err)
+			}
+		}
+		return sendDatagrams(influx.conn, lines)
+	}
+
+	client := &http.Client{Timeout: INFLUX_TIMEOUT}
+	resp, err := client.Post(influx.URL, "text/plain; charset=utf-8", bytes.NewReader([]byte(strings.Join(lines, "\n")+"\n")))
+	if err != nil {
+		return fmt.Errorf("Unable to post metrics to InfluxDB: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response status posting metrics to InfluxDB: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// influxLines formats the given batch as lines of the InfluxDB line protocol,
+// one per point
+func influxLines(batch *Batch) []string {
+	series := influxEscaper.Replace(batch.Prefix)
+	exemplarSeries := influxEscaper.Replace(batch.Prefix + "_exemplars")
+	tags := ""
+	tagNames := make([]string, 0, len(batch.Tags))
+	for name := range batch.Tags {
+		tagNames = append(tagNames, name)
+	}
+	// InfluxDB prefers tags sorted by name
+	sort.Strings(tagNames)
+	for _, name := range tagNames {
+		tags += "," + influxEscaper.Replace(name) + "=" + influxEscaper.Replace(batch.Tags[name])
+	}
+	series += tags
+	timestamp := strconv.FormatInt(batch.Time.UnixNano(), 10)
+
+	lines := make([]string, 0, len(batch.Points)+len(batch.Exemplars))
+	for _, point := range batch.Points {
+		value := formatFloat(point.Value)
+		if point.Kind == COUNTER {
+			value = strconv.FormatInt(int64(point.Value), 10) + "i"
+		}
+		lines = append(lines, series+" "+influxEscaper.Replace(point.Name)+"="+value+" "+timestamp)
+	}
+	for _, exemplar := range batch.Exemplars {
+		lines = append(lines, fmt.Sprintf(`%s%s,metric=%s ms=%s,label="%s" %s`,
+			exemplarSeries, tags, influxEscaper.Replace(exemplar.Name), formatFloat(exemplar.Millis),
+			influxStringEscaper.Replace(exemplar.Label), timestamp))
+	}
+	return lines
+}
@@ -0,0 +1,210 @@
+// package metrics collects flashlight's counters, gauges and latency
+// histograms and periodically exports them to monitoring systems.  Exporters for StatsD and the InfluxDB
+// line protocol are included, so that operators can use whatever they already
+// run (Telegraf, Graphite, InfluxDB and the like).
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_INTERVAL = 10 * time.Second
+	DEFAULT_PREFIX   = "flashlight"
+)
+
+// Kind is the kind of a metric
+type Kind int
+
+const (
+	COUNTER Kind = iota // a count that only goes up, like bytes sent
+	GAUGE               // a value that goes up and down, like open connections
+)
+
+// Point is the value of a metric at the time of an export
+type Point struct {
+	Name  string
+	Kind  Kind
+	Value float64 // for counters, the total so far
+	Delta float64 // for counters, the change since the previous export
+}
+
+// Batch is what's exported at once
+type Batch struct {
+	Prefix string            // prefix for metric names (or the measurement name)
+	Tags   map[string]string // tags that apply to all points, for exporters that support them
+	Time   time.Time
+	Points []*Point // sorted by name
+
+	// Exemplars are the slowest observations of the histograms that were
+	// observed since the previous export, sorted by name
+	Exemplars []*Exemplar
+}
+
+// Exporter exports metrics to a monitoring system
+type Exporter interface {
+	Export(batch *Batch) error
+}
+
+// Registry holds the metrics and exports them periodically
+type Registry struct {
+	Exporters []Exporter        // where to export metrics
+	Interval  time.Duration     // (optional) how often to export, defaults to DEFAULT_INTERVAL
+	Prefix    string            // (optional) prefix for metric names, defaults to DEFAULT_PREFIX
+	Tags      map[string]string // (optional) tags that apply to all metrics, e.g. role
+
+	counters   map[string]*int64
+	previous   map[string]int64
+	histograms map[string]*histogram
+	gauges     []func() map[string]float64
+	stop       chan bool
+	mutex      sync.Mutex
+}
+
+// Add adds delta to the named counter.  It is safe to call on a nil Registry.
+func (registry *Registry) Add(name string, delta int64) {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	counter := registry.counters[name]
+	if counter == nil {
+		if registry.counters == nil {
+			registry.counters = make(map[string]*int64)
+		}
+		counter = new(int64)
+		registry.counters[name] = counter
+	}
+	registry.mutex.Unlock()
+	atomic.AddInt64(counter, delta)
+}
+
+// AddGauges registers a function that's called on every export for the
+// current values of some gauges, by name.  It is safe to call on a nil
+// Registry.
+func (registry *Registry) AddGauges(gauges func() map[string]float64) {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.gauges = append(registry.gauges, gauges)
+}
+
+// Start starts exporting periodically in the background, until Stop.  It is
+// safe to call on a nil Registry.
+func (registry *Registry) Start() {
+	if registry == nil {
+		return
+	}
+	interval := registry.Interval
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	stop := make(chan bool)
+	registry.mutex.Lock()
+	registry.stop = stop
+	registry.mutex.Unlock()
+	go func() {
+		defer crash.Recover()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			registry.export()
+		}
+	}()
+}
+
+// Stop stops exporting.  It is safe to call on a nil or stopped Registry.
+func (registry *Registry) Stop() {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.stop != nil {
+		close(registry.stop)
+		registry.stop = nil
+	}
+}
+
+func (registry *Registry) export() {
+	batch := registry.Snapshot()
+	for _, exporter := range registry.Exporters {
+		if err := exporter.Export(batch); err != nil {
+			log.Errorf("Unable to export metrics: %s", err)
+		}
+	}
+}
+
+// Snapshot returns the current values of all metrics.  Counters' deltas are
+// relative to the previous Snapshot, and histograms' percentiles and
+// Exemplars cover what was observed since then.
+func (registry *Registry) Snapshot() *Batch {
+	registry.mutex.Lock()
+	gauges := registry.gauges
+	if registry.previous == nil {
+		registry.previous = make(map[string]int64)
+	}
+	var points []*Point
+	for name, counter := range registry.counters {
+		value := atomic.LoadInt64(counter)
+		points = append(points, &Point{
+			Name:  name,
+			Kind:  COUNTER,
+			Value: float64(value),
+			Delta: float64(value - registry.previous[name]),
+		})
+		registry.previous[name] = value
+	}
+	var exemplars []*Exemplar
+	for name, h := range registry.histograms {
+		if h.exemplar != nil {
+			exemplars = append(exemplars, h.exemplar)
+		}
+		points = append(points, h.points(name)...)
+	}
+	registry.mutex.Unlock()
+
+	// Gauges are read without holding the lock, since they may be slow
+	for _, g := range gauges {
+		for name, value := range g() {
+			points = append(points, &Point{Name: name, Kind: GAUGE, Value: value})
+		}
+	}
+	sort.Sort(byName(points))
+	sort.Sort(exemplarsByName(exemplars))
+
+	prefix := registry.Prefix
+	if prefix == "" {
+		prefix = DEFAULT_PREFIX
+	}
+	return &Batch{
+		Prefix:    prefix,
+		Tags:      registry.Tags,
+		Time:      time.Now(),
+		Points:    points,
+		Exemplars: exemplars,
+	}
+}
+
+type byName []*Point
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+type exemplarsByName []*Exemplar
+
+func (a exemplarsByName) Len() int           { return len(a) }
+func (a exemplarsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a exemplarsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRegistry(exporters ...Exporter) *Registry {
+	registry := &Registry{Exporters: exporters, Tags: map[string]string{"role": "server"}}
+	registry.Add("bytes_sent", 100)
+	registry.AddGauges(func() map[string]float64 {
+		return map[string]float64{"goroutines": 12}
+	})
+	return registry
+}
+
+func TestSnapshot(t *testing.T) {
+	registry := testRegistry()
+	registry.Snapshot()
+	registry.Add("bytes_sent", 50)
+	batch := registry.Snapshot()
+	if len(batch.Points) != 2 {
+		t.Fatalf("Expected 2 points, got %d", len(batch.Points))
+	}
+	counter := batch.Points[0]
+	if counter.Name != "bytes_sent" || counter.Value != 150 || counter.Delta != 50 {
+		t.Errorf("Unexpected counter: %+v", counter)
+	}
+	if gauge := batch.Points[1]; gauge.Name != "goroutines" || gauge.Value != 12 {
+		t.Errorf("Unexpected gauge: %+v", gauge)
+	}
+
+	var nilRegistry *Registry
+	nilRegistry.Add("bytes_sent", 1)
+}
+
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	registry := testRegistry(&StatsD{Addr: conn.LocalAddr().String()})
+	registry.export()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, MAX_DATAGRAM_SIZE)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("Unable to read datagram: %s", err)
+	}
+	expected := "flashlight.bytes_sent:100|c\nflashlight.goroutines:12|g"
+	if string(b[:n]) != expected {
+		t.Errorf("Expected %q, got %q", expected, b[:n])
+	}
+}
+
+func TestInflux(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+		resp.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	registry := testRegistry(&Influx{URL: server.URL + "/write?db=flashlight"})
+	registry.export()
+	lines := strings.Split(strings.TrimSpace(<-bodies), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %v", lines)
+	}
+	if !strings.HasPrefix(lines[0], "flashlight,role=server bytes_sent=100i ") {
+		t.Errorf("Unexpected counter line: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "flashlight,role=server goroutines=12 ") {
+		t.Errorf("Unexpected gauge line: %s", lines[1])
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	registry := &Registry{}
+	for i := 1; i < 100; i++ {
+		registry.Observe("latency_dial_cloudflare", time.Duration(i)*time.Millisecond, "cdnjs.com")
+	}
+	registry.Observe("latency_dial_cloudflare", 3*time.Second, "slow.example.com")
+	batch := registry.Snapshot()
+	values := make(map[string]float64)
+	for _, point := range batch.Points {
+		values[point.Name] = point.Value
+	}
+	expected := map[string]float64{
+		"latency_dial_cloudflare_count": 100,
+		"latency_dial_cloudflare_p50":   50,
+		"latency_dial_cloudflare_p90":   100,
+		"latency_dial_cloudflare_p99":   100,
+		"latency_dial_cloudflare_max":   3000,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s to be %v, got %v", name, value, values[name])
+		}
+	}
+	if len(batch.Exemplars) != 1 || batch.Exemplars[0].Label != "slow.example.com" {
+		t.Errorf("Expected the slowest observation as exemplar, got %v", batch.Exemplars)
+	}
+	lines := influxLines(batch)
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, `flashlight_exemplars,metric=latency_dial_cloudflare ms=3000,label="slow.example.com" `) {
+		t.Errorf("Unexpected exemplar line: %s", last)
+	}
+
+	// Percentiles are per interval
+	batch = registry.Snapshot()
+	if len(batch.Points) != 1 || batch.Points[0].Delta != 0 || len(batch.Exemplars) != 0 {
+		t.Errorf("Expected only the count after an idle interval, got %v", batch.Points)
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	MAX_DATAGRAM_SIZE = 1432 // keeps datagrams within a typical MTU
+)
+
+// StatsD exports metrics to a StatsD server (or Telegraf's statsd input) over
+// UDP.  Counters are sent as their change since the last export, gauges as
+// their current value.  StatsD has no tags, so Batch.Tags are ignored, as are
+// Batch.Exemplars.
+type StatsD struct {
+	Addr string // host:port of the StatsD server
+
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+func (statsd *StatsD) Export(batch *Batch) error {
+	lines := make([]string, 0, len(batch.Points))
+	for _, point := range batch.Points {
+		name := batch.Prefix + "." + point.Name
+		if point.Kind == COUNTER {
+			lines = append(lines, fmt.Sprintf("%s:%s|c", name, formatFloat(point.Delta)))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s:%s|g", name, formatFloat(point.Value)))
+		}
+	}
+	statsd.mutex.Lock()
+	defer statsd.mutex.Unlock()
+	if statsd.conn == nil {
+		conn, err := net.Dial("udp", statsd.Addr)
+		if err != nil {
+			return fmt.Errorf("Unable to dial StatsD at %s: %s", statsd.Addr, err)
+		}
+		statsd.conn = conn
+	}
+	return sendDatagrams(statsd.conn, lines)
+}
+
+// sendDatagrams sends the given lines, newline-separated, in as few datagrams
+// as possible
+func sendDatagrams(conn net.Conn, lines []string) error {
+	var datagram []byte
+	flush := func() error {
+		if len(datagram) == 0 {
+			return nil
+		}
+		_, err := conn.Write(datagram)
+		datagram = datagram[:0]
+		return err
+	}
+	for _, line := range lines {
+		if len(datagram) > 0 && len(datagram)+1+len(line) > MAX_DATAGRAM_SIZE {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if len(datagram) > 0 {
+			datagram = append(datagram, '\n')
+		}
+		datagram = append(datagram, line...)
+	}
+	return flush()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
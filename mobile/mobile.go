@@ -0,0 +1,127 @@
+// package mobile runs the flashlight client inside mobile apps, through
+// bindings generated with gomobile:
+//
+//	gomobile bind -target=android github.com/getlantern/flashlight/mobile
+//	gomobile bind -target=ios github.com/getlantern/flashlight/mobile
+//
+// It only uses types that gomobile supports (strings, bools and errors), so
+// lists are comma-separated.  Unlike the flashlight command, nothing here
+// parses flags or exits the process; problems are returned as errors.
+package mobile
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/client"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	START_TIMEOUT      = 5 * time.Second       // how long Start waits for the client to listen
+	START_POLL         = 50 * time.Millisecond // how often Start checks whether the client is listening
+	STOP_DRAIN_TIMEOUT = 2 * time.Second       // how long Stop waits for open connections to finish
+)
+
+var (
+	current *client.Client
+	mutex   sync.Mutex
+)
+
+// Start starts the client proxy listening with http at addr (e.g.
+// 127.0.0.1:8787), reaching the given servers (comma-separated FQDNs) via the
+// given masquerades (comma-separated, or empty to dial the servers directly).
+// It returns once the client is listening, or with an error if it can't
+// start.
+func Start(addr string, servers string, masquerades string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current != nil {
+		return fmt.Errorf("Already started")
+	}
+	// Check up front, since something else listening at addr would look
+	// like the client while we wait for it
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen at %s: %s", addr, err)
+	}
+	l.Close()
+	c := client.New(&client.Config{
+		Addr:        addr,
+		Servers:     splitList(servers),
+		Masquerades: splitList(masquerades),
+	})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.ListenAndServe()
+	}()
+	if err := waitUntilListening(addr, errCh); err != nil {
+		c.Close()
+		return err
+	}
+	go func() {
+		if err := <-errCh; err != nil {
+			log.Errorf("Client proxy stopped: %s", err)
+		}
+	}()
+	current = c
+	return nil
+}
+
+// Stop stops the client proxy, giving open connections up to
+// STOP_DRAIN_TIMEOUT to finish.  Stopping a client that isn't running does
+// nothing.
+func Stop() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		return
+	}
+	current.Close()
+	current.Shutdown(STOP_DRAIN_TIMEOUT)
+	current = nil
+}
+
+// IsConnected indicates whether the client is running and its latest dial to
+// a server succeeded.  It's false until the first request goes through.
+func IsConnected() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return current != nil && current.IsConnected()
+}
+
+// waitUntilListening waits until something accepts connections at addr, or
+// until the client fails (with an error on errCh), for up to START_TIMEOUT
+func waitUntilListening(addr string, errCh chan error) error {
+	deadline := time.Now().Add(START_TIMEOUT)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-errCh:
+			if err == nil {
+				err = fmt.Errorf("Client proxy stopped")
+			}
+			return fmt.Errorf("Unable to start client proxy: %s", err)
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", addr, START_POLL); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(START_POLL)
+	}
+	return fmt.Errorf("Client proxy didn't start listening at %s within %v", addr, START_TIMEOUT)
+}
+
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package mobile
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStartStop(t *testing.T) {
+	if err := Start("127.0.0.1:0", "", ""); err == nil {
+		Stop()
+		t.Fatalf("Expected error starting without servers")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	// Starting again after stopping must find the port free
+	for i := 0; i < 2; i++ {
+		if err := Start(addr, "fl1.example.org", ""); err != nil {
+			t.Fatalf("Unable to start: %s", err)
+		}
+		if err := Start(addr, "fl1.example.org", ""); err == nil {
+			t.Errorf("Expected error starting twice")
+		}
+		if IsConnected() {
+			t.Errorf("Expected not to be connected before any requests")
+		}
+		Stop()
+	}
+	if IsConnected() {
+		t.Errorf("Expected not to be connected after stopping")
+	}
+}
+
+func TestStopLeavesNoGoroutines(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		if err := Start(addr, "fl1.example.org,fl2.example.org", "m1.example.org"); err != nil {
+			t.Fatalf("Unable to start: %s", err)
+		}
+		Stop()
+	}
+	// Give stopped loops a moment to return
+	after := runtime.NumGoroutine()
+	for i := 0; i < 50 && after > before+2; i++ {
+		time.Sleep(100 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before+2 {
+		buf := make([]byte, 1<<20)
+		t.Errorf("Expected about %d goroutines after stopping, got %d:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
@@ -0,0 +1,187 @@
+// package offline implements an http.RoundTripper that keeps copies of pages
+// from selected domains for offline reading.  Pages from those domains have
+// their no-cache headers relaxed so that the browser's cache holds on to them,
+// and a copy is saved in a store.Store (encrypted if the store is).  When the
+// upstream can't be reached (e.g. during a shutdown), the saved copy is served
+// instead.  Pages are saved on every visit, and when the saved pages grow
+// beyond MaxBytes, the least recently visited ones are evicted.
+//
+// Which domains are kept is under the user's explicit control through the
+// "offline" setting in the rules file (see package rules).  Only plain http
+// pages can be kept, since HTTPS is tunneled end-to-end.
+package offline
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/rules"
+	"github.com/getlantern/flashlight/store"
+)
+
+const (
+	DEFAULT_MAX_BYTES = 50 * 1024 * 1024
+	MAX_PAGE_SIZE     = 5 * 1024 * 1024 // largest response that we'll keep
+	CACHE_MAX_AGE     = 24 * time.Hour  // how long browsers may cache kept pages
+	NAME_PREFIX       = "offline-"
+
+	X_LANTERN_OFFLINE = "X-Lantern-Offline" // header marking responses served from the offline copy
+)
+
+// Cache is an http.RoundTripper that keeps pages for offline reading
+type Cache struct {
+	Transport http.RoundTripper
+	Rules     *rules.Engine // rules deciding which domains are kept
+	Store     *store.Store  // store in which pages are kept
+	MaxBytes  int64         // (optional) maximum total size of kept pages, defaults to DEFAULT_MAX_BYTES
+
+	capped     *store.Capped // kept pages, created on first use
+	cappedOnce sync.Once
+}
+
+// page is a saved response
+type page struct {
+	URL    string
+	Status int
+	Header http.Header
+	Body   []byte
+	Saved  time.Time
+}
+
+func (cache *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || !cache.Rules.IsOffline(req.Host) {
+		return cache.Transport.RoundTrip(req)
+	}
+
+	url := req.URL.String()
+	resp, err := cache.Transport.RoundTrip(req)
+	if err != nil {
+		saved, loadErr := cache.load(url)
+		if loadErr != nil {
+			if !os.IsNotExist(loadErr) {
+				log.Errorf("Unable to load offline copy of %s: %s", log.Redact(url), loadErr)
+			}
+			return nil, err
+		}
+		log.Debugf("Upstream unavailable, serving offline copy of %s: %s", log.Redact(url), err)
+		return saved.toResponse(req), nil
+	}
+	if resp.StatusCode != 200 {
+		return resp, nil
+	}
+
+	relaxCacheHeaders(resp.Header)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_PAGE_SIZE+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > MAX_PAGE_SIZE {
+		// Too big to keep, pass it through
+		resp.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	header := cloneHeader(resp.Header)
+	// Never replay cookies from the offline copy
+	header.Del("Set-Cookie")
+	cache.save(nameFor(url), &page{
+		URL:    url,
+		Status: resp.StatusCode,
+		Header: header,
+		Body:   body,
+		Saved:  time.Now(),
+	})
+	return resp, nil
+}
+
+// save saves the given page under the given name, evicting the least recently
+// saved pages if that takes us over MaxBytes
+func (cache *Cache) save(name string, p *page) {
+	if err := cache.pages().Save(name, p); err != nil {
+		log.Errorf("Unable to save offline copy of %s: %s", log.Redact(p.URL), err)
+	}
+}
+
+// pages returns the store.Capped in which pages are kept
+func (cache *Cache) pages() *store.Capped {
+	cache.cappedOnce.Do(func() {
+		cache.capped = &store.Capped{Store: cache.Store, Prefix: NAME_PREFIX, MaxBytes: cache.maxBytes()}
+	})
+	return cache.capped
+}
+
+func (cache *Cache) maxBytes() int64 {
+	if cache.MaxBytes > 0 {
+		return cache.MaxBytes
+	}
+	return DEFAULT_MAX_BYTES
+}
+
+func (cache *Cache) load(url string) (*page, error) {
+	p := &page{}
+	if err := cache.Store.Load(nameFor(url), p); err != nil {
+		return nil, err
+	}
+	if p.URL != url {
+		return nil, fmt.Errorf("Saved page is for a different URL")
+	}
+	return p, nil
+}
+
+// nameFor returns the store name for the given URL, which is hashed so that
+// file names don't reveal what was visited
+func nameFor(url string) string {
+	hash := sha256.Sum256([]byte(url))
+	return NAME_PREFIX + hex.EncodeToString(hash[:])
+}
+
+// relaxCacheHeaders replaces headers that prevent caching with ones that allow
+// the browser to cache for CACHE_MAX_AGE
+func relaxCacheHeaders(header http.Header) {
+	header.Del("Pragma")
+	header.Del("Expires")
+	header.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(CACHE_MAX_AGE.Seconds())))
+}
+
+func (p *page) toResponse(req *http.Request) *http.Response {
+	header := cloneHeader(p.Header)
+	header.Set(X_LANTERN_OFFLINE, p.Saved.UTC().Format(http.TimeFormat))
+	header.Set("Warning", `111 - "Revalidation Failed"`)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", p.Status, http.StatusText(p.Status)),
+		StatusCode:    p.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(p.Body)),
+		ContentLength: int64(len(p.Body)),
+		Request:       req,
+	}
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// multiReadCloser reads from a Reader and closes a Closer
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
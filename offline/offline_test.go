@@ -0,0 +1,120 @@
+package offline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/rules"
+	"github.com/getlantern/flashlight/store"
+)
+
+// fakeTransport returns a fixed page, or fails if down
+type fakeTransport struct {
+	down bool
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.down {
+		return nil, fmt.Errorf("Upstream down")
+	}
+	header := make(http.Header)
+	header.Set("Cache-Control", "no-cache, no-store")
+	header.Set("Set-Cookie", "session=1")
+	return &http.Response{
+		StatusCode: 200,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("news"))),
+	}, nil
+}
+
+func TestOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.New(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &fakeTransport{}
+	cache := &Cache{
+		Transport: transport,
+		Rules:     &rules.Engine{Rules: []*rules.Rule{&rules.Rule{Domain: "example.org", Offline: true}}},
+		Store:     s,
+	}
+
+	req, _ := http.NewRequest("GET", "http://news.example.org/", nil)
+	resp, err := cache.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unable to round trip: %s", err)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "private, max-age=86400" {
+		t.Errorf("Cache-Control not relaxed: %s", cc)
+	}
+
+	transport.down = true
+	resp, err = cache.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Offline copy not served: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "news" || resp.Header.Get(X_LANTERN_OFFLINE) == "" {
+		t.Errorf("Wrong offline copy: %s", body)
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		t.Error("Offline copy shouldn't set cookies")
+	}
+
+	other, _ := http.NewRequest("GET", "http://other.com/", nil)
+	if _, err := cache.RoundTrip(other); err == nil {
+		t.Error("Domain not marked offline shouldn't be served offline")
+	}
+}
+
+func TestEvictsLeastRecentlySaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.New(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each page takes about 1.5KB on disk, so two fit but three don't
+	cache := &Cache{Store: s, MaxBytes: 4000}
+	body := bytes.Repeat([]byte("x"), 1000)
+	for i, url := range []string{"http://example.org/1", "http://example.org/2", "http://example.org/3"} {
+		cache.save(nameFor(url), &page{URL: url, Status: 200, Body: body})
+		// Modification times are only so precise on some filesystems
+		os.Chtimes(s.Dir+"/"+nameFor(url)+".json", time.Now(), time.Now().Add(time.Duration(i-3)*time.Minute))
+	}
+	if _, err := cache.load("http://example.org/1"); !os.IsNotExist(err) {
+		t.Errorf("Least recently saved page should have been evicted: %v", err)
+	}
+	for _, url := range []string{"http://example.org/2", "http://example.org/3"} {
+		if _, err := cache.load(url); err != nil {
+			t.Errorf("Unable to load %s: %s", url, err)
+		}
+	}
+	infos, err := s.List(NAME_PREFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept int64
+	for _, info := range infos {
+		kept += info.Size
+	}
+	if kept > cache.MaxBytes {
+		t.Errorf("Expected at most %d bytes kept, got %d", cache.MaxBytes, kept)
+	}
+	if total := cache.pages().TotalBytes(); total != kept {
+		t.Errorf("Expected %d bytes counted, got %d", kept, total)
+	}
+}
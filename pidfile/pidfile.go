@@ -0,0 +1,135 @@
+// package pidfile keeps track of a running flashlight in a file holding its
+// pid, the addresses that it listens at and when it started, so that another
+// flashlight can tell whether it would clash with it, and stop it if asked to
+// replace it.
+//
+// The file looks like:
+//
+//	1234
+//	:8080,127.0.0.1:8081
+//	1720451
+//
+// The last line identifies when the process started (in a platform-specific
+// form), so that a file left behind by a flashlight that didn't exit cleanly
+// doesn't make us mistake another process that has since been given the same
+// pid (e.g. after a reboot) for flashlight.  Such a process isn't Running as
+// far as the Instance is concerned, and Stop leaves it alone.
+package pidfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stopPollInterval = 100 * time.Millisecond
+)
+
+// Instance is a flashlight recorded in a pidfile
+type Instance struct {
+	PID     int
+	Addrs   []string // the addresses it listens at
+	Started string   // when it started, see startTime
+}
+
+// Read reads the pidfile at path, returning nil if there isn't one
+func Read(path string) (*Instance, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read pidfile: %s", err)
+	}
+	lines := strings.SplitN(strings.TrimSpace(string(data)), "\n", 3)
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil || pid <= 0 {
+		return nil, fmt.Errorf("Invalid pid in pidfile %s", path)
+	}
+	instance := &Instance{PID: pid}
+	if len(lines) > 1 {
+		for _, addr := range strings.Split(strings.TrimSpace(lines[1]), ",") {
+			if addr != "" {
+				instance.Addrs = append(instance.Addrs, addr)
+			}
+		}
+	}
+	if len(lines) > 2 {
+		instance.Started = strings.TrimSpace(lines[2])
+	}
+	return instance, nil
+}
+
+// Write records our pid, the given addresses and when we started in the
+// pidfile at path, replacing it atomically
+func Write(path string, addrs []string) error {
+	started, err := startTime(os.Getpid())
+	if err != nil {
+		return fmt.Errorf("Unable to determine when we started: %s", err)
+	}
+	data := fmt.Sprintf("%d\n%s\n%s\n", os.Getpid(), strings.Join(addrs, ","), started)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return fmt.Errorf("Unable to write pidfile: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Unable to write pidfile: %s", err)
+	}
+	return nil
+}
+
+// Remove removes the pidfile at path if it's ours, leaving it alone if
+// another flashlight (e.g. one that we restarted into) has since replaced it
+func Remove(path string) error {
+	instance, err := Read(path)
+	if err != nil || instance == nil || instance.PID != os.Getpid() {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("Unable to remove pidfile: %s", err)
+	}
+	return nil
+}
+
+// Running indicates whether the instance is still running, i.e. whether
+// there's a process with its pid that started when it did.  Without a start
+// time (in pidfiles from older flashlights), any process with its pid counts.
+func (instance *Instance) Running() bool {
+	if !running(instance.PID) {
+		return false
+	}
+	if instance.Started == "" {
+		return true
+	}
+	started, err := startTime(instance.PID)
+	return err == nil && started == instance.Started
+}
+
+// Stop asks the instance to shut down (with SIGTERM, or on Windows, where we
+// can't signal it, by killing it) and waits up to timeout for it to exit.  It
+// refuses to stop a process whose start time it can't confirm, which might not
+// be flashlight.
+func (instance *Instance) Stop(timeout time.Duration) error {
+	if instance.Started == "" {
+		return fmt.Errorf("Unable to confirm that pid %d is flashlight, since its pidfile doesn't say when it started", instance.PID)
+	}
+	if !instance.Running() {
+		return nil
+	}
+	if err := stop(instance.PID); err != nil {
+		return fmt.Errorf("Unable to stop pid %d: %s", instance.PID, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for instance.Running() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Pid %d still running after %s", instance.PID, timeout)
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return nil
+}
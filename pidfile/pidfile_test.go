@@ -0,0 +1,96 @@
+package pidfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flashlight.pid")
+
+	if instance, err := Read(path); instance != nil || err != nil {
+		t.Fatalf("Missing pidfile should read as nil, got %v, %v", instance, err)
+	}
+	addrs := []string{":8080", "127.0.0.1:8081"}
+	if err := Write(path, addrs); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.PID != os.Getpid() || !reflect.DeepEqual(instance.Addrs, addrs) {
+		t.Errorf("Unexpected instance: %+v", instance)
+	}
+	if !instance.Running() {
+		t.Errorf("We should be running")
+	}
+
+	// Another process's pidfile is left alone
+	ioutil.WriteFile(path, []byte("1\n:8080\n"), 0644)
+	if err := Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Someone else's pidfile shouldn't be removed: %s", err)
+	}
+	Write(path, addrs)
+	if err := Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Our pidfile should be removed")
+	}
+
+	ioutil.WriteFile(path, []byte("nonsense\n"), 0644)
+	if _, err := Read(path); err == nil {
+		t.Errorf("Invalid pidfile should fail to read")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flashlight.pid")
+
+	if err := Write(path, []string{":8080"}); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Started == "" {
+		t.Fatalf("Expected our start time to be recorded")
+	}
+	if !instance.Running() {
+		t.Errorf("We should be running")
+	}
+
+	// A process that reuses a recorded pid isn't the recorded instance
+	reused := &Instance{PID: os.Getpid(), Started: instance.Started + "0"}
+	if reused.Running() {
+		t.Errorf("A process with a different start time shouldn't count as running")
+	}
+	if err := reused.Stop(time.Second); err != nil {
+		t.Errorf("Stopping an instance that isn't running should do nothing, got %s", err)
+	}
+
+	// Without a start time, we can't tell who has the pid, so we don't stop it
+	unknown := &Instance{PID: os.Getpid()}
+	if err := unknown.Stop(time.Second); err == nil {
+		t.Errorf("Stopping an instance without a start time should fail")
+	}
+}
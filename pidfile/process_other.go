@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package pidfile
+
+import (
+	"syscall"
+)
+
+// running indicates whether there's a process with the given pid, including
+// one owned by another user
+func running(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// stop sends SIGTERM to the process with the given pid, on which flashlight
+// shuts down gracefully
+func stop(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
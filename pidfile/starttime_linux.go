@@ -0,0 +1,24 @@
+package pidfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// startTime returns when the process with the given pid started, in clock
+// ticks since boot (the starttime field of /proc/<pid>/stat)
+func startTime(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", err
+	}
+	// The command in parentheses may contain spaces, so count fields after
+	// it, starting with the state (field 3)
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return "", fmt.Errorf("Unexpected /proc/%d/stat", pid)
+	}
+	return fields[19], nil
+}
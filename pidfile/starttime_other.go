@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package pidfile
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// startTime returns when the process with the given pid started, as reported
+// by ps
+func startTime(pid int) (string, error) {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+	started := strings.Join(strings.Fields(string(out)), " ")
+	if started == "" {
+		return "", fmt.Errorf("No start time for pid %d", pid)
+	}
+	return started, nil
+}
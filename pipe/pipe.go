@@ -0,0 +1,144 @@
+// package pipe copies data between connections with bounded buffering.  A
+// fast source (e.g. an origin server) may read ahead of a slow destination
+// (e.g. a fronted link) by at most a fixed window, after which reading from
+// the source blocks until the destination catches up.  This keeps throughput
+// up on asymmetric links while bounding per-tunnel memory.
+//
+// Relay ties two connections together this way, closing them once they've
+// been idle for IdleTimeout so that stalled peers don't leak connections.
+package pipe
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BUFFER_SIZE    = 32 * 1024
+	DEFAULT_WINDOW = 8 // number of buffers that may be in flight, i.e. 256 KB
+)
+
+var (
+	// Window is the window used by Relay, which can be lowered on devices
+	// with little memory
+	Window = DEFAULT_WINDOW
+
+	// BufferSize is the size of the buffers used by Copy
+	BufferSize = BUFFER_SIZE
+
+	// buffers pools the buffers used by Copy, so that busy clients and
+	// servers don't allocate fresh ones for every connection
+	buffers sync.Pool
+
+	// bytesInUse is the total size of the buffers that Copy is using
+	bytesInUse int64
+)
+
+// Copy copies from src to dst until EOF on src or an error.  Up to window
+// buffers read from src may be waiting to be written to dst.  It returns the
+// number of bytes written and the first error encountered (other than EOF).
+func Copy(dst io.Writer, src io.Reader, window int) (int64, error) {
+	if window < 1 {
+		window = 1
+	}
+	full := make(chan []byte, window)
+	free := make(chan []byte, window)
+	done := make(chan bool)
+
+	var written int64
+	var writeErr error
+	go func() {
+		defer close(done)
+		for b := range full {
+			n, err := dst.Write(b)
+			written += int64(n)
+			if err == nil && n < len(b) {
+				err = io.ErrShortWrite
+			}
+			// Never blocks since at most window buffers are in flight
+			free <- b[:cap(b)]
+			if err != nil {
+				writeErr = err
+				return
+			}
+		}
+	}()
+
+	var readErr error
+	allocated := 0
+reading:
+	for {
+		var buf []byte
+		select {
+		case <-done:
+			// Writing failed
+			break reading
+		case buf = <-free:
+		default:
+			if allocated < window {
+				// Only allocate buffers as needed
+				buf = getBuffer()
+				allocated++
+			} else {
+				// Window is full, wait for dst to catch up
+				select {
+				case buf = <-free:
+				case <-done:
+					break reading
+				}
+			}
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			// Never blocks since at most window buffers are in flight
+			full <- buf[:n]
+		} else {
+			free <- buf
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+	}
+	close(full)
+	<-done
+
+	// Return all buffers to the pool, including any that didn't get written
+	for b := range full {
+		putBuffer(b)
+	}
+	close(free)
+	for b := range free {
+		putBuffer(b)
+	}
+
+	if writeErr != nil {
+		return written, writeErr
+	}
+	return written, readErr
+}
+
+// BytesInUse returns the total size of the buffers that are currently being
+// used for copying
+func BytesInUse() int64 {
+	return atomic.LoadInt64(&bytesInUse)
+}
+
+// getBuffer gets a buffer of BufferSize from the pool
+func getBuffer() []byte {
+	size := BufferSize
+	atomic.AddInt64(&bytesInUse, int64(size))
+	if b, ok := buffers.Get().([]byte); ok && cap(b) == size {
+		return b[:size]
+	}
+	return make([]byte, size)
+}
+
+// putBuffer returns the given buffer to the pool
+func putBuffer(b []byte) {
+	atomic.AddInt64(&bytesInUse, -int64(cap(b)))
+	buffers.Put(b[:cap(b)])
+}
@@ -0,0 +1,68 @@
+package pipe
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// endlessReader reads zeros forever, counting how many it has read
+type endlessReader struct {
+	read int64
+}
+
+func (r *endlessReader) Read(b []byte) (int, error) {
+	atomic.AddInt64(&r.read, int64(len(b)))
+	return len(b), nil
+}
+
+// stuckWriter blocks until unblocked, then fails
+type stuckWriter struct {
+	unblock chan bool
+}
+
+func (w *stuckWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return 0, io.ErrClosedPipe
+}
+
+func TestCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("flashlight"), 100000)
+	out := &bytes.Buffer{}
+	n, err := Copy(out, bytes.NewReader(data), 2)
+	if err != nil {
+		t.Fatalf("Unable to copy: %s", err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("Copied data doesn't match, copied %d of %d bytes", n, len(data))
+	}
+	if inUse := BytesInUse(); inUse != 0 {
+		t.Errorf("Buffers weren't returned, %d bytes still in use", inUse)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	src := &endlessReader{}
+	dst := &stuckWriter{make(chan bool)}
+	result := make(chan error)
+	go func() {
+		_, err := Copy(dst, src, 4)
+		result <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if read := atomic.LoadInt64(&src.read); read > 4*BUFFER_SIZE {
+		t.Errorf("Read %d bytes ahead of a stuck writer, more than the window", read)
+	}
+	close(dst.unblock)
+	select {
+	case err := <-result:
+		if err != io.ErrClosedPipe {
+			t.Errorf("Expected write error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Copy didn't stop after write failed")
+	}
+}
@@ -0,0 +1,131 @@
+package pipe
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_IDLE_TIMEOUT = 5 * time.Minute
+)
+
+var (
+	// IdleTimeout is how long Relay waits without data flowing in either
+	// direction before giving up on both connections.  0 means no timeout.
+	IdleTimeout = DEFAULT_IDLE_TIMEOUT
+)
+
+// closeWriter is implemented by connections that support half-closing, like
+// *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay is the state of a single Relay
+type relay struct {
+	a          net.Conn
+	b          net.Conn
+	lastActive int64 // UnixNano
+}
+
+// Relay copies data in both directions between a and b with Window until
+// both directions are done or no data has flowed for IdleTimeout.  When one
+// side is done sending, the other side's write half is closed (or the whole
+// connection, if it can't be half-closed) so that protocols relying on
+// half-close keep working.  An error in either direction aborts both.  Both
+// connections are closed by the time Relay returns.  It returns the number of
+// bytes relayed from a to b and from b to a.
+func Relay(a net.Conn, b net.Conn) (aToB int64, bToA int64) {
+	r := &relay{a: a, b: b}
+	r.touch()
+	done := make(chan bool)
+	if IdleTimeout > 0 {
+		go r.closeWhenIdle(IdleTimeout, done)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aToB = r.copy(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		bToA = r.copy(a, b)
+	}()
+	wg.Wait()
+	close(done)
+	r.close()
+	return
+}
+
+// copy copies from src to dst and half-closes dst once src is done
+func (r *relay) copy(dst net.Conn, src net.Conn) int64 {
+	n, err := Copy(&activityConn{dst, r}, &activityConn{src, r}, Window)
+	if err != nil {
+		r.close()
+		return n
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
+
+// closeWhenIdle closes both connections once no data has flowed for
+// idleTimeout, unblocking any stalled reads or writes
+func (r *relay) closeWhenIdle(idleTimeout time.Duration, done chan bool) {
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			idle := time.Now().Sub(time.Unix(0, atomic.LoadInt64(&r.lastActive)))
+			if idle >= idleTimeout {
+				log.Debugf("Closing connections idle for %s", idle)
+				r.close()
+				return
+			}
+			timer.Reset(idleTimeout - idle)
+		}
+	}
+}
+
+func (r *relay) touch() {
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+}
+
+func (r *relay) close() {
+	r.a.Close()
+	r.b.Close()
+}
+
+// activityConn records reads and writes as activity on its relay
+type activityConn struct {
+	net.Conn
+	r *relay
+}
+
+func (conn *activityConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.r.touch()
+	}
+	return n, err
+}
+
+func (conn *activityConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		conn.r.touch()
+	}
+	return n, err
+}
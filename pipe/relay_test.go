@@ -0,0 +1,80 @@
+package pipe
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Unable to accept: %s", err)
+	}
+	return client, server
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	client, relayedClient := tcpPair(t)
+	relayedOrigin, origin := tcpPair(t)
+	defer client.Close()
+	defer origin.Close()
+	result := make(chan [2]int64)
+	go func() {
+		sent, received := Relay(relayedClient, relayedOrigin)
+		result <- [2]int64{sent, received}
+	}()
+
+	// Origin only responds once the client is done sending
+	go func() {
+		request, _ := ioutil.ReadAll(origin)
+		origin.Write([]byte("response to " + string(request)))
+		origin.Close()
+	}()
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+	response, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Unable to read response: %s", err)
+	}
+	if string(response) != "response to request" {
+		t.Errorf("Unexpected response: %s", response)
+	}
+
+	counts := <-result
+	if counts[0] != 7 || counts[1] != 19 {
+		t.Errorf("Expected 7 bytes sent and 19 received, got %d and %d", counts[0], counts[1])
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	oldIdleTimeout := IdleTimeout
+	IdleTimeout = 50 * time.Millisecond
+	defer func() { IdleTimeout = oldIdleTimeout }()
+
+	client, relayedClient := net.Pipe()
+	relayedOrigin, origin := net.Pipe()
+	defer client.Close()
+	defer origin.Close()
+	done := make(chan bool)
+	go func() {
+		Relay(relayedClient, relayedOrigin)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay didn't time out")
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/clientauth"
+	"github.com/getlantern/flashlight/configdir"
+	"github.com/getlantern/flashlight/egress"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/rules"
+	"github.com/getlantern/flashlight/server"
+	"github.com/getlantern/flashlight/tenants"
+	"github.com/getlantern/flashlight/users"
+)
+
+// printPlan prints what flashlight would do with the current flags (listeners,
+// upstreams, protocols, certs and rules) to out, without binding any sockets
+// or dialing anything.  The flags must have been validated.
+func printPlan(out io.Writer) {
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(out, format+"\n", args...)
+	}
+	if len(environmentVars) > 0 {
+		p("Environment: %s", strings.Join(environmentVars, ", "))
+	}
+	if *configFile != "" {
+		p("Config file: %s (overridden by command-line flags and the environment)", *configFile)
+	}
+	p("Role: %s", *role)
+	migrator := configDirMigrator()
+	if current, err := migrator.Current(); err != nil {
+		p("Config dir: %s", err)
+	} else if current != migrator.Latest() {
+		p("Config dir: will migrate from layout version %d to %d, backing up to %s", current, migrator.Latest(), configPath(configdir.BACKUP_DIR))
+	}
+	if *replace {
+		p("PID file: %s, replacing the flashlight running there", configPath(PID_FILE))
+	} else {
+		p("PID file: %s, refusing to start if flashlight is running there at the same address", configPath(PID_FILE))
+	}
+	both := isClientAndServer()
+	if hasRole("server") {
+		if both {
+			p("Server role:")
+		}
+		printServerPlan(p)
+	}
+	if hasRole("client") {
+		if both {
+			p("Client role:")
+		}
+		printClientPlan(p)
+	}
+	if *logFile != "" {
+		p("Logging: %s as %s to %s, rotated at %d MB", *logLevel, *logFormat, *logFile, *logMaxSize)
+	} else if *logLevel != log.LEVEL_DEBUG || *logFormat != log.FORMAT_TEXT {
+		p("Logging: %s as %s", *logLevel, *logFormat)
+	}
+	if *statsAddr != "" {
+		p("Stats: server-sent events at %s", *statsAddr)
+	}
+	if *statsdAddr != "" {
+		p("Metrics: StatsD at %s every %v", *statsdAddr, *metricsInterval)
+	}
+	if *influxURL != "" {
+		// Leave out the query, which may hold credentials
+		u, _ := url.Parse(*influxURL)
+		p("Metrics: InfluxDB at %s://%s%s every %v", u.Scheme, u.Host, u.Path, *metricsInterval)
+	}
+	if *traceEndpoint != "" {
+		u, _ := url.Parse(*traceEndpoint)
+		p("Tracing: OTLP to %s://%s%s, sampling %v of client requests", u.Scheme, u.Host, u.Path, *traceSampleRate)
+	}
+	if *updateURL != "" {
+		u, _ := url.Parse(*updateURL)
+		p("Auto-update: version %s, checking %s://%s%s every %v", version, u.Scheme, u.Host, u.Path, *updateInterval)
+	}
+	if *crashReportURL != "" {
+		u, _ := url.Parse(*crashReportURL)
+		p("Crash dumps: kept in %s, submitted to %s://%s%s", configPath(CRASH_DIR), u.Scheme, u.Host, u.Path)
+	} else {
+		p("Crash dumps: kept in %s", configPath(CRASH_DIR))
+	}
+	if *lowMemory {
+		p("Low memory mode: pipe window %d, GC percent %d", LOW_MEMORY_PIPE_WINDOW, LOW_MEMORY_GC_PERCENT)
+	}
+}
+
+func printClientPlan(p func(string, ...interface{})) {
+	p("Listeners:")
+	p("  http proxy at %s", clientAddr())
+	if *socksAddr != "" {
+		p("  SOCKS5 at %s", *socksAddr)
+	}
+	listeners, _ := proxy.ParseListeners(splitList(*listenerSpecs))
+	for _, listener := range listeners {
+		switch listener.Role {
+		case proxy.LISTENER_HTTP:
+			p("  http proxy at %s", listener.Addr)
+		case proxy.LISTENER_SOCKS:
+			p("  SOCKS5 at %s", listener.Addr)
+		case proxy.LISTENER_ADMIN:
+			p("  status and admin API at %s", listener.Addr)
+		}
+	}
+	if *transparentAddr != "" {
+		mode := "REDIRECT"
+		if *tproxy {
+			mode = "TPROXY"
+		}
+		p("  transparent proxy (%s) at %s", mode, *transparentAddr)
+	}
+	if *dnsAddr != "" {
+		p("  DNS at %s", *dnsAddr)
+	}
+
+	specs, _ := clientServers()
+	servers := splitList(specs)
+	p("Upstream servers (port %d):", *upstreamPort)
+	for _, server := range servers {
+		p("  %s", server)
+	}
+	if len(servers) > 1 {
+		p("  balanced by %s", *balance)
+	}
+	for _, hop := range splitList(*hops) {
+		p("  then via hop %s", hop)
+	}
+	p("Protocols, in order of preference:")
+	for _, name := range splitList(*protocolNames) {
+		host, masquerades := "each server", *masqueradeAs
+		if name == "azure" {
+			if *azureServer != "" {
+				host = *azureServer
+			}
+			if *azureMasquerade != "" {
+				masquerades = *azureMasquerade
+			}
+		}
+		if masquerades == "" {
+			masquerades = "none, dialing the server directly"
+		}
+		p("  %s to %s, masquerading as: %s", name, host, masquerades)
+	}
+	p("  %d parallel dial(s), IP version %s, %d retries, %d idle connection(s) per host", *parallelDials, *ipVersion, *dialRetries, *maxIdleConns)
+	if *upstreamProxyURL != "" {
+		// Don't print credentials
+		if u, err := url.Parse(*upstreamProxyURL); err == nil {
+			p("  through upstream proxy %s://%s", u.Scheme, u.Host)
+		}
+	}
+	if *dohProviders == "off" {
+		p("DNS resolution: OS resolver")
+	} else {
+		p("DNS resolution: DNS-over-HTTPS via %s", *dohProviders)
+	}
+
+	p("Certificates:")
+	printCert(p, "rootca", *rootCA, "none, using system roots")
+	printCert(p, "masqueradeca", *masqueradeCA, "none, using system roots")
+	if *clientCertFile != "" {
+		printCert(p, "clientcert", *clientCertFile, "")
+	}
+	if pins, err := serverPins(); err == nil && len(pins) > 0 {
+		p("  server keys: %s", strings.Join(pins, ", "))
+	}
+
+	if *rulesFile != "" {
+		engine, _ := rules.Load(*rulesFile)
+		p("Rules from %s: %s", *rulesFile, summarizeRules(engine.Rules))
+	} else {
+		p("Rules: none")
+	}
+	if *compressTunnel {
+		p("Tunnel compression: plain http")
+	}
+	if *sessionHistory {
+		p("Session history: kept in %s", configPath("store"))
+	}
+	if *bandwidthFlag {
+		p("Bandwidth accounting: per domain, kept in %s", configPath("store"))
+	}
+	if *selfTestInterval > 0 {
+		p("Self-tests: every %v, kept in %s", *selfTestInterval, configPath("store"))
+	}
+	if *cacheSize > 0 {
+		p("HTTP cache: up to %d MB in %s", *cacheSize, configPath("store"))
+	}
+	if *smartRouting {
+		p("Smart routing: tunnel only destinations that appear blocked")
+	}
+	if *usersFile != "" {
+		u, _ := users.Load(*usersFile)
+		p("Users from %s: %d", *usersFile, len(u.Users))
+	}
+	if *blocklistsFile != "" {
+		p("Blocklists from %s", *blocklistsFile)
+	}
+	if *canaryURL != "" {
+		p("Canary: %s through each server every %v", *canaryURL, *probeInterval)
+	}
+	if *shipLogsURL != "" {
+		p("Shipping up to %d errors per minute to %s", *shipLogsMax, *shipLogsURL)
+	}
+	if *remoteConfigURL != "" {
+		p("Remote config from %s every %v", *remoteConfigURL, *remoteInterval)
+	}
+	if *proxyApps != "" {
+		p("Per-app proxying for: %s", *proxyApps)
+	}
+	if *setSystemProxy {
+		p("System proxy: set to %s", clientAddr())
+	}
+	if *showTray {
+		p("Tray icon: shown")
+	}
+}
+
+func printServerPlan(p func(string, ...interface{})) {
+	p("Listeners:")
+	p("  https at %s as %s", *addr, *upstreamHost)
+	if *tenantsFile != "" {
+		t, _ := tenants.Load(*tenantsFile)
+		names := make([]string, 0, len(t.Tenants))
+		for _, tenant := range t.Tenants {
+			names = append(names, tenant.Name)
+		}
+		p("  tenants from %s: %s", *tenantsFile, strings.Join(names, ", "))
+	}
+
+	p("Certificates:")
+	if *acmeChallenge != "" {
+		u, _ := url.Parse(*acmeDirectory)
+		printCert(p, "server cert", configPath("servercert.pem"), "will be obtained")
+		p("  obtained for %s from %s://%s%s with %s challenges, and renewed automatically", *upstreamHost, u.Scheme, u.Host, u.Path, *acmeChallenge)
+	} else {
+		printCert(p, "server cert", configPath("servercert.pem"), "will be generated")
+		if pk, err := proxy.LoadPK(configPath("proxypk.pem")); err == nil {
+			p("  private key: %s (%s)", configPath("proxypk.pem"), proxy.DescribePK(pk))
+		} else if os.IsNotExist(err) {
+			p("  private key: will be generated (%s)", describeKeyParams())
+		} else {
+			p("  private key: %s (unreadable: %s)", configPath("proxypk.pem"), err)
+		}
+	}
+	printCert(p, "hoprootca", *hopRootCA, "none, using system roots")
+	if *requireClientCert {
+		printCert(p, "clientca", configPath(server.CLIENT_CA_FILE), "will be generated")
+		if *clientAllowlist == "" {
+			p("  client certs: required, any issued by clientca")
+		} else if allowed, err := clientauth.LoadAllowlist(*clientAllowlist); err == nil {
+			p("  client certs: required, issued by clientca for %d client(s) in %s", len(allowed), *clientAllowlist)
+		}
+	}
+
+	p("Egress:")
+	allowedASNs, _ := parseASNs(*egressASNs)
+	excludedASNs, _ := parseASNs(*excludeASNs)
+	policy := &egress.Policy{
+		AllowedCountries:  splitList(*egressCountries),
+		ExcludedCountries: splitList(*excludeCountries),
+		AllowedASNs:       allowedASNs,
+		ExcludedASNs:      excludedASNs,
+	}
+	if policy.IsRestricted() {
+		p("  restricted to %s", policy)
+	} else {
+		p("  unrestricted")
+	}
+	for _, route := range splitList(*egressRoutes) {
+		p("  route %s", route)
+	}
+	for _, hop := range splitList(*allowedHops) {
+		p("  relaying to hop %s", hop)
+	}
+	if *egressIPs != "" {
+		p("  rotating among IPs %s", *egressIPs)
+	}
+	p("  idle timeouts: %s", *idleTimeouts)
+	if *originIdleConns > 0 {
+		p("Origin reuse: up to %d idle connection(s) per origin for %s", *originIdleConns, *originIdleTime)
+	}
+	if *compressMedia {
+		p("Media compression: video throttled to %d kbps", *videoKbps)
+	}
+	if *ddnsProvider != "" {
+		p("Dynamic DNS: %s", strings.SplitN(*ddnsProvider, "://", 2)[0])
+	}
+	if *accessLogFile != "" {
+		p("Access log: %s format to %s", *accessLogFormat, *accessLogFile)
+	}
+	if *authToken != "" {
+		if *authDecoy != "" {
+			p("Authentication: token required, others shown %s", *authDecoy)
+		} else {
+			p("Authentication: token required, others shown a generic 404 page")
+		}
+	}
+	if *healthPath != "" {
+		if *healthOrigin != "" {
+			p("Health checks: at %s, requiring %s to be reachable", *healthPath, *healthOrigin)
+		} else {
+			p("Health checks: at %s", *healthPath)
+		}
+	}
+	if *bandwidthFlag {
+		p("Bandwidth accounting: per client IP, kept in %s", configPath("store"))
+	}
+	if *webhookURL != "" {
+		// The URL usually embeds a secret, so only show where it goes
+		if u, err := url.Parse(*webhookURL); err == nil {
+			p("Webhook: notifying %s", u.Host)
+		}
+	}
+}
+
+// printCert prints the given cert file and when it expires, or what happens
+// if there's no such file
+func printCert(p func(string, ...interface{}), name string, filename string, otherwise string) {
+	if filename == "" {
+		p("  %s: %s", name, otherwise)
+		return
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		p("  %s: %s", name, otherwise)
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		p("  %s: %s is not PEM", name, filename)
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		p("  %s: %s is not a certificate: %s", name, filename, err)
+		return
+	}
+	expiry := fmt.Sprintf("expires %s", cert.NotAfter.Format(time.RFC3339))
+	if time.Now().After(cert.NotAfter) {
+		expiry = fmt.Sprintf("EXPIRED %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	p("  %s: %s (%s, %s)", name, filename, cert.Subject.CommonName, expiry)
+}
+
+// summarizeRules summarizes what the given rules do
+func summarizeRules(rs []*rules.Rule) string {
+	var direct, proxied, blocked, offline, headers, media, scheduled int
+	for _, rule := range rs {
+		switch rule.Route {
+		case rules.ROUTE_DIRECT:
+			direct++
+		case rules.ROUTE_PROXY:
+			proxied++
+		}
+		if rule.Block {
+			blocked++
+		}
+		if rule.Offline {
+			offline++
+		}
+		if len(rule.Headers) > 0 {
+			headers++
+		}
+		if rule.CompressMedia {
+			media++
+		}
+		if rule.Schedule != nil {
+			scheduled++
+		}
+	}
+	return fmt.Sprintf("%d rule(s), %d direct, %d proxied, %d blocking, %d offline, %d setting headers, %d compressing media, %d scheduled",
+		len(rs), direct, proxied, blocked, offline, headers, media, scheduled)
+}
+
+// describeKeyParams describes the private key that -keytype and -keysize
+// generate, e.g. "ecdsa 256"
+func describeKeyParams() string {
+	switch {
+	case *keyType == proxy.KEY_TYPE_ED25519:
+		return *keyType
+	case *keySize != 0:
+		return fmt.Sprintf("%s %d", *keyType, *keySize)
+	case *keyType == proxy.KEY_TYPE_RSA:
+		return fmt.Sprintf("%s %d", *keyType, proxy.DEFAULT_RSA_BITS)
+	default:
+		return fmt.Sprintf("%s %d", *keyType, proxy.DEFAULT_EC_CURVE)
+	}
+}
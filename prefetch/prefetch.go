@@ -0,0 +1,340 @@
+// package prefetch implements an http.RoundTripper that speculatively fetches
+// the subresources (images, scripts, stylesheets) referenced by HTML pages as
+// soon as the page itself arrives, so that they're already on their way by the
+// time the browser asks for them.  This cuts page load time on high-latency
+// fronted links, where each round trip is expensive.
+//
+// With a server that has a Pusher, the client asks the server to fetch all of
+// a page's subresources in one request to PUSH_PATH, and the server streams
+// them back as they arrive from the origin, so that they cost one round trip
+// through the front rather than one each.
+package prefetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_MAX_PER_PAGE = 20
+	MAX_HTML_SIZE        = 1024 * 1024     // largest HTML page we'll parse
+	MAX_RESOURCE_SIZE    = 2 * 1024 * 1024 // largest subresource we'll hold onto
+	DEFAULT_MAX_SIZE     = 32 * 1024 * 1024
+	ENTRY_TTL            = 30 * time.Second
+)
+
+var (
+	subresourcePattern = regexp.MustCompile(`(?i)<(?:img|script|link)\s[^>]*?(?:src|href)\s*=\s*["']([^"'#]+)["']`)
+)
+
+// Prefetcher is an http.RoundTripper that prefetches subresources of HTML
+// pages that it fetches using Transport.  Only plain http subresources on the
+// same host as the page are prefetched (so that we never send cookies
+// anywhere the browser wouldn't have), and a prefetched response is only
+// served to a request with the same credentials (Cookie and Authorization) as
+// the page's.  Responses that aren't requested within ENTRY_TTL are dropped.
+type Prefetcher struct {
+	Transport  http.RoundTripper
+	MaxPerPage int   // maximum subresources to prefetch per page, defaults to DEFAULT_MAX_PER_PAGE
+	MaxSize    int64 // (optional) maximum total size of the prefetched bodies held, defaults to DEFAULT_MAX_SIZE
+
+	// Push (optional) asks the server to fetch the subresources of the given
+	// page and push them to us (see Pusher), returning the stream of pushed
+	// responses.  If it fails, subresources are fetched through Transport
+	// instead, and once it returns ErrPushUnsupported, it's not used again.
+	Push func(page *http.Request, push *PushRequest) (io.ReadCloser, error)
+
+	entries         map[string]*entry
+	size            int64 // total size of the bodies of entries
+	entriesMutex    sync.Mutex
+	pushUnsupported int32 // 1 once Push returned ErrPushUnsupported
+}
+
+// entry is a prefetched (or in-flight) response
+type entry struct {
+	done    chan bool
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+	size    int64 // size of body counted towards the Prefetcher's size
+	err     error
+}
+
+func (p *Prefetcher) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" {
+		if e := p.take(keyOf(req.URL.String(), req.Header)); e != nil {
+			<-e.done
+			if e.err == nil {
+				log.Debugf("Serving prefetched %s", log.Redact(req.URL.String()))
+				return e.toResponse(req), nil
+			}
+			// Fall through and fetch normally
+		}
+	}
+
+	resp, err := p.Transport.RoundTrip(req)
+	if err != nil || req.Method != "GET" || resp.StatusCode != 200 ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_HTML_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	// Put the body back together, including anything past MAX_HTML_SIZE
+	resp.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	go p.prefetchSubresources(req, resp.Header.Get("Content-Encoding"), body)
+	return resp, nil
+}
+
+// keyOf returns the key of the entry for the given url, requested with the
+// given credentials
+func keyOf(u string, header http.Header) string {
+	return u + "\n" + header.Get("Cookie") + "\n" + header.Get("Authorization")
+}
+
+// take removes and returns the unexpired entry with the given key, if any
+func (p *Prefetcher) take(key string) *entry {
+	p.entriesMutex.Lock()
+	defer p.entriesMutex.Unlock()
+	e, found := p.entries[key]
+	if !found {
+		return nil
+	}
+	p.remove(key, e)
+	if time.Now().After(e.expires) {
+		return nil
+	}
+	return e
+}
+
+// remove removes the given entry.  entriesMutex must be held.
+func (p *Prefetcher) remove(key string, e *entry) {
+	delete(p.entries, key)
+	p.size -= e.size
+	e.size = 0
+}
+
+// sweep removes the expired entries.  entriesMutex must be held.
+func (p *Prefetcher) sweep() {
+	now := time.Now()
+	for key, e := range p.entries {
+		if now.After(e.expires) {
+			p.remove(key, e)
+		}
+	}
+}
+
+// hold counts the given entry's body towards our size, unless it's no longer
+// waiting to be taken.  It returns false if the body doesn't fit within
+// MaxSize.
+func (p *Prefetcher) hold(key string, e *entry) bool {
+	maxSize := p.MaxSize
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_SIZE
+	}
+	p.entriesMutex.Lock()
+	defer p.entriesMutex.Unlock()
+	if p.entries[key] != e {
+		// Already taken (or dropped), so it won't be held
+		return true
+	}
+	p.sweep()
+	if p.size+int64(len(e.body)) > maxSize {
+		p.remove(key, e)
+		return false
+	}
+	e.size = int64(len(e.body))
+	p.size += e.size
+	return true
+}
+
+func (p *Prefetcher) prefetchSubresources(page *http.Request, contentEncoding string, body []byte) {
+	html := body
+	if strings.EqualFold(contentEncoding, "gzip") {
+		gzr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		html, err = ioutil.ReadAll(io.LimitReader(gzr, MAX_HTML_SIZE))
+		if err != nil && len(html) == 0 {
+			return
+		}
+	} else if contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity") {
+		// Encoding we don't understand
+		return
+	}
+
+	maxPerPage := p.MaxPerPage
+	if maxPerPage <= 0 {
+		maxPerPage = DEFAULT_MAX_PER_PAGE
+	}
+	reserved := make(map[string]*reservation)
+	var urls []string
+	for _, match := range subresourcePattern.FindAllSubmatch(html, -1) {
+		if len(urls) >= maxPerPage {
+			break
+		}
+		ref, err := url.Parse(strings.TrimSpace(string(match[1])))
+		if err != nil {
+			continue
+		}
+		u := page.URL.ResolveReference(ref)
+		if u.Scheme != "http" || u.Host != page.URL.Host {
+			continue
+		}
+		if r := p.reserve(page, u); r != nil {
+			reserved[u.String()] = r
+			urls = append(urls, u.String())
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+	if p.Push != nil && atomic.LoadInt32(&p.pushUnsupported) == 0 {
+		log.Debugf("Having the server push %d subresources of %s", len(urls), log.Redact(page.URL.String()))
+		go p.push(page, urls, reserved)
+		return
+	}
+	log.Debugf("Prefetching %d subresources of %s", len(urls), log.Redact(page.URL.String()))
+	for _, r := range reserved {
+		go p.fetch(page, r)
+	}
+}
+
+// reservation is an entry that's waiting for the response to u
+type reservation struct {
+	u     *url.URL
+	key   string
+	entry *entry
+}
+
+// reserve adds an entry for the given url, unless it's already being
+// prefetched.
+func (p *Prefetcher) reserve(page *http.Request, u *url.URL) *reservation {
+	key := keyOf(u.String(), page.Header)
+	e := &entry{
+		done:    make(chan bool),
+		expires: time.Now().Add(ENTRY_TTL),
+	}
+	p.entriesMutex.Lock()
+	defer p.entriesMutex.Unlock()
+	if p.entries == nil {
+		p.entries = make(map[string]*entry)
+	}
+	p.sweep()
+	if _, found := p.entries[key]; found {
+		return nil
+	}
+	p.entries[key] = e
+	return &reservation{u, key, e}
+}
+
+// fetch fetches the reserved url through our Transport
+func (p *Prefetcher) fetch(page *http.Request, r *reservation) {
+	req, err := http.NewRequest("GET", r.u.String(), nil)
+	if err != nil {
+		p.finish(r, nil, err)
+		return
+	}
+	// Look like the browser that requested the page
+	for _, name := range FORWARDED_HEADERS {
+		if value := page.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Referer", page.URL.String())
+	resp, err := p.Transport.RoundTrip(req)
+	p.finish(r, resp, err)
+}
+
+// push has the server fetch and push the reserved urls, falling back to
+// fetching them ourselves if it can't
+func (p *Prefetcher) push(page *http.Request, urls []string, reserved map[string]*reservation) {
+	stream, err := p.Push(page, newPushRequest(page, urls))
+	if err != nil {
+		if err == ErrPushUnsupported {
+			atomic.StoreInt32(&p.pushUnsupported, 1)
+		}
+		log.Debugf("Unable to have subresources pushed, fetching them instead: %s", err)
+		for _, r := range reserved {
+			go p.fetch(page, r)
+		}
+		return
+	}
+	defer stream.Close()
+	err = ReadPushed(stream, func(u string, resp *http.Response) {
+		if r := reserved[u]; r != nil {
+			delete(reserved, u)
+			p.finish(r, resp, nil)
+		}
+	})
+	if err != nil {
+		log.Debugf("Unable to read pushed subresources: %s", err)
+	}
+	// Whatever the server didn't push gets fetched when the browser asks for
+	// it
+	for _, r := range reserved {
+		p.finish(r, nil, errNotPushed)
+	}
+}
+
+// finish completes the reserved entry with the given response (or error)
+func (p *Prefetcher) finish(r *reservation, resp *http.Response, err error) {
+	e := r.entry
+	defer close(e.done)
+	if err != nil {
+		e.err = err
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_RESOURCE_SIZE+1))
+	if err != nil {
+		e.err = err
+		return
+	}
+	if len(body) > MAX_RESOURCE_SIZE {
+		e.err = io.ErrShortBuffer
+		return
+	}
+	e.status = resp.StatusCode
+	e.header = resp.Header
+	e.body = body
+	if !p.hold(r.key, e) {
+		log.Debugf("Too much prefetched already, dropping %s", log.Redact(r.u.String()))
+	}
+}
+
+func (e *entry) toResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// multiReadCloser reads from a Reader and closes a Closer
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,194 @@
+package prefetch
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrefetch(t *testing.T) {
+	var hits = make(map[string]int)
+	var hitsMutex sync.Mutex
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		hitsMutex.Lock()
+		hits[req.URL.Path+" "+req.Header.Get("Cookie")] += 1
+		hitsMutex.Unlock()
+		if req.URL.Path == "/" {
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Write([]byte(`<html><script src="/app.js"></script></html>`))
+			return
+		}
+		resp.Write([]byte("console.log('hi')"))
+	}))
+	defer origin.Close()
+	countHits := func(key string) int {
+		hitsMutex.Lock()
+		defer hitsMutex.Unlock()
+		return hits[key]
+	}
+
+	p := &Prefetcher{Transport: http.DefaultTransport}
+	get := func(path string, cookie string) string {
+		req, _ := http.NewRequest("GET", origin.URL+path, nil)
+		req.Header.Set("Cookie", cookie)
+		resp, err := p.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Unable to get %s: %s", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	waitForPrefetch := func(key string) {
+		for i := 0; i < 100 && countHits(key) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	get("/", "alice")
+	waitForPrefetch("/app.js alice")
+	if body := get("/app.js", "bob"); body != "console.log('hi')" || countHits("/app.js bob") != 1 {
+		t.Errorf("A request with other cookies should be fetched itself, got %q", body)
+	}
+	if body := get("/app.js", "alice"); body != "console.log('hi')" || countHits("/app.js alice") != 1 {
+		t.Errorf("Expected the prefetched response, got %q after %d fetches", body, countHits("/app.js alice"))
+	}
+
+	// Responses that don't fit aren't held
+	p = &Prefetcher{Transport: http.DefaultTransport, MaxSize: 5}
+	get("/", "carol")
+	waitForPrefetch("/app.js carol")
+	time.Sleep(50 * time.Millisecond)
+	p.entriesMutex.Lock()
+	held, size := len(p.entries), p.size
+	p.entriesMutex.Unlock()
+	if held != 0 || size != 0 {
+		t.Errorf("Expected nothing held beyond MaxSize, got %d entries of %d bytes", held, size)
+	}
+
+	// Expired responses are swept
+	p.entriesMutex.Lock()
+	p.entries = map[string]*entry{"stale": {expires: time.Now().Add(-time.Second), size: 3}}
+	p.size = 3
+	p.sweep()
+	held, size = len(p.entries), p.size
+	p.entriesMutex.Unlock()
+	if held != 0 || size != 0 {
+		t.Errorf("Expected expired entries to be swept, got %d entries of %d bytes", held, size)
+	}
+}
+
+// countingTransport counts the requests that it makes
+type countingTransport struct {
+	requests int32
+}
+
+func (transport *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&transport.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestPush(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Write([]byte(`<html><script src="/app.js"></script><img src="/logo.png"><img src="/missing.png"></html>`))
+		case "/app.js":
+			if req.Header.Get("Cookie") != "alice" {
+				t.Errorf("Pushed request without the page's cookie")
+			}
+			resp.Write([]byte("console.log('hi')"))
+		case "/logo.png":
+			resp.Write([]byte("png"))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+	pusher := &Pusher{Dial: func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}}
+	server := httptest.NewServer(pusher)
+	defer server.Close()
+
+	var pushes int32
+	transport := &countingTransport{}
+	p := &Prefetcher{
+		Transport: transport,
+		Push: func(page *http.Request, push *PushRequest) (io.ReadCloser, error) {
+			atomic.AddInt32(&pushes, 1)
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			if err := PrepareRequest(req, push); err != nil {
+				return nil, err
+			}
+			if !IsPushRequest(req) {
+				t.Errorf("Not a push request")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		},
+	}
+	get := func(path string) (int, string) {
+		req, _ := http.NewRequest("GET", origin.URL+path, nil)
+		req.Header.Set("Cookie", "alice")
+		resp, err := p.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Unable to get %s: %s", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	get("/")
+	// Subresources are reserved before pushing, and then wait for the push
+	for i := 0; i < 100 && atomic.LoadInt32(&pushes) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, path := range []string{"/app.js", "/logo.png", "/missing.png"} {
+		get(path)
+	}
+	if pushes := atomic.LoadInt32(&pushes); pushes != 1 {
+		t.Errorf("Expected the subresources to be pushed in 1 request, got %d", pushes)
+	}
+	// Only the page itself
+	if requests := atomic.LoadInt32(&transport.requests); requests != 1 {
+		t.Errorf("Expected pushed subresources not to be fetched through the Transport, got %d requests", requests)
+	}
+	if status, body := get("/app.js"); status != 200 || body != "console.log('hi')" {
+		t.Errorf("Wrong response after push: %d %q", status, body)
+	}
+
+	// Without a server that pushes, subresources are fetched through the
+	// Transport, and pushing isn't tried again
+	atomic.StoreInt32(&pushes, 0)
+	transport = &countingTransport{}
+	p = &Prefetcher{
+		Transport: transport,
+		Push: func(page *http.Request, push *PushRequest) (io.ReadCloser, error) {
+			atomic.AddInt32(&pushes, 1)
+			return nil, ErrPushUnsupported
+		},
+	}
+	get("/")
+	for i := 0; i < 100 && atomic.LoadInt32(&transport.requests) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if requests := atomic.LoadInt32(&transport.requests); requests != 4 {
+		t.Errorf("Expected the subresources to be fetched through the Transport, got %d requests", requests)
+	}
+	get("/")
+	if pushes := atomic.LoadInt32(&pushes); pushes != 1 {
+		t.Errorf("Expected pushing not to be tried again, got %d pushes", pushes)
+	}
+}
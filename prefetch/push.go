@@ -0,0 +1,226 @@
+package prefetch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	PUSH_PATH             = "/prefetch" // path at which servers with a Pusher accept PushRequests
+	MAX_PUSH_REQUEST_SIZE = 64 * 1024
+	PUSH_TIMEOUT          = 30 * time.Second // how long the server spends fetching the subresources of a page
+)
+
+var (
+	// FORWARDED_HEADERS are the headers of the page's request that are sent
+	// along with requests for its subresources, so that they look like the
+	// browser's
+	FORWARDED_HEADERS = []string{"User-Agent", "Accept-Language", "Cookie", "Authorization"}
+
+	// ErrPushUnsupported is returned by a Prefetcher's Push when the server
+	// doesn't push subresources
+	ErrPushUnsupported = errors.New("Server doesn't push prefetched subresources")
+
+	errNotPushed = errors.New("Not pushed by the server")
+)
+
+// PushRequest asks the server to fetch the given subresources of a page and
+// push them to the client
+type PushRequest struct {
+	Page   string            `json:"page"`   // url of the page
+	Header map[string]string `json:"header"` // FORWARDED_HEADERS of the page's request
+	URLs   []string          `json:"urls"`   // urls of the subresources, on the same host as the page
+}
+
+// newPushRequest creates a PushRequest for the given urls of the given page
+func newPushRequest(page *http.Request, urls []string) *PushRequest {
+	push := &PushRequest{
+		Page:   page.URL.String(),
+		Header: make(map[string]string),
+		URLs:   urls,
+	}
+	for _, name := range FORWARDED_HEADERS {
+		if value := page.Header.Get(name); value != "" {
+			push.Header[name] = value
+		}
+	}
+	return push
+}
+
+// PrepareRequest turns the given request to the server (usually built by a
+// protocol.ClientProtocol) into one for the given PushRequest
+func PrepareRequest(req *http.Request, push *PushRequest) error {
+	body, err := json.Marshal(push)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal push request: %s", err)
+	}
+	req.Method = "POST"
+	req.URL.Path = PUSH_PATH
+	req.Header.Set("Content-Type", "application/json")
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
+// IsPushRequest indicates whether the given request to the server is a
+// PushRequest
+func IsPushRequest(req *http.Request) bool {
+	return req.Method == "POST" && req.URL.Path == PUSH_PATH
+}
+
+// ReadPushed reads the responses that a Pusher pushed from the given stream,
+// calling found with each response and the url that it's for
+func ReadPushed(stream io.Reader, found func(u string, resp *http.Response)) error {
+	br := bufio.NewReader(stream)
+	for {
+		u, err := br.ReadString('\n')
+		if err == io.EOF && u == "" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read pushed url: %s", err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return fmt.Errorf("Unable to read pushed response: %s", err)
+		}
+		// The response is framed by its Content-Length, so read it all
+		// before moving on to the next one
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to read pushed body: %s", err)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		found(strings.TrimSuffix(u, "\n"), resp)
+	}
+}
+
+// Pusher is the server side of prefetching.  It serves PushRequests by
+// fetching the requested subresources concurrently and streaming each one to
+// the client as soon as it arrives: the url on a line of its own, followed by
+// the response with its Content-Length.  Subresources that fail or are too big
+// are left out, and the client fetches them itself when the browser asks.
+type Pusher struct {
+	// Dial dials the origin, applying the same checks (egress policy and so
+	// on) as tunneled connections
+	Dial       func(addr string) (net.Conn, error)
+	MaxPerPage int // maximum subresources to push per page, defaults to DEFAULT_MAX_PER_PAGE
+}
+
+func (pusher *Pusher) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	push := &PushRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, MAX_PUSH_REQUEST_SIZE)).Decode(push)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Unable to decode push request: %s", err), http.StatusBadRequest)
+		return
+	}
+	page, err := url.Parse(push.Page)
+	if err != nil || page.Scheme != "http" {
+		http.Error(resp, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	maxPerPage := pusher.MaxPerPage
+	if maxPerPage <= 0 {
+		maxPerPage = DEFAULT_MAX_PER_PAGE
+	}
+
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return pusher.Dial(addr)
+		},
+		ResponseHeaderTimeout: PUSH_TIMEOUT,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   PUSH_TIMEOUT,
+		// Redirects are for the browser to follow
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.WriteHeader(http.StatusOK)
+	var writeMutex sync.Mutex
+	var wg sync.WaitGroup
+	for i, raw := range push.URLs {
+		if i >= maxPerPage {
+			break
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "http" || u.Host != page.Host {
+			// Only push what the client would prefetch itself
+			continue
+		}
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			pushed, err := pusher.fetch(client, u, page.String(), push.Header)
+			if err != nil {
+				log.Debugf("Not pushing %s: %s", log.Redact(u), err)
+				return
+			}
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			fmt.Fprintf(resp, "%s\n", u)
+			pushed.Write(resp)
+			if flusher, ok := resp.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}(u.String())
+	}
+	wg.Wait()
+}
+
+// fetch fetches the given subresource of the given page, as a response that
+// can be written with its Content-Length
+func (pusher *Pusher) fetch(client *http.Client, u string, page string, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range FORWARDED_HEADERS {
+		if value := header[name]; value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Referer", page)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_RESOURCE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MAX_RESOURCE_SIZE {
+		return nil, io.ErrShortBuffer
+	}
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Transfer-Encoding")
+	return &http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        resp.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}, nil
+}
@@ -0,0 +1,114 @@
+// package azure implements the domain-fronting protocol for Azure CDN and
+// Azure Front Door (which also covers Edgio/Verizon-backed Azure endpoints).
+//
+// Unlike CloudFlare, Azure's edge requires an SNI that matches a hostname it
+// serves, so the client sends the masquerade host as the ServerName while the
+// Host header of the request carries the real (azureedge.net) endpoint.
+package azure
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/tls"
+)
+
+const (
+	AZURE_PREFIX     = "X-Azure-"         // prefix of headers added by Azure
+	AZURE_CLIENT_IP  = "X-Azure-Clientip" // header in which Azure reports the client's IP
+	EDGIO_PREFIX     = "X-Ec-"            // prefix of headers added by Edgio-backed endpoints
+	X_FORWARDED_FOR  = "X-Forwarded-For"
+	X_FORWARDED_HOST = "X-Forwarded-Host"
+)
+
+// AZURE_RANGES are the ranges from which Azure Front Door connects to origins,
+// as published in the AzureFrontDoor.Backend service tag
+var AZURE_RANGES = protocol.MustParseIPRanges([]string{
+	"147.243.0.0/16",
+	"2a01:111:2050::/44",
+})
+
+type azureClientProtocol struct {
+	config       *protocol.ClientConfig
+	rootCAs      *x509.CertPool
+	sessionCache tls.ClientSessionCache
+}
+
+type azureServerProtocol struct {
+	trusted protocol.IPRanges
+}
+
+// NewClientProtocol creates a ClientProtocol for fronting via Azure CDN
+func NewClientProtocol(config *protocol.ClientConfig) (protocol.ClientProtocol, error) {
+	rootCAs, err := config.RootCAs()
+	if err != nil {
+		return nil, err
+	}
+	return &azureClientProtocol{
+		config:       config,
+		rootCAs:      rootCAs,
+		sessionCache: protocol.SessionCacheFor(config),
+	}, nil
+}
+
+// NewServerProtocol creates a ServerProtocol for requests fronted by Azure,
+// which trusts the client IPs reported by requests from AZURE_RANGES
+func NewServerProtocol() protocol.ServerProtocol {
+	return NewServerProtocolTrusting(AZURE_RANGES)
+}
+
+// NewServerProtocolTrusting is like NewServerProtocol but trusts the client
+// IPs reported by requests from the given ranges instead, e.g. for Azure CDN
+// endpoints that aren't covered by AZURE_RANGES
+func NewServerProtocolTrusting(trusted protocol.IPRanges) protocol.ServerProtocol {
+	return &azureServerProtocol{trusted}
+}
+
+func (cp *azureClientProtocol) DialProxy(addr string) (net.Conn, error) {
+	return cp.config.DialServer(cp.dialHost)
+}
+
+func (cp *azureClientProtocol) Hosts() []string {
+	return cp.config.Hosts()
+}
+
+func (cp *azureClientProtocol) DialProxyVia(host string) (net.Conn, error) {
+	return cp.config.DialVia(cp.dialHost, host)
+}
+
+func (cp *azureClientProtocol) MarkFailed(host string) {
+	cp.config.MarkFailed(host)
+}
+
+func (cp *azureClientProtocol) dialHost(network string, host string) (net.Conn, error) {
+	// Azure needs to see the host that we're dialing (the masquerade) as SNI
+	tlsConfig := &tls.Config{
+		ClientSessionCache: cp.sessionCache,
+		ServerName:         host,
+		RootCAs:            cp.rootCAs,
+	}
+	return cp.config.DialTLS(network, host, tlsConfig)
+}
+
+func (cp *azureClientProtocol) NewRequest(host string, method string, body io.Reader) (*http.Request, error) {
+	if host == "" {
+		host = cp.config.UpstreamHost
+	}
+	return http.NewRequest(method, "http://"+host+"/", body)
+}
+
+// RewriteRequest strips the headers added by Azure, preserving the client's
+// IP as X-Forwarded-For.  A client that connects directly could send
+// X-Azure-Clientip itself, so it's only preserved if the request comes from
+// one of the trusted ranges.
+func (sp *azureServerProtocol) RewriteRequest(req *http.Request) {
+	if clientIP := req.Header.Get(AZURE_CLIENT_IP); clientIP != "" && sp.trusted.ContainsAddr(req.RemoteAddr) {
+		req.Header.Set(X_FORWARDED_FOR, clientIP)
+	}
+	req.Header.Del(X_FORWARDED_HOST)
+	protocol.StripHeadersWithPrefix(req.Header, AZURE_PREFIX)
+	protocol.StripHeadersWithPrefix(req.Header, EDGIO_PREFIX)
+}
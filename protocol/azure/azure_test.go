@@ -0,0 +1,91 @@
+package azure
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/flashlight/protocol"
+)
+
+func TestNewRequest(t *testing.T) {
+	cp, err := NewClientProtocol(&protocol.ClientConfig{UpstreamHost: "fl1.azureedge.net", UpstreamPort: 443})
+	if err != nil {
+		t.Fatalf("Unable to create protocol: %s", err)
+	}
+	for _, test := range []struct {
+		host     string
+		method   string
+		expected string
+	}{
+		{"", "GET", "fl1.azureedge.net"},
+		{"fl2.azureedge.net", "POST", "fl2.azureedge.net"},
+	} {
+		req, err := cp.NewRequest(test.host, test.method, nil)
+		if err != nil {
+			t.Fatalf("Unable to create request for %q: %s", test.host, err)
+		}
+		// The Host header carries the endpoint, whatever masquerade we dial
+		if req.Host != test.expected || req.URL.Host != test.expected || req.URL.Path != "/" || req.URL.Scheme != "http" {
+			t.Errorf("Request for %q went to %s (Host %s), expected http://%s/", test.host, req.URL, req.Host, test.expected)
+		}
+		if req.Method != test.method {
+			t.Errorf("Wrong method %s, expected %s", req.Method, test.method)
+		}
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	sp := NewServerProtocolTrusting(protocol.MustParseIPRanges([]string{"147.243.0.0/16"}))
+	for _, test := range []struct {
+		name         string
+		remoteAddr   string
+		header       http.Header
+		forwardedFor string
+		keptHeaders  []string
+	}{
+		{
+			name:       "from Azure",
+			remoteAddr: "147.243.1.2:443",
+			header: http.Header{
+				"X-Azure-Clientip": {"203.0.113.5"},
+				"X-Azure-Ref":      {"abc"},
+				"X-Ec-Debug":       {"x"},
+				"X-Forwarded-Host": {"fl1.azureedge.net"},
+				"User-Agent":       {"test"},
+			},
+			forwardedFor: "203.0.113.5",
+			keptHeaders:  []string{"User-Agent"},
+		},
+		{
+			name:         "direct with forged X-Azure-Clientip",
+			remoteAddr:   "198.51.100.7:50000",
+			header:       http.Header{"X-Azure-Clientip": {"203.0.113.5"}, "X-Forwarded-Host": {"evil.example"}},
+			forwardedFor: "",
+		},
+		{
+			name:         "from Azure without client IP",
+			remoteAddr:   "147.243.1.2:443",
+			header:       http.Header{"X-Azure-Ref": {"abc"}},
+			forwardedFor: "",
+		},
+	} {
+		req, _ := http.NewRequest("GET", "http://fl1.azureedge.net/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header = test.header
+		sp.RewriteRequest(req)
+		if got := req.Header.Get(X_FORWARDED_FOR); got != test.forwardedFor {
+			t.Errorf("%s: X-Forwarded-For is %q, expected %q", test.name, got, test.forwardedFor)
+		}
+		for name := range req.Header {
+			if strings.HasPrefix(name, AZURE_PREFIX) || strings.HasPrefix(name, EDGIO_PREFIX) || name == X_FORWARDED_HOST {
+				t.Errorf("%s: %s not stripped", test.name, name)
+			}
+		}
+		for _, name := range test.keptHeaders {
+			if req.Header.Get(name) == "" {
+				t.Errorf("%s: %s stripped", test.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/egress"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/reputation"
+)
+
+const (
+	BALANCE_ROUND_ROBIN = "roundrobin" // weighted round-robin
+	BALANCE_LATENCY     = "latency"    // lowest observed latency
+
+	MAX_SERVER_FAILURES = 3               // consecutive failures after which we evict a server
+	EVICTION_PERIOD     = 1 * time.Minute // how long evicted servers stay out of rotation
+	LATENCY_SMOOTHING   = 0.3             // weight of new samples in the latency moving average
+)
+
+// BalancedServer is a flashlight server among which a Balancer distributes
+// connections
+type BalancedServer struct {
+	Name   string // for logging and status
+	Weight int    // (optional) relative share of connections for BALANCE_ROUND_ROBIN, defaults to 1
+	Chain  *Chain // protocols for reaching this server
+
+	currentWeight       int
+	latency             time.Duration
+	consecutiveFailures int
+	evictedUntil        time.Time
+	policy              *egress.Policy // egress policy that the server advertised, if any
+	degraded            bool           // whether the server advertised a degraded reputation
+}
+
+// Balancer distributes new connections among multiple flashlight servers,
+// either by weighted round-robin or by lowest observed latency (time to the
+// first response byte).  Servers that fail repeatedly are evicted for
+// EVICTION_PERIOD.  Servers whose advertised egress policy (see Advertised)
+// doesn't permit a destination's country are skipped for that destination,
+// and servers that advertise a degraded reputation (their egress IP being
+// blocked or captcha-walled) are skipped altogether, unless no other server
+// is left.
+type Balancer struct {
+	// Usable (optional) indicates whether we may use the named server at all
+	// (e.g. once its identity is verified).  Unusable servers are skipped
+	// even if no other server is left.
+	Usable func(name string) bool
+
+	// LookupCountry (optional) looks up the country code of a destination
+	// host, for picking servers whose egress policy permits it.  It's only
+	// called when some server restricts egress by country.
+	LookupCountry func(host string) (string, error)
+
+	servers  []*BalancedServer
+	strategy string
+	last     *BalancedServer
+	mutex    sync.Mutex
+}
+
+// NewBalancer creates a Balancer among the given servers using the given
+// strategy (BALANCE_ROUND_ROBIN or BALANCE_LATENCY)
+func NewBalancer(servers []*BalancedServer, strategy string) (*Balancer, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("Balancer requires at least one server")
+	}
+	if strategy != BALANCE_ROUND_ROBIN && strategy != BALANCE_LATENCY {
+		return nil, fmt.Errorf("Unknown balancing strategy: %s", strategy)
+	}
+	for _, server := range servers {
+		if server.Weight < 1 {
+			server.Weight = 1
+		}
+	}
+	return &Balancer{servers: servers, strategy: strategy}, nil
+}
+
+// Stop stops the servers' Chains, e.g. once the Balancer is replaced
+func (balancer *Balancer) Stop() {
+	for _, server := range balancer.servers {
+		server.Chain.Stop()
+	}
+}
+
+// ServerConfigs returns an enproxy.Config for each server by name, for
+// reaching that server in particular
+func (balancer *Balancer) ServerConfigs() map[string]*enproxy.Config {
+	configs := make(map[string]*enproxy.Config)
+	for _, server := range balancer.servers {
+		configs[server.Name] = server.Chain.EnproxyConfig()
+	}
+	return configs
+}
+
+// EnproxyConfig returns an enproxy.Config for the next server.  A new config
+// should be obtained for each new connection.
+func (balancer *Balancer) EnproxyConfig() *enproxy.Config {
+	return balancer.EnproxyConfigFor("")
+}
+
+// EnproxyConfigFor is like EnproxyConfig, but prefers servers whose egress
+// policy permits the given destination addr (host:port).
+func (balancer *Balancer) EnproxyConfigFor(addr string) *enproxy.Config {
+	server := balancer.next(balancer.countryOf(addr))
+	if server == nil {
+		config := balancer.servers[0].Chain.EnproxyConfig()
+		config.DialProxy = func(addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("No usable server")
+		}
+		return config
+	}
+	config := server.Chain.EnproxyConfig()
+	dialProxy := config.DialProxy
+	config.DialProxy = func(addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dialProxy(addr)
+		if err != nil {
+			balancer.onFailure(server, err)
+			return nil, err
+		}
+		return &statusSniffingConn{Conn: conn, onStatus: func(status int) {
+			if status == http.StatusForbidden || status >= http.StatusInternalServerError {
+				balancer.onFailure(server, fmt.Errorf("Got %d response", status))
+			} else {
+				balancer.onSuccess(server, time.Now().Sub(start))
+			}
+		}}, nil
+	}
+	return config
+}
+
+// Current returns the name of the server most recently picked and the
+// protocol currently in use for it
+func (balancer *Balancer) Current() string {
+	balancer.mutex.Lock()
+	server := balancer.last
+	balancer.mutex.Unlock()
+	if server == nil {
+		server = balancer.servers[0]
+	}
+	return server.Name + "/" + server.Chain.Current()
+}
+
+// Observe records the outcome of a probe of the named server (see Prober).  A
+// successful probe brings an evicted server back into rotation.
+func (balancer *Balancer) Observe(name string, rtt time.Duration, err error) {
+	for _, server := range balancer.servers {
+		if server.Name != name {
+			continue
+		}
+		if err != nil {
+			balancer.onFailure(server, err)
+			return
+		}
+		balancer.onSuccess(server, rtt)
+		balancer.mutex.Lock()
+		server.evictedUntil = time.Time{}
+		balancer.mutex.Unlock()
+		return
+	}
+}
+
+// Advertised records what the named server advertised in the given response
+// header (see Prober.OnAdvertised), namely its egress policy and reputation
+func (balancer *Balancer) Advertised(name string, header http.Header) {
+	degraded := header.Get(reputation.X_LANTERN_REPUTATION) == reputation.DEGRADED
+	var policy *egress.Policy
+	if advertised := header.Get(egress.X_LANTERN_EGRESS_POLICY); advertised != "" {
+		var err error
+		policy, err = egress.ParsePolicy(advertised)
+		if err != nil {
+			log.Debugf("Ignoring egress policy of server %s: %s", name, err)
+		}
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	for _, server := range balancer.servers {
+		if server.Name == name {
+			if degraded && !server.degraded {
+				log.Debugf("Server %s reports a degraded reputation, avoiding it", name)
+			}
+			server.policy = policy
+			server.degraded = degraded
+		}
+	}
+}
+
+// countryOf looks up the country of the host of the given addr if any server
+// restricts egress by country, returning "" otherwise or if the lookup fails
+func (balancer *Balancer) countryOf(addr string) string {
+	if addr == "" || balancer.LookupCountry == nil {
+		return ""
+	}
+	balancer.mutex.Lock()
+	restricted := false
+	for _, server := range balancer.servers {
+		restricted = restricted || server.policy.RestrictsCountries()
+	}
+	balancer.mutex.Unlock()
+	if !restricted {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	country, err := balancer.LookupCountry(host)
+	if err != nil {
+		log.Debugf("Unable to look up country of %s, picking any server: %s", log.Redact(host), err)
+		return ""
+	}
+	return country
+}
+
+// next picks the server for a new connection to the given destination country
+// (if known), or returns nil if no server is Usable
+func (balancer *Balancer) next(country string) *BalancedServer {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	candidates := reputable(permitting(balancer.healthy(), country))
+	if len(candidates) == 0 {
+		return nil
+	}
+	var picked *BalancedServer
+	if balancer.strategy == BALANCE_LATENCY {
+		// Servers without samples have a latency of 0, so they get tried
+		// first
+		for _, server := range candidates {
+			if picked == nil || server.latency < picked.latency {
+				picked = server
+			}
+		}
+	} else {
+		// Smooth weighted round-robin, which interleaves servers rather than
+		// sending Weight connections in a row to each one
+		total := 0
+		for _, server := range candidates {
+			server.currentWeight += server.Weight
+			total += server.Weight
+			if picked == nil || server.currentWeight > picked.currentWeight {
+				picked = server
+			}
+		}
+		picked.currentWeight -= total
+	}
+	balancer.last = picked
+	return picked
+}
+
+// healthy returns the Usable servers that aren't evicted, or all Usable
+// servers if they're all evicted
+func (balancer *Balancer) healthy() []*BalancedServer {
+	now := time.Now()
+	var usable, healthy []*BalancedServer
+	for _, server := range balancer.servers {
+		if balancer.Usable != nil && !balancer.Usable(server.Name) {
+			continue
+		}
+		usable = append(usable, server)
+		if now.After(server.evictedUntil) {
+			healthy = append(healthy, server)
+		}
+	}
+	if len(healthy) == 0 {
+		return usable
+	}
+	return healthy
+}
+
+// permitting returns those of the given servers whose egress policy permits
+// the given country, or all of them if none do or the country is unknown
+func permitting(servers []*BalancedServer, country string) []*BalancedServer {
+	if country == "" {
+		return servers
+	}
+	var permitted []*BalancedServer
+	for _, server := range servers {
+		if server.policy.PermitsCountry(country) {
+			permitted = append(permitted, server)
+		}
+	}
+	if len(permitted) == 0 {
+		return servers
+	}
+	return permitted
+}
+
+// reputable returns those of the given servers that don't have a degraded
+// reputation, or all of them if they all do
+func reputable(servers []*BalancedServer) []*BalancedServer {
+	var reputable []*BalancedServer
+	for _, server := range servers {
+		if !server.degraded {
+			reputable = append(reputable, server)
+		}
+	}
+	if len(reputable) == 0 {
+		return servers
+	}
+	return reputable
+}
+
+func (balancer *Balancer) onFailure(server *BalancedServer, err error) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	server.consecutiveFailures += 1
+	log.Debugf("Server %s failed (%d consecutive failures): %s", server.Name, server.consecutiveFailures, err)
+	if server.consecutiveFailures >= MAX_SERVER_FAILURES {
+		server.consecutiveFailures = 0
+		server.evictedUntil = time.Now().Add(EVICTION_PERIOD)
+		log.Errorf("Evicting server %s for %s", server.Name, EVICTION_PERIOD)
+	}
+}
+
+func (balancer *Balancer) onSuccess(server *BalancedServer, latency time.Duration) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	server.consecutiveFailures = 0
+	if server.latency == 0 {
+		server.latency = latency
+	} else {
+		server.latency = time.Duration(LATENCY_SMOOTHING*float64(latency) + (1-LATENCY_SMOOTHING)*float64(server.latency))
+	}
+}
@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func balancedServer(t *testing.T, name string, weight int, cp ClientProtocol) *BalancedServer {
+	chain, err := NewChain([]*ChainEntry{&ChainEntry{Name: "test", Protocol: cp}})
+	if err != nil {
+		t.Fatalf("Unable to create chain: %s", err)
+	}
+	return &BalancedServer{Name: name, Weight: weight, Chain: chain}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	a := balancedServer(t, "a", 3, &failingProtocol{})
+	b := balancedServer(t, "b", 1, &failingProtocol{})
+	balancer, err := NewBalancer([]*BalancedServer{a, b}, BALANCE_ROUND_ROBIN)
+	if err != nil {
+		t.Fatalf("Unable to create balancer: %s", err)
+	}
+	picks := ""
+	for i := 0; i < 8; i++ {
+		picks += balancer.next("").Name
+	}
+	if picks != "aabaaaba" {
+		t.Errorf("Unexpected picks: %s", picks)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	failing := &failingProtocol{}
+	other := &failingProtocol{}
+	a := balancedServer(t, "a", 1, failing)
+	b := balancedServer(t, "b", 1, other)
+	balancer, err := NewBalancer([]*BalancedServer{a, b}, BALANCE_LATENCY)
+	if err != nil {
+		t.Fatalf("Unable to create balancer: %s", err)
+	}
+	b.latency = 1 // prefer a while both are healthy
+	for i := 0; i < MAX_SERVER_FAILURES; i++ {
+		balancer.EnproxyConfig().DialProxy("")
+	}
+	if failing.dials != MAX_SERVER_FAILURES {
+		t.Fatalf("Expected %d dials to a, got %d", MAX_SERVER_FAILURES, failing.dials)
+	}
+	balancer.EnproxyConfig().DialProxy("")
+	if other.dials != 1 {
+		t.Errorf("Expected a to be evicted in favor of b")
+	}
+}
+
+func TestObserve(t *testing.T) {
+	a := balancedServer(t, "a", 1, &failingProtocol{})
+	b := balancedServer(t, "b", 1, &failingProtocol{})
+	balancer, err := NewBalancer([]*BalancedServer{a, b}, BALANCE_LATENCY)
+	if err != nil {
+		t.Fatalf("Unable to create balancer: %s", err)
+	}
+	balancer.Observe("a", 50*time.Millisecond, nil)
+	balancer.Observe("b", 10*time.Millisecond, nil)
+	if balancer.next("") != b {
+		t.Errorf("Expected lower latency server to be picked")
+	}
+	for i := 0; i < MAX_SERVER_FAILURES; i++ {
+		balancer.Observe("b", 0, fmt.Errorf("Blocked"))
+	}
+	if balancer.next("") != a {
+		t.Errorf("Expected failing server to be evicted")
+	}
+	balancer.Observe("b", 10*time.Millisecond, nil)
+	if balancer.next("") != b {
+		t.Errorf("Expected successful probe to bring server back")
+	}
+}
+
+func TestUsable(t *testing.T) {
+	a := balancedServer(t, "a", 1, &failingProtocol{})
+	b := balancedServer(t, "b", 1, &failingProtocol{})
+	balancer, err := NewBalancer([]*BalancedServer{a, b}, BALANCE_ROUND_ROBIN)
+	if err != nil {
+		t.Fatalf("Unable to create balancer: %s", err)
+	}
+	usable := map[string]bool{"b": true}
+	balancer.Usable = func(name string) bool {
+		return usable[name]
+	}
+	for i := 0; i < 3; i++ {
+		if picked := balancer.next(""); picked != b {
+			t.Errorf("Expected only b to be picked, got %v", picked)
+		}
+	}
+	if len(balancer.ServerConfigs()) != 2 {
+		t.Errorf("Expected configs for both servers")
+	}
+
+	usable["b"] = false
+	if picked := balancer.next(""); picked != nil {
+		t.Errorf("Expected no server to be picked, got %s", picked.Name)
+	}
+	if _, err := balancer.EnproxyConfig().DialProxy(""); err == nil || err.Error() != "No usable server" {
+		t.Errorf("Expected dialing to fail without a usable server, got %v", err)
+	}
+}
+
+func TestAdvertisedEgressPolicy(t *testing.T) {
+	a := balancedServer(t, "a", 1, &failingProtocol{})
+	b := balancedServer(t, "b", 1, &failingProtocol{})
+	balancer, err := NewBalancer([]*BalancedServer{a, b}, BALANCE_ROUND_ROBIN)
+	if err != nil {
+		t.Fatalf("Unable to create balancer: %s", err)
+	}
+	lookups := 0
+	balancer.LookupCountry = func(host string) (string, error) {
+		lookups += 1
+		if host == "example.de" {
+			return "DE", nil
+		}
+		return "", fmt.Errorf("Unknown host %s", host)
+	}
+	if country := balancer.countryOf("example.de:443"); country != "" || lookups != 0 {
+		t.Errorf("Expected no lookup while no server restricts countries, got %s after %d lookups", country, lookups)
+	}
+
+	header := http.Header{}
+	header.Set("X-Lantern-Egress-Policy", "allow=;exclude=DE;allowasn=;excludeasn=")
+	balancer.Advertised("a", header)
+	country := balancer.countryOf("example.de:443")
+	if country != "DE" {
+		t.Fatalf("Expected DE, got %s", country)
+	}
+	for i := 0; i < 3; i++ {
+		if picked := balancer.next(country); picked != b {
+			t.Errorf("Expected only b to be picked for DE, got %s", picked.Name)
+		}
+	}
+	if balancer.countryOf("unknown.example:443") != "" {
+		t.Errorf("Expected failed lookups to leave the country unknown")
+	}
+
+	// With no compliant server left, any server is better than none
+	balancer.Advertised("b", header)
+	if picked := balancer.next(country); picked == nil {
+		t.Errorf("Expected a server to be picked even though none permits DE")
+	}
+
+	// Servers that stop advertising a policy are no longer restricted
+	balancer.Advertised("a", http.Header{})
+	for i := 0; i < 3; i++ {
+		if picked := balancer.next(country); picked != a {
+			t.Errorf("Expected only a to be picked for DE, got %s", picked.Name)
+		}
+	}
+}
+
+func TestAdvertisedReputation(t *testing.T) {
+	a := balancedServer(t, "a", 1, &failingProtocol{})
+	b := balancedServer(t, "b", 1, &failingProtocol{})
+	balancer, err := NewBalancer([]*BalancedServer{a, b}, BALANCE_ROUND_ROBIN)
+	if err != nil {
+		t.Fatalf("Unable to create balancer: %s", err)
+	}
+	degraded := http.Header{}
+	degraded.Set("X-Lantern-Reputation", "degraded")
+	balancer.Advertised("a", degraded)
+	for i := 0; i < 3; i++ {
+		if picked := balancer.next(""); picked != b {
+			t.Errorf("Expected degraded server to be avoided, got %s", picked.Name)
+		}
+	}
+
+	// With only degraded servers left, any server is better than none
+	balancer.Advertised("b", degraded)
+	if picked := balancer.next(""); picked == nil {
+		t.Errorf("Expected a server to be picked even though all are degraded")
+	}
+
+	ok := http.Header{}
+	ok.Set("X-Lantern-Reputation", "ok")
+	balancer.Advertised("b", ok)
+	for i := 0; i < 3; i++ {
+		if picked := balancer.next(""); picked != b {
+			t.Errorf("Expected recovered server to be picked, got %s", picked.Name)
+		}
+	}
+}
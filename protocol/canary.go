@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/enproxy"
+)
+
+const (
+	CANARY_TIMEOUT  = 30 * time.Second
+	MAX_CANARY_SIZE = 1024 * 1024
+)
+
+// Canary is a resource with known content that a Prober fetches through each
+// server to detect on-path tampering (e.g. content injection) and broken
+// fronts.  It has to be plain http, since https can't be tampered with
+// without failing the TLS handshake anyway.
+type Canary struct {
+	URL    string
+	SHA256 []byte // hash of the resource's content
+}
+
+// TamperingError indicates that a Canary came back with unexpected content
+type TamperingError struct {
+	Reason string
+}
+
+func (err *TamperingError) Error() string {
+	return "Canary tampered with: " + err.Reason
+}
+
+// NewCanary creates a Canary for the given plain http URL, whose content has
+// the given hex-encoded SHA-256 hash
+func NewCanary(canaryURL string, sha256Hex string) (*Canary, error) {
+	u, err := url.Parse(canaryURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid canary URL %s: %s", canaryURL, err)
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("Canary URL %s must be plain http", canaryURL)
+	}
+	hash, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("Invalid canary SHA-256 %s", sha256Hex)
+	}
+	return &Canary{URL: canaryURL, SHA256: hash}, nil
+}
+
+// check fetches the Canary through the given protocol, dialing the fronting
+// provider with dial.  It returns a TamperingError if the response isn't the
+// expected content, or some other error if the canary couldn't be fetched at
+// all.
+func (canary *Canary) check(cp ClientProtocol, dial func() (net.Conn, error)) error {
+	req, err := http.NewRequest("GET", canary.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+	conn := &enproxy.Conn{
+		Addr: addr,
+		Config: &enproxy.Config{
+			DialProxy: func(string) (net.Conn, error) {
+				return dial()
+			},
+			NewRequest: cp.NewRequest,
+		},
+	}
+	if err := conn.Connect(); err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CANARY_TIMEOUT))
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &TamperingError{fmt.Sprintf("got %d response", resp.StatusCode)}
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(resp.Body, MAX_CANARY_SIZE)); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), canary.SHA256) {
+		return &TamperingError{"content doesn't match"}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestNewCanary(t *testing.T) {
+	hash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	canary, err := NewCanary("http://canary.example.org/canary.txt", hash)
+	if err != nil || len(canary.SHA256) != 32 {
+		t.Errorf("Valid canary should parse: %s", err)
+	}
+	if _, err := NewCanary("https://canary.example.org/canary.txt", hash); err == nil {
+		t.Error("https canary shouldn't be allowed")
+	}
+	if _, err := NewCanary("http://canary.example.org/canary.txt", "abcd"); err == nil {
+		t.Error("Truncated hash shouldn't be allowed")
+	}
+}
+
+func TestRecordTampering(t *testing.T) {
+	prober := &Prober{}
+	target := &probeTarget{result: &ProbeResult{Server: "fl1.example.org"}}
+	prober.record(target, 0, &TamperingError{"content doesn't match"})
+	prober.record(target, 0, nil)
+	if target.result.Tampered != 1 || target.result.Successes != 1 || target.result.Probes != 2 {
+		t.Errorf("Unexpected result: %+v", target.result)
+	}
+}
@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	MAX_CONSECUTIVE_FAILURES = 3               // failures after which we fail over to the next protocol
+	REPROBE_INTERVAL         = 5 * time.Minute // how frequently to re-probe preferred protocols after failing over
+)
+
+// ChainEntry is a named ClientProtocol in a Chain
+type ChainEntry struct {
+	Name     string
+	Protocol ClientProtocol
+}
+
+// Chain is a list of ClientProtocols in priority order.  It uses the first
+// protocol until that protocol appears to be blocked (repeated dial failures
+// or 403 responses) and then fails over to the next one.  While failed over,
+// it periodically re-probes the preferred protocols and switches back to them
+// once they're working again.
+type Chain struct {
+	entries             []*ChainEntry
+	current             int
+	consecutiveFailures int
+	mutex               sync.Mutex
+	stop                chan bool
+	stopOnce            sync.Once
+}
+
+// NewChain creates a Chain using the given entries in priority order
+func NewChain(entries []*ChainEntry) (*Chain, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("Chain requires at least one protocol")
+	}
+	chain := &Chain{entries: entries, stop: make(chan bool)}
+	if len(entries) > 1 {
+		go chain.reprobePeriodically()
+	}
+	return chain, nil
+}
+
+// EnproxyConfig returns an enproxy.Config that uses the currently preferred
+// protocol.  A new config should be obtained for each new connection so that
+// the dial and the requests on a given connection use the same protocol.
+func (chain *Chain) EnproxyConfig() *enproxy.Config {
+	chain.mutex.Lock()
+	idx := chain.current
+	chain.mutex.Unlock()
+
+	entry := chain.entries[idx]
+	return &enproxy.Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			conn, err := entry.Protocol.DialProxy(addr)
+			if err != nil {
+				chain.onFailure(idx, err)
+				return nil, err
+			}
+			return &statusSniffingConn{Conn: conn, onStatus: func(status int) {
+				if status == http.StatusForbidden {
+					chain.onFailure(idx, fmt.Errorf("Got %d response", status))
+				} else {
+					chain.onSuccess(idx)
+				}
+			}}, nil
+		},
+		NewRequest: entry.Protocol.NewRequest,
+	}
+}
+
+// Stop stops re-probing the preferred protocols, e.g. once the Chain is
+// replaced.  Connections made through it stay open.
+func (chain *Chain) Stop() {
+	chain.stopOnce.Do(func() {
+		close(chain.stop)
+	})
+}
+
+// Current returns the name of the protocol currently in use
+func (chain *Chain) Current() string {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	return chain.entries[chain.current].Name
+}
+
+func (chain *Chain) onFailure(idx int, err error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	if idx != chain.current {
+		// Stale failure from a protocol that we're no longer using
+		return
+	}
+	chain.consecutiveFailures += 1
+	log.Debugf("Protocol %s failed (%d consecutive failures): %s", chain.entries[idx].Name, chain.consecutiveFailures, err)
+	if chain.consecutiveFailures >= MAX_CONSECUTIVE_FAILURES {
+		chain.current = (idx + 1) % len(chain.entries)
+		chain.consecutiveFailures = 0
+		log.Errorf("Protocol %s appears to be blocked, failing over to %s", chain.entries[idx].Name, chain.entries[chain.current].Name)
+	}
+}
+
+func (chain *Chain) onSuccess(idx int) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	if idx == chain.current {
+		chain.consecutiveFailures = 0
+	}
+}
+
+// reprobePeriodically checks protocols preferred to the current one and
+// switches back to the first one that's working.
+func (chain *Chain) reprobePeriodically() {
+	defer crash.Recover()
+	for {
+		select {
+		case <-chain.stop:
+			return
+		case <-time.After(REPROBE_INTERVAL):
+		}
+		chain.mutex.Lock()
+		current := chain.current
+		chain.mutex.Unlock()
+		for i := 0; i < current; i++ {
+			entry := chain.entries[i]
+			err := probe(entry.Protocol)
+			if err != nil {
+				log.Debugf("Preferred protocol %s still failing: %s", entry.Name, err)
+				continue
+			}
+			chain.mutex.Lock()
+			chain.current = i
+			chain.consecutiveFailures = 0
+			chain.mutex.Unlock()
+			log.Debugf("Preferred protocol %s is working again, switching back to it", entry.Name)
+			break
+		}
+	}
+}
+
+// probe checks whether the given protocol can reach the server without being
+// blocked by making a simple HEAD request through it.
+func probe(cp ClientProtocol) error {
+	_, _, err := probeVia(cp, func() (net.Conn, error) {
+		return cp.DialProxy("")
+	}, nil)
+	return err
+}
+
+// probeVia is like probe but dials using the given dial function and adds the
+// given header (if any) to the request.  It returns the time from starting the
+// dial to receiving the response, and the response's header.
+func probeVia(cp ClientProtocol, dial func() (net.Conn, error), header http.Header) (time.Duration, http.Header, error) {
+	start := time.Now()
+	conn, err := dial()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	req, err := cp.NewRequest("", "HEAD", nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		return 0, nil, fmt.Errorf("Got %d response", resp.StatusCode)
+	}
+	return time.Now().Sub(start), resp.Header, nil
+}
+
+// statusSniffingConn is a net.Conn that parses the status code of the first
+// HTTP response read from it and reports it to onStatus.
+type statusSniffingConn struct {
+	net.Conn
+	onStatus func(status int)
+	sniffed  bool
+}
+
+func (conn *statusSniffingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if !conn.sniffed && n > 0 {
+		conn.sniffed = true
+		// Status line looks like "HTTP/1.1 403 Forbidden"
+		fields := bytes.Fields(b[:n])
+		if len(fields) > 1 && bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+			status, parseErr := strconv.Atoi(string(fields[1]))
+			if parseErr == nil {
+				conn.onStatus(status)
+			}
+		}
+	}
+	return n, err
+}
+
+// ServerProtocols is a list of ServerProtocols that are all applied to
+// inbound requests, for servers that are reachable via multiple fronting
+// providers.
+type ServerProtocols []ServerProtocol
+
+func (protocols ServerProtocols) RewriteRequest(req *http.Request) {
+	for _, sp := range protocols {
+		sp.RewriteRequest(req)
+	}
+}
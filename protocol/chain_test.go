@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// failingProtocol is a ClientProtocol whose dials always fail
+type failingProtocol struct {
+	dials int
+}
+
+func (cp *failingProtocol) DialProxy(addr string) (net.Conn, error) {
+	cp.dials += 1
+	return nil, fmt.Errorf("Blocked")
+}
+
+func (cp *failingProtocol) NewRequest(host string, method string, body io.Reader) (*http.Request, error) {
+	return http.NewRequest(method, "http://"+host+"/", body)
+}
+
+func TestChainFailover(t *testing.T) {
+	preferred := &failingProtocol{}
+	fallback := &failingProtocol{}
+	chain, err := NewChain([]*ChainEntry{
+		&ChainEntry{Name: "preferred", Protocol: preferred},
+		&ChainEntry{Name: "fallback", Protocol: fallback},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create chain: %s", err)
+	}
+
+	for i := 0; i < MAX_CONSECUTIVE_FAILURES; i++ {
+		chain.EnproxyConfig().DialProxy("")
+	}
+	if preferred.dials != MAX_CONSECUTIVE_FAILURES {
+		t.Errorf("Expected %d dials on preferred protocol, got %d", MAX_CONSECUTIVE_FAILURES, preferred.dials)
+	}
+
+	chain.EnproxyConfig().DialProxy("")
+	if fallback.dials != 1 {
+		t.Errorf("Expected chain to fail over to fallback protocol")
+	}
+	if preferred.dials != MAX_CONSECUTIVE_FAILURES {
+		t.Errorf("Expected no further dials on preferred protocol")
+	}
+}
+
+func TestStatusSniffing(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		server.Close()
+	}()
+
+	var status int
+	conn := &statusSniffingConn{Conn: client, onStatus: func(s int) {
+		status = s
+	}}
+	b := make([]byte, 100)
+	conn.Read(b)
+	if status != http.StatusForbidden {
+		t.Errorf("Expected to sniff status %d, got %d", http.StatusForbidden, status)
+	}
+}
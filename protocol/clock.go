@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxydialer"
+	"github.com/getlantern/flashlight/resolver"
+	"github.com/getlantern/tls"
+)
+
+const (
+	MIN_CLOCK_SKEW      = 1 * time.Minute  // smaller skews are left alone
+	CLOCK_SYNC_INTERVAL = 1 * time.Minute  // minimum time between clock syncs
+	CLOCK_SYNC_TIMEOUT  = 10 * time.Second // timeout for fetching the time
+)
+
+var (
+	// SyncClock enables correcting for a skewed system clock.  When a TLS
+	// handshake with a fronting provider fails because the certificate
+	// appears expired or not yet valid, we take the time from the Date header
+	// of the provider's response to a HEAD request and, if the certificate
+	// chain is valid as of that time, validate certificates with it from then
+	// on.  This lets users whose clocks are badly off (e.g. routers without a
+	// real-time clock that boot in 1970) connect anyway.
+	SyncClock = false
+
+	clockOffset   int64 // nanoseconds added to the system clock, see Now
+	lastClockSync time.Time
+	clockMutex    sync.Mutex
+)
+
+// Now returns the current time according to the system clock, corrected for
+// any skew found by SyncClock.  It's used for validating certificates.
+func Now() time.Time {
+	return time.Now().Add(ClockOffset())
+}
+
+// ClockOffset returns the correction applied to the system clock, which is
+// zero unless SyncClock found it to be skewed
+func ClockOffset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&clockOffset))
+}
+
+// isClockError indicates whether the given handshake error could be caused by
+// a skewed clock, i.e. the certificate appears expired or not yet valid
+func isClockError(err error) bool {
+	certErr, ok := err.(x509.CertificateInvalidError)
+	return ok && certErr.Reason == x509.Expired
+}
+
+// syncClockAfter syncs the clock with the host at addr after a handshake
+// using the given tls.Config failed with the given error while the clock
+// offset was offsetBefore (in nanoseconds).  It returns true if the offset
+// has changed since, in which case the handshake is worth retrying.
+func syncClockAfter(handshakeErr error, offsetBefore int64, r *resolver.Resolver, upstreamProxy proxydialer.Dialer, network string, addr string, tlsConfig *tls.Config) bool {
+	if !SyncClock || !isClockError(handshakeErr) {
+		return false
+	}
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+	if atomic.LoadInt64(&clockOffset) != offsetBefore {
+		// Another dial synced the clock while we were handshaking
+		return true
+	}
+	if time.Now().Sub(lastClockSync) < CLOCK_SYNC_INTERVAL {
+		return false
+	}
+	lastClockSync = time.Now()
+
+	date, err := fetchDate(r, upstreamProxy, network, addr, tlsConfig)
+	if err != nil {
+		log.Errorf("Unable to sync clock with %s: %s", tlsConfig.ServerName, err)
+		return false
+	}
+	offset := date.Sub(time.Now())
+	if offset > -MIN_CLOCK_SKEW && offset < MIN_CLOCK_SKEW {
+		offset = 0
+	}
+	if int64(offset) == offsetBefore {
+		return false
+	}
+	atomic.StoreInt64(&clockOffset, int64(offset))
+	log.Errorf("System clock is off by %v according to %s, correcting for it when validating certificates", offset, tlsConfig.ServerName)
+	return true
+}
+
+// fetchDate fetches the time from the Date header of the response to a HEAD
+// request to the host at addr.  Since our clock can't be trusted, the
+// handshake skips verification, and the certificate chain is verified
+// afterwards as of the returned time instead.  The request itself reveals
+// nothing, since it's for the root of the host that we were dialing anyway.
+func fetchDate(r *resolver.Resolver, upstreamProxy proxydialer.Dialer, network string, addr string, tlsConfig *tls.Config) (time.Time, error) {
+	conn, err := handshakeTLS(r, upstreamProxy, network, addr, &tls.Config{
+		ServerName:                          tlsConfig.ServerName,
+		SuppressServerNameInClientHandshake: tlsConfig.SuppressServerNameInClientHandshake,
+		InsecureSkipVerify:                  true,
+	}, CLOCK_SYNC_TIMEOUT, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CLOCK_SYNC_TIMEOUT))
+
+	req, err := http.NewRequest("HEAD", "http://"+tlsConfig.ServerName+"/", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := req.Write(conn); err != nil {
+		return time.Time{}, fmt.Errorf("Unable to send request: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to read response: %s", err)
+	}
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to parse Date header: %s", err)
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	if err := verifyChainAt(state.PeerCertificates, tlsConfig.ServerName, tlsConfig.RootCAs, date); err != nil {
+		return time.Time{}, fmt.Errorf("Certificate is not valid as of %v: %s", date, err)
+	}
+	return date, nil
+}
+
+// verifyChainAt verifies that the given chain (leaf first) is valid for
+// serverName as of the given time, using the given roots (nil means use the
+// system's trusted roots)
+func verifyChainAt(certs []*x509.Certificate, serverName string, roots *x509.CertPool, at time.Time) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("No certificates presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+	})
+	return err
+}
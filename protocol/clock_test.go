@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifyChainAt(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	cert := server.Certificate()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	certs := []*x509.Certificate{cert}
+
+	if err := verifyChainAt(certs, "example.com", roots, time.Now()); err != nil {
+		t.Errorf("Expected chain to be valid now: %s", err)
+	}
+	err := verifyChainAt(certs, "example.com", roots, cert.NotAfter.Add(time.Hour))
+	if err == nil {
+		t.Errorf("Expected chain to be invalid after it expires")
+	} else if !isClockError(err) {
+		t.Errorf("Expected expiry to be a clock error, got %s", err)
+	}
+	if err := verifyChainAt(certs, "wrong.example.org", roots, time.Now()); err == nil || isClockError(err) {
+		t.Errorf("Expected wrong name to be invalid but not a clock error, got %v", err)
+	}
+	if err := verifyChainAt(nil, "example.com", roots, time.Now()); err == nil {
+		t.Errorf("Expected empty chain to be invalid")
+	}
+}
+
+func TestNow(t *testing.T) {
+	defer func() { clockOffset = 0 }()
+	clockOffset = int64(24 * time.Hour)
+	if skew := Now().Sub(time.Now()); skew < 23*time.Hour {
+		t.Errorf("Expected Now to be corrected by a day, was %v", skew)
+	}
+}
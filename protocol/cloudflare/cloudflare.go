@@ -0,0 +1,132 @@
+// package cloudflare implements the domain-fronting protocol for CloudFlare
+// (and CDNs that behave like it, such as Fastly).
+package cloudflare
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/tls"
+)
+
+const (
+	CF_PREFIX        = "Cf-"              // prefix of headers added by CloudFlare
+	CF_CONNECTING_IP = "Cf-Connecting-Ip" // header in which CloudFlare reports the client's IP
+	X_FORWARDED_FOR  = "X-Forwarded-For"
+)
+
+// CF_RANGES are the ranges from which CloudFlare connects to origins, as
+// published at https://www.cloudflare.com/ips/
+var CF_RANGES = protocol.MustParseIPRanges([]string{
+	"173.245.48.0/20",
+	"103.21.244.0/22",
+	"103.22.200.0/22",
+	"103.31.4.0/22",
+	"141.101.64.0/18",
+	"108.162.192.0/18",
+	"190.93.240.0/20",
+	"188.114.96.0/20",
+	"197.234.240.0/22",
+	"198.41.128.0/17",
+	"162.158.0.0/15",
+	"104.16.0.0/13",
+	"104.24.0.0/14",
+	"172.64.0.0/13",
+	"131.0.72.0/22",
+	"2400:cb00::/32",
+	"2606:4700::/32",
+	"2803:f800::/32",
+	"2405:b500::/32",
+	"2405:8100::/32",
+	"2a06:98c0::/29",
+	"2c0f:f248::/32",
+})
+
+type cloudFlareClientProtocol struct {
+	config       *protocol.ClientConfig
+	rootCAs      *x509.CertPool
+	sessionCache tls.ClientSessionCache
+}
+
+type cloudFlareServerProtocol struct {
+	trusted protocol.IPRanges
+}
+
+// NewClientProtocol creates a ClientProtocol for fronting via CloudFlare
+func NewClientProtocol(config *protocol.ClientConfig) (protocol.ClientProtocol, error) {
+	rootCAs, err := config.RootCAs()
+	if err != nil {
+		return nil, err
+	}
+	return &cloudFlareClientProtocol{
+		config:       config,
+		rootCAs:      rootCAs,
+		sessionCache: protocol.SessionCacheFor(config),
+	}, nil
+}
+
+// NewServerProtocol creates a ServerProtocol for requests fronted by
+// CloudFlare, which trusts the client IPs reported by requests from CF_RANGES
+func NewServerProtocol() protocol.ServerProtocol {
+	return NewServerProtocolTrusting(CF_RANGES)
+}
+
+// NewServerProtocolTrusting is like NewServerProtocol but trusts the client
+// IPs reported by requests from the given ranges instead, e.g. when CloudFlare
+// has published new ones or the server is behind a load balancer
+func NewServerProtocolTrusting(trusted protocol.IPRanges) protocol.ServerProtocol {
+	return &cloudFlareServerProtocol{trusted}
+}
+
+func (cp *cloudFlareClientProtocol) DialProxy(addr string) (net.Conn, error) {
+	return cp.config.DialServer(cp.dialHost)
+}
+
+func (cp *cloudFlareClientProtocol) Hosts() []string {
+	return cp.config.Hosts()
+}
+
+func (cp *cloudFlareClientProtocol) DialProxyVia(host string) (net.Conn, error) {
+	return cp.config.DialVia(cp.dialHost, host)
+}
+
+func (cp *cloudFlareClientProtocol) MarkFailed(host string) {
+	cp.config.MarkFailed(host)
+}
+
+func (cp *cloudFlareClientProtocol) dialHost(network string, host string) (net.Conn, error) {
+	// Note - we need to suppress the sending of the ServerName in the client
+	// handshake to make host-spoofing work with Fastly.  If the client Hello
+	// includes a server name, Fastly checks to make sure that this matches
+	// the Host header in the HTTP request and if they don't match, it
+	// returns a 400 Bad Request error.  The ServerName is still used for
+	// verifying the server's certificate.
+	tlsConfig := &tls.Config{
+		ClientSessionCache:                  cp.sessionCache,
+		SuppressServerNameInClientHandshake: true,
+		ServerName:                          host,
+		RootCAs:                             cp.rootCAs,
+	}
+	return cp.config.DialTLS(network, host, tlsConfig)
+}
+
+func (cp *cloudFlareClientProtocol) NewRequest(host string, method string, body io.Reader) (*http.Request, error) {
+	if host == "" {
+		host = cp.config.UpstreamHost
+	}
+	return http.NewRequest(method, "http://"+host+"/", body)
+}
+
+// RewriteRequest strips the headers added by CloudFlare, preserving the
+// client's IP as X-Forwarded-For.  A client that connects directly could send
+// Cf-Connecting-Ip itself, so it's only preserved if the request comes from
+// one of the trusted ranges.
+func (sp *cloudFlareServerProtocol) RewriteRequest(req *http.Request) {
+	if clientIP := req.Header.Get(CF_CONNECTING_IP); clientIP != "" && sp.trusted.ContainsAddr(req.RemoteAddr) {
+		req.Header.Set(X_FORWARDED_FOR, clientIP)
+	}
+	protocol.StripHeadersWithPrefix(req.Header, CF_PREFIX)
+}
@@ -0,0 +1,95 @@
+package cloudflare
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/flashlight/protocol"
+)
+
+func TestNewRequest(t *testing.T) {
+	cp, err := NewClientProtocol(&protocol.ClientConfig{UpstreamHost: "fl1.example.org", UpstreamPort: 443})
+	if err != nil {
+		t.Fatalf("Unable to create protocol: %s", err)
+	}
+	for _, test := range []struct {
+		host     string
+		method   string
+		expected string
+	}{
+		{"", "GET", "fl1.example.org"},
+		{"fl2.example.org", "POST", "fl2.example.org"},
+	} {
+		req, err := cp.NewRequest(test.host, test.method, nil)
+		if err != nil {
+			t.Fatalf("Unable to create request for %q: %s", test.host, err)
+		}
+		if req.Host != test.expected || req.URL.Host != test.expected || req.URL.Path != "/" || req.URL.Scheme != "http" {
+			t.Errorf("Request for %q went to %s (Host %s), expected http://%s/", test.host, req.URL, req.Host, test.expected)
+		}
+		if req.Method != test.method {
+			t.Errorf("Wrong method %s, expected %s", req.Method, test.method)
+		}
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	sp := NewServerProtocolTrusting(protocol.MustParseIPRanges([]string{"173.245.48.0/20"}))
+	for _, test := range []struct {
+		name         string
+		remoteAddr   string
+		header       http.Header
+		forwardedFor string
+		keptHeaders  []string
+	}{
+		{
+			name:         "from CloudFlare",
+			remoteAddr:   "173.245.48.10:443",
+			header:       http.Header{"Cf-Connecting-Ip": {"203.0.113.5"}, "Cf-Ray": {"abc"}, "Cf-Ipcountry": {"DE"}, "User-Agent": {"test"}},
+			forwardedFor: "203.0.113.5",
+			keptHeaders:  []string{"User-Agent"},
+		},
+		{
+			name:         "direct with forged Cf-Connecting-Ip",
+			remoteAddr:   "198.51.100.7:50000",
+			header:       http.Header{"Cf-Connecting-Ip": {"203.0.113.5"}, "Cf-Ray": {"abc"}},
+			forwardedFor: "",
+		},
+		{
+			name:         "from CloudFlare without client IP",
+			remoteAddr:   "173.245.48.10:443",
+			header:       http.Header{"Cf-Ray": {"abc"}},
+			forwardedFor: "",
+		},
+	} {
+		req, _ := http.NewRequest("GET", "http://fl1.example.org/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header = test.header
+		sp.RewriteRequest(req)
+		if got := req.Header.Get(X_FORWARDED_FOR); got != test.forwardedFor {
+			t.Errorf("%s: X-Forwarded-For is %q, expected %q", test.name, got, test.forwardedFor)
+		}
+		for name := range req.Header {
+			if strings.HasPrefix(name, CF_PREFIX) {
+				t.Errorf("%s: %s not stripped", test.name, name)
+			}
+		}
+		for _, name := range test.keptHeaders {
+			if req.Header.Get(name) == "" {
+				t.Errorf("%s: %s stripped", test.name, name)
+			}
+		}
+	}
+}
+
+func TestPublishedRanges(t *testing.T) {
+	sp := NewServerProtocol()
+	req, _ := http.NewRequest("GET", "http://fl1.example.org/", nil)
+	req.RemoteAddr = "[2606:4700::6810:1]:443"
+	req.Header.Set(CF_CONNECTING_IP, "203.0.113.5")
+	sp.RewriteRequest(req)
+	if req.Header.Get(X_FORWARDED_FOR) != "203.0.113.5" {
+		t.Errorf("Client IP from CloudFlare's published ranges not trusted")
+	}
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/getlantern/flashlight/pipe"
+)
+
+// Compress returns a connection that compresses what's written to it before
+// writing it to conn, and decompresses what's read from conn, using DEFLATE.
+// Every Write is flushed so that interactive traffic isn't held back.
+// CloseWrite ends the compressed stream, which the other end reads as EOF.
+// Clients use this on tunnels that they mark with EncodeCompressed.
+func Compress(conn net.Conn) net.Conn {
+	// BestSpeed since we're compressing on the fly, often on routers
+	writer, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &compressedConn{Conn: conn, writer: writer, reader: flate.NewReader(conn)}
+}
+
+// CompressedPipe returns a connection that decompresses what's written to it
+// before writing it to dest, and compresses what's read from dest.  It's the
+// server's end of a connection that a client wrapped with Compress.
+func CompressedPipe(dest net.Conn) net.Conn {
+	conn, ours := net.Pipe()
+	go pipe.Relay(Compress(ours), dest)
+	return conn
+}
+
+type compressedConn struct {
+	net.Conn
+	writer     *flate.Writer
+	writeMutex sync.Mutex
+	reader     io.ReadCloser
+}
+
+func (conn *compressedConn) Write(b []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	n, err := conn.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, conn.writer.Flush()
+}
+
+func (conn *compressedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// CloseWrite ends the compressed stream
+func (conn *compressedConn) CloseWrite() error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	return conn.writer.Close()
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	// client <-> tunnel <-> server end <-> echoing destination
+	dest, origin := net.Pipe()
+	go io.Copy(origin, origin)
+	serverEnd := CompressedPipe(dest)
+	clientEnd, tunnel := net.Pipe()
+	compressed := make(chan int64)
+	go func() {
+		n, _ := io.Copy(serverEnd, tunnel)
+		compressed <- n
+	}()
+	go io.Copy(tunnel, serverEnd)
+
+	conn := Compress(clientEnd)
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	go conn.Write(data)
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("Unable to read echo: %s", err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Errorf("Echo doesn't match")
+	}
+	conn.Close()
+	if n := <-compressed; n >= int64(len(data)) {
+		t.Errorf("Data wasn't compressed, %d bytes went through the tunnel", n)
+	}
+}
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_MAX_IDLE_PER_HOST = 1
+	DEFAULT_IDLE_CONN_TIMEOUT = 30 * time.Second // well below the idle timeouts of the CDNs that we front with
+)
+
+// ConnPool keeps warm (already dialed and TLS-handshaked) connections to the
+// hosts via which we reach the server, keyed by network and host.  Since
+// enproxy consumes the connections that it dials, connections aren't returned
+// to the pool.  Instead, whenever a connection to a host is taken, the pool
+// dials replacements in the background so that the next request via that host
+// doesn't have to wait for a dial.  Replacement dials use the protocol's TLS
+// session cache, so they're usually cheap resumptions.
+type ConnPool struct {
+	MaxIdlePerHost int           // (optional) maximum idle connections per host, defaults to DEFAULT_MAX_IDLE_PER_HOST
+	IdleTimeout    time.Duration // (optional) how long connections may sit idle before they're closed, defaults to DEFAULT_IDLE_CONN_TIMEOUT
+
+	idle    map[string][]*idleConn
+	dialing map[string]int
+	mutex   sync.Mutex
+}
+
+// idleConn is a connection waiting in a ConnPool
+type idleConn struct {
+	net.Conn
+	expires time.Time
+}
+
+// Get returns an idle connection for the given key if there is one, or dials
+// one using the given dial function otherwise, and then tops up the idle
+// connections for the key in the background.  It is safe to call on a nil
+// ConnPool, in which case it just dials.
+func (pool *ConnPool) Get(key string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if pool == nil {
+		return dial()
+	}
+	conn := pool.take(key)
+	go pool.fill(key, dial)
+	if conn != nil {
+		return conn, nil
+	}
+	return dial()
+}
+
+// take removes and returns an unexpired idle connection for the given key, or
+// nil if there is none
+func (pool *ConnPool) take(key string) net.Conn {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	conns := pool.idle[key]
+	for len(conns) > 0 {
+		conn := conns[0]
+		conns = conns[1:]
+		if time.Now().Before(conn.expires) {
+			pool.idle[key] = conns
+			return conn.Conn
+		}
+		conn.Close()
+	}
+	delete(pool.idle, key)
+	return nil
+}
+
+// fill dials connections for the given key until there are MaxIdlePerHost
+// idle or dialing
+func (pool *ConnPool) fill(key string, dial func() (net.Conn, error)) {
+	for {
+		pool.mutex.Lock()
+		if pool.idle == nil {
+			pool.idle = make(map[string][]*idleConn)
+			pool.dialing = make(map[string]int)
+		}
+		if len(pool.idle[key])+pool.dialing[key] >= pool.maxIdlePerHost() {
+			pool.mutex.Unlock()
+			return
+		}
+		pool.dialing[key]++
+		pool.mutex.Unlock()
+
+		conn, err := dial()
+
+		pool.mutex.Lock()
+		pool.dialing[key]--
+		if pool.dialing[key] == 0 {
+			delete(pool.dialing, key)
+		}
+		if err != nil {
+			pool.mutex.Unlock()
+			log.Debugf("Unable to dial idle connection for %s: %s", key, err)
+			return
+		}
+		ic := &idleConn{conn, time.Now().Add(pool.idleTimeout())}
+		pool.idle[key] = append(pool.idle[key], ic)
+		pool.mutex.Unlock()
+		time.AfterFunc(pool.idleTimeout(), func() {
+			pool.expire(key, ic)
+		})
+	}
+}
+
+// expire closes the given connection if it's still idle
+func (pool *ConnPool) expire(key string, expired *idleConn) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	conns := pool.idle[key]
+	for i, conn := range conns {
+		if conn == expired {
+			pool.idle[key] = append(conns[:i:i], conns[i+1:]...)
+			if len(pool.idle[key]) == 0 {
+				delete(pool.idle, key)
+			}
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (pool *ConnPool) maxIdlePerHost() int {
+	if pool.MaxIdlePerHost <= 0 {
+		return DEFAULT_MAX_IDLE_PER_HOST
+	}
+	return pool.MaxIdlePerHost
+}
+
+func (pool *ConnPool) idleTimeout() time.Duration {
+	if pool.IdleTimeout <= 0 {
+		return DEFAULT_IDLE_CONN_TIMEOUT
+	}
+	return pool.IdleTimeout
+}
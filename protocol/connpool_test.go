@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDialer dials net.Pipes, counting the dials
+type countingDialer struct {
+	dials int32
+}
+
+func (d *countingDialer) dial() (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestConnPoolReusesWarmConns(t *testing.T) {
+	d := &countingDialer{}
+	pool := &ConnPool{MaxIdlePerHost: 1, IdleTimeout: time.Minute}
+	conn, err := pool.Get("tcp host", d.dial)
+	if err != nil {
+		t.Fatalf("Unable to get conn: %s", err)
+	}
+	conn.Close()
+	// Wait for the pool to warm up
+	time.Sleep(50 * time.Millisecond)
+	if dials := atomic.LoadInt32(&d.dials); dials != 2 {
+		t.Fatalf("Expected 2 dials after first get, got %d", dials)
+	}
+	if pool.take("tcp host") == nil {
+		t.Error("Expected a warm conn")
+	}
+	if pool.take("tcp other") != nil {
+		t.Error("Shouldn't have a conn for another key")
+	}
+}
+
+func TestConnPoolExpiresIdleConns(t *testing.T) {
+	d := &countingDialer{}
+	pool := &ConnPool{MaxIdlePerHost: 2, IdleTimeout: 20 * time.Millisecond}
+	pool.fill("tcp host", d.dial)
+	if dials := atomic.LoadInt32(&d.dials); dials != 2 {
+		t.Fatalf("Expected 2 dials to fill pool, got %d", dials)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pool.take("tcp host") != nil {
+		t.Error("Idle conn should have expired")
+	}
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"net"
+	"strings"
+)
+
+const (
+	// HOP_SEPARATOR separates the hops in a multi-hop destination address.
+	// It can't appear in a host:port.
+	HOP_SEPARATOR = "|"
+
+	DEFAULT_HOP_PORT = "443"
+
+	// MEDIA_PREFIX marks a destination address for which the client asks the
+	// server to compress media (see package media).  It can't appear in a
+	// host:port.
+	MEDIA_PREFIX = "media+"
+
+	// COMPRESSED_PREFIX marks a destination address whose tunnel the client
+	// compresses (see Compress).  It can't appear in a host:port.
+	COMPRESSED_PREFIX = "deflate+"
+)
+
+// EncodeHops encodes a destination address that routes through the given
+// additional hops (host:port of flashlight servers) after the first server.
+// For example, hops [hop2:443] and addr origin:80 yield "hop2:443|origin:80",
+// which tells the first server to relay to hop2, which then dials origin.
+func EncodeHops(hops []string, addr string) string {
+	if len(hops) == 0 {
+		return addr
+	}
+	return strings.Join(hops, HOP_SEPARATOR) + HOP_SEPARATOR + addr
+}
+
+// NextHop splits a multi-hop destination address into the next hop and the
+// rest of the address.  ok is false if addr doesn't route through another hop.
+func NextHop(addr string) (hop string, rest string, ok bool) {
+	parts := strings.SplitN(addr, HOP_SEPARATOR, 2)
+	if len(parts) != 2 {
+		return "", addr, false
+	}
+	return parts[0], parts[1], true
+}
+
+// NormalizeHop adds DEFAULT_HOP_PORT to the given hop if it doesn't have a
+// port.
+func NormalizeHop(hop string) string {
+	if _, _, err := net.SplitHostPort(hop); err == nil {
+		return hop
+	}
+	return net.JoinHostPort(strings.Trim(hop, "[]"), DEFAULT_HOP_PORT)
+}
+
+// EncodeMedia marks the given destination address as one for which the
+// server should compress media
+func EncodeMedia(addr string) string {
+	return MEDIA_PREFIX + addr
+}
+
+// DecodeMedia strips the mark added by EncodeMedia from the given address,
+// indicating whether it was there
+func DecodeMedia(addr string) (string, bool) {
+	if strings.HasPrefix(addr, MEDIA_PREFIX) {
+		return addr[len(MEDIA_PREFIX):], true
+	}
+	return addr, false
+}
+
+// EncodeCompressed marks the given destination address as one whose tunnel is
+// compressed between the client and the first server
+func EncodeCompressed(addr string) string {
+	return COMPRESSED_PREFIX + addr
+}
+
+// DecodeCompressed strips the mark added by EncodeCompressed from the given
+// address, indicating whether it was there
+func DecodeCompressed(addr string) (string, bool) {
+	if strings.HasPrefix(addr, COMPRESSED_PREFIX) {
+		return addr[len(COMPRESSED_PREFIX):], true
+	}
+	return addr, false
+}
@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestHops(t *testing.T) {
+	addr := EncodeHops([]string{"hop2:443", "[::1]:8443"}, "origin.com:80")
+	hop, rest, ok := NextHop(addr)
+	if !ok || hop != "hop2:443" {
+		t.Fatalf("Wrong first hop: %s", hop)
+	}
+	hop, rest, ok = NextHop(rest)
+	if !ok || hop != "[::1]:8443" {
+		t.Fatalf("Wrong second hop: %s", hop)
+	}
+	if _, rest, ok = NextHop(rest); ok || rest != "origin.com:80" {
+		t.Errorf("Wrong final destination: %s", rest)
+	}
+	if EncodeHops(nil, "origin.com:80") != "origin.com:80" {
+		t.Error("No hops should leave the address alone")
+	}
+	if NormalizeHop("hop2") != "hop2:443" || NormalizeHop("::1") != "[::1]:443" {
+		t.Error("Hops without ports should default to 443")
+	}
+}
@@ -0,0 +1,284 @@
+package protocol
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxydialer"
+	"github.com/getlantern/flashlight/resolver"
+	"github.com/getlantern/tls"
+)
+
+const (
+	MASQUERADE_VERIFY_TIMEOUT    = 10 * time.Second
+	MASQUERADE_REVERIFY_INTERVAL = 1 * time.Hour
+	MASQUERADE_RETRY_MIN         = 5 * time.Second // first delay before re-verifying a failed host, doubled after each failure
+)
+
+// MasqueradePool is a pool of masquerade hosts.  Before a host is used, its
+// certificate chain is verified against the expected CDN CA.  Verified hosts
+// are handed out in round-robin fashion, and hosts that fail to dial are
+// taken out of rotation until they're verified again, which is retried with
+// exponential backoff starting at MASQUERADE_RETRY_MIN.  If no host is in
+// rotation, all candidates are handed out instead.
+type MasqueradePool struct {
+	candidates    []string
+	port          int
+	rootCAs       *x509.CertPool
+	resolver      *resolver.Resolver
+	upstreamProxy proxydialer.Dialer
+	generation    int // incremented whenever the candidates change
+	verified      []string
+	failed        map[string]bool // hosts being re-verified after failing
+	next          int
+	mutex         sync.Mutex
+	firstVerified chan bool
+	stop          chan bool
+	stopOnce      sync.Once
+	verifyHost    func(host string) error
+}
+
+// NewMasqueradePool creates a pool of the given candidate hosts, which will be
+// verified on the given port using the given CA pool (nil means use the
+// system's trusted roots).  Hosts are resolved with the given Resolver (nil
+// means use the OS resolver) and dialed through the given upstreamProxy (nil
+// means dial directly).  Verification starts immediately in the background.
+func NewMasqueradePool(candidates []string, port int, rootCAs *x509.CertPool, r *resolver.Resolver, upstreamProxy proxydialer.Dialer) *MasqueradePool {
+	pool := &MasqueradePool{
+		candidates:    candidates,
+		port:          port,
+		rootCAs:       rootCAs,
+		resolver:      r,
+		upstreamProxy: upstreamProxy,
+		failed:        make(map[string]bool),
+		firstVerified: make(chan bool),
+		stop:          make(chan bool),
+	}
+	pool.verifyHost = pool.verify
+	go pool.verifyPeriodically()
+	return pool
+}
+
+// Stop stops verifying the candidates periodically
+func (pool *MasqueradePool) Stop() {
+	pool.stopOnce.Do(func() {
+		close(pool.stop)
+	})
+}
+
+// Next returns the next verified masquerade host, waiting for the first
+// verification pass to finish if necessary.
+func (pool *MasqueradePool) Next() (string, error) {
+	hosts, err := pool.NextN(1)
+	if err != nil {
+		return "", err
+	}
+	return hosts[0], nil
+}
+
+// NextN returns up to n distinct verified masquerade hosts, starting with the
+// next one in rotation.  If none are verified, it returns candidates instead.
+func (pool *MasqueradePool) NextN(n int) ([]string, error) {
+	<-pool.firstVerified
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	rotation := pool.verified
+	if len(rotation) == 0 {
+		rotation = pool.candidates
+		if len(rotation) == 0 {
+			return nil, fmt.Errorf("No masquerade hosts available")
+		}
+		log.Debugf("No verified masquerade hosts, falling back to all %d candidates", len(rotation))
+	}
+	if n > len(rotation) {
+		n = len(rotation)
+	}
+	hosts := make([]string, n)
+	for i := 0; i < n; i++ {
+		hosts[i] = rotation[(pool.next+i)%len(rotation)]
+	}
+	pool.next += 1
+	return hosts, nil
+}
+
+// MarkFailed takes the given host out of rotation until it is verified again
+func (pool *MasqueradePool) MarkFailed(host string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for i, verified := range pool.verified {
+		if verified == host {
+			pool.verified = append(pool.verified[:i], pool.verified[i+1:]...)
+			log.Debugf("Masquerade host %s failed, %d hosts left in rotation", host, len(pool.verified))
+			if !pool.failed[host] {
+				pool.failed[host] = true
+				go pool.reverify(host, pool.generation)
+			}
+			return
+		}
+	}
+}
+
+// reverify verifies the given failed host again with exponential backoff,
+// putting it back in rotation once it passes.  It gives up when the
+// candidates change or the pool is stopped.
+func (pool *MasqueradePool) reverify(host string, generation int) {
+	defer crash.Recover()
+	defer func() {
+		pool.mutex.Lock()
+		delete(pool.failed, host)
+		pool.mutex.Unlock()
+	}()
+	backoff := MASQUERADE_RETRY_MIN
+	for {
+		select {
+		case <-pool.stop:
+			return
+		case <-time.After(backoff):
+		}
+		pool.mutex.Lock()
+		current := pool.generation == generation && !contains(pool.verified, host)
+		pool.mutex.Unlock()
+		if !current {
+			// Changed candidates or a full verification pass took over
+			return
+		}
+		err := pool.verifyHost(host)
+		if err == nil {
+			pool.restore(host, generation)
+			return
+		}
+		backoff *= 2
+		if backoff > MASQUERADE_REVERIFY_INTERVAL {
+			backoff = MASQUERADE_REVERIFY_INTERVAL
+		}
+		log.Debugf("Unable to re-verify masquerade host %s, retrying in %v: %s", host, backoff, err)
+	}
+}
+
+// restore puts the given re-verified host back in rotation, keeping the
+// verified hosts in the candidates' order
+func (pool *MasqueradePool) restore(host string, generation int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.generation != generation || contains(pool.verified, host) {
+		return
+	}
+	var verified []string
+	for _, candidate := range pool.candidates {
+		if candidate == host || contains(pool.verified, candidate) {
+			verified = append(verified, candidate)
+		}
+	}
+	pool.verified = verified
+	log.Debugf("Masquerade host %s re-verified, %d hosts in rotation", host, len(pool.verified))
+}
+
+// Candidates returns all candidate hosts, verified or not
+func (pool *MasqueradePool) Candidates() []string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.candidates
+}
+
+// SetCandidates replaces the candidate hosts and verifies them in the
+// background.  Until they're verified, the currently verified hosts stay in
+// rotation, so that connections aren't interrupted.
+func (pool *MasqueradePool) SetCandidates(candidates []string) {
+	pool.mutex.Lock()
+	pool.candidates = candidates
+	pool.generation++
+	pool.mutex.Unlock()
+	go pool.verifyAll()
+}
+
+func (pool *MasqueradePool) verifyPeriodically() {
+	defer crash.Recover()
+	func() {
+		// Even if verifying panics, don't leave NextN waiting
+		defer close(pool.firstVerified)
+		pool.verifyAll()
+	}()
+	for {
+		select {
+		case <-pool.stop:
+			return
+		case <-time.After(MASQUERADE_REVERIFY_INTERVAL):
+		}
+		pool.verifyAll()
+	}
+}
+
+// verifyAll verifies all candidates concurrently, replacing the list of
+// verified hosts with those that passed (in their original order).
+func (pool *MasqueradePool) verifyAll() {
+	pool.mutex.Lock()
+	candidates := pool.candidates
+	generation := pool.generation
+	pool.mutex.Unlock()
+	results := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		go func(i int, candidate string) {
+			defer wg.Done()
+			err := pool.verifyHost(candidate)
+			if err != nil {
+				log.Errorf("Unable to verify masquerade host %s: %s", candidate, err)
+				return
+			}
+			results[i] = true
+		}(i, candidate)
+	}
+	wg.Wait()
+
+	var verified []string
+	for i, candidate := range candidates {
+		if results[i] {
+			verified = append(verified, candidate)
+		}
+	}
+	log.Debugf("Verified %d of %d masquerade hosts", len(verified), len(candidates))
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.generation != generation {
+		// The candidates changed while we were verifying them
+		return
+	}
+	pool.verified = verified
+}
+
+// verify checks that the given host presents a certificate for itself that
+// chains up to the expected CA.
+func (pool *MasqueradePool) verify(host string) error {
+	conn, err := dialTLS(
+		pool.resolver,
+		pool.upstreamProxy,
+		"tcp",
+		net.JoinHostPort(host, strconv.Itoa(pool.port)),
+		&tls.Config{
+			ServerName: host,
+			RootCAs:    pool.rootCAs,
+		},
+		MASQUERADE_VERIFY_TIMEOUT,
+		nil)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// contains indicates whether the given hosts include host
+func contains(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMasqueradeFailover(t *testing.T) {
+	pool := &MasqueradePool{
+		candidates:    []string{"m1.example.org", "m2.example.org", "m3.example.org"},
+		verified:      []string{"m1.example.org", "m2.example.org"},
+		failed:        make(map[string]bool),
+		firstVerified: make(chan bool),
+		stop:          make(chan bool),
+		verifyHost: func(host string) error {
+			return nil
+		},
+	}
+	close(pool.firstVerified)
+	defer pool.Stop()
+
+	pool.MarkFailed("m1.example.org")
+	if hosts, _ := pool.NextN(3); !reflect.DeepEqual(hosts, []string{"m2.example.org"}) {
+		t.Errorf("Expected only m2 in rotation, got %v", hosts)
+	}
+	if !pool.failed["m1.example.org"] {
+		t.Errorf("m1 should be re-verified")
+	}
+
+	pool.MarkFailed("m2.example.org")
+	hosts, err := pool.NextN(3)
+	if err != nil || len(hosts) != 3 {
+		t.Errorf("With every host failed, expected all candidates, got %v: %s", hosts, err)
+	}
+
+	pool.restore("m2.example.org", pool.generation)
+	pool.restore("m1.example.org", pool.generation)
+	if !reflect.DeepEqual(pool.verified, []string{"m1.example.org", "m2.example.org"}) {
+		t.Errorf("Re-verified hosts should be back in their original order, got %v", pool.verified)
+	}
+
+	pool.MarkFailed("m1.example.org")
+	pool.generation++
+	pool.restore("m1.example.org", pool.generation-1)
+	if contains(pool.verified, "m1.example.org") {
+		t.Errorf("Hosts verified for old candidates shouldn't be restored")
+	}
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	NETWORK_POLL_INTERVAL = 2 * time.Second
+)
+
+// NetworkMonitor watches the local interface addresses and closes tracked
+// connections whose local address has disappeared, as happens when a mobile
+// device hands off between networks.
+//
+// This isn't connection migration: nothing is resumed on the new network.
+// Closing dead proxy connections promptly just means that new requests (and
+// enproxy's next request for an existing tunnel) get redialed over the new
+// network right away, instead of hanging until the OS times out the old
+// connection.  Data that was in flight on a closed connection is lost, so
+// long downloads and websockets that were mid-transfer generally fail and
+// have to be retried by the application.  Surviving a handoff without that
+// would need a transport that can resume streams, like QUIC.
+type NetworkMonitor struct {
+	conns      map[*trackedConn]bool
+	connsMutex sync.Mutex
+	connected  int32 // 1 if the latest dial succeeded
+	stop       chan bool
+	stopOnce   sync.Once
+}
+
+// trackedConn is a net.Conn that's tracked by a NetworkMonitor
+type trackedConn struct {
+	net.Conn
+	monitor   *NetworkMonitor
+	localIP   string
+	closeOnce sync.Once
+}
+
+// migratingProtocol is a ClientProtocol whose connections are tracked by a
+// NetworkMonitor
+type migratingProtocol struct {
+	ClientProtocol
+	monitor *NetworkMonitor
+}
+
+// NewNetworkMonitor creates a NetworkMonitor and starts polling
+func NewNetworkMonitor() *NetworkMonitor {
+	monitor := &NetworkMonitor{
+		conns: make(map[*trackedConn]bool),
+		stop:  make(chan bool),
+	}
+	go monitor.poll()
+	return monitor
+}
+
+// Stop stops polling.  Tracked connections stay open.
+func (monitor *NetworkMonitor) Stop() {
+	monitor.stopOnce.Do(func() {
+		close(monitor.stop)
+	})
+}
+
+// Migrating wraps the given ClientProtocol so that its connections are
+// tracked by this NetworkMonitor.
+func (monitor *NetworkMonitor) Migrating(cp ClientProtocol) ClientProtocol {
+	return &migratingProtocol{cp, monitor}
+}
+
+func (cp *migratingProtocol) DialProxy(addr string) (net.Conn, error) {
+	conn, err := cp.ClientProtocol.DialProxy(addr)
+	if err != nil {
+		atomic.StoreInt32(&cp.monitor.connected, 0)
+		return nil, err
+	}
+	atomic.StoreInt32(&cp.monitor.connected, 1)
+	return cp.monitor.track(conn), nil
+}
+
+// Connected indicates whether the latest dial through one of our protocols
+// succeeded.  It's false until the first dial.
+func (monitor *NetworkMonitor) Connected() bool {
+	return atomic.LoadInt32(&monitor.connected) == 1
+}
+
+func (monitor *NetworkMonitor) track(conn net.Conn) net.Conn {
+	localIP := ""
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP.String()
+	}
+	tc := &trackedConn{
+		Conn:    conn,
+		monitor: monitor,
+		localIP: localIP,
+	}
+	monitor.connsMutex.Lock()
+	monitor.conns[tc] = true
+	monitor.connsMutex.Unlock()
+	return tc
+}
+
+func (conn *trackedConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		conn.monitor.connsMutex.Lock()
+		delete(conn.monitor.conns, conn)
+		conn.monitor.connsMutex.Unlock()
+		err = conn.Conn.Close()
+	})
+	return err
+}
+
+func (monitor *NetworkMonitor) poll() {
+	defer crash.Recover()
+	for {
+		select {
+		case <-monitor.stop:
+			return
+		case <-time.After(NETWORK_POLL_INTERVAL):
+		}
+		localIPs, err := currentLocalIPs()
+		if err != nil {
+			log.Debugf("Unable to determine local addresses: %s", err)
+			continue
+		}
+		if closed := monitor.closeStale(localIPs); closed > 0 {
+			log.Debugf("Local network changed, closed %d proxy connections so that they can be redialed", closed)
+		}
+	}
+}
+
+// closeStale closes the tracked connections whose local IP isn't among the
+// given localIPs, returning how many it closed
+func (monitor *NetworkMonitor) closeStale(localIPs map[string]bool) int {
+	var stale []*trackedConn
+	monitor.connsMutex.Lock()
+	for conn := range monitor.conns {
+		if conn.localIP != "" && !localIPs[conn.localIP] {
+			stale = append(stale, conn)
+		}
+	}
+	monitor.connsMutex.Unlock()
+	for _, conn := range stale {
+		conn.Close()
+	}
+	return len(stale)
+}
+
+// currentLocalIPs returns the set of IPs currently assigned to local
+// interfaces
+func currentLocalIPs() (map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make(map[string]bool)
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips[ipNet.IP.String()] = true
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// dialingProtocol is a ClientProtocol that dials addr directly
+type dialingProtocol struct {
+	addr string
+}
+
+func (cp *dialingProtocol) DialProxy(addr string) (net.Conn, error) {
+	return net.Dial("tcp", cp.addr)
+}
+
+func (cp *dialingProtocol) NewRequest(host string, method string, body io.Reader) (*http.Request, error) {
+	return http.NewRequest(method, "http://"+host+"/", body)
+}
+
+func TestNetworkMonitorClosesConnsOnAddressChange(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// Not started with NewNetworkMonitor, so that we control the local IPs
+	monitor := &NetworkMonitor{conns: make(map[*trackedConn]bool)}
+	cp := monitor.Migrating(&dialingProtocol{l.Addr().String()})
+	conn, err := cp.DialProxy("")
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	if !monitor.Connected() {
+		t.Errorf("Should be connected after a successful dial")
+	}
+
+	if closed := monitor.closeStale(map[string]bool{"127.0.0.1": true}); closed != 0 {
+		t.Errorf("Closed %d connections although the local address didn't change", closed)
+	}
+	if _, err := conn.Write([]byte("a")); err != nil {
+		t.Fatalf("Connection unusable although the local address didn't change: %s", err)
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("Unable to read echo: %s", err)
+	}
+
+	// The device moved to another network, 127.0.0.1 is gone
+	if closed := monitor.closeStale(map[string]bool{"192.0.2.10": true}); closed != 1 {
+		t.Errorf("Closed %d connections after the local address changed, expected 1", closed)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(b); err == nil {
+		t.Errorf("Connection still open after the local address changed")
+	}
+	if len(monitor.conns) != 0 {
+		t.Errorf("Closed connection still tracked")
+	}
+
+	// A redial gets a fresh, tracked connection
+	redialed, err := cp.DialProxy("")
+	if err != nil {
+		t.Fatalf("Unable to redial: %s", err)
+	}
+	defer redialed.Close()
+	if len(monitor.conns) != 1 {
+		t.Errorf("Redialed connection not tracked")
+	}
+}
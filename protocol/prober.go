@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_PROBE_INTERVAL = 5 * time.Minute
+)
+
+// ProbeResult summarizes the probes of a server via a specific protocol and
+// host (masquerade or upstream)
+type ProbeResult struct {
+	Server    string    `json:"server"`
+	Protocol  string    `json:"protocol"`
+	Via       string    `json:"via,omitempty"`
+	Probes    int       `json:"probes"`
+	Successes int       `json:"successes"`
+	RTTMillis int64     `json:"rttms"`    // moving average of successful probes, including the dial
+	Tampered  int       `json:"tampered"` // probes whose Canary came back with unexpected content
+	LastError string    `json:"lasterror,omitempty"`
+	LastProbe time.Time `json:"lastprobe"`
+}
+
+// TestResult is the outcome of a single probe of a server via a specific
+// protocol and host, see Prober.Test
+type TestResult struct {
+	Server    string `json:"server"`
+	Protocol  string `json:"protocol"`
+	Via       string `json:"via,omitempty"`
+	OK        bool   `json:"ok"`
+	RTTMillis int64  `json:"rttms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// probeTarget is something that a Prober probes
+type probeTarget struct {
+	result *ProbeResult
+	cp     ClientProtocol
+	dial   func() (net.Conn, error)
+}
+
+// Prober periodically probes servers by making lightweight requests through
+// each of their protocols and, for protocols that are HostDialers, through
+// each host.  With a Canary, it also checks that content fetched through each
+// of them isn't tampered with.  Hosts that tamper with it are taken out of
+// rotation, and the probe fails with a TamperingError.
+type Prober struct {
+	Interval time.Duration // (optional) how frequently to probe, defaults to DEFAULT_PROBE_INTERVAL
+	Canary   *Canary       // (optional) resource to fetch through each server to detect tampering
+	Header   http.Header   // (optional) headers to add to probe requests, e.g. the tokens without which servers don't advertise anything
+
+	// OnProbe (optional) is called with the outcome of every probe
+	OnProbe func(server string, rtt time.Duration, err error)
+
+	// OnAdvertised (optional) is called with the response header of every
+	// successful probe, in which servers advertise things like their egress
+	// policy
+	OnAdvertised func(server string, header http.Header)
+
+	targets []*probeTarget
+	mutex   sync.Mutex
+	stop    chan bool
+}
+
+// Add adds targets for reaching the given server with the given protocol.  It
+// is safe to call on a nil Prober, in which case it does nothing.
+func (prober *Prober) Add(server string, protocolName string, cp ClientProtocol) {
+	if prober == nil {
+		return
+	}
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+	hd, ok := cp.(HostDialer)
+	if !ok {
+		prober.targets = append(prober.targets, &probeTarget{
+			result: &ProbeResult{Server: server, Protocol: protocolName},
+			cp:     cp,
+			dial: func() (net.Conn, error) {
+				return cp.DialProxy("")
+			},
+		})
+		return
+	}
+	for _, host := range hd.Hosts() {
+		host := host
+		prober.targets = append(prober.targets, &probeTarget{
+			result: &ProbeResult{Server: server, Protocol: protocolName, Via: host},
+			cp:     cp,
+			dial: func() (net.Conn, error) {
+				return hd.DialProxyVia(host)
+			},
+		})
+	}
+}
+
+// ReplaceTargets replaces this Prober's targets with those added to other,
+// which isn't used otherwise.  This is for switching to different servers
+// while running.  It is safe to call on a nil Prober.
+func (prober *Prober) ReplaceTargets(other *Prober) {
+	if prober == nil {
+		return
+	}
+	other.mutex.Lock()
+	targets := other.targets
+	other.mutex.Unlock()
+	prober.mutex.Lock()
+	prober.targets = targets
+	prober.mutex.Unlock()
+}
+
+// Start starts probing in the background, until Stop
+func (prober *Prober) Start() {
+	if prober.Interval <= 0 {
+		prober.Interval = DEFAULT_PROBE_INTERVAL
+	}
+	stop := make(chan bool)
+	prober.mutex.Lock()
+	prober.stop = stop
+	prober.mutex.Unlock()
+	go func() {
+		defer crash.Recover()
+		for {
+			prober.probeAll()
+			select {
+			case <-stop:
+				return
+			case <-time.After(prober.Interval):
+			}
+		}
+	}()
+}
+
+// Stop stops probing.  It is safe to call on a nil or stopped Prober.
+func (prober *Prober) Stop() {
+	if prober == nil {
+		return
+	}
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+	if prober.stop != nil {
+		close(prober.stop)
+		prober.stop = nil
+	}
+}
+
+// Results returns a snapshot of the probe results.  It is safe to call on a
+// nil Prober.
+func (prober *Prober) Results() []*ProbeResult {
+	if prober == nil {
+		return nil
+	}
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+	results := make([]*ProbeResult, len(prober.targets))
+	for i, target := range prober.targets {
+		result := *target.result
+		results[i] = &result
+	}
+	return results
+}
+
+// Test probes all targets once, right away, and returns the outcome for each.
+// The probes count towards the Results like the periodic ones.  It is safe to
+// call on a nil Prober, in which case there are no results.
+func (prober *Prober) Test() []*TestResult {
+	if prober == nil {
+		return nil
+	}
+	return prober.probeAll()
+}
+
+// probeAll probes all targets concurrently and returns the outcomes
+func (prober *Prober) probeAll() []*TestResult {
+	prober.mutex.Lock()
+	targets := prober.targets
+	prober.mutex.Unlock()
+
+	results := make([]*TestResult, len(targets))
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	for i, target := range targets {
+		go func(i int, target *probeTarget) {
+			defer wg.Done()
+			rtt, header, err := probeVia(target.cp, target.dial, prober.Header)
+			if err == nil && prober.Canary != nil {
+				err = prober.checkCanary(target)
+			}
+			prober.record(target, rtt, err)
+			if prober.OnProbe != nil {
+				prober.OnProbe(target.result.Server, rtt, err)
+			}
+			if err == nil && prober.OnAdvertised != nil {
+				prober.OnAdvertised(target.result.Server, header)
+			}
+			result := &TestResult{Server: target.result.Server, Protocol: target.result.Protocol, Via: target.result.Via, OK: err == nil}
+			if err == nil {
+				result.RTTMillis = int64(rtt / time.Millisecond)
+			} else {
+				result.Error = err.Error()
+			}
+			results[i] = result
+		}(i, target)
+	}
+	wg.Wait()
+	return results
+}
+
+// checkCanary fetches the Canary via the given target, returning a
+// TamperingError if it was tampered with.  Failures to fetch it at all are
+// already covered by the regular probe, so they're only logged.
+func (prober *Prober) checkCanary(target *probeTarget) error {
+	err := prober.Canary.check(target.cp, target.dial)
+	if err == nil {
+		return nil
+	}
+	result := target.result
+	if _, tampered := err.(*TamperingError); !tampered {
+		log.Debugf("Unable to check canary via %s/%s/%s: %s", result.Server, result.Protocol, result.Via, err)
+		return nil
+	}
+	log.Errorf("Canary via %s/%s/%s failed, possible tampering: %s", result.Server, result.Protocol, result.Via, err)
+	if hd, ok := target.cp.(HostDialer); ok && result.Via != "" {
+		hd.MarkFailed(result.Via)
+	}
+	return err
+}
+
+func (prober *Prober) record(target *probeTarget, rtt time.Duration, err error) {
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+	result := target.result
+	result.Probes += 1
+	result.LastProbe = time.Now()
+	if err != nil {
+		if _, tampered := err.(*TamperingError); tampered {
+			result.Tampered += 1
+		}
+		log.Debugf("Probe of %s via %s/%s failed: %s", result.Server, result.Protocol, result.Via, err)
+		result.LastError = err.Error()
+		return
+	}
+	result.Successes += 1
+	result.LastError = ""
+	rttMillis := int64(rtt / time.Millisecond)
+	if result.Successes == 1 {
+		result.RTTMillis = rttMillis
+	} else {
+		result.RTTMillis = int64(LATENCY_SMOOTHING*float64(rttMillis) + (1-LATENCY_SMOOTHING)*float64(result.RTTMillis))
+	}
+}
@@ -0,0 +1,337 @@
+// package protocol defines the interfaces implemented by the domain-fronting
+// protocols that flashlight supports, along with configuration and helpers
+// that are shared among them.
+package protocol
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/identity"
+	"github.com/getlantern/flashlight/proxydialer"
+	"github.com/getlantern/flashlight/resolver"
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/tls"
+)
+
+const (
+	DIAL_TIMEOUT      = 20 * time.Second
+	KEEP_ALIVE_PERIOD = 70 * time.Second
+
+	PHASE_DIAL = "dial" // connecting to the fronting provider (or UpstreamProxy)
+	PHASE_TLS  = "tls"  // the TLS handshake with the fronting provider
+)
+
+// ClientProtocol is the client side of a fronting protocol.  It knows how to
+// reach the flashlight server through a specific fronting provider (CDN).
+type ClientProtocol interface {
+	// DialProxy dials the fronting provider.  The addr is ignored in favor of
+	// the configured upstream/masquerade host.
+	DialProxy(addr string) (net.Conn, error)
+
+	// NewRequest creates a new request destined for the flashlight server via
+	// the fronting provider.
+	NewRequest(host string, method string, body io.Reader) (*http.Request, error)
+}
+
+// HostDialer is implemented by ClientProtocols that can dial the fronting
+// provider via a specific host (masquerade or upstream), which allows probing
+// each of them.
+type HostDialer interface {
+	// Hosts returns the hosts via which the protocol may dial
+	Hosts() []string
+
+	// DialProxyVia dials the fronting provider via the given host
+	DialProxyVia(host string) (net.Conn, error)
+
+	// MarkFailed takes the given host out of rotation if it's a masquerade
+	MarkFailed(host string)
+}
+
+// ServerProtocol is the server side of a fronting protocol.  It cleans up
+// requests that arrived via a specific fronting provider.
+type ServerProtocol interface {
+	// RewriteRequest rewrites an inbound request before it gets handled by
+	// the server proxy.
+	RewriteRequest(req *http.Request)
+}
+
+// ClientConfig is the configuration shared by all ClientProtocols
+type ClientConfig struct {
+	UpstreamHost  string             // FQDN of flashlight server
+	UpstreamPort  int                // port on which to connect to the server
+	Masquerades   *MasqueradePool    // (optional) hosts to actually dial in place of UpstreamHost
+	RootCA        string             // (optional) PEM encoded CA cert to which to pin
+	ServerPins    []string           // (optional) identity.Fingerprints of the server's public key, checked when dialing the server itself (without masquerades)
+	ClientCert    *tls.Certificate   // (optional) certificate to present when dialing the server itself, for servers that require one (see package clientauth)
+	ParallelDials int                // (optional) number of masquerades to dial concurrently, defaults to 1
+	IPVersion     string             // (optional) "4" or "6" to prefer dialing over IPv4 or IPv6, defaults to auto
+	Resolver      *resolver.Resolver // (optional) resolver for hostnames, defaults to the OS resolver
+	UpstreamProxy proxydialer.Dialer // (optional) proxy (e.g. a corporate proxy) through which to dial the server and masquerades
+	Pool          *ConnPool          // (optional) pool of warm connections to use for DialServer
+
+	// SessionCache (optional) caches TLS sessions so that dials resume them
+	// rather than doing full handshakes, defaults to a cache per protocol
+	SessionCache tls.ClientSessionCache
+
+	// OnTiming (optional) is called with how long each phase (PHASE_DIAL and
+	// PHASE_TLS) of successfully dialing a host took, e.g. for latency
+	// metrics
+	OnTiming Timing
+}
+
+// Timing is called with how long the given phase of dialing host took
+type Timing func(phase string, elapsed time.Duration, host string)
+
+// DialServer dials the server using the given dialHost function, which dials
+// a specific host on the given network (including the TLS handshake).  If
+// there are masquerades, it dials up to ParallelDials of them concurrently
+// ("happy eyeballs") and returns whichever connection succeeds first, closing
+// the others.  Connections come from the Pool, if configured.
+func (config *ClientConfig) DialServer(dialHost func(network string, host string) (net.Conn, error)) (net.Conn, error) {
+	hosts, err := config.nextHosts()
+	if err != nil {
+		return nil, err
+	}
+	if config.Pool != nil {
+		dialHost = config.pooled(dialHost)
+	}
+
+	results := make(chan *dialResult, len(hosts))
+	for _, host := range hosts {
+		go func(host string) {
+			conn, err := config.dialPreferringIPVersion(dialHost, host)
+			results <- &dialResult{conn, host, err}
+		}(host)
+	}
+
+	var lastErr error
+	for remaining := len(hosts); remaining > 0; remaining-- {
+		result := <-results
+		if result.err == nil {
+			go config.closeLosers(results, remaining-1)
+			return result.conn, nil
+		}
+		config.MarkFailed(result.host)
+		lastErr = result.err
+	}
+	return nil, lastErr
+}
+
+// DialVia dials the given host using the given dialHost function, preferring
+// the configured IP version.  Unlike DialServer, it doesn't take failing
+// masquerades out of rotation.
+func (config *ClientConfig) DialVia(dialHost func(network string, host string) (net.Conn, error), host string) (net.Conn, error) {
+	return config.dialPreferringIPVersion(dialHost, host)
+}
+
+// Hosts returns all hosts via which we might reach the server, which are the
+// masquerade candidates or, if there are no masquerades, the UpstreamHost.
+func (config *ClientConfig) Hosts() []string {
+	if config.Masquerades == nil {
+		return []string{config.UpstreamHost}
+	}
+	return config.Masquerades.Candidates()
+}
+
+// DialTLS dials the given host on the given network and performs a TLS
+// handshake using the given tls.Config, which should specify the host as its
+// ServerName.
+func (config *ClientConfig) DialTLS(network string, host string, tlsConfig *tls.Config) (net.Conn, error) {
+	if config.ClientCert != nil && host == config.UpstreamHost {
+		// Fronts terminate TLS, so only the server itself would see it
+		tlsConfig.Certificates = []tls.Certificate{*config.ClientCert}
+	}
+	conn, err := dialTLS(config.Resolver, config.UpstreamProxy, network, config.AddressFor(host), tlsConfig, DIAL_TIMEOUT, config.OnTiming)
+	if err != nil || len(config.ServerPins) == 0 || host != config.UpstreamHost {
+		// Masquerades present the front's certificate, not the server's
+		return conn, err
+	}
+	if err := checkPins(conn, config.ServerPins); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// checkPins checks that the peer of the given TLS connection presented a
+// certificate with one of the given identity.Fingerprints
+func checkPins(conn net.Conn, pins []string) error {
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("No certificates presented")
+	}
+	return identity.CheckPins(certs[0], pins)
+}
+
+// dialTLS dials addr over TLS, as handshakeTLS does, validating certificates
+// as of Now and, if the handshake fails because our clock is skewed, retrying
+// after syncing it (see SyncClock)
+func dialTLS(r *resolver.Resolver, upstreamProxy proxydialer.Dialer, network string, addr string, tlsConfig *tls.Config, timeout time.Duration, onTiming Timing) (net.Conn, error) {
+	tlsConfig.Time = Now
+	offsetBefore := int64(ClockOffset())
+	conn, err := handshakeTLS(r, upstreamProxy, network, addr, tlsConfig, timeout, onTiming)
+	if err != nil && syncClockAfter(err, offsetBefore, r, upstreamProxy, network, addr, tlsConfig) {
+		return handshakeTLS(r, upstreamProxy, network, addr, tlsConfig, timeout, onTiming)
+	}
+	return conn, err
+}
+
+// handshakeTLS dials addr over TLS, resolving the host using the given
+// Resolver (if not nil).  If upstreamProxy is not nil, it dials through that
+// instead and leaves resolving the host to the proxy.  The tlsConfig must
+// specify the ServerName.  If onTiming isn't nil, it's called with how long
+// dialing and the handshake took.
+func handshakeTLS(r *resolver.Resolver, upstreamProxy proxydialer.Dialer, network string, addr string, tlsConfig *tls.Config, timeout time.Duration, onTiming Timing) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: KEEP_ALIVE_PERIOD,
+	}
+	start := time.Now()
+	var rawConn net.Conn
+	var err error
+	switch {
+	case upstreamProxy != nil:
+		rawConn, err = upstreamProxy(network, addr)
+	case r != nil:
+		rawConn, err = r.Dial(dialer, network, addr)
+	default:
+		rawConn, err = dialer.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dialed := time.Now()
+	rawConn.SetDeadline(dialed.Add(timeout))
+	conn := tls.Client(rawConn, tlsConfig)
+	err = conn.Handshake()
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	rawConn.SetDeadline(time.Time{})
+	recordHandshake(conn, tlsConfig.ServerName)
+	if onTiming != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		onTiming(PHASE_DIAL, dialed.Sub(start), host)
+		onTiming(PHASE_TLS, time.Now().Sub(dialed), host)
+	}
+	return conn, nil
+}
+
+// pooled wraps the given dialHost function to get connections from our Pool
+func (config *ClientConfig) pooled(dialHost func(network string, host string) (net.Conn, error)) func(network string, host string) (net.Conn, error) {
+	return func(network string, host string) (net.Conn, error) {
+		return config.Pool.Get(network+" "+host, func() (net.Conn, error) {
+			return dialHost(network, host)
+		})
+	}
+}
+
+// dialPreferringIPVersion dials the given host using the preferred IP version
+// first and falling back to the other IP version.
+func (config *ClientConfig) dialPreferringIPVersion(dialHost func(network string, host string) (net.Conn, error), host string) (net.Conn, error) {
+	var networks []string
+	switch config.IPVersion {
+	case "4":
+		networks = []string{"tcp4", "tcp6"}
+	case "6":
+		networks = []string{"tcp6", "tcp4"}
+	default:
+		networks = []string{"tcp"}
+	}
+	var err error
+	for _, network := range networks {
+		var conn net.Conn
+		conn, err = dialHost(network, host)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialResult is the result of dialing a specific host
+type dialResult struct {
+	conn net.Conn
+	host string
+	err  error
+}
+
+// nextHosts returns the hosts to dial for reaching the server, which are
+// either the next masquerade hosts or, if there are no masquerades, the
+// UpstreamHost.
+func (config *ClientConfig) nextHosts() ([]string, error) {
+	if config.Masquerades == nil {
+		return []string{config.UpstreamHost}, nil
+	}
+	parallelDials := config.ParallelDials
+	if parallelDials < 1 {
+		parallelDials = 1
+	}
+	return config.Masquerades.NextN(parallelDials)
+}
+
+// closeLosers closes the connections that lost the race in DialServer
+func (config *ClientConfig) closeLosers(results chan *dialResult, count int) {
+	for i := 0; i < count; i++ {
+		result := <-results
+		if result.err != nil {
+			config.MarkFailed(result.host)
+		} else {
+			result.conn.Close()
+		}
+	}
+}
+
+// AddressFor returns the address to dial for reaching the server at the given
+// host
+func (config *ClientConfig) AddressFor(host string) string {
+	return net.JoinHostPort(host, strconv.Itoa(config.UpstreamPort))
+}
+
+// MarkFailed takes the given host out of rotation if it's a masquerade
+func (config *ClientConfig) MarkFailed(host string) {
+	if config.Masquerades != nil {
+		config.Masquerades.MarkFailed(host)
+	}
+}
+
+// RootCAs returns a pool containing the configured RootCA, or nil if no
+// RootCA was configured.
+func (config *ClientConfig) RootCAs() (*x509.CertPool, error) {
+	if config.RootCA == "" {
+		return nil, nil
+	}
+	caCert, err := keyman.LoadCertificateFromPEMBytes([]byte(config.RootCA))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load root ca cert: %s", err)
+	}
+	return caCert.PoolContainingCert(), nil
+}
+
+// EnproxyConfig builds an enproxy.Config that uses the given ClientProtocol
+func EnproxyConfig(cp ClientProtocol) *enproxy.Config {
+	return &enproxy.Config{
+		DialProxy:  cp.DialProxy,
+		NewRequest: cp.NewRequest,
+	}
+}
+
+// StripHeadersWithPrefix removes all headers whose name starts with the given
+// prefix (case-insensitive).
+func StripHeadersWithPrefix(header http.Header, prefix string) {
+	prefix = strings.ToLower(prefix)
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			header.Del(name)
+		}
+	}
+}
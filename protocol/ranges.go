@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPRanges is a list of IP ranges, such as those that a fronting provider
+// publishes for its edge servers
+type IPRanges []*net.IPNet
+
+// ParseIPRanges parses the given CIDRs, e.g. 173.245.48.0/20
+func ParseIPRanges(cidrs []string) (IPRanges, error) {
+	ranges := make(IPRanges, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse IP range %s: %s", cidr, err)
+		}
+		ranges = append(ranges, network)
+	}
+	return ranges, nil
+}
+
+// MustParseIPRanges is like ParseIPRanges but panics if a CIDR is invalid,
+// for ranges that are compiled in
+func MustParseIPRanges(cidrs []string) IPRanges {
+	ranges, err := ParseIPRanges(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return ranges
+}
+
+// ContainsAddr checks whether the ip of the given ip:port (like an
+// http.Request's RemoteAddr) is in one of the ranges
+func (ranges IPRanges) ContainsAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range ranges {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
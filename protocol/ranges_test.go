@@ -0,0 +1,27 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestIPRanges(t *testing.T) {
+	ranges, err := ParseIPRanges([]string{"173.245.48.0/20", "2400:cb00::/32"})
+	if err != nil {
+		t.Fatalf("Unable to parse ranges: %s", err)
+	}
+	for addr, expected := range map[string]bool{
+		"173.245.48.1:443":  true,
+		"[2400:cb00::1]:80": true,
+		"173.245.64.1:443":  false,
+		"10.0.0.1:443":      false,
+		"173.245.48.1":      true,
+		"not an ip:443":     false,
+	} {
+		if ranges.ContainsAddr(addr) != expected {
+			t.Errorf("Wrong result for %s, expected %v", addr, expected)
+		}
+	}
+	if _, err := ParseIPRanges([]string{"173.245.48.0"}); err == nil {
+		t.Errorf("Expected error for range without prefix length")
+	}
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_RETRIES         = 2
+	DEFAULT_REQUEST_RETRIES = 2
+	DEFAULT_INITIAL_BACKOFF = 250 * time.Millisecond
+	DEFAULT_MAX_BACKOFF     = 4 * time.Second
+)
+
+// RetryPolicy retries failed dials to the fronting provider with exponential
+// backoff and jitter, so that transient CDN hiccups don't surface as errors.
+// Since each dial picks the next masquerade in rotation (and failed
+// masquerades are taken out of rotation), retries go through alternate
+// masquerades.
+type RetryPolicy struct {
+	Retries        int           // number of retries after the first attempt
+	RequestRetries int           // (optional) number of times to retry idempotent requests that fail without a response (see RoundTripper)
+	InitialBackoff time.Duration // (optional) backoff before the first retry, defaults to DEFAULT_INITIAL_BACKOFF
+	MaxBackoff     time.Duration // (optional) maximum backoff, defaults to DEFAULT_MAX_BACKOFF
+}
+
+// Wrap returns a copy of the given enproxy.Config whose DialProxy retries
+// according to this policy.  It is safe to call on a nil RetryPolicy, in
+// which case it returns the config unchanged.
+func (policy *RetryPolicy) Wrap(config *enproxy.Config) *enproxy.Config {
+	if policy == nil || policy.Retries < 1 {
+		return config
+	}
+	dialProxy := config.DialProxy
+	wrapped := *config
+	wrapped.DialProxy = func(addr string) (net.Conn, error) {
+		conn, err := dialProxy(addr)
+		for attempt := 0; err != nil && attempt < policy.Retries; attempt++ {
+			backoff := policy.backoff(attempt)
+			log.Debugf("Unable to dial server, retrying in %s: %s", backoff, err)
+			time.Sleep(backoff)
+			conn, err = dialProxy(addr)
+		}
+		return conn, err
+	}
+	return &wrapped
+}
+
+// RoundTripper returns an http.RoundTripper that retries idempotent requests
+// (GET and HEAD without a body) that fail through the given RoundTripper with
+// a transport error, up to RequestRetries times with backoff.  Since nothing
+// has reached the browser yet when a request fails without a response, and
+// every attempt dials anew (through the next server and masquerade), this
+// hides transient failures of a front.  It is safe to call on a nil
+// RetryPolicy, in which case it returns rt unchanged.
+func (policy *RetryPolicy) RoundTripper(rt http.RoundTripper) http.RoundTripper {
+	if policy == nil || policy.RequestRetries < 1 {
+		return rt
+	}
+	return &retryingRoundTripper{rt, policy}
+}
+
+type retryingRoundTripper struct {
+	orig   http.RoundTripper
+	policy *RetryPolicy
+}
+
+func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.orig.RoundTrip(req)
+	if !isIdempotent(req) {
+		return resp, err
+	}
+	for attempt := 0; err != nil && attempt < rt.policy.RequestRetries; attempt++ {
+		backoff := rt.policy.backoff(attempt)
+		log.Debugf("Request failed, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		resp, err = rt.orig.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// isIdempotent indicates whether the given request can safely be retried
+func isIdempotent(req *http.Request) bool {
+	return (req.Method == "GET" || req.Method == "HEAD") && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// backoff returns the backoff before the given retry (starting at 0), which is
+// chosen randomly between half and all of the exponential backoff so that
+// clients don't retry in lockstep
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	initial := policy.InitialBackoff
+	if initial <= 0 {
+		initial = DEFAULT_INITIAL_BACKOFF
+	}
+	max := policy.MaxBackoff
+	if max <= 0 {
+		max = DEFAULT_MAX_BACKOFF
+	}
+	backoff := initial
+	for i := 0; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
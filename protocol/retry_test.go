@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/enproxy"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	cp := &failingProtocol{}
+	policy := &RetryPolicy{Retries: 2, InitialBackoff: time.Millisecond}
+	config := policy.Wrap(&enproxy.Config{DialProxy: cp.DialProxy})
+	_, err := config.DialProxy("")
+	if err == nil {
+		t.Fatalf("Dial should have failed")
+	}
+	if cp.dials != 3 {
+		t.Errorf("Expected 3 dials, got %d", cp.dials)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	for attempt, max := range []time.Duration{100, 200, 300, 300} {
+		max *= time.Millisecond
+		backoff := policy.backoff(attempt)
+		if backoff < max/2 || backoff > max {
+			t.Errorf("Backoff for attempt %d should be between %s and %s, was %s", attempt, max/2, max, backoff)
+		}
+	}
+}
+
+// failingRoundTripper fails the first failures round trips
+type failingRoundTripper struct {
+	failures int
+	attempts int
+}
+
+func (rt *failingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.attempts++
+	if rt.attempts <= rt.failures {
+		return nil, fmt.Errorf("Connection reset")
+	}
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+func TestRequestRetries(t *testing.T) {
+	policy := &RetryPolicy{RequestRetries: 2, InitialBackoff: time.Millisecond}
+
+	rt := &failingRoundTripper{failures: 2}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := policy.RoundTripper(rt).RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("GET should have succeeded on the third attempt: %v", err)
+	}
+
+	rt = &failingRoundTripper{failures: 1}
+	req, _ = http.NewRequest("POST", "http://example.com/", strings.NewReader("data"))
+	_, err = policy.RoundTripper(rt).RoundTrip(req)
+	if err == nil || rt.attempts != 1 {
+		t.Errorf("POST shouldn't have been retried, made %d attempts", rt.attempts)
+	}
+}
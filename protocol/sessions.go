@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/tls"
+)
+
+const (
+	DEFAULT_SESSION_CACHE_SIZE = 1000
+	MAX_CERT_EXPIRIES          = 1000 // number of hosts whose certificate expiry we remember for CertExpiry
+)
+
+var (
+	handshakes int64
+	resumed    int64
+
+	certExpiries      = make(map[string]time.Time)
+	certExpiriesMutex sync.Mutex
+)
+
+// TLSStats counts the TLS handshakes with fronting providers and how many of
+// them resumed a cached session (skipping a round trip and the key exchange)
+type TLSStats struct {
+	Handshakes int64 `json:"handshakes"`
+	Resumed    int64 `json:"resumed"`
+}
+
+// NewSessionCache creates a TLS session cache of DEFAULT_SESSION_CACHE_SIZE
+// sessions, for sharing among ClientConfigs.  Sessions are cached by
+// ServerName, which is the masquerade (or upstream) host, so a shared cache
+// lets every protocol and server that dials a host resume its sessions.
+func NewSessionCache() tls.ClientSessionCache {
+	return tls.NewLRUClientSessionCache(DEFAULT_SESSION_CACHE_SIZE)
+}
+
+// SessionCacheFor returns the given config's SessionCache, or a new one if it
+// has none
+func SessionCacheFor(config *ClientConfig) tls.ClientSessionCache {
+	if config.SessionCache != nil {
+		return config.SessionCache
+	}
+	return NewSessionCache()
+}
+
+// CurrentTLSStats returns the TLSStats since we started
+func CurrentTLSStats() *TLSStats {
+	return &TLSStats{
+		Handshakes: atomic.LoadInt64(&handshakes),
+		Resumed:    atomic.LoadInt64(&resumed),
+	}
+}
+
+// CertExpiry returns when the certificate presented by the given host (e.g. a
+// masquerade) in our latest handshake with it expires, or the zero time if we
+// haven't seen it
+func CertExpiry(host string) time.Time {
+	certExpiriesMutex.Lock()
+	defer certExpiriesMutex.Unlock()
+	return certExpiries[host]
+}
+
+// recordHandshake records a completed handshake with host on the given conn
+func recordHandshake(conn *tls.Conn, host string) {
+	atomic.AddInt64(&handshakes, 1)
+	state := conn.ConnectionState()
+	if state.DidResume {
+		atomic.AddInt64(&resumed, 1)
+	}
+	if len(state.PeerCertificates) > 0 {
+		certExpiriesMutex.Lock()
+		if len(certExpiries) >= MAX_CERT_EXPIRIES {
+			// Keep it simple and just start over
+			certExpiries = make(map[string]time.Time)
+		}
+		certExpiries[host] = state.PeerCertificates[0].NotAfter
+		certExpiriesMutex.Unlock()
+	}
+}
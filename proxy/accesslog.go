@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACCESS_LOG_COMMON   = "common"   // Common Log Format
+	ACCESS_LOG_COMBINED = "combined" // Combined Log Format, followed by the request's duration in milliseconds
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLog logs every request to the server, one line each, in the Common
+// or Combined Log Format that existing log analysis tools understand.  The
+// client is identified by the IP that the fronting protocol forwarded (if
+// any), the user is the tenant (if any) and the request line has the host as
+// rewritten by the fronting protocol.  For example:
+//
+//	203.0.113.7 - school [01/Mar/2015:12:00:00 +0000] "POST https://fl1.example.org/ HTTP/1.1" 200 5120 "-" "Go-http-client/1.1" 31
+//
+// Requests to the decoy sites of tenants are logged without a user.
+type AccessLog struct {
+	Writer io.Writer // where to log
+	Format string    // (optional) ACCESS_LOG_COMMON or ACCESS_LOG_COMBINED, defaults to ACCESS_LOG_COMBINED
+
+	mutex sync.Mutex
+}
+
+// log logs the given request, which was handled for the given user (empty if
+// none) with the given response since start
+func (accessLog *AccessLog) log(req *http.Request, user string, resp *loggedResponseWriter, start time.Time) {
+	var line bytes.Buffer
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if user == "" {
+		user = "-"
+	}
+	status := resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	size := "-"
+	if resp.bytes > 0 {
+		size = fmt.Sprint(resp.bytes)
+	}
+	fmt.Fprintf(&line, "%s - %s [%s] \"%s %s://%s%s %s\" %d %s",
+		clientIP(req), escapeCLF(user, false), start.Format(clfTimeFormat),
+		escapeCLF(req.Method, true), scheme, escapeCLF(req.Host, true), escapeCLF(req.URL.RequestURI(), true), escapeCLF(req.Proto, true),
+		status, size)
+	if accessLog.Format != ACCESS_LOG_COMMON {
+		fmt.Fprintf(&line, " \"%s\" \"%s\" %d",
+			orDash(escapeCLF(req.Referer(), true)), orDash(escapeCLF(req.UserAgent(), true)),
+			int64(time.Now().Sub(start)/time.Millisecond))
+	}
+	line.WriteByte('\n')
+
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+	accessLog.Writer.Write(line.Bytes())
+}
+
+// clientIP returns the IP of the client that sent the given request,
+// preferring X-Forwarded-For (set by the fronting protocols) over the remote
+// address
+func clientIP(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		return escapeCLF(strings.TrimSpace(strings.Split(forwardedFor, ",")[0]), false)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// escapeCLF escapes the given value for a log line the way Apache does, with
+// non-printable characters as \xhh.  Values in quotes also get quotes and
+// backslashes escaped, unquoted ones get spaces escaped.
+func escapeCLF(value string, quoted bool) string {
+	var escaped bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quoted && (c == '"' || c == '\\'):
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c < 0x20 || c >= 0x7f || (!quoted && c == ' '):
+			fmt.Fprintf(&escaped, "\\x%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// loggedResponseWriter notes the status and size of a response for the
+// AccessLog
+type loggedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (resp *loggedResponseWriter) WriteHeader(status int) {
+	if resp.status == 0 {
+		resp.status = status
+	}
+	resp.ResponseWriter.WriteHeader(status)
+}
+
+func (resp *loggedResponseWriter) Write(b []byte) (int, error) {
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	n, err := resp.ResponseWriter.Write(b)
+	resp.bytes += int64(n)
+	return n, err
+}
+
+func (resp *loggedResponseWriter) Flush() {
+	if flusher, ok := resp.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
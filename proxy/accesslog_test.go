@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	accessLog := &AccessLog{Writer: &out}
+	req := readRequest(t, "POST /?q=\"x\" HTTP/1.1\r\nHost: fl1.example.org\r\nX-Forwarded-For: 203.0.113.7, 10.0.0.1\r\nUser-Agent: Go-http-client/1.1\r\n\r\n")
+	logged := &loggedResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	logged.Write([]byte("hello"))
+	start := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	accessLog.log(req, "my school", logged, start)
+	expected := `203.0.113.7 - my\x20school [01/Mar/2015:12:00:00 +0000] "POST http://fl1.example.org/?q=\"x\" HTTP/1.1" 200 5 "-" "Go-http-client/1.1" `
+	if line := out.String(); len(line) <= len(expected) || line[:len(expected)] != expected {
+		t.Errorf("Unexpected combined line:\n%s\nexpected:\n%s", line, expected)
+	}
+
+	out.Reset()
+	accessLog.Format = ACCESS_LOG_COMMON
+	accessLog.log(req, "", &loggedResponseWriter{}, start)
+	expected = `203.0.113.7 - - [01/Mar/2015:12:00:00 +0000] "POST http://fl1.example.org/?q=\"x\" HTTP/1.1" 200 -` + "\n"
+	if line := out.String(); line != expected {
+		t.Errorf("Unexpected common line:\n%s\nexpected:\n%s", line, expected)
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/flashlight/blocklist"
+	"github.com/getlantern/flashlight/rules"
+)
+
+const (
+	ADMIN_RULES_PATH      = "/admin/rules"           // path at which the admin API serves the client's Rules to direct (non-proxy) requests
+	ADMIN_STATUS_PATH     = "/admin/status"          // path at which the admin API serves our Status
+	ADMIN_STATS_PATH      = "/admin/stats"           // path at which the admin API serves the Session so far
+	ADMIN_CONFIG_PATH     = "/admin/config"          // path at which the admin API serves the settings from Control.Config
+	ADMIN_RELOAD_PATH     = "/admin/reload"          // path to which to POST to reload via Control.Reload
+	ADMIN_STOP_PATH       = "/admin/stop"            // path to which to POST to stop via Control.Stop
+	ADMIN_WIPE_PATH       = "/admin/wipe"            // path to which to POST to wipe our data and exit via Control.Wipe
+	ADMIN_SELFTESTS_PATH  = "/admin/selftests"       // path at which the admin API serves the history of the SelfTests
+	ADMIN_BANDWIDTH_PATH  = "/admin/stats/bandwidth" // path at which the admin API serves the Bandwidth totals per domain
+	ADMIN_BLOCKLISTS_PATH = "/admin/blocklists"      // path at which the admin API serves (GET) and toggles (POST) the Blocklist's subscriptions
+	X_LANTERN_ADMIN_TOKEN = "X-Lantern-Admin-Token"  // header carrying the AdminToken
+	MAX_RULES_SIZE        = 1024 * 1024
+)
+
+// Control lets the admin API inspect and control the program running the
+// client (e.g. the flashlight command), for GUIs and scripts
+type Control struct {
+	Config func() map[string]string // (optional) returns the current settings by name, without secrets
+	Reload func() error             // (optional) reloads the configuration
+	Stop   func()                   // (optional) stops the program, called after responding
+	Wipe   func()                   // (optional) wipes the program's data and exits, called after responding
+}
+
+// isAdminRequest indicates whether the given request is for the admin API
+// rather than something to proxy
+func isAdminRequest(req *http.Request) bool {
+	if req.URL.Host != "" {
+		return false
+	}
+	switch req.URL.Path {
+	case ADMIN_RULES_PATH, ADMIN_STATUS_PATH, ADMIN_STATS_PATH, ADMIN_BANDWIDTH_PATH, ADMIN_BLOCKLISTS_PATH, ADMIN_CONFIG_PATH, ADMIN_RELOAD_PATH, ADMIN_STOP_PATH, ADMIN_WIPE_PATH, ADMIN_SELFTESTS_PATH:
+		return true
+	}
+	return false
+}
+
+// serveAdmin serves the admin API.  It requires the AdminToken and is disabled
+// if there's none.  Requiring the token in a header also keeps web pages from
+// using the API through the browser.
+func (client *Client) serveAdmin(resp http.ResponseWriter, req *http.Request) {
+	if !client.isAuthorizedAdmin(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch req.URL.Path {
+	case ADMIN_RULES_PATH:
+		client.serveRules(resp, req)
+	case ADMIN_STATUS_PATH:
+		if req.Method != "GET" {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		client.serveStatus(resp)
+	case ADMIN_STATS_PATH:
+		if req.Method != "GET" {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(client.CurrentSession())
+	case ADMIN_BANDWIDTH_PATH:
+		if req.Method != "GET" {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if client.Bandwidth == nil {
+			http.Error(resp, "No bandwidth accounting configured", http.StatusNotFound)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(client.Bandwidth.Totals(0))
+	case ADMIN_BLOCKLISTS_PATH:
+		client.serveBlocklists(resp, req)
+	case ADMIN_SELFTESTS_PATH:
+		if req.Method != "GET" {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if client.SelfTests == nil {
+			http.Error(resp, "No self-tests configured", http.StatusNotFound)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(client.SelfTests.History())
+	default:
+		client.serveControl(resp, req)
+	}
+}
+
+// isAuthorizedAdmin indicates whether the given request carries our
+// AdminToken, which is never the case if there's none
+func (client *Client) isAuthorizedAdmin(req *http.Request) bool {
+	token := req.Header.Get(X_LANTERN_ADMIN_TOKEN)
+	return client.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(client.AdminToken)) == 1
+}
+
+// serveRules returns (GET) or replaces (PUT) the client's Rules as JSON
+func (client *Client) serveRules(resp http.ResponseWriter, req *http.Request) {
+	if client.Rules == nil {
+		http.Error(resp, "No rules configured", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(client.Rules.Current())
+	case "PUT":
+		var updated []*rules.Rule
+		err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, MAX_RULES_SIZE)).Decode(&updated)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Unable to decode rules: %s", err), http.StatusBadRequest)
+			return
+		}
+		err = client.Rules.Update(updated)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveBlocklists returns (GET) the status of our Blocklist's subscriptions
+// as JSON, or enables or disables (POST) one, given as JSON like
+// {"name": "malware", "enabled": false}
+func (client *Client) serveBlocklists(resp http.ResponseWriter, req *http.Request) {
+	if client.Blocklist == nil {
+		http.Error(resp, "No blocklists configured", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(client.Blocklist.Lists())
+	case "POST":
+		toggle := &blocklist.ListStatus{}
+		err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, MAX_RULES_SIZE)).Decode(toggle)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Unable to decode blocklist: %s", err), http.StatusBadRequest)
+			return
+		}
+		err = client.Blocklist.SetEnabled(toggle.Name, toggle.Enabled)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveControl serves the parts of the admin API that are handled by our
+// Control
+func (client *Client) serveControl(resp http.ResponseWriter, req *http.Request) {
+	method := "POST"
+	if req.URL.Path == ADMIN_CONFIG_PATH {
+		method = "GET"
+	}
+	if req.Method != method {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	control := client.Control
+	if control == nil {
+		control = &Control{}
+	}
+	switch {
+	case req.URL.Path == ADMIN_CONFIG_PATH && control.Config != nil:
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(control.Config())
+	case req.URL.Path == ADMIN_RELOAD_PATH && control.Reload != nil:
+		if err := control.Reload(); err != nil {
+			http.Error(resp, fmt.Sprintf("Unable to reload: %s", err), http.StatusInternalServerError)
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	case req.URL.Path == ADMIN_STOP_PATH && control.Stop != nil:
+		resp.WriteHeader(http.StatusAccepted)
+		if flusher, ok := resp.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		go control.Stop()
+	case req.URL.Path == ADMIN_WIPE_PATH && control.Wipe != nil:
+		resp.WriteHeader(http.StatusAccepted)
+		if flusher, ok := resp.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		go control.Wipe()
+	default:
+		http.Error(resp, "Not supported", http.StatusNotFound)
+	}
+}
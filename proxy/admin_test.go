@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminControl(t *testing.T) {
+	stopped := make(chan bool, 1)
+	wiped := make(chan bool, 1)
+	reloadErr := fmt.Errorf("bad config")
+	client := &Client{
+		AdminToken: "secret",
+		Control: &Control{
+			Reload: func() error { return reloadErr },
+			Stop:   func() { stopped <- true },
+			Wipe:   func() { wiped <- true },
+		},
+	}
+	serve := func(method string, path string, token string) *httptest.ResponseRecorder {
+		req := readRequest(t, fmt.Sprintf("%s %s HTTP/1.1\r\nHost: 127.0.0.1:8787\r\n%s: %s\r\n\r\n", method, path, X_LANTERN_ADMIN_TOKEN, token))
+		if !isAdminRequest(req) {
+			t.Fatalf("%s should be an admin request", path)
+		}
+		resp := httptest.NewRecorder()
+		client.serveAdmin(resp, req)
+		return resp
+	}
+
+	for _, test := range []struct {
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{"GET", ADMIN_STATS_PATH, "wrong", http.StatusForbidden},
+		{"GET", ADMIN_STATS_PATH, "secret", http.StatusOK},
+		{"GET", ADMIN_STATUS_PATH, "secret", http.StatusOK},
+		{"GET", ADMIN_CONFIG_PATH, "secret", http.StatusNotFound},
+		{"GET", ADMIN_SELFTESTS_PATH, "secret", http.StatusNotFound},
+		{"GET", ADMIN_RELOAD_PATH, "secret", http.StatusMethodNotAllowed},
+		{"POST", ADMIN_RELOAD_PATH, "secret", http.StatusInternalServerError},
+	} {
+		if resp := serve(test.method, test.path, test.token); resp.Code != test.expected {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.path, test.expected, resp.Code)
+		}
+	}
+
+	reloadErr = nil
+	if resp := serve("POST", ADMIN_RELOAD_PATH, "secret"); resp.Code != http.StatusNoContent {
+		t.Errorf("Expected successful reload, got %d", resp.Code)
+	}
+	if resp := serve("POST", ADMIN_STOP_PATH, "secret"); resp.Code != http.StatusAccepted {
+		t.Errorf("Expected stop to be accepted, got %d", resp.Code)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("Expected stop")
+	}
+	if resp := serve("GET", ADMIN_WIPE_PATH, "secret"); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Wipe should require POST, got %d", resp.Code)
+	}
+	if resp := serve("POST", ADMIN_WIPE_PATH, "secret"); resp.Code != http.StatusAccepted {
+		t.Errorf("Expected wipe to be accepted, got %d", resp.Code)
+	}
+	select {
+	case <-wiped:
+	case <-time.After(time.Second):
+		t.Errorf("Expected wipe")
+	}
+}
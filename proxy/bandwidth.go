@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"time"
+)
+
+const (
+	DOMAIN_BANDWIDTH_NAME = "bandwidth-domains" // name of a Client's Bandwidth totals in the store
+	CLIENT_BANDWIDTH_NAME = "bandwidth-clients" // name of a Server's Bandwidth totals in the store
+	BANDWIDTH_INTERVAL    = 1 * time.Minute     // how frequently a Server publishes its Bandwidth totals
+	BANDWIDTH_TOP_CLIENTS = 100                 // number of clients whose totals a Server publishes
+)
+
+// publishBandwidth periodically publishes the Bandwidth totals of our busiest
+// clients to our StatServer
+func (server *Server) publishBandwidth() {
+	for {
+		time.Sleep(BANDWIDTH_INTERVAL)
+		server.StatServer.OnBandwidth(server.Bandwidth.Totals(BANDWIDTH_TOP_CLIENTS))
+	}
+}
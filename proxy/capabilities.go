@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/flashlight/capabilities"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/tenants"
+)
+
+const (
+	CAPABILITIES_RETRY_INTERVAL = 1 * time.Minute
+)
+
+// capabilities returns what we support, with the limits of the given tenant
+// (which may be nil)
+func (server *Server) capabilities(tenant *tenants.Tenant) *capabilities.Capabilities {
+	result := &capabilities.Capabilities{
+		Version:     capabilities.VERSION,
+		Transports:  []string{capabilities.TRANSPORT_ENPROXY},
+		Compression: []string{capabilities.CODEC_DEFLATE},
+		Media:       server.Media != nil,
+		Hops:        len(server.AllowedHops) > 0,
+		UDP:         true,
+		Feedback:    server.Feedback != nil,
+		Prefetch:    server.Prefetch,
+		Limits: &capabilities.Limits{
+			ReadTimeout:  int64(server.ReadTimeout / time.Second),
+			WriteTimeout: int64(server.WriteTimeout / time.Second),
+		},
+	}
+	if tenant != nil {
+		result.Limits.DailyCap = tenant.DailyCap
+	}
+	return result
+}
+
+// isCapabilitiesRequest indicates whether the given request is for our
+// capabilities and allowed to see them, which requires the CapabilitiesToken
+// or an authenticated tenant.  Requests that aren't allowed are handled like
+// any other, so that they can't tell whether we publish our capabilities.
+func (server *Server) isCapabilitiesRequest(req *http.Request, tenant *tenants.Tenant) bool {
+	if req.Method != "GET" || req.URL.Path != capabilities.CAPABILITIES_PATH {
+		return false
+	}
+	return tenant != nil || capabilities.Authorized(req, server.CapabilitiesToken)
+}
+
+// discoversCapabilities indicates whether we can authenticate to the server
+// for its capabilities
+func (client *Client) discoversCapabilities() bool {
+	return client.CapabilitiesToken != "" || client.TenantToken != ""
+}
+
+// discoverCapabilities fetches the server's capabilities, retrying until we
+// reach the server (or stop is closed), and configures us accordingly.  Until then, we assume
+// that the server supports everything that we're configured to use.
+func (client *Client) discoverCapabilities(stop chan bool) {
+	for {
+		result, err := client.fetchCapabilities()
+		if err == nil {
+			client.setCapabilities(result)
+			return
+		}
+		if capabilities.IsUnsupported(err) {
+			log.Debugf("%s, assuming that it supports what we're configured for", err)
+			return
+		}
+		log.Debugf("Unable to discover server capabilities, retrying in %v: %s", CAPABILITIES_RETRY_INTERVAL, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(CAPABILITIES_RETRY_INTERVAL):
+		}
+	}
+}
+
+// fetchCapabilities fetches the server's capabilities
+func (client *Client) fetchCapabilities() (*capabilities.Capabilities, error) {
+	config := client.enproxyConfig("")
+	conn, err := config.DialProxy("")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial server: %s", err)
+	}
+	defer conn.Close()
+	req, err := config.NewRequest("", "GET", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request: %s", err)
+	}
+	capabilities.PrepareRequest(req, client.CapabilitiesToken)
+	err = req.Write(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to request capabilities: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read capabilities response: %s", err)
+	}
+	return capabilities.ReadResponse(resp)
+}
+
+// setCapabilities configures us for the given capabilities of the server,
+// logging the features that we're configured to use but the server lacks
+func (client *Client) setCapabilities(result *capabilities.Capabilities) {
+	if client.CompressTunnel && !result.SupportsCompression(capabilities.CODEC_DEFLATE) {
+		log.Error("Server doesn't support compressed tunnels, not compressing")
+	}
+	if len(client.Hops) > 0 && !result.SupportsHops() {
+		log.Errorf("Server doesn't relay to next hops, tunnels through %d hops will fail", len(client.Hops))
+	}
+	if client.feedback != nil && !result.SupportsFeedback() {
+		log.Error("Server doesn't accept feedback, not reporting failed destinations")
+	}
+	log.Debugf("Discovered server capabilities: transports %v, compression %v, media %v, hops %v, udp %v",
+		result.Transports, result.Compression, result.Media, result.Hops, result.UDP)
+	client.capabilitiesMutex.Lock()
+	client.capabilities = result
+	client.capabilitiesMutex.Unlock()
+}
+
+// serverCapabilities returns the server's capabilities, or nil if we haven't
+// discovered them (yet)
+func (client *Client) serverCapabilities() *capabilities.Capabilities {
+	client.capabilitiesMutex.RLock()
+	defer client.capabilitiesMutex.RUnlock()
+	return client.capabilities
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	SERVER_CERT_VALIDITY     = 10 * 365 * 24 * time.Hour // how long self-signed server certs are valid for
+	SERVER_CERT_RENEW_BEFORE = 30 * 24 * time.Hour       // how long before it expires to regenerate the self-signed server cert
+	CERT_CHECK_INTERVAL      = 1 * time.Hour             // how often to check whether to regenerate it
+)
+
+// GetCertificate returns the server cert that we currently serve, for use as
+// a tls.Config's GetCertificate, so that renewed certs are served without
+// restarting
+func (ctx *CertContext) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if ctx.ACME != nil {
+		return ctx.ACME.GetCertificate(hello)
+	}
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+	if ctx.tlsCert == nil {
+		return nil, fmt.Errorf("No server cert yet")
+	}
+	return ctx.tlsCert, nil
+}
+
+// Certificate returns the server cert that we currently serve, if any
+func (ctx *CertContext) Certificate() *x509.Certificate {
+	if ctx.ACME != nil {
+		return ctx.ACME.Certificate()
+	}
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+	if ctx.tlsCert == nil {
+		return nil
+	}
+	return ctx.tlsCert.Leaf
+}
+
+// keepRenewed regenerates the self-signed server cert for the given host
+// once it's within SERVER_CERT_RENEW_BEFORE of expiring, checking every
+// CERT_CHECK_INTERVAL
+func (ctx *CertContext) keepRenewed(host string) {
+	defer crash.Recover()
+	for {
+		time.Sleep(CERT_CHECK_INTERVAL)
+		if !needsRenewal(ctx.Certificate(), time.Now()) {
+			continue
+		}
+		if err := ctx.initServerCert(host); err != nil {
+			log.Errorf("Unable to renew server cert: %s", err)
+			continue
+		}
+		log.Debugf("Renewed server cert, which now expires %s", ctx.Certificate().NotAfter.Format(time.RFC3339))
+	}
+}
+
+// needsRenewal indicates whether the given cert is missing or expires within
+// SERVER_CERT_RENEW_BEFORE of now
+func needsRenewal(cert *x509.Certificate, now time.Time) bool {
+	return cert == nil || now.Add(SERVER_CERT_RENEW_BEFORE).After(cert.NotAfter)
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestCertRenewal(t *testing.T) {
+	now := time.Now()
+	if !needsRenewal(nil, now) {
+		t.Errorf("Missing cert should need renewal")
+	}
+	if needsRenewal(&x509.Certificate{NotAfter: now.Add(SERVER_CERT_RENEW_BEFORE + time.Hour)}, now) {
+		t.Errorf("Cert that isn't about to expire shouldn't need renewal")
+	}
+	if !needsRenewal(&x509.Certificate{NotAfter: now.Add(SERVER_CERT_RENEW_BEFORE - time.Hour)}, now) {
+		t.Errorf("Cert that's about to expire should need renewal")
+	}
+
+	ctx := &CertContext{}
+	if _, err := ctx.GetCertificate(nil); err == nil || ctx.Certificate() != nil {
+		t.Errorf("Should have no cert before initializing")
+	}
+	// Renewing swaps the cert that's served
+	for _, notAfter := range []time.Time{now.Add(time.Hour), now.Add(SERVER_CERT_VALIDITY)} {
+		ctx.mutex.Lock()
+		ctx.tlsCert = &tls.Certificate{Leaf: &x509.Certificate{NotAfter: notAfter}}
+		ctx.mutex.Unlock()
+		cert, err := ctx.GetCertificate(nil)
+		if err != nil || cert.Leaf.NotAfter != notAfter || ctx.Certificate().NotAfter != notAfter {
+			t.Errorf("Expected cert expiring %s, got %v, %v", notAfter, cert, err)
+		}
+	}
+}
@@ -1,19 +1,52 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync"
 	"time"
 
 	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/accounting"
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/blocklist"
+	"github.com/getlantern/flashlight/capabilities"
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/feedback"
+	"github.com/getlantern/flashlight/handoff"
+	"github.com/getlantern/flashlight/httpcache"
 	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/logship"
+	"github.com/getlantern/flashlight/metrics"
+	"github.com/getlantern/flashlight/offline"
+	"github.com/getlantern/flashlight/pipe"
+	"github.com/getlantern/flashlight/prefetch"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/proxydialer"
+	"github.com/getlantern/flashlight/remoteconfig"
+	"github.com/getlantern/flashlight/resolver"
+	"github.com/getlantern/flashlight/rules"
+	"github.com/getlantern/flashlight/selftest"
+	"github.com/getlantern/flashlight/smartroute"
+	"github.com/getlantern/flashlight/socks"
+	"github.com/getlantern/flashlight/store"
+	"github.com/getlantern/flashlight/tenants"
+	"github.com/getlantern/flashlight/trace"
+	"github.com/getlantern/flashlight/transparent"
+	"github.com/getlantern/flashlight/updater"
+	"github.com/getlantern/flashlight/users"
 )
 
 const (
 	CONNECT = "CONNECT" // HTTP CONNECT method
 
 	REVERSE_PROXY_FLUSH_INTERVAL = 250 * time.Millisecond
+	DIRECT_DIAL_TIMEOUT          = 30 * time.Second
 )
 
 type Client struct {
@@ -21,66 +54,802 @@ type Client struct {
 
 	EnproxyConfig *enproxy.Config
 
-	reverseProxy *httputil.ReverseProxy
+	// NewEnproxyConfig (optional) supplies an EnproxyConfig for each new
+	// connection to the given destination addr.  If specified, it takes
+	// precedence over EnproxyConfig.
+	NewEnproxyConfig func(addr string) *enproxy.Config
+
+	// ServerConfigs (optional) supplies an EnproxyConfig for reaching each
+	// server in particular, by name, so that the servers' identities are
+	// verified separately (see ServerPins).  Without it, the server that the
+	// EnproxyConfig reaches is verified as the only one.
+	ServerConfigs func() map[string]*enproxy.Config
+
+	// RetryPolicy (optional) retries failed dials to the server, and failed
+	// idempotent plain http requests
+	RetryPolicy *protocol.RetryPolicy
+
+	// Prefetch, if true, causes subresources of plain http HTML pages to be
+	// fetched ahead of the browser requesting them, pushed by the server if
+	// it supports that.
+	Prefetch bool
+
+	// Rules (optional) is the rules engine that's applied to requests
+	Rules *rules.Engine
+
+	// LookupIP (optional) resolves hosts for Rules (and users' rules) that
+	// match by cidr or country, e.g. over DoH.  Defaults to net.LookupIP.
+	LookupIP func(host string) ([]net.IP, error)
+
+	// LookupCountry (optional) looks up the country code of an IP for Rules
+	// (and users' rules) that match by country
+	LookupCountry func(ip string) (string, error)
+
+	// Blocklist (optional) blocks hosts from subscribed lists, in addition to
+	// the blocking Rules
+	Blocklist *blocklist.Blocklist
+
+	// Hops (optional) are additional flashlight servers (host:port) through
+	// which to route traffic after the first server, in order
+	Hops []string
+
+	// Users (optional) enables multi-user mode, in which users must
+	// authenticate and get their own rules, accounting and data caps
+	Users *users.Users
+
+	// SmartRoute (optional) detects destinations that are reachable directly,
+	// which then aren't tunneled
+	SmartRoute *smartroute.Detector
+
+	// OfflineStore (optional) is where pages from domains that Rules mark as
+	// offline are kept for offline reading
+	OfflineStore *store.Store
+
+	// OfflineMaxBytes (optional) caps the size of the pages kept for offline
+	// reading, defaults to offline.DEFAULT_MAX_BYTES
+	OfflineMaxBytes int64
+
+	// CompressTunnel, if true, causes plain http traffic to be compressed
+	// between us and the server, which saves bandwidth when origins don't
+	// compress
+	CompressTunnel bool
+
+	// CacheStore (optional) enables caching plain http responses (see
+	// package httpcache), which are kept in this store
+	CacheStore *store.Store
+
+	// CacheMaxBytes (optional) caps the size of the cache, defaults to
+	// httpcache.DEFAULT_MAX_BYTES
+	CacheMaxBytes int64
+
+	// Listeners (optional) are additional listeners.  If there's an admin
+	// listener, the status and admin API are only served there.
+	Listeners []*Listener
+
+	// SocksAddr (optional) is the address at which to listen for SOCKS5
+	// clients, including UDP ASSOCIATE
+	SocksAddr string
+
+	// TransparentAddr (optional) is the address at which to listen for
+	// connections redirected by the firewall (see package transparent)
+	TransparentAddr string
+
+	// TProxy, if true, causes TransparentAddr to accept TPROXY rather than
+	// REDIRECT traffic
+	TProxy bool
+
+	// DNSAddr (optional) is the address at which to listen for DNS queries,
+	// which are answered by querying DNSProviders through the tunnel
+	DNSAddr string
+
+	// DNSProviders (optional) are the DoH providers used for answering DNS
+	// queries, defaults to resolver.DEFAULT_PROVIDERS
+	DNSProviders []string
+
+	// UpstreamProxy (optional) is the proxy (e.g. a corporate proxy) through
+	// which to dial destinations that aren't tunneled
+	UpstreamProxy proxydialer.Dialer
+
+	// CurrentProtocol (optional) reports the name of the protocol currently
+	// in use, for our Status
+	CurrentProtocol func() string
+
+	// CurrentHost (optional) reports the host (masquerade or server) that we
+	// last dialed, for our Status
+	CurrentHost func() string
+
+	// FeedbackToken (optional), if specified, causes us to report
+	// destinations that fail through the server to the server, authenticating
+	// with this token (see package feedback)
+	FeedbackToken string
+
+	// Prober (optional) probes the servers, its results are included in our
+	// Status
+	Prober *protocol.Prober
+
+	// AuthToken (optional) authenticates us to servers that require a token
+	// (see package auth)
+	AuthToken string
+
+	// TenantToken (optional) selects our tenant on servers that host several
+	// (see package tenants)
+	TenantToken string
+
+	// CapabilitiesToken (optional) lets us discover the server's capabilities
+	// (see package capabilities), which servers that host tenants also let us
+	// do with our TenantToken
+	CapabilitiesToken string
+
+	// ServerPins (optional) are the identity.Fingerprints of the servers'
+	// public keys.  If specified, we only tunnel through a server once it
+	// proves that it has one of the keys (see package identity), and check
+	// again periodically.  Servers that fail are skipped (see ServerVerified),
+	// and we only stop tunneling if none is verified.
+	ServerPins []string
+
+	// AdminToken (optional) enables the admin API for inspecting and
+	// controlling the client at runtime, which requires this token
+	AdminToken string
+
+	// Control (optional) lets the admin API inspect and control the program
+	// running the client, see Control
+	Control *Control
+
+	// FlushInterval (optional) is how often plain http responses are flushed
+	// to the browser while they're being copied, defaults to
+	// REVERSE_PROXY_FLUSH_INTERVAL.  Streams (e.g. Server-Sent Events) are
+	// always flushed on every write.
+	FlushInterval time.Duration
+
+	// RemoteConfig (optional) fetches signed configuration through the tunnel
+	RemoteConfig *remoteconfig.Fetcher
+
+	// LogShipper (optional) ships error logs through the tunnel
+	LogShipper *logship.Shipper
+
+	// Updater (optional) checks for and installs new binaries through the
+	// tunnel
+	Updater *updater.Updater
+
+	// CrashReporter (optional) submits crash dumps left by previous runs
+	// through the tunnel
+	CrashReporter *crash.Reporter
+
+	// Metrics (optional) exports metrics to monitoring systems
+	Metrics *metrics.Registry
+
+	// SessionStore (optional) is where a summary of each session (see
+	// Session) is kept on shutdown, for dashboards' history
+	SessionStore *store.Store
+
+	// SelfTests (optional) periodically tests connectivity, its Trends are
+	// included in our Status and its history is served by the admin API
+	SelfTests *selftest.Scheduler
+
+	// Tracer (optional) traces a sample of requests, propagating the traces
+	// of CONNECT tunnels to the server
+	Tracer *trace.Tracer
+
+	// Bandwidth (optional) accumulates the bytes transferred per destination
+	// domain across sessions, which the admin API serves.  Connections are
+	// accounted when they close.
+	Bandwidth *accounting.Ledger
+
+	reverseProxy  *httputil.ReverseProxy
+	feedback      *feedback.Reporter
+	started       time.Time
+	conns         connSet
+	predialed     predialPool
+	draining      int32
+	separateAdmin bool
+	listener      net.Listener
+	closed        bool
+	stop          chan bool   // closed by Close, stops what runs in the background
+	servers       []io.Closer // servers besides the main listener, closed by Close
+	listenerMutex sync.Mutex
+
+	capabilities      *capabilities.Capabilities
+	capabilitiesMutex sync.RWMutex
+
+	userProxies      map[string]*userProxy // by user name
+	userProxiesMutex sync.Mutex
+
+	identityErrs  map[string]error // why each server's identity isn't verified, nil for verified servers
+	reverify      chan bool        // asks to verify the servers right away, e.g. once they change
+	identityMutex sync.RWMutex
 }
 
 func (client *Client) Run() error {
+	client.started = time.Now()
+	stop := client.stopped()
+	client.conns.recordDomains = client.SessionStore != nil
+	client.conns.bandwidth = client.Bandwidth
+	if client.Metrics != nil {
+		client.Metrics.AddGauges(resourceGauges)
+		client.Metrics.AddGauges(client.conns.gauges)
+		client.Metrics.AddGauges(client.predialed.gauges)
+		if client.Prober != nil && client.Prober.Canary != nil {
+			client.Metrics.AddGauges(client.probeGauges)
+		}
+		client.Metrics.Start()
+	}
+	if client.FeedbackToken != "" {
+		client.feedback = &feedback.Reporter{Send: client.sendFeedback}
+		client.feedback.Start()
+	}
+	if client.discoversCapabilities() {
+		go client.discoverCapabilities(stop)
+	}
+	if len(client.ServerPins) > 0 {
+		go client.keepVerifyingServers(stop)
+	}
+	client.configureLookups()
 	client.buildReverseProxy()
 
-	httpServer := &http.Server{
-		Addr:         client.Addr,
-		ReadTimeout:  client.ReadTimeout,
-		WriteTimeout: client.WriteTimeout,
-		Handler:      client,
+	client.separateAdmin = client.hasAdminListener()
+	httpServer := client.httpServer(client.Addr)
+
+	if client.Blocklist != nil {
+		client.Blocklist.Start(func(network, addr string) (net.Conn, error) {
+			return client.Dial(addr)
+		})
+	}
+
+	if client.LogShipper != nil {
+		client.LogShipper.Start(func(network, addr string) (net.Conn, error) {
+			return client.Dial(addr)
+		})
+	}
+
+	if client.RemoteConfig != nil {
+		client.RemoteConfig.Start(func(network, addr string) (net.Conn, error) {
+			return client.Dial(addr)
+		})
+	}
+
+	if client.Updater != nil {
+		client.Updater.Start(func(network, addr string) (net.Conn, error) {
+			return client.Dial(addr)
+		})
+	}
+
+	if client.CrashReporter != nil {
+		client.CrashReporter.Start(func(network, addr string) (net.Conn, error) {
+			return client.Dial(addr)
+		})
+	}
+
+	if client.Users != nil {
+		client.Users.Start()
+	}
+
+	if client.SocksAddr != "" {
+		socksServer := client.socksServer(client.SocksAddr)
+		client.closeOnClose(socksServer)
+		go func() {
+			err := socksServer.ListenAndServe()
+			if err != nil {
+				log.Errorf("Unable to run SOCKS proxy: %s", err)
+			}
+		}()
+	}
+
+	if client.TransparentAddr != "" {
+		transparentServer := &transparent.Server{
+			Addr:   client.TransparentAddr,
+			TProxy: client.TProxy,
+			Dial:   client.Dial,
+		}
+		client.closeOnClose(transparentServer)
+		go func() {
+			err := transparentServer.ListenAndServe()
+			if err != nil {
+				log.Errorf("Unable to run transparent proxy: %s", err)
+			}
+		}()
+	}
+
+	if client.DNSAddr != "" {
+		dnsServer := &resolver.DNSServer{
+			Addr: client.DNSAddr,
+			Resolver: resolver.NewDialing(client.DNSProviders, func(network, addr string) (net.Conn, error) {
+				return client.Dial(addr)
+			}),
+		}
+		client.closeOnClose(dnsServer)
+		go func() {
+			err := dnsServer.ListenAndServe()
+			if err != nil {
+				log.Errorf("Unable to run DNS server: %s", err)
+			}
+		}()
 	}
 
+	client.runListeners()
+
 	log.Debugf("About to start client (http) proxy at %s", client.Addr)
-	return httpServer.ListenAndServe()
+	listener, err := handoff.Listen(client.Addr)
+	if err != nil {
+		return err
+	}
+	client.listenerMutex.Lock()
+	if client.closed {
+		client.listenerMutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	client.listener = listener
+	client.listenerMutex.Unlock()
+	err = httpServer.Serve(listener)
+	client.listenerMutex.Lock()
+	defer client.listenerMutex.Unlock()
+	if client.closed {
+		return nil
+	}
+	return err
+}
+
+// Close stops listening at Addr, after which Run returns without an error,
+// closes our other listeners (SOCKS, DNS, transparent and Listeners) and stops
+// everything that Run started in the background.  Unlike Shutdown, it doesn't
+// wait for open connections, so it's meant for embedding programs that stop
+// and start the client within the same process (see package mobile).
+func (client *Client) Close() error {
+	client.stopped()
+	client.listenerMutex.Lock()
+	defer client.listenerMutex.Unlock()
+	if !client.closed {
+		close(client.stop)
+		for _, server := range client.servers {
+			server.Close()
+		}
+		client.Blocklist.Stop()
+		client.LogShipper.Stop()
+		client.RemoteConfig.Stop()
+		client.Updater.Stop()
+		client.CrashReporter.Stop()
+		client.Users.Stop()
+		client.feedback.Stop()
+		client.Metrics.Stop()
+	}
+	client.closed = true
+	client.predialed.closeAll()
+	if client.listener == nil {
+		return nil
+	}
+	return client.listener.Close()
+}
+
+// closeOnClose remembers to close the given server when the Client is closed,
+// or closes it right away if it already is
+func (client *Client) closeOnClose(server io.Closer) {
+	client.listenerMutex.Lock()
+	defer client.listenerMutex.Unlock()
+	if client.closed {
+		server.Close()
+		return
+	}
+	client.servers = append(client.servers, server)
+}
+
+// stopped returns the channel that Close closes
+func (client *Client) stopped() chan bool {
+	client.listenerMutex.Lock()
+	defer client.listenerMutex.Unlock()
+	if client.stop == nil {
+		client.stop = make(chan bool)
+	}
+	return client.stop
 }
 
 func (client *Client) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	log.Debugf("Handling request for: %s", req.RequestURI)
+	log.Debugf("Handling request for: %s", log.Redact(req.RequestURI))
+	if !client.separateAdmin && isStatusRequest(req) {
+		client.serveStatus(resp)
+		return
+	}
+	if !client.separateAdmin && isDashboardRequest(req) {
+		client.serveDashboard(resp)
+		return
+	}
+	if !client.separateAdmin && isAdminRequest(req) {
+		client.serveAdmin(resp, req)
+		return
+	}
+	if client.isDraining() {
+		resp.Header().Set("Connection", "close")
+		http.Error(resp, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	span := client.Tracer.StartTrace("client.accept", trace.SPAN_KIND_SERVER)
+	defer span.Finish(nil)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("peer.service", log.Redact(req.Host))
+	rewrite := span.Child("client.rewrite", trace.SPAN_KIND_INTERNAL)
+	defer rewrite.Finish(nil)
+	var user *users.User
+	if client.Users != nil {
+		user = client.Users.FromRequest(req)
+		if user == nil {
+			requireProxyAuth(resp)
+			return
+		}
+		if user.IsOverCap() {
+			http.Error(resp, "Daily data cap reached", http.StatusForbidden)
+			return
+		}
+		resp = &userResponseWriter{resp, user}
+	}
+	if !normalizeProxyRequest(resp, req) {
+		return
+	}
+	engine := user.RulesOr(client.Rules)
+
+	if client.isBlocked(engine, req.Host) {
+		log.Debugf("Blocked request for: %s", log.Redact(req.RequestURI))
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
 	if req.Method == CONNECT {
-		client.EnproxyConfig.Intercept(resp, req)
+		if client.isDirect(engine, req.Host) {
+			rewrite.Finish(nil)
+			client.interceptDirect(resp, req)
+		} else if err := client.serverVerifiedErr(); err != nil {
+			// Plain http checks this when dialing, but CONNECTs are tunneled
+			// by enproxy directly
+			rewrite.Finish(nil)
+			log.Debugf("Not tunneling %s: %s", log.Redact(req.Host), err)
+			resp.WriteHeader(http.StatusBadGateway)
+		} else {
+			// enproxy dials the request's Host
+			host := req.Host
+			req.Host = protocol.EncodeHops(client.Hops, req.Host)
+			rewrite.Finish(nil)
+			withTrace(client.enproxyConfig(host), span).Intercept(&drainableResponseWriter{resp, &client.conns, host}, req)
+		}
 	} else {
-		client.reverseProxy.ServeHTTP(resp, req)
+		// Note - header overrides can only be applied to plain http
+		// requests, since HTTPS requests are tunneled via CONNECT.
+		engine.ApplyHeaders(req)
+		rewrite.Finish(nil)
+		// Plain http goes through our reverseProxy's pooled connections, so
+		// it's traced as a whole
+		fetch := span.Child("upstream.fetch", trace.SPAN_KIND_CLIENT)
+		defer fetch.Finish(nil)
+		if isUpgrade(req) {
+			client.proxyUpgrade(engine, resp, req)
+		} else if client.Metrics != nil {
+			client.serveTimed(engine, client.reverseProxyFor(user), resp, req)
+		} else {
+			client.reverseProxyFor(user).ServeHTTP(withStreaming(resp), req)
+		}
+	}
+}
+
+// interceptDirect handles a CONNECT request by dialing the destination
+// directly rather than through the tunnel.  For https, if the browser goes
+// away before sending anything, the connection that we dialed is kept for the
+// next CONNECT to the same host (see predialPool).
+func (client *Client) interceptDirect(resp http.ResponseWriter, req *http.Request) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, "Unable to hijack connection", http.StatusInternalServerError)
+		return
+	}
+	dest := client.predialed.get(req.Host)
+	if dest == nil {
+		var err error
+		dest, err = client.dialDirect(req.Host)
+		if err != nil {
+			log.Debugf("Unable to dial %s directly: %s", log.Redact(req.Host), err)
+			resp.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to hijack connection: %s", err)
+		dest.Close()
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		dest.Close()
+		return
+	}
+	var first []byte
+	if isHTTPS(req.Host) {
+		// The browser speaks first, so wait for its ClientHello before
+		// committing dest to this CONNECT
+		b := make([]byte, firstReadSize)
+		if pipe.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(pipe.IdleTimeout))
+		}
+		n, _ := conn.Read(b)
+		conn.SetReadDeadline(time.Time{})
+		if n == 0 {
+			log.Debugf("Browser aborted handshake with %s, keeping connection for reuse", log.Redact(req.Host))
+			client.predialed.put(req.Host, dest)
+			return
+		}
+		first = b[:n]
+	}
+	dest = client.conns.track(req.Host, dest)
+	defer dest.Close()
+	if _, err := dest.Write(first); err != nil {
+		return
+	}
+	sent, received := pipe.Relay(conn, dest)
+	log.Debugf("Relayed %d bytes to and %d bytes from %s directly", int64(len(first))+sent, received, log.Redact(req.Host))
+}
+
+// isHTTPS indicates whether the given destination (host:port) is one to
+// which browsers CONNECT for https
+func isHTTPS(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == "443"
+}
+
+// configureLookups has our Rules and our users' rules (which keep them when
+// they're reloaded) use our LookupIP and LookupCountry, unless they have their
+// own
+func (client *Client) configureLookups() {
+	engines := []*rules.Engine{client.Rules}
+	if client.Users != nil {
+		for _, user := range client.Users.Users {
+			engines = append(engines, user.Rules)
+		}
+	}
+	for _, engine := range engines {
+		if engine == nil {
+			continue
+		}
+		if engine.LookupIP == nil {
+			engine.LookupIP = client.LookupIP
+		}
+		if engine.LookupCountry == nil {
+			engine.LookupCountry = client.LookupCountry
+		}
 	}
 }
 
+// isDirect indicates whether the given addr should be dialed directly.
+// Routes from the given rules take precedence over SmartRoute.
+func (client *Client) isDirect(engine *rules.Engine, addr string) bool {
+	route := engine.MatchRoute(addr)
+	if route != "" {
+		return route == rules.ROUTE_DIRECT
+	}
+	return !client.SmartRoute.ShouldTunnel(addr)
+}
+
+// isBlocked indicates whether the given host is blocked by the given rules or
+// our Blocklist
+func (client *Client) isBlocked(engine *rules.Engine, host string) bool {
+	return engine.IsBlocked(host) || client.Blocklist.IsBlocked(host)
+}
+
 // buildReverseProxy builds the httputil.ReverseProxy used by the client to
 // proxy requests upstream.
 func (client *Client) buildReverseProxy() {
-	client.reverseProxy = &httputil.ReverseProxy{
+	client.reverseProxy = client.newReverseProxy(nil)
+}
+
+// reverseProxyFor returns the httputil.ReverseProxy for the given user, which
+// is our reverseProxy if user is nil.  Users get their own, built on first
+// use, so that their requests are routed by their rules and nothing fetched
+// for one user is served to another.
+func (client *Client) reverseProxyFor(user *users.User) *httputil.ReverseProxy {
+	if user == nil {
+		return client.reverseProxy
+	}
+	client.userProxiesMutex.Lock()
+	defer client.userProxiesMutex.Unlock()
+	existing := client.userProxies[user.Name]
+	if existing != nil && existing.user == user {
+		return existing.proxy
+	}
+	// New user, or the users were reloaded
+	if client.userProxies == nil {
+		client.userProxies = make(map[string]*userProxy)
+	}
+	proxy := client.newReverseProxy(user)
+	client.userProxies[user.Name] = &userProxy{user, proxy}
+	return proxy
+}
+
+// newReverseProxy builds an httputil.ReverseProxy that dials as the given user
+// (if not nil).  The CacheStore and OfflineStore are shared, so they're only
+// used without users.
+func (client *Client) newReverseProxy(user *users.User) *httputil.ReverseProxy {
+	var transport http.RoundTripper = &http.Transport{
+		// We disable keepalives because some servers pretend to support
+		// keep-alives but close their connections immediately, which
+		// causes an error inside ReverseProxy.  This is not an issue
+		// for HTTPS because  the browser is responsible for handling
+		// the problem, which browsers like Chrome and Firefox already
+		// know to do.
+		// See https://code.google.com/p/go/issues/detail?id=4677
+		DisableKeepAlives: true,
+		Dial: func(network, addr string) (net.Conn, error) {
+			// The user's traffic is accounted by the userResponseWriter
+			return client.dialAs(user, addr)
+		},
+	}
+	transport = client.RetryPolicy.RoundTripper(transport)
+	if client.CacheStore != nil && user == nil {
+		transport = &httpcache.Cache{
+			Transport: transport,
+			Store:     client.CacheStore,
+			MaxBytes:  client.CacheMaxBytes,
+		}
+	}
+	if client.OfflineStore != nil && user == nil {
+		transport = &offline.Cache{
+			Transport: transport,
+			Rules:     client.Rules,
+			Store:     client.OfflineStore,
+			MaxBytes:  client.OfflineMaxBytes,
+		}
+	}
+	if client.Prefetch {
+		prefetcher := &prefetch.Prefetcher{Transport: transport}
+		if user == nil && len(client.Hops) == 0 {
+			// With hops, the subresources have to come from the last one
+			prefetcher.Push = client.pushSubresources
+		}
+		transport = prefetcher
+	}
+
+	flushInterval := client.FlushInterval
+	if flushInterval == 0 {
+		flushInterval = REVERSE_PROXY_FLUSH_INTERVAL
+	}
+	return &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			// do nothing
+			// Header overrides from rules are applied in ServeHTTP,
+			// where we know the user
 		},
-		Transport: withDumpHeaders(
-			client.ShouldDumpHeaders,
-			&http.Transport{
-				// We disable keepalives because some servers pretend to support
-				// keep-alives but close their connections immediately, which
-				// causes an error inside ReverseProxy.  This is not an issue
-				// for HTTPS because  the browser is responsible for handling
-				// the problem, which browsers like Chrome and Firefox already
-				// know to do.
-				// See https://code.google.com/p/go/issues/detail?id=4677
-				DisableKeepAlives: true,
-				Dial: func(network, addr string) (net.Conn, error) {
-					conn := &enproxy.Conn{
-						Addr:   addr,
-						Config: client.EnproxyConfig,
-					}
-					err := conn.Connect()
-					if err != nil {
-						return nil, err
-					}
-					return conn, nil
-				},
-			}),
+		Transport: withDumpHeaders(client.ShouldDumpHeaders, transport),
 		// Set a FlushInterval to prevent overly aggressive buffering of
 		// responses, which helps keep memory usage down
-		FlushInterval: 250 * time.Millisecond,
+		FlushInterval: flushInterval,
+	}
+}
+
+// Dial dials the given addr through the tunnel (or directly if our Rules or
+// SmartRoute say so), unless it's blocked
+func (client *Client) Dial(addr string) (net.Conn, error) {
+	return client.dialFor(nil, addr)
+}
+
+// dialFor is like Dial, but applies the given user's rules and accounts the
+// traffic to them (if user isn't nil)
+func (client *Client) dialFor(user *users.User, addr string) (net.Conn, error) {
+	conn, err := client.dialAs(user, addr)
+	if err != nil || user == nil {
+		return conn, err
+	}
+	return user.Track(conn), nil
+}
+
+// dialAs is like dialFor, but leaves accounting the traffic to the caller
+func (client *Client) dialAs(user *users.User, addr string) (net.Conn, error) {
+	engine := user.RulesOr(client.Rules)
+	if client.isBlocked(engine, addr) {
+		return nil, fmt.Errorf("Destination is blocked")
+	}
+	if user != nil && user.IsOverCap() {
+		return nil, fmt.Errorf("Daily data cap reached")
 	}
+	return client.dial(engine, addr)
+}
+
+// dialDirect dials the given addr without tunneling it, going through the
+// UpstreamProxy if there is one
+func (client *Client) dialDirect(addr string) (net.Conn, error) {
+	if client.UpstreamProxy != nil {
+		return client.UpstreamProxy("tcp", addr)
+	}
+	return net.DialTimeout("tcp", addr, DIRECT_DIAL_TIMEOUT)
+}
+
+func (client *Client) dial(engine *rules.Engine, addr string) (net.Conn, error) {
+	conn, err := client.dialUntracked(engine, addr)
+	if err != nil {
+		return nil, err
+	}
+	return client.conns.track(addr, conn), nil
+}
+
+func (client *Client) dialUntracked(engine *rules.Engine, addr string) (net.Conn, error) {
+	if client.isDirect(engine, addr) {
+		return client.dialDirect(addr)
+	}
+	if err := client.serverVerifiedErr(); err != nil {
+		return nil, err
+	}
+	server := client.serverCapabilities()
+	if addr == socks.UDP_RELAY_ADDR && !server.SupportsUDP() {
+		return nil, fmt.Errorf("Server doesn't relay UDP")
+	}
+	dest := addr
+	_, port, _ := net.SplitHostPort(addr)
+	if port == "80" && server.SupportsMedia() && engine.CompressesMedia(addr) {
+		dest = protocol.EncodeMedia(addr)
+	}
+	dest = protocol.EncodeHops(client.Hops, dest)
+	// Only plain http is worth compressing, anything else is most likely
+	// encrypted
+	compressed := client.CompressTunnel && port == "80" && server.SupportsCompression(capabilities.CODEC_DEFLATE)
+	if compressed {
+		dest = protocol.EncodeCompressed(dest)
+	}
+	enproxyConn := &enproxy.Conn{
+		Addr:   dest,
+		Config: client.enproxyConfig(addr),
+	}
+	err := enproxyConn.Connect()
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn = enproxyConn
+	if compressed {
+		conn = protocol.Compress(conn)
+	}
+	if client.feedback != nil && server.SupportsFeedback() {
+		return &feedbackConn{Conn: conn, addr: addr, reporter: client.feedback}, nil
+	}
+	return conn, nil
+}
+
+// enproxyConfig returns the enproxy.Config to use for a new connection to the
+// given addr
+func (client *Client) enproxyConfig(addr string) *enproxy.Config {
+	config := client.EnproxyConfig
+	if client.NewEnproxyConfig != nil {
+		config = client.NewEnproxyConfig(addr)
+	}
+	return client.wrapEnproxyConfig(config)
+}
+
+// TokenHeader returns a header carrying our tokens, for requests to the
+// servers that don't use an enproxy.Config from us (e.g. probes)
+func (client *Client) TokenHeader() http.Header {
+	header := http.Header{}
+	if client.AuthToken != "" {
+		header.Set(auth.X_LANTERN_AUTH, client.AuthToken)
+	}
+	if client.TenantToken != "" {
+		header.Set(tenants.X_LANTERN_TENANT_TOKEN, client.TenantToken)
+	}
+	return header
+}
+
+// wrapEnproxyConfig adds our tokens and RetryPolicy to the given config
+func (client *Client) wrapEnproxyConfig(config *enproxy.Config) *enproxy.Config {
+	if client.AuthToken != "" {
+		config = withHeader(config, auth.X_LANTERN_AUTH, client.AuthToken)
+	}
+	if client.TenantToken != "" {
+		config = withHeader(config, tenants.X_LANTERN_TENANT_TOKEN, client.TenantToken)
+	}
+	return client.RetryPolicy.Wrap(config)
+}
+
+// withHeader returns a copy of the given config whose requests carry the
+// given header (e.g. a token)
+func withHeader(config *enproxy.Config, header string, value string) *enproxy.Config {
+	newRequest := config.NewRequest
+	wrapped := *config
+	wrapped.NewRequest = func(host string, method string, body io.Reader) (*http.Request, error) {
+		req, err := newRequest(host, method, body)
+		if err == nil {
+			req.Header.Set(header, value)
+		}
+		return req, err
+	}
+	return &wrapped
 }
 
 // withDumpHeaders creates a RoundTripper that uses the supplied RoundTripper
@@ -106,3 +875,46 @@ func (rt *headerDumpingRoundTripper) RoundTrip(req *http.Request) (resp *http.Re
 	}
 	return
 }
+
+// userProxy is the httputil.ReverseProxy for a user
+type userProxy struct {
+	user  *users.User
+	proxy *httputil.ReverseProxy
+}
+
+// userResponseWriter is an http.ResponseWriter that accounts the traffic
+// written to it (including through hijacked connections) to a user
+type userResponseWriter struct {
+	http.ResponseWriter
+	user *users.User
+}
+
+func (resp *userResponseWriter) Write(b []byte) (int, error) {
+	n, err := resp.ResponseWriter.Write(b)
+	resp.user.AddBytes(n)
+	return n, err
+}
+
+func (resp *userResponseWriter) Flush() {
+	if flusher, ok := resp.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (resp *userResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := resp.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Unable to hijack connection")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = resp.user.Track(conn)
+	// Make sure that reads and writes through rw also go through the
+	// tracked connection, starting with whatever was already buffered
+	buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+	reader := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), conn)
+	rw = bufio.NewReadWriter(bufio.NewReader(reader), bufio.NewWriter(conn))
+	return conn, rw, nil
+}
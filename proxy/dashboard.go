@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	DASHBOARD_PATH             = "/dashboard" // path at which the client serves its dashboard to direct (non-proxy) requests
+	DASHBOARD_REFRESH_INTERVAL = 2000         // milliseconds between the dashboard's updates from STATUS_PATH
+)
+
+// isDashboardRequest indicates whether the given request is for our
+// dashboard rather than something to proxy
+func isDashboardRequest(req *http.Request) bool {
+	return req.Method == "GET" && req.URL.Host == "" && req.URL.Path == DASHBOARD_PATH
+}
+
+// serveDashboard serves an HTML page that shows our Status for people, so
+// that they can tell whether things are working without reading logs.  The
+// page itself is static and polls STATUS_PATH.  Blocklists can be toggled from
+// it through the admin API, with the AdminToken entered in the page.
+func (client *Client) serveDashboard(resp http.ResponseWriter) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Write([]byte(dashboardHTML))
+}
+
+var dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>flashlight</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; vertical-align: top; }
+.ok { color: #2e7d32; }
+.bad { color: #c62828; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>flashlight <span id="state" class="muted">loading...</span></h1>
+<table>
+<tr><th>Upstream</th><td id="protocol"></td></tr>
+<tr><th>Fronting host</th><td id="host"></td></tr>
+<tr><th>Certificate</th><td id="cert"></td></tr>
+<tr><th>Throughput</th><td id="throughput"></td></tr>
+<tr><th>Transferred</th><td id="bytes"></td></tr>
+<tr><th>Uptime</th><td id="uptime"></td></tr>
+<tr><th>Clock offset</th><td id="clock"></td></tr>
+</table>
+<h2>Trends</h2>
+<ul id="trends"></ul>
+<h2>Servers</h2>
+<table id="upstreams"></table>
+<h2>Recent errors</h2>
+<table id="errors"></table>
+<div id="blocklistsection" style="display: none">
+<h2>Blocklists</h2>
+<table id="blocklists"></table>
+<p class="muted">Changing blocklists requires the admin token (-admintoken):
+<input type="password" id="admintoken" size="20">
+<span id="blocklisterror" class="bad"></span></p>
+</div>
+<script>
+var last = null;
+
+function text(id, value, className) {
+  var el = document.getElementById(id);
+  el.textContent = value;
+  el.className = className || "";
+}
+
+function formatBytes(n) {
+  var units = ["bytes", "KB", "MB", "GB", "TB"];
+  var i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i == 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function formatDuration(seconds) {
+  var h = Math.floor(seconds / 3600), m = Math.floor(seconds % 3600 / 60);
+  return h + "h " + m + "m " + seconds % 60 + "s";
+}
+
+function rows(id, header, items) {
+  var table = document.getElementById(id);
+  while (table.firstChild) {
+    table.removeChild(table.firstChild);
+  }
+  [header].concat(items).forEach(function(cells, i) {
+    var tr = document.createElement("tr");
+    cells.forEach(function(cell) {
+      var td = document.createElement(i == 0 ? "th" : "td");
+      td.textContent = cell;
+      tr.appendChild(td);
+    });
+    table.appendChild(tr);
+  });
+}
+
+function render(status) {
+  var now = Date.now();
+  text("state", status.protocol ? "running" : "starting", status.protocol ? "ok" : "muted");
+  text("protocol", status.protocol || "none yet");
+  text("host", status.host || "none dialed yet");
+  if (status.hostcertexpires) {
+    var expires = new Date(status.hostcertexpires);
+    var days = Math.floor((expires - now) / 86400000);
+    text("cert", "expires " + expires.toISOString().substring(0, 10) + " (" + days + " days)", days < 14 ? "bad" : "ok");
+  } else {
+    text("cert", "unknown", "muted");
+  }
+  if (last) {
+    var rate = (status.bytes - last.status.bytes) / ((now - last.time) / 1000);
+    text("throughput", formatBytes(Math.max(rate, 0)) + "/s");
+  }
+  text("bytes", formatBytes(status.bytes));
+  text("uptime", formatDuration(status.uptime));
+  text("clock", (status.clockoffset || 0) + " s", Math.abs(status.clockoffset || 0) > 60 ? "bad" : "");
+  var trends = document.getElementById("trends");
+  while (trends.firstChild) {
+    trends.removeChild(trends.firstChild);
+  }
+  (status.trends || []).forEach(function(trend) {
+    var li = document.createElement("li");
+    li.textContent = trend.text;
+    li.className = "bad";
+    trends.appendChild(li);
+  });
+  if (!trends.firstChild) {
+    var li = document.createElement("li");
+    li.textContent = "No recurring failures found";
+    li.className = "muted";
+    trends.appendChild(li);
+  }
+  rows("upstreams", ["Server", "Protocol", "Successes", "RTT (ms)", "Last error"], (status.upstreams || []).map(function(u) {
+    return [u.server + (u.via ? " via " + u.via : ""), u.protocol, u.successes + "/" + u.probes, u.rttms, u.lasterror || ""];
+  }));
+  rows("errors", ["Time", "Message"], (status.recenterrors || []).slice().reverse().map(function(e) {
+    return [new Date(e.time).toLocaleTimeString(), e.message];
+  }));
+  renderBlocklists(status.blocklists || []);
+  last = {status: status, time: now};
+}
+
+function renderBlocklists(lists) {
+  document.getElementById("blocklistsection").style.display = lists.length ? "" : "none";
+  rows("blocklists", ["Enabled", "List", "Hosts blocked"], lists.map(function(list) {
+    return ["", list.name, list.enabled ? list.hosts : ""];
+  }));
+  var table = document.getElementById("blocklists");
+  lists.forEach(function(list, i) {
+    var checkbox = document.createElement("input");
+    checkbox.type = "checkbox";
+    checkbox.checked = list.enabled;
+    checkbox.onchange = function() {
+      toggleBlocklist(list.name, checkbox.checked);
+    };
+    table.rows[i + 1].cells[0].appendChild(checkbox);
+  });
+}
+
+function toggleBlocklist(name, enabled) {
+  var token = document.getElementById("admintoken").value;
+  sessionStorage.setItem("admintoken", token);
+  var req = new XMLHttpRequest();
+  req.onload = function() {
+    text("blocklisterror", req.status == 204 ? "" : (req.status == 403 ? "wrong admin token" : req.responseText), "bad");
+    refresh();
+  };
+  req.onerror = function() {
+    text("blocklisterror", "not running", "bad");
+  };
+  req.open("POST", "` + ADMIN_BLOCKLISTS_PATH + `");
+  req.setRequestHeader("` + X_LANTERN_ADMIN_TOKEN + `", token);
+  req.send(JSON.stringify({name: name, enabled: enabled}));
+}
+
+function refresh() {
+  var req = new XMLHttpRequest();
+  req.onload = function() {
+    if (req.status == 200) {
+      render(JSON.parse(req.responseText));
+    } else {
+      text("state", "unavailable (" + req.status + ")", "bad");
+    }
+  };
+  req.onerror = function() {
+    text("state", "not running", "bad");
+  };
+  req.open("GET", "` + STATUS_PATH + `");
+  req.send();
+}
+
+document.getElementById("admintoken").value = sessionStorage.getItem("admintoken") || "";
+refresh();
+setInterval(refresh, ` + strconv.Itoa(DASHBOARD_REFRESH_INTERVAL) + `);
+</script>
+</body>
+</html>
+`
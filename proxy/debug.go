@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	runtimepprof "runtime/pprof"
+)
+
+const (
+	ADMIN_DEBUG_PATH      = "/admin/debug/"           // prefix under which admin listeners serve runtime debugging endpoints
+	ADMIN_PPROF_PATH      = "/admin/debug/pprof/"     // net/http/pprof profiles, e.g. /admin/debug/pprof/heap
+	ADMIN_VARS_PATH       = "/admin/debug/vars"       // expvar variables, including memstats
+	ADMIN_GOROUTINES_PATH = "/admin/debug/goroutines" // stacks of all goroutines, grouped with ?debug=1
+)
+
+// isDebugRequest indicates whether the given request is for the debugging
+// endpoints
+func isDebugRequest(req *http.Request) bool {
+	return req.URL.Host == "" && strings.HasPrefix(req.URL.Path, ADMIN_DEBUG_PATH)
+}
+
+// serveDebug serves pprof, expvar and goroutine dumps for diagnosing leaks.
+// These reveal a lot about the process and profiles are expensive, so on top
+// of the AdminToken, they're only served on admin listeners (see
+// serveAdminListener) and to loopback clients.  net/http/pprof and expvar also
+// register themselves with http.DefaultServeMux, which we never serve.
+func (client *Client) serveDebug(resp http.ResponseWriter, req *http.Request) {
+	if !client.isAuthorizedAdmin(req) || !isLoopback(req.RemoteAddr) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch path := req.URL.Path; {
+	case path == ADMIN_VARS_PATH:
+		expvar.Handler().ServeHTTP(resp, req)
+	case path == ADMIN_GOROUTINES_PATH:
+		debug := 2
+		if req.URL.Query().Get("debug") == "1" {
+			debug = 1
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(resp, debug)
+	case strings.HasPrefix(path, ADMIN_PPROF_PATH):
+		servePprof(resp, req, strings.TrimPrefix(path, ADMIN_PPROF_PATH))
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+// servePprof serves the pprof endpoint of the given name, with the index of
+// profiles for no name.  pprof.Index only finds profiles under /debug/pprof/,
+// so we look up the named ones ourselves.
+func servePprof(resp http.ResponseWriter, req *http.Request, name string) {
+	switch name {
+	case "":
+		pprof.Index(resp, req)
+	case "cmdline":
+		pprof.Cmdline(resp, req)
+	case "profile":
+		pprof.Profile(resp, req)
+	case "symbol":
+		pprof.Symbol(resp, req)
+	case "trace":
+		pprof.Trace(resp, req)
+	default:
+		if runtimepprof.Lookup(name) == nil {
+			http.NotFound(resp, req)
+			return
+		}
+		pprof.Handler(name).ServeHTTP(resp, req)
+	}
+}
+
+// isLoopback indicates whether the given remote address (ip:port) is a
+// loopback address
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
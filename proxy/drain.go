@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/accounting"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_DRAIN_TIMEOUT = 5 * time.Second
+	SESSIONS_NAME         = "sessions" // name of the session history in the SessionStore
+	SESSION_HISTORY       = 30         // number of sessions to keep in the history
+	SESSION_TOP_DOMAINS   = 20         // number of domains to keep per session
+	MAX_SESSION_DOMAINS   = 10000      // number of domains for which to accumulate stats during a session
+
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// Session summarizes a run of the client, for dashboards' history
+type Session struct {
+	Started time.Time               `json:"started"`
+	Ended   time.Time               `json:"ended"`
+	Tunnels int64                   `json:"tunnels"` // connections opened through us
+	Bytes   int64                   `json:"bytes"`   // sent and received
+	Drained int                     `json:"drained"` // connections that finished while draining
+	Closed  int                     `json:"closed"`  // connections still open after draining, which we closed
+	Domains map[string]*DomainStats `json:"domains,omitempty"`
+}
+
+// DomainStats are a Session's statistics for one destination host
+type DomainStats struct {
+	Tunnels int64 `json:"tunnels"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// connSet tracks the client's open connections, so that they can be drained
+// on shutdown, and accumulates the session's statistics
+type connSet struct {
+	recordDomains bool               // whether to accumulate per-domain stats
+	bandwidth     *accounting.Ledger // (optional) accumulates bytes per domain across sessions
+	conns         map[*drainableConn]bool
+	domains       map[string]*DomainStats
+	tunnels       int64
+	bytes         int64
+	mutex         sync.Mutex
+}
+
+// drainableConn is a connection tracked by a connSet
+type drainableConn struct {
+	net.Conn
+	set       *connSet
+	host      string
+	bytes     int64
+	closeOnce sync.Once
+}
+
+// track tracks the given connection to the given host (host:port), until
+// it's closed
+func (set *connSet) track(host string, conn net.Conn) net.Conn {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tracked := &drainableConn{Conn: conn, set: set, host: host}
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if set.conns == nil {
+		set.conns = make(map[*drainableConn]bool)
+		set.domains = make(map[string]*DomainStats)
+	}
+	set.conns[tracked] = true
+	set.tunnels++
+	return tracked
+}
+
+func (set *connSet) remove(conn *drainableConn) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	delete(set.conns, conn)
+	bytes := atomic.LoadInt64(&conn.bytes)
+	set.bytes += bytes
+	set.bandwidth.Add(conn.host, bytes)
+	if !set.recordDomains {
+		return
+	}
+	stats := set.domains[conn.host]
+	if stats == nil {
+		if len(set.domains) >= MAX_SESSION_DOMAINS {
+			return
+		}
+		stats = &DomainStats{}
+		set.domains[conn.host] = stats
+	}
+	stats.Tunnels++
+	stats.Bytes += bytes
+}
+
+// totalBytes returns the bytes sent and received so far, including on open
+// connections
+func (set *connSet) totalBytes() int64 {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	total := set.bytes
+	for conn := range set.conns {
+		total += atomic.LoadInt64(&conn.bytes)
+	}
+	return total
+}
+
+func (set *connSet) open() []*drainableConn {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	conns := make([]*drainableConn, 0, len(set.conns))
+	for conn := range set.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// drain waits up to timeout for open connections to finish and then closes
+// the rest, returning how many finished and how many it closed.  Closing our
+// end of tunnels promptly lets servers release their end rather than wait for
+// it to time out.
+func (set *connSet) drain(timeout time.Duration) (int, int) {
+	initial := len(set.open())
+	deadline := time.Now().Add(timeout)
+	for len(set.open()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	remaining := set.open()
+	for _, conn := range remaining {
+		conn.Close()
+	}
+	return initial - len(remaining), len(remaining)
+}
+
+// topDomains returns the session's SESSION_TOP_DOMAINS domains with the most
+// traffic
+func (set *connSet) topDomains() map[string]*DomainStats {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	hosts := make(byBytes, 0, len(set.domains))
+	for host, stats := range set.domains {
+		hosts = append(hosts, &domain{host, *stats})
+	}
+	sort.Sort(hosts)
+	if len(hosts) > SESSION_TOP_DOMAINS {
+		hosts = hosts[:SESSION_TOP_DOMAINS]
+	}
+	top := make(map[string]*DomainStats, len(hosts))
+	for _, d := range hosts {
+		top[d.host] = &d.stats
+	}
+	return top
+}
+
+type domain struct {
+	host  string
+	stats DomainStats
+}
+
+// byBytes sorts domains by descending traffic
+type byBytes []*domain
+
+func (a byBytes) Len() int           { return len(a) }
+func (a byBytes) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byBytes) Less(i, j int) bool { return a[i].stats.Bytes > a[j].stats.Bytes }
+
+func (conn *drainableConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.bytes, int64(n))
+	return n, err
+}
+
+func (conn *drainableConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.bytes, int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the connection if it supports that, or closes it
+// otherwise
+func (conn *drainableConn) CloseWrite() error {
+	if cw, ok := conn.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+func (conn *drainableConn) Close() error {
+	err := conn.Conn.Close()
+	conn.closeOnce.Do(func() {
+		conn.set.remove(conn)
+	})
+	return err
+}
+
+// Shutdown stops listening at Addr and taking new http proxy requests on
+// open connections, drains the open tunnels for up to drainTimeout
+// (DEFAULT_DRAIN_TIMEOUT if 0) and returns a summary of the session, which is
+// also added to the history in our SessionStore, if any.
+func (client *Client) Shutdown(drainTimeout time.Duration) *Session {
+	if drainTimeout == 0 {
+		drainTimeout = DEFAULT_DRAIN_TIMEOUT
+	}
+	atomic.StoreInt32(&client.draining, 1)
+	if err := client.Close(); err != nil {
+		log.Debugf("Unable to stop listening at %s: %s", client.Addr, err)
+	}
+	drained, closed := client.conns.drain(drainTimeout)
+	log.Debugf("Drained %d connection(s), closed %d", drained, closed)
+	if err := client.Bandwidth.Save(); err != nil {
+		log.Error(err)
+	}
+
+	session := client.CurrentSession()
+	session.Drained = drained
+	session.Closed = closed
+	if client.SessionStore != nil {
+		if err := client.saveSession(session); err != nil {
+			log.Errorf("Unable to save session: %s", err)
+		}
+	}
+	return session
+}
+
+// CurrentSession summarizes the session so far
+func (client *Client) CurrentSession() *Session {
+	client.conns.mutex.Lock()
+	session := &Session{
+		Started: client.started,
+		Ended:   time.Now(),
+		Tunnels: client.conns.tunnels,
+		Bytes:   client.conns.bytes,
+	}
+	client.conns.mutex.Unlock()
+	session.Domains = client.conns.topDomains()
+	return session
+}
+
+// isDraining indicates whether we're shutting down
+func (client *Client) isDraining() bool {
+	return atomic.LoadInt32(&client.draining) == 1
+}
+
+// saveSession adds the given session to the history in our SessionStore,
+// keeping the latest SESSION_HISTORY sessions
+func (client *Client) saveSession(session *Session) error {
+	var sessions []*Session
+	err := client.SessionStore.Load(SESSIONS_NAME, &sessions)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to load session history, starting a new one: %s", err)
+	}
+	sessions = append(sessions, session)
+	if len(sessions) > SESSION_HISTORY {
+		sessions = sessions[len(sessions)-SESSION_HISTORY:]
+	}
+	return client.SessionStore.Save(SESSIONS_NAME, sessions)
+}
+
+// drainableResponseWriter is an http.ResponseWriter whose hijacked connection
+// (e.g. for CONNECT) is tracked by a connSet
+type drainableResponseWriter struct {
+	http.ResponseWriter
+	set  *connSet
+	host string
+}
+
+func (resp *drainableResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := resp.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Unable to hijack connection")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = resp.set.track(resp.host, conn)
+	// Make sure that reads and writes through rw also go through the
+	// tracked connection, starting with whatever was already buffered
+	buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+	reader := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), conn)
+	rw = bufio.NewReadWriter(bufio.NewReader(reader), bufio.NewWriter(conn))
+	return conn, rw, nil
+}
+
+// serverConns tracks the states of a Server's connections from clients (and
+// fronting providers), so that it can drain them on shutdown
+type serverConns struct {
+	states map[net.Conn]http.ConnState
+	mutex  sync.Mutex
+}
+
+// track is an http.Server's ConnState hook
+func (conns *serverConns) track(conn net.Conn, state http.ConnState) {
+	conns.mutex.Lock()
+	defer conns.mutex.Unlock()
+	if conns.states == nil {
+		conns.states = make(map[net.Conn]http.ConnState)
+	}
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(conns.states, conn)
+	default:
+		conns.states[conn] = state
+	}
+}
+
+// closeIdle closes the connections that aren't in the middle of a request and
+// returns how many are
+func (conns *serverConns) closeIdle() int {
+	conns.mutex.Lock()
+	defer conns.mutex.Unlock()
+	active := 0
+	for conn, state := range conns.states {
+		if state == http.StateActive {
+			active++
+		} else {
+			conn.Close()
+			delete(conns.states, conn)
+		}
+	}
+	return active
+}
+
+// drain waits up to timeout for in-flight requests to finish, closing
+// connections as they go idle, and then closes the rest, returning how many
+// requests finished and how many connections it closed in the middle of one
+func (conns *serverConns) drain(timeout time.Duration) (int, int) {
+	initial := conns.closeIdle()
+	active := initial
+	deadline := time.Now().Add(timeout)
+	for active > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+		active = conns.closeIdle()
+	}
+	conns.mutex.Lock()
+	defer conns.mutex.Unlock()
+	for conn := range conns.states {
+		conn.Close()
+	}
+	conns.states = nil
+	return initial - active, active
+}
+
+// Shutdown stops accepting connections, waits up to drainTimeout
+// (DEFAULT_DRAIN_TIMEOUT if 0) for in-flight requests to finish and closes
+// the connections that are left, after which Run returns without an error.
+// It returns how many requests finished and how many connections it closed in
+// the middle of one.
+func (server *Server) Shutdown(drainTimeout time.Duration) (int, int) {
+	if drainTimeout == 0 {
+		drainTimeout = DEFAULT_DRAIN_TIMEOUT
+	}
+	server.listenerMutex.Lock()
+	atomic.StoreInt32(&server.draining, 1)
+	if server.listener != nil {
+		server.httpServer.SetKeepAlivesEnabled(false)
+		server.listener.Close()
+	}
+	server.listenerMutex.Unlock()
+	drained, closed := server.conns.drain(drainTimeout)
+	log.Debugf("Drained %d request(s), closed %d connection(s)", drained, closed)
+	return drained, closed
+}
+
+// isDraining indicates whether we're shutting down
+func (server *Server) isDraining() bool {
+	return atomic.LoadInt32(&server.draining) == 1
+}
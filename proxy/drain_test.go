@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/store"
+)
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.New(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{SessionStore: s}
+	client.conns.recordDomains = true
+
+	finishing, finishingPeer := net.Pipe()
+	defer finishingPeer.Close()
+	finishing = client.conns.track("example.com:80", finishing)
+	stuck, stuckPeer := net.Pipe()
+	defer stuckPeer.Close()
+	stuck = client.conns.track("example.org:443", stuck)
+
+	go func() {
+		buf := make([]byte, 5)
+		finishingPeer.Read(buf)
+	}()
+	finishing.Write([]byte("hello"))
+	time.AfterFunc(50*time.Millisecond, func() {
+		finishing.Close()
+	})
+
+	session := client.Shutdown(500 * time.Millisecond)
+	if session.Drained != 1 || session.Closed != 1 {
+		t.Errorf("Expected 1 drained and 1 closed connection, got %d and %d", session.Drained, session.Closed)
+	}
+	if _, err := stuck.Write([]byte("x")); err == nil {
+		t.Error("Stuck connection should have been closed")
+	}
+	if session.Tunnels != 2 || session.Domains["example.com"] == nil || session.Domains["example.com"].Bytes != 5 {
+		t.Errorf("Unexpected session: %+v", session)
+	}
+
+	var sessions []*Session
+	if err := s.Load(SESSIONS_NAME, &sessions); err != nil || len(sessions) != 1 {
+		t.Errorf("Session should have been saved to the history: %s", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := &Server{}
+	stuck := make(chan bool)
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/stuck" {
+			<-stuck
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	httpServer.Config.ConnState = server.conns.track
+	httpServer.Start()
+	defer httpServer.Close()
+	defer close(stuck)
+	server.listener = httpServer.Listener
+	server.httpServer = httpServer.Config
+
+	// An idle keep-alive connection, which gets closed right away
+	if resp, err := http.Get(httpServer.URL + "/idle"); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+	finished := make(chan error, 2)
+	for _, path := range []string{"/finishing", "/stuck"} {
+		go func(path string) {
+			resp, err := (&http.Client{Transport: &http.Transport{}}).Get(httpServer.URL + path)
+			if err == nil {
+				resp.Body.Close()
+			}
+			finished <- err
+		}(path)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	drained, closed := server.Shutdown(500 * time.Millisecond)
+	if drained != 1 || closed != 1 {
+		t.Errorf("Expected 1 drained request and 1 closed connection, got %d and %d", drained, closed)
+	}
+	if !server.isDraining() || server.checkHealth().Checks[0].OK {
+		t.Errorf("Server should be draining")
+	}
+	if _, err := net.DialTimeout("tcp", httpServer.Listener.Addr().String(), time.Second); err == nil {
+		t.Errorf("Server shouldn't accept connections after shutting down")
+	}
+	errors := 0
+	for i := 0; i < 2; i++ {
+		if <-finished != nil {
+			errors++
+		}
+	}
+	if errors != 1 {
+		t.Errorf("Only the stuck request should have failed, got %d failures", errors)
+	}
+}
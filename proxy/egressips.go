@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	MIN_ROTATION_INTERVAL = 10 * time.Minute // rotations within this interval of the last one are ignored
+)
+
+// EgressIPs are the local IPs from which the server egresses.  It uses one at
+// a time and rotates to the next one when the current one appears to be
+// blocked (see packages feedback and reputation).
+type EgressIPs struct {
+	// RotateCommand (optional) is run when rotating, e.g. to allocate a new
+	// IP through a cloud provider's API and assign it to an interface.  If
+	// it prints an IP, we switch to that IP, otherwise we rotate among the
+	// IPs that we already have.
+	RotateCommand string
+
+	ips         []net.IP
+	current     int
+	lastRotated time.Time
+	mutex       sync.Mutex
+}
+
+// NewEgressIPs creates EgressIPs that rotate among the given IPs
+func NewEgressIPs(ips []net.IP) *EgressIPs {
+	return &EgressIPs{ips: ips}
+}
+
+// Rotate switches to a new IP, unless we rotated within the last
+// MIN_ROTATION_INTERVAL (so that a burst of blocked origins doesn't cycle us
+// back to the IP that they're blocking).  It is safe to call on a nil
+// EgressIPs.
+func (e *EgressIPs) Rotate() {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	if time.Now().Sub(e.lastRotated) < MIN_ROTATION_INTERVAL {
+		e.mutex.Unlock()
+		return
+	}
+	e.lastRotated = time.Now()
+	e.mutex.Unlock()
+
+	var allocated net.IP
+	if e.RotateCommand != "" {
+		var err error
+		allocated, err = e.runRotateCommand()
+		if err != nil {
+			log.Errorf("Unable to run egress IP rotation command: %s", err)
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if allocated != nil {
+		e.current = len(e.ips)
+		for i, ip := range e.ips {
+			if ip.Equal(allocated) {
+				e.current = i
+			}
+		}
+		if e.current == len(e.ips) {
+			e.ips = append(e.ips, allocated)
+		}
+	} else if len(e.ips) > 1 {
+		e.current = (e.current + 1) % len(e.ips)
+	} else {
+		log.Debug("No other egress IPs to rotate to")
+		return
+	}
+	log.Debugf("Rotated egress IP to %s", e.ips[e.current])
+}
+
+// runRotateCommand runs the RotateCommand and returns the IP that it printed,
+// if any
+func (e *EgressIPs) runRotateCommand() (net.IP, error) {
+	args := strings.Fields(e.RotateCommand)
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(strings.TrimSpace(string(out))), nil
+}
+
+// dial dials the given addr from the current IP.  Hostnames are resolved to
+// the family of the current IP.  If the current IP is of a different family
+// than a destination IP, it lets the OS pick the source address.  It is safe
+// to call on a nil EgressIPs.
+func (e *EgressIPs) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	network := "tcp"
+	if local := e.currentIP(); local != nil {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			isIPv4 := local.To4() != nil
+			dest := net.ParseIP(host)
+			if dest == nil {
+				dialer.LocalAddr = &net.TCPAddr{IP: local}
+				network = "tcp6"
+				if isIPv4 {
+					network = "tcp4"
+				}
+			} else if (dest.To4() != nil) == isIPv4 {
+				dialer.LocalAddr = &net.TCPAddr{IP: local}
+			}
+		}
+	}
+	return dialer.Dial(network, addr)
+}
+
+// currentIP returns the current IP, or nil if we don't have any
+func (e *EgressIPs) currentIP() net.IP {
+	if e == nil {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.ips) == 0 {
+		return nil
+	}
+	return e.ips[e.current]
+}
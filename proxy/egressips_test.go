@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEgressIPRotation(t *testing.T) {
+	e := NewEgressIPs([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")})
+	e.Rotate()
+	if !e.currentIP().Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Expected rotation to second IP, got %s", e.currentIP())
+	}
+	e.Rotate()
+	if !e.currentIP().Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Rotation within MIN_ROTATION_INTERVAL should be ignored")
+	}
+
+	e.lastRotated = time.Time{}
+	e.RotateCommand = "echo 10.0.0.9"
+	e.Rotate()
+	if !e.currentIP().Equal(net.ParseIP("10.0.0.9")) {
+		t.Errorf("Expected rotation to allocated IP, got %s", e.currentIP())
+	}
+	if len(e.ips) != 3 {
+		t.Errorf("Expected allocated IP to be added, have %v", e.ips)
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/flashlight/feedback"
+)
+
+// feedbackConn is a tunneled connection that reports its destination to a
+// feedback.Reporter if it looks like the destination refused us: either the
+// connection closed before we received anything, or the destination responded
+// to plain http with a status that origins use for blocking.
+type feedbackConn struct {
+	net.Conn
+	addr     string
+	reporter *feedback.Reporter
+	wrote    bool
+	sniffed  bool
+}
+
+func (conn *feedbackConn) Write(b []byte) (int, error) {
+	conn.wrote = true
+	return conn.Conn.Write(b)
+}
+
+func (conn *feedbackConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if !conn.sniffed && (n > 0 || err != nil) {
+		conn.sniffed = true
+		if n == 0 {
+			if conn.wrote {
+				conn.reporter.Record(conn.addr, "closed")
+			}
+		} else if status := sniffStatus(b[:n]); isBlockingStatus(status) {
+			conn.reporter.Record(conn.addr, strconv.Itoa(status))
+		}
+	}
+	return n, err
+}
+
+// sniffStatus returns the status code if b starts with an HTTP status line,
+// or 0 otherwise
+func sniffStatus(b []byte) int {
+	// Status line looks like "HTTP/1.1 403 Forbidden"
+	fields := bytes.Fields(b)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return 0
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0
+	}
+	return status
+}
+
+func isBlockingStatus(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusTooManyRequests || status == 451
+}
+
+// sendFeedback sends the given report to the server
+func (client *Client) sendFeedback(report *feedback.Report) error {
+	config := client.enproxyConfig("")
+	conn, err := config.DialProxy("")
+	if err != nil {
+		return fmt.Errorf("Unable to dial server: %s", err)
+	}
+	defer conn.Close()
+	req, err := config.NewRequest("", "POST", nil)
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	err = feedback.PrepareRequest(req, client.FeedbackToken, report)
+	if err != nil {
+		return err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return fmt.Errorf("Unable to send feedback: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("Unable to read feedback response: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Server rejected feedback: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_ORIGIN_INTERVAL = 10 * time.Second // how long to reuse the result of checking the HealthOrigin
+	HEALTH_ORIGIN_TIMEOUT  = 5 * time.Second
+)
+
+// Health is our readiness, as reported at the HealthPath
+type Health struct {
+	Ready  bool           `json:"ready"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+// HealthCheck is the result of one of the checks that make up our readiness
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// originHealth caches the result of checking whether the HealthOrigin is
+// reachable, so that frequent health checks don't each dial it
+type originHealth struct {
+	checked time.Time
+	err     error
+	mutex   sync.Mutex
+}
+
+// isHealthRequest indicates whether the given request is a load balancer's
+// health check, which is answered before the Protocol rewrites the request
+// and tenants are selected
+func (server *Server) isHealthRequest(req *http.Request) bool {
+	return server.HealthPath != "" && req.URL.Path == server.HealthPath && (req.Method == "GET" || req.Method == "HEAD")
+}
+
+// serveHealth reports our readiness as JSON, with status 200 if we're ready
+// and 503 if we're not
+func (server *Server) serveHealth(resp http.ResponseWriter, req *http.Request) {
+	health := server.checkHealth()
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-cache")
+	if health.Ready {
+		resp.WriteHeader(http.StatusOK)
+	} else {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if req.Method != "HEAD" {
+		json.NewEncoder(resp).Encode(health)
+	}
+}
+
+// checkHealth checks that our listener is up (which it is if we're
+// answering, unless we're shutting down), that our server cert is valid
+// and, if we have a HealthOrigin, that it's reachable
+func (server *Server) checkHealth() *Health {
+	health := &Health{Ready: true}
+	add := func(name string, err error, detail string) {
+		check := &HealthCheck{Name: name, OK: err == nil, Detail: detail}
+		if err != nil {
+			check.Detail = err.Error()
+			health.Ready = false
+		}
+		health.Checks = append(health.Checks, check)
+	}
+	var draining error
+	if server.isDraining() {
+		draining = fmt.Errorf("Shutting down")
+	}
+	add("listener", draining, server.Addr)
+	expiry, err := server.checkServerCert()
+	add("cert", err, expiry)
+	if server.HealthOrigin != "" {
+		add("origin", server.originHealth.check(server), server.HealthOrigin)
+	}
+	return health
+}
+
+// checkServerCert checks that the cert we serve hasn't expired, returning
+// when it expires
+func (server *Server) checkServerCert() (string, error) {
+	if server.CertContext == nil {
+		return "", fmt.Errorf("No server cert")
+	}
+	data, err := ioutil.ReadFile(server.CertContext.ServerCertFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read server cert: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("Server cert %s is not PEM", server.CertContext.ServerCertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse server cert: %s", err)
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return "", fmt.Errorf("Server cert is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return "", fmt.Errorf("Server cert expired %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("expires %s", cert.NotAfter.Format(time.RFC3339)), nil
+}
+
+// check dials the server's HealthOrigin from our egress IP, unless it was
+// checked within the last HEALTH_ORIGIN_INTERVAL
+func (origin *originHealth) check(server *Server) error {
+	origin.mutex.Lock()
+	defer origin.mutex.Unlock()
+	if time.Now().Sub(origin.checked) < HEALTH_ORIGIN_INTERVAL {
+		return origin.err
+	}
+	conn, err := server.EgressIPs.dial(server.HealthOrigin, HEALTH_ORIGIN_TIMEOUT)
+	if err != nil {
+		origin.err = fmt.Errorf("Unable to reach %s: %s", server.HealthOrigin, err)
+	} else {
+		conn.Close()
+		origin.err = nil
+	}
+	origin.checked = time.Now()
+	return origin.err
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	certFile, err := ioutil.TempFile("", "servercert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(certFile.Name())
+	writeCert := func(notAfter time.Time) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: notAfter.Add(-time.Hour), NotAfter: notAfter}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(certFile.Name(), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	}
+
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		ProxyConfig:  ProxyConfig{Addr: ":443"},
+		CertContext:  &CertContext{ServerCertFile: certFile.Name()},
+		HealthPath:   "/healthz",
+		HealthOrigin: origin.Addr().String(),
+	}
+	check := func(expectedStatus int) *Health {
+		req, _ := http.NewRequest("GET", "https://fl1.example.org/healthz", nil)
+		if !server.isHealthRequest(req) {
+			t.Fatalf("%s should be a health check", req.URL)
+		}
+		resp := httptest.NewRecorder()
+		server.serveHealth(resp, req)
+		if resp.Code != expectedStatus {
+			t.Errorf("Expected %d, got %d: %s", expectedStatus, resp.Code, resp.Body)
+		}
+		health := &Health{}
+		if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+			t.Fatal(err)
+		}
+		return health
+	}
+
+	writeCert(time.Now().Add(time.Hour))
+	if health := check(http.StatusOK); !health.Ready || len(health.Checks) != 3 {
+		t.Errorf("Unexpected health: %+v", health)
+	}
+
+	// The origin's last result is reused until HEALTH_ORIGIN_INTERVAL passes
+	origin.Close()
+	check(http.StatusOK)
+	server.originHealth.checked = time.Time{}
+	if health := check(http.StatusServiceUnavailable); health.Checks[2].OK {
+		t.Errorf("Closed origin shouldn't be reachable")
+	}
+
+	server.HealthOrigin = ""
+	writeCert(time.Now().Add(-time.Minute))
+	if health := check(http.StatusServiceUnavailable); len(health.Checks) != 2 || health.Checks[1].OK {
+		t.Errorf("Expired cert shouldn't be healthy: %+v", health)
+	}
+
+	req, _ := http.NewRequest("POST", "https://fl1.example.org/healthz", nil)
+	if server.isHealthRequest(req) {
+		t.Errorf("Only GETs and HEADs should be health checks")
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/identity"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	IDENTITY_RETRY_INTERVAL = 10 * time.Second
+	IDENTITY_CHECK_INTERVAL = 1 * time.Hour // how often to check again, since fronts may start routing elsewhere
+)
+
+// proveIdentity answers an identity challenge with the cert that we serve
+func (server *Server) proveIdentity(resp http.ResponseWriter, req *http.Request) {
+	cert, err := server.CertContext.GetCertificate(nil)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	identity.Serve(resp, req, cert)
+}
+
+// keepVerifyingServers verifies that each server has a key pinned with
+// ServerPins, retrying those that fail (or that we don't reach) every
+// IDENTITY_RETRY_INTERVAL, and checking all of them again every
+// IDENTITY_CHECK_INTERVAL, until stop is closed.  We don't tunnel through a
+// server that fails.
+func (client *Client) keepVerifyingServers(stop chan bool) {
+	defer crash.Recover()
+	reverify := client.reverifyRequests()
+	var lastFull time.Time
+	for {
+		full := time.Now().Sub(lastFull) >= IDENTITY_CHECK_INTERVAL
+		if full {
+			lastFull = time.Now()
+		}
+		next := IDENTITY_CHECK_INTERVAL - time.Now().Sub(lastFull)
+		configs := client.serverConfigs()
+		client.forgetServersExcept(configs)
+		for name, config := range configs {
+			if !full && client.ServerVerified(name) {
+				continue
+			}
+			err := client.verifyServer(config)
+			client.setServerVerified(name, err)
+			if err != nil {
+				log.Errorf("Not tunneling through %s, retrying in %v: %s", name, IDENTITY_RETRY_INTERVAL, err)
+				next = IDENTITY_RETRY_INTERVAL
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-reverify:
+		case <-time.After(next):
+		}
+	}
+}
+
+// VerifyServers asks to verify the identities of servers that aren't verified
+// yet right away, e.g. once the servers change.  It does nothing without
+// ServerPins.
+func (client *Client) VerifyServers() {
+	select {
+	case client.reverifyRequests() <- true:
+	default:
+		// Already asked
+	}
+}
+
+// reverifyRequests returns the channel on which VerifyServers asks to verify
+// the servers
+func (client *Client) reverifyRequests() chan bool {
+	client.identityMutex.Lock()
+	defer client.identityMutex.Unlock()
+	if client.reverify == nil {
+		client.reverify = make(chan bool, 1)
+	}
+	return client.reverify
+}
+
+// serverConfigs returns the configs for reaching each server by name (see
+// ServerConfigs)
+func (client *Client) serverConfigs() map[string]*enproxy.Config {
+	if client.ServerConfigs == nil {
+		return map[string]*enproxy.Config{"server": client.enproxyConfig("")}
+	}
+	configs := client.ServerConfigs()
+	for name, config := range configs {
+		configs[name] = client.wrapEnproxyConfig(config)
+	}
+	return configs
+}
+
+// verifyServer challenges the server reached with the given config to prove
+// that it has a key pinned with ServerPins
+func (client *Client) verifyServer(config *enproxy.Config) error {
+	conn, err := config.DialProxy("")
+	if err != nil {
+		return fmt.Errorf("Unable to dial server: %s", err)
+	}
+	defer conn.Close()
+	req, err := config.NewRequest("", "GET", nil)
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	nonce, err := identity.PrepareRequest(req)
+	if err != nil {
+		return err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return fmt.Errorf("Unable to send identity challenge: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("Unable to read identity proof: %s", err)
+	}
+	return identity.ReadResponse(resp, nonce, client.ServerPins)
+}
+
+// setServerVerified records whether the named server's identity is verified
+// (nil) or why not
+func (client *Client) setServerVerified(name string, err error) {
+	client.identityMutex.Lock()
+	previous, known := client.identityErrs[name]
+	if client.identityErrs == nil {
+		client.identityErrs = make(map[string]error)
+	}
+	client.identityErrs[name] = err
+	client.identityMutex.Unlock()
+	if err == nil && (!known || previous != nil) {
+		log.Debugf("Verified identity of %s", name)
+	}
+}
+
+// forgetServersExcept forgets whether servers other than the given ones are
+// verified, e.g. once they've been replaced
+func (client *Client) forgetServersExcept(configs map[string]*enproxy.Config) {
+	client.identityMutex.Lock()
+	defer client.identityMutex.Unlock()
+	for name := range client.identityErrs {
+		if _, found := configs[name]; !found {
+			delete(client.identityErrs, name)
+		}
+	}
+}
+
+// ServerVerified indicates whether we may tunnel through the named server,
+// which we may unless ServerPins are set and it hasn't proven its identity
+// (yet).
+func (client *Client) ServerVerified(name string) bool {
+	if len(client.ServerPins) == 0 {
+		return true
+	}
+	client.identityMutex.RLock()
+	defer client.identityMutex.RUnlock()
+	err, known := client.identityErrs[name]
+	return known && err == nil
+}
+
+// serverVerifiedErr returns why we can't tunnel at all because no server's
+// identity is verified, or nil if we can
+func (client *Client) serverVerifiedErr() error {
+	if len(client.ServerPins) == 0 {
+		return nil
+	}
+	client.identityMutex.RLock()
+	defer client.identityMutex.RUnlock()
+	var lastErr error
+	for _, err := range client.identityErrs {
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		return fmt.Errorf("Server identity not verified yet")
+	}
+	return lastErr
+}
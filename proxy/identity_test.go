@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/identity"
+)
+
+func TestVerifyServersSeparately(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fl1.example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Unable to create cert: %s", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		identity.Serve(resp, req, cert)
+	}))
+	defer server.Close()
+
+	newRequest := func(host string, method string, body io.Reader) (*http.Request, error) {
+		return http.NewRequest(method, "http://"+server.Listener.Addr().String()+"/", body)
+	}
+	good := &enproxy.Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		},
+		NewRequest: newRequest,
+	}
+	bad := &enproxy.Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("Unreachable")
+		},
+		NewRequest: newRequest,
+	}
+	configs := map[string]*enproxy.Config{"fl1": good, "fl2": bad}
+	var configsMutex sync.Mutex
+	client := &Client{
+		ServerPins: []string{identity.Fingerprint(leaf)},
+		ServerConfigs: func() map[string]*enproxy.Config {
+			configsMutex.Lock()
+			defer configsMutex.Unlock()
+			copied := make(map[string]*enproxy.Config)
+			for name, config := range configs {
+				copied[name] = config
+			}
+			return copied
+		},
+	}
+	if client.serverVerifiedErr() == nil {
+		t.Errorf("Servers shouldn't be verified before they're checked")
+	}
+	stop := make(chan bool)
+	defer close(stop)
+	go client.keepVerifyingServers(stop)
+	waitFor := func(condition func() bool) bool {
+		for i := 0; i < 100 && !condition(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return condition()
+	}
+
+	if !waitFor(func() bool { return client.ServerVerified("fl1") }) {
+		t.Fatalf("fl1 should have been verified")
+	}
+	if client.ServerVerified("fl2") {
+		t.Errorf("fl2 shouldn't be verified")
+	}
+	if err := client.serverVerifiedErr(); err != nil {
+		t.Errorf("One failed server shouldn't stop tunneling: %s", err)
+	}
+
+	configsMutex.Lock()
+	delete(configs, "fl1")
+	configsMutex.Unlock()
+	client.VerifyServers()
+	if !waitFor(func() bool { return client.serverVerifiedErr() != nil }) {
+		t.Errorf("Without a verified server, tunneling should stop")
+	}
+}
+
+func TestUnverifiedServerRefusesConnect(t *testing.T) {
+	dialed := false
+	client := &Client{
+		ServerPins: []string{"unknown"},
+		EnproxyConfig: &enproxy.Config{
+			DialProxy: func(addr string) (net.Conn, error) {
+				dialed = true
+				return nil, fmt.Errorf("Shouldn't dial")
+			},
+			NewRequest: func(host string, method string, body io.Reader) (*http.Request, error) {
+				return http.NewRequest(method, "http://"+host+"/", body)
+			},
+		},
+	}
+	client.buildReverseProxy()
+
+	req := httptest.NewRequest("CONNECT", "http://example.com:443", nil)
+	req.Host = "example.com:443"
+	resp := httptest.NewRecorder()
+	client.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadGateway {
+		t.Errorf("CONNECT through an unverified server should be refused, got %d", resp.Code)
+	}
+	if dialed {
+		t.Errorf("Unverified server shouldn't have been dialed")
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	KEY_TYPE_ECDSA   = "ecdsa"
+	KEY_TYPE_RSA     = "rsa"
+	KEY_TYPE_ED25519 = "ed25519"
+
+	DEFAULT_KEY_TYPE  = KEY_TYPE_ECDSA
+	DEFAULT_RSA_BITS  = 2048
+	DEFAULT_EC_CURVE  = 256
+	MIN_RSA_BITS      = 2048
+	CERT_ORGANIZATION = "Lantern"
+)
+
+var (
+	curves = map[int]elliptic.Curve{
+		256: elliptic.P256(),
+		384: elliptic.P384(),
+		521: elliptic.P521(),
+	}
+)
+
+// CheckKeyParams checks that we can generate keys of the given type and size
+// (bits for rsa, curve size for ecdsa, unused for ed25519).  A keyType of ""
+// means DEFAULT_KEY_TYPE and a keySize of 0 the default size for the type.
+func CheckKeyParams(keyType string, keySize int) error {
+	switch keyType {
+	case "", KEY_TYPE_ECDSA:
+		if _, found := curves[keySize]; !found && keySize != 0 {
+			return fmt.Errorf("Unsupported ecdsa curve size %d, use 256, 384 or 521", keySize)
+		}
+	case KEY_TYPE_RSA:
+		if keySize != 0 && keySize < MIN_RSA_BITS {
+			return fmt.Errorf("rsa keys must have at least %d bits, not %d", MIN_RSA_BITS, keySize)
+		}
+	case KEY_TYPE_ED25519:
+		if keySize != 0 {
+			return fmt.Errorf("ed25519 keys have a fixed size")
+		}
+	default:
+		return fmt.Errorf("Unknown key type %s, use ecdsa, rsa or ed25519", keyType)
+	}
+	return nil
+}
+
+// GeneratePK generates a private key of the given type and size, as accepted
+// by CheckKeyParams
+func GeneratePK(keyType string, keySize int) (crypto.Signer, error) {
+	if err := CheckKeyParams(keyType, keySize); err != nil {
+		return nil, err
+	}
+	switch keyType {
+	case KEY_TYPE_RSA:
+		if keySize == 0 {
+			keySize = DEFAULT_RSA_BITS
+		}
+		return rsa.GenerateKey(rand.Reader, keySize)
+	case KEY_TYPE_ED25519:
+		_, pk, err := ed25519.GenerateKey(rand.Reader)
+		return pk, err
+	default:
+		if keySize == 0 {
+			keySize = DEFAULT_EC_CURVE
+		}
+		return ecdsa.GenerateKey(curves[keySize], rand.Reader)
+	}
+}
+
+// LoadPK loads a PEM encoded private key from the given file.  Besides PKCS8,
+// it reads the PKCS1 rsa keys that we used to generate and SEC1 ecdsa keys.
+func LoadPK(filename string) (crypto.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM encoded private key in %s", filename)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := pk.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported private key %T in %s", pk, filename)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %s in %s", block.Type, filename)
+	}
+}
+
+// WritePK writes the given private key to the given file, PEM encoded, in the
+// format that LoadPK reads.  Only we can read the file.
+func WritePK(pk crypto.Signer, filename string) error {
+	var block *pem.Block
+	switch key := pk.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(pk)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	return ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600)
+}
+
+// DescribePK describes the type and size of the given private key, e.g.
+// "ecdsa P-256" or "rsa 2048"
+func DescribePK(pk crypto.Signer) string {
+	switch key := pk.(type) {
+	case *rsa.PrivateKey:
+		return fmt.Sprintf("%s %d", KEY_TYPE_RSA, key.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return fmt.Sprintf("%s %s", KEY_TYPE_ECDSA, key.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return KEY_TYPE_ED25519
+	default:
+		return fmt.Sprintf("%T", pk)
+	}
+}
+
+// selfSignedCert creates a certificate for host that's signed by pk and
+// valid until validUntil.  It's its own root, so clients can trust it with
+// -rootca.
+func selfSignedCert(pk crypto.Signer, host string, validUntil time.Time) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate serial number: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{CERT_ORGANIZATION},
+			CommonName:   host,
+		},
+		NotBefore:             time.Now().AddDate(0, -1, 0),
+		NotAfter:              validUntil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if _, isRSA := pk.(*rsa.PrivateKey); isRSA {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pk.Public(), pk)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create certificate: %s", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// writeCert writes the given certificate to the given file, PEM encoded
+func writeCert(cert *x509.Certificate, filename string) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return ioutil.WriteFile(filename, certPEM, 0644)
+}
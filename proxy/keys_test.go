@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, params := range []struct {
+		keyType     string
+		keySize     int
+		description string
+	}{
+		{"", 0, "ecdsa P-256"},
+		{KEY_TYPE_ECDSA, 384, "ecdsa P-384"},
+		{KEY_TYPE_RSA, 0, "rsa 2048"},
+		{KEY_TYPE_ED25519, 0, "ed25519"},
+	} {
+		ctx := &CertContext{
+			PKFile:         filepath.Join(dir, params.description+".pem"),
+			ServerCertFile: filepath.Join(dir, params.description+"-cert.pem"),
+			KeyType:        params.keyType,
+			KeySize:        params.keySize,
+		}
+		if err := ctx.initServerCert("fl1.example.org"); err != nil {
+			t.Fatalf("Unable to init %s cert: %s", params.description, err)
+		}
+		pk, err := LoadPK(ctx.PKFile)
+		if err != nil {
+			t.Fatalf("Unable to load %s key: %s", params.description, err)
+		}
+		if DescribePK(pk) != params.description {
+			t.Errorf("Expected %s key, got %s", params.description, DescribePK(pk))
+		}
+		cert := ctx.Certificate()
+		if cert == nil || cert.Subject.CommonName != "fl1.example.org" || cert.NotAfter.Before(time.Now().Add(SERVER_CERT_VALIDITY-time.Hour)) {
+			t.Errorf("Unexpected %s cert: %v", params.description, cert)
+			continue
+		}
+		if err := cert.CheckSignatureFrom(cert); err != nil {
+			t.Errorf("%s cert isn't self-signed: %s", params.description, err)
+		}
+	}
+}
+
+func TestLegacyRSAKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Older versions wrote PKCS1 rsa keys, which we keep using even though we
+	// now generate ecdsa keys by default
+	legacy, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkFile := filepath.Join(dir, "proxypk.pem")
+	legacyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(legacy)})
+	if err := ioutil.WriteFile(pkFile, legacyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &CertContext{PKFile: pkFile, ServerCertFile: filepath.Join(dir, "servercert.pem")}
+	if err := ctx.initServerCert("fl1.example.org"); err != nil {
+		t.Fatalf("Unable to init cert with legacy key: %s", err)
+	}
+	if pub, ok := ctx.Certificate().PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(legacy.N) != 0 {
+		t.Errorf("Cert should use the legacy rsa key")
+	}
+}
+
+func TestCheckKeyParams(t *testing.T) {
+	for _, bad := range []struct {
+		keyType string
+		keySize int
+	}{
+		{KEY_TYPE_ECDSA, 224},
+		{KEY_TYPE_RSA, 1024},
+		{KEY_TYPE_ED25519, 256},
+		{"dsa", 0},
+	} {
+		if CheckKeyParams(bad.keyType, bad.keySize) == nil {
+			t.Errorf("%s %d should be rejected", bad.keyType, bad.keySize)
+		}
+	}
+	if err := CheckKeyParams(KEY_TYPE_RSA, 4096); err != nil {
+		t.Errorf("rsa 4096 should be accepted: %s", err)
+	}
+}
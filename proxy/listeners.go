@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/socks"
+)
+
+const (
+	LISTENER_HTTP  = "http"  // http proxy, like Addr
+	LISTENER_SOCKS = "socks" // SOCKS5 proxy, like SocksAddr
+	LISTENER_ADMIN = "admin" // status and admin API only, which then aren't served to proxy clients
+)
+
+// Listener is an additional listener for a Client, which serves one role
+type Listener struct {
+	Role string `json:"role"` // LISTENER_HTTP, LISTENER_SOCKS or LISTENER_ADMIN
+	Addr string `json:"addr"` // ip:port
+}
+
+// ParseListeners parses listeners given as role=ip:port, e.g.
+// admin=127.0.0.1:7070
+func ParseListeners(specs []string) ([]*Listener, error) {
+	var listeners []*Listener
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Listener %s should be role=ip:port", spec)
+		}
+		listener := &Listener{Role: parts[0], Addr: parts[1]}
+		if listener.Role != LISTENER_HTTP && listener.Role != LISTENER_SOCKS && listener.Role != LISTENER_ADMIN {
+			return nil, fmt.Errorf("Unknown role %s for listener %s", listener.Role, listener.Addr)
+		}
+		if _, _, err := net.SplitHostPort(listener.Addr); err != nil {
+			return nil, fmt.Errorf("Invalid address for %s listener: %s", listener.Role, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// hasAdminListener indicates whether the status and admin API have listeners
+// of their own
+func (client *Client) hasAdminListener() bool {
+	for _, listener := range client.Listeners {
+		if listener.Role == LISTENER_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// runListeners starts serving on our additional Listeners in the background
+func (client *Client) runListeners() {
+	for _, listener := range client.Listeners {
+		listener := listener
+		var server interface {
+			ListenAndServe() error
+			Close() error
+		}
+		switch listener.Role {
+		case LISTENER_HTTP:
+			server = client.httpServer(listener.Addr)
+		case LISTENER_SOCKS:
+			server = client.socksServer(listener.Addr)
+		case LISTENER_ADMIN:
+			server = &http.Server{
+				Addr:    listener.Addr,
+				Handler: http.HandlerFunc(client.serveAdminListener),
+			}
+		}
+		client.closeOnClose(server)
+		log.Debugf("About to start %s listener at %s", listener.Role, listener.Addr)
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Unable to run %s listener at %s: %s", listener.Role, listener.Addr, err)
+			}
+		}()
+	}
+}
+
+// serveAdminListener serves requests to an admin listener, which only
+// handles the status, dashboard, admin API and debugging endpoints.  The
+// dashboard is also its home page.
+func (client *Client) serveAdminListener(resp http.ResponseWriter, req *http.Request) {
+	if isStatusRequest(req) {
+		client.serveStatus(resp)
+	} else if isDashboardRequest(req) || (req.Method == "GET" && req.URL.Path == "/") {
+		client.serveDashboard(resp)
+	} else if isDebugRequest(req) {
+		client.serveDebug(resp, req)
+	} else if isAdminRequest(req) {
+		client.serveAdmin(resp, req)
+	} else {
+		http.NotFound(resp, req)
+	}
+}
+
+// httpServer builds the server for an http proxy listener at the given
+// address
+func (client *Client) httpServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		ReadTimeout:  client.ReadTimeout,
+		WriteTimeout: client.WriteTimeout,
+		Handler:      client,
+	}
+}
+
+// socksServer builds the server for a SOCKS5 listener at the given address,
+// which authenticates our Users (if any)
+func (client *Client) socksServer(addr string) *socks.Server {
+	socksServer := &socks.Server{
+		Addr: addr,
+		Dial: client.Dial,
+	}
+	if client.Users != nil {
+		socksServer.Authenticate = func(username string, password string) (func(addr string) (net.Conn, error), bool) {
+			user := client.Users.Authenticate(username, password)
+			if user == nil {
+				return nil, false
+			}
+			return func(addr string) (net.Conn, error) {
+				return client.dialFor(user, addr)
+			}, true
+		}
+	}
+	return socksServer
+}
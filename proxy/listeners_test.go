@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners([]string{"admin=127.0.0.1:7070", "socks=[::1]:1081"})
+	if err != nil || len(listeners) != 2 || listeners[1].Role != LISTENER_SOCKS || listeners[1].Addr != "[::1]:1081" {
+		t.Errorf("Unexpected listeners %v: %s", listeners, err)
+	}
+	for _, spec := range []string{"127.0.0.1:7070", "dns=127.0.0.1:53", "admin=7070"} {
+		if _, err := ParseListeners([]string{spec}); err == nil {
+			t.Errorf("%s should have been rejected", spec)
+		}
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	client := &Client{Listeners: []*Listener{{Role: LISTENER_ADMIN, Addr: "127.0.0.1:7070"}}}
+	client.separateAdmin = client.hasAdminListener()
+
+	resp := httptest.NewRecorder()
+	client.ServeHTTP(resp, readRequest(t, "GET /status HTTP/1.1\r\nHost: 127.0.0.1:8787\r\n\r\n"))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Status shouldn't be served to proxy clients, got %d", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	client.serveAdminListener(resp, readRequest(t, "GET /status HTTP/1.1\r\nHost: 127.0.0.1:7070\r\n\r\n"))
+	if resp.Code != http.StatusOK {
+		t.Errorf("Status should be served on the admin listener, got %d", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	client.serveAdminListener(resp, readRequest(t, "GET / HTTP/1.1\r\nHost: 127.0.0.1:7070\r\n\r\n"))
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), STATUS_PATH) {
+		t.Errorf("Dashboard should be served as the admin listener's home page, got %d", resp.Code)
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	client := &Client{AdminToken: "secret", Listeners: []*Listener{{Role: LISTENER_ADMIN, Addr: "127.0.0.1:7070"}}}
+	serve := func(path string, remoteAddr string, token string) *httptest.ResponseRecorder {
+		req := readRequest(t, "GET "+path+" HTTP/1.1\r\nHost: 127.0.0.1:7070\r\n"+X_LANTERN_ADMIN_TOKEN+": "+token+"\r\n\r\n")
+		req.RemoteAddr = remoteAddr
+		resp := httptest.NewRecorder()
+		client.serveAdminListener(resp, req)
+		return resp
+	}
+
+	for _, test := range []struct {
+		path       string
+		remoteAddr string
+		token      string
+		expected   int
+		contains   string
+	}{
+		{ADMIN_GOROUTINES_PATH, "127.0.0.1:5000", "secret", http.StatusOK, "TestDebugEndpoints"},
+		{ADMIN_VARS_PATH, "[::1]:5000", "secret", http.StatusOK, "memstats"},
+		{ADMIN_PPROF_PATH + "heap?debug=1", "127.0.0.1:5000", "secret", http.StatusOK, "heap profile"},
+		{ADMIN_PPROF_PATH + "nonexistent", "127.0.0.1:5000", "secret", http.StatusNotFound, ""},
+		{ADMIN_GOROUTINES_PATH, "127.0.0.1:5000", "wrong", http.StatusForbidden, ""},
+		{ADMIN_GOROUTINES_PATH, "192.168.1.2:5000", "secret", http.StatusForbidden, ""},
+	} {
+		resp := serve(test.path, test.remoteAddr, test.token)
+		if resp.Code != test.expected || !strings.Contains(resp.Body.String(), test.contains) {
+			t.Errorf("%s from %s: expected %d with %q, got %d", test.path, test.remoteAddr, test.expected, test.contains, resp.Code)
+		}
+	}
+}
+
+func TestCloseStopsListeners(t *testing.T) {
+	freeAddr := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unable to find a free port: %s", err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+	client := &Client{
+		ProxyConfig: ProxyConfig{Addr: freeAddr()},
+		SocksAddr:   freeAddr(),
+		DNSAddr:     freeAddr(),
+		Listeners: []*Listener{
+			{Role: LISTENER_HTTP, Addr: freeAddr()},
+			{Role: LISTENER_SOCKS, Addr: freeAddr()},
+			{Role: LISTENER_ADMIN, Addr: freeAddr()},
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run()
+	}()
+	tcpAddrs := []string{client.Addr, client.SocksAddr}
+	for _, listener := range client.Listeners {
+		tcpAddrs = append(tcpAddrs, listener.Addr)
+	}
+	for _, addr := range tcpAddrs {
+		waitForServer(addr, 2*time.Second, t)
+	}
+
+	client.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run should return without an error after Close, got %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Run didn't return after Close")
+	}
+	for _, addr := range tcpAddrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("%s should be free after Close: %s", addr, err)
+			continue
+		}
+		l.Close()
+	}
+	conn, err := net.ListenPacket("udp", client.DNSAddr)
+	if err != nil {
+		t.Errorf("DNS address %s should be free after Close: %s", client.DNSAddr, err)
+	} else {
+		conn.Close()
+	}
+}
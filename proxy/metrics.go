@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+	"github.com/getlantern/flashlight/resources"
+	"github.com/getlantern/flashlight/rules"
+)
+
+const (
+	PHASE_FIRST_BYTE = "firstbyte" // from receiving a plain http request to starting the response
+	PHASE_TOTAL      = "total"     // from receiving a plain http request to finishing the response
+
+	ROUTE_DIRECT = "direct" // route of requests that aren't tunneled, for latency metrics
+	ROUTE_TUNNEL = "tunnel" // route of tunneled requests when we don't know the protocol
+)
+
+// resourceGauges reports our own resource usage as gauges for a
+// metrics.Registry
+func resourceGauges() map[string]float64 {
+	usage := resources.Current()
+	gauges := map[string]float64{
+		"cpu_seconds":  usage.CPUSeconds,
+		"goroutines":   float64(usage.Goroutines),
+		"heap_bytes":   float64(usage.HeapBytes),
+		"memory_bytes": float64(usage.MemoryBytes),
+	}
+	if usage.RSSBytes > 0 {
+		gauges["rss_bytes"] = float64(usage.RSSBytes)
+	}
+	if usage.FDs > 0 {
+		gauges["fds"] = float64(usage.FDs)
+	}
+	for subsystem, bytes := range usage.Subsystems {
+		gauges[subsystem+"_bytes"] = float64(bytes)
+	}
+	return gauges
+}
+
+// gauges reports the client's connections as gauges for a metrics.Registry
+func (set *connSet) gauges() map[string]float64 {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return map[string]float64{
+		"tunnels_open":  float64(len(set.conns)),
+		"tunnels_total": float64(set.tunnels),
+		"tunnel_bytes":  float64(set.bytes),
+	}
+}
+
+// probeGauges reports how often the Prober's canary was tampered with as
+// gauges for a metrics.Registry
+func (client *Client) probeGauges() map[string]float64 {
+	tampered := 0
+	for _, result := range client.Prober.Results() {
+		tampered += result.Tampered
+	}
+	return map[string]float64{
+		"canary_tampered": float64(tampered),
+	}
+}
+
+// gauges reports the pool's reuse of origin connections as gauges for a
+// metrics.Registry
+func (pool *OriginPool) gauges() map[string]float64 {
+	stats := pool.Stats()
+	return map[string]float64{
+		"origin_requests":  float64(stats.Requests),
+		"origin_dials":     float64(stats.Dials),
+		"origin_reuserate": stats.ReuseRate,
+	}
+}
+
+// serveTimed proxies a plain http request with the given reverseProxy like
+// ServeHTTP does, observing its
+// PHASE_FIRST_BYTE and PHASE_TOTAL latencies in our Metrics by route (the
+// protocol or ROUTE_DIRECT), with the (redacted) host as the exemplar
+func (client *Client) serveTimed(engine *rules.Engine, reverseProxy *httputil.ReverseProxy, resp http.ResponseWriter, req *http.Request) {
+	route := client.routeFor(engine, req.Host)
+	host := log.Redact(req.Host)
+	start := time.Now()
+	timed := &timedResponseWriter{ResponseWriter: resp}
+	reverseProxy.ServeHTTP(withStreaming(timed), req)
+	end := time.Now()
+	if timed.firstByte.IsZero() {
+		timed.firstByte = end
+	}
+	client.Metrics.Observe(metrics.LatencyName(PHASE_FIRST_BYTE, route), timed.firstByte.Sub(start), host)
+	client.Metrics.Observe(metrics.LatencyName(PHASE_TOTAL, route), end.Sub(start), host)
+}
+
+// routeFor returns the name of the route by which requests for the given
+// host go, for latency metrics
+func (client *Client) routeFor(engine *rules.Engine, host string) string {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "80")
+	}
+	if client.isDirect(engine, addr) {
+		return ROUTE_DIRECT
+	}
+	if client.CurrentProtocol == nil {
+		return ROUTE_TUNNEL
+	}
+	// Balancers report server/protocol
+	current := client.CurrentProtocol()
+	return current[strings.LastIndex(current, "/")+1:]
+}
+
+// timedResponseWriter notes when the response started
+type timedResponseWriter struct {
+	http.ResponseWriter
+	firstByte time.Time
+}
+
+func (resp *timedResponseWriter) WriteHeader(status int) {
+	if resp.firstByte.IsZero() {
+		resp.firstByte = time.Now()
+	}
+	resp.ResponseWriter.WriteHeader(status)
+}
+
+func (resp *timedResponseWriter) Write(b []byte) (int, error) {
+	if resp.firstByte.IsZero() {
+		resp.firstByte = time.Now()
+	}
+	return resp.ResponseWriter.Write(b)
+}
+
+func (resp *timedResponseWriter) Flush() {
+	if flusher, ok := resp.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/egress"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/pipe"
+	"github.com/getlantern/flashlight/statserver"
+)
+
+const (
+	DEFAULT_MAX_IDLE_PER_ORIGIN = 4
+	DEFAULT_ORIGIN_IDLE_TIMEOUT = 90 * time.Second
+	ORIGIN_STATS_INTERVAL       = 1 * time.Minute
+)
+
+var (
+	httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE "}
+)
+
+// OriginPool keeps connections to origins alive across the plain http
+// tunnels that clients open, so that a page's requests don't each cost a
+// fresh origin connection (clients open a tunnel per request).  Requests are
+// read off the tunnel and sent with an http.Transport per egress policy, which
+// keeps idle connections per origin.  Protocol upgrades and anything that
+// isn't http are relayed raw.
+type OriginPool struct {
+	MaxIdlePerOrigin int           // (optional) maximum idle connections per origin, defaults to DEFAULT_MAX_IDLE_PER_ORIGIN
+	IdleTimeout      time.Duration // (optional) how long connections may sit idle before they're closed, defaults to DEFAULT_ORIGIN_IDLE_TIMEOUT
+
+	transports      map[*egress.Policy]*http.Transport
+	transportsMutex sync.Mutex
+	requests        int64
+	dials           int64
+}
+
+// Stats returns the current statistics about our reuse of connections
+func (pool *OriginPool) Stats() *statserver.OriginStats {
+	stats := &statserver.OriginStats{
+		Requests: atomic.LoadInt64(&pool.requests),
+		Dials:    atomic.LoadInt64(&pool.dials),
+	}
+	if stats.Requests > 0 && stats.Dials < stats.Requests {
+		stats.ReuseRate = 1 - float64(stats.Dials)/float64(stats.Requests)
+	}
+	return stats
+}
+
+// Wrap returns a connection that serves the tunnel to the given plain http
+// origin (host:port) using pooled connections dialed with dial, which the
+// given policy's connections all go through.
+func (pool *OriginPool) Wrap(policy *egress.Policy, addr string, dial func(addr string) (net.Conn, error)) net.Conn {
+	conn, tunnel := net.Pipe()
+	go pool.serve(tunnel, addr, pool.transportFor(policy, dial), dial)
+	return conn
+}
+
+// transportFor returns the http.Transport for the given policy, creating it if
+// necessary.  Policies get their own transports so that connections dialed
+// for one tenant are never reused for another.
+func (pool *OriginPool) transportFor(policy *egress.Policy, dial func(addr string) (net.Conn, error)) *http.Transport {
+	pool.transportsMutex.Lock()
+	defer pool.transportsMutex.Unlock()
+	if pool.transports == nil {
+		pool.transports = make(map[*egress.Policy]*http.Transport)
+	}
+	transport := pool.transports[policy]
+	if transport == nil {
+		maxIdle := pool.MaxIdlePerOrigin
+		if maxIdle <= 0 {
+			maxIdle = DEFAULT_MAX_IDLE_PER_ORIGIN
+		}
+		idleTimeout := pool.IdleTimeout
+		if idleTimeout <= 0 {
+			idleTimeout = DEFAULT_ORIGIN_IDLE_TIMEOUT
+		}
+		transport = &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				atomic.AddInt64(&pool.dials, 1)
+				return dial(addr)
+			},
+			MaxIdleConnsPerHost: maxIdle,
+			IdleConnTimeout:     idleTimeout,
+			// Pass bodies through as the origin sent them
+			DisableCompression: true,
+		}
+		pool.transports[policy] = transport
+	}
+	return transport
+}
+
+// serve reads requests from the tunnel and sends them to the origin at addr
+// with the given transport, until the tunnel is closed or a request asks to
+// close it
+func (pool *OriginPool) serve(tunnel net.Conn, addr string, transport *http.Transport, dial func(addr string) (net.Conn, error)) {
+	defer tunnel.Close()
+	reader := bufio.NewReader(tunnel)
+	if !looksLikeHTTP(reader) {
+		pool.relayRaw(tunnel, reader, addr, nil, dial)
+		return
+	}
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if isUpgrade(req) {
+			pool.relayRaw(tunnel, reader, addr, req, dial)
+			return
+		}
+		req.RequestURI = ""
+		req.URL.Scheme = "http"
+		req.URL.Host = addr
+		atomic.AddInt64(&pool.requests, 1)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			log.Debugf("Unable to send request to %s: %s", log.Redact(addr), err)
+			writeBadGateway(tunnel, req)
+			return
+		}
+		// The tunnel is kept alive independently of the origin connection,
+		// so delimit bodies of unknown length by chunking rather than by
+		// closing
+		resp.Close = req.Close
+		resp.ProtoMajor, resp.ProtoMinor = 1, 1
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		err = resp.Write(tunnel)
+		resp.Body.Close()
+		// Make sure that the request body is consumed before reading the
+		// next request
+		io.Copy(ioutil.Discard, req.Body)
+		if err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// relayRaw dials addr and relays the tunnel to it as is, starting with the
+// given request (if any) and whatever is buffered in reader
+func (pool *OriginPool) relayRaw(tunnel net.Conn, reader *bufio.Reader, addr string, req *http.Request, dial func(addr string) (net.Conn, error)) {
+	atomic.AddInt64(&pool.dials, 1)
+	origin, err := dial(addr)
+	if err != nil {
+		log.Debugf("Unable to dial %s: %s", log.Redact(addr), err)
+		if req != nil {
+			writeBadGateway(tunnel, req)
+		}
+		return
+	}
+	if req != nil {
+		if err := req.Write(origin); err != nil {
+			origin.Close()
+			return
+		}
+	}
+	pipe.Relay(&bufferedConn{tunnel, reader}, origin)
+}
+
+// publishOriginStats periodically publishes our OriginPool's stats to our
+// StatServer
+func (server *Server) publishOriginStats() {
+	for {
+		time.Sleep(ORIGIN_STATS_INTERVAL)
+		server.StatServer.OnOriginStats(server.OriginPool.Stats())
+	}
+}
+
+// isPlainHTTP indicates whether the given destination (host:port) is one to
+// which clients tunnel plain http
+func isPlainHTTP(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == "80"
+}
+
+// looksLikeHTTP indicates whether what's coming from reader starts with an http
+// request line
+func looksLikeHTTP(reader *bufio.Reader) bool {
+	start, _ := reader.Peek(len("OPTIONS "))
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(start, []byte(method)) || strings.HasPrefix(method, string(start)) && len(start) < len(method) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeBadGateway(conn net.Conn, req *http.Request) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Close:      true,
+	}
+	resp.Write(conn)
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginReuse(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// No Content-Length, so that the pool has to chunk
+		resp.Write([]byte("hello"))
+		resp.(http.Flusher).Flush()
+	}))
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	pool := &OriginPool{}
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+	// Each tunnel carries two requests, like a client keeping its tunnel
+	// alive
+	for i := 0; i < 3; i++ {
+		conn := pool.Wrap(nil, addr, dial)
+		br := bufio.NewReader(conn)
+		for j := 0; j < 2; j++ {
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("Unable to read response: %s", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != "hello" {
+				t.Fatalf("Unexpected body: %s", body)
+			}
+		}
+		conn.Close()
+	}
+
+	stats := pool.Stats()
+	if stats.Requests != 6 || stats.Dials != 1 {
+		t.Errorf("Expected 6 requests over 1 connection, got %d over %d", stats.Requests, stats.Dials)
+	}
+}
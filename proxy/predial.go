@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PREDIALED_IDLE_TIMEOUT = 10 * time.Second // how long connections left over from aborted handshakes are kept for reuse
+	MAX_PREDIALED_PER_HOST = 2                // how many of those are kept per host
+
+	predialedCheckTimeout = 1 * time.Millisecond
+	firstReadSize         = 4 * 1024 // enough for the start of a ClientHello, the rest is relayed as usual
+)
+
+// predialPool keeps the connections that we dialed for direct CONNECTs whose
+// browsers went away before starting their TLS handshakes, as browsers do
+// when a page is unloaded mid-load or a preconnect goes unused.  Nothing has
+// been sent on them, so the next CONNECT to the same host can use one instead
+// of dialing.  Connections that aren't reused within PREDIALED_IDLE_TIMEOUT
+// are closed.
+type predialPool struct {
+	conns   map[string][]*predialed
+	closed  bool
+	aborted int64
+	reused  int64
+	mutex   sync.Mutex
+}
+
+// predialed is a connection in a predialPool
+type predialed struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+// put keeps the given unused connection to host (host:port) for reuse,
+// closing the oldest one for host if there are already
+// MAX_PREDIALED_PER_HOST.  It counts an aborted handshake.
+func (pool *predialPool) put(host string, conn net.Conn) {
+	atomic.AddInt64(&pool.aborted, 1)
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed {
+		conn.Close()
+		return
+	}
+	if pool.conns == nil {
+		pool.conns = make(map[string][]*predialed)
+	}
+	p := &predialed{conn: conn}
+	p.timer = time.AfterFunc(PREDIALED_IDLE_TIMEOUT, func() {
+		if pool.remove(host, p) {
+			conn.Close()
+		}
+	})
+	conns := append(pool.conns[host], p)
+	if len(conns) > MAX_PREDIALED_PER_HOST {
+		conns[0].timer.Stop()
+		conns[0].conn.Close()
+		conns = conns[1:]
+	}
+	pool.conns[host] = conns
+}
+
+// get returns a kept connection to host (host:port) that's still open, or
+// nil if there's none
+func (pool *predialPool) get(host string) net.Conn {
+	for {
+		pool.mutex.Lock()
+		conns := pool.conns[host]
+		if len(conns) == 0 {
+			pool.mutex.Unlock()
+			return nil
+		}
+		// The newest is the least likely to have been closed by the other end
+		p := conns[len(conns)-1]
+		pool.removeLocked(host, p)
+		pool.mutex.Unlock()
+
+		p.timer.Stop()
+		if isUnused(p.conn) {
+			atomic.AddInt64(&pool.reused, 1)
+			return p.conn
+		}
+		p.conn.Close()
+	}
+}
+
+// remove removes the given connection to host, indicating whether it was
+// still there
+func (pool *predialPool) remove(host string, p *predialed) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.removeLocked(host, p)
+}
+
+func (pool *predialPool) removeLocked(host string, p *predialed) bool {
+	conns := pool.conns[host]
+	for i, candidate := range conns {
+		if candidate == p {
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(pool.conns, host)
+			} else {
+				pool.conns[host] = conns
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// closeAll closes all kept connections and stops keeping new ones
+func (pool *predialPool) closeAll() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.closed = true
+	for _, conns := range pool.conns {
+		for _, p := range conns {
+			p.timer.Stop()
+			p.conn.Close()
+		}
+	}
+	pool.conns = nil
+}
+
+// gauges reports the aborted handshakes and reused connections as gauges for
+// a metrics.Registry
+func (pool *predialPool) gauges() map[string]float64 {
+	return map[string]float64{
+		"handshakes_aborted": float64(atomic.LoadInt64(&pool.aborted)),
+		"predialed_reused":   float64(atomic.LoadInt64(&pool.reused)),
+	}
+}
+
+// isUnused indicates whether the given connection is still open without the
+// other end having sent anything, which would have to be passed on to
+// whoever uses it
+func isUnused(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(predialedCheckTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if n > 0 || err == nil {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
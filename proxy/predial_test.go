@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/rules"
+)
+
+func TestAbortedHandshake(t *testing.T) {
+	// Origin that echoes, standing in for every https destination
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	client := &Client{
+		Rules: &rules.Engine{Rules: []*rules.Rule{{Domain: "*", Route: rules.ROUTE_DIRECT}}},
+		UpstreamProxy: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, l.Addr().String())
+		},
+	}
+	defer client.predialed.closeAll()
+	server := httptest.NewServer(client)
+	defer server.Close()
+
+	connect := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Unable to dial client: %s", err)
+		}
+		io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unable to CONNECT: %v %s", resp, err)
+		}
+		return conn, br
+	}
+
+	// Browser goes away before its ClientHello
+	conn, _ := connect()
+	conn.Close()
+	for i := 0; i < 100 && atomic.LoadInt64(&client.predialed.aborted) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, br := connect()
+	defer conn.Close()
+	io.WriteString(conn, "hello")
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "hello" {
+		t.Fatalf("Unable to relay through reused connection: %s %s", echo, err)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("Connection should have been reused, origin accepted %d", n)
+	}
+	if aborted, reused := atomic.LoadInt64(&client.predialed.aborted), atomic.LoadInt64(&client.predialed.reused); aborted != 1 || reused != 1 {
+		t.Errorf("Expected 1 aborted and 1 reused, got %d and %d", aborted, reused)
+	}
+}
+
+func TestPredialPoolSkipsClosed(t *testing.T) {
+	pool := &predialPool{}
+	a, b := net.Pipe()
+	pool.put("example.com:443", a)
+	b.Close()
+	if conn := pool.get("example.com:443"); conn != nil {
+		t.Errorf("Closed connection shouldn't be reused")
+	}
+	a, b = net.Pipe()
+	defer b.Close()
+	pool.put("example.com:443", a)
+	pool.closeAll()
+	if conn := pool.get("example.com:443"); conn != nil {
+		t.Errorf("Nothing should be reused after closeAll")
+	}
+}
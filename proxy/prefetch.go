@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/flashlight/prefetch"
+	"github.com/getlantern/flashlight/tenants"
+)
+
+// pushSubresources serves a prefetch.PushRequest from a client of the given
+// tenant (which may be nil), dialing the origin like its tunnels
+func (server *Server) pushSubresources(resp http.ResponseWriter, req *http.Request, tenant *tenants.Tenant) {
+	pusher := &prefetch.Pusher{
+		Dial: func(addr string) (net.Conn, error) {
+			return server.dialDestination(tenant, addr)
+		},
+	}
+	pusher.ServeHTTP(resp, req)
+}
+
+// pushSubresources asks the server to push the subresources of the given page,
+// which is a prefetch.Prefetcher's Push
+func (client *Client) pushSubresources(page *http.Request, push *prefetch.PushRequest) (io.ReadCloser, error) {
+	addr := page.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+	if client.isDirect(client.Rules, addr) {
+		return nil, fmt.Errorf("%s isn't tunneled", addr)
+	}
+	if !client.serverCapabilities().SupportsPrefetch() {
+		return nil, prefetch.ErrPushUnsupported
+	}
+	if err := client.serverVerifiedErr(); err != nil {
+		return nil, err
+	}
+	config := client.enproxyConfig(addr)
+	conn, err := config.DialProxy("")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial server: %s", err)
+	}
+	req, err := config.NewRequest("", "POST", nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to create request: %s", err)
+	}
+	err = prefetch.PrepareRequest(req, push)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to request push: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to read push response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		// Most likely a server without Prefetch, which handles the request
+		// like a tunnel
+		return nil, prefetch.ErrPushUnsupported
+	}
+	return &pushStream{resp.Body, conn}, nil
+}
+
+// pushStream is the body of a push response, which closes the connection to
+// the server when closed
+type pushStream struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (stream *pushStream) Close() error {
+	stream.ReadCloser.Close()
+	return stream.conn.Close()
+}
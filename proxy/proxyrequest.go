@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	PROXY_AUTH_REALM = "flashlight" // realm in which we challenge for proxy credentials
+)
+
+// normalizeProxyRequest brings the given request to our listener in line with
+// RFC 7230 proxy semantics before we handle it.  Requests other than CONNECT
+// must use the absolute form (http://host/path), whose host takes precedence
+// over any Host header, and CONNECT requests must name a host and port.  The
+// legacy Proxy-Connection header is honored when there's no Connection
+// header, and credentials meant for us are never passed on.  It returns false
+// if it rejected the request.
+func normalizeProxyRequest(resp http.ResponseWriter, req *http.Request) bool {
+	if req.Method == CONNECT {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			http.Error(resp, "CONNECT requires a host:port target", http.StatusBadRequest)
+			return false
+		}
+	} else {
+		if !req.URL.IsAbs() || req.URL.Host == "" {
+			http.Error(resp, "Proxy requests require an absolute URI like http://example.com/", http.StatusBadRequest)
+			return false
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			http.Error(resp, "Unsupported scheme "+req.URL.Scheme, http.StatusBadRequest)
+			return false
+		}
+		// net/http already takes the Host from an absolute URI, but
+		// make sure that the Host header we send agrees
+		req.Host = req.URL.Host
+	}
+
+	if proxyConnection := req.Header.Get("Proxy-Connection"); proxyConnection != "" {
+		if req.Header.Get("Connection") == "" && hasToken(proxyConnection, "close") {
+			req.Close = true
+			resp.Header().Set("Connection", "close")
+		}
+		req.Header.Del("Proxy-Connection")
+	}
+	req.Header.Del("Proxy-Authorization")
+	return true
+}
+
+// requireProxyAuth challenges the client for proxy credentials with a 407
+func requireProxyAuth(resp http.ResponseWriter) {
+	resp.Header().Set("Proxy-Authenticate", `Basic realm="`+PROXY_AUTH_REALM+`", charset="UTF-8"`)
+	http.Error(resp, "Proxy authentication required", http.StatusProxyAuthRequired)
+}
+
+// hasToken indicates whether the given comma-separated header value contains
+// the given token, ignoring case
+func hasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func readRequest(t *testing.T, raw string) *http.Request {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("Unable to read request: %s", err)
+	}
+	return req
+}
+
+func TestNormalizeProxyRequest(t *testing.T) {
+	for _, raw := range []string{
+		"GET /page HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET ftp://example.com/file HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		resp := httptest.NewRecorder()
+		if normalizeProxyRequest(resp, readRequest(t, raw)) || resp.Code != http.StatusBadRequest {
+			t.Errorf("Request should have been rejected: %q", raw)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	req := readRequest(t, "GET http://example.com/page HTTP/1.0\r\nHost: other.com\r\nProxy-Connection: close\r\nProxy-Authorization: Basic YTpi\r\n\r\n")
+	if !normalizeProxyRequest(resp, req) {
+		t.Fatalf("Request should have been accepted, got %d", resp.Code)
+	}
+	if req.Host != "example.com" {
+		t.Errorf("Absolute URI should take precedence over Host, got %s", req.Host)
+	}
+	if !req.Close || resp.Header().Get("Connection") != "close" {
+		t.Error("Proxy-Connection: close should close the connection")
+	}
+	if req.Header.Get("Proxy-Connection") != "" || req.Header.Get("Proxy-Authorization") != "" {
+		t.Error("Proxy headers should have been removed")
+	}
+}
+
+func TestRequireProxyAuth(t *testing.T) {
+	resp := httptest.NewRecorder()
+	requireProxyAuth(resp)
+	if resp.Code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected 407, got %d", resp.Code)
+	}
+	if !strings.HasPrefix(resp.Header().Get("Proxy-Authenticate"), `Basic realm="flashlight"`) {
+		t.Errorf("Unexpected challenge: %s", resp.Header().Get("Proxy-Authenticate"))
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	CLASS_HTTP      = "http"      // ordinary connections
+	CLASS_TUNNEL    = "tunnel"    // connections tunneled for CONNECT (e.g. TLS), which don't start with a plain http request
+	CLASS_WEBSOCKET = "websocket" // connections that were upgraded to websockets
+	CLASS_BULK      = "bulk"      // connections that have transferred a lot of data
+
+	BULK_THRESHOLD = 1024 * 1024 // bytes after which a connection counts as bulk
+	REAP_INTERVAL  = 10 * time.Second
+
+	DEFAULT_IDLE_POLICY = "http=2m,tunnel=1h,websocket=1h,bulk=10m"
+)
+
+var (
+	websocketUpgrade = []byte("upgrade: websocket")
+	httpRequestLine  = regexp.MustCompile(`^[A-Z]+ [^ ]+ HTTP/1\.[0-9]`)
+)
+
+// IdlePolicy maps connection classes to how long connections of that class may
+// sit idle before they're closed.  Classes that aren't in the policy (or have
+// a zero timeout) are never closed for being idle.
+type IdlePolicy map[string]time.Duration
+
+// ParseIdlePolicy parses a comma-separated list of class=duration pairs like
+// "http=2m,tunnel=1h,websocket=1h,bulk=10m".
+func ParseIdlePolicy(spec string) (IdlePolicy, error) {
+	policy := make(IdlePolicy)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid idle timeout, expected class=duration: %s", item)
+		}
+		class := strings.TrimSpace(parts[0])
+		if class != CLASS_HTTP && class != CLASS_TUNNEL && class != CLASS_WEBSOCKET && class != CLASS_BULK {
+			return nil, fmt.Errorf("Unknown connection class: %s", class)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid idle timeout for %s: %s", class, err)
+		}
+		policy[class] = timeout
+	}
+	return policy, nil
+}
+
+// Reaper closes connections that have been idle for longer than their
+// class's timeout under the IdlePolicy, so that half-dead connections don't
+// hold on to server resources until the OS times them out.
+type Reaper struct {
+	Policy IdlePolicy
+
+	conns map[*reapableConn]bool
+	mutex sync.Mutex
+}
+
+// reapableConn is a net.Conn that tracks when it was last active
+type reapableConn struct {
+	// 64 bit fields come first for atomic alignment on 32 bit platforms
+	lastActive int64 // UnixNano
+	bytes      int64
+	websocket  int32
+	tunnel     int32
+	firstWrite int32
+
+	net.Conn
+	reaper *Reaper
+}
+
+// NewReaper creates a Reaper with the given IdlePolicy and starts reaping.
+func NewReaper(policy IdlePolicy) *Reaper {
+	reaper := &Reaper{
+		Policy: policy,
+		conns:  make(map[*reapableConn]bool),
+	}
+	go reaper.run()
+	return reaper
+}
+
+// Track wraps the given connection so that it gets reaped when idle.  If
+// reaper is nil, the connection is returned as is.
+func (reaper *Reaper) Track(conn net.Conn) net.Conn {
+	if reaper == nil {
+		return conn
+	}
+	rc := &reapableConn{
+		lastActive: time.Now().UnixNano(),
+		Conn:       conn,
+		reaper:     reaper,
+	}
+	reaper.mutex.Lock()
+	reaper.conns[rc] = true
+	reaper.mutex.Unlock()
+	return rc
+}
+
+func (reaper *Reaper) run() {
+	for {
+		time.Sleep(REAP_INTERVAL)
+		reaper.reap(time.Now())
+	}
+}
+
+// reap closes the connections that are idle as of now
+func (reaper *Reaper) reap(now time.Time) {
+	var idle []*reapableConn
+	reaper.mutex.Lock()
+	for conn := range reaper.conns {
+		timeout := reaper.Policy[conn.class()]
+		if timeout > 0 && now.Sub(conn.lastActiveTime()) > timeout {
+			idle = append(idle, conn)
+		}
+	}
+	reaper.mutex.Unlock()
+
+	for _, conn := range idle {
+		log.Debugf("Closing idle %s connection to %s", conn.class(), log.Redact(conn.RemoteAddr().String()))
+		conn.Close()
+	}
+}
+
+func (conn *reapableConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.markActive(n)
+	return n, err
+}
+
+func (conn *reapableConn) Write(b []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&conn.firstWrite, 0, 1) {
+		// The first thing written is the client's request, which tells us
+		// whether this is a (plain) websocket, or a tunnel if it's not plain
+		// http at all
+		if !httpRequestLine.Match(b) {
+			atomic.StoreInt32(&conn.tunnel, 1)
+		} else if bytes.Contains(bytes.ToLower(b), websocketUpgrade) {
+			atomic.StoreInt32(&conn.websocket, 1)
+		}
+	}
+	n, err := conn.Conn.Write(b)
+	conn.markActive(n)
+	return n, err
+}
+
+func (conn *reapableConn) Close() error {
+	conn.reaper.mutex.Lock()
+	delete(conn.reaper.conns, conn)
+	conn.reaper.mutex.Unlock()
+	return conn.Conn.Close()
+}
+
+func (conn *reapableConn) markActive(n int) {
+	if n > 0 {
+		atomic.AddInt64(&conn.bytes, int64(n))
+		atomic.StoreInt64(&conn.lastActive, time.Now().UnixNano())
+	}
+}
+
+func (conn *reapableConn) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.lastActive))
+}
+
+// class classifies the connection.  Tunnels stay tunnels however much they
+// transfer, since they're often long-lived (e.g. ssh or IMAP IDLE) and only
+// plain http connections count as bulk.
+func (conn *reapableConn) class() string {
+	if atomic.LoadInt32(&conn.websocket) == 1 {
+		return CLASS_WEBSOCKET
+	}
+	if atomic.LoadInt32(&conn.tunnel) == 1 {
+		return CLASS_TUNNEL
+	}
+	if atomic.LoadInt64(&conn.bytes) >= BULK_THRESHOLD {
+		return CLASS_BULK
+	}
+	return CLASS_HTTP
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseIdlePolicy(t *testing.T) {
+	policy, err := ParseIdlePolicy(DEFAULT_IDLE_POLICY)
+	if err != nil {
+		t.Fatalf("Unable to parse default policy: %s", err)
+	}
+	if policy[CLASS_WEBSOCKET] != time.Hour {
+		t.Errorf("Wrong websocket timeout: %s", policy[CLASS_WEBSOCKET])
+	}
+	if policy[CLASS_TUNNEL] != time.Hour {
+		t.Errorf("Wrong tunnel timeout: %s", policy[CLASS_TUNNEL])
+	}
+	if _, err := ParseIdlePolicy("ftp=1m"); err == nil {
+		t.Error("Unknown class should have failed")
+	}
+}
+
+func TestReap(t *testing.T) {
+	reaper := &Reaper{
+		Policy: IdlePolicy{CLASS_HTTP: time.Minute, CLASS_TUNNEL: time.Hour, CLASS_WEBSOCKET: time.Hour},
+		conns:  make(map[*reapableConn]bool),
+	}
+	track := func(request string) net.Conn {
+		conn, peer := net.Pipe()
+		go func() {
+			b := make([]byte, 1024)
+			peer.Read(b)
+		}()
+		tracked := reaper.Track(conn)
+		if _, err := tracked.Write([]byte(request)); err != nil {
+			t.Fatalf("Unable to write: %s", err)
+		}
+		return tracked
+	}
+	httpConn := track("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	track("GET / HTTP/1.1\r\nUpgrade: websocket\r\n\r\n")
+	track("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03")
+
+	reaper.reap(time.Now().Add(2 * time.Minute))
+	if len(reaper.conns) != 2 {
+		t.Fatalf("Expected only the websocket and the tunnel to survive, have %d conns", len(reaper.conns))
+	}
+	for conn := range reaper.conns {
+		if conn.class() != CLASS_WEBSOCKET && conn.class() != CLASS_TUNNEL {
+			t.Errorf("Wrong surviving class: %s", conn.class())
+		}
+	}
+	if _, err := httpConn.Write([]byte("x")); err == nil {
+		t.Error("Idle http connection should have been closed")
+	}
+}
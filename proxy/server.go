@@ -1,27 +1,53 @@
 package proxy
 
 import (
+	"crypto"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/accounting"
+	"github.com/getlantern/flashlight/acmecert"
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/capabilities"
+	"github.com/getlantern/flashlight/clientauth"
+	"github.com/getlantern/flashlight/ddns"
+	"github.com/getlantern/flashlight/egress"
+	"github.com/getlantern/flashlight/feedback"
+	"github.com/getlantern/flashlight/handoff"
+	"github.com/getlantern/flashlight/identity"
 	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/media"
+	"github.com/getlantern/flashlight/metrics"
+	"github.com/getlantern/flashlight/prefetch"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/protocol/cloudflare"
+	"github.com/getlantern/flashlight/reputation"
+	"github.com/getlantern/flashlight/resources"
+	"github.com/getlantern/flashlight/socks"
 	"github.com/getlantern/flashlight/statreporter"
 	"github.com/getlantern/flashlight/statserver"
+	"github.com/getlantern/flashlight/tenants"
+	"github.com/getlantern/flashlight/trace"
+	"github.com/getlantern/flashlight/webhook"
 	"github.com/getlantern/keyman"
 )
 
+const (
+	EGRESS_POLICY_PATH = "/egresspolicy" // path at which the server publishes its egress.Policy
+	REPUTATION_PATH    = "/reputation"   // path at which the server publishes its latest reputation.Report
+	RESOURCES_INTERVAL = 1 * time.Minute
+)
+
 var (
 	dialTimeout = 10 * time.Second
 
-	// Points in time, mostly used for generating certificates
-	TEN_YEARS_FROM_TODAY = time.Now().AddDate(10, 0, 0)
-
 	// Default TLS configuration for servers
 	DEFAULT_TLS_SERVER_CONFIG = &tls.Config{
 		// The ECDHE cipher suites are preferred for performance and forward
@@ -44,40 +70,293 @@ var (
 
 type Server struct {
 	ProxyConfig
-	Host                       string                 // FQDN that is guaranteed to hit this server
-	CertContext                *CertContext           // context for certificate management
-	AllowNonGlobalDestinations bool                   // if true, requests to LAN, Loopback, etc. will be allowed
-	StatReporter               *statreporter.Reporter // optional reporter of stats
-	StatServer                 *statserver.Server     // optional server of stats
+	Host                       string                  // FQDN that is guaranteed to hit this server
+	Protocol                   protocol.ServerProtocol // (optional) fronting protocol used to reach this server
+	CertContext                *CertContext            // context for certificate management
+	ClientAuth                 *clientauth.Verifier    // (optional) requires clients to present certificates issued by its CA (mutual TLS)
+	AllowNonGlobalDestinations bool                    // if true, requests to LAN, Loopback, etc. will be allowed
+	EgressPolicy               *egress.Policy          // (optional) restrictions on the destinations to which we egress
+	EgressRouter               *egress.Router          // (optional) routes for sending some destinations through secondary upstreams
+	Reaper                     *Reaper                 // (optional) closes destination connections that sit idle
+	AllowedHops                []string                // (optional) next hops (host:port) to which we'll relay as an intermediate hop
+	HopRootCA                  string                  // (optional) PEM encoded CA cert to which to pin next hops
+	DDNS                       *ddns.Updater           // (optional) keeps Host's DNS record pointing at our public IP
+	Reputation                 *reputation.Checker     // (optional) checks whether reference sites block or captcha-wall our egress IP
+	Feedback                   *feedback.Aggregator    // (optional) aggregates clients' reports of destinations that failed through us
+	EgressIPs                  *EgressIPs              // (optional) local IPs from which to egress
+	Media                      *media.Compressor       // (optional) compresses media for destinations that clients mark with protocol.EncodeMedia
+	Prefetch                   bool                    // (optional) if true, we fetch the subresources of pages for clients that ask and push them (see package prefetch)
+	OriginPool                 *OriginPool             // (optional) reuses connections to origins for plain http tunnels
+	Tenants                    *tenants.Tenants        // (optional) logical instances hosted by this server, selected by token or SNI
+	StatReporter               *statreporter.Reporter  // optional reporter of stats
+	StatServer                 *statserver.Server      // optional server of stats
+	Metrics                    *metrics.Registry       // (optional) exports metrics to monitoring systems
+	Webhook                    *webhook.Notifier       // (optional) notifies the operator of significant events
+	AccessLog                  *AccessLog              // (optional) logs every request
+	Bandwidth                  *accounting.Ledger      // (optional) accumulates bytes per client IP across restarts, published to the StatServer
+	CapabilitiesToken          string                  // (optional) token with which clients may discover our capabilities (see package capabilities), tenants don't need it
+	AuthToken                  string                  // (optional) token that clients must carry (see package auth), requests without it are shown the AuthDecoy
+	AuthDecoy                  *auth.Decoy             // (optional) what requests without the AuthToken are shown, defaults to a generic 404 page
+	Tracer                     *trace.Tracer           // (optional) continues the traces that clients propagate
+	HealthPath                 string                  // (optional) path at which load balancers can check our readiness, answered before the Protocol's rewrite and tenant selection
+	HealthOrigin               string                  // (optional) host:port that must be reachable for us to be ready
+
+	hopConfigs      map[string]*enproxy.Config
+	hopConfigsMutex sync.Mutex
+	dialStats       dialStats
+	pendingSpans    pendingSpans
+	originHealth    originHealth
+	conns           serverConns
+	draining        int32
+	listener        net.Listener
+	httpServer      *http.Server
+	listenerMutex   sync.Mutex
 }
 
 // CertContext encapsulates the certificates used by a Server
 type CertContext struct {
 	PKFile         string
 	ServerCertFile string
-	pk             *keyman.PrivateKey
+	ACME           *acmecert.Manager // (optional) obtains a publicly trusted cert (kept in ServerCertFile) instead of self-signing one
+	KeyType        string            // (optional) type of private key to generate if PKFile doesn't exist yet: "ecdsa" (default), "rsa" or "ed25519"
+	KeySize        int               // (optional) bits of a generated rsa key (default 2048) or curve size of an ecdsa one: 256 (default), 384 or 521
+	pk             crypto.Signer
 	serverCert     *keyman.Certificate
+	tlsCert        *tls.Certificate // what we serve, swapped when renewed
+	mutex          sync.RWMutex
 }
 
 func (server *Server) Run() error {
-	err := server.CertContext.initServerCert(strings.Split(server.Addr, ":")[0])
+	host, _, err := net.SplitHostPort(server.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to split host and port of %s: %s", server.Addr, err)
+	}
+	if server.CertContext.ACME != nil {
+		err = server.CertContext.ACME.Start()
+	} else {
+		err = server.CertContext.initServerCert(host)
+	}
 	if err != nil {
 		return fmt.Errorf("Unable to init server cert: %s", err)
 	}
-
-	// Set up an enproxy Proxy
-	proxy := &enproxy.Proxy{
-		Dial: server.dialDestination,
-		Host: server.Host,
+	if cert := server.CertContext.Certificate(); cert != nil {
+		log.Debugf("Server key fingerprint, with which clients can pin us: %s", identity.Fingerprint(cert))
 	}
 
 	// Hook into stats reporting if necessary
 	reportingStats := server.startReportingStatsIfNecessary()
 	servingStats := server.startServingStatsIfNecessary()
 
-	if reportingStats || servingStats {
+	// Set up an enproxy Proxy, or one for each tenant so that they're
+	// isolated from each other
+	var proxy http.Handler
+	if server.Tenants == nil {
+		proxy = server.newEnproxy(nil, reportingStats, servingStats)
+	} else {
+		proxy = server.tenantsHandler(reportingStats, servingStats)
+		if servingStats {
+			go server.publishTenantUsage()
+		}
+	}
+
+	if server.Metrics != nil {
+		server.Metrics.AddGauges(resourceGauges)
+		if server.OriginPool != nil {
+			server.Metrics.AddGauges(server.OriginPool.gauges)
+		}
+		server.Metrics.Start()
+	}
+
+	if servingStats {
+		go server.publishResources()
+		if server.OriginPool != nil {
+			go server.publishOriginStats()
+		}
+		if server.Bandwidth != nil {
+			go server.publishBandwidth()
+		}
+	}
+
+	if server.Reputation != nil {
+		server.Reputation.Dial = func(network, addr string) (net.Conn, error) {
+			return server.EgressIPs.dial(addr, dialTimeout)
+		}
+		server.Reputation.OnReport = func(report *reputation.Report) {
+			if servingStats {
+				server.StatServer.OnReputation(report)
+			}
+			if report.Status == reputation.DEGRADED {
+				server.Webhook.Notify(webhook.EVENT_EGRESS_DEGRADED, "", "Reference sites are blocking or captcha-walling our egress IP")
+				server.EgressIPs.Rotate()
+			}
+		}
+		server.Reputation.Start()
+	}
+
+	if server.Feedback != nil && server.Webhook != nil {
+		onBlocked := server.Feedback.OnBlocked
+		server.Feedback.OnBlocked = func(host string) {
+			server.Webhook.Notify(webhook.EVENT_ORIGIN_BLOCKED, log.Redact(host), fmt.Sprintf("Clients report that %s is blocking us", log.Redact(host)))
+			if onBlocked != nil {
+				onBlocked(host)
+			}
+		}
+	}
+	if server.Webhook != nil {
+		go server.watchForWebhooks()
+	}
+
+	if server.DDNS != nil {
+		log.Debugf("Registering %s with dynamic dns", server.DDNS.Host)
+		server.DDNS.Start()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(EGRESS_POLICY_PATH, server.EgressPolicy)
+	mux.Handle(REPUTATION_PATH, server.Reputation)
+	if server.Feedback != nil {
+		mux.Handle(feedback.FEEDBACK_PATH, server.Feedback)
+	}
+	mux.Handle("/", proxy)
+
+	handler := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if server.isHealthRequest(req) {
+			// Answer health checks ourselves rather than proxying them, and
+			// don't log them since load balancers check every few seconds
+			server.serveHealth(resp, req)
+			return
+		}
+		user := ""
+		if server.AccessLog != nil {
+			start := time.Now()
+			logged := &loggedResponseWriter{ResponseWriter: resp}
+			resp = logged
+			defer func() {
+				server.AccessLog.log(req, user, logged, start)
+			}()
+		}
+		span := server.Tracer.Continue("server.accept", trace.SPAN_KIND_SERVER, req.Header.Get(trace.X_LANTERN_TRACE))
+		defer span.Finish(nil)
+		// Only trust a client IP that the front's RewriteRequest reports, not
+		// one that the client sent itself
+		req.Header.Del("X-Forwarded-For")
+		if server.Protocol != nil {
+			rewrite := span.Child("server.rewrite", trace.SPAN_KIND_INTERNAL)
+			server.Protocol.RewriteRequest(req)
+			rewrite.Finish(nil)
+		}
+		if server.AuthToken != "" {
+			if !auth.Authorized(req, server.AuthToken) {
+				// Could be a probe, so just look like an ordinary web server
+				server.AuthDecoy.ServeHTTP(resp, req)
+				return
+			}
+			auth.Strip(req)
+		}
+		policy := server.EgressPolicy
+		var tenant *tenants.Tenant
+		if server.Tenants != nil {
+			var authenticated bool
+			tenant, authenticated = server.Tenants.Select(req)
+			if !authenticated {
+				// Could be a probe, so just look like the decoy site
+				tenant.ServeDecoy(resp, req)
+				return
+			}
+			user = tenant.Name
+			policy = tenant.PolicyOr(policy)
+		}
+		if policy.IsRestricted() {
+			resp.Header().Set(egress.X_LANTERN_EGRESS_POLICY, policy.String())
+		}
+		if server.Reputation != nil {
+			resp.Header().Set(reputation.X_LANTERN_REPUTATION, server.Reputation.Status())
+		}
+		if server.isCapabilitiesRequest(req, tenant) {
+			capabilities.Serve(resp, server.capabilities(tenant))
+			return
+		}
+		if identity.IsRequest(req) {
+			server.proveIdentity(resp, req)
+			return
+		}
+		if server.Prefetch && prefetch.IsPushRequest(req) {
+			server.pushSubresources(resp, req, tenant)
+			return
+		}
+		if span != nil {
+			// enproxy dials the destination while handling the request
+			addr := req.Header.Get(enproxyDestAddrHeader)
+			fetch := span.Child("origin.fetch", trace.SPAN_KIND_CLIENT)
+			fetch.SetAttribute("peer.service", log.Redact(addr))
+			server.pendingSpans.add(addr, fetch)
+			defer server.pendingSpans.remove(addr, fetch)
+			defer fetch.Finish(nil)
+		}
+		mux.ServeHTTP(resp, req)
+	})
+
+	httpServer := &http.Server{
+		Addr:         server.Addr,
+		Handler:      handler,
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: server.WriteTimeout,
+		TLSConfig:    server.TLSConfig,
+	}
+	// TODO: Add flag to reenable this
+	if httpServer.TLSConfig == nil {
+		httpServer.TLSConfig = DEFAULT_TLS_SERVER_CONFIG
+	}
+
+	// Renewed certs are picked up without restarting
+	httpServer.TLSConfig = httpServer.TLSConfig.Clone()
+	httpServer.TLSConfig.GetCertificate = server.CertContext.GetCertificate
+	if server.ClientAuth != nil {
+		server.ClientAuth.Configure(httpServer.TLSConfig)
+	}
+	if server.CertContext.ACME == nil {
+		// The ACME Manager renews its own
+		go server.CertContext.keepRenewed(host)
+	}
+
+	httpServer.ConnState = server.conns.track
+
+	log.Debugf("About to start server (https) proxy at %s", server.Addr)
+	listener, err := handoff.Listen(server.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen at %s: %s", server.Addr, err)
+	}
+	server.listenerMutex.Lock()
+	if server.isDraining() {
+		server.listenerMutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	server.listener = listener
+	server.httpServer = httpServer
+	server.listenerMutex.Unlock()
+	err = httpServer.ServeTLS(listener, "", "")
+	if server.isDraining() {
+		return nil
+	}
+	return err
+}
+
+// newEnproxy creates and starts an enproxy Proxy that dials destinations for
+// the given tenant (which may be nil) and reports bytes to our stats
+func (server *Server) newEnproxy(tenant *tenants.Tenant, reportingStats bool, servingStats bool) *enproxy.Proxy {
+	proxy := &enproxy.Proxy{
+		Dial: func(addr string) (net.Conn, error) {
+			return server.dialDestination(tenant, addr)
+		},
+		Host: server.Host,
+	}
+
+	if reportingStats || servingStats || server.Metrics != nil || server.Bandwidth != nil {
 		// Add callbacks to track bytes given
 		proxy.OnBytesReceived = func(ip string, bytes int64) {
+			server.Metrics.Add("bytes_received", bytes)
+			server.Bandwidth.Add(ip, bytes)
 			if reportingStats {
 				server.StatReporter.OnBytesGiven(ip, bytes)
 			}
@@ -86,6 +365,8 @@ func (server *Server) Run() error {
 			}
 		}
 		proxy.OnBytesSent = func(ip string, bytes int64) {
+			server.Metrics.Add("bytes_sent", bytes)
+			server.Bandwidth.Add(ip, bytes)
 			if reportingStats {
 				server.StatReporter.OnBytesGiven(ip, bytes)
 			}
@@ -96,54 +377,209 @@ func (server *Server) Run() error {
 	}
 
 	proxy.Start()
+	return proxy
+}
 
-	httpServer := &http.Server{
-		Addr:         server.Addr,
-		Handler:      proxy,
-		ReadTimeout:  server.ReadTimeout,
-		WriteTimeout: server.WriteTimeout,
-		TLSConfig:    server.TLSConfig,
+// dialDestination dials the destination server for the given tenant (which
+// may be nil), making sure that it's a global address (unless
+// AllowNonGlobalDestinations) and that it complies with the tenant's (or our)
+// EgressPolicy.  Destinations matching an EgressRouter route are dialed
+// through that route's upstream.  The special socks.UDP_RELAY_ADDR gets a
+// relay for UDP datagrams.  Connections are tracked by our Reaper, if any,
+// and accounted to the tenant.  Media is compressed for destinations that the
+// client marked, if we have a Media Compressor.  Plain http destinations
+// reuse pooled origin connections, if we have an OriginPool.  Dialing is
+// traced if the request for the destination was.
+func (server *Server) dialDestination(tenant *tenants.Tenant, addr string) (net.Conn, error) {
+	policy := tenant.PolicyOr(server.EgressPolicy)
+	if addr == socks.UDP_RELAY_ADDR {
+		// UDP relays have their own idle timeout
+		return socks.NewUDPRelayConn(func(host string) (net.IP, error) {
+			return server.checkDestination(policy, host)
+		})
 	}
-	// TODO: Add flag to reenable this
-	if httpServer.TLSConfig == nil {
-		httpServer.TLSConfig = DEFAULT_TLS_SERVER_CONFIG
+	fetch := server.pendingSpans.take(addr)
+	addr, compressed := protocol.DecodeCompressed(addr)
+	var conn net.Conn
+	var err error
+	compressMedia := false
+	if hop, rest, ok := protocol.NextHop(addr); ok {
+		dial := fetch.Child("hop.dial", trace.SPAN_KIND_CLIENT)
+		conn, err = server.dialNextHop(hop, rest, dial)
+		dial.Finish(err)
+	} else {
+		addr, compressMedia = protocol.DecodeMedia(addr)
+		dial := fetch.Child("origin.dial", trace.SPAN_KIND_CLIENT)
+		if server.OriginPool != nil && isPlainHTTP(addr) {
+			conn, err = server.dialPooledDestination(policy, addr)
+		} else {
+			conn, err = server.dialTCPDestination(policy, addr)
+		}
+		dial.Finish(err)
+	}
+	server.dialStats.record(err)
+	if err != nil {
+		return nil, err
+	}
+	conn = server.Reaper.Track(conn)
+	if tenant != nil {
+		conn = tenant.Track(conn)
+	}
+	if compressMedia && server.Media != nil {
+		conn = server.Media.Wrap(conn)
+	}
+	if compressed {
+		conn = protocol.CompressedPipe(conn)
 	}
+	return conn, nil
+}
 
-	log.Debugf("About to start server (https) proxy at %s", server.Addr)
-	return httpServer.ListenAndServeTLS(server.CertContext.ServerCertFile, server.CertContext.PKFile)
-	//return httpServer.ListenAndServe()
+func (server *Server) dialTCPDestination(policy *egress.Policy, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Errorf("Unable to split destination host and port of %s", log.Redact(addr))
+		return nil, fmt.Errorf("Unable to split destination host and port: %s", err)
+	}
+	route := server.EgressRouter.RouteFor(host)
+
+	if server.AllowNonGlobalDestinations && !policy.IsRestricted() {
+		if route != nil {
+			return route.Dial(addr)
+		}
+		return server.EgressIPs.dial(addr, dialTimeout)
+	}
+
+	ip, err := server.checkDestination(policy, host)
+	if err != nil {
+		return nil, err
+	}
+	if route != nil {
+		// Let the upstream resolve the host itself, since it may see
+		// different (e.g. region-specific) DNS results
+		return route.Dial(addr)
+	}
+	// Dial the IP that we checked rather than resolving the host again
+	return server.EgressIPs.dial(net.JoinHostPort(ip.String(), port), dialTimeout)
 }
 
-// dialDestination dials the destination server and wraps the resulting net.Conn
-// in a countingConn if an InstanceId was configured.
-func (server *Server) dialDestination(addr string) (net.Conn, error) {
-	if !server.AllowNonGlobalDestinations {
-		host := strings.Split(addr, ":")[0]
-		ipAddr, err := net.ResolveIPAddr("ip", host)
+// dialPooledDestination returns a connection to the given plain http
+// destination that's served from our OriginPool.  The destination is checked
+// upfront so that disallowed destinations still fail to dial.
+func (server *Server) dialPooledDestination(policy *egress.Policy, addr string) (net.Conn, error) {
+	if !server.AllowNonGlobalDestinations || policy.IsRestricted() {
+		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
-			err = fmt.Errorf("Unable to resolve destination IP addr: %s", err)
-			log.Error(err.Error())
-			return nil, err
+			return nil, fmt.Errorf("Unable to split destination host and port: %s", err)
 		}
-		if !ipAddr.IP.IsGlobalUnicast() {
-			err = fmt.Errorf("Not accepting connections to non-global address: %s", host)
-			log.Error(err.Error())
+		if _, err := server.checkDestination(policy, host); err != nil {
 			return nil, err
 		}
 	}
-	return net.DialTimeout("tcp", addr, dialTimeout)
+	return server.OriginPool.Wrap(policy, addr, func(addr string) (net.Conn, error) {
+		return server.dialTCPDestination(policy, addr)
+	}), nil
+}
+
+// dialNextHop dials the rest of a multi-hop destination address through the
+// given next hop, acting as an intermediate hop.  We only relay to hops in our
+// AllowedHops so that we can't be used to reach arbitrary servers.  The next
+// hop continues the trace of the given span, if any.
+func (server *Server) dialNextHop(hop string, rest string, span *trace.Span) (net.Conn, error) {
+	hop = protocol.NormalizeHop(hop)
+	allowed := false
+	for _, allowedHop := range server.AllowedHops {
+		if protocol.NormalizeHop(allowedHop) == hop {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		log.Errorf("Not relaying to disallowed hop %s", hop)
+		return nil, fmt.Errorf("Not relaying to disallowed hop %s", hop)
+	}
+
+	config, err := server.enproxyConfigForHop(hop)
+	if err != nil {
+		return nil, err
+	}
+	if span != nil {
+		config = withTraceHeader(config, span)
+	}
+	conn := &enproxy.Conn{
+		Addr:   rest,
+		Config: config,
+	}
+	if err := conn.Connect(); err != nil {
+		return nil, fmt.Errorf("Unable to connect to next hop %s: %s", hop, err)
+	}
+	return conn, nil
 }
 
-// initServerCert initializes a PK + cert for use by a server proxy, signed by
-// the CA certificate.  We always generate a new certificate just in case.
+// enproxyConfigForHop returns the (cached) enproxy.Config for relaying to the
+// given next hop, which we dial directly (without fronting)
+func (server *Server) enproxyConfigForHop(hop string) (*enproxy.Config, error) {
+	server.hopConfigsMutex.Lock()
+	defer server.hopConfigsMutex.Unlock()
+	if config := server.hopConfigs[hop]; config != nil {
+		return config, nil
+	}
+	host, portString, _ := net.SplitHostPort(hop)
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port for hop %s: %s", hop, err)
+	}
+	cp, err := cloudflare.NewClientProtocol(&protocol.ClientConfig{
+		UpstreamHost: host,
+		UpstreamPort: port,
+		RootCA:       server.HopRootCA,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to initialize protocol for hop %s: %s", hop, err)
+	}
+	if server.hopConfigs == nil {
+		server.hopConfigs = make(map[string]*enproxy.Config)
+	}
+	config := protocol.EnproxyConfig(cp)
+	if server.AuthToken != "" {
+		// Hops are expected to share our token
+		config = withHeader(config, auth.X_LANTERN_AUTH, server.AuthToken)
+	}
+	server.hopConfigs[hop] = config
+	return config, nil
+}
+
+// checkDestination resolves the given destination host and makes sure that
+// it's a global address (unless AllowNonGlobalDestinations) and that it
+// complies with the given egress policy.
+func (server *Server) checkDestination(policy *egress.Policy, host string) (net.IP, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		log.Errorf("Unable to resolve destination IP addr for %s", log.Redact(host))
+		return nil, fmt.Errorf("Unable to resolve destination IP addr: %s", err)
+	}
+	if !server.AllowNonGlobalDestinations && !ipAddr.IP.IsGlobalUnicast() {
+		log.Errorf("Not accepting connections to non-global address: %s", log.Redact(host))
+		return nil, fmt.Errorf("Not accepting connections to non-global address: %s", host)
+	}
+	if err := policy.Check(ipAddr.IP); err != nil {
+		log.Errorf("Not accepting connection to %s: %s", log.Redact(host), err)
+		return nil, err
+	}
+	return ipAddr.IP, nil
+}
+
+// initServerCert initializes a PK + self-signed cert for use by a server
+// proxy, and starts serving it.  We always generate a new certificate just in
+// case, reusing the PK so that clients that trust the previous cert (e.g. with
+// -rootca) also trust the new one.
 func (ctx *CertContext) initServerCert(host string) (err error) {
-	if ctx.pk, err = keyman.LoadPKFromFile(ctx.PKFile); err != nil {
+	if ctx.pk, err = LoadPK(ctx.PKFile); err != nil {
 		if os.IsNotExist(err) {
-			log.Debugf("Creating new PK at: %s", ctx.PKFile)
-			if ctx.pk, err = keyman.GeneratePK(2048); err != nil {
-				return
+			if ctx.pk, err = GeneratePK(ctx.KeyType, ctx.KeySize); err != nil {
+				return fmt.Errorf("Unable to generate private key: %s", err)
 			}
-			if err = ctx.pk.WriteToFile(ctx.PKFile); err != nil {
+			log.Debugf("Creating new %s PK at: %s", DescribePK(ctx.pk), ctx.PKFile)
+			if err = WritePK(ctx.pk, ctx.PKFile); err != nil {
 				return fmt.Errorf("Unable to save private key: %s", err)
 			}
 		} else {
@@ -152,14 +588,26 @@ func (ctx *CertContext) initServerCert(host string) (err error) {
 	}
 
 	log.Debugf("Creating new server cert at: %s", ctx.ServerCertFile)
-	ctx.serverCert, err = ctx.pk.TLSCertificateFor("Lantern", host, TEN_YEARS_FROM_TODAY, true, nil)
+	leaf, err := selfSignedCert(ctx.pk, host, time.Now().Add(SERVER_CERT_VALIDITY))
 	if err != nil {
 		return
 	}
-	err = ctx.serverCert.WriteToFile(ctx.ServerCertFile)
+	if err = writeCert(leaf, ctx.ServerCertFile); err != nil {
+		return fmt.Errorf("Unable to save server cert: %s", err)
+	}
+	serverCert, err := keyman.LoadCertificateFromX509(leaf)
 	if err != nil {
 		return
 	}
+	tlsCert := &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  ctx.pk,
+		Leaf:        leaf,
+	}
+	ctx.mutex.Lock()
+	ctx.serverCert = serverCert
+	ctx.tlsCert = tlsCert
+	ctx.mutex.Unlock()
 	return nil
 }
 
@@ -184,3 +632,12 @@ func (server *Server) startServingStatsIfNecessary() bool {
 		return false
 	}
 }
+
+// publishResources periodically publishes our own resource usage to our
+// StatServer
+func (server *Server) publishResources() {
+	for {
+		time.Sleep(RESOURCES_INTERVAL)
+		server.StatServer.OnResources(resources.Current())
+	}
+}
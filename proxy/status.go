@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/blocklist"
+	"github.com/getlantern/flashlight/capabilities"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/resources"
+	"github.com/getlantern/flashlight/selftest"
+	"github.com/getlantern/flashlight/users"
+)
+
+const (
+	STATUS_PATH = "/status" // path at which the client reports its Status to direct (non-proxy) requests
+)
+
+// Status is the client's status, as JSON for consumption by router UIs such
+// as LuCI
+type Status struct {
+	Uptime          int64                      `json:"uptime"` // seconds
+	Protocol        string                     `json:"protocol,omitempty"`
+	Host            string                     `json:"host,omitempty"`            // masquerade or server that we last dialed
+	HostCertExpires *time.Time                 `json:"hostcertexpires,omitempty"` // when Host's certificate expires
+	Bytes           int64                      `json:"bytes"`                     // sent and received through us since we started
+	HTTPAddr        string                     `json:"httpaddr"`
+	SocksAddr       string                     `json:"socksaddr,omitempty"`
+	TransparentAddr string                     `json:"transparentaddr,omitempty"`
+	DNSAddr         string                     `json:"dnsaddr,omitempty"`
+	Listeners       []*Listener                `json:"listeners,omitempty"`
+	Goroutines      int                        `json:"goroutines"`
+	MemoryBytes     uint64                     `json:"memorybytes"` // bytes obtained from the OS
+	Users           map[string]*users.Usage    `json:"users,omitempty"`
+	Upstreams       []*protocol.ProbeResult    `json:"upstreams,omitempty"`
+	TLS             *protocol.TLSStats         `json:"tls"`                   // handshakes with fronting providers
+	ClockOffset     float64                    `json:"clockoffset,omitempty"` // seconds by which the system clock is corrected, see protocol.SyncClock
+	Resources       *resources.Usage           `json:"resources"`
+	RecentErrors    []*log.RecentError         `json:"recenterrors,omitempty"`
+	Trends          []*selftest.Trend          `json:"trends,omitempty"`       // found by the SelfTests
+	Aborted         int64                      `json:"abortedhandshakes"`      // direct https CONNECTs whose browsers went away before their handshakes
+	Reused          int64                      `json:"reuseddials"`            // connections dialed for those that were reused for later CONNECTs
+	Capabilities    *capabilities.Capabilities `json:"capabilities,omitempty"` // of the server, once discovered
+	Blocklists      []*blocklist.ListStatus    `json:"blocklists,omitempty"`   // subscriptions of our Blocklist
+}
+
+// isStatusRequest indicates whether the given request is for our status
+// rather than something to proxy
+func isStatusRequest(req *http.Request) bool {
+	return req.Method == "GET" && req.URL.Host == "" && req.URL.Path == STATUS_PATH
+}
+
+func (client *Client) serveStatus(resp http.ResponseWriter) {
+	usage := resources.Current()
+	status := &Status{
+		Uptime:          int64(time.Now().Sub(client.started).Seconds()),
+		HTTPAddr:        client.Addr,
+		SocksAddr:       client.SocksAddr,
+		TransparentAddr: client.TransparentAddr,
+		DNSAddr:         client.DNSAddr,
+		Listeners:       client.Listeners,
+		Goroutines:      usage.Goroutines,
+		MemoryBytes:     usage.MemoryBytes,
+		Upstreams:       client.Prober.Results(),
+		TLS:             protocol.CurrentTLSStats(),
+		ClockOffset:     protocol.ClockOffset().Seconds(),
+		Resources:       usage,
+		RecentErrors:    log.RecentErrors(),
+		Trends:          client.SelfTests.Trends(),
+		Capabilities:    client.serverCapabilities(),
+		Blocklists:      client.Blocklist.Lists(),
+	}
+	if client.CurrentProtocol != nil {
+		status.Protocol = client.CurrentProtocol()
+	}
+	if client.CurrentHost != nil {
+		status.Host = client.CurrentHost()
+		if expires := protocol.CertExpiry(status.Host); !expires.IsZero() {
+			status.HostCertExpires = &expires
+		}
+	}
+	status.Bytes = client.conns.totalBytes()
+	status.Aborted = atomic.LoadInt64(&client.predialed.aborted)
+	status.Reused = atomic.LoadInt64(&client.predialed.reused)
+	if client.Users != nil {
+		status.Users = make(map[string]*users.Usage)
+		for _, user := range client.Users.Users {
+			status.Users[user.Name] = user.Usage()
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(status)
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// streamingResponseWriter is an http.ResponseWriter that flushes after every
+// write once it sees that the response is a stream (Server-Sent Events or a
+// body of unknown length, e.g. chunked), so that events and long-poll
+// responses reach the browser right away rather than at the next
+// FlushInterval.
+type streamingResponseWriter struct {
+	http.ResponseWriter
+	flusher   http.Flusher
+	streaming bool
+}
+
+// withStreaming wraps the given ResponseWriter with a streamingResponseWriter
+// if it can be flushed
+func withStreaming(resp http.ResponseWriter) http.ResponseWriter {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		return resp
+	}
+	return &streamingResponseWriter{ResponseWriter: resp, flusher: flusher}
+}
+
+func (resp *streamingResponseWriter) WriteHeader(status int) {
+	resp.streaming = isStream(resp.Header())
+	resp.ResponseWriter.WriteHeader(status)
+	if resp.streaming {
+		// Let the browser know that the stream has started
+		resp.flusher.Flush()
+	}
+}
+
+func (resp *streamingResponseWriter) Write(b []byte) (int, error) {
+	n, err := resp.ResponseWriter.Write(b)
+	if resp.streaming {
+		resp.flusher.Flush()
+	}
+	return n, err
+}
+
+func (resp *streamingResponseWriter) Flush() {
+	resp.flusher.Flush()
+}
+
+// isStream indicates whether a response with the given headers is a stream
+func isStream(header http.Header) bool {
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	return strings.HasPrefix(contentType, "text/event-stream") || header.Get("Content-Length") == ""
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreaming(t *testing.T) {
+	rec := httptest.NewRecorder()
+	resp := withStreaming(rec)
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.WriteHeader(200)
+	rec.Flushed = false
+	resp.Write([]byte("data: hello\n\n"))
+	if !rec.Flushed {
+		t.Error("Event wasn't flushed")
+	}
+
+	rec = httptest.NewRecorder()
+	resp = withStreaming(rec)
+	resp.Header().Set("Content-Type", "text/html")
+	resp.Header().Set("Content-Length", "5")
+	resp.WriteHeader(200)
+	resp.Write([]byte("hello"))
+	if rec.Flushed {
+		t.Error("Response of known length shouldn't be flushed on every write")
+	}
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/getlantern/flashlight/tenants"
+)
+
+const (
+	TENANT_USAGE_INTERVAL = 1 * time.Minute
+)
+
+// tenantsHandler returns a handler that proxies each request with an enproxy
+// Proxy of its own tenant, enforcing the tenant's DailyCap.  Requests have
+// already been authenticated.
+func (server *Server) tenantsHandler(reportingStats bool, servingStats bool) http.Handler {
+	proxies := make(map[*tenants.Tenant]http.Handler)
+	for _, tenant := range server.Tenants.Tenants {
+		proxies[tenant] = server.newEnproxy(tenant, reportingStats, servingStats)
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		tenant, _ := server.Tenants.Select(req)
+		if tenant == nil {
+			http.NotFound(resp, req)
+			return
+		}
+		if tenant.IsOverCap() {
+			http.Error(resp, "Daily data cap reached", http.StatusForbidden)
+			return
+		}
+		req.Header.Del(tenants.X_LANTERN_TENANT_TOKEN)
+		proxies[tenant].ServeHTTP(resp, req)
+	})
+}
+
+// publishTenantUsage periodically publishes each tenant's usage to our
+// StatServer
+func (server *Server) publishTenantUsage() {
+	for {
+		time.Sleep(TENANT_USAGE_INTERVAL)
+		for _, usage := range server.Tenants.Usages() {
+			server.StatServer.OnTenantUsage(usage)
+		}
+	}
+}
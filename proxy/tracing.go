@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/trace"
+)
+
+const (
+	// enproxyDestAddrHeader is the header in which enproxy sends a tunnel's
+	// destination address
+	enproxyDestAddrHeader = "X-Enproxy-Dest-Addr"
+)
+
+// withTrace returns a copy of the given config that records dialing the
+// server as an upstream.dial span within the given span (if any) and
+// propagates the trace to the server
+func withTrace(config *enproxy.Config, span *trace.Span) *enproxy.Config {
+	if span == nil {
+		return config
+	}
+	dial := span.Child("upstream.dial", trace.SPAN_KIND_CLIENT)
+	dialProxy := config.DialProxy
+	wrapped := withTraceHeader(config, dial)
+	wrapped.DialProxy = func(addr string) (net.Conn, error) {
+		conn, err := dialProxy(addr)
+		// Only the first dial counts
+		dial.Finish(err)
+		return conn, err
+	}
+	return wrapped
+}
+
+// withTraceHeader returns a copy of the given config whose first request
+// carries the given span's context in the X-Lantern-Trace header.  That's the
+// request on which servers dial the destination, the rest of the tunnel's
+// requests aren't traced.
+func withTraceHeader(config *enproxy.Config, span *trace.Span) *enproxy.Config {
+	newRequest := config.NewRequest
+	wrapped := *config
+	var sent int32
+	wrapped.NewRequest = func(host string, method string, body io.Reader) (*http.Request, error) {
+		req, err := newRequest(host, method, body)
+		if err == nil && atomic.CompareAndSwapInt32(&sent, 0, 1) {
+			req.Header.Set(trace.X_LANTERN_TRACE, span.TraceParent())
+		}
+		return req, err
+	}
+	return &wrapped
+}
+
+// pendingSpans hands the origin.fetch spans of traced requests to
+// dialDestination, which enproxy calls with just the destination address
+// while it's handling the request.  Concurrent traced requests for the same
+// destination may get each other's spans, which doesn't matter much for
+// latency.
+type pendingSpans struct {
+	spans map[string][]*trace.Span
+	mutex sync.Mutex
+}
+
+// add adds the span of a request for the given destination
+func (pending *pendingSpans) add(addr string, span *trace.Span) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	if pending.spans == nil {
+		pending.spans = make(map[string][]*trace.Span)
+	}
+	pending.spans[addr] = append(pending.spans[addr], span)
+}
+
+// take removes and returns the oldest span for the given destination, or nil
+// if there's none
+func (pending *pendingSpans) take(addr string) *trace.Span {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	spans := pending.spans[addr]
+	if len(spans) == 0 {
+		return nil
+	}
+	pending.removeLocked(addr, spans[0])
+	return spans[0]
+}
+
+// remove removes the given span for the given destination, if it wasn't
+// taken
+func (pending *pendingSpans) remove(addr string, span *trace.Span) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	pending.removeLocked(addr, span)
+}
+
+func (pending *pendingSpans) removeLocked(addr string, span *trace.Span) {
+	spans := pending.spans[addr]
+	for i, s := range spans {
+		if s == span {
+			spans = append(spans[:i:i], spans[i+1:]...)
+			break
+		}
+	}
+	if len(spans) == 0 {
+		delete(pending.spans, addr)
+	} else {
+		pending.spans[addr] = spans
+	}
+}
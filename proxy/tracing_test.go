@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/trace"
+)
+
+func TestTracePropagation(t *testing.T) {
+	tracer := &trace.Tracer{SampleRate: 1}
+	span := tracer.StartTrace("client.accept", trace.SPAN_KIND_SERVER)
+	config := withTraceHeader(&enproxy.Config{
+		NewRequest: func(host string, method string, body io.Reader) (*http.Request, error) {
+			return http.NewRequest(method, "http://"+host+"/", body)
+		},
+	}, span)
+	first, _ := config.NewRequest("fl1.example.org", "POST", nil)
+	second, _ := config.NewRequest("fl1.example.org", "POST", nil)
+	if first.Header.Get(trace.X_LANTERN_TRACE) != span.TraceParent() || second.Header.Get(trace.X_LANTERN_TRACE) != "" {
+		t.Errorf("Only the tunnel's first request should carry the trace")
+	}
+
+	pending := &pendingSpans{}
+	a, b := span.Child("origin.fetch", trace.SPAN_KIND_CLIENT), span.Child("origin.fetch", trace.SPAN_KIND_CLIENT)
+	pending.add("example.com:443", a)
+	pending.add("example.com:443", b)
+	pending.remove("example.com:443", a)
+	if taken := pending.take("example.com:443"); taken != b {
+		t.Errorf("Expected the remaining span")
+	}
+	if taken := pending.take("example.com:443"); taken != nil || len(pending.spans) != 0 {
+		t.Errorf("Expected no more spans")
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/pipe"
+	"github.com/getlantern/flashlight/rules"
+)
+
+// isUpgrade indicates whether the given plain http request asks to switch
+// protocols, e.g. to websockets
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyUpgrade handles a plain http request that asks to switch protocols,
+// which ReverseProxy can't do since it doesn't hijack the connection.  It
+// forwards the request to the destination on a connection of its own and
+// relays the response.  If the destination switches protocols, the
+// connections are relayed raw from then on.
+func (client *Client) proxyUpgrade(engine *rules.Engine, resp http.ResponseWriter, req *http.Request) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, "Unable to hijack connection", http.StatusInternalServerError)
+		return
+	}
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+	dest, err := client.dial(engine, addr)
+	if err != nil {
+		log.Debugf("Unable to dial %s for upgrade: %s", log.Redact(addr), err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer dest.Close()
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to hijack connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	req.Header.Del("Proxy-Connection")
+	if err := req.Write(dest); err != nil {
+		log.Debugf("Unable to write upgrade request to %s: %s", log.Redact(addr), err)
+		return
+	}
+	destReader := bufio.NewReader(dest)
+	destResp, err := http.ReadResponse(destReader, req)
+	if err != nil {
+		log.Debugf("Unable to read upgrade response from %s: %s", log.Redact(addr), err)
+		return
+	}
+	err = destResp.Write(conn)
+	destResp.Body.Close()
+	if err != nil || destResp.StatusCode != http.StatusSwitchingProtocols {
+		// Destination declined, we're done since we've taken over the
+		// connection
+		return
+	}
+	sent, received := pipe.Relay(&bufferedConn{conn, rw.Reader}, &bufferedConn{dest, destReader})
+	log.Debugf("Relayed %d bytes to and %d bytes from %s after upgrade", sent, received, log.Redact(addr))
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader, which may
+// have buffered data following an http exchange
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.br.Read(b)
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/flashlight/rules"
+)
+
+func TestUpgrade(t *testing.T) {
+	// Origin that switches to echoing
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Header.Get("Upgrade") != "websocket" {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		io.Copy(conn, br)
+	}()
+
+	client := &Client{
+		Rules: &rules.Engine{Rules: []*rules.Rule{{Domain: "*", Route: rules.ROUTE_DIRECT}}},
+	}
+	server := httptest.NewServer(client)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial client: %s", err)
+	}
+	defer conn.Close()
+	origin := l.Addr().String()
+	io.WriteString(conn, "GET http://"+origin+"/socket HTTP/1.1\r\nHost: "+origin+"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Unable to read response: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(br, echo); err != nil {
+		t.Fatalf("Unable to read echo: %s", err)
+	}
+	if string(echo) != "ping" {
+		t.Errorf("Expected ping, got %s", echo)
+	}
+}
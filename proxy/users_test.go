@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/flashlight/rules"
+	"github.com/getlantern/flashlight/users"
+)
+
+func TestReverseProxyPerUser(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	alice := &users.User{Name: "alice", Rules: &rules.Engine{Rules: []*rules.Rule{{Domain: "*", Route: rules.ROUTE_DIRECT}}}}
+	bob := &users.User{Name: "bob"}
+	client := &Client{
+		// Without their own rules, users get the client's, which block
+		// everything
+		Rules:    &rules.Engine{Rules: []*rules.Rule{{Domain: "*", Block: true}}},
+		Prefetch: true,
+	}
+	client.buildReverseProxy()
+
+	fetch := func(user *users.User) int {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		resp := httptest.NewRecorder()
+		client.reverseProxyFor(user).ServeHTTP(resp, req)
+		return resp.Code
+	}
+	if code := fetch(alice); code != http.StatusOK {
+		t.Errorf("alice's rules route directly, expected 200, got %d", code)
+	}
+	if code := fetch(bob); code != http.StatusBadGateway {
+		t.Errorf("bob gets the client's rules, expected 502, got %d", code)
+	}
+	if code := fetch(nil); code != http.StatusBadGateway {
+		t.Errorf("Without a user, expected the client's rules and 502, got %d", code)
+	}
+
+	if client.reverseProxyFor(alice) != client.reverseProxyFor(alice) {
+		t.Errorf("alice should keep her reverse proxy")
+	}
+	if client.reverseProxyFor(alice) == client.reverseProxyFor(bob) {
+		t.Errorf("Users shouldn't share reverse proxies")
+	}
+	reloaded := &users.User{Name: "alice"}
+	if client.reverseProxyFor(reloaded) == client.reverseProxyFor(alice) {
+		t.Errorf("Reloaded users should get a new reverse proxy")
+	}
+	if fetch(reloaded) != http.StatusBadGateway {
+		t.Errorf("Reloaded alice has no rules of her own anymore")
+	}
+}
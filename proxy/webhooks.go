@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/webhook"
+	"github.com/getlantern/keyman"
+)
+
+const (
+	WEBHOOK_WATCH_INTERVAL = 1 * time.Minute     // how often to check for events to notify the operator of
+	CERT_EXPIRY_WARNING    = 30 * 24 * time.Hour // how long before a certificate expires to notify the operator
+	ERROR_SPIKE_RATE       = 0.5                 // fraction of failed destination dials that counts as a spike
+	ERROR_SPIKE_MIN_DIALS  = 20                  // dials per WEBHOOK_WATCH_INTERVAL below which we don't judge the error rate
+	ERROR_SPIKE_INTERVALS  = 3                   // consecutive WEBHOOK_WATCH_INTERVALs of spiking before notifying
+)
+
+// dialStats counts the server's destination dials, for spotting error rate
+// spikes
+type dialStats struct {
+	dials    int64
+	failures int64
+}
+
+// record counts a dial that failed with the given error (or succeeded)
+func (stats *dialStats) record(err error) {
+	atomic.AddInt64(&stats.dials, 1)
+	if err != nil {
+		atomic.AddInt64(&stats.failures, 1)
+	}
+}
+
+// reset returns the counts so far and starts over
+func (stats *dialStats) reset() (dials int64, failures int64) {
+	return atomic.SwapInt64(&stats.dials, 0), atomic.SwapInt64(&stats.failures, 0)
+}
+
+// watchForWebhooks periodically checks for events that aren't notified as
+// they happen (certificates nearing expiry, tenants over their caps and
+// error rate spikes) and notifies our Webhook of them
+func (server *Server) watchForWebhooks() {
+	spiking := 0
+	server.dialStats.reset()
+	for {
+		server.checkCerts()
+		if server.Tenants != nil {
+			for _, tenant := range server.Tenants.Tenants {
+				if tenant.IsOverCap() {
+					server.Webhook.Notify(webhook.EVENT_QUOTA_EXHAUSTED, tenant.Name, fmt.Sprintf("Tenant %s used up its daily cap of %d bytes", tenant.Name, tenant.DailyCap))
+				}
+			}
+		}
+		time.Sleep(WEBHOOK_WATCH_INTERVAL)
+		dials, failures := server.dialStats.reset()
+		if dials >= ERROR_SPIKE_MIN_DIALS && float64(failures)/float64(dials) >= ERROR_SPIKE_RATE {
+			spiking++
+		} else {
+			spiking = 0
+		}
+		if spiking >= ERROR_SPIKE_INTERVALS {
+			server.Webhook.Notify(webhook.EVENT_ERROR_RATE_SPIKE, "", fmt.Sprintf("%d of %d dials to destinations failed in the last %v", failures, dials, WEBHOOK_WATCH_INTERVAL))
+		}
+	}
+}
+
+// checkCerts notifies our Webhook of our certificates (the server's own and
+// the HopRootCA) that expire within CERT_EXPIRY_WARNING
+func (server *Server) checkCerts() {
+	if server.CertContext != nil {
+		server.checkCert(filepath.Base(server.CertContext.ServerCertFile), server.CertContext.Certificate())
+	}
+	if server.HopRootCA != "" {
+		cert, err := keyman.LoadCertificateFromPEMBytes([]byte(server.HopRootCA))
+		if err != nil {
+			log.Errorf("Unable to parse hop root CA: %s", err)
+			return
+		}
+		server.checkCert("hop root CA", cert.X509())
+	}
+}
+
+func (server *Server) checkCert(name string, cert *x509.Certificate) {
+	if cert == nil || time.Now().Add(CERT_EXPIRY_WARNING).Before(cert.NotAfter) {
+		return
+	}
+	verb := "expires"
+	if time.Now().After(cert.NotAfter) {
+		verb = "expired"
+	}
+	server.Webhook.Notify(webhook.EVENT_CERT_EXPIRING, name, fmt.Sprintf("Certificate %s %s on %s", name, verb, cert.NotAfter.Format("2006-01-02")))
+}
@@ -0,0 +1,169 @@
+package proxydialer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectProxy is an HTTP proxy that answers CONNECT with status and, like
+// some proxies, sends greeting in the same write as its response, then echoes
+func connectProxy(t *testing.T, status int, greeting string, gotAuth *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		*gotAuth = req.Header.Get("Proxy-Authorization")
+		if req.Method != "CONNECT" || req.Host != "example.com:443" {
+			t.Errorf("Unexpected request %s %s", req.Method, req.Host)
+		}
+		if status != http.StatusOK {
+			resp.WriteHeader(status)
+			return
+		}
+		conn, _, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Unable to hijack: %s", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n" + greeting))
+		io.Copy(conn, conn)
+	}))
+}
+
+func TestCONNECT(t *testing.T) {
+	var gotAuth string
+	server := connectProxy(t, http.StatusOK, "hello", &gotAuth)
+	defer server.Close()
+
+	dial, err := New("http://user:pass@"+server.Listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create dialer: %s", err)
+	}
+	conn, err := dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if gotAuth != expectedAuth {
+		t.Errorf("Wrong Proxy-Authorization %q, expected %q", gotAuth, expectedAuth)
+	}
+	// The greeting arrived with the CONNECT response, so it's only read if
+	// the bufio.Reader that read the response is kept
+	greeting := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, greeting); err != nil || string(greeting) != "hello" {
+		t.Errorf("Lost bytes buffered after the CONNECT response, got %q: %v", greeting, err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Unable to write: %s", err)
+	}
+	echoed := make([]byte, len("ping"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "ping" {
+		t.Errorf("Wrong echo %q: %v", echoed, err)
+	}
+}
+
+func TestCONNECTRefused(t *testing.T) {
+	var gotAuth string
+	server := connectProxy(t, http.StatusProxyAuthRequired, "", &gotAuth)
+	defer server.Close()
+
+	dial, err := New("http://"+server.Listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create dialer: %s", err)
+	}
+	conn, err := dial("tcp", "example.com:443")
+	if err == nil {
+		conn.Close()
+		t.Fatalf("Expected error from refused CONNECT")
+	}
+	if !strings.Contains(err.Error(), "407") {
+		t.Errorf("Error doesn't mention the proxy's status: %s", err)
+	}
+	if gotAuth != "" {
+		t.Errorf("Sent Proxy-Authorization without credentials: %s", gotAuth)
+	}
+}
+
+// socks5Proxy serves one SOCKS5 client that authenticates with user:pass and
+// connects to a domain, reporting the destination and echoing
+func socks5Proxy(t *testing.T, l net.Listener, dest chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			t.Errorf("Unable to read from SOCKS5 client: %s", err)
+		}
+		return b
+	}
+
+	// Greeting, we pick username/password authentication
+	greeting := read(2)
+	read(int(greeting[1]))
+	conn.Write([]byte{5, 2})
+	// Username and password
+	read(1)
+	user := string(read(int(read(1)[0])))
+	pass := string(read(int(read(1)[0])))
+	if user != "user" || pass != "pass" {
+		t.Errorf("Wrong credentials %s:%s", user, pass)
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+	// CONNECT to a domain
+	request := read(4)
+	if request[1] != 1 || request[3] != 3 {
+		t.Errorf("Unexpected SOCKS5 request %v", request)
+		return
+	}
+	host := string(read(int(read(1)[0])))
+	port := binary.BigEndian.Uint16(read(2))
+	dest <- net.JoinHostPort(host, strconv.Itoa(int(port)))
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	io.Copy(conn, br)
+}
+
+func TestSOCKS5(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	dest := make(chan string, 1)
+	go socks5Proxy(t, l, dest)
+
+	dial, err := New("socks5://user:pass@"+l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create dialer: %s", err)
+	}
+	conn, err := dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+
+	if d := <-dest; d != "example.com:443" {
+		t.Errorf("Proxy connected to %s, expected example.com:443", d)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Unable to write: %s", err)
+	}
+	echoed := make([]byte, len("ping"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "ping" {
+		t.Errorf("Wrong echo %q: %v", echoed, err)
+	}
+}
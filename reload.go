@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/flashlight/client"
+	"github.com/getlantern/flashlight/clientauth"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/rules"
+)
+
+const (
+	RELOAD_POLL_INTERVAL = 2 * time.Second
+)
+
+var (
+	reloadMutex sync.Mutex
+
+	// currentClient is the client, if we're a client
+	currentClient *client.Client
+
+	// currentClientAuth verifies client certificates, if we're a server with
+	// -requireclientcert
+	currentClientAuth *clientauth.Verifier
+)
+
+// reloadOnChange reloads the -config and -rules files whenever we get a
+// SIGHUP and, with -watchconfig, whenever they change on disk.  The given
+// rules are the client's, if any.
+func reloadOnChange(engine *rules.Engine) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Debug("Got SIGHUP, reloading configuration")
+			reload(engine)
+		}
+	}()
+	if *watchConfig {
+		go watchFiles(func() {
+			log.Debug("Configuration changed, reloading")
+			reload(engine)
+		}, *configFile, *rulesFile, *clientAllowlist)
+	}
+}
+
+// watchFiles calls onChange whenever one of the given files (empty names are
+// ignored) is modified.  Files are polled rather than watched through the OS,
+// which works the same everywhere (including on routers) and is cheap for a
+// couple of files.
+func watchFiles(onChange func(), filenames ...string) {
+	modified := func() map[string]time.Time {
+		times := make(map[string]time.Time)
+		for _, filename := range filenames {
+			if filename == "" {
+				continue
+			}
+			if info, err := os.Stat(filename); err == nil {
+				times[filename] = info.ModTime()
+			}
+		}
+		return times
+	}
+	last := modified()
+	for {
+		time.Sleep(RELOAD_POLL_INTERVAL)
+		current := modified()
+		for filename, t := range current {
+			if !t.Equal(last[filename]) {
+				onChange()
+				break
+			}
+		}
+		last = current
+	}
+}
+
+// reload applies the current -config and -rules files.  Changes to rules,
+// servers, masquerade hosts and logging take effect immediately, without dropping
+// connections.  Other changes are logged as requiring a restart.  If a file
+// is invalid, the current configuration is kept and an error is returned.
+func reload(engine *rules.Engine) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	var result error
+	if engine != nil && *rulesFile != "" {
+		if err := engine.Reload(); err != nil {
+			log.Errorf("Unable to reload rules, keeping the current ones: %s", err)
+			result = fmt.Errorf("Unable to reload rules: %s", err)
+		} else {
+			log.Debugf("Reloaded %d rule(s)", len(engine.Current()))
+		}
+	}
+
+	if currentClientAuth != nil && *clientAllowlist != "" {
+		if err := currentClientAuth.Reload(); err != nil {
+			log.Errorf("Unable to reload client allowlist, keeping the current one: %s", err)
+			if result == nil {
+				result = fmt.Errorf("Unable to reload client allowlist: %s", err)
+			}
+		} else {
+			log.Debugf("Reloaded client allowlist with %d client(s)", currentClientAuth.Allowed())
+		}
+	}
+
+	if *configFile == "" {
+		return result
+	}
+	settings, err := loadConfigFile(*configFile)
+	if err != nil {
+		log.Errorf("Unable to reload config file, keeping the current configuration: %s", err)
+		if result == nil {
+			result = fmt.Errorf("Unable to reload config file: %s", err)
+		}
+		return result
+	}
+	applySettings(mergeSettings(fileSettings, remoteSettings), mergeSettings(settings, remoteSettings))
+	fileSettings = settings
+	return result
+}
+
+// applySettings applies the settings that differ between old and new, except
+// for those given on the command line, which take precedence.  Settings that
+// are only in old revert to their defaults.
+func applySettings(old map[string]string, new map[string]string) {
+	for _, name := range changedSettings(old, new) {
+		if commandLineFlags[name] {
+			continue
+		}
+		value, found := new[name]
+		if !found {
+			value = flag.Lookup(name).DefValue
+		}
+		if !applySetting(name, value) {
+			log.Errorf("Changing -%s requires a restart", name)
+		}
+	}
+}
+
+// mergeSettings returns the given settings, with those in override taking
+// precedence
+func mergeSettings(settings map[string]string, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(settings)+len(override))
+	for name, value := range settings {
+		merged[name] = value
+	}
+	for name, value := range override {
+		merged[name] = value
+	}
+	return merged
+}
+
+// changedSettings returns the names of the flags whose settings differ
+// between old and new
+func changedSettings(old map[string]string, new map[string]string) []string {
+	var changed []string
+	for name, value := range new {
+		if oldValue, found := old[name]; !found || oldValue != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, found := new[name]; !found {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// applySetting applies the given value of the named flag to the running
+// proxy, returning false if that's not possible without a restart
+func applySetting(name string, value string) bool {
+	switch name {
+	case "logdestinations":
+		logDestinations, err := strconv.ParseBool(value)
+		if err != nil {
+			return false
+		}
+		if logDestinations && *shipLogsURL != "" {
+			log.Errorf("Not logging destinations, since logs are shipped to -shiplogs")
+			return true
+		}
+		flag.Set(name, value)
+		log.SafeLogging = !logDestinations
+		log.Debugf("Logging destinations: %v", logDestinations)
+		return true
+	case "loglevel", "logformat", "logfile", "logmaxsize":
+		previous := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			log.Errorf("Invalid -%s %s, keeping %s: %s", name, value, previous, err)
+			return true
+		}
+		if err := configureLogging(); err != nil {
+			flag.Set(name, previous)
+			log.Errorf("Unable to change -%s to %s, keeping %s: %s", name, value, previous, err)
+			return true
+		}
+		log.Debugf("Changed -%s to %s", name, value)
+		return true
+	case "masquerade", "azuremasquerade":
+		current := flag.Lookup(name).Value.String()
+		if currentClient == nil || value == "" || !currentClient.ReplaceMasquerades(splitList(current), splitList(value)) {
+			// Masquerading can't be switched on or off while running
+			return false
+		}
+		flag.Set(name, value)
+		log.Debugf("Verifying new masquerade hosts for -%s", name)
+		return true
+	case "server", "clientservers":
+		_, serversFlag := clientServers()
+		if currentClient == nil || value == "" || name != serversFlag {
+			return false
+		}
+		if err := currentClient.SetServers(splitList(value)); err != nil {
+			log.Errorf("Unable to switch to servers %s, keeping the current ones: %s", value, err)
+			return true
+		}
+		flag.Set(name, value)
+		log.Debugf("Switched to servers %s", value)
+		return true
+	}
+	return false
+}
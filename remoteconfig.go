@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/getlantern/flashlight/configfile"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/remoteconfig"
+)
+
+const (
+	REMOTE_CONFIG_CACHE = "remoteconfig.json"
+)
+
+var (
+	// remoteFlags are the flags that remote configuration may set, which are
+	// those that can be changed without a restart
+	remoteFlags = map[string]bool{
+		"server":          true,
+		"masquerade":      true,
+		"azuremasquerade": true,
+	}
+
+	// remoteSettings are the settings from the last remote configuration
+	// applied, by flag name.  They take precedence over the config file's.
+	remoteSettings map[string]string
+)
+
+// remoteConfigFetcher builds the remoteconfig.Fetcher for the -remoteconfig
+// URL specified at the command line, or returns nil if none was specified
+func remoteConfigFetcher() *remoteconfig.Fetcher {
+	if *remoteConfigURL == "" {
+		return nil
+	}
+	publicKey, err := remoteconfig.ParsePublicKey(*remoteConfigKey)
+	if err != nil {
+		log.Fatalf("Invalid -remoteconfigkey: %s", err)
+	}
+	return &remoteconfig.Fetcher{
+		URL:       *remoteConfigURL,
+		PublicKey: publicKey,
+		Interval:  *remoteInterval,
+		CacheFile: inConfigDir(REMOTE_CONFIG_CACHE),
+		OnConfig:  applyRemoteConfig,
+	}
+}
+
+// parseRemoteConfig parses a remote configuration, which is in the same format
+// as the -config file (in JSON), but may only set the remoteFlags
+func parseRemoteConfig(config []byte) (map[string]string, error) {
+	fc := &fileConfig{}
+	if err := configfile.Decode(config, fc); err != nil {
+		return nil, fmt.Errorf("Unable to decode remote config: %s", err)
+	}
+	settings, err := fc.settings()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid remote config: %s", err)
+	}
+	for name := range settings {
+		if !remoteFlags[name] {
+			return nil, fmt.Errorf("Remote config can't set %s", name)
+		}
+	}
+	return settings, nil
+}
+
+// applyCachedRemoteConfig sets the flags from the remote configuration that
+// the given Fetcher cached last time, before anything is built from them
+func applyCachedRemoteConfig(fetcher *remoteconfig.Fetcher) {
+	config := fetcher.Cached()
+	if config == nil {
+		return
+	}
+	settings, err := parseRemoteConfig(config)
+	if err != nil {
+		log.Errorf("Ignoring cached remote config: %s", err)
+		return
+	}
+	for name, value := range settings {
+		if commandLineFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			log.Errorf("Ignoring invalid value for %s in cached remote config: %s", name, err)
+		}
+	}
+	remoteSettings = settings
+	log.Debugf("Using cached remote config")
+}
+
+// applyRemoteConfig applies a new remote configuration to the running client
+func applyRemoteConfig(config []byte) error {
+	settings, err := parseRemoteConfig(config)
+	if err != nil {
+		return err
+	}
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	applySettings(mergeSettings(fileSettings, remoteSettings), mergeSettings(fileSettings, settings))
+	remoteSettings = settings
+	return nil
+}
@@ -0,0 +1,275 @@
+// package remoteconfig periodically fetches configuration that's signed with
+// Ed25519, so that clients can be given new servers and masquerade hosts (for
+// example when fronts get blocked) without being updated.  Signed bytes are
+// served in a JSON envelope:
+//
+//	{
+//	  "config": "<base64-encoded signed bytes>",
+//	  "signature": "<base64-encoded Ed25519 signature of the signed bytes>"
+//	}
+//
+// For Fetchers, the signed bytes are a JSON Payload, which wraps the
+// configuration with a serial number and an expiry:
+//
+//	{
+//	  "serial": 42,
+//	  "expires": "2026-12-01T00:00:00Z",
+//	  "config": "<base64-encoded configuration>"
+//	}
+//
+// The configuration itself is opaque to this package.  Only configurations
+// whose signature verifies with the Fetcher's public key are accepted, and
+// only until they expire.  Serials must increase with each new configuration,
+// so that an older configuration (e.g. one replayed by whoever controls the
+// URL) is rejected once a newer one has been accepted.
+package remoteconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DEFAULT_INTERVAL = 1 * time.Hour
+	RETRY_INTERVAL   = 5 * time.Minute
+	FETCH_TIMEOUT    = 1 * time.Minute
+	MAX_CONFIG_SIZE  = 1024 * 1024
+)
+
+// envelope is what's served at a Fetcher's URL.  []byte fields are base64 in
+// JSON.
+type envelope struct {
+	Config    []byte `json:"config"`
+	Signature []byte `json:"signature"`
+}
+
+// Payload is a configuration with the serial number and expiry that are signed
+// along with it
+type Payload struct {
+	Serial  int64     `json:"serial"`  // must increase with each new configuration
+	Expires time.Time `json:"expires"` // after which the configuration is rejected
+	Config  []byte    `json:"config"`
+}
+
+// Fetcher periodically fetches the configuration at a URL and passes it to
+// OnConfig whenever it changes
+type Fetcher struct {
+	URL       string            // where the signed configuration is served
+	PublicKey ed25519.PublicKey // key with which the configuration must be signed
+	Interval  time.Duration     // (optional) how often to fetch, defaults to DEFAULT_INTERVAL
+	CacheFile string            // (optional) where to keep the last accepted configuration, so that it's used even if the URL can't be reached after a restart
+
+	// OnConfig is called with each new verified configuration.  If it returns
+	// an error, the configuration is rejected.
+	OnConfig func(config []byte) error
+
+	httpClient *http.Client
+	last       *Payload // the last accepted payload, whose serial newer ones must exceed
+	stop       chan bool
+	stopMutex  sync.Mutex
+}
+
+// ParsePublicKey parses a base64-encoded Ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode public key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Public key should be %d bytes, not %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Sign signs the given configuration with privateKey, returning the envelope
+// to serve
+func Sign(config []byte, privateKey ed25519.PrivateKey) ([]byte, error) {
+	return json.Marshal(&envelope{
+		Config:    config,
+		Signature: ed25519.Sign(privateKey, config),
+	})
+}
+
+// Open verifies the signature of the configuration in the given envelope with
+// publicKey and returns the configuration
+func Open(data []byte, publicKey ed25519.PublicKey) ([]byte, error) {
+	e := &envelope{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("Unable to parse envelope: %s", err)
+	}
+	if len(e.Config) == 0 {
+		return nil, fmt.Errorf("Envelope has no config")
+	}
+	if !ed25519.Verify(publicKey, e.Config, e.Signature) {
+		return nil, fmt.Errorf("Invalid signature")
+	}
+	return e.Config, nil
+}
+
+// SignPayload signs the given Payload with privateKey, returning the envelope
+// to serve to Fetchers
+func SignPayload(payload *Payload, privateKey ed25519.PrivateKey) ([]byte, error) {
+	signed, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode payload: %s", err)
+	}
+	return Sign(signed, privateKey)
+}
+
+// OpenPayload verifies the signature of the Payload in the given envelope with
+// publicKey and returns the Payload, which may have expired
+func OpenPayload(data []byte, publicKey ed25519.PublicKey) (*Payload, error) {
+	signed, err := Open(data, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	payload := &Payload{}
+	if err := json.Unmarshal(signed, payload); err != nil {
+		return nil, fmt.Errorf("Unable to parse payload: %s", err)
+	}
+	if len(payload.Config) == 0 || payload.Expires.IsZero() {
+		return nil, fmt.Errorf("Payload needs a config and an expiry")
+	}
+	return payload, nil
+}
+
+// Cached returns the configuration in the CacheFile, or nil if there isn't a
+// valid one.  Fetches that return the same configuration don't call OnConfig,
+// and those that return an older one (by serial) are rejected, even if the
+// cached one has expired.
+func (fetcher *Fetcher) Cached() []byte {
+	if fetcher.CacheFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fetcher.CacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read cached remote config: %s", err)
+		}
+		return nil
+	}
+	payload, err := OpenPayload(data, fetcher.PublicKey)
+	if err != nil {
+		log.Errorf("Ignoring cached remote config %s: %s", fetcher.CacheFile, err)
+		return nil
+	}
+	fetcher.last = payload
+	if time.Now().After(payload.Expires) {
+		log.Errorf("Ignoring cached remote config %s, which expired at %v", fetcher.CacheFile, payload.Expires)
+		return nil
+	}
+	return payload.Config
+}
+
+// Start starts fetching periodically in the background, dialing with the
+// given function (e.g. through the tunnel), until Stop
+func (fetcher *Fetcher) Start(dial func(network, addr string) (net.Conn, error)) {
+	fetcher.httpClient = &http.Client{
+		Timeout:   FETCH_TIMEOUT,
+		Transport: &http.Transport{Dial: dial},
+	}
+	stop := make(chan bool)
+	fetcher.stopMutex.Lock()
+	fetcher.stop = stop
+	fetcher.stopMutex.Unlock()
+	go fetcher.keepFresh(stop)
+}
+
+// Stop stops fetching.  It is safe to call on a nil or stopped Fetcher.
+func (fetcher *Fetcher) Stop() {
+	if fetcher == nil {
+		return
+	}
+	fetcher.stopMutex.Lock()
+	defer fetcher.stopMutex.Unlock()
+	if fetcher.stop != nil {
+		close(fetcher.stop)
+		fetcher.stop = nil
+	}
+}
+
+func (fetcher *Fetcher) keepFresh(stop chan bool) {
+	defer crash.Recover()
+	interval := fetcher.Interval
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	for {
+		next := interval
+		if err := fetcher.fetch(); err != nil {
+			log.Errorf("Unable to refresh remote config: %s", err)
+			next = RETRY_INTERVAL
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// fetch fetches and verifies the configuration, passing it to OnConfig if it
+// changed
+func (fetcher *Fetcher) fetch() error {
+	data, err := fetcher.get()
+	if err != nil {
+		return err
+	}
+	payload, err := OpenPayload(data, fetcher.PublicKey)
+	if err != nil {
+		return fmt.Errorf("Rejecting config from %s: %s", fetcher.URL, err)
+	}
+	if time.Now().After(payload.Expires) {
+		return fmt.Errorf("Rejecting config from %s, which expired at %v", fetcher.URL, payload.Expires)
+	}
+	if last := fetcher.last; last != nil {
+		if payload.Serial == last.Serial && bytes.Equal(payload.Config, last.Config) {
+			return nil
+		}
+		if payload.Serial <= last.Serial {
+			return fmt.Errorf("Rejecting config from %s with serial %d, which isn't newer than %d", fetcher.URL, payload.Serial, last.Serial)
+		}
+	}
+	if err := fetcher.OnConfig(payload.Config); err != nil {
+		return fmt.Errorf("Rejecting config from %s: %s", fetcher.URL, err)
+	}
+	fetcher.last = payload
+	log.Debugf("Applied new remote config %d from %s", payload.Serial, fetcher.URL)
+	if fetcher.CacheFile != "" {
+		if err := ioutil.WriteFile(fetcher.CacheFile, data, 0600); err != nil {
+			log.Errorf("Unable to cache remote config: %s", err)
+		}
+	}
+	return nil
+}
+
+func (fetcher *Fetcher) get() ([]byte, error) {
+	resp, err := fetcher.httpClient.Get(fetcher.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch %s: %s", fetcher.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response status fetching %s: %d", fetcher.URL, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_CONFIG_SIZE))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", fetcher.URL, err)
+	}
+	return body, nil
+}
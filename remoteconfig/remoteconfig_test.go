@@ -0,0 +1,122 @@
+package remoteconfig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestOpen(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := []byte(`{"masquerades": ["cdnjs.com"]}`)
+	signed, err := Sign(config, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Open(signed, publicKey)
+	if err != nil || !bytes.Equal(opened, config) {
+		t.Errorf("Valid config didn't open: %s", err)
+	}
+
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := Open(signed, otherKey); err == nil {
+		t.Error("Config signed with another key shouldn't open")
+	}
+	tampered := bytes.Replace(signed, []byte("e"), []byte("f"), 1)
+	if _, err := Open(tampered, publicKey); err == nil {
+		t.Error("Tampered config shouldn't open")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed []byte
+	sign := func(serial int64, expires time.Time, config string) {
+		signed, err = SignPayload(&Payload{Serial: serial, Expires: expires, Config: []byte(config)}, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign(1, time.Now().Add(time.Hour), "v1")
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(signed)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "remoteconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var applied []string
+	fetcher := &Fetcher{
+		URL:       server.URL,
+		PublicKey: publicKey,
+		CacheFile: filepath.Join(dir, "remoteconfig.json"),
+		OnConfig: func(config []byte) error {
+			applied = append(applied, string(config))
+			return nil
+		},
+	}
+	fetcher.httpClient = &http.Client{Transport: &http.Transport{Dial: net.Dial}}
+	for i := 0; i < 2; i++ {
+		if err := fetcher.fetch(); err != nil {
+			t.Fatalf("Unable to fetch: %s", err)
+		}
+	}
+	if len(applied) != 1 || applied[0] != "v1" {
+		t.Errorf("Unchanged config should have been applied once, got %v", applied)
+	}
+
+	restarted := &Fetcher{PublicKey: publicKey, CacheFile: fetcher.CacheFile}
+	if cached := restarted.Cached(); string(cached) != "v1" {
+		t.Errorf("Expected cached config v1, got %q", cached)
+	}
+
+	sign(2, time.Now().Add(time.Hour), "v2")
+	if err := fetcher.fetch(); err != nil || len(applied) != 2 || applied[1] != "v2" {
+		t.Errorf("Newer config should have been applied, got %v: %s", applied, err)
+	}
+	for _, test := range []struct {
+		serial  int64
+		expires time.Time
+		config  string
+	}{
+		{1, time.Now().Add(time.Hour), "v1"},     // replayed
+		{2, time.Now().Add(time.Hour), "v2 bis"}, // same serial
+		{3, time.Now().Add(-time.Minute), "v3"},  // expired
+	} {
+		sign(test.serial, test.expires, test.config)
+		if err := fetcher.fetch(); err == nil {
+			t.Errorf("Config %s with serial %d should have been rejected", test.config, test.serial)
+		}
+	}
+	if len(applied) != 2 {
+		t.Errorf("Rejected configs shouldn't be applied, got %v", applied)
+	}
+
+	// Even after a restart, the cached serial keeps older configs out
+	restarted = &Fetcher{PublicKey: publicKey, CacheFile: fetcher.CacheFile, OnConfig: fetcher.OnConfig}
+	restarted.httpClient = fetcher.httpClient
+	restarted.URL = server.URL
+	restarted.Cached()
+	sign(1, time.Now().Add(time.Hour), "v1")
+	if err := restarted.fetch(); err == nil {
+		t.Errorf("Config older than the cached one should have been rejected")
+	}
+}
@@ -0,0 +1,221 @@
+// package reputation checks whether a server's egress IP has a bad reputation
+// by periodically fetching a set of reference sites and looking for signs that
+// they're blocking us or walling us off with captchas.  Servers publish the
+// latest Report, and advertise its status in the X-Lantern-Reputation header
+// so that clients can avoid degraded exits (see protocol.Balancer).
+package reputation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	X_LANTERN_REPUTATION = "X-Lantern-Reputation" // header advertising OK or DEGRADED to clients
+
+	OK       = "ok"
+	CAPTCHA  = "captcha"
+	BLOCKED  = "blocked"
+	ERROR    = "error"
+	DEGRADED = "degraded"
+
+	DEFAULT_INTERVAL = 1 * time.Hour
+	CHECK_TIMEOUT    = 30 * time.Second
+	MAX_BODY_SIZE    = 256 * 1024
+)
+
+var (
+	DEFAULT_SITES = []string{
+		"https://www.google.com/search?q=flashlight",
+		"https://www.cloudflare.com/",
+		"https://www.amazon.com/",
+	}
+
+	// CAPTCHA_MARKERS are strings whose presence in a response body indicates
+	// a captcha or bot challenge (compared case-insensitively)
+	CAPTCHA_MARKERS = [][]byte{
+		[]byte("unusual traffic from your computer network"), // google
+		[]byte("g-recaptcha"),
+		[]byte("h-captcha"),
+		[]byte("cf-chl-"),                     // cloudflare challenge
+		[]byte("Attention Required!"),         // cloudflare block page
+		[]byte("Type the characters you see"), // amazon
+	}
+)
+
+// Result is the outcome of checking a single site
+type Result struct {
+	Site   string `json:"site"`
+	Status string `json:"status"`           // OK, CAPTCHA, BLOCKED or ERROR
+	Detail string `json:"detail,omitempty"` // e.g. the response status or error
+}
+
+// Report is the outcome of checking all sites
+type Report struct {
+	Checked time.Time `json:"checked"`
+	Status  string    `json:"status"` // OK or DEGRADED
+	Results []*Result `json:"results"`
+}
+
+// Checker periodically checks our reputation with Sites
+type Checker struct {
+	Sites    []string      // (optional) URLs of reference sites, defaults to DEFAULT_SITES
+	Interval time.Duration // (optional) how frequently to check, defaults to DEFAULT_INTERVAL
+	OnReport func(*Report) // (optional) called with each new Report
+
+	// Dial (optional) dials the reference sites, e.g. from a specific egress
+	// IP, defaults to dialing from the OS's choice of source address
+	Dial func(network, addr string) (net.Conn, error)
+
+	report *Report
+	mutex  sync.RWMutex
+}
+
+// Start starts checking in the background
+func (checker *Checker) Start() {
+	if len(checker.Sites) == 0 {
+		checker.Sites = DEFAULT_SITES
+	}
+	if checker.Interval <= 0 {
+		checker.Interval = DEFAULT_INTERVAL
+	}
+	go checker.run()
+}
+
+// Status returns the status from the latest Report (OK until the first check
+// completes).  It is safe to call on a nil Checker.
+func (checker *Checker) Status() string {
+	if checker == nil {
+		return OK
+	}
+	checker.mutex.RLock()
+	defer checker.mutex.RUnlock()
+	if checker.report == nil {
+		return OK
+	}
+	return checker.report.Status
+}
+
+// ServeHTTP publishes the latest Report as JSON
+func (checker *Checker) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	report := &Report{Status: OK}
+	if checker != nil {
+		checker.mutex.RLock()
+		if checker.report != nil {
+			report = checker.report
+		}
+		checker.mutex.RUnlock()
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(resp).Encode(report)
+	if err != nil {
+		log.Errorf("Unable to write reputation report: %s", err)
+	}
+}
+
+func (checker *Checker) run() {
+	defer crash.Recover()
+	for {
+		report := checker.check()
+		log.Debugf("Egress reputation is %s", report.Status)
+		checker.mutex.Lock()
+		checker.report = report
+		checker.mutex.Unlock()
+		if checker.OnReport != nil {
+			checker.OnReport(report)
+		}
+		time.Sleep(checker.Interval)
+	}
+}
+
+// check checks all Sites concurrently
+func (checker *Checker) check() *Report {
+	report := &Report{
+		Checked: time.Now(),
+		Status:  OK,
+		Results: make([]*Result, len(checker.Sites)),
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(checker.Sites))
+	for i, site := range checker.Sites {
+		go func(i int, site string) {
+			defer wg.Done()
+			report.Results[i] = checker.checkSite(site)
+		}(i, site)
+	}
+	wg.Wait()
+	for _, result := range report.Results {
+		if result.Status == CAPTCHA || result.Status == BLOCKED {
+			report.Status = DEGRADED
+		}
+	}
+	return report
+}
+
+// checkSite fetches the given site and classifies the response
+func (checker *Checker) checkSite(site string) *Result {
+	result := &Result{Site: site}
+	client := &http.Client{Timeout: CHECK_TIMEOUT}
+	if checker.Dial != nil {
+		client.Transport = &http.Transport{Dial: checker.Dial}
+	}
+	req, err := http.NewRequest("GET", site, nil)
+	if err != nil {
+		result.Status = ERROR
+		result.Detail = err.Error()
+		return result
+	}
+	// Look like a browser, since that's what we're checking on behalf of
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Status = ERROR
+		result.Detail = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_BODY_SIZE))
+	if err != nil {
+		result.Status = ERROR
+		result.Detail = err.Error()
+		return result
+	}
+	result.Status = classify(resp, body)
+	result.Detail = resp.Status
+	return result
+}
+
+// classify classifies a response from a reference site
+func classify(resp *http.Response, body []byte) string {
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == 451 {
+		// Challenge pages are often served with a 403, so look for markers
+		// before concluding that we're blocked
+		if hasCaptchaMarker(body) {
+			return CAPTCHA
+		}
+		return BLOCKED
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || hasCaptchaMarker(body) {
+		return CAPTCHA
+	}
+	return OK
+}
+
+func hasCaptchaMarker(body []byte) bool {
+	lowerBody := bytes.ToLower(body)
+	for _, marker := range CAPTCHA_MARKERS {
+		if bytes.Contains(lowerBody, bytes.ToLower(marker)) {
+			return true
+		}
+	}
+	return false
+}
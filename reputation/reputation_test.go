@@ -0,0 +1,42 @@
+package reputation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			resp.Write([]byte("<html>Welcome</html>"))
+		case "/challenge":
+			resp.WriteHeader(http.StatusForbidden)
+			resp.Write([]byte(`<html><form id="challenge-form" action="/?__cf_chl_f_tk=abc"><div class="cf-chl-widget"></div></form></html>`))
+		case "/blocked":
+			resp.WriteHeader(http.StatusForbidden)
+		case "/ratelimited":
+			resp.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer s.Close()
+
+	checker := &Checker{Sites: []string{s.URL + "/ok"}}
+	report := checker.check()
+	if report.Status != OK || report.Results[0].Status != OK {
+		t.Errorf("Expected ok report, got %s (%s)", report.Status, report.Results[0].Status)
+	}
+
+	checker = &Checker{Sites: []string{s.URL + "/ok", s.URL + "/challenge", s.URL + "/blocked", s.URL + "/ratelimited", "http://127.0.0.1:1/"}}
+	report = checker.check()
+	if report.Status != DEGRADED {
+		t.Errorf("Expected degraded report, got %s", report.Status)
+	}
+	expected := []string{OK, CAPTCHA, BLOCKED, CAPTCHA, ERROR}
+	for i, result := range report.Results {
+		if result.Status != expected[i] {
+			t.Errorf("Wrong status for %s, expected %s got %s", result.Site, expected[i], result.Status)
+		}
+	}
+}
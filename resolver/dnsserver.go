@@ -0,0 +1,216 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DNS_HEADER_LENGTH  = 12
+	MAX_DNS_MSG_LENGTH = 512
+	ANSWER_TTL         = 60 // seconds, kept short since we cache internally
+
+	CLASS_IN = 1
+
+	RCODE_FORMAT_ERROR    = 1
+	RCODE_SERVER_FAILURE  = 2
+	RCODE_NAME_ERROR      = 3 // NXDOMAIN
+	RCODE_NOT_IMPLEMENTED = 4
+)
+
+// DNSServer is a minimal DNS server that answers A and AAAA queries (over UDP)
+// using a Resolver.  It lets the OS resolver (and thereby non-proxied apps)
+// benefit from unpoisoned DNS.  Other query types are answered with
+// NOTIMP so that clients fall back to their other resolvers.
+type DNSServer struct {
+	Addr     string    // listen address in form of host:port
+	Resolver *Resolver // resolver used to answer queries
+
+	conn   net.PacketConn
+	closed bool
+	mutex  sync.Mutex
+}
+
+// question is the single question in a DNS query
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	end    int // offset of the end of the question in the query
+}
+
+// ListenAndServe listens at Addr and serves DNS queries
+func (server *DNSServer) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for DNS at %s: %s", server.Addr, err)
+	}
+	log.Debugf("About to start DNS server at %s", server.Addr)
+	return server.Serve(conn)
+}
+
+// Serve serves DNS queries on the given PacketConn, until Close
+func (server *DNSServer) Serve(conn net.PacketConn) error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		conn.Close()
+		return nil
+	}
+	server.conn = conn
+	server.mutex.Unlock()
+	for {
+		b := make([]byte, MAX_DNS_MSG_LENGTH)
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			if server.closed {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			resp := server.answer(b[:n])
+			if resp == nil {
+				return
+			}
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				log.Debugf("Unable to write DNS response: %s", err)
+			}
+		}()
+	}
+}
+
+// Close stops serving queries
+func (server *DNSServer) Close() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.closed = true
+	if server.conn == nil {
+		return nil
+	}
+	return server.conn.Close()
+}
+
+// answer builds the response to the given query, or returns nil if the query
+// is too malformed to respond to.
+func (server *DNSServer) answer(query []byte) []byte {
+	if len(query) < DNS_HEADER_LENGTH || query[2]&0x80 != 0 {
+		// Too short or not a query
+		return nil
+	}
+	qdcount := binary.BigEndian.Uint16(query[4:])
+	if qdcount != 1 {
+		return responseHeader(query, DNS_HEADER_LENGTH, RCODE_FORMAT_ERROR)
+	}
+	q, err := parseQuestion(query)
+	if err != nil {
+		log.Debugf("Unable to parse DNS question: %s", err)
+		return responseHeader(query, DNS_HEADER_LENGTH, RCODE_FORMAT_ERROR)
+	}
+	if q.qclass != CLASS_IN || (q.qtype != TYPE_A && q.qtype != TYPE_AAAA) {
+		return responseHeader(query, q.end, RCODE_NOT_IMPLEMENTED)
+	}
+
+	ips, err := server.Resolver.lookup(q.name, int(q.qtype))
+	if rcodeErr, ok := err.(*RcodeError); ok {
+		// Pass on the DoH provider's answer, e.g. NXDOMAIN
+		return responseHeader(query, q.end, byte(rcodeErr.Rcode&0x0F))
+	}
+	if err != nil {
+		log.Debugf("Unable to resolve %s: %s", log.Redact(q.name), err)
+		return responseHeader(query, q.end, RCODE_SERVER_FAILURE)
+	}
+
+	resp := responseHeader(query, q.end, 0)
+	ancount := uint16(0)
+	for _, ip := range ips {
+		data := ip.To4()
+		if q.qtype == TYPE_AAAA {
+			data = ip.To16()
+		}
+		if data == nil {
+			continue
+		}
+		// Pointer to the name in the question, which starts right after the
+		// header
+		rr := []byte{0xC0, DNS_HEADER_LENGTH}
+		rr = appendUint16(rr, q.qtype)
+		rr = appendUint16(rr, CLASS_IN)
+		rr = append(rr, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(rr[len(rr)-4:], ANSWER_TTL)
+		rr = appendUint16(rr, uint16(len(data)))
+		rr = append(rr, data...)
+		if len(resp)+len(rr) > MAX_DNS_MSG_LENGTH {
+			break
+		}
+		resp = append(resp, rr...)
+		ancount++
+	}
+	binary.BigEndian.PutUint16(resp[6:], ancount)
+	return resp
+}
+
+// parseQuestion parses the question that follows the header of the given
+// query
+func parseQuestion(query []byte) (*question, error) {
+	var labels []string
+	i := DNS_HEADER_LENGTH
+	for {
+		if i >= len(query) {
+			return nil, fmt.Errorf("Truncated name")
+		}
+		length := int(query[i])
+		i++
+		if length == 0 {
+			break
+		}
+		if length&0xC0 != 0 {
+			// Compression isn't used in questions in practice
+			return nil, fmt.Errorf("Unsupported label type")
+		}
+		if i+length > len(query) {
+			return nil, fmt.Errorf("Truncated label")
+		}
+		labels = append(labels, string(query[i:i+length]))
+		i += length
+	}
+	if i+4 > len(query) || len(labels) == 0 {
+		return nil, fmt.Errorf("Truncated question")
+	}
+	return &question{
+		name:   strings.Join(labels, "."),
+		qtype:  binary.BigEndian.Uint16(query[i:]),
+		qclass: binary.BigEndian.Uint16(query[i+2:]),
+		end:    i + 4,
+	}, nil
+}
+
+// responseHeader builds the start of a response to the given query, echoing
+// back the query's header and question (up to questionEnd)
+func responseHeader(query []byte, questionEnd int, rcode byte) []byte {
+	resp := make([]byte, questionEnd)
+	copy(resp, query[:questionEnd])
+	// QR=1 (response), keep opcode and RD, RA=1
+	resp[2] = 0x80 | (query[2] & 0x79)
+	resp[3] = 0x80 | rcode
+	if questionEnd == DNS_HEADER_LENGTH {
+		// Question wasn't echoed back
+		binary.BigEndian.PutUint16(resp[4:], 0)
+	}
+	// No answer, authority or additional records (yet)
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	return resp
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
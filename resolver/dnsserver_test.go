@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// buildQuery builds a query with the given question section, which follows a
+// header with the given number of questions
+func buildQuery(qdcount uint16, question []byte) []byte {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(query[4:], qdcount)
+	return append(query, question...)
+}
+
+// nameFor encodes the given labels as a DNS name
+func nameFor(labels ...string) []byte {
+	var name []byte
+	for _, label := range labels {
+		name = append(name, byte(len(label)))
+		name = append(name, label...)
+	}
+	return append(name, 0)
+}
+
+func TestAnswer(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("name") {
+		case "example.com":
+			resp.Write([]byte(`{"Status": 0, "Answer": [{"type": 1, "TTL": 300, "data": "93.184.216.34"}]}`))
+		case "broken.example.com":
+			resp.Write([]byte(`{"Status": 2}`))
+		default:
+			resp.Write([]byte(`{"Status": 3}`))
+		}
+	}))
+	defer doh.Close()
+	server := &DNSServer{Resolver: New([]string{doh.URL})}
+
+	a := nameFor("example", "com")
+	a = append(a, 0, TYPE_A, 0, CLASS_IN)
+	mx := nameFor("example", "com")
+	mx = append(mx, 0, 15, 0, CLASS_IN)
+	missing := nameFor("missing", "example", "com")
+	missing = append(missing, 0, TYPE_A, 0, CLASS_IN)
+	broken := nameFor("broken", "example", "com")
+	broken = append(broken, 0, TYPE_A, 0, CLASS_IN)
+	// A pointer to a name elsewhere in the message, as in answers
+	compressed := []byte{0xC0, DNS_HEADER_LENGTH, 0, TYPE_A, 0, CLASS_IN}
+
+	for _, test := range []struct {
+		name    string
+		query   []byte
+		rcode   byte
+		answers uint16
+	}{
+		{"A", buildQuery(1, a), 0, 1},
+		{"MX", buildQuery(1, mx), RCODE_NOT_IMPLEMENTED, 0},
+		{"NXDOMAIN", buildQuery(1, missing), RCODE_NAME_ERROR, 0},
+		{"SERVFAIL", buildQuery(1, broken), RCODE_SERVER_FAILURE, 0},
+		{"truncated name", buildQuery(1, a[:5]), RCODE_FORMAT_ERROR, 0},
+		{"truncated question", buildQuery(1, a[:len(a)-2]), RCODE_FORMAT_ERROR, 0},
+		{"compressed", buildQuery(1, compressed), RCODE_FORMAT_ERROR, 0},
+		{"multiple questions", buildQuery(2, append(append([]byte{}, a...), a...)), RCODE_FORMAT_ERROR, 0},
+		{"no question", buildQuery(0, nil), RCODE_FORMAT_ERROR, 0},
+	} {
+		resp := server.answer(test.query)
+		if len(resp) < DNS_HEADER_LENGTH {
+			t.Errorf("%s: expected a response, got %v", test.name, resp)
+			continue
+		}
+		if resp[0] != 0x12 || resp[1] != 0x34 || resp[2]&0x80 == 0 {
+			t.Errorf("%s: response header doesn't match query: %v", test.name, resp[:4])
+		}
+		if rcode := resp[3] & 0x0F; rcode != test.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", test.name, test.rcode, rcode)
+		}
+		if answers := binary.BigEndian.Uint16(resp[6:]); answers != test.answers {
+			t.Errorf("%s: expected %d answers, got %d", test.name, test.answers, answers)
+		}
+	}
+
+	for _, malformed := range [][]byte{nil, {0x12, 0x34}, buildQuery(1, a)[:11]} {
+		if resp := server.answer(malformed); resp != nil {
+			t.Errorf("Expected no response to %v, got %v", malformed, resp)
+		}
+	}
+	response := buildQuery(1, a)
+	response[2] |= 0x80
+	if resp := server.answer(response); resp != nil {
+		t.Errorf("Expected no response to a response, got %v", resp)
+	}
+}
@@ -0,0 +1,299 @@
+// package resolver resolves hostnames using DNS-over-HTTPS, which protects
+// against the DNS poisoning that's common in censored regions.  It uses the
+// JSON API (application/dns-json) supported by the major DoH providers and
+// caches results according to their TTLs, evicting the least recently used
+// ones once the cache is full.
+package resolver
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	TYPE_A    = 1
+	TYPE_AAAA = 28
+
+	MIN_TTL        = 30 * time.Second
+	MAX_TTL        = 1 * time.Hour
+	LOOKUP_TIMEOUT = 10 * time.Second
+
+	DEFAULT_MAX_CACHE_ENTRIES = 10000
+	CACHE_SWEEP_INTERVAL      = 5 * time.Minute
+)
+
+var (
+	DEFAULT_PROVIDERS = []string{
+		"https://cloudflare-dns.com/dns-query",
+		"https://dns.google/resolve",
+	}
+)
+
+// Resolver resolves hostnames using DoH.  If all providers fail, it falls
+// back to the OS resolver so that a blocked provider doesn't break
+// connectivity.
+type Resolver struct {
+	Providers       []string // URLs of DoH JSON endpoints, tried in order
+	MaxCacheEntries int      // (optional) defaults to DEFAULT_MAX_CACHE_ENTRIES
+
+	httpClient *http.Client
+	cache      map[string]*list.Element
+	lru        *list.List // of *cacheEntry, most recently used first
+	lastSwept  time.Time
+	cacheMutex sync.Mutex
+}
+
+type cacheEntry struct {
+	key     string
+	ips     []net.IP
+	err     error // an RcodeError for negative answers
+	expires time.Time
+}
+
+// RcodeError is a DNS answer with a non-zero rcode, e.g. 3 (NXDOMAIN) for a
+// name that doesn't exist
+type RcodeError struct {
+	Rcode int
+}
+
+func (err *RcodeError) Error() string {
+	return fmt.Sprintf("DNS answer with rcode %d", err.Rcode)
+}
+
+// dohResponse is a response from a DoH JSON endpoint
+type dohResponse struct {
+	Status int
+	Answer []struct {
+		Type int    `json:"type"`
+		TTL  int    `json:"TTL"`
+		Data string `json:"data"`
+	}
+}
+
+// New creates a Resolver using the given providers (DEFAULT_PROVIDERS if
+// none given)
+func New(providers []string) *Resolver {
+	return NewDialing(providers, nil)
+}
+
+// NewDialing is like New, but connects to the providers using the given dial
+// function (e.g. one that dials through the tunnel).  A nil dial means dial
+// directly.
+func NewDialing(providers []string, dial func(network, addr string) (net.Conn, error)) *Resolver {
+	if len(providers) == 0 {
+		providers = DEFAULT_PROVIDERS
+	}
+	httpClient := &http.Client{Timeout: LOOKUP_TIMEOUT}
+	if dial != nil {
+		httpClient.Transport = &http.Transport{Dial: dial}
+	}
+	return &Resolver{
+		Providers:  providers,
+		httpClient: httpClient,
+		cache:      make(map[string]*list.Element),
+		lru:        list.New(),
+		lastSwept:  time.Now(),
+	}
+}
+
+// LookupIP looks up the IPs for the given host.  network is "tcp4" for IPv4
+// only, "tcp6" for IPv6 only and anything else for both.
+func (resolver *Resolver) LookupIP(network string, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if !strings.Contains(host, ".") {
+		// Local names like localhost aren't in public DNS
+		return net.LookupIP(host)
+	}
+
+	var ips []net.IP
+	var lastErr error
+	if network != "tcp6" {
+		v4, err := resolver.lookup(host, TYPE_A)
+		ips = append(ips, v4...)
+		lastErr = err
+	}
+	if network != "tcp4" {
+		v6, err := resolver.lookup(host, TYPE_AAAA)
+		ips = append(ips, v6...)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("No addresses found for %s", host)
+	}
+	return nil, lastErr
+}
+
+// Dial dials the given addr on the given network, resolving the host using
+// DoH and trying each resolved IP in turn.
+func (resolver *Resolver) Dial(dialer *net.Dialer, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolver.LookupIP(network, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (resolver *Resolver) lookup(host string, qtype int) ([]net.IP, error) {
+	key := fmt.Sprintf("%s/%d", strings.ToLower(host), qtype)
+	if entry := resolver.cached(key); entry != nil {
+		return entry.ips, entry.err
+	}
+
+	var lastErr error
+	for _, provider := range resolver.Providers {
+		ips, ttl, err := resolver.query(provider, host, qtype)
+		if _, negative := err.(*RcodeError); err != nil && !negative {
+			log.Debugf("Unable to resolve %s via %s: %s", log.Redact(host), provider, err)
+			lastErr = err
+			continue
+		}
+		// Negative answers are answers too, which the other providers (or
+		// the OS resolver) would only repeat
+		resolver.store(&cacheEntry{key, ips, err, time.Now().Add(ttl)})
+		return ips, err
+	}
+
+	log.Errorf("All DoH providers failed, falling back to OS resolver: %s", lastErr)
+	all, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, ip := range all {
+		if (ip.To4() != nil) == (qtype == TYPE_A) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// cached returns the unexpired cache entry for the given key, if any, marking
+// it as recently used
+func (resolver *Resolver) cached(key string) *cacheEntry {
+	resolver.cacheMutex.Lock()
+	defer resolver.cacheMutex.Unlock()
+	elem, found := resolver.cache[key]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		resolver.remove(elem)
+		return nil
+	}
+	resolver.lru.MoveToFront(elem)
+	return entry
+}
+
+// store caches the given entry, evicting the least recently used entries
+// beyond MaxCacheEntries and, every CACHE_SWEEP_INTERVAL, all expired ones so
+// that names that are never looked up again don't linger.
+func (resolver *Resolver) store(entry *cacheEntry) {
+	resolver.cacheMutex.Lock()
+	defer resolver.cacheMutex.Unlock()
+	if elem, found := resolver.cache[entry.key]; found {
+		resolver.remove(elem)
+	}
+	resolver.cache[entry.key] = resolver.lru.PushFront(entry)
+
+	now := time.Now()
+	if now.Sub(resolver.lastSwept) > CACHE_SWEEP_INTERVAL {
+		resolver.lastSwept = now
+		for elem := resolver.lru.Front(); elem != nil; {
+			next := elem.Next()
+			if !now.Before(elem.Value.(*cacheEntry).expires) {
+				resolver.remove(elem)
+			}
+			elem = next
+		}
+	}
+	maxEntries := resolver.MaxCacheEntries
+	if maxEntries <= 0 {
+		maxEntries = DEFAULT_MAX_CACHE_ENTRIES
+	}
+	for resolver.lru.Len() > maxEntries {
+		resolver.remove(resolver.lru.Back())
+	}
+}
+
+// remove removes the given element from the cache.  The caller must hold the
+// cacheMutex.
+func (resolver *Resolver) remove(elem *list.Element) {
+	resolver.lru.Remove(elem)
+	delete(resolver.cache, elem.Value.(*cacheEntry).key)
+}
+
+// query queries a single DoH provider, returning the IPs and the TTL for which
+// to cache them, or an RcodeError (with the TTL) if the answer is negative.
+func (resolver *Resolver) query(provider string, host string, qtype int) ([]net.IP, time.Duration, error) {
+	u := fmt.Sprintf("%s?name=%s&type=%d", provider, url.QueryEscape(host), qtype)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	resp, err := resolver.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("Unexpected response status: %d", resp.StatusCode)
+	}
+	dr := &dohResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(dr); err != nil {
+		return nil, 0, fmt.Errorf("Unable to decode response: %s", err)
+	}
+	if dr.Status != 0 {
+		// Non-zero rcode (e.g. NXDOMAIN) is a valid answer, cache it briefly
+		return nil, MIN_TTL, &RcodeError{dr.Status}
+	}
+
+	var ips []net.IP
+	ttl := MAX_TTL
+	for _, answer := range dr.Answer {
+		if answer.Type != qtype {
+			// CNAMEs and such
+			continue
+		}
+		ip := net.ParseIP(answer.Data)
+		if ip == nil {
+			continue
+		}
+		ips = append(ips, ip)
+		if answerTTL := time.Duration(answer.TTL) * time.Second; answerTTL < ttl {
+			ttl = answerTTL
+		}
+	}
+	if ttl < MIN_TTL {
+		ttl = MIN_TTL
+	}
+	return ips, ttl, nil
+}
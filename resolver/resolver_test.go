@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheBounded(t *testing.T) {
+	var queries = make(map[string]int)
+	var queriesMutex sync.Mutex
+	doh := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		queriesMutex.Lock()
+		queries[req.URL.Query().Get("name")] += 1
+		queriesMutex.Unlock()
+		resp.Write([]byte(`{"Status": 0, "Answer": [{"type": 1, "TTL": 300, "data": "93.184.216.34"}]}`))
+	}))
+	defer doh.Close()
+	countQueries := func(host string) int {
+		queriesMutex.Lock()
+		defer queriesMutex.Unlock()
+		return queries[host]
+	}
+
+	resolver := New([]string{doh.URL})
+	resolver.MaxCacheEntries = 2
+	lookup := func(host string) {
+		if _, err := resolver.LookupIP("tcp4", host); err != nil {
+			t.Fatalf("Unable to look up %s: %s", host, err)
+		}
+	}
+	lookup("a.example.com")
+	lookup("b.example.com")
+	lookup("a.example.com")
+	lookup("c.example.com")
+	if resolver.lru.Len() != 2 || len(resolver.cache) != 2 {
+		t.Errorf("Expected 2 cached entries, got %d", resolver.lru.Len())
+	}
+	lookup("a.example.com")
+	if n := countQueries("a.example.com"); n != 1 {
+		t.Errorf("Recently used entry should have stayed cached, queried %d times", n)
+	}
+	lookup("b.example.com")
+	if n := countQueries("b.example.com"); n != 2 {
+		t.Errorf("Least recently used entry should have been evicted, queried %d times", n)
+	}
+
+	resolver.MaxCacheEntries = 10
+	for _, elem := range resolver.cache {
+		elem.Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	}
+	resolver.lastSwept = time.Now().Add(-2 * CACHE_SWEEP_INTERVAL)
+	lookup("d.example.com")
+	if resolver.lru.Len() != 1 || len(resolver.cache) != 1 {
+		t.Errorf("Expected expired entries to be swept, got %d entries", resolver.lru.Len())
+	}
+	for i := 0; i < 20; i++ {
+		lookup(fmt.Sprintf("host%d.example.com", i))
+	}
+	if resolver.lru.Len() != 10 {
+		t.Errorf("Expected cache capped at 10 entries, got %d", resolver.lru.Len())
+	}
+}
@@ -0,0 +1,37 @@
+// package resources reports how much of the machine's resources flashlight
+// itself is using, so that UIs can warn users when flashlight is the one
+// hogging their CPU or memory.
+package resources
+
+import (
+	"runtime"
+
+	"github.com/getlantern/flashlight/pipe"
+)
+
+// Usage is a snapshot of the process's resource usage
+type Usage struct {
+	CPUSeconds  float64          `json:"cpuseconds"`         // user and system CPU time used since starting
+	RSSBytes    uint64           `json:"rssbytes,omitempty"` // resident set size, where available
+	FDs         int              `json:"fds,omitempty"`      // open file descriptors (including sockets), where available
+	Goroutines  int              `json:"goroutines"`
+	HeapBytes   uint64           `json:"heapbytes"`            // bytes of allocated heap objects
+	MemoryBytes uint64           `json:"memorybytes"`          // bytes obtained from the OS
+	Subsystems  map[string]int64 `json:"subsystems,omitempty"` // bytes held by individual subsystems
+}
+
+// Current returns the current resource usage
+func Current() *Usage {
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	usage := &Usage{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapBytes:   memStats.HeapAlloc,
+		MemoryBytes: memStats.Sys,
+		Subsystems: map[string]int64{
+			"pipebuffers": pipe.BytesInUse(),
+		},
+	}
+	addOSUsage(usage)
+	return usage
+}
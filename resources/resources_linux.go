@@ -0,0 +1,32 @@
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// addOSUsage adds the usage that the OS keeps track of to the given Usage
+func addOSUsage(usage *Usage) {
+	rusage := &syscall.Rusage{}
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, rusage); err == nil {
+		usage.CPUSeconds = seconds(rusage.Utime) + seconds(rusage.Stime)
+	}
+	// statm has the sizes in pages, the second of which is the RSS
+	if statm, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(statm))
+		if len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			usage.RSSBytes = pages * uint64(os.Getpagesize())
+		}
+	}
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		usage.FDs = len(fds)
+	}
+}
+
+func seconds(tv syscall.Timeval) float64 {
+	return float64(tv.Sec) + float64(tv.Usec)/1e6
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package resources
+
+// addOSUsage adds the usage that the OS keeps track of to the given Usage.
+// Only Go runtime stats are available on this platform.
+func addOSUsage(usage *Usage) {
+}
@@ -0,0 +1,19 @@
+package resources
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCurrent(t *testing.T) {
+	usage := Current()
+	if usage.Goroutines < 1 || usage.MemoryBytes == 0 || usage.HeapBytes == 0 {
+		t.Errorf("Missing runtime stats: %+v", usage)
+	}
+	if _, found := usage.Subsystems["pipebuffers"]; !found {
+		t.Errorf("Missing pipe buffers")
+	}
+	if runtime.GOOS == "linux" && (usage.RSSBytes == 0 || usage.FDs == 0) {
+		t.Errorf("Missing OS stats: %+v", usage)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/getlantern/flashlight/handoff"
+	"github.com/getlantern/flashlight/log"
+)
+
+// restartOnSignal starts a new process from our binary on SIGUSR2, handing it
+// our listeners (see package handoff).  Once it has taken them over, it tells
+// us to shut down.
+func restartOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for range c {
+			pid, err := handoff.Restart()
+			if err != nil {
+				log.Errorf("Unable to restart: %s", err)
+				continue
+			}
+			log.Debugf("Restarted as process %d, handing off our listeners", pid)
+		}
+	}()
+}
@@ -0,0 +1,6 @@
+package main
+
+// restartOnSignal does nothing on Windows, which has neither SIGUSR2 nor file
+// descriptor inheritance
+func restartOnSignal() {
+}
@@ -0,0 +1,423 @@
+// package rules implements the client's rules engine, which matches requests
+// by destination domain and decides how they should be handled.
+//
+// Rules are loaded from a JSON file containing a list of rules, for example:
+//
+//	[
+//	  {"domain": "*.example.com", "headers": {"Accept-Language": "en-US"}},
+//	  {"domain": "intranet.corp", "headers": {"X-Auth": "secret", "Cookie": ""}},
+//	  {"domain": "news.example.org", "offline": true},
+//	  {"domain": "*.tracker.example", "block": true}
+//	]
+//
+// Pages on domains with "offline" set are kept for offline reading (see
+// package offline).  On domains with "compressmedia" set, the server
+// downscales images and throttles video in plain http responses to save
+// bandwidth (see package media).
+//
+// A rule's domain is a glob (see path.Match) that is matched against the
+// destination host.  A domain without wildcards matches the domain itself and
+// all of its subdomains.  All matching rules apply, in the order in which they
+// appear in the file.
+//
+// Rules can also decide whether requests go through the tunnel ("proxy") or
+// directly ("direct"), for example:
+//
+//	[
+//	  {"domain": "*.local", "route": "direct"},
+//	  {"cidr": "192.168.0.0/16", "route": "direct"},
+//	  {"country": "DE", "route": "direct"}
+//	]
+//
+// Routing rules may match by domain, by destination IP range (cidr) or by
+// the country of the destination IP.  The first matching rule with a route
+// decides, and anything that no rule routes is proxied.  Rules matching by
+// cidr or country only affect routing.  Hosts are resolved with LookupIP
+// (e.g. over DoH, so that the local network doesn't see them) and countries
+// are looked up with LookupCountry (e.g. in a local GeoIP database), and if
+// either fails the host is proxied.  Resolved IPs are cached per host for
+// LOOKUP_CACHE_TTL.
+//
+// Any rule can be limited to certain days and times of day (in local time)
+// with a schedule, for example to keep the proxy unavailable during school
+// hours, or to only allow a site in the evening:
+//
+//	[
+//	  {"domain": "*", "block": true, "schedule": {"days": ["mon", "tue", "wed", "thu", "fri"], "from": "08:00", "to": "15:00"}},
+//	  {"domain": "games.example", "block": true, "schedule": {"from": "20:00", "to": "18:00"}}
+//	]
+//
+// A schedule whose "to" is before its "from" wraps around midnight.  Rules
+// can be changed at runtime through the client's admin API (see package
+// proxy), which saves them back to the rules file.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROUTE_PROXY  = "proxy"  // route through the tunnel
+	ROUTE_DIRECT = "direct" // route directly to the destination
+
+	LOOKUP_CACHE_TTL   = 5 * time.Minute // how long resolved IPs are cached
+	MAX_CACHED_LOOKUPS = 10000
+)
+
+// Rule is a single rule in the rules engine
+type Rule struct {
+	Domain        string            `json:"domain,omitempty"`        // glob matched against the destination host
+	CIDR          string            `json:"cidr,omitempty"`          // range of destination IPs (routing only)
+	Country       string            `json:"country,omitempty"`       // country code of destination IPs (routing only)
+	Route         string            `json:"route,omitempty"`         // ROUTE_PROXY or ROUTE_DIRECT
+	Headers       map[string]string `json:"headers,omitempty"`       // request headers to set, an empty value removes the header
+	Offline       bool              `json:"offline,omitempty"`       // if true, pages are kept for offline reading
+	Block         bool              `json:"block,omitempty"`         // if true, requests are refused
+	CompressMedia bool              `json:"compressmedia,omitempty"` // if true, the server compresses images and video in plain http responses
+	Schedule      *Schedule         `json:"schedule,omitempty"`      // (optional) when the rule applies, defaults to always
+}
+
+// Engine is the rules engine
+type Engine struct {
+	Rules []*Rule
+
+	// LookupIP (optional) resolves hosts for matching by cidr or country
+	// (e.g. over DoH), defaults to net.LookupIP
+	LookupIP func(host string) ([]net.IP, error)
+
+	// LookupCountry (optional) looks up the country code of an IP for
+	// matching by country (e.g. in a local GeoIP database).  Without it,
+	// rules matching by country never match and their hosts are proxied.
+	LookupCountry func(ip string) (string, error)
+
+	// Now (optional) returns the time against which schedules are checked,
+	// defaults to time.Now
+	Now func() time.Time
+
+	filename string
+	mutex    sync.RWMutex
+
+	lookups      map[string]*lookup // by host
+	lookupsMutex sync.Mutex
+}
+
+// lookup is a cached resolution of a host
+type lookup struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Load loads an Engine from the JSON rules file at the given filename
+func Load(filename string) (*Engine, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open rules file %s: %s", filename, err)
+	}
+	defer file.Close()
+	engine := &Engine{filename: filename}
+	err = json.NewDecoder(file).Decode(&engine.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse rules file %s: %s", filename, err)
+	}
+	if err := validateAll(engine.Rules); err != nil {
+		return nil, fmt.Errorf("Invalid rule in %s: %s", filename, err)
+	}
+	return engine, nil
+}
+
+// Current returns the current rules.  It is safe to call on a nil Engine.
+func (engine *Engine) Current() []*Rule {
+	if engine == nil {
+		return nil
+	}
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	return engine.Rules
+}
+
+// Update validates the given rules and replaces the current ones with them,
+// saving them to the rules file if the Engine was loaded from one.
+func (engine *Engine) Update(rules []*Rule) error {
+	if err := validateAll(rules); err != nil {
+		return err
+	}
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	if engine.filename != "" {
+		data, err := json.MarshalIndent(rules, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Unable to marshal rules: %s", err)
+		}
+		err = ioutil.WriteFile(engine.filename, data, 0644)
+		if err != nil {
+			return fmt.Errorf("Unable to save rules file %s: %s", engine.filename, err)
+		}
+	}
+	engine.Rules = rules
+	return nil
+}
+
+// Reload replaces the current rules with those in the rules file that the
+// Engine was loaded from.  If the file is invalid, the current rules are kept.
+func (engine *Engine) Reload() error {
+	if engine.filename == "" {
+		return fmt.Errorf("Rules weren't loaded from a file")
+	}
+	loaded, err := Load(engine.filename)
+	if err != nil {
+		return err
+	}
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.Rules = loaded.Rules
+	return nil
+}
+
+// Matching returns the rules that match the given host (which may include a
+// port), in order.  It is safe to call on a nil Engine.
+func (engine *Engine) Matching(host string) []*Rule {
+	if engine == nil {
+		return nil
+	}
+	host = strings.ToLower(hostWithoutPort(host))
+	now := engine.now()
+	var matching []*Rule
+	for _, rule := range engine.Current() {
+		if rule.Matches(host) && rule.Schedule.Active(now) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
+
+// ApplyHeaders applies the header overrides of all rules matching the given
+// request's host.  It is safe to call on a nil Engine.
+func (engine *Engine) ApplyHeaders(req *http.Request) {
+	for _, rule := range engine.Matching(req.Host) {
+		for name, value := range rule.Headers {
+			if value == "" {
+				req.Header.Del(name)
+			} else {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+}
+
+// Route returns the route (ROUTE_PROXY or ROUTE_DIRECT) for requests to the
+// given host (which may include a port).  It is safe to call on a nil Engine.
+func (engine *Engine) Route(host string) string {
+	route := engine.MatchRoute(host)
+	if route == "" {
+		return ROUTE_PROXY
+	}
+	return route
+}
+
+// MatchRoute is like Route, but returns "" if no rule routes the given host.
+// It is safe to call on a nil Engine.
+func (engine *Engine) MatchRoute(host string) string {
+	if engine == nil {
+		return ""
+	}
+	host = strings.ToLower(hostWithoutPort(host))
+	now := engine.now()
+	var ips []net.IP
+	resolved := false
+	for _, rule := range engine.Current() {
+		if rule.Route == "" || !rule.Schedule.Active(now) {
+			continue
+		}
+		if rule.Domain != "" {
+			if rule.Matches(host) {
+				return rule.Route
+			}
+			continue
+		}
+		if !resolved {
+			// Only resolve once we get to a rule that needs it
+			var err error
+			ips, err = engine.lookupIP(host)
+			if err != nil {
+				// We can't tell whether it should go direct, so play it safe
+				return ROUTE_PROXY
+			}
+			resolved = true
+		}
+		for _, ip := range ips {
+			matches, err := engine.matchesIP(rule, ip)
+			if err != nil {
+				return ROUTE_PROXY
+			}
+			if matches {
+				return rule.Route
+			}
+		}
+	}
+	return ""
+}
+
+// IsOffline indicates whether any rule matching the given host keeps pages for
+// offline reading.  It is safe to call on a nil Engine.
+func (engine *Engine) IsOffline(host string) bool {
+	for _, rule := range engine.Matching(host) {
+		if rule.Offline {
+			return true
+		}
+	}
+	return false
+}
+
+// CompressesMedia indicates whether any rule matching the given host asks the
+// server to compress media.  It is safe to call on a nil Engine.
+func (engine *Engine) CompressesMedia(host string) bool {
+	for _, rule := range engine.Matching(host) {
+		if rule.CompressMedia {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBlocked indicates whether any rule matching the given host blocks it.  It
+// is safe to call on a nil Engine.
+func (engine *Engine) IsBlocked(host string) bool {
+	for _, rule := range engine.Matching(host) {
+		if rule.Block {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches indicates whether this rule's domain matches the given (lowercase)
+// host
+func (rule *Rule) Matches(host string) bool {
+	if rule.Domain == "" {
+		return false
+	}
+	pattern := strings.ToLower(rule.Domain)
+	if !strings.ContainsAny(pattern, "*?[") {
+		return host == pattern || strings.HasSuffix(host, "."+pattern)
+	}
+	matched, _ := path.Match(pattern, host)
+	return matched
+}
+
+// validate makes sure that the rule matches by exactly one of domain, cidr or
+// country and that its route is valid
+func (rule *Rule) validate() error {
+	matchers := 0
+	if rule.Domain != "" {
+		matchers++
+		if _, err := path.Match(rule.Domain, ""); err != nil {
+			return fmt.Errorf("Invalid domain pattern %s: %s", rule.Domain, err)
+		}
+	}
+	if rule.CIDR != "" {
+		matchers++
+		if _, _, err := net.ParseCIDR(rule.CIDR); err != nil {
+			return fmt.Errorf("Invalid cidr %s: %s", rule.CIDR, err)
+		}
+	}
+	if rule.Country != "" {
+		matchers++
+	}
+	if matchers != 1 {
+		return fmt.Errorf("A rule needs exactly one of domain, cidr or country")
+	}
+	if rule.Domain == "" && rule.Route == "" {
+		return fmt.Errorf("Rules matching by cidr or country need a route")
+	}
+	if rule.Route != "" && rule.Route != ROUTE_PROXY && rule.Route != ROUTE_DIRECT {
+		return fmt.Errorf("Unknown route %s", rule.Route)
+	}
+	if rule.Schedule != nil {
+		return rule.Schedule.validate()
+	}
+	return nil
+}
+
+func validateAll(rules []*Rule) error {
+	for _, rule := range rules {
+		if rule == nil {
+			return fmt.Errorf("Empty rule")
+		}
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (engine *Engine) now() time.Time {
+	if engine.Now != nil {
+		return engine.Now()
+	}
+	return time.Now()
+}
+
+// matchesIP indicates whether the given rule matches the given IP by cidr or
+// country, returning an error if the IP's country can't be looked up
+func (engine *Engine) matchesIP(rule *Rule, ip net.IP) (bool, error) {
+	if rule.CIDR != "" {
+		_, network, err := net.ParseCIDR(rule.CIDR)
+		return err == nil && network.Contains(ip), nil
+	}
+	if engine.LookupCountry == nil {
+		return false, fmt.Errorf("Unable to look up countries")
+	}
+	country, err := engine.LookupCountry(ip.String())
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(country, rule.Country), nil
+}
+
+// lookupIP resolves the given host, using the cached IPs if they're recent
+// enough
+func (engine *Engine) lookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	now := time.Now()
+	engine.lookupsMutex.Lock()
+	cached := engine.lookups[host]
+	engine.lookupsMutex.Unlock()
+	if cached != nil && now.Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	lookupIP := engine.LookupIP
+	if lookupIP == nil {
+		lookupIP = net.LookupIP
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	engine.lookupsMutex.Lock()
+	defer engine.lookupsMutex.Unlock()
+	if engine.lookups == nil || len(engine.lookups) >= MAX_CACHED_LOOKUPS {
+		// Keep it simple and just start over
+		engine.lookups = make(map[string]*lookup)
+	}
+	engine.lookups[host] = &lookup{ips: ips, expires: now.Add(LOOKUP_CACHE_TTL)}
+	return ips, nil
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
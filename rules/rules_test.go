@@ -0,0 +1,230 @@
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		domain   string
+		host     string
+		expected bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", true},
+		{"example.com", "badexample.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"www.example.*", "www.example.org", true},
+	}
+	for _, c := range cases {
+		rule := &Rule{Domain: c.domain}
+		if rule.Matches(c.host) != c.expected {
+			t.Errorf("Expected match of %s against %s to be %v", c.host, c.domain, c.expected)
+		}
+	}
+}
+
+func TestApplyHeaders(t *testing.T) {
+	engine := &Engine{Rules: []*Rule{
+		&Rule{Domain: "example.com", Headers: map[string]string{"Accept-Language": "en-US", "Cookie": ""}},
+		&Rule{Domain: "other.com", Headers: map[string]string{"X-Other": "true"}},
+	}}
+	req, _ := http.NewRequest("GET", "http://www.example.com:8080/", nil)
+	req.Header.Set("Cookie", "a=b")
+	engine.ApplyHeaders(req)
+	if req.Header.Get("Accept-Language") != "en-US" {
+		t.Errorf("Accept-Language not overridden")
+	}
+	if req.Header.Get("Cookie") != "" {
+		t.Errorf("Cookie not removed")
+	}
+	if req.Header.Get("X-Other") != "" {
+		t.Errorf("Header from non-matching rule applied")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	engine := &Engine{
+		Rules: []*Rule{
+			&Rule{Domain: "blocked.example", Route: ROUTE_PROXY},
+			&Rule{Domain: "example", Route: ROUTE_DIRECT},
+			&Rule{CIDR: "192.168.0.0/16", Route: ROUTE_DIRECT},
+			&Rule{Country: "DE", Route: ROUTE_DIRECT},
+		},
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("5.6.7.8")}, nil
+		},
+		LookupCountry: func(ip string) (string, error) {
+			if ip == "5.6.7.8" {
+				return "de", nil
+			}
+			return "US", nil
+		},
+	}
+	cases := map[string]string{
+		"www.blocked.example:443": ROUTE_PROXY,
+		"other.example":           ROUTE_DIRECT,
+		"192.168.1.1:80":          ROUTE_DIRECT,
+		"1.2.3.4:80":              ROUTE_PROXY,
+		"www.german.de":           ROUTE_DIRECT,
+	}
+	for host, expected := range cases {
+		if route := engine.Route(host); route != expected {
+			t.Errorf("Expected route for %s to be %s, got %s", host, expected, route)
+		}
+	}
+	var nilEngine *Engine
+	if nilEngine.Route("example") != ROUTE_PROXY {
+		t.Error("nil Engine should proxy everything")
+	}
+}
+
+func TestRouteLookups(t *testing.T) {
+	lookups := 0
+	lookupErr := fmt.Errorf("SERVFAIL")
+	engine := &Engine{
+		Rules: []*Rule{&Rule{CIDR: "10.0.0.0/8", Route: ROUTE_DIRECT}},
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		},
+	}
+	if route := engine.MatchRoute("intranet.example"); route != ROUTE_PROXY {
+		t.Errorf("Failed lookup should be proxied, got %s", route)
+	}
+	lookupErr = nil
+	for i := 0; i < 3; i++ {
+		if route := engine.MatchRoute("intranet.example:443"); route != ROUTE_DIRECT {
+			t.Errorf("Expected direct route, got %s", route)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("Successful lookup should have been cached, looked up %d times", lookups)
+	}
+
+	// Without a way to look up countries, rules by country proxy
+	engine = &Engine{
+		Rules: []*Rule{&Rule{Country: "DE", Route: ROUTE_DIRECT}},
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("5.6.7.8")}, nil
+		},
+	}
+	if route := engine.MatchRoute("www.german.de"); route != ROUTE_PROXY {
+		t.Errorf("Country that can't be looked up should be proxied, got %s", route)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []*Rule{
+		&Rule{},
+		&Rule{Domain: "example.com", CIDR: "10.0.0.0/8", Route: ROUTE_DIRECT},
+		&Rule{CIDR: "10.0.0.0/8"},
+		&Rule{CIDR: "10.0.0.0", Route: ROUTE_DIRECT},
+		&Rule{Domain: "example.com", Route: "sideways"},
+	}
+	for _, rule := range invalid {
+		if rule.validate() == nil {
+			t.Errorf("Rule should be invalid: %v", rule)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// Monday
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", "2024-01-01 "+clock)
+		return t
+	}
+	cases := []struct {
+		schedule *Schedule
+		clock    string
+		expected bool
+	}{
+		{nil, "12:00", true},
+		{&Schedule{From: "08:00", To: "15:00"}, "07:59", false},
+		{&Schedule{From: "08:00", To: "15:00"}, "08:00", true},
+		{&Schedule{From: "08:00", To: "15:00"}, "15:00", false},
+		{&Schedule{From: "20:00", To: "06:00"}, "23:00", true},
+		{&Schedule{From: "20:00", To: "06:00"}, "05:00", true},
+		{&Schedule{From: "20:00", To: "06:00"}, "12:00", false},
+		{&Schedule{Days: []string{"mon"}}, "12:00", true},
+		{&Schedule{Days: []string{"Sat", "sun"}}, "12:00", false},
+	}
+	for _, c := range cases {
+		if c.schedule.Active(at(c.clock)) != c.expected {
+			t.Errorf("Expected %v at %s to be active: %v", c.schedule, c.clock, c.expected)
+		}
+	}
+}
+
+func TestScheduledBlock(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.Local)
+	engine := &Engine{
+		Rules: []*Rule{
+			&Rule{Domain: "*", Block: true, Schedule: &Schedule{From: "08:00", To: "15:00"}},
+		},
+		Now: func() time.Time { return now },
+	}
+	if !engine.IsBlocked("example.com") {
+		t.Error("Should be blocked during schedule")
+	}
+	now = now.Add(8 * time.Hour)
+	if engine.IsBlocked("example.com") {
+		t.Error("Shouldn't be blocked outside of schedule")
+	}
+}
+
+func TestUpdateValidates(t *testing.T) {
+	engine := &Engine{}
+	err := engine.Update([]*Rule{&Rule{Domain: "example.com", Schedule: &Schedule{From: "8am"}}})
+	if err == nil {
+		t.Error("Invalid schedule should have been rejected")
+	}
+	err = engine.Update([]*Rule{&Rule{Domain: "example.com", Schedule: &Schedule{Days: []string{"fri"}, To: "24:00"}}})
+	if err != nil {
+		t.Errorf("Unable to update rules: %s", err)
+	}
+	if len(engine.Current()) != 1 {
+		t.Error("Rules not updated")
+	}
+}
+
+func TestReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"domain": "example.com", "block": true}]`)
+	file.Close()
+
+	engine, err := Load(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to load rules: %s", err)
+	}
+	ioutil.WriteFile(file.Name(), []byte(`[{"domain": "example.com"}, {"domain": "example.org", "block": true}]`), 0644)
+	if err := engine.Reload(); err != nil {
+		t.Fatalf("Unable to reload rules: %s", err)
+	}
+	if len(engine.Current()) != 2 || engine.IsBlocked("example.com") {
+		t.Error("Rules not reloaded")
+	}
+
+	ioutil.WriteFile(file.Name(), []byte(`[{"domain": "example.com", "schedule": {"from": "8am"}}]`), 0644)
+	if err := engine.Reload(); err == nil {
+		t.Error("Invalid rules should have been rejected")
+	}
+	if len(engine.Current()) != 2 {
+		t.Error("Current rules should have been kept")
+	}
+}
@@ -0,0 +1,87 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	CLOCK_FORMAT = "15:04"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule limits when a rule applies, in local time
+type Schedule struct {
+	Days []string `json:"days,omitempty"` // (optional) days (mon, tue, ...) on which the rule applies, defaults to every day
+	From string   `json:"from,omitempty"` // (optional) time of day (HH:MM) from which the rule applies, defaults to 00:00
+	To   string   `json:"to,omitempty"`   // (optional) time of day (HH:MM) until which the rule applies, defaults to 24:00
+}
+
+// Active indicates whether the schedule applies at the given time.  If To is
+// before From, the schedule wraps around midnight.  Days are checked against
+// the day of the given time.  It is safe to call on a nil Schedule, which is
+// always active.
+func (schedule *Schedule) Active(t time.Time) bool {
+	if schedule == nil {
+		return true
+	}
+	if len(schedule.Days) > 0 {
+		found := false
+		for _, day := range schedule.Days {
+			if weekdays[strings.ToLower(day)] == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	from, _ := minuteOfDay(schedule.From, 0)
+	to, _ := minuteOfDay(schedule.To, 24*60)
+	now := t.Hour()*60 + t.Minute()
+	if to < from {
+		return now >= from || now < to
+	}
+	return now >= from && now < to
+}
+
+// validate makes sure that the schedule's days and times parse
+func (schedule *Schedule) validate() error {
+	for _, day := range schedule.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("Unknown day %s", day)
+		}
+	}
+	if _, err := minuteOfDay(schedule.From, 0); err != nil {
+		return err
+	}
+	_, err := minuteOfDay(schedule.To, 24*60)
+	return err
+}
+
+// minuteOfDay parses the given HH:MM time of day into minutes since midnight,
+// returning def if clock is empty
+func minuteOfDay(clock string, def int) (int, error) {
+	if clock == "" {
+		return def, nil
+	}
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse(CLOCK_FORMAT, clock)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %s, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,130 @@
+// package selftest periodically tests the client's connectivity to its
+// servers (via every protocol and masquerade host, see protocol.Prober.Test)
+// and keeps a history of the results in the configDir.  From the history, it
+// finds Trends like fronting via some host failing every evening, which helps
+// users and support tell ISP throttling at certain times of day apart from
+// hosts that are simply blocked.
+package selftest
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/store"
+)
+
+const (
+	DEFAULT_INTERVAL = 1 * time.Hour
+	HISTORY_NAME     = "selftests"         // name of the history in the Store
+	RETENTION        = 14 * 24 * time.Hour // how long tests are kept in the history
+	MAX_REPORTS      = 1000                // number of tests to keep in the history at most
+)
+
+// Report is the outcome of one test run
+type Report struct {
+	Time    time.Time              `json:"time"`
+	Results []*protocol.TestResult `json:"results"`
+}
+
+// Scheduler runs tests every Interval and keeps their Reports in Store
+type Scheduler struct {
+	Interval time.Duration                 // (optional) how frequently to test, defaults to DEFAULT_INTERVAL
+	Store    *store.Store                  // (optional) where the history is kept across restarts
+	Test     func() []*protocol.TestResult // runs a test, e.g. protocol.Prober.Test
+
+	history []*Report
+	trends  []*Trend
+	mutex   sync.Mutex
+}
+
+// Start loads the history and starts testing in the background
+func (scheduler *Scheduler) Start() {
+	if scheduler.Interval <= 0 {
+		scheduler.Interval = DEFAULT_INTERVAL
+	}
+	if scheduler.Store != nil {
+		var history []*Report
+		err := scheduler.Store.Load(HISTORY_NAME, &history)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Unable to load self-test history, starting a new one: %s", err)
+		}
+		scheduler.mutex.Lock()
+		scheduler.history = history
+		scheduler.trends = FindTrends(history)
+		scheduler.mutex.Unlock()
+	}
+	go func() {
+		defer crash.Recover()
+		for {
+			time.Sleep(scheduler.Interval)
+			if err := scheduler.RunNow(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// RunNow runs a test right away and adds it to the history
+func (scheduler *Scheduler) RunNow() error {
+	report := &Report{Time: time.Now(), Results: scheduler.Test()}
+	failed := 0
+	for _, result := range report.Results {
+		if !result.OK {
+			failed++
+		}
+	}
+	log.Debugf("Self-test: %d of %d probe(s) failed", failed, len(report.Results))
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.history = trim(append(scheduler.history, report), report.Time)
+	scheduler.trends = FindTrends(scheduler.history)
+	if scheduler.Store == nil {
+		return nil
+	}
+	if err := scheduler.Store.Save(HISTORY_NAME, scheduler.history); err != nil {
+		return fmt.Errorf("Unable to save self-test history: %s", err)
+	}
+	return nil
+}
+
+// History returns the Reports kept so far, oldest first.  It is safe to call
+// on a nil Scheduler.
+func (scheduler *Scheduler) History() []*Report {
+	if scheduler == nil {
+		return nil
+	}
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	history := make([]*Report, len(scheduler.history))
+	copy(history, scheduler.history)
+	return history
+}
+
+// Trends returns the Trends in the history.  It is safe to call on a nil
+// Scheduler.
+func (scheduler *Scheduler) Trends() []*Trend {
+	if scheduler == nil {
+		return nil
+	}
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	return scheduler.trends
+}
+
+// trim drops the Reports that are older than RETENTION as of now, and the
+// oldest ones beyond MAX_REPORTS
+func trim(history []*Report, now time.Time) []*Report {
+	for len(history) > 0 && now.Sub(history[0].Time) > RETENTION {
+		history = history[1:]
+	}
+	if len(history) > MAX_REPORTS {
+		history = history[len(history)-MAX_REPORTS:]
+	}
+	return history
+}
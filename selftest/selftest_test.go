@@ -0,0 +1,84 @@
+package selftest
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/store"
+)
+
+func TestFindTrends(t *testing.T) {
+	var history []*Report
+	for day := 0; day < 5; day++ {
+		for hour := 0; hour < 24; hour++ {
+			evening := hour >= 19 && hour < 23
+			history = append(history, &Report{
+				Time: time.Date(2015, 3, 1+day, hour, 0, 0, 0, time.Local),
+				Results: []*protocol.TestResult{
+					{Server: "fl1", Protocol: "cloudflare", Via: "throttled.example.com", OK: !evening},
+					{Server: "fl1", Protocol: "cloudflare", Via: "blocked.example.com", OK: false},
+					{Server: "fl1", Protocol: "cloudflare", Via: "fine.example.com", OK: day != 2 || hour != 3},
+				},
+			})
+		}
+	}
+
+	trends := FindTrends(history)
+	if len(trends) != 2 {
+		t.Fatalf("Expected 2 trends, got %d", len(trends))
+	}
+	blocked, throttled := trends[0], trends[1]
+	if blocked.Via != "blocked.example.com" || blocked.From != blocked.To || blocked.Failures != 120 || !strings.Contains(blocked.Text, "all times of day") {
+		t.Errorf("Unexpected trend for blocked host: %v", blocked)
+	}
+	if throttled.Via != "throttled.example.com" || throttled.From != 19 || throttled.To != 23 || throttled.Tests != 20 || throttled.Failures != 20 || throttled.Days != 5 {
+		t.Errorf("Unexpected trend for throttled host: %v", throttled)
+	}
+	if !strings.Contains(throttled.Text, "in the evening (19:00-23:00)") {
+		t.Errorf("Unexpected text: %s", throttled.Text)
+	}
+}
+
+func TestSchedulerHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.New(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func() []*protocol.TestResult {
+		return []*protocol.TestResult{{Server: "fl1", Protocol: "cloudflare", OK: true}}
+	}
+	scheduler := &Scheduler{Store: s, Test: test}
+	for i := 0; i < 2; i++ {
+		if err := scheduler.RunNow(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted := &Scheduler{Interval: time.Hour, Store: s, Test: test}
+	restarted.Start()
+	if history := restarted.History(); len(history) != 2 || len(history[1].Results) != 1 {
+		t.Errorf("History wasn't kept across restarts: %v", history)
+	}
+	var none *Scheduler
+	if none.History() != nil || none.Trends() != nil {
+		t.Errorf("Nil scheduler should have no history")
+	}
+}
+
+func TestTrim(t *testing.T) {
+	now := time.Now()
+	history := []*Report{{Time: now.Add(-RETENTION - time.Hour)}, {Time: now.Add(-time.Hour)}}
+	if trimmed := trim(history, now); len(trimmed) != 1 || trimmed[0] != history[1] {
+		t.Errorf("Old reports should be dropped, got %v", trimmed)
+	}
+}
@@ -0,0 +1,171 @@
+package selftest
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	TREND_MIN_TESTS    = 3   // tests needed at an hour of the day before it can be part of a Trend
+	TREND_MIN_DAYS     = 2   // days on which tests at an hour of the day must have failed
+	TREND_FAILURE_RATE = 0.5 // fraction of tests at an hour of the day that must have failed
+)
+
+// Trend is a server that regularly fails to be reached via a protocol and
+// host at certain hours of the day (local time), or all day
+type Trend struct {
+	Server   string `json:"server"`
+	Protocol string `json:"protocol"`
+	Via      string `json:"via,omitempty"`
+	From     int    `json:"from"`     // hour of the day at which the failures start
+	To       int    `json:"to"`       // hour of the day at which they stop, the same as From if they don't
+	Tests    int    `json:"tests"`    // tests during those hours
+	Failures int    `json:"failures"` // failed tests during those hours
+	Days     int    `json:"days"`     // days on which tests during those hours failed
+	Text     string `json:"text"`     // human-readable description
+}
+
+// hourStats are the tests of a target at one hour of the day
+type hourStats struct {
+	tests    int
+	failures int
+	days     map[string]bool // on which there were failures
+}
+
+func (stats *hourStats) isBad() bool {
+	return stats.tests >= TREND_MIN_TESTS && len(stats.days) >= TREND_MIN_DAYS &&
+		float64(stats.failures) >= TREND_FAILURE_RATE*float64(stats.tests)
+}
+
+// target identifies what was tested
+type target struct {
+	server   string
+	protocol string
+	via      string
+}
+
+// FindTrends finds Trends in the given history
+func FindTrends(history []*Report) []*Trend {
+	targets := make(map[target]*[24]hourStats)
+	for _, report := range history {
+		t := report.Time.Local()
+		day := t.Format("2006-01-02")
+		for _, result := range report.Results {
+			key := target{result.Server, result.Protocol, result.Via}
+			hours := targets[key]
+			if hours == nil {
+				hours = &[24]hourStats{}
+				targets[key] = hours
+			}
+			stats := &hours[t.Hour()]
+			stats.tests++
+			if !result.OK {
+				stats.failures++
+				if stats.days == nil {
+					stats.days = make(map[string]bool)
+				}
+				stats.days[day] = true
+			}
+		}
+	}
+
+	var trends []*Trend
+	for key, hours := range targets {
+		trends = append(trends, trendsFor(key, hours)...)
+	}
+	sort.Sort(byTarget(trends))
+	return trends
+}
+
+// trendsFor finds the periods of consecutive bad hours for one target.  If
+// it's failing at the other hours too, that's a single all-day Trend instead.
+func trendsFor(key target, hours *[24]hourStats) []*Trend {
+	var bad [24]bool
+	anyBad := false
+	var other hourStats
+	for hour := range hours {
+		bad[hour] = hours[hour].isBad()
+		if bad[hour] {
+			anyBad = true
+		} else {
+			other.tests += hours[hour].tests
+			other.failures += hours[hour].failures
+		}
+	}
+	if !anyBad {
+		return nil
+	}
+	if float64(other.failures) >= TREND_FAILURE_RATE*float64(other.tests) {
+		return []*Trend{newTrend(key, hours, 0, 24)}
+	}
+
+	var trends []*Trend
+	for from := 0; from < 24; from++ {
+		if !bad[from] || bad[(from+23)%24] {
+			continue
+		}
+		length := 1
+		for bad[(from+length)%24] {
+			length++
+		}
+		trends = append(trends, newTrend(key, hours, from, length))
+	}
+	return trends
+}
+
+// newTrend builds the Trend for the given number of hours starting at from
+func newTrend(key target, hours *[24]hourStats, from int, length int) *Trend {
+	trend := &Trend{Server: key.server, Protocol: key.protocol, Via: key.via, From: from, To: (from + length) % 24}
+	days := make(map[string]bool)
+	for i := 0; i < length; i++ {
+		stats := &hours[(from+i)%24]
+		trend.Tests += stats.tests
+		trend.Failures += stats.failures
+		for day := range stats.days {
+			days[day] = true
+		}
+	}
+	trend.Days = len(days)
+
+	what := trend.Protocol + " to " + trend.Server
+	if trend.Via != "" {
+		what = trend.Protocol + " via " + trend.Via
+	}
+	when := "at all times of day"
+	if length < 24 {
+		when = fmt.Sprintf("%s (%02d:00-%02d:00)", partOfDay((from+length/2)%24), trend.From, trend.To)
+	}
+	trend.Text = fmt.Sprintf("%s has been failing %s: %d of %d tests on %d day(s)", what, when, trend.Failures, trend.Tests, trend.Days)
+	return trend
+}
+
+// partOfDay names the part of the day that the given hour is in
+func partOfDay(hour int) string {
+	switch {
+	case hour >= 5 && hour < 12:
+		return "in the morning"
+	case hour >= 12 && hour < 17:
+		return "in the afternoon"
+	case hour >= 17 && hour < 22:
+		return "in the evening"
+	default:
+		return "at night"
+	}
+}
+
+type byTarget []*Trend
+
+func (a byTarget) Len() int      { return len(a) }
+func (a byTarget) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byTarget) Less(i, j int) bool {
+	if a[i].Server != a[j].Server {
+		return a[i].Server < a[j].Server
+	}
+	if a[i].Protocol != a[j].Protocol {
+		return a[i].Protocol < a[j].Protocol
+	}
+	if a[i].Via != a[j].Via {
+		return a[i].Via < a[j].Via
+	}
+	return a[i].From < a[j].From
+}
@@ -0,0 +1,184 @@
+// package server provides flashlight's server for embedding in other Go
+// programs, such as tests.  The flashlight command is a thin CLI around it and
+// package client.  For example:
+//
+//	s := server.New(&server.Config{
+//		Addr:      ":443",
+//		Host:      "fl1.example.org",
+//		ConfigDir: "/var/lib/flashlight",
+//	})
+//	err := s.ListenAndServe()
+//
+// Settings beyond those of Config (egress policy, stats and so on) are made on
+// the proxy.Server given as Config.Proxy.
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/getlantern/flashlight/acmecert"
+	"github.com/getlantern/flashlight/clientauth"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/protocol/azure"
+	"github.com/getlantern/flashlight/protocol/cloudflare"
+	"github.com/getlantern/flashlight/proxy"
+)
+
+const (
+	PK_FILE               = "proxypk.pem"
+	SERVER_CERT_FILE      = "servercert.pem"
+	ACME_KEY_FILE         = "acmekey.pem"     // key of the cert obtained with Config.ACME
+	ACME_ACCOUNT_KEY_FILE = "acmeaccount.pem" // key of our account with the ACME CA
+	CLIENT_CA_FILE        = "clientca.pem"    // CA that issues client certificates, see package clientauth
+	CLIENT_CA_KEY_FILE    = "clientcakey.pem" // key of the CLIENT_CA_FILE
+)
+
+// Config configures a Server
+type Config struct {
+	Addr      string   // ip:port on which to listen with https
+	Host      string   // FQDN that is guaranteed to hit this server
+	Protocols []string // (optional) fronting protocols ("cloudflare" or "azure") through which clients reach us, defaults to cloudflare
+	// FrontRanges (optional) are the CIDRs from which to trust the client IPs
+	// that fronts report, defaults to the ranges that each protocol's
+	// provider publishes
+	FrontRanges []string
+	ConfigDir   string // (optional) directory in which to keep our private key and certificate, created if necessary, defaults to the current directory
+	KeyType     string // (optional) type of private key to generate if we don't have one yet: "ecdsa" (default), "rsa" or "ed25519"
+	KeySize     int    // (optional) bits of a generated rsa key (default 2048) or curve size of an ecdsa one: 256 (default), 384 or 521
+
+	// ACME (optional) obtains a publicly trusted certificate for Host from an
+	// ACME CA rather than generating a self-signed one.  Its Host and files
+	// default to ours.
+	ACME *acmecert.Manager
+
+	// ClientAuth (optional) requires clients to present certificates issued by
+	// its CA.  It's loaded from (or created in) ConfigDir if it has no CA.
+	ClientAuth *clientauth.Verifier
+
+	// Proxy (optional) is the server proxy, for settings beyond these.  Its
+	// Addr, Host and Protocol are set from this Config, as is its CertContext
+	// unless already set.
+	Proxy *proxy.Server
+}
+
+// Server is a flashlight server
+type Server struct {
+	config Config
+	proxy  *proxy.Server
+}
+
+// New creates a Server with the given Config
+func New(config *Config) *Server {
+	server := &Server{config: *config, proxy: config.Proxy}
+	if server.proxy == nil {
+		server.proxy = &proxy.Server{}
+	}
+	return server
+}
+
+// Proxy returns the server proxy
+func (server *Server) Proxy() *proxy.Server {
+	return server.proxy
+}
+
+// ListenAndServe runs the server proxy until it fails
+func (server *Server) ListenAndServe() error {
+	p, err := serverProtocol(server.config.Protocols, server.config.FrontRanges)
+	if err != nil {
+		return err
+	}
+	server.proxy.Addr = server.config.Addr
+	server.proxy.Host = server.config.Host
+	server.proxy.Protocol = p
+	if server.proxy.CertContext == nil {
+		if server.config.ConfigDir != "" {
+			if err := os.MkdirAll(server.config.ConfigDir, 0755); err != nil {
+				return fmt.Errorf("Unable to create configDir at %s: %s", server.config.ConfigDir, err)
+			}
+		}
+		server.proxy.CertContext = &proxy.CertContext{
+			PKFile:         filepath.Join(server.config.ConfigDir, PK_FILE),
+			ServerCertFile: filepath.Join(server.config.ConfigDir, SERVER_CERT_FILE),
+			KeyType:        server.config.KeyType,
+			KeySize:        server.config.KeySize,
+		}
+		if acme := server.config.ACME; acme != nil {
+			if acme.Host == "" {
+				acme.Host = server.config.Host
+			}
+			if acme.CertFile == "" {
+				acme.CertFile = server.proxy.CertContext.ServerCertFile
+			}
+			if acme.KeyFile == "" {
+				acme.KeyFile = filepath.Join(server.config.ConfigDir, ACME_KEY_FILE)
+			}
+			if acme.AccountKeyFile == "" {
+				acme.AccountKeyFile = filepath.Join(server.config.ConfigDir, ACME_ACCOUNT_KEY_FILE)
+			}
+			server.proxy.CertContext.ServerCertFile = acme.CertFile
+			server.proxy.CertContext.ACME = acme
+		}
+	}
+	if server.config.ClientAuth != nil {
+		if err := server.initClientAuth(); err != nil {
+			return err
+		}
+	}
+	return server.proxy.Run()
+}
+
+// initClientAuth loads (or creates) the ClientAuth's CA and allowlist and
+// has the server proxy require client certificates
+func (server *Server) initClientAuth() error {
+	verifier := server.config.ClientAuth
+	if verifier.CA == nil {
+		ca, err := clientauth.LoadOrCreateCA(filepath.Join(server.config.ConfigDir, CLIENT_CA_FILE), filepath.Join(server.config.ConfigDir, CLIENT_CA_KEY_FILE))
+		if err != nil {
+			return err
+		}
+		verifier.CA = ca
+	}
+	if err := verifier.Reload(); err != nil {
+		return err
+	}
+	server.proxy.ClientAuth = verifier
+	return nil
+}
+
+// serverProtocol builds the protocol.ServerProtocol(s) with the given names,
+// trusting client IPs reported from the given ranges or, if there are none,
+// from the ranges that their providers publish
+func serverProtocol(names []string, frontRanges []string) (protocol.ServerProtocol, error) {
+	trusted, err := protocol.ParseIPRanges(frontRanges)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		names = []string{"cloudflare"}
+	}
+	var protocols protocol.ServerProtocols
+	for _, name := range names {
+		switch name {
+		case "cloudflare":
+			if len(trusted) > 0 {
+				protocols = append(protocols, cloudflare.NewServerProtocolTrusting(trusted))
+			} else {
+				protocols = append(protocols, cloudflare.NewServerProtocol())
+			}
+		case "azure":
+			if len(trusted) > 0 {
+				protocols = append(protocols, azure.NewServerProtocolTrusting(trusted))
+			} else {
+				protocols = append(protocols, azure.NewServerProtocol())
+			}
+		default:
+			return nil, fmt.Errorf("Unknown protocol %s", name)
+		}
+	}
+	if len(protocols) == 1 {
+		return protocols[0], nil
+	}
+	return protocols, nil
+}
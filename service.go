@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	SERVICE_NAME         = "flashlight"
+	SERVICE_DISPLAY_NAME = "Flashlight"
+	SERVICE_DESCRIPTION  = "Proxies traffic through flashlight servers"
+
+	SERVICE_INSTALL   = "install"
+	SERVICE_START     = "start"
+	SERVICE_STOP      = "stop"
+	SERVICE_UNINSTALL = "uninstall"
+
+	SERVICE_SECRETS_FILE = "service-secrets.json" // in the configDir, holds the SECRET_FLAGS of the Windows service
+)
+
+// manageService runs the given -service command and exits
+func manageService(cmd string) {
+	if err := controlService(cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to %s service: %s\n", cmd, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Service %s: %s done\n", SERVICE_NAME, cmd)
+	os.Exit(0)
+}
+
+// argsWithout returns the given command-line arguments without the named
+// flag (and its value, if it takes one), for installing services that run
+// with the rest
+func argsWithout(args []string, name string, takesValue bool) []string {
+	var filtered []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-"+name || arg == "--"+name {
+			if takesValue {
+				// The value is the next argument
+				i++
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "-"+name+"=") || strings.HasPrefix(arg, "--"+name+"=") {
+			continue
+		}
+		filtered = append(filtered, arg)
+	}
+	return filtered
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+)
+
+// runningAsService indicates whether we were started as a Windows service,
+// which we never are elsewhere
+func runningAsService() bool {
+	return false
+}
+
+// loadServiceSecrets is only needed on Windows, where other platforms' daemons
+// get the SECRET_FLAGS from their environment
+func loadServiceSecrets() error {
+	return nil
+}
+
+// runService is only needed on Windows
+func runService(run func()) {
+	run()
+}
+
+// controlService fails except on Windows, where systemd, launchd and the like
+// don't exist
+func controlService(cmd string) error {
+	return fmt.Errorf("services are only supported on Windows, use systemd, launchd or similar instead")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	SERVICE_RESTART_DELAY = 5 * time.Second  // how long after failing the service is restarted
+	SERVICE_STOP_TIMEOUT  = 30 * time.Second // how long to wait for the service to stop, on top of -draintimeout
+
+	// SERVICE_SECRETS_SDDL lets only SYSTEM and Administrators access the
+	// SERVICE_SECRETS_FILE, without inheriting access from the configDir
+	SERVICE_SECRETS_SDDL = "D:P(A;;FA;;;SY)(A;;FA;;;BA)"
+
+	servicePollInterval = 250 * time.Millisecond
+)
+
+// runningAsService indicates whether the service control manager started us,
+// in which case it changes to the binary's directory, since services start in
+// the system directory
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	if executable, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(executable))
+	}
+	return true
+}
+
+// runService runs the given function as our service, reporting errors to the
+// event log, until the service control manager stops us
+func runService(run func()) {
+	elog, err := eventlog.Open(SERVICE_NAME)
+	if err == nil {
+		defer elog.Close()
+		log.OnError(func(message string) {
+			elog.Error(1, message)
+		})
+	}
+	if err := svc.Run(SERVICE_NAME, &service{run: run, elog: elog}); err != nil {
+		log.Errorf("Unable to run as a service: %s", err)
+	}
+}
+
+// loadServiceSecrets sets the environment variables in the
+// SERVICE_SECRETS_FILE if the service control manager started us, so that
+// applyEnvironment applies them to the SECRET_FLAGS
+func loadServiceSecrets() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return nil
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Unable to find our binary: %s", err)
+	}
+	filename := serviceSecretsFile(executable)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read %s: %s", filename, err)
+	}
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("Unable to parse %s: %s", filename, err)
+	}
+	for name, value := range secrets {
+		os.Setenv(name, value)
+	}
+	return nil
+}
+
+// serviceSecretsFile returns the path of the SERVICE_SECRETS_FILE of the
+// service that runs the given binary, whose -configdir is relative to the
+// binary's directory
+func serviceSecretsFile(executable string) string {
+	dir := *configDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(executable), dir)
+	}
+	return filepath.Join(dir, SERVICE_SECRETS_FILE)
+}
+
+// writeServiceSecrets writes the given secrets, by the names of their
+// environment variables, to the given file, which is created readable only by
+// SYSTEM and Administrators
+func writeServiceSecrets(filename string, secrets map[string]string) error {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal secrets: %s", err)
+	}
+	sd, err := windows.SecurityDescriptorFromString(SERVICE_SECRETS_SDDL)
+	if err != nil {
+		return fmt.Errorf("Unable to build security descriptor: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return fmt.Errorf("Unable to create %s: %s", filepath.Dir(filename), err)
+	}
+	// The security descriptor only applies to new files
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to replace %s: %s", filename, err)
+	}
+	name, err := windows.UTF16PtrFromString(filename)
+	if err != nil {
+		return fmt.Errorf("Invalid filename %s: %s", filename, err)
+	}
+	sa := &windows.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	handle, err := windows.CreateFile(name, windows.GENERIC_WRITE, 0, sa, windows.CREATE_NEW, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to create %s: %s", filename, err)
+	}
+	file := os.NewFile(uintptr(handle), filename)
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write %s: %s", filename, err)
+	}
+	return nil
+}
+
+// service is our svc.Handler
+type service struct {
+	run  func()
+	elog *eventlog.Log // nil if the event log couldn't be opened
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go s.run()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	s.info(fmt.Sprintf("Started as %s", *role))
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32((*drainTimeout + SERVICE_STOP_TIMEOUT) / time.Millisecond)}
+			s.info("Stopping")
+			runShutdownHooks()
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+func (s *service) info(message string) {
+	log.Debug(message)
+	if s.elog != nil {
+		s.elog.Info(1, message)
+	}
+}
+
+// controlService installs, starts, stops or uninstalls our service
+func controlService(cmd string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Unable to connect to the service control manager: %s", err)
+	}
+	defer m.Disconnect()
+	if cmd == SERVICE_INSTALL {
+		return installService(m)
+	}
+
+	s, err := m.OpenService(SERVICE_NAME)
+	if err != nil {
+		return fmt.Errorf("Unable to open service %s, is it installed? %s", SERVICE_NAME, err)
+	}
+	defer s.Close()
+	switch cmd {
+	case SERVICE_START:
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("Unable to start service: %s", err)
+		}
+		return nil
+	case SERVICE_STOP:
+		return stopService(s)
+	case SERVICE_UNINSTALL:
+		if current, err := s.Query(); err == nil && current.State != svc.Stopped {
+			if err := stopService(s); err != nil {
+				return err
+			}
+		}
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("Unable to delete service: %s", err)
+		}
+		if executable, err := os.Executable(); err == nil {
+			filename := serviceSecretsFile(executable)
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				log.Debugf("Unable to remove %s: %s", filename, err)
+			}
+		}
+		if err := eventlog.Remove(SERVICE_NAME); err != nil {
+			log.Debugf("Unable to remove event log source: %s", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown command %s", cmd)
+}
+
+// installService installs our service to run this binary at boot with our
+// command-line arguments, restarting it if it fails.  The SECRET_FLAGS aren't
+// part of its command line, which other users can read, but go in the
+// SERVICE_SECRETS_FILE.
+func installService(m *mgr.Mgr) error {
+	executable, err := exec.LookPath(os.Args[0])
+	if err == nil {
+		executable, err = filepath.Abs(executable)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to find our binary: %s", err)
+	}
+	if s, err := m.OpenService(SERVICE_NAME); err == nil {
+		s.Close()
+		return fmt.Errorf("Service %s is already installed", SERVICE_NAME)
+	}
+	args, secrets := splitSecretArgs(argsWithout(os.Args[1:], "service", true))
+	secretsFile := serviceSecretsFile(executable)
+	if len(secrets) > 0 {
+		if err := writeServiceSecrets(secretsFile, secrets); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", secretsFile)
+	} else if err := os.Remove(secretsFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove %s: %s", secretsFile, err)
+	}
+	s, err := m.CreateService(SERVICE_NAME, executable, mgr.Config{
+		DisplayName: SERVICE_DISPLAY_NAME,
+		Description: SERVICE_DESCRIPTION,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("Unable to create service: %s", err)
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: SERVICE_RESTART_DELAY}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32(time.Hour/time.Second)); err != nil {
+		log.Debugf("Unable to set recovery actions: %s", err)
+	}
+	if err := eventlog.InstallAsEventCreate(SERVICE_NAME, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("Unable to register event log source: %s", err)
+	}
+	return nil
+}
+
+// stopService stops the given service and waits for it to finish draining
+func stopService(s *mgr.Service) error {
+	current, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("Unable to stop service: %s", err)
+	}
+	deadline := time.Now().Add(*drainTimeout + SERVICE_STOP_TIMEOUT)
+	for current.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Service didn't stop within %v", *drainTimeout+SERVICE_STOP_TIMEOUT)
+		}
+		time.Sleep(servicePollInterval)
+		if current, err = s.Query(); err != nil {
+			return fmt.Errorf("Unable to query service status: %s", err)
+		}
+	}
+	return nil
+}
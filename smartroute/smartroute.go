@@ -0,0 +1,192 @@
+// package smartroute detects which destinations are reachable directly, so
+// that the client only needs to tunnel the ones that are blocked.  The first
+// time that a host is seen, it's tunneled while a probe checks whether it can
+// be reached directly.  Later requests then follow the probe's verdict until
+// it expires.
+//
+// A probe considers a host blocked if its DNS answer from the OS resolver
+// looks poisoned (fails, or points at non-global addresses while DoH
+// doesn't), if connecting to it times out or gets reset, or if the TLS
+// handshake (for port 443) or a HEAD request (for other ports) fails.
+package smartroute
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/resolver"
+)
+
+const (
+	DEFAULT_TTL   = 1 * time.Hour
+	PROBE_TIMEOUT = 5 * time.Second
+	MAX_VERDICTS  = 10000
+)
+
+var (
+	// privateNetworks are the RFC 1918 and RFC 4193 ranges, which poisoned
+	// DNS answers commonly point at
+	privateNetworks = []*net.IPNet{
+		mustParseCIDR("10.0.0.0/8"),
+		mustParseCIDR("172.16.0.0/12"),
+		mustParseCIDR("192.168.0.0/16"),
+		mustParseCIDR("fc00::/7"),
+	}
+)
+
+// Detector detects whether destinations are reachable directly
+type Detector struct {
+	TTL      time.Duration      // how long verdicts are cached, defaults to DEFAULT_TTL
+	Resolver *resolver.Resolver // (optional) trusted resolver for detecting DNS poisoning
+
+	verdicts     map[string]*verdict
+	verdictMutex sync.Mutex
+}
+
+// verdict is the result of probing a host.  While the probe is in flight,
+// probing is true.
+type verdict struct {
+	reachable bool
+	probing   bool
+	expires   time.Time
+}
+
+// ShouldTunnel indicates whether the given addr (host:port) should be
+// tunneled.  It never blocks on probing.  It is safe to call on a nil
+// Detector, in which case everything is tunneled.
+func (detector *Detector) ShouldTunnel(addr string) bool {
+	if detector == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return true
+	}
+	key := strings.ToLower(host)
+
+	detector.verdictMutex.Lock()
+	defer detector.verdictMutex.Unlock()
+	if detector.verdicts == nil {
+		detector.verdicts = make(map[string]*verdict)
+	}
+	v, found := detector.verdicts[key]
+	if found && (v.probing || time.Now().Before(v.expires)) {
+		return !v.reachable
+	}
+	if len(detector.verdicts) >= MAX_VERDICTS {
+		// Keep it simple and just start over
+		detector.verdicts = make(map[string]*verdict)
+	}
+	detector.verdicts[key] = &verdict{probing: true}
+	go detector.probe(key, addr)
+	return true
+}
+
+func (detector *Detector) probe(key string, addr string) {
+	err := detector.probeDirect(addr)
+	if err != nil {
+		log.Debugf("%s looks blocked: %s", log.Redact(addr), err)
+	} else {
+		log.Debugf("%s is reachable directly", log.Redact(addr))
+	}
+	ttl := detector.TTL
+	if ttl == 0 {
+		ttl = DEFAULT_TTL
+	}
+	detector.verdictMutex.Lock()
+	detector.verdicts[key] = &verdict{
+		reachable: err == nil,
+		expires:   time.Now().Add(ttl),
+	}
+	detector.verdictMutex.Unlock()
+}
+
+// probeDirect tries to reach addr directly, returning an error describing why
+// it looks blocked if it does
+func (detector *Detector) probeDirect(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip, err := detector.checkDNS(host)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), PROBE_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(PROBE_TIMEOUT))
+
+	if port == "443" {
+		// Censors commonly reset connections based on the SNI, and
+		// MITMing ones fail verification
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %s", err)
+		}
+		return nil
+	}
+
+	_, err = fmt.Fprintf(conn, "HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+	if err != nil {
+		return fmt.Errorf("Unable to send request: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return fmt.Errorf("No response: %s", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checkDNS resolves host using the OS resolver, checking for signs of
+// poisoning.  It returns the IP to probe.
+func (detector *Detector) checkDNS(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve: %s", err)
+	}
+	for _, ip := range ips {
+		if !ip.IsGlobalUnicast() || isPrivate(ip) {
+			if detector.Resolver == nil {
+				return nil, fmt.Errorf("Resolved to non-global address %s", ip)
+			}
+			trusted, err := detector.Resolver.LookupIP("tcp", host)
+			if err == nil && len(trusted) > 0 && trusted[0].IsGlobalUnicast() && !isPrivate(trusted[0]) {
+				return nil, fmt.Errorf("DNS appears poisoned, resolved to %s", ip)
+			}
+			// Trusted resolver agrees, it's a genuinely local host
+		}
+	}
+	return ips[0], nil
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
@@ -0,0 +1,52 @@
+package smartroute
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldTunnel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	reachable := strings.TrimPrefix(server.URL, "http://")
+
+	// Use a different host, since verdicts are per host
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a reset by closing connections immediately
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	defer l.Close()
+	blocked := l.Addr().String()
+
+	detector := &Detector{}
+	if !detector.ShouldTunnel(reachable) || !detector.ShouldTunnel(blocked) {
+		t.Fatal("Unprobed destinations should be tunneled")
+	}
+	// Wait for probes
+	time.Sleep(500 * time.Millisecond)
+	if detector.ShouldTunnel(reachable) {
+		t.Error("Reachable destination shouldn't be tunneled")
+	}
+	if !detector.ShouldTunnel(blocked) {
+		t.Error("Blocked destination should be tunneled")
+	}
+
+	var nilDetector *Detector
+	if !nilDetector.ShouldTunnel(reachable) {
+		t.Error("nil Detector should tunnel everything")
+	}
+}
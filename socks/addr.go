@@ -0,0 +1,81 @@
+package socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	ATYP_IPV4   = 1
+	ATYP_DOMAIN = 3
+	ATYP_IPV6   = 4
+)
+
+// readAddr reads a SOCKS5 address (ATYP, DST.ADDR, DST.PORT) from r and
+// returns it in host:port form.
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case ATYP_IPV4, ATYP_IPV6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == ATYP_IPV6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case ATYP_DOMAIN:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("Unknown address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendAddr appends the SOCKS5 encoding of the given host:port to b
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, ATYP_IPV4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, ATYP_IPV6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Domain name too long")
+		}
+		b = append(b, ATYP_DOMAIN, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
@@ -0,0 +1,214 @@
+// package socks implements a SOCKS5 server for the client proxy, supporting
+// CONNECT as well as UDP ASSOCIATE.  UDP datagrams are relayed through the
+// tunnel to a matching forwarder on the server (see NewUDPRelayConn).
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/pipe"
+)
+
+const (
+	SOCKS5_VERSION = 5
+
+	CMD_CONNECT       = 1
+	CMD_UDP_ASSOCIATE = 3
+
+	REP_SUCCEEDED             = 0
+	REP_GENERAL_FAILURE       = 1
+	REP_COMMAND_NOT_SUPPORTED = 7
+
+	METHOD_NO_AUTH       = 0
+	METHOD_USERNAME      = 2
+	METHOD_NO_ACCEPTABLE = 0xFF
+
+	USERNAME_AUTH_VERSION = 1
+	USERNAME_AUTH_SUCCESS = 0
+	USERNAME_AUTH_FAILURE = 1
+)
+
+// Server is a SOCKS5 server
+type Server struct {
+	Addr string // listen address in form of host:port
+
+	// Dial dials the given addr through the tunnel
+	Dial func(addr string) (net.Conn, error)
+
+	// Authenticate (optional) authenticates clients by username and password
+	// (RFC 1929), returning the dial function to use for the authenticated
+	// user.  If specified, clients must authenticate.
+	Authenticate func(username string, password string) (func(addr string) (net.Conn, error), bool)
+
+	listener net.Listener
+	closed   bool
+	mutex    sync.Mutex
+}
+
+// ListenAndServe listens at Addr and serves SOCKS5 clients
+func (server *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for SOCKS at %s: %s", server.Addr, err)
+	}
+	log.Debugf("About to start SOCKS5 proxy at %s", server.Addr)
+	return server.Serve(l)
+}
+
+// Serve serves SOCKS5 clients on the given Listener, until Close
+func (server *Server) Serve(l net.Listener) error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		l.Close()
+		return nil
+	}
+	server.listener = l
+	server.mutex.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			if server.closed {
+				return nil
+			}
+			return err
+		}
+		go server.handle(conn)
+	}
+}
+
+// Close stops listening.  Connections being served stay open.
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.closed = true
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Close()
+}
+
+func (server *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	dial, err := server.negotiate(conn)
+	if err != nil {
+		log.Debugf("Unable to negotiate SOCKS5: %s", err)
+		return
+	}
+
+	// Request is VER CMD RSV ATYP DST.ADDR DST.PORT
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	addr, err := readAddr(conn)
+	if err != nil {
+		log.Debugf("Unable to read SOCKS5 address: %s", err)
+		return
+	}
+
+	switch header[1] {
+	case CMD_CONNECT:
+		handleConnect(conn, addr, dial)
+	case CMD_UDP_ASSOCIATE:
+		handleUDPAssociate(conn, addr, dial)
+	default:
+		reply(conn, REP_COMMAND_NOT_SUPPORTED, "0.0.0.0:0")
+	}
+}
+
+// negotiate handles the SOCKS5 method negotiation, returning the dial
+// function to use for this client.  Without Authenticate, we only support "no
+// authentication" since the SOCKS server is meant to listen locally.
+func (server *Server) negotiate(conn net.Conn) (func(addr string) (net.Conn, error), error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != SOCKS5_VERSION {
+		return nil, fmt.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	wanted := byte(METHOD_NO_AUTH)
+	if server.Authenticate != nil {
+		wanted = METHOD_USERNAME
+	}
+	for _, method := range methods {
+		if method == wanted {
+			if _, err := conn.Write([]byte{SOCKS5_VERSION, wanted}); err != nil {
+				return nil, err
+			}
+			if wanted == METHOD_NO_AUTH {
+				return server.Dial, nil
+			}
+			return server.authenticate(conn)
+		}
+	}
+	conn.Write([]byte{SOCKS5_VERSION, METHOD_NO_ACCEPTABLE})
+	return nil, fmt.Errorf("No acceptable authentication method")
+}
+
+// authenticate handles username/password authentication (RFC 1929)
+func (server *Server) authenticate(conn net.Conn) (func(addr string) (net.Conn, error), error) {
+	// Request is VER ULEN UNAME PLEN PASSWD
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != USERNAME_AUTH_VERSION {
+		return nil, fmt.Errorf("Unsupported username authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return nil, err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, err
+	}
+	dial, ok := server.Authenticate(string(username), string(password))
+	if !ok {
+		conn.Write([]byte{USERNAME_AUTH_VERSION, USERNAME_AUTH_FAILURE})
+		return nil, fmt.Errorf("Authentication failed")
+	}
+	_, err := conn.Write([]byte{USERNAME_AUTH_VERSION, USERNAME_AUTH_SUCCESS})
+	return dial, err
+}
+
+func handleConnect(conn net.Conn, addr string, dial func(addr string) (net.Conn, error)) {
+	upstream, err := dial(addr)
+	if err != nil {
+		log.Debugf("Unable to dial %s for SOCKS: %s", log.Redact(addr), err)
+		reply(conn, REP_GENERAL_FAILURE, "0.0.0.0:0")
+		return
+	}
+	defer upstream.Close()
+	if err := reply(conn, REP_SUCCEEDED, upstream.LocalAddr().String()); err != nil {
+		return
+	}
+	sent, received := pipe.Relay(conn, upstream)
+	log.Debugf("Relayed %d bytes to and %d bytes from %s for SOCKS", sent, received, log.Redact(addr))
+}
+
+// reply writes a SOCKS5 reply with the given code and bound address
+func reply(conn net.Conn, rep byte, boundAddr string) error {
+	b, err := appendAddr([]byte{SOCKS5_VERSION, rep, 0}, boundAddr)
+	if err != nil {
+		// Bound address isn't meaningful (e.g. enproxy conn), send zeros
+		b, _ = appendAddr([]byte{SOCKS5_VERSION, rep, 0}, "0.0.0.0:0")
+	}
+	_, err = conn.Write(b)
+	return err
+}
@@ -0,0 +1,245 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// UDP_RELAY_ADDR is the pseudo-destination that the client dials through
+	// the tunnel in order to reach the server's UDP forwarder.
+	UDP_RELAY_ADDR = "udp.relay.lantern:1"
+
+	UDP_IDLE_TIMEOUT = 2 * time.Minute
+	MAX_DATAGRAM     = 65535
+)
+
+// Datagrams travel through the tunnel as frames consisting of a 2 byte
+// big-endian length followed by the datagram in SOCKS5 UDP request format
+// (RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA).  From client to server the
+// address is the destination, from server to client it's the source.
+
+// writeFrame writes the given datagram as a frame
+func writeFrame(w io.Writer, datagram []byte) error {
+	if len(datagram) > MAX_DATAGRAM {
+		return fmt.Errorf("Datagram too large: %d", len(datagram))
+	}
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a frame, returning the datagram
+func readFrame(r io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	datagram := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, datagram); err != nil {
+		return nil, err
+	}
+	return datagram, nil
+}
+
+// parseDatagram parses a SOCKS5 UDP datagram, returning its address and
+// payload.  Fragmented datagrams are not supported.
+func parseDatagram(datagram []byte) (string, []byte, error) {
+	if len(datagram) < 4 {
+		return "", nil, fmt.Errorf("Datagram too short")
+	}
+	if datagram[2] != 0 {
+		return "", nil, fmt.Errorf("Fragmented datagrams not supported")
+	}
+	r := bytes.NewReader(datagram[3:])
+	addr, err := readAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, datagram[len(datagram)-r.Len():], nil
+}
+
+// buildDatagram builds a SOCKS5 UDP datagram with the given address and
+// payload
+func buildDatagram(addr string, payload []byte) ([]byte, error) {
+	datagram, err := appendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(datagram, payload...), nil
+}
+
+// handleUDPAssociate handles a UDP ASSOCIATE request whose client sends from
+// the given address.  As in RFC 1928 section 7, only datagrams from the
+// control connection's IP (and from the given port, unless it's 0) are
+// relayed.  The association lasts as long as the control connection stays
+// open.
+func handleUDPAssociate(conn net.Conn, addr string, dial func(addr string) (net.Conn, error)) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	clientPort := 0
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		clientPort, _ = strconv.Atoi(port)
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Errorf("Unable to listen for UDP: %s", err)
+		reply(conn, REP_GENERAL_FAILURE, "0.0.0.0:0")
+		return
+	}
+	defer pc.Close()
+
+	relay, err := dial(UDP_RELAY_ADDR)
+	if err != nil {
+		log.Errorf("Unable to dial UDP relay: %s", err)
+		reply(conn, REP_GENERAL_FAILURE, "0.0.0.0:0")
+		return
+	}
+	defer relay.Close()
+
+	if err := reply(conn, REP_SUCCEEDED, pc.LocalAddr().String()); err != nil {
+		return
+	}
+
+	// Client to relay
+	var clientAddr *net.UDPAddr
+	clientAddrs := make(chan *net.UDPAddr, 1)
+	go func() {
+		b := make([]byte, MAX_DATAGRAM)
+		for {
+			n, from, err := pc.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if !from.IP.Equal(clientIP) || clientPort != 0 && from.Port != clientPort {
+				log.Debugf("Dropping UDP datagram from %s, not the client", from)
+				continue
+			}
+			if clientAddr == nil {
+				// The first sender becomes the client for this association
+				clientAddr = from
+				clientAddrs <- from
+			} else if !from.IP.Equal(clientAddr.IP) || from.Port != clientAddr.Port {
+				continue
+			}
+			if _, _, err := parseDatagram(b[:n]); err != nil {
+				log.Debugf("Dropping UDP datagram: %s", err)
+				continue
+			}
+			if err := writeFrame(relay, b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Relay to client, once we know who the client is
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		var to *net.UDPAddr
+		select {
+		case to = <-clientAddrs:
+		case <-done:
+			return
+		}
+		for {
+			datagram, err := readFrame(relay)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(datagram, to)
+		}
+	}()
+
+	// Wait for control connection to close
+	io.Copy(ioutil.Discard, conn)
+}
+
+// NewUDPRelayConn returns a net.Conn for use on the server in place of a
+// connection to UDP_RELAY_ADDR.  Datagrams written to it by the tunnel are
+// forwarded to their destinations, and responses are framed and read back
+// into the tunnel.  checkDestination resolves the destination host and
+// returns an error if the server shouldn't send to it.
+func NewUDPRelayConn(checkDestination func(host string) (net.IP, error)) (net.Conn, error) {
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for UDP: %s", err)
+	}
+	local, remote := net.Pipe()
+	lastActive := time.Now().UnixNano()
+	go forwardToDestinations(remote, pc, checkDestination, &lastActive)
+	go forwardFromDestinations(remote, pc, &lastActive)
+	return local, nil
+}
+
+// forwardToDestinations forwards datagrams from the tunnel, recording when it
+// last did in lastActive (UnixNano)
+func forwardToDestinations(tunnel net.Conn, pc *net.UDPConn, checkDestination func(host string) (net.IP, error), lastActive *int64) {
+	defer pc.Close()
+	defer tunnel.Close()
+	for {
+		datagram, err := readFrame(tunnel)
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(lastActive, time.Now().UnixNano())
+		addr, payload, err := parseDatagram(datagram)
+		if err != nil {
+			log.Debugf("Dropping UDP datagram: %s", err)
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip, err := checkDestination(host)
+		if err != nil {
+			continue
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			continue
+		}
+		pc.WriteToUDP(payload, udpAddr)
+	}
+}
+
+// forwardFromDestinations forwards datagrams from destinations into the
+// tunnel until there's been no traffic in either direction (see lastActive)
+// for UDP_IDLE_TIMEOUT
+func forwardFromDestinations(tunnel net.Conn, pc *net.UDPConn, lastActive *int64) {
+	defer pc.Close()
+	defer tunnel.Close()
+	b := make([]byte, MAX_DATAGRAM)
+	for {
+		pc.SetReadDeadline(time.Unix(0, atomic.LoadInt64(lastActive)).Add(UDP_IDLE_TIMEOUT))
+		n, from, err := pc.ReadFromUDP(b)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+				time.Now().Sub(time.Unix(0, atomic.LoadInt64(lastActive))) < UDP_IDLE_TIMEOUT {
+				// Datagrams went out in the meantime
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(lastActive, time.Now().UnixNano())
+		datagram, err := buildDatagram(from.String(), b[:n])
+		if err != nil {
+			continue
+		}
+		if err := writeFrame(tunnel, datagram); err != nil {
+			return
+		}
+	}
+}
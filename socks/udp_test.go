@@ -0,0 +1,160 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	for _, addr := range []string{"8.8.8.8:53", "[2001:db8::1]:443", "example.com:123"} {
+		datagram, err := buildDatagram(addr, []byte("payload"))
+		if err != nil {
+			t.Fatalf("Unable to build datagram for %s: %s", addr, err)
+		}
+		buf := &bytes.Buffer{}
+		if err := writeFrame(buf, datagram); err != nil {
+			t.Fatalf("Unable to write frame: %s", err)
+		}
+		framed, err := readFrame(buf)
+		if err != nil {
+			t.Fatalf("Unable to read frame: %s", err)
+		}
+		parsedAddr, payload, err := parseDatagram(framed)
+		if err != nil {
+			t.Fatalf("Unable to parse datagram for %s: %s", addr, err)
+		}
+		if parsedAddr != addr {
+			t.Errorf("Expected address %s, got %s", addr, parsedAddr)
+		}
+		if string(payload) != "payload" {
+			t.Errorf("Wrong payload: %s", payload)
+		}
+	}
+}
+
+func TestFragmentedDatagramRejected(t *testing.T) {
+	datagram, _ := buildDatagram("8.8.8.8:53", []byte("payload"))
+	datagram[2] = 1
+	if _, _, err := parseDatagram(datagram); err == nil {
+		t.Errorf("Fragmented datagram should have been rejected")
+	}
+}
+
+func TestUDPAssociateWithoutDatagrams(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	before := runtime.NumGoroutine()
+	finished := make(chan bool)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		handleUDPAssociate(conn, "0.0.0.0:0", func(addr string) (net.Conn, error) {
+			relay, _ := net.Pipe()
+			return relay, nil
+		})
+		conn.Close()
+		close(finished)
+	}()
+
+	control, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(control, header); err != nil || header[1] != REP_SUCCEEDED {
+		t.Fatalf("Expected successful reply, got %v: %s", header, err)
+	}
+	control.Close()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Association should end with the control connection")
+	}
+
+	// The association's goroutines shouldn't wait for a client that never
+	// sent anything
+	after := runtime.NumGoroutine()
+	for i := 0; i < 50 && after > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		t.Errorf("Expected %d goroutines after the association ended, got %d", before, after)
+	}
+}
+
+func TestUDPAssociateDropsOtherSources(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	relay, tunnel := net.Pipe()
+	defer tunnel.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handleUDPAssociate(conn, client.LocalAddr().String(), func(addr string) (net.Conn, error) {
+			return relay, nil
+		})
+	}()
+
+	control, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(control, header); err != nil || header[1] != REP_SUCCEEDED {
+		t.Fatalf("Expected successful reply, got %v: %s", header, err)
+	}
+	bound, err := readAddr(control)
+	if err != nil {
+		t.Fatalf("Unable to read bound address: %s", err)
+	}
+	boundAddr, _ := net.ResolveUDPAddr("udp", bound)
+
+	spoofed, _ := buildDatagram("8.8.8.8:53", []byte("spoofed"))
+	if _, err := other.WriteToUDP(spoofed, boundAddr); err != nil {
+		t.Fatal(err)
+	}
+	// Give the spoofed datagram a head start, so that it would be relayed
+	// first if it weren't dropped
+	time.Sleep(50 * time.Millisecond)
+	legit, _ := buildDatagram("8.8.8.8:53", []byte("legit"))
+	if _, err := client.WriteToUDP(legit, boundAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel.SetReadDeadline(time.Now().Add(2 * time.Second))
+	datagram, err := readFrame(tunnel)
+	if err != nil {
+		t.Fatalf("Unable to read relayed datagram: %s", err)
+	}
+	if _, payload, _ := parseDatagram(datagram); string(payload) != "legit" {
+		t.Errorf("Only the client's datagram should have been relayed, got %s", payload)
+	}
+}
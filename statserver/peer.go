@@ -1,15 +1,11 @@
 package statserver
 
 import (
-	"encoding/json"
-	"fmt"
-	"net/http"
 	"sync/atomic"
 	"time"
-)
 
-const (
-	GEOSERVE_URL_TEMPLATE = "http://go-geoserve.herokuapp.com/lookup/%s"
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/geolookup"
 )
 
 var (
@@ -34,84 +30,6 @@ type Peer struct {
 	lastReported    time.Time
 }
 
-// The City structure corresponds to the data in the GeoIP2/GeoLite2 City
-// databases.
-type City struct {
-	City struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"city"`
-	Continent struct {
-		Code      string            `maxminddb:"code"`
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"continent"`
-	Country struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		IsoCode   string            `maxminddb:"iso_code"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"country"`
-	Location struct {
-		Latitude  float64 `maxminddb:"latitude"`
-		Longitude float64 `maxminddb:"longitude"`
-		MetroCode uint    `maxminddb:"metro_code"`
-		TimeZone  string  `maxminddb:"time_zone"`
-	} `maxminddb:"location"`
-	Postal struct {
-		Code string `maxminddb:"code"`
-	} `maxminddb:"postal"`
-	RegisteredCountry struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		IsoCode   string            `maxminddb:"iso_code"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"registered_country"`
-	RepresentedCountry struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		IsoCode   string            `maxminddb:"iso_code"`
-		Names     map[string]string `maxminddb:"names"`
-		Type      string            `maxminddb:"type"`
-	} `maxminddb:"represented_country"`
-	Subdivisions []struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		IsoCode   string            `maxminddb:"iso_code"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"subdivisions"`
-	Traits struct {
-		IsAnonymousProxy    bool `maxminddb:"is_anonymous_proxy"`
-		IsSatelliteProvider bool `maxminddb:"is_satellite_provider"`
-	} `maxminddb:"traits"`
-}
-
-// The Country structure corresponds to the data in the GeoIP2/GeoLite2
-// Country databases.
-type Country struct {
-	Continent struct {
-		Code      string            `maxminddb:"code"`
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"continent"`
-	Country struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		IsoCode   string            `maxminddb:"iso_code"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"country"`
-	RegisteredCountry struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		IsoCode   string            `maxminddb:"iso_code"`
-		Names     map[string]string `maxminddb:"names"`
-	} `maxminddb:"registered_country"`
-	RepresentedCountry struct {
-		GeoNameID uint              `maxminddb:"geoname_id"`
-		IsoCode   string            `maxminddb:"iso_code"`
-		Names     map[string]string `maxminddb:"names"`
-		Type      string            `maxminddb:"type"`
-	} `maxminddb:"represented_country"`
-	Traits struct {
-		IsAnonymousProxy    bool `maxminddb:"is_anonymous_proxy"`
-		IsSatelliteProvider bool `maxminddb:"is_satellite_provider"`
-	} `maxminddb:"traits"`
-}
-
 // publish is a function to which a peer can publish itself
 type publish func(peer *Peer)
 
@@ -140,13 +58,7 @@ func (peer *Peer) run() error {
 }
 
 func (peer *Peer) geolocate() error {
-	resp, err := http.Get(fmt.Sprintf(GEOSERVE_URL_TEMPLATE, peer.IP))
-	if err != nil {
-		return err
-	}
-	decoder := json.NewDecoder(resp.Body)
-	geodata := &City{}
-	err = decoder.Decode(geodata)
+	geodata, err := geolookup.LookupCity(peer.IP)
 	if err != nil {
 		return err
 	}
@@ -157,6 +69,7 @@ func (peer *Peer) geolocate() error {
 }
 
 func (peer *Peer) publishPeriodically() {
+	defer crash.Recover()
 	for {
 		time.Sleep(publishInterval)
 		// Only report if there's been activity
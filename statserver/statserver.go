@@ -6,7 +6,11 @@ import (
 	"sync"
 
 	"github.com/getlantern/eventsource"
+	"github.com/getlantern/flashlight/accounting"
 	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/reputation"
+	"github.com/getlantern/flashlight/resources"
+	"github.com/getlantern/flashlight/tenants"
 )
 
 // Server provides an SSE server that publishes stat updates for peers.
@@ -122,6 +126,78 @@ func (server *Server) onPeerUpdate(peer *Peer) {
 	server.pushUpdate(update)
 }
 
+// OnReputation publishes the given reputation report
+func (server *Server) OnReputation(report *reputation.Report) {
+	update, err := json.Marshal(&Update{
+		Type: "reputation",
+		Data: report,
+	})
+	if err != nil {
+		log.Errorf("Unable to marshal reputation update: %s", err)
+		return
+	}
+	server.pushUpdate(update)
+}
+
+// OnTenantUsage publishes the given tenant's usage
+func (server *Server) OnTenantUsage(usage *tenants.Usage) {
+	update, err := json.Marshal(&Update{
+		Type: "tenant",
+		Data: usage,
+	})
+	if err != nil {
+		log.Errorf("Unable to marshal tenant update: %s", err)
+		return
+	}
+	server.pushUpdate(update)
+}
+
+// OnBandwidth publishes the given bandwidth totals per client
+func (server *Server) OnBandwidth(totals []*accounting.Total) {
+	update, err := json.Marshal(&Update{
+		Type: "bandwidth",
+		Data: totals,
+	})
+	if err != nil {
+		log.Errorf("Unable to marshal bandwidth update: %s", err)
+		return
+	}
+	server.pushUpdate(update)
+}
+
+// OnResources publishes the given resource usage of the server itself
+func (server *Server) OnResources(usage *resources.Usage) {
+	update, err := json.Marshal(&Update{
+		Type: "resources",
+		Data: usage,
+	})
+	if err != nil {
+		log.Errorf("Unable to marshal resources update: %s", err)
+		return
+	}
+	server.pushUpdate(update)
+}
+
+// OriginStats are statistics about the reuse of connections to origins
+type OriginStats struct {
+	Requests  int64   `json:"requests"`  // requests sent to origins
+	Dials     int64   `json:"dials"`     // connections dialed to origins
+	ReuseRate float64 `json:"reuserate"` // share of requests that reused a connection
+}
+
+// OnOriginStats publishes the given statistics about origin connections
+func (server *Server) OnOriginStats(stats *OriginStats) {
+	update, err := json.Marshal(&Update{
+		Type: "origins",
+		Data: stats,
+	})
+	if err != nil {
+		log.Errorf("Unable to marshal origins update: %s", err)
+		return
+	}
+	server.pushUpdate(update)
+}
+
 func (server *Server) pushUpdate(update []byte) {
 	server.clientsMutex.Lock()
 	defer server.clientsMutex.Unlock()
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// Capped is a set of documents in a Store, named with a common prefix, whose
+// total size on disk is capped.  When saving takes them over MaxBytes, the
+// least recently saved ones are deleted.
+type Capped struct {
+	Store    *Store
+	Prefix   string // prefix of the documents' names
+	MaxBytes int64
+
+	sizes      map[string]int64 // sizes of the documents by name, loaded on first use
+	totalBytes int64
+	mutex      sync.Mutex
+}
+
+// Save saves the given value under the given name (which starts with our
+// Prefix), evicting the least recently saved documents if that takes us over
+// MaxBytes
+func (capped *Capped) Save(name string, v interface{}) error {
+	size, err := capped.Store.save(name, v)
+	if err != nil {
+		return err
+	}
+	capped.mutex.Lock()
+	defer capped.mutex.Unlock()
+	if capped.sizes == nil {
+		capped.loadSizes()
+	}
+	capped.totalBytes += size - capped.sizes[name]
+	capped.sizes[name] = size
+	if capped.totalBytes > capped.MaxBytes {
+		capped.evict()
+	}
+	return nil
+}
+
+// Purge deletes all of the documents
+func (capped *Capped) Purge() error {
+	infos, err := capped.Store.List(capped.Prefix)
+	if err != nil {
+		return err
+	}
+	capped.mutex.Lock()
+	defer capped.mutex.Unlock()
+	for _, info := range infos {
+		if err := capped.Store.Delete(info.Name); err != nil {
+			return err
+		}
+	}
+	capped.sizes = nil
+	capped.totalBytes = 0
+	return nil
+}
+
+// TotalBytes returns the total size of the documents on disk
+func (capped *Capped) TotalBytes() int64 {
+	capped.mutex.Lock()
+	defer capped.mutex.Unlock()
+	if capped.sizes == nil {
+		capped.loadSizes()
+	}
+	return capped.totalBytes
+}
+
+// loadSizes loads the sizes of the documents already in the Store
+func (capped *Capped) loadSizes() {
+	capped.sizes = make(map[string]int64)
+	capped.totalBytes = 0
+	infos, err := capped.Store.List(capped.Prefix)
+	if err != nil {
+		log.Errorf("Unable to list %s documents: %s", capped.Prefix, err)
+		return
+	}
+	for _, info := range infos {
+		capped.sizes[info.Name] = info.Size
+		capped.totalBytes += info.Size
+	}
+}
+
+// evict deletes the least recently saved documents until we're down to 90% of
+// MaxBytes, so that we don't evict on every save
+func (capped *Capped) evict() {
+	infos, err := capped.Store.List(capped.Prefix)
+	if err != nil {
+		log.Errorf("Unable to list %s documents: %s", capped.Prefix, err)
+		return
+	}
+	sort.Sort(byModified(infos))
+	target := capped.MaxBytes * 9 / 10
+	for _, info := range infos {
+		if capped.totalBytes <= target {
+			break
+		}
+		if err := capped.Store.Delete(info.Name); err != nil {
+			log.Errorf("Unable to evict %s: %s", info.Name, err)
+			continue
+		}
+		capped.totalBytes -= capped.sizes[info.Name]
+		delete(capped.sizes, info.Name)
+	}
+}
+
+// byModified sorts Infos from least to most recently modified
+type byModified []*Info
+
+func (infos byModified) Len() int           { return len(infos) }
+func (infos byModified) Swap(i, j int)      { infos[i], infos[j] = infos[j], infos[i] }
+func (infos byModified) Less(i, j int) bool { return infos[i].Modified.Before(infos[j].Modified) }
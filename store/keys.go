@@ -0,0 +1,61 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	KEYSTORE_SERVICE = "flashlight" // service under which the passphrase is kept in the OS's keystore
+	KEYSTORE_ACCOUNT = "store"      // account under which the passphrase is kept in the OS's keystore
+	KEYSTORE_SOURCE  = "keystore"   // source for Passphrase that uses the OS's keystore
+	FILE_PREFIX      = "file:"      // prefix of sources for Passphrase that read a file
+	ENV_PREFIX       = "env:"       // prefix of sources for Passphrase that read an environment variable
+	GENERATED_LENGTH = KEY_LENGTH   // bytes of randomness in passphrases that we generate for the keystore
+)
+
+// Passphrase returns the passphrase for a Store from the given source, so that
+// it doesn't have to be given on the command line, where other users can see
+// it.  dir is where the keystore may keep a file.  Sources are:
+//
+//	file:<path>  the contents of a file (trailing whitespace is ignored), e.g. a secret mounted by an orchestrator
+//	env:<name>   the value of an environment variable
+//	keystore     a random passphrase generated on first use and kept in the OS's keystore: the Keychain on macOS, the Secret Service (e.g. GNOME Keyring) on Linux via secret-tool, and a DPAPI-protected file in dir on Windows, which only the current user can decrypt
+func Passphrase(source string, dir string) (string, error) {
+	var passphrase string
+	switch {
+	case strings.HasPrefix(source, FILE_PREFIX):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(source, FILE_PREFIX))
+		if err != nil {
+			return "", fmt.Errorf("Unable to read store passphrase: %s", err)
+		}
+		passphrase = strings.TrimRight(string(data), " \t\r\n")
+	case strings.HasPrefix(source, ENV_PREFIX):
+		passphrase = os.Getenv(strings.TrimPrefix(source, ENV_PREFIX))
+	case source == KEYSTORE_SOURCE:
+		var err error
+		passphrase, err = keystorePassphrase(dir)
+		if err != nil {
+			return "", fmt.Errorf("Unable to get store passphrase from the OS keystore: %s", err)
+		}
+	default:
+		return "", fmt.Errorf("Unknown store passphrase source %s, use file:<path>, env:<name> or keystore", source)
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("Store passphrase from %s is empty", source)
+	}
+	return passphrase, nil
+}
+
+// generatePassphrase generates a random passphrase for the keystore
+func generatePassphrase() (string, error) {
+	b := make([]byte, GENERATED_LENGTH)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to generate passphrase: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
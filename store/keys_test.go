@@ -0,0 +1,45 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPassphraseSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(filename, []byte("from file\n"), 0600); err != nil {
+		t.Fatalf("Unable to write key file: %s", err)
+	}
+	os.Setenv("FLASHLIGHT_TEST_STORE_KEY", "from env")
+	defer os.Unsetenv("FLASHLIGHT_TEST_STORE_KEY")
+
+	for source, expected := range map[string]string{
+		"file:" + filename:              "from file",
+		"env:FLASHLIGHT_TEST_STORE_KEY": "from env",
+	} {
+		passphrase, err := Passphrase(source, dir)
+		if err != nil {
+			t.Errorf("Unable to get passphrase from %s: %s", source, err)
+		} else if passphrase != expected {
+			t.Errorf("Wrong passphrase from %s: %s", source, passphrase)
+		}
+	}
+
+	for _, source := range []string{
+		"file:" + filepath.Join(dir, "missing"),
+		"env:FLASHLIGHT_TEST_UNSET_STORE_KEY",
+		"plaintext",
+	} {
+		if _, err := Passphrase(source, dir); err == nil {
+			t.Errorf("Expected error from %s", source)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keystorePassphrase gets our passphrase from the Keychain, generating and
+// adding one if there isn't one yet.  It's added through security's
+// interactive mode so that it doesn't show up in our arguments.
+func keystorePassphrase(dir string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", KEYSTORE_SERVICE, "-a", KEYSTORE_ACCOUNT, "-w").Output()
+	if err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+	passphrase, err := generatePassphrase()
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -s %s -a %s -w %s\n", KEYSTORE_SERVICE, KEYSTORE_ACCOUNT, passphrase))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil || stderr.Len() > 0 {
+		return "", fmt.Errorf("Unable to add passphrase to the Keychain: %v %s", err, stderr.String())
+	}
+	return passphrase, nil
+}
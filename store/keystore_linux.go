@@ -0,0 +1,31 @@
+package store
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keystorePassphrase gets our passphrase from the Secret Service with
+// secret-tool, generating and storing one if there isn't one yet.  secret-tool
+// reads the passphrase to store from stdin, so it doesn't show up in our
+// arguments.
+func keystorePassphrase(dir string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", KEYSTORE_SERVICE, "account", KEYSTORE_ACCOUNT).Output()
+	if err == nil && len(out) > 0 {
+		return strings.TrimSpace(string(out)), nil
+	}
+	if _, lookErr := exec.LookPath("secret-tool"); lookErr != nil {
+		return "", fmt.Errorf("secret-tool (libsecret) is required: %s", lookErr)
+	}
+	passphrase, err := generatePassphrase()
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("secret-tool", "store", "--label=flashlight store", "service", KEYSTORE_SERVICE, "account", KEYSTORE_ACCOUNT)
+	cmd.Stdin = strings.NewReader(passphrase)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("Unable to store passphrase with secret-tool: %s %s", err, out)
+	}
+	return passphrase, nil
+}
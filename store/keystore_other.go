@@ -0,0 +1,14 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package store
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// keystorePassphrase isn't supported on this platform
+func keystorePassphrase(dir string) (string, error) {
+	return "", fmt.Errorf("No OS keystore supported on %s, use file:<path> or env:<name>", runtime.GOOS)
+}
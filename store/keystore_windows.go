@@ -0,0 +1,84 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	DPAPI_FILE = "store.dpapi" // in the store's dir, holds the passphrase protected with DPAPI
+
+	cryptprotectUIForbidden = 0x1
+)
+
+var (
+	crypt32                = syscall.NewLazyDLL("crypt32.dll")
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procCryptProtectData   = crypt32.NewProc("CryptProtectData")
+	procCryptUnprotectData = crypt32.NewProc("CryptUnprotectData")
+	procLocalFree          = kernel32.NewProc("LocalFree")
+)
+
+type dataBlob struct {
+	size uint32
+	data *byte
+}
+
+func newBlob(b []byte) *dataBlob {
+	if len(b) == 0 {
+		return &dataBlob{}
+	}
+	return &dataBlob{size: uint32(len(b)), data: &b[0]}
+}
+
+func (blob *dataBlob) bytes() []byte {
+	b := make([]byte, blob.size)
+	copy(b, (*[1 << 30]byte)(unsafe.Pointer(blob.data))[:blob.size:blob.size])
+	return b
+}
+
+// keystorePassphrase gets our passphrase from the DPAPI_FILE, which only the
+// current user can decrypt, generating and protecting one if there isn't one
+// yet
+func keystorePassphrase(dir string) (string, error) {
+	filename := filepath.Join(dir, DPAPI_FILE)
+	protected, err := ioutil.ReadFile(filename)
+	if err == nil {
+		passphrase, err := dpapi(procCryptUnprotectData, protected)
+		if err != nil {
+			return "", fmt.Errorf("Unable to unprotect %s: %s", filename, err)
+		}
+		return string(passphrase), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("Unable to read %s: %s", filename, err)
+	}
+	passphrase, err := generatePassphrase()
+	if err != nil {
+		return "", err
+	}
+	protected, err = dpapi(procCryptProtectData, []byte(passphrase))
+	if err != nil {
+		return "", fmt.Errorf("Unable to protect passphrase: %s", err)
+	}
+	if err := ioutil.WriteFile(filename, protected, 0600); err != nil {
+		return "", fmt.Errorf("Unable to write %s: %s", filename, err)
+	}
+	return passphrase, nil
+}
+
+// dpapi runs data through CryptProtectData or CryptUnprotectData, which take
+// the same arguments
+func dpapi(proc *syscall.LazyProc, data []byte) ([]byte, error) {
+	var out dataBlob
+	r, _, err := proc.Call(uintptr(unsafe.Pointer(newBlob(data))), 0, 0, 0, 0, cryptprotectUIForbidden, uintptr(unsafe.Pointer(&out)))
+	if r == 0 {
+		return nil, err
+	}
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(out.data)))
+	return out.bytes(), nil
+}
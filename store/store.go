@@ -0,0 +1,197 @@
+// package store persists small JSON documents (stats, history and the like)
+// under flashlight's configDir.  If a passphrase is given, documents are
+// encrypted at rest with AES-256-GCM under a key derived from the passphrase,
+// so that a seized device doesn't reveal browsing destinations.
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	SALT_FILE         = "store.salt"
+	SALT_LENGTH       = 32
+	KEY_LENGTH        = 32
+	PBKDF2_ITERATIONS = 100000
+)
+
+var (
+	// ENCRYPTED_MAGIC prefixes encrypted documents
+	ENCRYPTED_MAGIC = []byte("FLENC1")
+)
+
+// Store is a directory of JSON documents
+type Store struct {
+	Dir  string
+	aead cipher.AEAD
+}
+
+// New creates a Store in the given directory.  If passphrase is non-empty,
+// documents are encrypted at rest.
+func New(dir string, passphrase string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create store directory %s: %s", dir, err)
+	}
+	store := &Store{Dir: dir}
+	if passphrase == "" {
+		return store, nil
+	}
+
+	salt, err := store.salt()
+	if err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key([]byte(passphrase), salt, PBKDF2_ITERATIONS, KEY_LENGTH, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err)
+	}
+	store.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create GCM: %s", err)
+	}
+	return store, nil
+}
+
+// IsEncrypted indicates whether this store encrypts documents at rest
+func (store *Store) IsEncrypted() bool {
+	return store.aead != nil
+}
+
+// Save saves the given value as JSON under the given name, replacing the
+// existing document atomically.
+func (store *Store) Save(name string, v interface{}) error {
+	_, err := store.save(name, v)
+	return err
+}
+
+// save is Save, also returning the size of the document on disk (as in its
+// Info)
+func (store *Store) save(name string, v interface{}) (int64, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to marshal %s: %s", name, err)
+	}
+	if store.IsEncrypted() {
+		nonce := make([]byte, store.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, fmt.Errorf("Unable to generate nonce: %s", err)
+		}
+		sealed := append([]byte{}, ENCRYPTED_MAGIC...)
+		sealed = append(sealed, nonce...)
+		data = store.aead.Seal(sealed, nonce, data, []byte(name))
+	}
+
+	filename := store.path(name)
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0600); err != nil {
+		return 0, fmt.Errorf("Unable to write %s: %s", tmpFilename, err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return 0, fmt.Errorf("Unable to move %s into place: %s", tmpFilename, err)
+	}
+	return int64(len(data)), nil
+}
+
+// Load loads the JSON document with the given name into v.  If the document
+// doesn't exist, the returned error satisfies os.IsNotExist.  Unencrypted
+// documents (e.g. from before encryption was enabled) are loaded as-is and will
+// be encrypted the next time that they're saved.
+func (store *Store) Load(name string, v interface{}) error {
+	data, err := ioutil.ReadFile(store.path(name))
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, ENCRYPTED_MAGIC) {
+		if !store.IsEncrypted() {
+			return fmt.Errorf("%s is encrypted but no passphrase was given", name)
+		}
+		data = data[len(ENCRYPTED_MAGIC):]
+		nonceSize := store.aead.NonceSize()
+		if len(data) < nonceSize {
+			return fmt.Errorf("%s is truncated", name)
+		}
+		data, err = store.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(name))
+		if err != nil {
+			return fmt.Errorf("Unable to decrypt %s, wrong passphrase?", name)
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Unable to unmarshal %s: %s", name, err)
+	}
+	return nil
+}
+
+// Info describes a document in the Store
+type Info struct {
+	Name     string
+	Size     int64 // size on disk in bytes
+	Modified time.Time
+}
+
+// List lists the documents whose names start with the given prefix
+func (store *Store) List(prefix string) ([]*Info, error) {
+	files, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list store directory %s: %s", store.Dir, err)
+	}
+	var infos []*Info
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		infos = append(infos, &Info{
+			Name:     strings.TrimSuffix(name, ".json"),
+			Size:     file.Size(),
+			Modified: file.ModTime(),
+		})
+	}
+	return infos, nil
+}
+
+// Delete deletes the document with the given name, if it exists
+func (store *Store) Delete(name string) error {
+	err := os.Remove(store.path(name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to delete %s: %s", name, err)
+	}
+	return nil
+}
+
+func (store *Store) path(name string) string {
+	return filepath.Join(store.Dir, name+".json")
+}
+
+// salt returns the salt for key derivation, creating it if necessary
+func (store *Store) salt() ([]byte, error) {
+	filename := filepath.Join(store.Dir, SALT_FILE)
+	salt, err := ioutil.ReadFile(filename)
+	if err == nil {
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to read salt: %s", err)
+	}
+	salt = make([]byte, SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("Unable to generate salt: %s", err)
+	}
+	if err := ioutil.WriteFile(filename, salt, 0600); err != nil {
+		return nil, fmt.Errorf("Unable to save salt: %s", err)
+	}
+	return salt, nil
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type doc struct {
+	Destination string
+	Bytes       int64
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, "secret")
+	if err != nil {
+		t.Fatalf("Unable to create store: %s", err)
+	}
+	if err := s.Save("stats", &doc{"example.com", 5}); err != nil {
+		t.Fatalf("Unable to save: %s", err)
+	}
+
+	raw, _ := ioutil.ReadFile(s.path("stats"))
+	if string(raw[:len(ENCRYPTED_MAGIC)]) != string(ENCRYPTED_MAGIC) {
+		t.Errorf("Document not encrypted on disk")
+	}
+
+	s2, _ := New(dir, "secret")
+	loaded := &doc{}
+	if err := s2.Load("stats", loaded); err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+	if loaded.Destination != "example.com" || loaded.Bytes != 5 {
+		t.Errorf("Loaded wrong document: %v", loaded)
+	}
+
+	s3, _ := New(dir, "wrong")
+	if err := s3.Load("stats", loaded); err == nil {
+		t.Errorf("Loading with wrong passphrase should have failed")
+	}
+}
+
+func TestCappedEvictsLeastRecentlySaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, "secret")
+	if err != nil {
+		t.Fatalf("Unable to create store: %s", err)
+	}
+	d := &doc{Destination: strings.Repeat("x", 1000)}
+	// One document saved before the Capped, which it should count
+	if err := s.Save("capped-0", d); err != nil {
+		t.Fatalf("Unable to save: %s", err)
+	}
+	infos, _ := s.List("capped-")
+	size := infos[0].Size
+	capped := &Capped{Store: s, Prefix: "capped-", MaxBytes: size*3 + size/2}
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("capped-%d", i)
+		if err := capped.Save(name, d); err != nil {
+			t.Fatalf("Unable to save: %s", err)
+		}
+		// Modification times are only so precise on some filesystems
+		os.Chtimes(s.path(name), time.Now(), time.Now().Add(time.Duration(i-4)*time.Minute))
+	}
+
+	if err := s.Load("capped-0", &doc{}); !os.IsNotExist(err) {
+		t.Errorf("Least recently saved document should have been evicted: %v", err)
+	}
+	infos, _ = s.List("capped-")
+	if len(infos) != 3 {
+		t.Errorf("Expected 3 documents kept, got %d", len(infos))
+	}
+	if total := capped.TotalBytes(); total != size*3 {
+		t.Errorf("Expected %d bytes counted, got %d", size*3, total)
+	}
+}
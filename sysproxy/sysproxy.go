@@ -0,0 +1,49 @@
+// package sysproxy configures flashlight as the operating system's HTTP and
+// HTTPS proxy, so that browsers and other apps that honor the system settings
+// use it without any manual configuration.  It supports Windows (WinINET),
+// macOS (networksetup) and GNOME on Linux (gsettings).
+package sysproxy
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Enable makes the proxy listening at addr the system's HTTP and HTTPS proxy.
+// It returns a function that restores the previous settings.
+func Enable(addr string) (restore func() error, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to split host and port of %s: %s", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		// Listening on all interfaces, point at the loopback one
+		host = "127.0.0.1"
+	}
+	return enable(host, port)
+}
+
+// Disable turns off the system's HTTP and HTTPS proxy if it's the proxy
+// listening at addr, e.g. one that Enable set before we were killed.  Settings
+// that point elsewhere are left alone.
+func Disable(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Unable to split host and port of %s: %s", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return disable(host, port)
+}
+
+// run runs the given command, returning its trimmed output
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Unable to run %s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
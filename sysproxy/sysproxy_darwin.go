@@ -0,0 +1,139 @@
+package sysproxy
+
+import (
+	"strings"
+)
+
+var (
+	// proxyKinds are the networksetup proxy kinds that we set, i.e. http and
+	// https
+	proxyKinds = []string{"webproxy", "securewebproxy"}
+)
+
+// proxySetting is a network service's setting for one kind of proxy
+type proxySetting struct {
+	service string
+	kind    string
+	enabled bool
+	server  string
+	port    string
+}
+
+// enable sets the http and https proxies for all enabled network services
+func enable(host string, port string) (func() error, error) {
+	services, err := networkServices()
+	if err != nil {
+		return nil, err
+	}
+
+	var prev []*proxySetting
+	restore := func() error {
+		var firstErr error
+		for _, setting := range prev {
+			if err := setting.apply(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	for _, service := range services {
+		for _, kind := range proxyKinds {
+			setting, err := getProxy(service, kind)
+			if err != nil {
+				restore()
+				return nil, err
+			}
+			prev = append(prev, setting)
+			ours := &proxySetting{service, kind, true, host, port}
+			if err := ours.apply(); err != nil {
+				restore()
+				return nil, err
+			}
+		}
+	}
+	return restore, nil
+}
+
+// disable turns off the http and https proxies of the enabled network services
+// that point at us
+func disable(host string, port string) error {
+	services, err := networkServices()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, service := range services {
+		for _, kind := range proxyKinds {
+			setting, err := getProxy(service, kind)
+			if err == nil && setting.enabled && setting.server == host && setting.port == port {
+				err = (&proxySetting{service: service, kind: kind}).apply()
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// networkServices lists the enabled network services.  Output looks like:
+//
+//	An asterisk (*) denotes that a network service is disabled.
+//	Wi-Fi
+//	*Thunderbolt Bridge
+func networkServices() ([]string, error) {
+	out, err := run("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for i, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if i == 0 || line == "" || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+// getProxy gets the current setting for the given service and kind.  Output
+// looks like:
+//
+//	Enabled: Yes
+//	Server: 127.0.0.1
+//	Port: 10080
+//	Authenticated Proxy Enabled: 0
+func getProxy(service string, kind string) (*proxySetting, error) {
+	out, err := run("networksetup", "-get"+kind, service)
+	if err != nil {
+		return nil, err
+	}
+	setting := &proxySetting{service: service, kind: kind}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "Enabled":
+			setting.enabled = value == "Yes"
+		case "Server":
+			setting.server = value
+		case "Port":
+			setting.port = value
+		}
+	}
+	return setting, nil
+}
+
+func (setting *proxySetting) apply() error {
+	if setting.enabled && setting.server != "" {
+		// Setting the proxy also turns it on
+		_, err := run("networksetup", "-set"+setting.kind, setting.service, setting.server, setting.port)
+		return err
+	}
+	_, err := run("networksetup", "-set"+setting.kind+"state", setting.service, "off")
+	return err
+}
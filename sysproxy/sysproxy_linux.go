@@ -0,0 +1,67 @@
+package sysproxy
+
+const (
+	GNOME_PROXY_SCHEMA = "org.gnome.system.proxy"
+)
+
+var (
+	// gnomeKeys are the schema/key pairs that we set.  Values are
+	// serialized GVariants, as used by gsettings.
+	gnomeKeys = [][2]string{
+		{GNOME_PROXY_SCHEMA, "mode"},
+		{GNOME_PROXY_SCHEMA + ".http", "host"},
+		{GNOME_PROXY_SCHEMA + ".http", "port"},
+		{GNOME_PROXY_SCHEMA + ".https", "host"},
+		{GNOME_PROXY_SCHEMA + ".https", "port"},
+	}
+)
+
+// enable sets the GNOME proxy settings using gsettings.  Other desktops
+// aren't supported.
+func enable(host string, port string) (func() error, error) {
+	prev := make([]string, len(gnomeKeys))
+	for i, key := range gnomeKeys {
+		value, err := run("gsettings", "get", key[0], key[1])
+		if err != nil {
+			return nil, err
+		}
+		prev[i] = value
+	}
+	restore := func() error {
+		return setAll(prev)
+	}
+
+	quotedHost := "'" + host + "'"
+	err := setAll([]string{"'manual'", quotedHost, port, quotedHost, port})
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// disable sets the GNOME proxy mode to none if the http proxy is ours
+func disable(host string, port string) error {
+	mode, err := run("gsettings", "get", GNOME_PROXY_SCHEMA, "mode")
+	if err != nil {
+		return err
+	}
+	httpHost, _ := run("gsettings", "get", GNOME_PROXY_SCHEMA+".http", "host")
+	httpPort, _ := run("gsettings", "get", GNOME_PROXY_SCHEMA+".http", "port")
+	if mode != "'manual'" || httpHost != "'"+host+"'" || httpPort != port {
+		return nil
+	}
+	_, err = run("gsettings", "set", GNOME_PROXY_SCHEMA, "mode", "'none'")
+	return err
+}
+
+// setAll sets the gnomeKeys to the given values
+func setAll(values []string) error {
+	var firstErr error
+	for i, key := range gnomeKeys {
+		if _, err := run("gsettings", "set", key[0], key[1], values[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package sysproxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func enable(host string, port string) (func() error, error) {
+	return nil, fmt.Errorf("Setting the system proxy is not supported on %s", runtime.GOOS)
+}
+
+func disable(host string, port string) error {
+	// We can't have set it
+	return nil
+}
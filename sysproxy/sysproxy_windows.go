@@ -0,0 +1,71 @@
+package sysproxy
+
+import (
+	"net"
+	"strings"
+)
+
+const (
+	INTERNET_SETTINGS = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+)
+
+// enable sets the WinINET proxy in the registry.  Note that apps that are
+// already running may not notice the change until they're restarted.
+func enable(host string, port string) (func() error, error) {
+	prevEnable, _ := queryValue("ProxyEnable")
+	prevServer, hadServer := queryValue("ProxyServer")
+
+	if err := addValue("ProxyServer", "REG_SZ", net.JoinHostPort(host, port)); err != nil {
+		return nil, err
+	}
+	if err := addValue("ProxyEnable", "REG_DWORD", "1"); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if prevEnable == "" {
+			prevEnable = "0"
+		}
+		if err := addValue("ProxyEnable", "REG_DWORD", prevEnable); err != nil {
+			return err
+		}
+		if hadServer {
+			return addValue("ProxyServer", "REG_SZ", prevServer)
+		}
+		_, err := run("reg", "delete", INTERNET_SETTINGS, "/v", "ProxyServer", "/f")
+		return err
+	}, nil
+}
+
+// disable turns off the WinINET proxy if it's ours
+func disable(host string, port string) error {
+	server, _ := queryValue("ProxyServer")
+	if server != net.JoinHostPort(host, port) {
+		return nil
+	}
+	return addValue("ProxyEnable", "REG_DWORD", "0")
+}
+
+// queryValue queries the named value under INTERNET_SETTINGS, returning false
+// if it doesn't exist.  Output looks like:
+//
+//	HKEY_CURRENT_USER\Software\...\Internet Settings
+//	    ProxyEnable    REG_DWORD    0x0
+func queryValue(name string) (string, bool) {
+	out, err := run("reg", "query", INTERNET_SETTINGS, "/v", name)
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == name {
+			return strings.Join(fields[2:], " "), true
+		}
+	}
+	return "", false
+}
+
+func addValue(name string, kind string, data string) error {
+	_, err := run("reg", "add", INTERNET_SETTINGS, "/v", name, "/t", kind, "/d", data, "/f")
+	return err
+}
@@ -0,0 +1,113 @@
+// package systemd integrates flashlight with systemd: it picks up sockets
+// passed by socket activation (see sd_listen_fds(3)) and tells systemd when
+// we're ready or stopping (see sd_notify(3)), for units of Type=notify.
+// Everything here does nothing when we weren't started by systemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	firstListenFD = 3 // SD_LISTEN_FDS_START
+)
+
+// Listeners returns the listeners passed to us by socket activation, if any.
+// It unsets the variables that passed them, so that they're only picked up
+// once and aren't passed on to our children.
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	var listeners []net.Listener
+	for fd := firstListenFD; fd < firstListenFD+n; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("Unable to use socket %d passed by systemd: %s", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Ready tells systemd that we're up.  It also tells it that we're its main
+// process, since we may have been started by a previous process handing off
+// its listeners (which needs NotifyAccess=all).
+func Ready() error {
+	return Notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+}
+
+// Stopping tells systemd that we're shutting down
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// Notify sends the given state to systemd, if it's waiting for notifications
+// from us
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Unable to connect to systemd's notify socket: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("Unable to notify systemd: %s", err)
+	}
+	return nil
+}
+
+// SameAddr indicates whether a listener at actual (like [::]:443) serves the
+// requested address (like :443), which it does if the ports are the same and
+// the IPs are the same or both unspecified
+func SameAddr(requested string, actual string) bool {
+	rhost, rport, err := net.SplitHostPort(requested)
+	if err != nil {
+		return false
+	}
+	ahost, aport, err := net.SplitHostPort(actual)
+	if err != nil || rport != aport {
+		return false
+	}
+	rip, aip := net.ParseIP(rhost), net.ParseIP(ahost)
+	if rhost == "" || (rip != nil && rip.IsUnspecified()) {
+		return ahost == "" || (aip != nil && aip.IsUnspecified())
+	}
+	if rip == nil {
+		// A hostname, e.g. localhost
+		ips, err := net.LookupIP(rhost)
+		if err != nil {
+			return false
+		}
+		for _, ip := range ips {
+			if ip.Equal(aip) {
+				return true
+			}
+		}
+		return false
+	}
+	return rip.Equal(aip)
+}
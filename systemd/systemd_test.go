@@ -0,0 +1,70 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := Ready(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if expected := "READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()); err != nil || string(buf[:n]) != expected {
+		t.Errorf("Expected %q, got %q: %v", expected, buf[:n], err)
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Stopping(); err != nil {
+		t.Errorf("Notifying shouldn't fail without systemd: %s", err)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if listeners, err := Listeners(); len(listeners) != 0 || err != nil {
+		t.Errorf("Sockets for another process shouldn't be used")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("LISTEN_FDS should have been unset")
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	for _, c := range []struct {
+		requested string
+		actual    string
+		same      bool
+	}{
+		{":443", "[::]:443", true},
+		{"0.0.0.0:443", "[::]:443", true},
+		{"127.0.0.1:8787", "127.0.0.1:8787", true},
+		{"localhost:8787", "127.0.0.1:8787", true},
+		{":443", "127.0.0.1:443", false},
+		{"127.0.0.1:8787", "127.0.0.1:8788", false},
+	} {
+		if SameAddr(c.requested, c.actual) != c.same {
+			t.Errorf("SameAddr(%s, %s) should be %v", c.requested, c.actual, c.same)
+		}
+	}
+}
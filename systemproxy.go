@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/getlantern/flashlight/sysproxy"
+)
+
+var (
+	// restoreSystemProxy restores the system proxy settings from before we
+	// became the system proxy, nil if we aren't
+	restoreSystemProxy func() error
+	systemProxyMutex   sync.Mutex
+)
+
+// enableSystemProxy makes our client the system proxy (see -setsystemproxy)
+func enableSystemProxy() error {
+	systemProxyMutex.Lock()
+	defer systemProxyMutex.Unlock()
+	if restoreSystemProxy != nil {
+		return nil
+	}
+	restore, err := sysproxy.Enable(clientAddr())
+	if err != nil {
+		return err
+	}
+	restoreSystemProxy = restore
+	return nil
+}
+
+// disableSystemProxy restores the system proxy settings from before
+// enableSystemProxy.  Disabling it when it isn't enabled does nothing.
+func disableSystemProxy() error {
+	systemProxyMutex.Lock()
+	defer systemProxyMutex.Unlock()
+	if restoreSystemProxy == nil {
+		return nil
+	}
+	if err := restoreSystemProxy(); err != nil {
+		return err
+	}
+	restoreSystemProxy = nil
+	return nil
+}
+
+// isSystemProxy indicates whether our client is currently the system proxy
+func isSystemProxy() bool {
+	systemProxyMutex.Lock()
+	defer systemProxyMutex.Unlock()
+	return restoreSystemProxy != nil
+}
@@ -0,0 +1,243 @@
+// package tenants lets one server host several logical instances ("tenants"),
+// for example for different communities, isolated from each other.  Each
+// tenant has its own token, daily data cap, decoy site, egress policy and
+// usage accounting.
+//
+// Requests select their tenant by auth token (the X-Lantern-Tenant-Token
+// header, see -tenanttoken on the client) or by the server name (SNI) that
+// they arrived on.  Requests that select a tenant by server name but don't
+// carry its token are shown its decoy site, so that the server looks like an
+// ordinary website to anyone who probes it.
+//
+// Tenants are configured in a JSON file, for example:
+//
+//	[
+//	  {"name": "school", "hosts": ["school.example.org"], "token": "secret", "dailycap": 10737418240, "decoy": "https://www.example.org/"},
+//	  {"name": "ngo", "token": "hunter2", "egress": {"excludedCountries": ["XX"]}}
+//	]
+package tenants
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/egress"
+)
+
+const (
+	X_LANTERN_TENANT_TOKEN = "X-Lantern-Tenant-Token" // header carrying the tenant's token
+	DAY_FORMAT             = "2006-01-02"
+)
+
+// Tenant is a logical instance of the server
+type Tenant struct {
+	Name         string         `json:"name"`
+	Hosts        []string       `json:"hosts,omitempty"`    // (optional) server names (SNI) that select this tenant
+	Token        string         `json:"token,omitempty"`    // (optional) token that selects this tenant and that clients need to use it
+	DailyCap     int64          `json:"dailycap,omitempty"` // (optional) maximum bytes per day across all of the tenant's clients
+	Decoy        string         `json:"decoy,omitempty"`    // (optional) URL of the site to show to requests that don't authenticate
+	EgressPolicy *egress.Policy `json:"egress,omitempty"`   // (optional) restrictions on egress, instead of the server's
+
+	decoy      *httputil.ReverseProxy
+	usage      *Usage
+	usageMutex sync.Mutex
+}
+
+// Usage is a tenant's usage, which makes up its metrics
+type Usage struct {
+	Tenant      string `json:"tenant"`
+	Day         string `json:"day"`         // day (in local time) to which Bytes applies
+	Bytes       int64  `json:"bytes"`       // bytes transferred on Day
+	TotalBytes  int64  `json:"totalBytes"`  // bytes transferred since we started
+	Connections int64  `json:"connections"` // destination connections since we started
+}
+
+// Tenants is the set of tenants
+type Tenants struct {
+	Tenants []*Tenant
+
+	byHost map[string]*Tenant
+}
+
+// trackedConn is a net.Conn that accounts its traffic to a Tenant
+type trackedConn struct {
+	net.Conn
+	tenant *Tenant
+}
+
+// Load loads the Tenants from the JSON file at the given filename
+func Load(filename string) (*Tenants, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open tenants file %s: %s", filename, err)
+	}
+	defer file.Close()
+	tenants := &Tenants{byHost: make(map[string]*Tenant)}
+	err = json.NewDecoder(file).Decode(&tenants.Tenants)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse tenants file %s: %s", filename, err)
+	}
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, tenant := range tenants.Tenants {
+		if err := tenant.init(); err != nil {
+			return nil, err
+		}
+		if names[tenant.Name] {
+			return nil, fmt.Errorf("Duplicate tenant %s", tenant.Name)
+		}
+		names[tenant.Name] = true
+		if tenant.Token != "" {
+			if tokens[tenant.Token] {
+				return nil, fmt.Errorf("Tenant %s shares its token with another tenant", tenant.Name)
+			}
+			tokens[tenant.Token] = true
+		}
+		for _, host := range tenant.Hosts {
+			host = strings.ToLower(host)
+			if tenants.byHost[host] != nil {
+				return nil, fmt.Errorf("Host %s belongs to more than one tenant", host)
+			}
+			tenants.byHost[host] = tenant
+		}
+	}
+	return tenants, nil
+}
+
+// init validates the tenant and prepares its decoy
+func (tenant *Tenant) init() error {
+	if tenant.Name == "" {
+		return fmt.Errorf("Tenants need a name")
+	}
+	if tenant.Token == "" && len(tenant.Hosts) == 0 {
+		return fmt.Errorf("Tenant %s needs a token or hosts", tenant.Name)
+	}
+	tenant.usage = &Usage{Tenant: tenant.Name}
+	if tenant.Decoy != "" {
+		target, err := url.Parse(tenant.Decoy)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("Invalid decoy %s for tenant %s", tenant.Decoy, tenant.Name)
+		}
+		tenant.decoy = httputil.NewSingleHostReverseProxy(target)
+		director := tenant.decoy.Director
+		tenant.decoy.Director = func(req *http.Request) {
+			director(req)
+			req.Host = target.Host
+		}
+	}
+	return nil
+}
+
+// Select returns the tenant selected by the given request's token or, failing
+// that, its server name.  authenticated indicates whether the request may use
+// the tenant, which it may if it carries the tenant's token or the tenant has
+// none.  It returns nil if the request selects no tenant.
+func (tenants *Tenants) Select(req *http.Request) (tenant *Tenant, authenticated bool) {
+	token := req.Header.Get(X_LANTERN_TENANT_TOKEN)
+	if token != "" {
+		for _, tenant := range tenants.Tenants {
+			if tenant.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(tenant.Token)) == 1 {
+				return tenant, true
+			}
+		}
+	}
+	if req.TLS != nil {
+		if tenant := tenants.byHost[strings.ToLower(req.TLS.ServerName)]; tenant != nil {
+			return tenant, tenant.Token == ""
+		}
+	}
+	return nil, false
+}
+
+// Usages returns a copy of the current usage of every tenant
+func (tenants *Tenants) Usages() []*Usage {
+	usages := make([]*Usage, 0, len(tenants.Tenants))
+	for _, tenant := range tenants.Tenants {
+		usages = append(usages, tenant.Usage())
+	}
+	return usages
+}
+
+// ServeDecoy serves the tenant's decoy site, or a 404 if it has none
+func (tenant *Tenant) ServeDecoy(resp http.ResponseWriter, req *http.Request) {
+	if tenant == nil || tenant.decoy == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	req.Header.Del(X_LANTERN_TENANT_TOKEN)
+	tenant.decoy.ServeHTTP(resp, req)
+}
+
+// AddBytes accounts the given number of bytes to this tenant
+func (tenant *Tenant) AddBytes(n int) {
+	if n <= 0 {
+		return
+	}
+	tenant.usageMutex.Lock()
+	defer tenant.usageMutex.Unlock()
+	tenant.rollOver()
+	tenant.usage.Bytes += int64(n)
+	tenant.usage.TotalBytes += int64(n)
+}
+
+// Usage returns a copy of this tenant's current usage
+func (tenant *Tenant) Usage() *Usage {
+	tenant.usageMutex.Lock()
+	defer tenant.usageMutex.Unlock()
+	tenant.rollOver()
+	usage := *tenant.usage
+	return &usage
+}
+
+// IsOverCap indicates whether this tenant has used up its DailyCap
+func (tenant *Tenant) IsOverCap() bool {
+	return tenant.DailyCap > 0 && tenant.Usage().Bytes >= tenant.DailyCap
+}
+
+// PolicyOr returns this tenant's EgressPolicy, or the given policy if the
+// tenant has none (or is nil)
+func (tenant *Tenant) PolicyOr(defaultPolicy *egress.Policy) *egress.Policy {
+	if tenant == nil || tenant.EgressPolicy == nil {
+		return defaultPolicy
+	}
+	return tenant.EgressPolicy
+}
+
+// Track wraps the given destination connection so that its traffic is
+// accounted to this tenant
+func (tenant *Tenant) Track(conn net.Conn) net.Conn {
+	tenant.usageMutex.Lock()
+	tenant.usage.Connections++
+	tenant.usageMutex.Unlock()
+	return &trackedConn{conn, tenant}
+}
+
+// rollOver starts a new day of usage if necessary
+func (tenant *Tenant) rollOver() {
+	today := time.Now().Format(DAY_FORMAT)
+	if tenant.usage.Day != today {
+		tenant.usage.Day = today
+		tenant.usage.Bytes = 0
+	}
+}
+
+func (conn *trackedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.tenant.AddBytes(n)
+	return n, err
+}
+
+func (conn *trackedConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.tenant.AddBytes(n)
+	return n, err
+}
@@ -0,0 +1,71 @@
+package tenants
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func testTenants(t *testing.T) *Tenants {
+	file, err := ioutil.TempFile("", "tenants")
+	if err != nil {
+		t.Fatalf("Unable to create tenants file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`[
+		{"name": "school", "hosts": ["school.example.org"], "token": "secret", "dailycap": 100},
+		{"name": "open", "hosts": ["open.example.org"]}
+	]`)
+	file.Close()
+	tenants, err := Load(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to load tenants: %s", err)
+	}
+	return tenants
+}
+
+func TestSelect(t *testing.T) {
+	tenants := testTenants(t)
+	cases := []struct {
+		serverName    string
+		token         string
+		expected      string
+		authenticated bool
+	}{
+		{"school.example.org", "secret", "school", true},
+		{"other.example.org", "secret", "school", true},
+		{"School.Example.org", "", "school", false},
+		{"school.example.org", "wrong", "school", false},
+		{"open.example.org", "", "open", true},
+		{"other.example.org", "", "", false},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "https://"+c.serverName+"/", nil)
+		req.TLS = &tls.ConnectionState{ServerName: c.serverName}
+		if c.token != "" {
+			req.Header.Set(X_LANTERN_TENANT_TOKEN, c.token)
+		}
+		tenant, authenticated := tenants.Select(req)
+		name := ""
+		if tenant != nil {
+			name = tenant.Name
+		}
+		if name != c.expected || authenticated != c.authenticated {
+			t.Errorf("%s with token %q: expected %q (%v), got %q (%v)", c.serverName, c.token, c.expected, c.authenticated, name, authenticated)
+		}
+	}
+}
+
+func TestDailyCap(t *testing.T) {
+	tenant := testTenants(t).Tenants[0]
+	tenant.AddBytes(99)
+	if tenant.IsOverCap() {
+		t.Error("Shouldn't be over cap yet")
+	}
+	tenant.AddBytes(1)
+	if !tenant.IsOverCap() {
+		t.Error("Should be over cap")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// setParentDeathSignal asks the kernel to send us SIGTERM (which shuts us down
+// gracefully) when our parent dies, if that's the -parentpid.  Processes
+// that we restart into on SIGUSR2 aren't children of the -parentpid, so they
+// poll instead.  It returns whether the signal was set.
+func setParentDeathSignal() bool {
+	if os.Getppid() != *parentPID {
+		return false
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(syscall.SIGTERM), 0); errno != 0 {
+		log.Debugf("Unable to set parent death signal: %s", errno)
+		return false
+	}
+	// If our parent died before we asked, polling notices
+	return os.Getppid() == *parentPID
+}
@@ -0,0 +1,10 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package main
+
+// setParentDeathSignal does nothing except on Linux, so we poll for our
+// parent instead
+func setParentDeathSignal() bool {
+	return false
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	ORPHAN_POLL_INTERVAL = 1 * time.Second
+)
+
+// terminateWhenOrphaned makes sure that flashlight stops running if the
+// process given by -parentpid (e.g. the UI that launched us) has stopped,
+// since children outlive their parents on Linux and macOS too.  Where we can,
+// we ask the kernel to signal us when our parent dies, otherwise we poll.  It
+// must be called after parsing flags.
+func terminateWhenOrphaned() {
+	if *parentPID == 0 {
+		return
+	}
+	if setParentDeathSignal() {
+		return
+	}
+	go func() {
+		// If it's our direct parent, we get reparented when it dies, which
+		// unlike its PID can't be reused
+		direct := os.Getppid() == *parentPID
+		for {
+			time.Sleep(ORPHAN_POLL_INTERVAL)
+			if direct {
+				if os.Getppid() != *parentPID {
+					break
+				}
+			} else if err := syscall.Kill(*parentPID, 0); err == syscall.ESRCH {
+				break
+			}
+		}
+		log.Errorf("Parent %d no longer running, terminating", *parentPID)
+		stop()
+	}()
+}
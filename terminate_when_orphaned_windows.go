@@ -6,14 +6,16 @@ import (
 	"github.com/getlantern/flashlight/log"
 )
 
-// On windows, make sure that flashlight stops running if its parent
-// process has stopped.  This is necessary on Windows, where child processes
-// don't tend to get terminated it the parent process dies unexpectedly.
-func init() {
+// terminateWhenOrphaned makes sure that flashlight stops running if its
+// parent process has stopped.  This is necessary on Windows, where child
+// processes don't tend to get terminated it the parent process dies
+// unexpectedly.  It must be called after parsing flags, for -parentpid.
+func terminateWhenOrphaned() {
+	if *parentPID == 0 {
+		// E.g. running as a service
+		return
+	}
 	go func() {
-		if *parentPID == 0 {
-			log.Errorf("No parent PID specified, not terminating when orphaned")
-		}
 		parent, _ := os.FindProcess(*parentPID)
 		if parent == nil {
 			log.Errorf("No parent, not terminating when orphaned")
@@ -22,6 +24,7 @@ func init() {
 		log.Errorf("Waiting for parent %d to terminate", *parentPID)
 		parent.Wait()
 		log.Error("Parent no longer running, terminating")
+		runShutdownHooks()
 		os.Exit(0)
 	}()
 }
@@ -0,0 +1,137 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// The OTLP/HTTP JSON encoding of spans (see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding), which
+// collectors accept at /v1/traces
+
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   *otlpResource     `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope *otlpScope  `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus      `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string     `json:"key"`
+	Value *otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+// Flush exports the spans that have finished since the last export
+func (tracer *Tracer) Flush() error {
+	tracer.mutex.Lock()
+	spans := tracer.queue
+	tracer.queue = nil
+	tracer.mutex.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(tracer.otlpRequest(spans))
+	if err != nil {
+		return fmt.Errorf("Unable to marshal spans: %s", err)
+	}
+	client := &http.Client{Timeout: EXPORT_TIMEOUT}
+	resp, err := client.Post(tracer.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to export %d spans: %s", len(spans), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unable to export %d spans: %s", len(spans), resp.Status)
+	}
+	return nil
+}
+
+func (tracer *Tracer) otlpRequest(spans []*Span) *otlpRequest {
+	service := tracer.Service
+	if service == "" {
+		service = DEFAULT_SERVICE
+	}
+	resourceAttributes := map[string]string{"service.name": service}
+	for key, value := range tracer.Attributes {
+		resourceAttributes[key] = value
+	}
+	scopeSpans := &otlpScopeSpans{Scope: &otlpScope{Name: DEFAULT_SERVICE}}
+	for _, span := range spans {
+		encoded := &otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Parent != [8]byte{} {
+			encoded.ParentSpanID = hex.EncodeToString(span.Parent[:])
+		}
+		if span.Error != "" {
+			encoded.Status = &otlpStatus{Code: 2, Message: span.Error}
+		}
+		scopeSpans.Spans = append(scopeSpans.Spans, encoded)
+	}
+	return &otlpRequest{ResourceSpans: []*otlpResourceSpans{{
+		Resource:   &otlpResource{Attributes: otlpAttributes(resourceAttributes)},
+		ScopeSpans: []*otlpScopeSpans{scopeSpans},
+	}}}
+}
+
+// otlpAttributes encodes the given attributes, sorted by key
+func otlpAttributes(attributes map[string]string) []*otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]*otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, &otlpAttribute{Key: key, Value: &otlpValue{StringValue: attributes[key]}})
+	}
+	return encoded
+}
@@ -0,0 +1,227 @@
+// package trace records spans of a request's journey through flashlight
+// (client accept, rewrite, upstream dial, server rewrite and origin fetch) and
+// exports them to an OpenTelemetry collector via OTLP/HTTP, for debugging
+// latency in multi-hop setups.
+//
+// The trace context travels between flashlight hops in the X-Lantern-Trace
+// header, in the W3C traceparent format (00-<trace id>-<span id>-01).  Only
+// sampled traces are propagated, so servers record spans for whatever their
+// clients sample.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	X_LANTERN_TRACE = "X-Lantern-Trace" // header carrying the trace context between hops
+
+	DEFAULT_SERVICE  = "flashlight"
+	EXPORT_INTERVAL  = 5 * time.Second
+	EXPORT_TIMEOUT   = 10 * time.Second
+	MAX_QUEUED_SPANS = 10000 // spans queued for export, beyond which new ones are dropped
+)
+
+// Context identifies a span within a trace
+type Context struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// String formats the context as a W3C traceparent
+func (ctx *Context) String() string {
+	return fmt.Sprintf("00-%x-%x-01", ctx.TraceID[:], ctx.SpanID[:])
+}
+
+// Parse parses a W3C traceparent, like the value of an X-Lantern-Trace header
+func Parse(traceparent string) (*Context, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return nil, fmt.Errorf("Invalid trace context %s", traceparent)
+	}
+	ctx := &Context{}
+	if err := decodeID(ctx.TraceID[:], parts[1]); err != nil {
+		return nil, err
+	}
+	if err := decodeID(ctx.SpanID[:], parts[2]); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func decodeID(id []byte, s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return fmt.Errorf("Invalid id %s in trace context", s)
+	}
+	copy(id, b)
+	for _, c := range id {
+		if c != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("All-zero id in trace context")
+}
+
+// Tracer records spans and exports them to Endpoint every EXPORT_INTERVAL
+type Tracer struct {
+	Endpoint   string            // OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces
+	Service    string            // (optional) service.name of our spans, defaults to DEFAULT_SERVICE
+	Attributes map[string]string // (optional) further resource attributes, e.g. the role
+	SampleRate float64           // share of new traces to record, from 0 to 1
+
+	queue []*Span
+	mutex sync.Mutex
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	Name       string
+	Context    Context
+	Parent     [8]byte // SpanID of the parent, all zero for root spans
+	Kind       int     // SPAN_KIND_ constant
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string // empty if the operation succeeded
+
+	tracer *Tracer
+	once   sync.Once
+}
+
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2 // handling a request from a client or downstream hop
+	SPAN_KIND_CLIENT   = 3 // making a request to an upstream hop or origin
+)
+
+// Start starts exporting in the background
+func (tracer *Tracer) Start() {
+	go func() {
+		defer crash.Recover()
+		for {
+			time.Sleep(EXPORT_INTERVAL)
+			if err := tracer.Flush(); err != nil {
+				log.Debug(err)
+			}
+		}
+	}()
+}
+
+// StartTrace starts the root span of a new trace, or returns nil if the trace
+// isn't sampled.  It is safe to call on a nil Tracer, which returns nil.
+func (tracer *Tracer) StartTrace(name string, kind int) *Span {
+	if tracer == nil || !tracer.sample() {
+		return nil
+	}
+	span := tracer.newSpan(name, kind)
+	randomize(span.Context.TraceID[:])
+	return span
+}
+
+// Continue starts a span in the trace with the given context (like the value
+// of an X-Lantern-Trace header), or returns nil if there's none.  It is safe
+// to call on a nil Tracer, which returns nil.
+func (tracer *Tracer) Continue(name string, kind int, traceparent string) *Span {
+	if tracer == nil || traceparent == "" {
+		return nil
+	}
+	parent, err := Parse(traceparent)
+	if err != nil {
+		log.Debug(err)
+		return nil
+	}
+	span := tracer.newSpan(name, kind)
+	span.Context.TraceID = parent.TraceID
+	span.Parent = parent.SpanID
+	return span
+}
+
+func (tracer *Tracer) newSpan(name string, kind int) *Span {
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), tracer: tracer}
+	randomize(span.Context.SpanID[:])
+	return span
+}
+
+func (tracer *Tracer) sample() bool {
+	if tracer.SampleRate >= 1 {
+		return true
+	}
+	var b [8]byte
+	randomize(b[:])
+	n := uint64(0)
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return float64(n) < tracer.SampleRate*math.MaxUint64
+}
+
+// Child starts a span within this span.  It is safe to call on a nil Span,
+// which returns nil.
+func (span *Span) Child(name string, kind int) *Span {
+	if span == nil {
+		return nil
+	}
+	child := span.tracer.newSpan(name, kind)
+	child.Context.TraceID = span.Context.TraceID
+	child.Parent = span.Context.SpanID
+	return child
+}
+
+// SetAttribute sets an attribute of the span.  It is safe to call on a nil
+// Span.
+func (span *Span) SetAttribute(key string, value string) {
+	if span == nil {
+		return
+	}
+	if span.Attributes == nil {
+		span.Attributes = make(map[string]string)
+	}
+	span.Attributes[key] = value
+}
+
+// Finish ends the span, which failed if err isn't nil, and queues it for
+// export.  Only the first call counts.  It is safe to call on a nil Span.
+func (span *Span) Finish(err error) {
+	if span == nil {
+		return
+	}
+	span.once.Do(func() {
+		span.End = time.Now()
+		if err != nil {
+			span.Error = err.Error()
+		}
+		span.tracer.enqueue(span)
+	})
+}
+
+// TraceParent returns the span's context as a W3C traceparent for
+// propagating it in an X-Lantern-Trace header, or "" for a nil Span
+func (span *Span) TraceParent() string {
+	if span == nil {
+		return ""
+	}
+	return span.Context.String()
+}
+
+func (tracer *Tracer) enqueue(span *Span) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if len(tracer.queue) < MAX_QUEUED_SPANS {
+		tracer.queue = append(tracer.queue, span)
+	}
+}
+
+func randomize(b []byte) {
+	// crypto/rand doesn't fail on the platforms that we support
+	rand.Read(b)
+}
@@ -0,0 +1,53 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPropagation(t *testing.T) {
+	if span := (&Tracer{SampleRate: 0}).StartTrace("client.accept", SPAN_KIND_SERVER); span != nil {
+		t.Errorf("Nothing should be sampled at rate 0")
+	}
+
+	var received otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&received)
+	}))
+	defer collector.Close()
+
+	client := &Tracer{Endpoint: collector.URL, SampleRate: 1}
+	server := &Tracer{Endpoint: collector.URL, Attributes: map[string]string{"role": "server"}}
+	accept := client.StartTrace("client.accept", SPAN_KIND_SERVER)
+	dial := accept.Child("upstream.dial", SPAN_KIND_CLIENT)
+	header := dial.TraceParent()
+	if parsed, err := Parse(header); err != nil || *parsed != dial.Context {
+		t.Fatalf("Unable to parse %s: %v", header, err)
+	}
+
+	remote := server.Continue("server.accept", SPAN_KIND_SERVER, header)
+	if remote.Context.TraceID != accept.Context.TraceID || remote.Parent != dial.Context.SpanID {
+		t.Errorf("Server span should continue the client's trace")
+	}
+	remote.Finish(fmt.Errorf("origin unreachable"))
+	remote.Finish(nil)
+	if err := server.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "server.accept" || spans[0].ParentSpanID == "" || spans[0].Status == nil || spans[0].Status.Code != 2 {
+		t.Errorf("Unexpected export: %+v", spans)
+	}
+	if attributes := received.ResourceSpans[0].Resource.Attributes; len(attributes) != 2 || attributes[0].Key != "role" {
+		t.Errorf("Unexpected resource attributes: %+v", attributes)
+	}
+
+	for _, bad := range []string{"", "00-abc-def-01", "00-00000000000000000000000000000000-0000000000000001-01"} {
+		if server.Continue("server.accept", SPAN_KIND_SERVER, bad) != nil {
+			t.Errorf("%q shouldn't continue a trace", bad)
+		}
+	}
+}
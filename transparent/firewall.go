@@ -0,0 +1,48 @@
+package transparent
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// bypassNetworks are destinations that are never redirected
+	bypassNetworks = []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+	}
+)
+
+// IPTablesRules returns iptables commands that redirect TCP traffic from the
+// given LAN interface to the given port.  Traffic to local and private
+// networks is left alone.  The router's own traffic (including flashlight's)
+// doesn't pass through PREROUTING, so it isn't redirected.
+func IPTablesRules(lanInterface string, port int) string {
+	lines := []string{
+		"iptables -t nat -N FLASHLIGHT",
+	}
+	for _, network := range bypassNetworks {
+		lines = append(lines, fmt.Sprintf("iptables -t nat -A FLASHLIGHT -d %s -j RETURN", network))
+	}
+	lines = append(lines,
+		fmt.Sprintf("iptables -t nat -A FLASHLIGHT -p tcp -j REDIRECT --to-ports %d", port),
+		fmt.Sprintf("iptables -t nat -A PREROUTING -i %s -p tcp -j FLASHLIGHT", lanInterface),
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// FW4Rules returns nftables rules for OpenWrt's fw4 that redirect TCP traffic
+// from the LAN zone to the given port.  They're meant to be saved as
+// /usr/share/nftables.d/chain-pre/dstnat_lan/flashlight.nft, after which
+// "fw4 reload" applies them.
+func FW4Rules(port int) string {
+	return fmt.Sprintf(`ip daddr { %s } return
+meta nfproto ipv4 meta l4proto tcp redirect to :%d
+`, strings.Join(bypassNetworks, ", "), port)
+}
@@ -0,0 +1,235 @@
+package transparent
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	CGROUP_NAME       = "flashlight"
+	CGROUP_V1_ROOT    = "/sys/fs/cgroup/net_cls"
+	CGROUP_V2_ROOT    = "/sys/fs/cgroup"
+	NET_CLS_CLASSID   = "0x00110011" // classid with which cgroup v1 marks our apps' traffic
+	PER_APP_CHAIN     = "FLASHLIGHT_APPS"
+	APP_SCAN_INTERVAL = 2 * time.Second
+)
+
+// perApp is the state of per-app proxying
+type perApp struct {
+	apps      map[string]bool
+	cgroupDir string
+	v2        bool
+	moved     map[int]string // pid -> cgroup.procs file of the cgroup it came from
+	movedMu   sync.Mutex
+	stop      chan bool
+}
+
+// EnablePerApp redirects the TCP traffic of the named applications (matched
+// by process name or executable name) to the transparent proxy listening on
+// the given port.  It puts their processes into a flashlight cgroup (net_cls
+// on cgroup v1) and adds iptables rules that match on that cgroup, so other
+// apps are left alone.  Processes are picked up as they start.  It returns a
+// function that removes the rules and moves the processes back.  Requires
+// root.
+func EnablePerApp(apps []string, port int) (restore func() error, err error) {
+	pa := &perApp{
+		apps:  make(map[string]bool),
+		moved: make(map[int]string),
+		stop:  make(chan bool),
+	}
+	for _, app := range apps {
+		pa.apps[app] = true
+	}
+	match, err := pa.setupCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := [][]string{{"-t", "nat", "-N", PER_APP_CHAIN}}
+	for _, network := range bypassNetworks {
+		rules = append(rules, []string{"-t", "nat", "-A", PER_APP_CHAIN, "-d", network, "-j", "RETURN"})
+	}
+	rules = append(rules,
+		[]string{"-t", "nat", "-A", PER_APP_CHAIN, "-p", "tcp", "-j", "REDIRECT", "--to-ports", strconv.Itoa(port)},
+		append(append([]string{"-t", "nat", "-A", "OUTPUT", "-p", "tcp"}, match...), "-j", PER_APP_CHAIN),
+	)
+	for _, rule := range rules {
+		if err := iptables(rule...); err != nil {
+			pa.removeRules(match)
+			os.Remove(pa.cgroupDir)
+			return nil, err
+		}
+	}
+
+	go pa.scanPeriodically()
+	return func() error {
+		close(pa.stop)
+		err := pa.removeRules(match)
+		pa.restoreProcesses()
+		if rmErr := os.Remove(pa.cgroupDir); rmErr != nil && err == nil {
+			err = fmt.Errorf("Unable to remove cgroup %s: %s", pa.cgroupDir, rmErr)
+		}
+		return err
+	}, nil
+}
+
+// setupCgroup creates our cgroup and returns the iptables match for traffic
+// from it
+func (pa *perApp) setupCgroup() ([]string, error) {
+	if _, err := os.Stat(filepath.Join(CGROUP_V2_ROOT, "cgroup.controllers")); err == nil {
+		pa.v2 = true
+		pa.cgroupDir = filepath.Join(CGROUP_V2_ROOT, CGROUP_NAME)
+	} else {
+		pa.cgroupDir = filepath.Join(CGROUP_V1_ROOT, CGROUP_NAME)
+	}
+	err := os.MkdirAll(pa.cgroupDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cgroup %s: %s", pa.cgroupDir, err)
+	}
+	if pa.v2 {
+		return []string{"-m", "cgroup", "--path", CGROUP_NAME}, nil
+	}
+	err = ioutil.WriteFile(filepath.Join(pa.cgroupDir, "net_cls.classid"), []byte(NET_CLS_CLASSID), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set net_cls classid: %s", err)
+	}
+	return []string{"-m", "cgroup", "--cgroup", NET_CLS_CLASSID}, nil
+}
+
+func (pa *perApp) removeRules(match []string) error {
+	err := iptables(append(append([]string{"-t", "nat", "-D", "OUTPUT", "-p", "tcp"}, match...), "-j", PER_APP_CHAIN)...)
+	iptables("-t", "nat", "-F", PER_APP_CHAIN)
+	iptables("-t", "nat", "-X", PER_APP_CHAIN)
+	return err
+}
+
+func (pa *perApp) scanPeriodically() {
+	for {
+		pa.scan()
+		select {
+		case <-pa.stop:
+			return
+		case <-time.After(APP_SCAN_INTERVAL):
+		}
+	}
+}
+
+// scan moves processes of our apps that aren't in our cgroup yet into it
+func (pa *perApp) scan() {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		log.Errorf("Unable to list processes: %s", err)
+		return
+	}
+	pa.movedMu.Lock()
+	defer pa.movedMu.Unlock()
+	live := make(map[int]bool)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		live[pid] = true
+		if !pa.isApp(pid) {
+			continue
+		}
+		if _, found := pa.moved[pid]; found {
+			continue
+		}
+		from := pa.currentCgroupProcs(pid)
+		err = ioutil.WriteFile(filepath.Join(pa.cgroupDir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+		if err != nil {
+			// Process may have exited in the meantime
+			log.Debugf("Unable to move process %d into cgroup: %s", pid, err)
+			continue
+		}
+		log.Debugf("Proxying process %d", pid)
+		pa.moved[pid] = from
+	}
+	// Forget processes that have exited, in case their pids get reused
+	for pid := range pa.moved {
+		if !live[pid] {
+			delete(pa.moved, pid)
+		}
+	}
+}
+
+// isApp indicates whether the given process is one of our apps
+func (pa *perApp) isApp(pid int) bool {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err == nil && pa.apps[strings.TrimSpace(string(comm))] {
+		return true
+	}
+	// comm is truncated to 15 characters, so also check the executable
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	return err == nil && pa.apps[filepath.Base(exe)]
+}
+
+// currentCgroupProcs returns the cgroup.procs file of the cgroup that the
+// given process is in, in the hierarchy that we use
+func (pa *perApp) currentCgroupProcs(pid int) string {
+	root := CGROUP_V1_ROOT
+	if pa.v2 {
+		root = CGROUP_V2_ROOT
+	}
+	defaultProcs := filepath.Join(root, "cgroup.procs")
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return defaultProcs
+	}
+	defer file.Close()
+	// Lines look like "0::/user.slice/..." (v2) or "3:net_cls,net_prio:/..." (v1)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if (pa.v2 && parts[0] == "0") || (!pa.v2 && strings.Contains(parts[1], "net_cls")) {
+			return filepath.Join(root, parts[2], "cgroup.procs")
+		}
+	}
+	return defaultProcs
+}
+
+// restoreProcesses moves the processes that we moved back to where they came
+// from
+func (pa *perApp) restoreProcesses() {
+	pa.movedMu.Lock()
+	defer pa.movedMu.Unlock()
+	procs, _ := ioutil.ReadFile(filepath.Join(pa.cgroupDir, "cgroup.procs"))
+	for _, line := range strings.Fields(string(procs)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			continue
+		}
+		to, found := pa.moved[pid]
+		if !found {
+			// Child that was started inside our cgroup
+			to = filepath.Join(filepath.Dir(pa.cgroupDir), "cgroup.procs")
+		}
+		err = ioutil.WriteFile(to, []byte(line), 0644)
+		if err != nil {
+			log.Debugf("Unable to move process %d out of cgroup: %s", pid, err)
+		}
+	}
+}
+
+// iptables runs iptables with the given arguments
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to run iptables %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package transparent
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// EnablePerApp is only supported on Linux
+func EnablePerApp(apps []string, port int) (restore func() error, err error) {
+	return nil, fmt.Errorf("Per-app proxying is not supported on %s", runtime.GOOS)
+}
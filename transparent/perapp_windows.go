@@ -0,0 +1,14 @@
+package transparent
+
+import (
+	"fmt"
+)
+
+// EnablePerApp is not supported on Windows.  WFP can only redirect
+// connections (ALE_CONNECT_REDIRECT) from a kernel-mode callout driver, and
+// recovering their original destinations (SIO_QUERY_WFP_CONNECTION_REDIRECT_RECORDS)
+// likewise depends on one.  Driverless WFP filters can merely permit or block
+// traffic, which isn't enough to tunnel it.
+func EnablePerApp(apps []string, port int) (restore func() error, err error) {
+	return nil, fmt.Errorf("Per-app proxying on Windows requires a WFP callout driver, which flashlight doesn't ship")
+}
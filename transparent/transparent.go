@@ -0,0 +1,98 @@
+// package transparent implements a transparent proxy for the client, which
+// accepts TCP connections redirected to it by the firewall (e.g. iptables
+// REDIRECT or TPROXY on Linux), recovers their original destinations and
+// tunnels them upstream.  This allows flashlight to run on a router without
+// any per-app proxy settings.
+package transparent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/pipe"
+)
+
+// Server is a transparent proxy server
+type Server struct {
+	Addr   string // listen address in form of host:port
+	TProxy bool   // if true, listen for TPROXY rather than REDIRECT traffic (requires CAP_NET_ADMIN)
+
+	// Dial dials the given addr through the tunnel
+	Dial func(addr string) (net.Conn, error)
+
+	listener net.Listener
+	closed   bool
+	mutex    sync.Mutex
+}
+
+// ListenAndServe listens at Addr and serves redirected connections
+func (server *Server) ListenAndServe() error {
+	l, err := listen(server.Addr, server.TProxy)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for transparent proxying at %s: %s", server.Addr, err)
+	}
+	log.Debugf("About to start transparent proxy at %s", server.Addr)
+	return server.Serve(l)
+}
+
+// Serve serves redirected connections on the given Listener, until Close
+func (server *Server) Serve(l net.Listener) error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		l.Close()
+		return nil
+	}
+	server.listener = l
+	server.mutex.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			if server.closed {
+				return nil
+			}
+			return err
+		}
+		go server.handle(conn, l.Addr())
+	}
+}
+
+// Close stops listening.  Connections being served stay open.
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.closed = true
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Close()
+}
+
+func (server *Server) handle(conn net.Conn, listenAddr net.Addr) {
+	defer conn.Close()
+	dst, err := originalDestination(conn, server.TProxy)
+	if err != nil {
+		log.Debugf("Unable to determine original destination: %s", err)
+		return
+	}
+	if dst.String() == listenAddr.String() {
+		// Connected to us directly rather than being redirected, dialing
+		// ourselves would loop
+		log.Debugf("Ignoring connection that wasn't redirected from %s", conn.RemoteAddr())
+		return
+	}
+
+	addr := dst.String()
+	upstream, err := server.Dial(addr)
+	if err != nil {
+		log.Debugf("Unable to dial %s for transparent proxying: %s", log.Redact(addr), err)
+		return
+	}
+	defer upstream.Close()
+	sent, received := pipe.Relay(conn, upstream)
+	log.Debugf("Relayed %d bytes to and %d bytes from %s", sent, received, log.Redact(addr))
+}
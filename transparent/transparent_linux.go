@@ -0,0 +1,128 @@
+package transparent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	SO_ORIGINAL_DST      = 80 // from linux/netfilter_ipv4.h
+	IP6T_SO_ORIGINAL_DST = 80 // from linux/netfilter_ipv6/ip6_tables.h
+	IPV6_TRANSPARENT     = 75 // from linux/in6.h, missing from syscall
+)
+
+// listen listens on the given addr.  For TPROXY, the socket needs to be
+// IP_TRANSPARENT so that it accepts connections for non-local addresses.
+func listen(addr string, tproxy bool) (net.Listener, error) {
+	if !tproxy {
+		return net.Listen("tcp", addr)
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	family, level, sa := syscall.AF_INET, syscall.SOL_IP, syscall.Sockaddr(nil)
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil || tcpAddr.IP == nil {
+		sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family, level = syscall.AF_INET6, syscall.SOL_IPV6
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create socket: %s", err)
+	}
+	// The file takes ownership of fd and closes it once we're done with it
+	f := os.NewFile(uintptr(fd), "tproxy")
+	defer f.Close()
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, fmt.Errorf("Unable to set SO_REUSEADDR: %s", err)
+	}
+	transparentOpt := syscall.IP_TRANSPARENT
+	if family == syscall.AF_INET6 {
+		transparentOpt = IPV6_TRANSPARENT
+	}
+	if err := syscall.SetsockoptInt(fd, level, transparentOpt, 1); err != nil {
+		return nil, fmt.Errorf("Unable to make socket transparent (requires CAP_NET_ADMIN): %s", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("Unable to bind: %s", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, fmt.Errorf("Unable to listen: %s", err)
+	}
+	// FileListener dups the fd, so closing f above is okay
+	return net.FileListener(f)
+}
+
+// originalDestination returns the address to which the given connection was
+// originally headed.  With TPROXY, that's simply the connection's local
+// address.  With REDIRECT, it's recovered from conntrack using
+// SO_ORIGINAL_DST.
+func originalDestination(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("Not a TCP connection")
+	}
+	if tproxy {
+		return local, nil
+	}
+
+	tcpConn := conn.(*net.TCPConn)
+	// Note - File() returns a dup of the connection's fd
+	f, err := tcpConn.File()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get file for connection: %s", err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	if local.IP.To4() != nil {
+		// sockaddr_in fits into the 16 bytes of an IPv6Mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get SO_ORIGINAL_DST: %s", err)
+		}
+		raw := mreq.Multiaddr
+		return &net.TCPAddr{
+			IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+			Port: int(raw[2])<<8 | int(raw[3]),
+		}, nil
+	}
+
+	// sockaddr_in6 fits into the IPv6MTUInfo
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get IP6T_SO_ORIGINAL_DST: %s", err)
+	}
+	raw := info.Addr
+	// Port is in network byte order
+	port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, raw.Addr[:])
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(port[0])<<8 | int(port[1]),
+		Zone: zoneFor(raw.Scope_id),
+	}, nil
+}
+
+func zoneFor(scopeId uint32) string {
+	if scopeId == 0 {
+		return ""
+	}
+	if iface, err := net.InterfaceByIndex(int(scopeId)); err == nil {
+		return iface.Name
+	}
+	return strconv.Itoa(int(scopeId))
+}
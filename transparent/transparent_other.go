@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package transparent
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func listen(addr string, tproxy bool) (net.Listener, error) {
+	return nil, fmt.Errorf("Transparent proxying is not supported on %s", runtime.GOOS)
+}
+
+func originalDestination(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("Transparent proxying is not supported on %s", runtime.GOOS)
+}
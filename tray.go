@@ -0,0 +1,191 @@
+//go:build systray
+// +build systray
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/systray"
+)
+
+const (
+	TRAY_REFRESH_INTERVAL = 2 * time.Second
+	TRAY_ICON_SIZE        = 32
+)
+
+var (
+	trayConnected    = color.RGBA{0x2e, 0xa0, 0x43, 0xff} // green
+	trayDisconnected = color.RGBA{0x9e, 0x9e, 0x9e, 0xff} // grey
+	trayPaused       = color.RGBA{0xe0, 0xa0, 0x00, 0xff} // amber
+)
+
+// runTray shows our icon in the system tray (see -tray) until we quit,
+// refreshing the connection state and data transferred every
+// TRAY_REFRESH_INTERVAL.  It must run on the main goroutine.
+func runTray(proxyClient *proxy.Client) {
+	systray.Run(func() {
+		onTrayReady(proxyClient)
+	}, nil)
+}
+
+func onTrayReady(proxyClient *proxy.Client) {
+	state := systray.AddMenuItem("Connecting...", "")
+	state.Disable()
+	transferred := systray.AddMenuItem("", "")
+	transferred.Disable()
+	systray.AddSeparator()
+	pause := systray.AddMenuItem("Pause proxying", "Stop using flashlight as the system proxy")
+	if !*setSystemProxy {
+		// Pausing means no longer being the system proxy
+		pause.Disable()
+	}
+	dashboard := systray.AddMenuItem("Open dashboard", "Show flashlight's status in the browser")
+	quit := systray.AddMenuItem("Quit", "Stop flashlight")
+
+	var icon []byte
+	refresh := func() {
+		text, c := trayState()
+		systray.SetTooltip("flashlight: " + text)
+		state.SetTitle(text)
+		transferred.SetTitle("Transferred " + formatBytes(proxyClient.CurrentSession().Bytes))
+		if updated := trayIcon(c); !bytes.Equal(updated, icon) {
+			icon = updated
+			systray.SetIcon(icon)
+		}
+	}
+	refresh()
+	go func() {
+		ticker := time.NewTicker(TRAY_REFRESH_INTERVAL)
+		for {
+			select {
+			case <-ticker.C:
+			case <-pause.ClickedCh:
+				togglePause(pause)
+			case <-dashboard.ClickedCh:
+				if err := openBrowser(dashboardURL(proxyClient)); err != nil {
+					log.Errorf("Unable to open dashboard: %s", err)
+				}
+			case <-quit.ClickedCh:
+				log.Debug("Quitting from the tray")
+				systray.Quit()
+				stop()
+			}
+			refresh()
+		}
+	}()
+}
+
+// trayState describes our state for the tray, along with the icon's color
+func trayState() (string, color.RGBA) {
+	if *setSystemProxy && !isSystemProxy() {
+		return "Paused", trayPaused
+	}
+	if !currentClient.IsConnected() {
+		return "Not connected", trayDisconnected
+	}
+	return "Connected", trayConnected
+}
+
+// togglePause stops or resumes being the system proxy
+func togglePause(pause *systray.MenuItem) {
+	if isSystemProxy() {
+		if err := disableSystemProxy(); err != nil {
+			log.Errorf("Unable to pause proxying: %s", err)
+			return
+		}
+		pause.SetTitle("Resume proxying")
+		return
+	}
+	if err := enableSystemProxy(); err != nil {
+		log.Errorf("Unable to resume proxying: %s", err)
+		return
+	}
+	pause.SetTitle("Pause proxying")
+}
+
+// dashboardURL returns the URL of our dashboard, on the admin listener if there is
+// one
+func dashboardURL(proxyClient *proxy.Client) string {
+	addr := clientAddr()
+	for _, listener := range proxyClient.Listeners {
+		if listener.Role == proxy.LISTENER_ADMIN {
+			addr = listener.Addr
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+	return "http://" + addr + proxy.DASHBOARD_PATH
+}
+
+// openBrowser opens the given URL in the default browser
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		return exec.Command("open", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+// trayIcon draws a dot of the given color, as ICO on Windows and PNG
+// elsewhere
+func trayIcon(c color.RGBA) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, TRAY_ICON_SIZE, TRAY_ICON_SIZE))
+	center := float64(TRAY_ICON_SIZE-1) / 2
+	radius := float64(TRAY_ICON_SIZE) / 2 * 0.8
+	for y := 0; y < TRAY_ICON_SIZE; y++ {
+		for x := 0; x < TRAY_ICON_SIZE; x++ {
+			dx, dy := float64(x)-center, float64(y)-center
+			if dx*dx+dy*dy <= radius*radius {
+				img.Set(x, y, c)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	if runtime.GOOS != "windows" {
+		return buf.Bytes()
+	}
+	// An ICO holding a single PNG image
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, []uint16{0, 1, 1})
+	ico.Write([]byte{TRAY_ICON_SIZE, TRAY_ICON_SIZE, 0, 0})
+	binary.Write(&ico, binary.LittleEndian, []uint16{1, 32})
+	binary.Write(&ico, binary.LittleEndian, []uint32{uint32(buf.Len()), 22})
+	ico.Write(buf.Bytes())
+	return ico.Bytes()
+}
+
+// formatBytes formats the given number of bytes for people, e.g. 1.5 MB
+func formatBytes(n int64) string {
+	units := []string{"bytes", "KB", "MB", "GB", "TB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return strings.Replace(fmt.Sprintf("%.1f %s", value, units[i]), ".0 ", " ", 1)
+}
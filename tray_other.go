@@ -0,0 +1,16 @@
+//go:build !systray
+// +build !systray
+
+package main
+
+import (
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+)
+
+// runTray explains that -tray needs building with -tags systray and waits
+// forever, so that the client keeps running without the tray
+func runTray(proxyClient *proxy.Client) {
+	log.Errorf("Built without systray support, not showing -tray (build with -tags systray)")
+	select {}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package updater
+
+import (
+	"fmt"
+	"os"
+)
+
+// swap atomically replaces executable with downloaded.  Running processes
+// keep running the old binary.
+func swap(downloaded string, executable string) error {
+	if err := os.Rename(downloaded, executable); err != nil {
+		return fmt.Errorf("Unable to replace %s: %s", executable, err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+)
+
+// swap replaces executable with downloaded.  Windows doesn't let us replace a
+// running binary, but it lets us rename it out of the way, so the previous
+// binary is kept next to it with a .old suffix until the next update.
+func swap(downloaded string, executable string) error {
+	old := executable + ".old"
+	os.Remove(old)
+	if err := os.Rename(executable, old); err != nil {
+		return fmt.Errorf("Unable to move %s out of the way: %s", executable, err)
+	}
+	if err := os.Rename(downloaded, executable); err != nil {
+		os.Rename(old, executable)
+		return fmt.Errorf("Unable to replace %s: %s", executable, err)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+// package updater keeps flashlight up to date by periodically checking a
+// release endpoint (through the tunnel, on clients, since release sites are
+// often blocked where they run), downloading new binaries, verifying them and
+// swapping them in for the running binary.
+//
+// The release endpoint serves a manifest signed with Ed25519, in the same
+// envelope as package remoteconfig's configurations:
+//
+//	{
+//	  "version": "2.1.0",
+//	  "binaries": {
+//	    "linux/amd64": {"url": "https://releases.example.org/flashlight-2.1.0-linux-amd64", "sha256": "<hex>"},
+//	    "windows/386": {"url": "https://releases.example.org/flashlight-2.1.0-windows-386.exe", "sha256": "<hex>"}
+//	  }
+//	}
+//
+// Binaries are keyed by GOOS/GOARCH.  A binary is only swapped in if its
+// SHA-256 matches the signed manifest's, so the binaries themselves can be
+// served from anywhere.
+package updater
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/remoteconfig"
+)
+
+const (
+	DEFAULT_INTERVAL  = 12 * time.Hour
+	RETRY_INTERVAL    = 30 * time.Minute
+	MANIFEST_TIMEOUT  = 1 * time.Minute
+	DOWNLOAD_TIMEOUT  = 30 * time.Minute
+	MAX_MANIFEST_SIZE = 64 * 1024
+	MAX_BINARY_SIZE   = 200 * 1024 * 1024
+)
+
+// Manifest describes the latest release
+type Manifest struct {
+	Version  string             `json:"version"`
+	Binaries map[string]*Binary `json:"binaries"` // by GOOS/GOARCH
+}
+
+// Binary is a release's binary for one platform
+type Binary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"` // hex-encoded
+}
+
+// Updater periodically checks the manifest at URL and swaps in the binary for
+// our platform whenever it's newer than Version
+type Updater struct {
+	URL        string            // where the signed manifest is served
+	PublicKey  ed25519.PublicKey // key with which the manifest must be signed
+	Version    string            // version of the running binary, e.g. 2.0.3
+	Interval   time.Duration     // (optional) how often to check, defaults to DEFAULT_INTERVAL
+	Executable string            // (optional) binary to replace, defaults to the one at os.Args[0]
+
+	// Restart (optional) is called once a new binary has been swapped in, to
+	// start running it.  If it's nil or fails, the new binary is used from
+	// the next start.
+	Restart func() error
+
+	dial      func(network, addr string) (net.Conn, error)
+	stop      chan bool
+	stopMutex sync.Mutex
+}
+
+// Start starts checking periodically in the background, dialing with the
+// given function (e.g. through the tunnel), or directly if it's nil, until
+// Stop
+func (updater *Updater) Start(dial func(network, addr string) (net.Conn, error)) {
+	updater.dial = dial
+	stop := make(chan bool)
+	updater.stopMutex.Lock()
+	updater.stop = stop
+	updater.stopMutex.Unlock()
+	go updater.keepUpdated(stop)
+}
+
+// Stop stops checking for updates.  It is safe to call on a nil or stopped
+// Updater.
+func (updater *Updater) Stop() {
+	if updater == nil {
+		return
+	}
+	updater.stopMutex.Lock()
+	defer updater.stopMutex.Unlock()
+	if updater.stop != nil {
+		close(updater.stop)
+		updater.stop = nil
+	}
+}
+
+func (updater *Updater) keepUpdated(stop chan bool) {
+	defer crash.Recover()
+	interval := updater.Interval
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	for {
+		next := interval
+		updated, err := updater.Check()
+		if err != nil {
+			log.Errorf("Unable to check for updates: %s", err)
+			next = RETRY_INTERVAL
+		} else if updated {
+			// Anything newer gets picked up by the new binary
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// Check checks the manifest once and, if there's a newer version, swaps in
+// its binary and restarts, returning whether it updated
+func (updater *Updater) Check() (bool, error) {
+	manifest, err := updater.fetchManifest()
+	if err != nil {
+		return false, err
+	}
+	if !IsNewer(manifest.Version, updater.Version) {
+		log.Debugf("Version %s is up to date", updater.Version)
+		return false, nil
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary := manifest.Binaries[platform]
+	if binary == nil {
+		log.Debugf("Version %s has no binary for %s", manifest.Version, platform)
+		return false, nil
+	}
+	executable := updater.Executable
+	if executable == "" {
+		// Not os.Executable, which may resolve to a binary that was already
+		// replaced
+		executable, err = exec.LookPath(os.Args[0])
+		if err != nil {
+			return false, fmt.Errorf("Unable to find our binary: %s", err)
+		}
+	}
+
+	log.Debugf("Updating from %s to %s", updater.Version, manifest.Version)
+	downloaded, err := updater.download(binary, filepath.Dir(executable))
+	if err != nil {
+		return false, err
+	}
+	if err := swap(downloaded, executable); err != nil {
+		os.Remove(downloaded)
+		return false, err
+	}
+	log.Debugf("Updated %s to version %s", executable, manifest.Version)
+	if updater.Restart == nil {
+		return true, nil
+	}
+	if err := updater.Restart(); err != nil {
+		log.Errorf("Unable to restart into version %s, it will run from the next start: %s", manifest.Version, err)
+	}
+	return true, nil
+}
+
+func (updater *Updater) httpClient(timeout time.Duration) *http.Client {
+	transport := &http.Transport{}
+	if updater.dial != nil {
+		transport.Dial = updater.dial
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// fetchManifest fetches the manifest and verifies its signature
+func (updater *Updater) fetchManifest() (*Manifest, error) {
+	resp, err := updater.httpClient(MANIFEST_TIMEOUT).Get(updater.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch %s: %s", updater.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response status fetching %s: %d", updater.URL, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_MANIFEST_SIZE))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", updater.URL, err)
+	}
+	opened, err := remoteconfig.Open(data, updater.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Rejecting manifest from %s: %s", updater.URL, err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(opened, manifest); err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest from %s: %s", updater.URL, err)
+	}
+	return manifest, nil
+}
+
+// download downloads the given binary to a temporary file in dir (so that it
+// can be renamed over the executable) and verifies its hash, returning the
+// file's name
+func (updater *Updater) download(binary *Binary, dir string) (string, error) {
+	expected, err := hex.DecodeString(binary.SHA256)
+	if err != nil || len(expected) != sha256.Size {
+		return "", fmt.Errorf("Invalid SHA-256 %s in manifest", binary.SHA256)
+	}
+	resp, err := updater.httpClient(DOWNLOAD_TIMEOUT).Get(binary.URL)
+	if err != nil {
+		return "", fmt.Errorf("Unable to download %s: %s", binary.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Unexpected response status downloading %s: %d", binary.URL, resp.StatusCode)
+	}
+
+	file, err := ioutil.TempFile(dir, ".flashlight-update")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create file for update: %s", err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), io.LimitReader(resp.Body, MAX_BINARY_SIZE))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !bytes.Equal(hash.Sum(nil), expected) {
+		err = fmt.Errorf("SHA-256 of %s doesn't match the manifest", binary.URL)
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0755)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("Unable to download %s: %s", binary.URL, err)
+	}
+	return file.Name(), nil
+}
+
+// IsNewer indicates whether version is newer than current, comparing their
+// dot-separated numbers (e.g. 2.1.0 is newer than 2.0.10).  Nothing is newer
+// than an empty current version, which development builds have.
+func IsNewer(version string, current string) bool {
+	if current == "" {
+		return false
+	}
+	a, b := versionNumbers(version), versionNumbers(current)
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// versionNumbers parses the numbers in a version like v2.1.0, ignoring
+// anything after a number (like -rc1)
+func versionNumbers(version string) []int {
+	var numbers []int
+	for _, part := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		n, _ := strconv.Atoi(part[:end])
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
@@ -0,0 +1,109 @@
+package updater
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/getlantern/flashlight/remoteconfig"
+)
+
+func TestIsNewer(t *testing.T) {
+	for _, c := range []struct {
+		version string
+		current string
+		newer   bool
+	}{
+		{"2.1.0", "2.0.10", true},
+		{"2.0.10", "2.0.9", true},
+		{"v2.1", "2.1.0", false},
+		{"2.1.0", "2.1.0-rc1", false},
+		{"2.0.9", "2.0.10", false},
+		{"9.9.9", "", false},
+	} {
+		if IsNewer(c.version, c.current) != c.newer {
+			t.Errorf("IsNewer(%s, %s) should be %v", c.version, c.current, c.newer)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("new binary")
+	hash := sha256.Sum256(binary)
+	var signed []byte
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/binary" {
+			resp.Write(binary)
+		} else {
+			resp.Write(signed)
+		}
+	}))
+	defer server.Close()
+	sign := func(sha string) {
+		manifest, _ := json.Marshal(&Manifest{
+			Version:  "2.1.0",
+			Binaries: map[string]*Binary{runtime.GOOS + "/" + runtime.GOARCH: {URL: server.URL + "/binary", SHA256: sha}},
+		})
+		signed, err = remoteconfig.Sign(manifest, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	executable := filepath.Join(dir, "flashlight")
+	ioutil.WriteFile(executable, []byte("old binary"), 0755)
+	restarted := false
+	updater := &Updater{
+		URL:        server.URL,
+		PublicKey:  publicKey,
+		Version:    "2.0.3",
+		Executable: executable,
+		Restart: func() error {
+			restarted = true
+			return nil
+		},
+	}
+
+	sign(hex.EncodeToString(make([]byte, sha256.Size)))
+	if updated, err := updater.Check(); updated || err == nil {
+		t.Errorf("Binary with the wrong hash shouldn't be swapped in")
+	}
+	if current, _ := ioutil.ReadFile(executable); string(current) != "old binary" {
+		t.Errorf("Binary shouldn't have been replaced")
+	}
+
+	sign(hex.EncodeToString(hash[:]))
+	if updated, err := updater.Check(); !updated || err != nil {
+		t.Fatalf("Should have updated: %v", err)
+	}
+	if current, _ := ioutil.ReadFile(executable); string(current) != "new binary" || !restarted {
+		t.Errorf("Binary should have been replaced and restarted")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 && runtime.GOOS != "windows" {
+		t.Errorf("Downloads should have been cleaned up, found %d files", len(files))
+	}
+
+	updater.Version = "2.1.0"
+	if updated, err := updater.Check(); updated || err != nil {
+		t.Errorf("Shouldn't update to the same version: %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+// package users implements multi-user mode for a client that's shared by
+// several people on a LAN (e.g. on a home router).  Users authenticate to
+// the client with a username and password, and each user can have their own
+// rules and a daily data cap.  Usage is accounted per user and persisted in a
+// store.Store.
+//
+// Users are configured in a JSON file, for example:
+//
+//	[
+//	  {"name": "alice", "password": "secret", "rules": "alice-rules.json"},
+//	  {"name": "bob", "password": "hunter2", "dailycap": 1073741824}
+//	]
+package users
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/crash"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/rules"
+	"github.com/getlantern/flashlight/store"
+)
+
+const (
+	USAGE_DOCUMENT = "usage"
+	SAVE_INTERVAL  = 1 * time.Minute
+	DAY_FORMAT     = "2006-01-02"
+)
+
+// User is a user of the client
+type User struct {
+	Name      string `json:"name"`
+	Password  string `json:"password"`
+	RulesFile string `json:"rules,omitempty"`    // (optional) rules file for this user, instead of the client's rules
+	DailyCap  int64  `json:"dailycap,omitempty"` // (optional) maximum bytes per day
+
+	// Rules are loaded from RulesFile
+	Rules *rules.Engine `json:"-"`
+
+	usage      *Usage
+	usageMutex sync.Mutex
+}
+
+// Usage is a user's usage
+type Usage struct {
+	Day        string // day (in local time) to which Bytes applies
+	Bytes      int64  // bytes transferred on Day
+	TotalBytes int64  // bytes transferred ever
+}
+
+// Users is the set of users
+type Users struct {
+	Users []*User
+	Store *store.Store // (optional) store in which usage is persisted
+
+	byName    map[string]*User
+	stop      chan bool
+	stopMutex sync.Mutex
+}
+
+// trackedConn is a net.Conn that accounts its traffic to a User
+type trackedConn struct {
+	net.Conn
+	user *User
+}
+
+// Load loads the Users from the JSON file at the given filename, including
+// their rules files.
+func Load(filename string) (*Users, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open users file %s: %s", filename, err)
+	}
+	defer file.Close()
+	users := &Users{byName: make(map[string]*User)}
+	err = json.NewDecoder(file).Decode(&users.Users)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse users file %s: %s", filename, err)
+	}
+	for _, user := range users.Users {
+		if user.Name == "" || user.Password == "" {
+			return nil, fmt.Errorf("Users need a name and password")
+		}
+		if users.byName[user.Name] != nil {
+			return nil, fmt.Errorf("Duplicate user %s", user.Name)
+		}
+		users.byName[user.Name] = user
+		user.usage = &Usage{}
+		if user.RulesFile != "" {
+			if user.Rules, err = rules.Load(user.RulesFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return users, nil
+}
+
+// Start loads persisted usage from the Store and starts saving it
+// periodically, until Stop.
+func (users *Users) Start() {
+	if users.Store == nil {
+		return
+	}
+	saved := make(map[string]*Usage)
+	err := users.Store.Load(USAGE_DOCUMENT, &saved)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to load usage: %s", err)
+	}
+	for name, usage := range saved {
+		if user := users.byName[name]; user != nil {
+			user.usage = usage
+		}
+	}
+	stop := make(chan bool)
+	users.stopMutex.Lock()
+	users.stop = stop
+	users.stopMutex.Unlock()
+	go func() {
+		defer crash.Recover()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(SAVE_INTERVAL):
+			}
+			users.Save()
+		}
+	}()
+}
+
+// Stop stops saving usage periodically, saving it one last time.  It is safe
+// to call on a nil or stopped Users.
+func (users *Users) Stop() {
+	if users == nil {
+		return
+	}
+	users.stopMutex.Lock()
+	defer users.stopMutex.Unlock()
+	if users.stop != nil {
+		close(users.stop)
+		users.stop = nil
+		users.Save()
+	}
+}
+
+// Save saves the current usage to the Store, if any
+func (users *Users) Save() {
+	if users.Store == nil {
+		return
+	}
+	usages := make(map[string]*Usage)
+	for _, user := range users.Users {
+		usages[user.Name] = user.Usage()
+	}
+	if err := users.Store.Save(USAGE_DOCUMENT, usages); err != nil {
+		log.Errorf("Unable to save usage: %s", err)
+	}
+}
+
+// Authenticate returns the user with the given name and password, or nil if
+// there's no such user.
+func (users *Users) Authenticate(name string, password string) *User {
+	user := users.byName[name]
+	if user == nil {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+// FromRequest authenticates the user of the given proxy request using its
+// Proxy-Authorization header, returning nil if it's missing or invalid.
+func (users *Users) FromRequest(req *http.Request) *User {
+	// The scheme is case-insensitive (RFC 7235)
+	fields := strings.Fields(req.Header.Get("Proxy-Authorization"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Basic") {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	return users.Authenticate(parts[0], parts[1])
+}
+
+// RulesOr returns this user's Rules, or the given rules if the user has none
+// (or is nil).
+func (user *User) RulesOr(defaultRules *rules.Engine) *rules.Engine {
+	if user == nil || user.Rules == nil {
+		return defaultRules
+	}
+	return user.Rules
+}
+
+// AddBytes accounts the given number of bytes to this user
+func (user *User) AddBytes(n int) {
+	if n <= 0 {
+		return
+	}
+	user.usageMutex.Lock()
+	defer user.usageMutex.Unlock()
+	user.rollOver()
+	user.usage.Bytes += int64(n)
+	user.usage.TotalBytes += int64(n)
+}
+
+// Usage returns a copy of this user's current usage
+func (user *User) Usage() *Usage {
+	user.usageMutex.Lock()
+	defer user.usageMutex.Unlock()
+	user.rollOver()
+	usage := *user.usage
+	return &usage
+}
+
+// IsOverCap indicates whether this user has used up their DailyCap
+func (user *User) IsOverCap() bool {
+	return user.DailyCap > 0 && user.Usage().Bytes >= user.DailyCap
+}
+
+// Track wraps the given connection so that its traffic is accounted to this
+// user.
+func (user *User) Track(conn net.Conn) net.Conn {
+	return &trackedConn{conn, user}
+}
+
+// rollOver starts a new day of usage if necessary
+func (user *User) rollOver() {
+	today := time.Now().Format(DAY_FORMAT)
+	if user.usage.Day != today {
+		user.usage.Day = today
+		user.usage.Bytes = 0
+	}
+}
+
+func (conn *trackedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.user.AddBytes(n)
+	return n, err
+}
+
+func (conn *trackedConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.user.AddBytes(n)
+	return n, err
+}
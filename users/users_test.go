@@ -0,0 +1,56 @@
+package users
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func testUsers() *Users {
+	alice := &User{Name: "alice", Password: "secret", DailyCap: 100, usage: &Usage{}}
+	return &Users{
+		Users:  []*User{alice},
+		byName: map[string]*User{"alice": alice},
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	users := testUsers()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if users.FromRequest(req) != nil {
+		t.Error("Request without credentials shouldn't authenticate")
+	}
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:wrong")))
+	if users.FromRequest(req) != nil {
+		t.Error("Wrong password shouldn't authenticate")
+	}
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	if user := users.FromRequest(req); user == nil || user.Name != "alice" {
+		t.Error("Right password should authenticate")
+	}
+	req.Header.Set("Proxy-Authorization", "basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	if users.FromRequest(req) == nil {
+		t.Error("Scheme should be case-insensitive")
+	}
+}
+
+func TestDailyCap(t *testing.T) {
+	user := testUsers().Users[0]
+	user.AddBytes(60)
+	if user.IsOverCap() {
+		t.Error("Shouldn't be over cap yet")
+	}
+	user.AddBytes(40)
+	if !user.IsOverCap() {
+		t.Error("Should be over cap")
+	}
+
+	// Simulate the next day
+	user.usage.Day = "2000-01-01"
+	if user.IsOverCap() {
+		t.Error("Cap should reset daily")
+	}
+	if usage := user.Usage(); usage.TotalBytes != 100 {
+		t.Errorf("Wrong total bytes: %d", usage.TotalBytes)
+	}
+}
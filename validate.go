@@ -0,0 +1,432 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/getlantern/flashlight/acmecert"
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/blocklist"
+	"github.com/getlantern/flashlight/clientauth"
+	"github.com/getlantern/flashlight/ddns"
+	"github.com/getlantern/flashlight/egress"
+	"github.com/getlantern/flashlight/geolookup"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/remoteconfig"
+	"github.com/getlantern/flashlight/rules"
+	"github.com/getlantern/flashlight/store"
+	"github.com/getlantern/flashlight/tenants"
+	"github.com/getlantern/flashlight/users"
+)
+
+// problem is something wrong with the command-line flags
+type problem struct {
+	flag       string // the flag with the problem, e.g. "rules"
+	message    string // what's wrong
+	suggestion string // (optional) how to fix it
+}
+
+// problems is a list of problems
+type problems []*problem
+
+// add adds a problem with the given flag, suggestion and formatted message
+func (ps *problems) add(flag string, suggestion string, msg string, args ...interface{}) {
+	*ps = append(*ps, &problem{flag, fmt.Sprintf(msg, args...), suggestion})
+}
+
+func (p *problem) String() string {
+	s := fmt.Sprintf("-%s: %s", p.flag, p.message)
+	if p.suggestion != "" {
+		s += fmt.Sprintf(" (%s)", p.suggestion)
+	}
+	return s
+}
+
+// validateFlags checks the command-line flags and the files that they point
+// to, returning all problems found rather than stopping at the first one, so
+// that a bad configuration can be fixed in one go before anything starts
+// listening.
+func validateFlags() problems {
+	var found problems
+
+	if *addr == "" {
+		found.add("addr", "e.g. -addr 127.0.0.1:8787", "required")
+	} else if _, _, err := net.SplitHostPort(*addr); err != nil {
+		found.add("addr", "use ip:port, with IPv6 addresses in brackets", "invalid address %s", *addr)
+	}
+	roles := splitList(*role)
+	for _, r := range roles {
+		if r != "server" && r != "client" {
+			found.add("role", "use 'client', 'server' or 'client,server'", "invalid role '%s'", r)
+		}
+	}
+	if len(roles) == 0 || len(roles) > 2 || (len(roles) == 2 && !isClientAndServer()) {
+		found.add("role", "use 'client', 'server' or 'client,server'", "invalid role '%s'", *role)
+	}
+	if *upstreamHost == "" {
+		found.add("server", "e.g. -server proxy.example.com", "required")
+	}
+	if *ipVersion != "auto" && *ipVersion != "4" && *ipVersion != "6" {
+		found.add("ipversion", "use '4', '6' or 'auto'", "invalid ipversion %s", *ipVersion)
+	}
+	for _, name := range splitList(*protocolNames) {
+		if name != "cloudflare" && name != "azure" {
+			found.add("protocol", "use 'cloudflare' and/or 'azure'", "unknown protocol %s", name)
+		}
+	}
+	if *balance != protocol.BALANCE_ROUND_ROBIN && *balance != protocol.BALANCE_LATENCY {
+		found.add("balance", "use 'roundrobin' or 'latency'", "unknown strategy %s", *balance)
+	}
+	if *parallelDials < 1 {
+		found.add("paralleldials", "use at least 1", "invalid number of parallel dials %d", *parallelDials)
+	}
+	if *bufferSize < 0 {
+		found.add("buffersize", "use 0 for the default", "invalid buffer size %d", *bufferSize)
+	}
+	if *statsdAddr != "" {
+		if _, _, err := net.SplitHostPort(*statsdAddr); err != nil {
+			found.add("statsd", "use host:port, e.g. localhost:8125", "invalid address %s", *statsdAddr)
+		}
+	}
+	if *influxURL != "" {
+		u, err := url.Parse(*influxURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") || u.Host == "" {
+			found.add("influx", "use an http(s) write URL or udp://host:port", "invalid URL %s", *influxURL)
+		}
+	}
+	if *metricsInterval <= 0 {
+		found.add("metricsinterval", "e.g. -metricsinterval 10s", "must be positive")
+	}
+	if *traceEndpoint != "" {
+		u, err := url.Parse(*traceEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			found.add("otlp", "use an http(s) URL, e.g. http://localhost:4318/v1/traces", "invalid URL %s", *traceEndpoint)
+		}
+	}
+	if *traceSampleRate < 0 || *traceSampleRate > 1 {
+		found.add("tracesample", "e.g. -tracesample 0.01 for 1% of requests", "must be between 0 and 1, got %v", *traceSampleRate)
+	}
+	for _, cert := range []struct{ name, filename string }{{"rootca", *rootCA}, {"hoprootca", *hopRootCA}, {"masqueradeca", *masqueradeCA}} {
+		if cert.filename == "" {
+			continue
+		}
+		if _, err := os.Stat(cert.filename); err != nil {
+			found.add(cert.name, "specify the path of a PEM file", "%s", err)
+		}
+	}
+
+	if *storeKey != "" {
+		if *storePassphrase != "" {
+			found.add("storekey", "remove -storepassphrase", "can't be combined with -storepassphrase")
+		}
+		if *storeKey != store.KEYSTORE_SOURCE {
+			// file and env sources are cheap to check, unlike the keystore,
+			// which may prompt the user
+			if _, err := store.Passphrase(*storeKey, ""); err != nil {
+				found.add("storekey", "use file:<path>, env:<name> or keystore", "%s", err)
+			}
+		}
+	}
+
+	if *clientCertFile != "" {
+		if _, err := clientauth.LoadClientCert(*clientCertFile); err != nil {
+			found.add("clientcert", "use the output of -issueclientcert", "%s", err)
+		} else if *masqueradeAs != "" {
+			found.add("clientcert", "dial the server directly, without -masquerade", "fronts terminate TLS, so the server never sees the certificate")
+		}
+	}
+	if *clientAllowlist != "" {
+		if !*requireClientCert {
+			found.add("clientallowlist", "add -requireclientcert", "only applies with -requireclientcert")
+		} else if _, err := clientauth.LoadAllowlist(*clientAllowlist); err != nil {
+			found.add("clientallowlist", "specify a file with one client name per line", "%s", err)
+		}
+	}
+	if *clientCertValidity <= 0 {
+		found.add("clientcertvalidity", "e.g. -clientcertvalidity 8760h", "must be positive")
+	}
+	if _, err := serverPins(); err != nil {
+		found.add("servercertfingerprint", "use the fingerprint that the server logs when it starts", "%s", err)
+	}
+
+	// Flags that don't apply to our role(s) are most likely a mistake
+	flag.Visit(func(f *flag.Flag) {
+		if !hasRole("server") && strings.HasPrefix(f.Usage, "(server only)") {
+			found.add(f.Name, "remove it or run with -role server", "only applies to servers")
+		} else if !hasRole("client") && strings.HasPrefix(f.Usage, "(client only") {
+			found.add(f.Name, "remove it or run with -role client", "only applies to clients")
+		} else if !isClientAndServer() && strings.HasPrefix(f.Usage, "(client and server only)") {
+			found.add(f.Name, "remove it or run with -role client,server", "only applies when running both roles")
+		}
+	})
+
+	if hasRole("client") {
+		found = append(found, validateClientFlags()...)
+	}
+	if hasRole("server") {
+		found = append(found, validateServerFlags()...)
+	}
+	return found
+}
+
+func validateClientFlags() problems {
+	var found problems
+
+	if isClientAndServer() {
+		if *clientAddrFlag == "" {
+			found.add("clientaddr", "e.g. -clientaddr 127.0.0.1:8787", "required when running both roles")
+		} else if _, _, err := net.SplitHostPort(*clientAddrFlag); err != nil {
+			found.add("clientaddr", "use ip:port, with IPv6 addresses in brackets", "invalid address %s", *clientAddrFlag)
+		} else if *clientAddrFlag == *addr {
+			found.add("clientaddr", "use a different address than -addr", "already used by the server")
+		}
+		if *clientServerFlag == "" {
+			found.add("clientservers", "e.g. -clientservers proxy.example.com", "required when running both roles")
+		}
+	}
+
+	if *proxyApps != "" && transparentPort() == 0 {
+		found.add("proxyapps", "also specify -transparentaddr", "requires a transparent proxy to redirect to")
+	}
+	if *tproxy && *transparentAddr == "" {
+		found.add("tproxy", "also specify -transparentaddr", "requires a transparent proxy")
+	}
+	if *drainTimeout < 0 {
+		found.add("draintimeout", "use 0 for the default", "must not be negative")
+	}
+	if _, err := proxy.ParseListeners(splitList(*listenerSpecs)); err != nil {
+		found.add("listeners", "e.g. -listeners admin=127.0.0.1:7070,socks=127.0.0.1:1081", "%s", err)
+	}
+	if *canaryURL != "" {
+		if _, err := protocol.NewCanary(*canaryURL, *canarySHA256); err != nil {
+			found.add("canary", "use a plain http URL and its content's SHA-256 in -canarysha256", "%s", err)
+		}
+		if *probeInterval <= 0 {
+			found.add("canary", "also specify a positive -probeinterval", "is only checked when probing")
+		}
+	}
+	if *selfTestInterval < 0 {
+		found.add("selftest", "use 0 to disable self-tests", "must not be negative")
+	}
+	if *selfTestInterval > 0 && *probeInterval <= 0 {
+		found.add("selftest", "also specify a positive -probeinterval", "tests the servers that are probed")
+	}
+	if err := loggingConfig().Validate(); err != nil {
+		found.add("loglevel", "e.g. -loglevel error,proxy=debug -logformat json", "%s", err)
+	}
+	if *accessLogFormat != proxy.ACCESS_LOG_COMMON && *accessLogFormat != proxy.ACCESS_LOG_COMBINED {
+		found.add("accesslogformat", "use common or combined", "unknown format %s", *accessLogFormat)
+	}
+	if *healthPath != "" && !strings.HasPrefix(*healthPath, "/") {
+		found.add("healthpath", "e.g. /healthz", "invalid path %s", *healthPath)
+	}
+	if *healthOrigin != "" {
+		if _, _, err := net.SplitHostPort(*healthOrigin); err != nil {
+			found.add("healthorigin", "use host:port, e.g. www.google.com:443", "invalid address %s", *healthOrigin)
+		}
+		if *healthPath == "" {
+			found.add("healthorigin", "also specify -healthpath", "is only checked by health checks")
+		}
+	}
+	if *logMaxSize < 1 {
+		found.add("logmaxsize", "use at least 1", "invalid size %d MB", *logMaxSize)
+	}
+	if *shipLogsURL != "" {
+		if u, err := url.Parse(*shipLogsURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			found.add("shiplogs", "use an http(s) URL", "invalid URL %s", *shipLogsURL)
+		}
+		if *logDestinations {
+			found.add("shiplogs", "turn off -logdestinations", "would ship the destinations in error logs")
+		}
+	}
+	if *crashReportURL != "" {
+		if u, err := url.Parse(*crashReportURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			found.add("crashreport", "use an http(s) URL", "invalid URL %s", *crashReportURL)
+		}
+	}
+	if *shipLogsMax < 1 {
+		found.add("shiplogsmax", "use at least 1", "invalid number of errors %d", *shipLogsMax)
+	}
+	if *remoteConfigURL != "" {
+		if u, err := url.Parse(*remoteConfigURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			found.add("remoteconfig", "use an http(s) URL", "invalid URL %s", *remoteConfigURL)
+		}
+		if _, err := remoteconfig.ParsePublicKey(*remoteConfigKey); err != nil {
+			found.add("remoteconfigkey", "specify the base64-encoded public key with which the config is signed", "%s", err)
+		}
+	}
+	switch *serviceCmd {
+	case "", SERVICE_INSTALL, SERVICE_START, SERVICE_STOP, SERVICE_UNINSTALL:
+	default:
+		found.add("service", "use install, start, stop or uninstall", "unknown command %s", *serviceCmd)
+	}
+	if *serviceCmd != "" && runtime.GOOS != "windows" {
+		found.add("service", "use -install-systemd on Linux and -install-launchd on macOS", "is only supported on Windows")
+	}
+	if *installSystemd && runtime.GOOS != "linux" {
+		found.add("install-systemd", "use -install-launchd on macOS and -service on Windows", "is only supported on Linux")
+	}
+	if *installLaunchd && runtime.GOOS != "darwin" {
+		found.add("install-launchd", "use -install-systemd on Linux and -service on Windows", "is only supported on macOS")
+	}
+	if *installSystemd && *installLaunchd {
+		found.add("install-launchd", "specify one of -install-systemd and -install-launchd", "can't be combined with -install-systemd")
+	}
+	if (*installSystemd || *installLaunchd || *serviceCmd == SERVICE_INSTALL) && *showTray {
+		found.add("tray", "leave out -tray when installing a service", "services can't show a tray icon")
+	}
+	if *updateURL != "" {
+		if u, err := url.Parse(*updateURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			found.add("updateurl", "use an http(s) URL", "invalid URL %s", *updateURL)
+		}
+		if _, err := remoteconfig.ParsePublicKey(*updateKey); err != nil {
+			found.add("updatekey", "specify the base64-encoded public key with which the manifest is signed", "%s", err)
+		}
+		if version == "" {
+			found.add("updateurl", `build with -ldflags "-X main.version=<version>"`, "development builds don't update themselves")
+		}
+		if *updateInterval <= 0 {
+			found.add("updateinterval", "e.g. 12h", "must be positive")
+		}
+	}
+	if *cacheSize < 0 {
+		found.add("cachesize", "use 0 to disable caching", "invalid cache size %d", *cacheSize)
+	}
+	routesByCountry := false
+	if *rulesFile != "" {
+		if engine, err := rules.Load(*rulesFile); err != nil {
+			found.add("rules", "see package rules for the format", "%s", err)
+		} else {
+			routesByCountry = hasCountryRules(engine)
+		}
+	}
+	if *usersFile != "" {
+		if loaded, err := users.Load(*usersFile); err != nil {
+			found.add("users", "see package users for the format", "%s", err)
+		} else {
+			for _, user := range loaded.Users {
+				routesByCountry = routesByCountry || hasCountryRules(user.Rules)
+			}
+		}
+	}
+	if *countryDB != "" {
+		if _, err := geolookup.OpenCountryDatabase(*countryDB); err != nil {
+			found.add("countrydb", "download a MaxMind GeoLite2 Country database", "%s", err)
+		}
+	} else if routesByCountry {
+		found.add("countrydb", "download a MaxMind GeoLite2 Country database", "required for rules that route by country")
+	}
+	if *blocklistsFile != "" {
+		if _, err := blocklist.Load(*blocklistsFile); err != nil {
+			found.add("blocklists", "see package blocklist for the format", "%s", err)
+		}
+	}
+	return found
+}
+
+func validateServerFlags() problems {
+	var found problems
+
+	if _, err := protocol.ParseIPRanges(splitList(*frontRanges)); err != nil {
+		found.add("frontranges", "use CIDRs like 173.245.48.0/20", "%s", err)
+	}
+	if _, err := parseASNs(*egressASNs); err != nil {
+		found.add("egressasns", "use numbers like 15169 or AS15169", "%s", err)
+	}
+	if _, err := parseASNs(*excludeASNs); err != nil {
+		found.add("excludeasns", "use numbers like 15169 or AS15169", "%s", err)
+	}
+	if (*egressCountries != "" || *excludeCountries != "") && *countryDB == "" {
+		found.add("countrydb", "download a MaxMind GeoLite2 Country database", "required for -egresscountries and -excludecountries")
+	}
+	if (*egressASNs != "" || *excludeASNs != "") && *asnDB == "" {
+		found.add("asndb", "download a MaxMind GeoLite2 ASN database", "required for -egressasns and -excludeasns")
+	}
+	if _, err := egress.NewRouter(*egressRoutes, 0); err != nil {
+		found.add("egressroutes", "use domain=upstream entries", "%s", err)
+	}
+	if *authDecoy != "" {
+		if _, err := auth.NewDecoy(*authDecoy); err != nil {
+			found.add("authdecoy", "specify a URL (http:// or https://) or an HTML file", "%s", err)
+		} else if *authToken == "" {
+			found.add("authdecoy", "add -authtoken", "only applies with -authtoken")
+		}
+	}
+	if _, err := proxy.ParseIdlePolicy(*idleTimeouts); err != nil {
+		found.add("idletimeouts", "use class=duration entries, e.g. http=2m", "%s", err)
+	}
+	if *originIdleConns < 0 {
+		found.add("originidleconns", "use 0 to disable reuse", "must not be negative")
+	}
+	if *originIdleTime <= 0 {
+		found.add("originidletime", "e.g. 90s", "must be positive")
+	}
+	if err := proxy.CheckKeyParams(*keyType, *keySize); err != nil {
+		found.add("keysize", "e.g. -keytype ecdsa -keysize 256", "%s", err)
+	}
+	if *acmeChallenge != "" {
+		if *acmeChallenge != acmecert.HTTP_01 && *acmeChallenge != acmecert.DNS_01 {
+			found.add("acme", "use 'http-01' or 'dns-01'", "unknown challenge %s", *acmeChallenge)
+		} else if *acmeChallenge == acmecert.DNS_01 {
+			if _, err := acmeDNSProvider(); err != nil {
+				found.add("acmedns", "e.g. cloudflare://apitoken@zoneid", "%s", err)
+			}
+		}
+		if !hasRole("server") {
+			found.add("acme", "leave out -acme", "only applies to servers")
+		} else if net.ParseIP(*upstreamHost) != nil {
+			found.add("acme", "use a hostname for -server", "CAs don't issue certificates for IP addresses")
+		}
+		if u, err := url.Parse(*acmeDirectory); err != nil || u.Scheme != "https" || u.Host == "" {
+			found.add("acmedirectory", "use an https URL", "invalid URL %s", *acmeDirectory)
+		}
+	}
+	if *ddnsProvider != "" {
+		if _, err := ddns.ParseProvider(*ddnsProvider); err != nil {
+			found.add("ddns", "e.g. duckdns://token@duckdns.org", "%s", err)
+		}
+	}
+	for _, s := range splitList(*egressIPs) {
+		if net.ParseIP(s) == nil {
+			found.add("egressips", "use IP addresses assigned to this machine", "invalid IP %s", s)
+		}
+	}
+	if *tenantsFile != "" {
+		if loaded, err := tenants.Load(*tenantsFile); err != nil {
+			found.add("tenants", "see package tenants for the format", "%s", err)
+		} else if *countryDB == "" {
+			for _, tenant := range loaded.Tenants {
+				if tenant.EgressPolicy.RestrictsCountries() {
+					found.add("countrydb", "download a MaxMind GeoLite2 Country database", "required for tenant %s, which restricts egress by country", tenant.Name)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// hasCountryRules indicates whether any of the given engine's rules route by
+// country.  It is safe to call on a nil Engine.
+func hasCountryRules(engine *rules.Engine) bool {
+	for _, rule := range engine.Current() {
+		if rule.Country != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// printProblems prints the given problems to out
+func printProblems(out io.Writer, found problems) {
+	fmt.Fprintf(out, "Found %d problem(s) with the configuration:\n", len(found))
+	for _, p := range found {
+		fmt.Fprintf(out, "  %s\n", p)
+	}
+}
@@ -0,0 +1,120 @@
+// package webhook alerts a server's operator to significant events (a
+// certificate nearing expiry, a tenant using up its quota, our egress being
+// blocked or a spike in errors) by POSTing them as JSON to a URL of theirs, so
+// that small operators get alerted without running a monitoring stack.  For
+// example:
+//
+//	{
+//	  "event": "cert_expiring",
+//	  "server": "fl1.example.org",
+//	  "subject": "servercert.pem",
+//	  "time": "2015-03-01T12:00:00Z",
+//	  "text": "Certificate servercert.pem expires on 2015-03-20"
+//	}
+//
+// text is the human-readable message, under the name that Slack, Mattermost
+// and Rocket.Chat incoming webhooks expect, so that those can be used
+// directly.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	EVENT_CERT_EXPIRING    = "cert_expiring"    // a certificate that we use expires soon
+	EVENT_QUOTA_EXHAUSTED  = "quota_exhausted"  // a tenant used up its daily cap
+	EVENT_EGRESS_DEGRADED  = "egress_degraded"  // reference sites block or captcha-wall our egress IP
+	EVENT_ORIGIN_BLOCKED   = "origin_blocked"   // clients report that an origin blocks us
+	EVENT_ERROR_RATE_SPIKE = "error_rate_spike" // many dials to destinations are failing
+
+	DEFAULT_REPEAT_INTERVAL = 6 * time.Hour
+	POST_TIMEOUT            = 30 * time.Second
+)
+
+// Event is what's POSTed to the Notifier's URL
+type Event struct {
+	Event   string    `json:"event"`             // one of the EVENT_ constants
+	Server  string    `json:"server,omitempty"`  // the Notifier's Server
+	Subject string    `json:"subject,omitempty"` // what the event is about, e.g. the certificate or tenant
+	Time    time.Time `json:"time"`
+	Text    string    `json:"text"` // human-readable message
+}
+
+// Notifier POSTs Events to URL.  Repeats of an event about the same subject
+// are suppressed for RepeatInterval, so that ongoing problems don't flood the
+// operator.
+type Notifier struct {
+	URL            string        // where to POST Events
+	Server         string        // (optional) identifies this server in Events, e.g. its FQDN
+	RepeatInterval time.Duration // (optional) how long to suppress repeats, defaults to DEFAULT_REPEAT_INTERVAL
+
+	sent  map[string]time.Time
+	mutex sync.Mutex
+}
+
+// Notify POSTs an Event in the background, unless the same event about the
+// same subject was notified within RepeatInterval.  It is safe to call on a
+// nil Notifier.
+func (notifier *Notifier) Notify(event string, subject string, text string) {
+	if notifier == nil || !notifier.shouldSend(event, subject) {
+		return
+	}
+	log.Debugf("Notifying operator of %s: %s", event, text)
+	go func() {
+		err := notifier.post(&Event{
+			Event:   event,
+			Server:  notifier.Server,
+			Subject: subject,
+			Time:    time.Now(),
+			Text:    text,
+		})
+		if err != nil {
+			log.Errorf("Unable to notify operator of %s: %s", event, err)
+		}
+	}()
+}
+
+// shouldSend indicates whether the given event about the given subject is due,
+// noting that it's being sent if so
+func (notifier *Notifier) shouldSend(event string, subject string) bool {
+	repeatInterval := notifier.RepeatInterval
+	if repeatInterval <= 0 {
+		repeatInterval = DEFAULT_REPEAT_INTERVAL
+	}
+	key := event + " " + subject
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	if last, found := notifier.sent[key]; found && time.Now().Sub(last) < repeatInterval {
+		return false
+	}
+	if notifier.sent == nil {
+		notifier.sent = make(map[string]time.Time)
+	}
+	notifier.sent[key] = time.Now()
+	return true
+}
+
+func (notifier *Notifier) post(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Unable to encode event: %s", err)
+	}
+	client := &http.Client{Timeout: POST_TIMEOUT}
+	resp, err := client.Post(notifier.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to post event: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response status posting event: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	events := make(chan *Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		event := &Event{}
+		if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+			t.Errorf("Unable to decode event: %s", err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	notifier := &Notifier{URL: server.URL, Server: "fl1.example.org"}
+	notifier.Notify(EVENT_QUOTA_EXHAUSTED, "school", "Tenant school used up its daily cap")
+	notifier.Notify(EVENT_QUOTA_EXHAUSTED, "school", "Tenant school used up its daily cap")
+	notifier.Notify(EVENT_QUOTA_EXHAUSTED, "ngo", "Tenant ngo used up its daily cap")
+
+	subjects := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			if event.Event != EVENT_QUOTA_EXHAUSTED || event.Server != "fl1.example.org" || event.Text == "" {
+				t.Errorf("Unexpected event: %+v", event)
+			}
+			subjects[event.Subject] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 events")
+		}
+	}
+	if !subjects["school"] || !subjects["ngo"] {
+		t.Errorf("Expected an event for each tenant, got %v", subjects)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected repeat to be suppressed, got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var nilNotifier *Notifier
+	nilNotifier.Notify(EVENT_ORIGIN_BLOCKED, "", "")
+}
@@ -0,0 +1,85 @@
+// package wipe securely deletes files by overwriting their contents with
+// random data before removing them.  Note that on flash storage and
+// journaling or copy-on-write filesystems, old copies of the data may survive
+// the overwrite, so this is a best effort.
+package wipe
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	OVERWRITE_PASSES = 3
+	BUFFER_SIZE      = 64 * 1024
+)
+
+// Path wipes the file or directory (recursively) at the given path.  Wiping
+// something that doesn't exist is not an error.  Wiping continues past errors
+// so that as much as possible gets wiped, and the first error is returned.
+func Path(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to stat %s: %s", path, err)
+	}
+
+	var firstErr error
+	if info.IsDir() {
+		filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				err = overwrite(p, info.Size())
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			return nil
+		})
+	} else if info.Mode().IsRegular() {
+		firstErr = overwrite(path, info.Size())
+	}
+
+	if err := os.RemoveAll(path); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("Unable to remove %s: %s", path, err)
+	}
+	return firstErr
+}
+
+// overwrite overwrites the file at the given path with random data
+func overwrite(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to open %s for wiping: %s", path, err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, BUFFER_SIZE)
+	for i := 0; i < OVERWRITE_PASSES; i++ {
+		if _, err := f.Seek(0, 0); err != nil {
+			return fmt.Errorf("Unable to seek in %s: %s", path, err)
+		}
+		remaining := size
+		for remaining > 0 {
+			n := int64(len(buf))
+			if remaining < n {
+				n = remaining
+			}
+			if _, err := io.ReadFull(rand.Reader, buf[:n]); err != nil {
+				return fmt.Errorf("Unable to generate random data: %s", err)
+			}
+			if _, err := f.Write(buf[:n]); err != nil {
+				return fmt.Errorf("Unable to overwrite %s: %s", path, err)
+			}
+			remaining -= n
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("Unable to sync %s: %s", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package wipe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var secret = bytes.Repeat([]byte("secret "), 20000)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wipe")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	return dir
+}
+
+func writeSecret(t *testing.T, filename string) {
+	if err := ioutil.WriteFile(filename, secret, 0600); err != nil {
+		t.Fatalf("Unable to write %s: %s", filename, err)
+	}
+}
+
+func TestPathOverwritesAndRemoves(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	wiped := filepath.Join(dir, "wiped")
+	if err := os.MkdirAll(filepath.Join(wiped, "sub"), 0755); err != nil {
+		t.Fatalf("Unable to create dirs: %s", err)
+	}
+	filenames := []string{filepath.Join(wiped, "a"), filepath.Join(wiped, "sub", "b")}
+	for i, filename := range filenames {
+		writeSecret(t, filename)
+		// A hard link outside of the wiped dir lets us see what happened to
+		// the data after the file is removed
+		if err := os.Link(filename, filepath.Join(dir, fmt.Sprintf("link%d", i))); err != nil {
+			t.Fatalf("Unable to link %s: %s", filename, err)
+		}
+	}
+
+	if err := Path(wiped); err != nil {
+		t.Fatalf("Unable to wipe: %s", err)
+	}
+	if _, err := os.Lstat(wiped); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", wiped, err)
+	}
+	for i := range filenames {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("link%d", i)))
+		if err != nil {
+			t.Fatalf("Unable to read link: %s", err)
+		}
+		if len(data) != len(secret) {
+			t.Errorf("Wiped file changed size from %d to %d", len(secret), len(data))
+		}
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("%s not overwritten", filenames[i])
+		}
+	}
+}
+
+func TestPathDoesNotFollowSymlinks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	writeSecret(t, outside)
+	outsideDir := filepath.Join(dir, "outsidedir")
+	if err := os.Mkdir(outsideDir, 0755); err != nil {
+		t.Fatalf("Unable to create dir: %s", err)
+	}
+	writeSecret(t, filepath.Join(outsideDir, "c"))
+
+	wiped := filepath.Join(dir, "wiped")
+	if err := os.Mkdir(wiped, 0755); err != nil {
+		t.Fatalf("Unable to create dir: %s", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(wiped, "file")); err != nil {
+		t.Fatalf("Unable to symlink: %s", err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(wiped, "dir")); err != nil {
+		t.Fatalf("Unable to symlink: %s", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatalf("Unable to symlink: %s", err)
+	}
+
+	if err := Path(wiped); err != nil {
+		t.Fatalf("Unable to wipe: %s", err)
+	}
+	if err := Path(link); err != nil {
+		t.Fatalf("Unable to wipe: %s", err)
+	}
+	for _, path := range []string{wiped, link} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", path, err)
+		}
+	}
+	for _, filename := range []string{outside, filepath.Join(outsideDir, "c")} {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Symlink target %s removed: %s", filename, err)
+		}
+		if !bytes.Equal(data, secret) {
+			t.Errorf("Symlink target %s overwritten", filename)
+		}
+	}
+}
+
+func TestPathMissing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := Path(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("Wiping a missing path should succeed: %s", err)
+	}
+}